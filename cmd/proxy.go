@@ -52,7 +52,7 @@ func ProxyToRemote(ctx *cli.Context) error {
 		mongoHandler = handler.NewRecorder(reqStream, resStream, mongoHandler)
 	}
 
-	return startProxy(ctx, mongoHandler)
+	return startProxy(signalAwareContext(context.Background()), ctx, mongoHandler)
 }
 
 func makeRemoteMongoHandler(ctx *cli.Context) (proxy.RequestHandler, error) {
@@ -77,7 +77,7 @@ func makeRemoteMongoHandler(ctx *cli.Context) (proxy.RequestHandler, error) {
 	)
 }
 
-func startProxy(ctx *cli.Context, reqHandler proxy.RequestHandler) error {
+func startProxy(srvCtx context.Context, ctx *cli.Context, reqHandler proxy.RequestHandler) error {
 	var (
 		proxyTLSConf *tls.Config
 		err          error
@@ -99,7 +99,6 @@ func startProxy(ctx *cli.Context, reqHandler proxy.RequestHandler) error {
 		return err
 	}
 
-	srvCtx := signalAwareContext(context.Background())
 	return proxy.NewServer(proxyConf).Listen(srvCtx)
 }
 
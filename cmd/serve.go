@@ -1,6 +1,9 @@
 package cmd
 
 import (
+	"context"
+	"net"
+
 	"github.com/achilleasa/mongolite/emulator"
 	"github.com/achilleasa/mongolite/emulator/backend/dummy"
 	"golang.org/x/xerrors"
@@ -26,5 +29,55 @@ func EmulateServer(ctx *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	return startProxy(ctx, emu)
+
+	if ctx.Bool("enable-test-commands") {
+		srvLogger.Warn("enabling test commands")
+		emu.EnableTestCommands()
+	}
+
+	if ctx.Bool("auth") {
+		srvLogger.Info("enabling authentication")
+		emu.EnableAuth()
+	}
+
+	if err := emu.SetTTLMonitorSleepSecs(ctx.Int64("ttl-monitor-sleep-secs")); err != nil {
+		return err
+	}
+	if err := emu.SetBlockingMemoryLimit(ctx.Int64("blocking-memory-limit")); err != nil {
+		return err
+	}
+	if err := emu.SetTempDir(ctx.String("temp-dir")); err != nil {
+		return err
+	}
+	if err := emu.SetLogicalSessionTimeoutMinutes(ctx.Int64("logical-session-timeout-minutes")); err != nil {
+		return err
+	}
+	if replSet := ctx.String("replSet"); replSet != "" {
+		if err := emu.EnableReplicaSet(replSet, advertisedHost(ctx.String("listen-address"))); err != nil {
+			return err
+		}
+		if err := emu.SetOplogSizeMB(ctx.Int64("oplogSize")); err != nil {
+			return err
+		}
+	}
+
+	// The TTL monitor is stopped when the server context is cancelled.
+	srvCtx := signalAwareContext(context.Background())
+	go emu.RunTTLMonitor(srvCtx)
+
+	return startProxy(srvCtx, ctx, emu)
+}
+
+// advertisedHost returns the host:port that clients should use to reach a
+// server listening on listenAddr. Wildcard addresses are advertised as
+// localhost.
+func advertisedHost(listenAddr string) string {
+	host, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return listenAddr
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port)
 }
@@ -0,0 +1,436 @@
+package emulator
+
+import (
+	"fmt"
+	"math"
+	"sync/atomic"
+
+	"github.com/achilleasa/mongolite/emulator/aggregate"
+	"github.com/achilleasa/mongolite/emulator/filter"
+	"github.com/achilleasa/mongolite/emulator/index"
+	"github.com/achilleasa/mongolite/protocol"
+	"golang.org/x/xerrors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// AggregateOutputBackend is implemented by backends that can atomically store
+// the output of the $out and $merge aggregation stages (e.g. by applying all
+// writes within a single SQL transaction).
+//
+// When a backend does not implement this interface, the emulator falls back
+// to writing $out results to a temporary collection which is then renamed
+// over the target collection, and to writing $merge results as a single
+// ordered batch of upserts. If the backend implements TransactionBackend, the
+// upserts are applied within a transaction that is aborted if one of them
+// fails. Otherwise, the fallback for $merge is not atomic: if one of the
+// upserts fails (e.g. due to a unique index violation), the documents
+// preceding it remain written and the aggregation fails with the error of
+// the failed upsert.
+type AggregateOutputBackend interface {
+	Backend
+
+	// ReplaceCollection replaces the contents of col with docs, creating
+	// the collection if it does not exist. The indexes and options of an
+	// existing collection must be preserved. If the method fails, col must
+	// be left intact.
+	ReplaceCollection(clientID string, col protocol.NamespacedCollection, docs []bson.D) error
+
+	// UpsertDocuments inserts docs into col, replacing any existing
+	// documents with the same _id. Either all documents are written or
+	// none of them is.
+	UpsertDocuments(clientID string, col protocol.NamespacedCollection, docs []bson.D) error
+}
+
+// AggregateQueryBackend is implemented by backends that can evaluate the
+// leading stages of an aggregation pipeline natively (e.g. by compiling
+// them into a single SQL query).
+//
+// When a backend does not implement this interface, the emulator pushes down
+// the leading $match, $sort, $skip, $limit and $project stages as a query
+// request.
+type AggregateQueryBackend interface {
+	Backend
+
+	// CanPushDownQuery returns true if the backend is able to evaluate q
+	// against the documents in col.
+	CanPushDownQuery(col protocol.NamespacedCollection, q aggregate.Query) bool
+
+	// QueryAggregate returns the result of evaluating q against the
+	// documents in col.
+	QueryAggregate(clientID string, col protocol.NamespacedCollection, q aggregate.Query) ([]bson.D, error)
+}
+
+// defaultBatchSize is the number of documents returned in the first batch of
+// a cursor reply when the client does not specify a batch size.
+const defaultBatchSize = 101
+
+func (emu *MongoEmulator) handleAggregate(clientID string, r protocol.Request) (protocol.Response, error) {
+	req := r.(*protocol.AggregateRequest)
+	if req.Collection.Collection == "" {
+		return protocol.Response{}, protocol.ServerErrorf(protocol.CodeInvalidNamespace, "{aggregate: 1} is not valid for '%s'; a collection is required.", req.Collection.Database)
+	}
+
+	pipeline, err := aggregate.Parse(req.Pipeline)
+	if err != nil {
+		return protocol.Response{}, err
+	}
+
+	src := &backendSource{b: emu.b, emu: emu, clientID: clientID, origin: req}
+	env, err := aggregate.NewEnv(req.Collection, src, req.Let)
+	if err != nil {
+		return protocol.Response{}, err
+	}
+
+	if req.Explain {
+		return protocol.Response{
+			Documents: []bson.M{{"ok": 1, "stages": pipeline.Explain(env)}},
+		}, nil
+	}
+	env.Writer = src
+	env.AllowDiskUse = req.AllowDiskUse
+	env.MemoryLimit = atomic.LoadInt64(&emu.blockingMemoryLimit)
+	env.TempDir = emu.tempDir
+
+	docs, err := pipeline.Run(env)
+	if err != nil {
+		return protocol.Response{}, err
+	}
+
+	batchSize := int(req.BatchSize)
+	if batchSize == 0 {
+		batchSize = defaultBatchSize
+	}
+	return emu.newCursor(req.Collection, docs, batchSize), nil
+}
+
+// backendSource implements aggregate.Source and aggregate.Writer by issuing
+// requests against an emulator backend.
+type backendSource struct {
+	b        Backend
+	clientID string
+
+	// The emulator that executes the write requests of the source so
+	// that they are recorded in the oplog, maintain capped collections
+	// and wake up tailable cursors. Sources that only read leave it
+	// unset.
+	emu *MongoEmulator
+
+	// The client request on whose behalf the source issues requests. Its
+	// session and transaction arguments are attached to the issued
+	// requests.
+	origin protocol.Request
+}
+
+// requestInfo returns the RequestInfo for a request issued by the source.
+func (s *backendSource) requestInfo(reqType protocol.RequestType, replyType protocol.ReplyType) protocol.RequestInfo {
+	return derivedRequestInfo(s.origin, reqType, replyType)
+}
+
+// inTransaction returns true if the source issues requests on behalf of a
+// request that belongs to a multi-document transaction. The optional backend
+// interfaces do not receive the transaction arguments so they are bypassed
+// within transactions.
+func (s *backendSource) inTransaction() bool {
+	return s.origin != nil && inTransaction(s.origin)
+}
+
+// Find implements aggregate.Source. Queries that can be answered via one of
+// the indexes of an IndexScanBackend are served by scanning the index; other
+// queries are issued as a query request to the backend whose cursor is then
+// drained.
+func (s *backendSource) Find(col protocol.NamespacedCollection, query bson.M) ([]bson.D, error) {
+	if docs, scanned, err := s.scanIndex(col, query); scanned {
+		return docs, err
+	}
+
+	return s.query(&protocol.QueryRequest{
+		RequestInfo: s.requestInfo(protocol.RequestTypeQuery, protocol.ReplyTypeOpReply),
+		Collection:  col,
+		Query:       query,
+	})
+}
+
+// CanPushDown implements aggregate.QuerySource. Unless the backend implements
+// AggregateQueryBackend, only queries that can be expressed as a query
+// request (i.e. queries without a $group) are pushed down. Filters that can
+// be answered via an index scan are only pushed down on their own.
+func (s *backendSource) CanPushDown(col protocol.NamespacedCollection, q aggregate.Query) bool {
+	if qb, ok := s.b.(AggregateQueryBackend); ok && !s.inTransaction() {
+		return qb.CanPushDownQuery(col, q)
+	}
+	if _, plan, err := s.planQuery(col, q.Filter); err == nil && plan != nil {
+		return q.Sort == nil && q.Skip == 0 && q.Limit == 0 && q.Projection == nil && q.Group == nil
+	}
+	return q.Group == nil && q.Skip <= math.MaxInt32 && q.Limit <= math.MaxInt32
+}
+
+// Query implements aggregate.QuerySource.
+func (s *backendSource) Query(col protocol.NamespacedCollection, q aggregate.Query) ([]bson.D, error) {
+	if qb, ok := s.b.(AggregateQueryBackend); ok && !s.inTransaction() {
+		return qb.QueryAggregate(s.clientID, col, q)
+	}
+	if docs, scanned, err := s.scanIndex(col, q.Filter); scanned {
+		return docs, err
+	}
+
+	req := &protocol.QueryRequest{
+		RequestInfo: s.requestInfo(protocol.RequestTypeQuery, protocol.ReplyTypeOpReply),
+		Collection:  col,
+		Query:       q.Filter,
+		NumToSkip:   int32(q.Skip),
+		NumToReturn: int32(q.Limit),
+	}
+	for _, key := range q.Sort {
+		dir := 1
+		if key.Descending {
+			dir = -1
+		}
+		req.Sort = append(req.Sort, bson.DocElem{Name: key.Path, Value: dir})
+	}
+	if q.Projection != nil {
+		req.FieldSelector = q.Projection.Map()
+	}
+
+	docs, err := s.query(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Backends may treat the number of documents to return as the size
+	// of the first batch instead of a limit.
+	if q.Limit != 0 && int64(len(docs)) > q.Limit {
+		docs = docs[:q.Limit]
+	}
+	return docs, nil
+}
+
+// planQuery selects the index of an IndexScanBackend that can be used for
+// answering query. It returns a nil plan if the backend does not support index
+// scans, the source operates within a transaction or no index is usable.
+func (s *backendSource) planQuery(col protocol.NamespacedCollection, query bson.M) (IndexScanBackend, *index.Plan, error) {
+	isb, ok := s.b.(IndexScanBackend)
+	if !ok || s.inTransaction() || len(query) == 0 {
+		return nil, nil, nil
+	}
+
+	infos, err := isb.IndexInfo(s.clientID, col)
+	if err != nil {
+		if hasErrorCode(err, protocol.CodeNamespaceNotFound) {
+			return nil, nil, nil
+		}
+		return nil, nil, xerrors.Errorf("unable to list indexes for %q: %w", col.String(), err)
+	}
+	return isb, index.SelectIndex(query, infos), nil
+}
+
+// scanIndex returns the documents matching query by scanning the index that
+// planQuery selects for it. The scanned return value is false if no index can
+// be used and the caller must query the collection instead.
+func (s *backendSource) scanIndex(col protocol.NamespacedCollection, query bson.M) (docs []bson.D, scanned bool, err error) {
+	isb, plan, err := s.planQuery(col, query)
+	if err != nil {
+		return nil, true, err
+	} else if plan == nil {
+		return nil, false, nil
+	}
+
+	// Queries referencing variables cannot be compiled without their
+	// context; let the backend evaluate them instead.
+	matcher, err := filter.Compile(query)
+	if err != nil {
+		return nil, false, nil
+	}
+
+	candidates, err := isb.ScanIndex(s.clientID, col, plan)
+	if err != nil {
+		return nil, true, xerrors.Errorf("unable to scan index %q of %q: %w", plan.Index.Name, col.String(), err)
+	}
+	for _, doc := range candidates {
+		if matcher.Match(doc) {
+			docs = append(docs, doc)
+		}
+	}
+	return docs, true, nil
+}
+
+// query issues a query request to the backend and drains the returned cursor.
+// A nil query matches all documents.
+func (s *backendSource) query(req *protocol.QueryRequest) ([]bson.D, error) {
+	if req.Query == nil {
+		req.Query = bson.M{}
+	}
+
+	col := req.Collection
+	res, err := s.b.HandleRequest(s.clientID, req)
+	if err != nil {
+		if hasErrorCode(err, protocol.CodeNamespaceNotFound) {
+			return nil, nil
+		}
+		return nil, xerrors.Errorf("unable to query %q: %w", col.String(), err)
+	}
+
+	var docs []bson.D
+	for {
+		for _, doc := range res.Documents {
+			docs = append(docs, aggregate.ToDocument(doc))
+		}
+		if res.CursorID == 0 {
+			return docs, nil
+		}
+
+		if res, err = s.b.HandleRequest(s.clientID, protocol.GetMoreRequest{
+			RequestInfo: s.requestInfo(protocol.RequestTypeGetMore, protocol.ReplyTypeOpReply),
+			Collection:  col,
+			CursorID:    res.CursorID,
+		}); err != nil {
+			return nil, xerrors.Errorf("unable to fetch results for %q: %w", col.String(), err)
+		}
+	}
+}
+
+// ReplaceCollection implements aggregate.Writer.
+func (s *backendSource) ReplaceCollection(col protocol.NamespacedCollection, docs []bson.D) error {
+	if s.inTransaction() {
+		return protocol.ServerErrorf(protocol.CodeOperationNotSupportedInTransaction, "$out cannot be used in a transaction")
+	}
+	if ob, ok := s.b.(AggregateOutputBackend); ok {
+		return ob.ReplaceCollection(s.clientID, col, docs)
+	}
+
+	cb, ok := s.b.(CatalogBackend)
+	if !ok {
+		return xerrors.Errorf("replace collection %q: %w", col.String(), ErrUnsupportedRequest)
+	}
+
+	// Populate a temporary collection with the same indexes as the target
+	// and then atomically rename it over the target.
+	tmpCol := protocol.NamespacedCollection{
+		Database:   col.Database,
+		Collection: fmt.Sprintf("tmp.agg_out.%s", bson.NewObjectId().Hex()),
+	}
+	if err := s.populateTempCollection(cb, col, tmpCol, docs); err != nil {
+		_ = cb.DropCollection(s.clientID, tmpCol)
+		return err
+	}
+
+	renameReq := &protocol.RenameCollectionRequest{
+		RequestInfo: protocol.RequestInfo{RequestType: protocol.RequestTypeRenameCollection},
+		From:        tmpCol,
+		To:          col,
+		DropTarget:  true,
+	}
+	if err := cb.RenameCollection(s.clientID, renameReq); err != nil {
+		_ = cb.DropCollection(s.clientID, tmpCol)
+		return xerrors.Errorf("unable to replace %q: %w", col.String(), err)
+	}
+	if s.emu != nil {
+		s.emu.logCatalogChange(s.clientID, renameReq)
+		s.emu.capped.invalidate(renameReq)
+	}
+	return nil
+}
+
+func (s *backendSource) populateTempCollection(cb CatalogBackend, col, tmpCol protocol.NamespacedCollection, docs []bson.D) error {
+	err := cb.CreateCollection(s.clientID, &protocol.CreateRequest{
+		RequestInfo: protocol.RequestInfo{RequestType: protocol.RequestTypeCreate},
+		Collection:  tmpCol,
+	})
+	if err != nil {
+		return xerrors.Errorf("unable to create temporary collection for %q: %w", col.String(), err)
+	}
+
+	if ib, ok := s.b.(IndexBackend); ok {
+		specs, err := ib.ListIndexes(s.clientID, col)
+		if err != nil && !hasErrorCode(err, protocol.CodeNamespaceNotFound) {
+			return xerrors.Errorf("unable to list indexes for %q: %w", col.String(), err)
+		}
+
+		var toCopy []protocol.IndexSpec
+		for _, spec := range specs {
+			if spec.Name != "_id_" {
+				toCopy = append(toCopy, spec)
+			}
+		}
+		if len(toCopy) != 0 {
+			if _, err = ib.CreateIndexes(s.clientID, tmpCol, toCopy); err != nil {
+				return xerrors.Errorf("unable to copy indexes from %q: %w", col.String(), err)
+			}
+		}
+	}
+
+	if len(docs) == 0 {
+		return nil
+	}
+
+	inserts := make([]bson.M, len(docs))
+	for i, doc := range docs {
+		inserts[i] = doc.Map()
+	}
+	err = s.write(&protocol.InsertRequest{
+		RequestInfo: s.requestInfo(protocol.RequestTypeInsert, protocol.ReplyTypeOpMsg),
+		Collection:  tmpCol,
+		Inserts:     inserts,
+	})
+	if err != nil {
+		return xerrors.Errorf("unable to write documents for %q: %w", col.String(), err)
+	}
+	return nil
+}
+
+// WriteDocuments implements aggregate.Writer.
+func (s *backendSource) WriteDocuments(col protocol.NamespacedCollection, docs []bson.D) error {
+	if s.inTransaction() {
+		return protocol.ServerErrorf(protocol.CodeOperationNotSupportedInTransaction, "$merge cannot be used in a transaction")
+	}
+	if ob, ok := s.b.(AggregateOutputBackend); ok {
+		return ob.UpsertDocuments(s.clientID, col, docs)
+	}
+
+	updates := make([]protocol.UpdateTarget, len(docs))
+	for i, doc := range docs {
+		update := doc.Map()
+		updates[i] = protocol.UpdateTarget{
+			Selector: bson.M{"_id": update["_id"]},
+			Update:   update,
+			Flags:    protocol.UpdateFlagUpsert,
+		}
+	}
+
+	// The upserts are applied in order and the first failure reported by
+	// the backend fails the aggregation; see AggregateOutputBackend.
+	req := &protocol.UpdateRequest{
+		RequestInfo: s.requestInfo(protocol.RequestTypeUpdate, protocol.ReplyTypeOpMsg),
+		Collection:  col,
+		Updates:     updates,
+	}
+	var err error
+	if s.emu != nil {
+		err = s.emu.runInternalTxn(s.clientID, &req.RequestInfo, func() error {
+			return s.write(req)
+		})
+	} else {
+		err = s.write(req)
+	}
+	if err != nil {
+		return xerrors.Errorf("unable to write documents to %q: %w", col.String(), err)
+	}
+	return nil
+}
+
+// write executes a write request issued by the source and returns the first
+// failure reported via the writeErrors field of its reply.
+func (s *backendSource) write(req protocol.Request) error {
+	var (
+		res protocol.Response
+		err error
+	)
+	if s.emu != nil {
+		res, err = s.emu.handleWrite(s.clientID, req)
+	} else {
+		res, err = s.b.HandleRequest(s.clientID, req)
+	}
+	if err != nil {
+		return err
+	}
+	return replyWriteError(res)
+}
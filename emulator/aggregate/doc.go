@@ -0,0 +1,137 @@
+package aggregate
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ToDocument converts a document returned by a backend into the ordered
+// representation used by the pipeline engine. Since the field order of
+// unordered documents is not known, the _id field is placed first followed by
+// the remaining fields sorted by name. Embedded documents are converted
+// recursively.
+func ToDocument(doc interface{}) bson.D {
+	d, _ := toOrdered(doc).(bson.D)
+	return d
+}
+
+func toOrdered(v interface{}) interface{} {
+	switch val := v.(type) {
+	case bson.D:
+		out := make(bson.D, len(val))
+		for i, elem := range val {
+			out[i] = bson.DocElem{Name: elem.Name, Value: toOrdered(elem.Value)}
+		}
+		return out
+	case bson.M, map[string]interface{}, bson.RawD:
+		elems := bsonutil.Elements(val)
+		sort.SliceStable(elems, func(i, j int) bool { return elems[i].Name == "_id" && elems[j].Name != "_id" })
+		out := make(bson.D, len(elems))
+		for i, elem := range elems {
+			out[i] = bson.DocElem{Name: elem.Name, Value: toOrdered(elem.Value)}
+		}
+		return out
+	}
+
+	if bsonutil.IsArray(v) {
+		arr := bsonutil.ToArray(v)
+		out := make([]interface{}, len(arr))
+		for i, elem := range arr {
+			out[i] = toOrdered(elem)
+		}
+		return out
+	}
+	return v
+}
+
+// splitPath splits a dotted field path into its components.
+func splitPath(path string) []string {
+	return strings.Split(path, ".")
+}
+
+// getField returns the value of a top-level field in doc.
+func getField(doc bson.D, name string) (interface{}, bool) {
+	for _, elem := range doc {
+		if elem.Name == name {
+			return elem.Value, true
+		}
+	}
+	return nil, false
+}
+
+// setField returns a copy of doc where the named top-level field is set to v.
+// Existing fields retain their position while new fields are appended.
+func setField(doc bson.D, name string, v interface{}) bson.D {
+	out := make(bson.D, len(doc), len(doc)+1)
+	copy(out, doc)
+	for i := range out {
+		if out[i].Name == name {
+			out[i].Value = v
+			return out
+		}
+	}
+	return append(out, bson.DocElem{Name: name, Value: v})
+}
+
+// removeField returns a copy of doc without the named top-level field.
+func removeField(doc bson.D, name string) bson.D {
+	out := make(bson.D, 0, len(doc))
+	for _, elem := range doc {
+		if elem.Name != name {
+			out = append(out, elem)
+		}
+	}
+	return out
+}
+
+// setPath returns a copy of doc where the dotted field path is set to v.
+// Missing or non-document intermediate values are replaced by embedded
+// documents.
+func setPath(doc bson.D, path []string, v interface{}) bson.D {
+	if len(path) == 1 {
+		return setField(doc, path[0], v)
+	}
+
+	cur, _ := getField(doc, path[0])
+	sub, isDoc := cur.(bson.D)
+	if !isDoc {
+		if bsonutil.IsDocument(cur) {
+			sub = ToDocument(cur)
+		} else {
+			sub = bson.D{}
+		}
+	}
+	return setField(doc, path[0], setPath(sub, path[1:], v))
+}
+
+// removePath returns a copy of doc without the dotted field path. Arrays in
+// the path are traversed and the field is removed from each one of their
+// embedded documents.
+func removePath(doc bson.D, path []string) bson.D {
+	if len(path) == 1 {
+		return removeField(doc, path[0])
+	}
+
+	cur, found := getField(doc, path[0])
+	if !found {
+		return doc
+	}
+	return setField(doc, path[0], removePathFromValue(cur, path[1:]))
+}
+
+func removePathFromValue(v interface{}, path []string) interface{} {
+	if bsonutil.IsArray(v) {
+		arr := bsonutil.ToArray(v)
+		out := make([]interface{}, len(arr))
+		for i, elem := range arr {
+			out[i] = removePathFromValue(elem, path)
+		}
+		return out
+	} else if bsonutil.IsDocument(v) {
+		return removePath(ToDocument(v), path)
+	}
+	return v
+}
@@ -0,0 +1,108 @@
+package aggregate
+
+import (
+	"time"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/protocol"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// DefaultMemoryLimit is the maximum number of bytes that a blocking stage
+// (e.g. $sort or $group) may use unless the pipeline allows disk use.
+const DefaultMemoryLimit = 100 * 1024 * 1024
+
+// maxDocumentSize is the maximum size of a BSON document.
+const maxDocumentSize = 16 * 1024 * 1024
+
+// memoryLimitErrorFn returns the error reported by a blocking stage when it
+// exceeds the memory limit.
+type memoryLimitErrorFn func(limit int64) error
+
+func sortMemoryLimitError(limit int64) error {
+	return protocol.ServerErrorf(protocol.CodeQueryExceededMemoryLimitNoDiskUseAllowed, "Sort exceeded memory limit of %d bytes, but did not opt in to external sorting. Aborting operation. Pass allowDiskUse:true to opt in.", limit)
+}
+
+func groupMemoryLimitError(int64) error {
+	return protocol.ServerErrorf(protocol.CodeQueryExceededMemoryLimitNoDiskUseAllowed, "Exceeded memory limit for $group, but didn't allow external sort. Pass allowDiskUse:true to opt in.")
+}
+
+// memoryTracker keeps track of the approximate amount of memory retained by a
+// blocking stage.
+type memoryTracker struct {
+	used    int64
+	limit   int64
+	errorFn memoryLimitErrorFn
+
+	// Set if the stage may exceed the limit by spilling data to disk.
+	canSpill bool
+}
+
+// newMemoryTracker returns a memoryTracker for a blocking stage. If the
+// pipeline allows disk use, exceeding the limit is not an error; stages that
+// support spilling use shouldSpill to decide when to write their state to
+// disk while the remaining stages keep their state in memory.
+func (env *Env) newMemoryTracker(errorFn memoryLimitErrorFn) *memoryTracker {
+	return &memoryTracker{limit: env.MemoryLimit, errorFn: errorFn, canSpill: env.AllowDiskUse}
+}
+
+// add records that v is retained by the stage. It returns an error if the
+// stage exceeds its memory limit and may not spill to disk.
+func (t *memoryTracker) add(v interface{}) error {
+	t.used += approxSize(v)
+	if t.exceeded() && !t.canSpill {
+		return t.errorFn(t.limit)
+	}
+	return nil
+}
+
+// shouldSpill returns true if the stage exceeds its memory limit and may
+// spill its state to disk.
+func (t *memoryTracker) shouldSpill() bool {
+	return t.canSpill && t.exceeded()
+}
+
+// reset records that the stage has released all retained values (e.g.
+// after spilling them to disk).
+func (t *memoryTracker) reset() {
+	t.used = 0
+}
+
+func (t *memoryTracker) exceeded() bool {
+	return t.limit > 0 && t.used > t.limit
+}
+
+// approxSize returns the approximate BSON size of a value.
+func approxSize(v interface{}) int64 {
+	switch val := v.(type) {
+	case nil, bool:
+		return 1
+	case int, int32:
+		return 4
+	case int64, float64, float32, time.Time, bson.MongoTimestamp:
+		return 8
+	case string:
+		return int64(len(val)) + 5
+	case bson.ObjectId:
+		return 12
+	case bson.Decimal128:
+		return 16
+	case []byte:
+		return int64(len(val)) + 5
+	case bson.Binary:
+		return int64(len(val.Data)) + 5
+	}
+
+	var size int64 = 5
+	switch {
+	case bsonutil.IsDocument(v):
+		for _, elem := range bsonutil.Elements(v) {
+			size += int64(len(elem.Name)) + 2 + approxSize(elem.Value)
+		}
+	case bsonutil.IsArray(v):
+		for _, elem := range bsonutil.ToArray(v) {
+			size += 3 + approxSize(elem)
+		}
+	}
+	return size
+}
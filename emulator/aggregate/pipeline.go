@@ -0,0 +1,281 @@
+// Package aggregate implements an engine for executing mongo aggregation
+// pipelines over the documents provided by an emulator backend.
+//
+// See https://docs.mongodb.com/manual/core/aggregation-pipeline
+package aggregate
+
+import (
+	"time"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/emulator/expr"
+	"github.com/achilleasa/mongolite/protocol"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Source provides access to the documents of the collections referenced by a
+// pipeline.
+type Source interface {
+	// Find returns the documents in col that match the provided query. If
+	// the collection does not exist, Find returns an empty list.
+	Find(col protocol.NamespacedCollection, query bson.M) ([]bson.D, error)
+}
+
+// Writer stores the output of the $out and $merge stages.
+type Writer interface {
+	// ReplaceCollection replaces the contents of col with docs, creating
+	// the collection if it does not exist. The replacement must be atomic;
+	// if it fails, the original contents of col must be left intact.
+	ReplaceCollection(col protocol.NamespacedCollection, docs []bson.D) error
+
+	// WriteDocuments inserts docs into col, replacing any existing
+	// documents with the same _id. Implementations should write either
+	// all documents or none of them; those that cannot do so must write
+	// the documents in order and stop at the first failure.
+	WriteDocuments(col protocol.NamespacedCollection, docs []bson.D) error
+}
+
+// Env describes the environment for executing a pipeline.
+type Env struct {
+	// The namespace of the aggregated collection.
+	Namespace protocol.NamespacedCollection
+
+	// The source for the documents of the aggregated collection and any
+	// other collection referenced by the pipeline stages.
+	Source Source
+
+	// The destination for the output of $out and $merge stages. If nil,
+	// pipelines with such stages fail.
+	Writer Writer
+
+	// The variables that are visible to stage expressions. It includes
+	// the variables specified via the let option of the aggregate
+	// command and system variables such as $$NOW.
+	Vars *expr.Vars
+
+	// True if blocking stages may write temporary data to disk.
+	AllowDiskUse bool
+
+	// The maximum number of bytes that each blocking stage may keep in
+	// memory. When AllowDiskUse is false, stages that exceed the limit
+	// fail; otherwise, $sort and $group spill their state to disk. A zero
+	// value disables the limit.
+	MemoryLimit int64
+
+	// The directory for the temporary files created when stages spill to
+	// disk. If empty, the default directory for temporary files is used.
+	TempDir string
+}
+
+// NewEnv returns an Env for running a pipeline against a collection. The let
+// argument specifies a list of user variables whose values are evaluated
+// once, when the environment is created.
+func NewEnv(ns protocol.NamespacedCollection, source Source, let bson.M) (*Env, error) {
+	vars := new(expr.Vars).With("NOW", time.Now().UTC().Truncate(time.Millisecond))
+
+	for name, spec := range let {
+		if err := expr.ValidateUserVariableName(name); err != nil {
+			return nil, err
+		}
+
+		e, err := expr.Compile(spec)
+		if err != nil {
+			return nil, err
+		}
+
+		v, err := e.Eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		vars = vars.With(name, expr.Value(v))
+	}
+
+	return &Env{
+		Namespace:   ns,
+		Source:      source,
+		Vars:        vars,
+		MemoryLimit: DefaultMemoryLimit,
+	}, nil
+}
+
+// withScope returns a copy of env for running a nested pipeline against the
+// ns collection using the provided variable scope.
+func (env *Env) withScope(ns protocol.NamespacedCollection, vars *expr.Vars) *Env {
+	child := *env
+	child.Namespace = ns
+	child.Vars = vars
+	return &child
+}
+
+// varsFor returns the variable scope for evaluating expressions against doc.
+func (env *Env) varsFor(doc interface{}) *expr.Vars {
+	return env.Vars.WithDocument(doc)
+}
+
+// stage is implemented by all pipeline stages.
+type stage interface {
+	// process applies the stage to a list of input documents and returns
+	// the list of output documents.
+	process(env *Env, docs []bson.D) ([]bson.D, error)
+}
+
+// stageParser parses the specification of a pipeline stage.
+type stageParser func(spec interface{}) (stage, error)
+
+// outputStages lists the stages that write the pipeline output to a
+// collection. They may only appear as the last stage of a top-level pipeline.
+var outputStages = map[string]bool{
+	"$out":   true,
+	"$merge": true,
+}
+
+// stageParsers maps stage names to their parsers. The map is populated by init
+// functions as some stages (e.g. $facet) need to parse nested pipelines.
+var stageParsers = map[string]stageParser{}
+
+func init() {
+	registerStages(map[string]stageParser{
+		"$match":           parseMatchStage,
+		"$project":         parseProjectStage,
+		"$addFields":       parseAddFieldsStage,
+		"$set":             parseAddFieldsStage,
+		"$unset":           parseUnsetStage,
+		"$group":           parseGroupStage,
+		"$sort":            parseSortStage,
+		"$limit":           parseLimitStage,
+		"$skip":            parseSkipStage,
+		"$unwind":          parseUnwindStage,
+		"$count":           parseCountStage,
+		"$lookup":          parseLookupStage,
+		"$graphLookup":     parseGraphLookupStage,
+		"$out":             parseOutStage,
+		"$merge":           parseMergeStage,
+		"$facet":           parseFacetStage,
+		"$bucket":          parseBucketStage,
+		"$bucketAuto":      parseBucketAutoStage,
+		"$sortByCount":     parseSortByCountStage,
+		"$sample":          parseSampleStage,
+		"$replaceRoot":     parseReplaceRootStage,
+		"$replaceWith":     parseReplaceWithStage,
+		"$setWindowFields": parseSetWindowFieldsStage,
+	})
+}
+
+func registerStages(parsers map[string]stageParser) {
+	for name, parser := range parsers {
+		stageParsers[name] = parser
+	}
+}
+
+// Pipeline is a parsed aggregation pipeline.
+type Pipeline struct {
+	specs  []bson.D
+	stages []stage
+}
+
+// Parse validates a list of stage specifications and returns a Pipeline.
+func Parse(specs []bson.D) (*Pipeline, error) {
+	p := &Pipeline{specs: specs}
+	for i, spec := range specs {
+		if len(spec) != 1 {
+			return nil, protocol.ServerErrorf(40323, "A pipeline stage specification object must contain exactly one field.")
+		} else if outputStages[spec[0].Name] && i != len(specs)-1 {
+			return nil, protocol.ServerErrorf(40601, "%s can only be the final stage in the pipeline", spec[0].Name)
+		}
+
+		parser, found := stageParsers[spec[0].Name]
+		if !found {
+			return nil, protocol.ServerErrorf(40324, "Unrecognized pipeline stage name: '%s'", spec[0].Name)
+		}
+
+		s, err := parser(spec[0].Value)
+		if err != nil {
+			return nil, err
+		}
+		p.stages = append(p.stages, s)
+	}
+	return p, nil
+}
+
+// Stages returns the stage specifications for the pipeline.
+func (p *Pipeline) Stages() []bson.D {
+	return p.specs
+}
+
+// Run executes the pipeline against the documents of the collection specified
+// by env. If the source implements QuerySource, the leading stages of the
+// pipeline are pushed down to it.
+func (p *Pipeline) Run(env *Env) ([]bson.D, error) {
+	var (
+		q, pushed = p.pushDown(env)
+		docs      []bson.D
+		err       error
+	)
+	if pushed != 0 {
+		docs, err = env.Source.(QuerySource).Query(env.Namespace, q)
+	} else {
+		docs, err = env.Source.Find(env.Namespace, bson.M{})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return processStages(env, p.stages[pushed:], docs)
+}
+
+// Explain returns a description of how the pipeline is executed against the
+// collection specified by env. Stages that are pushed down to the source are
+// reported as part of a leading $cursor stage.
+func (p *Pipeline) Explain(env *Env) []interface{} {
+	_, pushed := p.pushDown(env)
+
+	var stages []interface{}
+	if pushed != 0 {
+		pushedStages := make([]interface{}, pushed)
+		for i, spec := range p.specs[:pushed] {
+			pushedStages[i] = spec
+		}
+		stages = append(stages, bson.D{{Name: "$cursor", Value: bson.D{
+			{Name: "pushedDownStages", Value: pushedStages},
+		}}})
+	}
+	for _, spec := range p.specs[pushed:] {
+		stages = append(stages, spec)
+	}
+	return stages
+}
+
+// Process executes the pipeline using the provided documents as input.
+func (p *Pipeline) Process(env *Env, docs []bson.D) ([]bson.D, error) {
+	return processStages(env, p.stages, docs)
+}
+
+func processStages(env *Env, stages []stage, docs []bson.D) ([]bson.D, error) {
+	var err error
+	for _, s := range stages {
+		if docs, err = s.process(env, docs); err != nil {
+			return nil, err
+		}
+	}
+	return docs, nil
+}
+
+// parseNestedPipeline parses the pipeline specified by an option of a stage
+// such as $lookup or $facet.
+func parseNestedPipeline(spec interface{}) (*Pipeline, error) {
+	if !bsonutil.IsArray(spec) {
+		return nil, protocol.ServerErrorf(protocol.CodeTypeMismatch, "a pipeline must be specified as an array, got %s", bsonutil.TypeName(spec))
+	}
+
+	var specs []bson.D
+	for _, item := range bsonutil.ToArray(spec) {
+		if !bsonutil.IsDocument(item) {
+			return nil, protocol.ServerErrorf(protocol.CodeTypeMismatch, "each element of a pipeline must be an object, got %s", bsonutil.TypeName(item))
+		}
+		spec := ToDocument(item)
+		if len(spec) == 1 && outputStages[spec[0].Name] {
+			return nil, protocol.ServerErrorf(51047, "%s is not allowed within a nested pipeline", spec[0].Name)
+		}
+		specs = append(specs, spec)
+	}
+	return Parse(specs)
+}
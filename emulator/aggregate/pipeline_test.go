@@ -0,0 +1,192 @@
+package aggregate
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/achilleasa/mongolite/emulator/filter"
+	"github.com/achilleasa/mongolite/protocol"
+	"golang.org/x/xerrors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// testCol is the collection aggregated by tests.
+var testCol = protocol.NamespacedCollection{Database: "test", Collection: "col"}
+
+// memSource implements Source for in-memory collections keyed by namespace.
+type memSource map[string][]bson.M
+
+func (s memSource) Find(col protocol.NamespacedCollection, query bson.M) ([]bson.D, error) {
+	m, err := filter.Compile(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []bson.D
+	for _, doc := range s[col.String()] {
+		if m.Match(doc) {
+			docs = append(docs, ToDocument(doc))
+		}
+	}
+	return docs, nil
+}
+
+// pipelineSpec describes a pipeline together with its expected output. The
+// output is described by its fmt representation so that the field order of
+// the output documents is verified. If expErr is non-zero, the pipeline must
+// fail with that error code.
+type pipelineSpec struct {
+	descr    string
+	pipeline []bson.D
+	exp      string
+	expErr   protocol.ErrorCode
+}
+
+// runPipeline parses pipeline and runs it within env.
+func runPipeline(env *Env, pipeline []bson.D) ([]bson.D, error) {
+	p, err := Parse(pipeline)
+	if err != nil {
+		return nil, err
+	}
+	return p.Run(env)
+}
+
+// newTestEnv returns an environment for running pipelines against the test
+// collection of src.
+func newTestEnv(t *testing.T, src Source) *Env {
+	t.Helper()
+	env, err := NewEnv(testCol, src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+// errorCode returns the code of the server error wrapped by err or zero if
+// err does not wrap a server error.
+func errorCode(err error) protocol.ErrorCode {
+	var srvErr protocol.ServerError
+	if !xerrors.As(err, &srvErr) {
+		return 0
+	}
+	return srvErr.Code
+}
+
+// runPipelineSpecs runs each spec against the test collection of src.
+func runPipelineSpecs(t *testing.T, src Source, specs []pipelineSpec) {
+	t.Helper()
+	for _, spec := range specs {
+		t.Run(spec.descr, func(t *testing.T) {
+			got, err := runPipeline(newTestEnv(t, src), spec.pipeline)
+			if spec.expErr != 0 {
+				if errorCode(err) != spec.expErr {
+					t.Fatalf("expected error with code %d; got %v (output %v)", spec.expErr, err, got)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if fmt.Sprint(got) != spec.exp {
+				t.Fatalf("expected output\n%s\ngot\n%v", spec.exp, got)
+			}
+		})
+	}
+}
+
+func TestCoreStages(t *testing.T) {
+	src := memSource{testCol.String(): {
+		{"_id": 1, "cat": "a", "qty": 5, "tags": []interface{}{"x", "y"}},
+		{"_id": 2, "cat": "b", "qty": 2, "tags": []interface{}{}},
+		{"_id": 3, "cat": "a", "qty": 1},
+		{"_id": 4, "cat": "b", "qty": 7, "tags": []interface{}{"z"}},
+	}}
+
+	runPipelineSpecs(t, src, []pipelineSpec{
+		{
+			descr: "match, sort, skip and limit",
+			pipeline: []bson.D{
+				{{Name: "$match", Value: bson.M{"qty": bson.M{"$gt": 1}}}},
+				{{Name: "$sort", Value: bson.D{{Name: "qty", Value: -1}}}},
+				{{Name: "$skip", Value: 1}},
+				{{Name: "$limit", Value: 1}},
+				{{Name: "$project", Value: bson.M{"qty": 1}}},
+			},
+			exp: "[[{_id 1} {qty 5}]]",
+		},
+		{
+			descr: "project with expressions and _id exclusion",
+			pipeline: []bson.D{
+				{{Name: "$match", Value: bson.M{"_id": 1}}},
+				{{Name: "$project", Value: bson.D{
+					{Name: "_id", Value: 0},
+					{Name: "double", Value: bson.M{"$multiply": []interface{}{"$qty", 2}}},
+				}}},
+			},
+			exp: "[[{double 10}]]",
+		},
+		{
+			descr: "addFields appends and replaces fields",
+			pipeline: []bson.D{
+				{{Name: "$match", Value: bson.M{"_id": 3}}},
+				{{Name: "$addFields", Value: bson.D{
+					{Name: "cat", Value: "c"},
+					{Name: "total", Value: bson.M{"$add": []interface{}{"$qty", 10}}},
+				}}},
+			},
+			exp: "[[{_id 3} {cat c} {qty 1} {total 11}]]",
+		},
+		{
+			descr: "group with accumulators",
+			pipeline: []bson.D{
+				{{Name: "$group", Value: bson.D{
+					{Name: "_id", Value: "$cat"},
+					{Name: "total", Value: bson.M{"$sum": "$qty"}},
+					{Name: "avg", Value: bson.M{"$avg": "$qty"}},
+					{Name: "ids", Value: bson.M{"$push": "$_id"}},
+				}}},
+				{{Name: "$sort", Value: bson.M{"_id": 1}}},
+			},
+			exp: "[[{_id a} {total 6} {avg 3} {ids [1 3]}] [{_id b} {total 9} {avg 4.5} {ids [2 4]}]]",
+		},
+		{
+			descr: "unwind with array index",
+			pipeline: []bson.D{
+				{{Name: "$unwind", Value: bson.M{"path": "$tags", "includeArrayIndex": "idx"}}},
+				{{Name: "$project", Value: bson.D{{Name: "tags", Value: 1}, {Name: "idx", Value: 1}}}},
+			},
+			exp: "[[{_id 1} {tags x} {idx 0}] [{_id 1} {tags y} {idx 1}] [{_id 4} {tags z} {idx 0}]]",
+		},
+		{
+			descr: "unwind preserving missing and empty arrays",
+			pipeline: []bson.D{
+				{{Name: "$unwind", Value: bson.M{"path": "$tags", "preserveNullAndEmptyArrays": true}}},
+				{{Name: "$count", Value: "n"}},
+			},
+			exp: "[[{n 5}]]",
+		},
+		{
+			descr: "count of empty input produces no documents",
+			pipeline: []bson.D{
+				{{Name: "$match", Value: bson.M{"qty": bson.M{"$gt": 100}}}},
+				{{Name: "$count", Value: "n"}},
+			},
+			exp: "[]",
+		},
+		{
+			descr:    "negative limit",
+			pipeline: []bson.D{{{Name: "$limit", Value: -1}}},
+			expErr:   15958,
+		},
+		{
+			descr:    "group without _id",
+			pipeline: []bson.D{{{Name: "$group", Value: bson.M{"n": bson.M{"$sum": 1}}}}},
+			expErr:   15955,
+		},
+		{
+			descr:    "unknown stage",
+			pipeline: []bson.D{{{Name: "$bogus", Value: bson.M{}}}},
+			expErr:   40324,
+		},
+	})
+}
@@ -0,0 +1,207 @@
+package aggregate
+
+import (
+	"strings"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/protocol"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Query describes a prefix of a pipeline that is evaluated by a QuerySource
+// instead of the pipeline engine. The query operations are applied in the
+// order of the struct fields: the documents of the collection are filtered,
+// sorted, skipped, limited, projected and finally grouped.
+type Query struct {
+	// The query filter for selecting documents. A nil value matches all
+	// documents.
+	Filter bson.M
+
+	// The (optional) sort order for the matched documents.
+	Sort SortSpec
+
+	// The number of documents to skip and the maximum number of documents
+	// to return. A zero limit returns all documents.
+	Skip  int64
+	Limit int64
+
+	// An (optional) inclusion or exclusion projection. Only top-level
+	// fields are referenced by pushed down projections.
+	Projection bson.D
+
+	// An (optional) grouping of the matched documents.
+	Group *GroupQuery
+}
+
+// GroupQuery describes a $group stage whose key and accumulator arguments are
+// either constants or field paths (e.g. "$a.b").
+type GroupQuery struct {
+	// The group key; either a constant or a "$"-prefixed field path.
+	ID interface{}
+
+	// The output fields of each group.
+	Fields []GroupQueryField
+}
+
+// GroupQueryField describes an accumulator for a GroupQuery.
+type GroupQueryField struct {
+	Name string
+
+	// One of $sum, $avg, $min, $max, $first or $last.
+	Op string
+
+	// The accumulator argument; either a constant or a "$"-prefixed field
+	// path.
+	Arg interface{}
+}
+
+// QuerySource is implemented by sources that can evaluate the leading stages
+// of a pipeline natively (e.g. by compiling them into a single SQL query).
+// The pipeline engine pushes down as many stages as the source accepts and
+// evaluates the remaining stages itself.
+type QuerySource interface {
+	Source
+
+	// CanPushDown returns true if the source is able to evaluate q
+	// against the documents in col.
+	CanPushDown(col protocol.NamespacedCollection, q Query) bool
+
+	// Query returns the result of evaluating q against the documents in
+	// col. If the collection does not exist, Query returns an empty list.
+	Query(col protocol.NamespacedCollection, q Query) ([]bson.D, error)
+}
+
+// pushDown returns the query for the longest prefix of the pipeline that can
+// be evaluated by the pipeline source together with the number of stages in
+// that prefix.
+func (p *Pipeline) pushDown(env *Env) (Query, int) {
+	src, ok := env.Source.(QuerySource)
+	if !ok {
+		return Query{}, 0
+	}
+
+	var (
+		q      Query
+		pushed int
+	)
+	for i, s := range p.stages {
+		next, ok := extendQuery(q, s, p.specs[i])
+		if !ok || !src.CanPushDown(env.Namespace, next) {
+			break
+		}
+		q, pushed = next, i+1
+	}
+	return q, pushed
+}
+
+// extendQuery returns a copy of q that also applies stage s. It returns false
+// if the stage cannot be expressed as part of q.
+func extendQuery(q Query, s stage, spec bson.D) (Query, bool) {
+	// Grouping and projecting are the last operations of a query so no
+	// other stage may be pushed down after them.
+	if q.Group != nil || q.Projection != nil {
+		return q, false
+	}
+
+	switch s := s.(type) {
+	case *matchStage:
+		// Queries with $expr may reference pipeline variables which are
+		// not available to the source. Filtering after a skip or limit
+		// changes the set of selected documents.
+		if s.hasExpr || q.Skip != 0 || q.Limit != 0 {
+			return q, false
+		}
+		if q.Filter == nil {
+			q.Filter = s.matcher.Query()
+		} else {
+			q.Filter = bson.M{"$and": []interface{}{q.Filter, s.matcher.Query()}}
+		}
+	case *sortStage:
+		// A second sort uses the first one to break ties which cannot
+		// be expressed by a single sort specification.
+		if q.Sort != nil || q.Skip != 0 || q.Limit != 0 {
+			return q, false
+		}
+		q.Sort = s.spec
+	case *skipStage:
+		if q.Limit != 0 {
+			return q, false
+		}
+		q.Skip += s.skip
+	case *limitStage:
+		if q.Limit == 0 || s.limit < q.Limit {
+			q.Limit = s.limit
+		}
+	case *projectStage:
+		if spec[0].Name != "$project" || !isSimpleProjection(spec[0].Value) {
+			return q, false
+		}
+		q.Projection = ToDocument(spec[0].Value)
+	case *groupStage:
+		group, ok := simpleGroup(spec[0].Value)
+		if !ok {
+			return q, false
+		}
+		q.Group = group
+	default:
+		return q, false
+	}
+	return q, true
+}
+
+// isSimpleProjection returns true if spec only includes or excludes top-level
+// fields.
+func isSimpleProjection(spec interface{}) bool {
+	for _, elem := range bsonutil.Elements(spec) {
+		if strings.Contains(elem.Name, ".") {
+			return false
+		}
+		if _, isBool := elem.Value.(bool); !isBool && !bsonutil.IsNumber(elem.Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// simpleGroupOps lists the accumulators that can be pushed down as part of a
+// GroupQuery.
+var simpleGroupOps = map[string]bool{
+	"$sum":   true,
+	"$avg":   true,
+	"$min":   true,
+	"$max":   true,
+	"$first": true,
+	"$last":  true,
+}
+
+// simpleGroup converts a $group specification into a GroupQuery. It returns
+// false if the group key or any of the accumulators use expressions other
+// than constants and field paths.
+func simpleGroup(spec interface{}) (*GroupQuery, bool) {
+	g := new(GroupQuery)
+	for _, elem := range bsonutil.Elements(spec) {
+		if elem.Name == "_id" {
+			if !isFieldPathOrScalar(elem.Value) {
+				return nil, false
+			}
+			g.ID = elem.Value
+			continue
+		}
+
+		acc := bsonutil.Elements(elem.Value)
+		if len(acc) != 1 || !simpleGroupOps[acc[0].Name] || !isFieldPathOrScalar(acc[0].Value) {
+			return nil, false
+		}
+		g.Fields = append(g.Fields, GroupQueryField{Name: elem.Name, Op: acc[0].Name, Arg: acc[0].Value})
+	}
+	return g, true
+}
+
+// isFieldPathOrScalar returns true if v is a field path expression or a
+// constant that is neither a document nor an array.
+func isFieldPathOrScalar(v interface{}) bool {
+	if str, isString := v.(string); isString {
+		return !strings.HasPrefix(str, "$$")
+	}
+	return !bsonutil.IsDocument(v) && !bsonutil.IsArray(v)
+}
@@ -0,0 +1,199 @@
+package aggregate
+
+import (
+	"sort"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/protocol"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// SortKey describes a single field of a sort specification.
+type SortKey struct {
+	Path       string
+	Descending bool
+}
+
+// SortSpec is a parsed sort specification.
+type SortSpec []SortKey
+
+// ParseSort parses a sort specification (e.g. {a: 1, b: -1}).
+func ParseSort(spec interface{}) (SortSpec, error) {
+	if !bsonutil.IsDocument(spec) {
+		return nil, protocol.ServerErrorf(15973, "the $sort key specification must be an object")
+	}
+
+	elems := bsonutil.Elements(spec)
+	if len(elems) == 0 {
+		return nil, protocol.ServerErrorf(15976, "$sort stage must have at least one sort key")
+	}
+
+	keys := make(SortSpec, len(elems))
+	for i, elem := range elems {
+		if bsonutil.IsDocument(elem.Value) {
+			return nil, protocol.ServerErrorf(17312, "$meta is the only expression supported by $sort right now")
+		}
+
+		dir, isNum := bsonutil.ToInt64(elem.Value)
+		if !isNum || (dir != 1 && dir != -1) {
+			return nil, protocol.ServerErrorf(15975, "$sort key ordering must be 1 (for ascending) or -1 (for descending)")
+		}
+		keys[i] = SortKey{Path: elem.Name, Descending: dir == -1}
+	}
+	return keys, nil
+}
+
+// sortValue returns the value used for sorting doc by a key. If the path
+// resolves to an array, ascending sorts use its smallest element while
+// descending sorts use its largest element.
+func (k SortKey) sortValue(doc interface{}) interface{} {
+	var (
+		values   []interface{}
+		hasEmpty bool
+	)
+	for _, v := range bsonutil.LookupValues(doc, k.Path) {
+		if bsonutil.IsArray(v) {
+			arr := bsonutil.ToArray(v)
+			hasEmpty = hasEmpty || len(arr) == 0
+			values = append(values, arr...)
+			continue
+		}
+		values = append(values, v)
+	}
+
+	// Empty arrays are represented as undefined values which sort before
+	// any other value.
+	if hasEmpty && (!k.Descending || len(values) == 0) {
+		return bson.Undefined
+	}
+
+	var result interface{}
+	for i, v := range values {
+		if i == 0 {
+			result = v
+			continue
+		}
+		c := bsonutil.Compare(v, result)
+		if (k.Descending && c > 0) || (!k.Descending && c < 0) {
+			result = v
+		}
+	}
+	return result
+}
+
+// Compare compares two documents using the sort specification.
+func (s SortSpec) Compare(a, b interface{}) int {
+	for _, k := range s {
+		c := compareSortValues(k.sortValue(a), k.sortValue(b))
+		if k.Descending {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// compareSortValues compares two sort values. Undefined values (which
+// represent empty arrays) sort before null values.
+func compareSortValues(a, b interface{}) int {
+	aUndef, bUndef := a == bson.Undefined, b == bson.Undefined
+	switch {
+	case aUndef && bUndef:
+		return 0
+	case aUndef && bsonutil.IsNull(b):
+		return -1
+	case bUndef && bsonutil.IsNull(a):
+		return 1
+	}
+	return bsonutil.Compare(a, b)
+}
+
+// Sort sorts a list of documents using the sort specification. The sort is
+// stable.
+func (s SortSpec) Sort(docs []bson.D) {
+	// Pre-compute the sort values for each document.
+	type entry struct {
+		doc    bson.D
+		values []interface{}
+	}
+	entries := make([]entry, len(docs))
+	for i, doc := range docs {
+		entries[i].doc = doc
+		entries[i].values = make([]interface{}, len(s))
+		for j, k := range s {
+			entries[i].values[j] = k.sortValue(doc)
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		for k, key := range s {
+			c := compareSortValues(entries[i].values[k], entries[j].values[k])
+			if key.Descending {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+
+	for i := range entries {
+		docs[i] = entries[i].doc
+	}
+}
+
+// sortStage implements $sort.
+type sortStage struct {
+	spec SortSpec
+}
+
+func parseSortStage(spec interface{}) (stage, error) {
+	keys, err := ParseSort(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &sortStage{spec: keys}, nil
+}
+
+func (s *sortStage) process(env *Env, docs []bson.D) ([]bson.D, error) {
+	if env.AllowDiskUse {
+		return s.externalSort(env, docs)
+	}
+
+	mem := env.newMemoryTracker(sortMemoryLimitError)
+	for _, doc := range docs {
+		if err := mem.add(doc); err != nil {
+			return nil, err
+		}
+	}
+
+	out := append([]bson.D(nil), docs...)
+	s.spec.Sort(out)
+	return out, nil
+}
+
+// externalSort sorts docs by spilling sorted runs to disk whenever the stage
+// exceeds its memory limit.
+func (s *sortStage) externalSort(env *Env, docs []bson.D) ([]bson.D, error) {
+	sorter := env.newExternalSorter(func(a, b bson.D) int { return s.spec.Compare(a, b) }, sortMemoryLimitError)
+	defer sorter.close()
+
+	for _, doc := range docs {
+		if err := sorter.add(doc); err != nil {
+			return nil, err
+		}
+	}
+
+	out := make([]bson.D, 0, len(docs))
+	err := sorter.each(func(doc bson.D) error {
+		out = append(out, doc)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,201 @@
+package aggregate
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"golang.org/x/xerrors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// spillRun is a sorted list of documents that a blocking stage has written to
+// a temporary file.
+type spillRun struct {
+	f *os.File
+	r *bufio.Reader
+}
+
+// writeSpillRun writes docs to a new temporary file in env.TempDir and
+// returns a spillRun for reading them back.
+func (env *Env) writeSpillRun(docs []bson.D) (*spillRun, error) {
+	f, err := ioutil.TempFile(env.TempDir, "mongolite-spill-")
+	if err != nil {
+		return nil, xerrors.Errorf("unable to create spill file: %w", err)
+	}
+	run := &spillRun{f: f}
+
+	w := bufio.NewWriter(f)
+	for _, doc := range docs {
+		data, err := bson.Marshal(doc)
+		if err != nil {
+			run.close()
+			return nil, xerrors.Errorf("unable to encode spilled document: %w", err)
+		}
+		if _, err = w.Write(data); err != nil {
+			run.close()
+			return nil, xerrors.Errorf("unable to write spill file: %w", err)
+		}
+	}
+
+	if err = w.Flush(); err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		run.close()
+		return nil, xerrors.Errorf("unable to write spill file: %w", err)
+	}
+	run.r = bufio.NewReader(f)
+	return run, nil
+}
+
+// next returns the next document in the run. It returns false when all
+// documents have been read.
+func (r *spillRun) next() (bson.D, bool, error) {
+	var sizeBuf [4]byte
+	if _, err := io.ReadFull(r.r, sizeBuf[:]); err == io.EOF {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, xerrors.Errorf("unable to read spill file: %w", err)
+	}
+
+	data := make([]byte, binary.LittleEndian.Uint32(sizeBuf[:]))
+	copy(data, sizeBuf[:])
+	if _, err := io.ReadFull(r.r, data[len(sizeBuf):]); err != nil {
+		return nil, false, xerrors.Errorf("unable to read spill file: %w", err)
+	}
+
+	var doc bson.D
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return nil, false, xerrors.Errorf("unable to decode spilled document: %w", err)
+	}
+	return doc, true, nil
+}
+
+// close closes and removes the temporary file for the run.
+func (r *spillRun) close() {
+	_ = r.f.Close()
+	_ = os.Remove(r.f.Name())
+}
+
+// externalSorter sorts a list of documents that may exceed the memory limit
+// of a stage. When the limit is exceeded, the buffered documents are sorted
+// and written to disk as a run. The runs are merged once all documents have
+// been added. The sort is stable.
+type externalSorter struct {
+	env     *Env
+	mem     *memoryTracker
+	compare func(a, b bson.D) int
+
+	buf  []bson.D
+	runs []*spillRun
+}
+
+func (env *Env) newExternalSorter(compare func(a, b bson.D) int, errorFn memoryLimitErrorFn) *externalSorter {
+	return &externalSorter{
+		env:     env,
+		mem:     env.newMemoryTracker(errorFn),
+		compare: compare,
+	}
+}
+
+// add appends doc to the list of documents to be sorted.
+func (s *externalSorter) add(doc bson.D) error {
+	if err := s.mem.add(doc); err != nil {
+		return err
+	}
+	s.buf = append(s.buf, doc)
+	if !s.mem.shouldSpill() {
+		return nil
+	}
+
+	s.sortBuffer()
+	run, err := s.env.writeSpillRun(s.buf)
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, run)
+	s.buf = nil
+	s.mem.reset()
+	return nil
+}
+
+func (s *externalSorter) sortBuffer() {
+	sort.SliceStable(s.buf, func(i, j int) bool {
+		return s.compare(s.buf[i], s.buf[j]) < 0
+	})
+}
+
+// each invokes fn for each of the added documents in sort order and removes
+// any spilled runs.
+func (s *externalSorter) each(fn func(bson.D) error) error {
+	defer s.close()
+
+	s.sortBuffer()
+	if len(s.runs) == 0 {
+		for _, doc := range s.buf {
+			if err := fn(doc); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Merge the runs and the in-memory buffer which holds the most recent
+	// documents. Ties are resolved in favor of earlier runs so that the
+	// merge preserves the input order of equal documents.
+	var (
+		heads  = make([]bson.D, len(s.runs)+1)
+		hasDoc = make([]bool, len(s.runs)+1)
+		bufIdx int
+	)
+	advance := func(i int) error {
+		if i == len(s.runs) {
+			hasDoc[i] = bufIdx < len(s.buf)
+			if hasDoc[i] {
+				heads[i] = s.buf[bufIdx]
+				bufIdx++
+			}
+			return nil
+		}
+
+		var err error
+		heads[i], hasDoc[i], err = s.runs[i].next()
+		return err
+	}
+
+	for i := range heads {
+		if err := advance(i); err != nil {
+			return err
+		}
+	}
+	for {
+		min := -1
+		for i := range heads {
+			if hasDoc[i] && (min == -1 || s.compare(heads[i], heads[min]) < 0) {
+				min = i
+			}
+		}
+		if min == -1 {
+			return nil
+		}
+
+		if err := fn(heads[min]); err != nil {
+			return err
+		}
+		if err := advance(min); err != nil {
+			return err
+		}
+	}
+}
+
+// close removes any spilled runs.
+func (s *externalSorter) close() {
+	for _, run := range s.runs {
+		run.close()
+	}
+	s.runs = nil
+}
@@ -0,0 +1,77 @@
+package aggregate
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/achilleasa/mongolite/protocol"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestBlockingStagesSpillToDisk(t *testing.T) {
+	var docs []bson.M
+	for i := 0; i < 100; i++ {
+		docs = append(docs, bson.M{"_id": i, "k": (i * 37) % 100, "g": i % 3})
+	}
+	src := memSource{testCol.String(): docs}
+
+	specs := []struct {
+		descr    string
+		pipeline []bson.D
+		exp      string
+	}{
+		{
+			descr: "sort",
+			pipeline: []bson.D{
+				{{Name: "$sort", Value: bson.M{"k": -1}}},
+				{{Name: "$limit", Value: 3}},
+				{{Name: "$project", Value: bson.M{"k": 1}}},
+			},
+			exp: "[[{_id 27} {k 99}] [{_id 54} {k 98}] [{_id 81} {k 97}]]",
+		},
+		{
+			// Groups that are computed by spilling to disk are
+			// returned in the order of their keys.
+			descr: "group",
+			pipeline: []bson.D{
+				{{Name: "$group", Value: bson.M{"_id": "$g", "ids": bson.M{"$push": "$_id"}}}},
+				{{Name: "$project", Value: bson.M{"n": bson.M{"$size": "$ids"}}}},
+			},
+			exp: "[[{_id 0} {n 34}] [{_id 1} {n 33}] [{_id 2} {n 33}]]",
+		},
+	}
+
+	for _, spec := range specs {
+		t.Run(spec.descr, func(t *testing.T) {
+			env := newTestEnv(t, src)
+			env.MemoryLimit = 256
+
+			if _, err := runPipeline(env, spec.pipeline); errorCode(err) != protocol.CodeQueryExceededMemoryLimitNoDiskUseAllowed {
+				t.Fatalf("expected the memory limit to be exceeded without disk use; got %v", err)
+			}
+
+			env.AllowDiskUse = true
+			env.TempDir = t.TempDir()
+			got, err := runPipeline(env, spec.pipeline)
+			if err != nil {
+				t.Fatal(err)
+			} else if fmt.Sprint(got) != spec.exp {
+				t.Fatalf("expected output\n%s\ngot\n%v", spec.exp, got)
+			}
+			if files, err := ioutil.ReadDir(env.TempDir); err != nil {
+				t.Fatal(err)
+			} else if len(files) != 0 {
+				t.Fatalf("expected the spill files to be removed; got %d files", len(files))
+			}
+
+			// Stages that spill fail if the spill files cannot be
+			// created.
+			env.TempDir = filepath.Join(env.TempDir, "missing")
+			if _, err := runPipeline(env, spec.pipeline); err == nil {
+				t.Fatal("expected spilling to a missing directory to fail")
+			}
+		})
+	}
+}
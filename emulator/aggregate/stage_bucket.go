@@ -0,0 +1,524 @@
+package aggregate
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/emulator/expr"
+	"github.com/achilleasa/mongolite/protocol"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// isGroupByExpression returns true if spec is either a $-prefixed field path
+// or an expression object, which are the only forms accepted by the groupBy
+// option of the bucketing stages.
+func isGroupByExpression(spec interface{}) bool {
+	if path, isString := spec.(string); isString {
+		return strings.HasPrefix(path, "$")
+	}
+	elems := bsonutil.Elements(spec)
+	return bsonutil.IsDocument(spec) && len(elems) == 1 && strings.HasPrefix(elems[0].Name, "$")
+}
+
+// parseOutputFields parses the output option of the bucketing stages. If no
+// output is specified, the stages output a count field.
+func parseOutputFields(spec interface{}) ([]groupField, error) {
+	if spec == nil {
+		return []groupField{{name: "count", op: "$sum", arg: expr.MustCompile(1)}}, nil
+	}
+
+	fields := []groupField{}
+	for _, elem := range bsonutil.Elements(spec) {
+		f, err := parseGroupField(elem)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// bucketStage implements $bucket which groups documents into buckets defined
+// by a list of boundaries.
+type bucketStage struct {
+	groupBy    expr.Expr
+	boundaries []interface{}
+	fields     []groupField
+
+	defaultValue interface{}
+	hasDefault   bool
+}
+
+func parseBucketStage(spec interface{}) (stage, error) {
+	if !bsonutil.IsDocument(spec) {
+		return nil, protocol.ServerErrorf(40201, "Argument to $bucket stage must be an object, but found type: %s.", bsonutil.TypeName(spec))
+	}
+
+	var (
+		s          = new(bucketStage)
+		groupBy    interface{}
+		boundaries interface{}
+		output     interface{}
+	)
+	for _, elem := range bsonutil.Elements(spec) {
+		switch elem.Name {
+		case "groupBy":
+			groupBy = elem.Value
+		case "boundaries":
+			boundaries = elem.Value
+		case "default":
+			s.defaultValue, s.hasDefault = elem.Value, true
+		case "output":
+			if !bsonutil.IsDocument(elem.Value) {
+				return nil, protocol.ServerErrorf(40196, "The $bucket 'output' field must be an object, but found type: %s.", bsonutil.TypeName(elem.Value))
+			}
+			output = elem.Value
+		default:
+			return nil, protocol.ServerErrorf(40197, "Unrecognized option to $bucket: %s.", elem.Name)
+		}
+	}
+
+	if groupBy == nil || boundaries == nil {
+		return nil, protocol.ServerErrorf(40198, "$bucket requires 'groupBy' and 'boundaries' to be specified.")
+	} else if !isGroupByExpression(groupBy) {
+		return nil, protocol.ServerErrorf(40202, "The $bucket 'groupBy' field must be defined as a $-prefixed path or an expression, but found: %v.", groupBy)
+	}
+
+	var err error
+	if s.groupBy, err = expr.Compile(groupBy); err != nil {
+		return nil, err
+	}
+	if s.boundaries, err = parseBoundaries(boundaries); err != nil {
+		return nil, err
+	}
+	if s.fields, err = parseOutputFields(output); err != nil {
+		return nil, err
+	}
+
+	if s.hasDefault {
+		lowest, highest := s.boundaries[0], s.boundaries[len(s.boundaries)-1]
+		if bsonutil.SameTypeBracket(s.defaultValue, lowest) && bsonutil.Compare(s.defaultValue, lowest) >= 0 && bsonutil.Compare(s.defaultValue, highest) < 0 {
+			return nil, protocol.ServerErrorf(40199, "The $bucket 'default' field must be less than the lowest boundary or greater than or equal to the highest boundary.")
+		}
+	}
+	return s, nil
+}
+
+func parseBoundaries(spec interface{}) ([]interface{}, error) {
+	if !bsonutil.IsArray(spec) {
+		return nil, protocol.ServerErrorf(40200, "The $bucket 'boundaries' field must be an array, but found type: %s.", bsonutil.TypeName(spec))
+	}
+
+	boundaries := bsonutil.ToArray(spec)
+	if len(boundaries) < 2 {
+		return nil, protocol.ServerErrorf(40192, "The $bucket 'boundaries' field must have at least 2 values, but found %d value(s).", len(boundaries))
+	}
+
+	for i, v := range boundaries {
+		if bsonutil.IsDocument(v) && isGroupByExpression(v) {
+			return nil, protocol.ServerErrorf(40191, "The $bucket 'boundaries' field must be an array of constant values, but found value: %v.", v)
+		} else if i == 0 {
+			continue
+		}
+
+		prev := boundaries[i-1]
+		if !bsonutil.SameTypeBracket(prev, v) {
+			return nil, protocol.ServerErrorf(40193, "All values in the the 'boundaries' option to $bucket must have the same type. Found conflicting types %s and %s.", bsonutil.TypeName(prev), bsonutil.TypeName(v))
+		} else if bsonutil.Compare(prev, v) >= 0 {
+			return nil, protocol.ServerErrorf(40194, "The 'boundaries' option to $bucket must be sorted in ascending order, but elements %d and %d are not in ascending order (%v is not less than %v).", i-1, i, prev, v)
+		}
+	}
+	return boundaries, nil
+}
+
+func (s *bucketStage) process(env *Env, docs []bson.D) ([]bson.D, error) {
+	groups, err := groupDocuments(env, docs, s.fields, func(vars *expr.Vars) (interface{}, error) {
+		v, err := s.groupBy.Eval(vars)
+		if err != nil {
+			return nil, err
+		} else if expr.IsMissing(v) {
+			v = nil
+		}
+
+		// Buckets include their lower boundary and exclude their
+		// upper boundary.
+		idx := sort.Search(len(s.boundaries), func(i int) bool {
+			return bsonutil.Compare(s.boundaries[i], v) > 0
+		})
+		if idx > 0 && idx < len(s.boundaries) {
+			return s.boundaries[idx-1], nil
+		} else if s.hasDefault {
+			return s.defaultValue, nil
+		}
+		return nil, protocol.ServerErrorf(40066, "$switch could not find a matching branch for an input, and no default was specified.")
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	out := groupOutput(groups, s.fields)
+	SortSpec{{Path: "_id"}}.Sort(out)
+	return out, nil
+}
+
+// bucketAutoStage implements $bucketAuto which groups documents into a fixed
+// number of buckets with an approximately equal number of documents.
+type bucketAutoStage struct {
+	groupBy    expr.Expr
+	buckets    int
+	fields     []groupField
+	rounder    granularityRounder
+	hasRounder bool
+}
+
+func parseBucketAutoStage(spec interface{}) (stage, error) {
+	if !bsonutil.IsDocument(spec) {
+		return nil, protocol.ServerErrorf(40240, "The argument to $bucketAuto must be an object, but found type: %s.", bsonutil.TypeName(spec))
+	}
+
+	var (
+		s          = new(bucketAutoStage)
+		groupBy    interface{}
+		hasBuckets bool
+		output     interface{}
+	)
+	for _, elem := range bsonutil.Elements(spec) {
+		switch elem.Name {
+		case "groupBy":
+			groupBy = elem.Value
+		case "buckets":
+			if !bsonutil.IsNumber(elem.Value) {
+				return nil, protocol.ServerErrorf(40241, "The $bucketAuto 'buckets' field must be a numeric value, but found type: %s.", bsonutil.TypeName(elem.Value))
+			}
+			n, isInt := bsonutil.ToInt64(elem.Value)
+			if !isInt || n > math.MaxInt32 || n < math.MinInt32 {
+				return nil, protocol.ServerErrorf(40242, "The $bucketAuto 'buckets' field must be representable as a 32-bit integer, but found %v.", elem.Value)
+			} else if n <= 0 {
+				return nil, protocol.ServerErrorf(40243, "The $bucketAuto 'buckets' field must be greater than 0, but found: %d.", n)
+			}
+			s.buckets, hasBuckets = int(n), true
+		case "output":
+			if !bsonutil.IsDocument(elem.Value) {
+				return nil, protocol.ServerErrorf(40244, "The $bucketAuto 'output' field must be an object, but found type: %s.", bsonutil.TypeName(elem.Value))
+			}
+			output = elem.Value
+		case "granularity":
+			name, isString := elem.Value.(string)
+			if !isString {
+				return nil, protocol.ServerErrorf(40261, "The $bucketAuto 'granularity' field must be a string, but found type: %s.", bsonutil.TypeName(elem.Value))
+			}
+			rounder, found := granularityRounders[name]
+			if !found {
+				return nil, protocol.ServerErrorf(40257, "Unknown rounding granularity '%s'", name)
+			}
+			s.rounder, s.hasRounder = rounder, true
+		default:
+			return nil, protocol.ServerErrorf(40245, "Unrecognized option to $bucketAuto: %s.", elem.Name)
+		}
+	}
+
+	if groupBy == nil || !hasBuckets {
+		return nil, protocol.ServerErrorf(40246, "$bucketAuto requires 'groupBy' and 'buckets' to be specified")
+	} else if !isGroupByExpression(groupBy) {
+		return nil, protocol.ServerErrorf(40239, "The $bucketAuto 'groupBy' field must be defined as a $-prefixed path or an expression object, but found: %v.", groupBy)
+	}
+
+	var err error
+	if s.groupBy, err = expr.Compile(groupBy); err != nil {
+		return nil, err
+	}
+	if s.fields, err = parseOutputFields(output); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// bucketAutoEntry associates a document with its groupBy value.
+type bucketAutoEntry struct {
+	doc   bson.D
+	value interface{}
+}
+
+// autoBucket describes the range and contents of a $bucketAuto bucket.
+type autoBucket struct {
+	min, max interface{}
+	entries  []bucketAutoEntry
+}
+
+func (s *bucketAutoStage) process(env *Env, docs []bson.D) ([]bson.D, error) {
+	var (
+		entries = make([]bucketAutoEntry, len(docs))
+		mem     = env.newMemoryTracker(sortMemoryLimitError)
+	)
+	for i, doc := range docs {
+		v, err := s.groupBy.Eval(env.varsFor(doc))
+		if err != nil {
+			return nil, err
+		} else if expr.IsMissing(v) {
+			v = nil
+		}
+
+		if s.hasRounder {
+			if f, isNum := bsonutil.ToFloat64(v); !isNum {
+				return nil, protocol.ServerErrorf(40258, "$bucketAuto can specify a 'granularity' with numeric boundaries only, but found a value with type: %s", bsonutil.TypeName(v))
+			} else if f < 0 || math.IsNaN(f) {
+				return nil, protocol.ServerErrorf(40260, "A granularity rounder can only round non-negative numbers, but found %v", v)
+			}
+		}
+
+		if err := mem.add(doc); err != nil {
+			return nil, err
+		}
+		entries[i] = bucketAutoEntry{doc: doc, value: v}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return bsonutil.Compare(entries[i].value, entries[j].value) < 0
+	})
+
+	var out []bson.D
+	for _, b := range s.bucketize(entries) {
+		accs := make([]expr.Accumulator, len(s.fields))
+		for i, f := range s.fields {
+			accs[i], _ = expr.NewAccumulator(f.op)
+		}
+		for _, entry := range b.entries {
+			vars := env.varsFor(entry.doc)
+			for i, f := range s.fields {
+				v, err := f.arg.Eval(vars)
+				if err != nil {
+					return nil, err
+				}
+				if err := accs[i].Add(v); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		doc := bson.D{{Name: "_id", Value: bson.D{{Name: "min", Value: b.min}, {Name: "max", Value: b.max}}}}
+		for i, f := range s.fields {
+			doc = append(doc, bson.DocElem{Name: f.name, Value: accs[i].Result()})
+		}
+		out = append(out, doc)
+	}
+	return out, nil
+}
+
+// bucketize splits a list of entries sorted by their value into buckets.
+// Entries with the same value are always placed in the same bucket so the
+// stage may output fewer buckets than requested.
+func (s *bucketAutoStage) bucketize(entries []bucketAutoEntry) []autoBucket {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	approxBucketSize := int(math.Round(float64(len(entries)) / float64(s.buckets)))
+	if approxBucketSize < 1 {
+		approxBucketSize = 1
+	}
+
+	var buckets []autoBucket
+	for start := 0; start < len(entries); {
+		end := start + approxBucketSize
+		if end > len(entries) || len(buckets) == s.buckets-1 {
+			end = len(entries)
+		}
+		for end < len(entries) && bsonutil.Compare(entries[end].value, entries[end-1].value) == 0 {
+			end++
+		}
+
+		b := autoBucket{min: entries[start].value, max: entries[end-1].value}
+		if s.hasRounder {
+			b.max = s.rounder.roundUp(b.max)
+			for end < len(entries) && bsonutil.Compare(entries[end].value, b.max) < 0 {
+				end++
+			}
+			if len(buckets) == 0 {
+				b.min = s.rounder.roundDown(b.min)
+			}
+		}
+		if len(buckets) != 0 {
+			// Buckets are contiguous so each bucket starts
+			// where the previous one ends.
+			prev := &buckets[len(buckets)-1]
+			if !s.hasRounder {
+				prev.max = b.min
+			} else {
+				b.min = prev.max
+			}
+		}
+
+		b.entries = entries[start:end]
+		buckets = append(buckets, b)
+		start = end
+	}
+	return buckets
+}
+
+// granularityRounder rounds bucket boundaries to a series of preferred
+// numbers.
+type granularityRounder interface {
+	// roundUp returns the smallest number in the series that is greater
+	// than v.
+	roundUp(v interface{}) interface{}
+
+	// roundDown returns the largest number in the series that is less
+	// than v.
+	roundDown(v interface{}) interface{}
+}
+
+// granularityRounders maps the granularity names supported by $bucketAuto to
+// their rounders.
+var granularityRounders = map[string]granularityRounder{
+	"R5":  preferredNumberRounder{1.0, 1.6, 2.5, 4.0, 6.3},
+	"R10": preferredNumberRounder{1.0, 1.25, 1.6, 2.0, 2.5, 3.15, 4.0, 5.0, 6.3, 8.0},
+	"R20": preferredNumberRounder{
+		1.0, 1.12, 1.25, 1.4, 1.6, 1.8, 2.0, 2.24, 2.5, 2.8,
+		3.15, 3.55, 4.0, 4.5, 5.0, 5.6, 6.3, 7.1, 8.0, 9.0,
+	},
+	"R40": preferredNumberRounder{
+		1.0, 1.06, 1.12, 1.18, 1.25, 1.32, 1.4, 1.5, 1.6, 1.7,
+		1.8, 1.9, 2.0, 2.12, 2.24, 2.36, 2.5, 2.65, 2.8, 3.0,
+		3.15, 3.35, 3.55, 3.75, 4.0, 4.25, 4.5, 4.75, 5.0, 5.3,
+		5.6, 6.0, 6.3, 6.7, 7.1, 7.5, 8.0, 8.5, 9.0, 9.5,
+	},
+	"R80": preferredNumberRounder{
+		1.0, 1.03, 1.06, 1.09, 1.12, 1.15, 1.18, 1.22, 1.25, 1.28,
+		1.32, 1.36, 1.4, 1.45, 1.5, 1.55, 1.6, 1.65, 1.7, 1.75,
+		1.8, 1.85, 1.9, 1.95, 2.0, 2.06, 2.12, 2.18, 2.24, 2.3,
+		2.36, 2.43, 2.5, 2.58, 2.65, 2.72, 2.8, 2.9, 3.0, 3.07,
+		3.15, 3.25, 3.35, 3.45, 3.55, 3.65, 3.75, 3.87, 4.0, 4.12,
+		4.25, 4.37, 4.5, 4.62, 4.75, 4.87, 5.0, 5.15, 5.3, 5.45,
+		5.6, 5.8, 6.0, 6.15, 6.3, 6.5, 6.7, 6.9, 7.1, 7.3,
+		7.5, 7.75, 8.0, 8.25, 8.5, 8.75, 9.0, 9.25, 9.5, 9.75,
+	},
+	"1-2-5": preferredNumberRounder{1.0, 2.0, 5.0},
+	"E6":    preferredNumberRounder{1.0, 1.5, 2.2, 3.3, 4.7, 6.8},
+	"E12":   preferredNumberRounder{1.0, 1.2, 1.5, 1.8, 2.2, 2.7, 3.3, 3.9, 4.7, 5.6, 6.8, 8.2},
+	"E24": preferredNumberRounder{
+		1.0, 1.1, 1.2, 1.3, 1.5, 1.6, 1.8, 2.0, 2.2, 2.4, 2.7, 3.0,
+		3.3, 3.6, 3.9, 4.3, 4.7, 5.1, 5.6, 6.2, 6.8, 7.5, 8.2, 9.1,
+	},
+	"E48":       eSeries(48),
+	"E96":       eSeries(96),
+	"E192":      eSeries(192),
+	"POWERSOF2": powersOf2Rounder{},
+}
+
+// eSeries returns the E48, E96 or E192 series of preferred numbers whose
+// values are defined as 10^(i/n) rounded to three significant digits.
+func eSeries(n int) preferredNumberRounder {
+	series := make(preferredNumberRounder, n)
+	for i := range series {
+		series[i] = math.Round(math.Pow(10, float64(i)/float64(n))*100) / 100
+	}
+	if n == 192 {
+		// The standard E192 series deviates from the formula for
+		// this value.
+		series[185] = 9.20
+	}
+	return series
+}
+
+// preferredNumberRounder rounds numbers to a series of preferred numbers
+// covering the [1, 10) interval which is scaled by powers of 10.
+type preferredNumberRounder []float64
+
+func (r preferredNumberRounder) roundUp(v interface{}) interface{} {
+	f, _ := bsonutil.ToFloat64(v)
+	if f == 0 {
+		return 0.0
+	}
+
+	scale := math.Pow(10, math.Floor(math.Log10(f)))
+	for {
+		for _, n := range r {
+			if candidate := roundSeriesValue(n * scale); candidate > f {
+				return candidate
+			}
+		}
+		scale *= 10
+	}
+}
+
+func (r preferredNumberRounder) roundDown(v interface{}) interface{} {
+	f, _ := bsonutil.ToFloat64(v)
+	if f == 0 {
+		return 0.0
+	}
+
+	scale := math.Pow(10, math.Floor(math.Log10(f)))
+	for {
+		for i := len(r) - 1; i >= 0; i-- {
+			if candidate := roundSeriesValue(r[i] * scale); candidate < f {
+				return candidate
+			}
+		}
+		scale /= 10
+	}
+}
+
+// roundSeriesValue removes any floating point noise introduced when scaling a
+// preferred number.
+func roundSeriesValue(f float64) float64 {
+	rounded, _ := strconv.ParseFloat(strconv.FormatFloat(f, 'g', 12, 64), 64)
+	return rounded
+}
+
+// powersOf2Rounder rounds numbers to powers of 2.
+type powersOf2Rounder struct{}
+
+func (powersOf2Rounder) roundUp(v interface{}) interface{} {
+	f, _ := bsonutil.ToFloat64(v)
+	if f == 0 {
+		return 0.0
+	}
+	_, exp := math.Frexp(f)
+	return math.Ldexp(1, exp)
+}
+
+func (powersOf2Rounder) roundDown(v interface{}) interface{} {
+	f, _ := bsonutil.ToFloat64(v)
+	if f == 0 {
+		return 0.0
+	}
+	frac, exp := math.Frexp(f)
+	if frac == 0.5 {
+		return math.Ldexp(1, exp-2)
+	}
+	return math.Ldexp(1, exp-1)
+}
+
+// sortByCountStage implements $sortByCount which groups documents by an
+// expression and outputs the number of documents in each group sorted by
+// descending count.
+type sortByCountStage struct {
+	groupBy expr.Expr
+}
+
+func parseSortByCountStage(spec interface{}) (stage, error) {
+	if !isGroupByExpression(spec) {
+		return nil, protocol.ServerErrorf(40147, "the sortByCount field must be defined as a $-prefixed path or an expression")
+	}
+
+	groupBy, err := expr.Compile(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &sortByCountStage{groupBy: groupBy}, nil
+}
+
+func (s *sortByCountStage) process(env *Env, docs []bson.D) ([]bson.D, error) {
+	fields, _ := parseOutputFields(nil)
+	groups, err := groupDocuments(env, docs, fields, s.groupBy.Eval)
+	if err != nil {
+		return nil, err
+	}
+
+	out := groupOutput(groups, fields)
+	SortSpec{{Path: "count", Descending: true}}.Sort(out)
+	return out, nil
+}
@@ -0,0 +1,88 @@
+package aggregate
+
+import (
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestBucketStages(t *testing.T) {
+	src := memSource{testCol.String(): {
+		{"_id": 1, "price": 5, "cat": "a"},
+		{"_id": 2, "price": 12, "cat": "b"},
+		{"_id": 3, "price": 18, "cat": "a"},
+		{"_id": 4, "price": 25, "cat": "a"},
+		{"_id": 5, "price": 40, "cat": "c"},
+		{"_id": 6, "cat": "b"},
+	}}
+
+	runPipelineSpecs(t, src, []pipelineSpec{
+		{
+			descr: "bucket with default and output",
+			pipeline: []bson.D{{{Name: "$bucket", Value: bson.M{
+				"groupBy":    "$price",
+				"boundaries": []interface{}{0, 10, 20, 30},
+				"default":    "other",
+				"output":     bson.M{"ids": bson.M{"$push": "$_id"}},
+			}}}},
+			// Documents outside the boundaries, including those
+			// without the field, fall into the default bucket.
+			exp: "[[{_id 0} {ids [1]}] [{_id 10} {ids [2 3]}] [{_id 20} {ids [4]}] [{_id other} {ids [5 6]}]]",
+		},
+		{
+			descr: "bucket without default",
+			pipeline: []bson.D{{{Name: "$bucket", Value: bson.M{
+				"groupBy":    "$price",
+				"boundaries": []interface{}{0, 100},
+			}}}},
+			expErr: 40066,
+		},
+		{
+			descr: "unsorted boundaries",
+			pipeline: []bson.D{{{Name: "$bucket", Value: bson.M{
+				"groupBy":    "$price",
+				"boundaries": []interface{}{10, 0},
+			}}}},
+			expErr: 40194,
+		},
+		{
+			descr: "default within the boundaries",
+			pipeline: []bson.D{{{Name: "$bucket", Value: bson.M{
+				"groupBy":    "$price",
+				"boundaries": []interface{}{0, 10},
+				"default":    5,
+			}}}},
+			expErr: 40199,
+		},
+		{
+			descr: "bucketAuto",
+			pipeline: []bson.D{
+				{{Name: "$match", Value: bson.M{"price": bson.M{"$exists": true}}}},
+				{{Name: "$bucketAuto", Value: bson.M{"groupBy": "$price", "buckets": 2}}},
+			},
+			exp: "[[{_id [{min 5} {max 25}]} {count 3}] [{_id [{min 25} {max 40}]} {count 2}]]",
+		},
+		{
+			descr: "bucketAuto with granularity",
+			pipeline: []bson.D{
+				{{Name: "$match", Value: bson.M{"price": bson.M{"$exists": true}}}},
+				{{Name: "$bucketAuto", Value: bson.M{"groupBy": "$price", "buckets": 2, "granularity": "POWERSOF2"}}},
+			},
+			// Rounding the boundary between the buckets up to 32
+			// moves 25 into the first bucket.
+			exp: "[[{_id [{min 4} {max 32}]} {count 4}] [{_id [{min 32} {max 64}]} {count 1}]]",
+		},
+		{
+			descr:    "bucketAuto with zero buckets",
+			pipeline: []bson.D{{{Name: "$bucketAuto", Value: bson.M{"groupBy": "$price", "buckets": 0}}}},
+			expErr:   40243,
+		},
+		{
+			descr: "sortByCount",
+			pipeline: []bson.D{
+				{{Name: "$sortByCount", Value: "$cat"}},
+			},
+			exp: "[[{_id a} {count 3}] [{_id b} {count 2}] [{_id c} {count 1}]]",
+		},
+	})
+}
@@ -0,0 +1,81 @@
+package aggregate
+
+import (
+	"strings"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/protocol"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// facetExcludedStages lists the stages that cannot be used within a $facet
+// sub-pipeline.
+var facetExcludedStages = map[string]bool{
+	"$facet":      true,
+	"$out":        true,
+	"$merge":      true,
+	"$collStats":  true,
+	"$indexStats": true,
+	"$geoNear":    true,
+}
+
+// facetStage implements $facet which runs multiple sub-pipelines over the
+// same input documents and outputs a single document with their results.
+type facetStage struct {
+	names     []string
+	pipelines []*Pipeline
+}
+
+func parseFacetStage(spec interface{}) (stage, error) {
+	elems := bsonutil.Elements(spec)
+	if !bsonutil.IsDocument(spec) || len(elems) == 0 {
+		return nil, protocol.ServerErrorf(40169, "the $facet specification must be a non-empty object, but found: %v", spec)
+	}
+
+	s := new(facetStage)
+	for _, elem := range elems {
+		if elem.Name == "" || strings.HasPrefix(elem.Name, "$") || strings.Contains(elem.Name, ".") {
+			return nil, protocol.ServerErrorf(40352, "FieldPath field names may not start with '$' or contain '.': %s", elem.Name)
+		} else if !bsonutil.IsArray(elem.Value) {
+			return nil, protocol.ServerErrorf(40170, "arguments to $facet must be arrays, %s is type %s", elem.Name, bsonutil.TypeName(elem.Value))
+		}
+
+		stages := bsonutil.ToArray(elem.Value)
+		if len(stages) == 0 {
+			return nil, protocol.ServerErrorf(40171, "sub-pipeline in $facet stage cannot be empty: %s", elem.Name)
+		}
+		for _, stageSpec := range stages {
+			if stageElems := bsonutil.Elements(stageSpec); len(stageElems) == 1 && facetExcludedStages[stageElems[0].Name] {
+				return nil, protocol.ServerErrorf(40600, "%s is not allowed to be used within a $facet stage", stageElems[0].Name)
+			}
+		}
+
+		pipeline, err := parseNestedPipeline(elem.Value)
+		if err != nil {
+			return nil, err
+		}
+		s.names = append(s.names, elem.Name)
+		s.pipelines = append(s.pipelines, pipeline)
+	}
+	return s, nil
+}
+
+func (s *facetStage) process(env *Env, docs []bson.D) ([]bson.D, error) {
+	var (
+		out  = make(bson.D, len(s.names))
+		size int64
+	)
+	for i, pipeline := range s.pipelines {
+		res, err := pipeline.Process(env, copyDocs(docs))
+		if err != nil {
+			return nil, err
+		}
+
+		facet := toInterfaceList(res)
+		if size += approxSize(facet); size > maxDocumentSize {
+			return nil, protocol.ServerErrorf(4031700, "document constructed by $facet is %d bytes, which exceeds the limit of %d bytes", size, maxDocumentSize)
+		}
+		out[i] = bson.DocElem{Name: s.names[i], Value: facet}
+	}
+	return []bson.D{out}, nil
+}
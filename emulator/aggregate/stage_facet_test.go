@@ -0,0 +1,59 @@
+package aggregate
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestFacet(t *testing.T) {
+	src := memSource{testCol.String(): {
+		{"_id": 1, "cat": "a", "price": 5},
+		{"_id": 2, "cat": "b", "price": 15},
+		{"_id": 3, "cat": "a", "price": 25},
+	}}
+
+	runPipelineSpecs(t, src, []pipelineSpec{
+		{
+			descr: "sub-pipelines share the input",
+			pipeline: []bson.D{
+				{{Name: "$match", Value: bson.M{"price": bson.M{"$gt": 1}}}},
+				{{Name: "$facet", Value: bson.D{
+					{Name: "byCat", Value: []interface{}{bson.M{"$sortByCount": "$cat"}}},
+					{Name: "byPrice", Value: []interface{}{bson.M{"$bucket": bson.M{"groupBy": "$price", "boundaries": []interface{}{0, 10, 30}}}}},
+					{Name: "none", Value: []interface{}{bson.M{"$match": bson.M{"cat": "z"}}}},
+				}}},
+			},
+			exp: "[[{byCat [[{_id a} {count 2}] [{_id b} {count 1}]]} {byPrice [[{_id 0} {count 1}] [{_id 10} {count 2}]]} {none []}]]",
+		},
+		{
+			descr:    "nested facet",
+			pipeline: []bson.D{{{Name: "$facet", Value: bson.M{"a": []interface{}{bson.M{"$facet": bson.M{"b": []interface{}{bson.M{"$count": "n"}}}}}}}}},
+			expErr:   40600,
+		},
+		{
+			descr:    "empty sub-pipeline",
+			pipeline: []bson.D{{{Name: "$facet", Value: bson.M{"a": []interface{}{}}}}},
+			expErr:   40171,
+		},
+	})
+}
+
+func TestFacetDocumentSizeLimit(t *testing.T) {
+	// The output of the facet exceeds the maximum document size even
+	// though each input document is within the limit.
+	var docs []bson.M
+	for i := 0; i < 17; i++ {
+		docs = append(docs, bson.M{"_id": i, "payload": strings.Repeat("x", 1<<20)})
+	}
+	src := memSource{testCol.String(): docs}
+
+	runPipelineSpecs(t, src, []pipelineSpec{
+		{
+			descr:    "facet output exceeds 16MB",
+			pipeline: []bson.D{{{Name: "$facet", Value: bson.M{"all": []interface{}{bson.M{"$match": bson.M{}}}}}}},
+			expErr:   4031700,
+		},
+	})
+}
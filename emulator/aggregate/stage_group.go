@@ -0,0 +1,301 @@
+package aggregate
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/emulator/expr"
+	"github.com/achilleasa/mongolite/protocol"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// groupStage implements $group which groups documents by a key expression and
+// computes aggregate values for each group.
+type groupStage struct {
+	idExpr expr.Expr
+	fields []groupField
+}
+
+type groupField struct {
+	name string
+	op   string
+	arg  expr.Expr
+}
+
+func parseGroupStage(spec interface{}) (stage, error) {
+	if !bsonutil.IsDocument(spec) {
+		return nil, protocol.ServerErrorf(15947, "a group's fields must be specified in an object")
+	}
+
+	s := new(groupStage)
+	for _, elem := range bsonutil.Elements(spec) {
+		if elem.Name == "_id" {
+			e, err := expr.Compile(elem.Value)
+			if err != nil {
+				return nil, err
+			}
+			s.idExpr = e
+			continue
+		}
+
+		f, err := parseGroupField(elem)
+		if err != nil {
+			return nil, err
+		}
+		s.fields = append(s.fields, f)
+	}
+
+	if s.idExpr == nil {
+		return nil, protocol.ServerErrorf(15955, "a group specification must include an _id")
+	}
+	return s, nil
+}
+
+// parseGroupField parses an accumulator field (e.g. total: {$sum: "$qty"}) of
+// a $group specification.
+func parseGroupField(elem bson.DocElem) (groupField, error) {
+	if strings.Contains(elem.Name, ".") {
+		return groupField{}, protocol.ServerErrorf(40235, "The field name '%s' cannot contain '.'", elem.Name)
+	} else if strings.HasPrefix(elem.Name, "$") {
+		return groupField{}, protocol.ServerErrorf(16410, "FieldPath field names may not start with '$'.")
+	}
+
+	if !bsonutil.IsDocument(elem.Value) {
+		return groupField{}, protocol.ServerErrorf(40234, "The field '%s' must be an accumulator object", elem.Name)
+	}
+	accSpec := bsonutil.Elements(elem.Value)
+	if len(accSpec) != 1 {
+		return groupField{}, protocol.ServerErrorf(40238, "The field '%s' must specify one accumulator", elem.Name)
+	}
+
+	op := accSpec[0].Name
+	if !expr.IsAccumulator(op) {
+		return groupField{}, protocol.ServerErrorf(15952, "unknown group operator '%s'", op)
+	} else if bsonutil.IsArray(accSpec[0].Value) {
+		return groupField{}, protocol.ServerErrorf(40237, "The %s accumulator is a unary operator", op)
+	}
+
+	arg, err := expr.Compile(accSpec[0].Value)
+	if err != nil {
+		return groupField{}, err
+	}
+	return groupField{name: elem.Name, op: op, arg: arg}, nil
+}
+
+// group holds the accumulator state for a group of documents.
+type group struct {
+	id   interface{}
+	accs []expr.Accumulator
+}
+
+func (s *groupStage) process(env *Env, docs []bson.D) ([]bson.D, error) {
+	groups, err := groupDocuments(env, docs, s.fields, func(vars *expr.Vars) (interface{}, error) {
+		return s.idExpr.Eval(vars)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return groupOutput(groups, s.fields), nil
+}
+
+// groupDocuments assigns each document to the group identified by keyFn and
+// feeds the group's accumulators. Groups are returned in the order that they
+// were first encountered unless the groups exceed the memory limit and are
+// computed by spilling to disk.
+func groupDocuments(env *Env, docs []bson.D, fields []groupField, keyFn func(*expr.Vars) (interface{}, error)) ([]*group, error) {
+	var (
+		groups []*group
+		byKey  = make(map[string]*group)
+		mem    = env.newMemoryTracker(groupMemoryLimitError)
+	)
+
+	for _, doc := range docs {
+		vars := env.varsFor(doc)
+		id, err := keyFn(vars)
+		if err != nil {
+			return nil, err
+		}
+		idValue := expr.Value(id)
+
+		key := groupKey(idValue)
+		g := byKey[key]
+		if g == nil {
+			g = newGroup(idValue, fields)
+			byKey[key] = g
+			groups = append(groups, g)
+			if err := mem.add(idValue); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := g.accumulate(vars, fields, mem); err != nil {
+			return nil, err
+		}
+		if mem.shouldSpill() {
+			return groupDocumentsExternal(env, docs, fields, keyFn)
+		}
+	}
+	return groups, nil
+}
+
+// groupDocumentsExternal implements groupDocuments for groups that exceed the
+// memory limit. Each document is tagged with its group key and the tagged
+// documents are sorted by key, spilling to disk as needed. The sorted
+// documents are then accumulated one group at a time. Groups are returned in
+// the order of their keys.
+func groupDocumentsExternal(env *Env, docs []bson.D, fields []groupField, keyFn func(*expr.Vars) (interface{}, error)) ([]*group, error) {
+	sorter := env.newExternalSorter(func(a, b bson.D) int {
+		return strings.Compare(a[0].Value.(string), b[0].Value.(string))
+	}, groupMemoryLimitError)
+	defer sorter.close()
+
+	for _, doc := range docs {
+		id, err := keyFn(env.varsFor(doc))
+		if err != nil {
+			return nil, err
+		}
+		idValue := expr.Value(id)
+
+		tagged := bson.D{
+			{Name: "key", Value: groupKey(idValue)},
+			{Name: "id", Value: idValue},
+			{Name: "doc", Value: doc},
+		}
+		if err := sorter.add(tagged); err != nil {
+			return nil, err
+		}
+	}
+
+	var (
+		groups []*group
+		cur    *group
+		curKey string
+		mem    = new(memoryTracker)
+	)
+	err := sorter.each(func(tagged bson.D) error {
+		if key := tagged[0].Value.(string); cur == nil || key != curKey {
+			cur, curKey = newGroup(tagged[1].Value, fields), key
+			groups = append(groups, cur)
+		}
+		return cur.accumulate(env.varsFor(ToDocument(tagged[2].Value)), fields, mem)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+func newGroup(id interface{}, fields []groupField) *group {
+	g := &group{id: id, accs: make([]expr.Accumulator, len(fields))}
+	for i, f := range fields {
+		g.accs[i], _ = expr.NewAccumulator(f.op)
+	}
+	return g
+}
+
+// accumulate feeds the values of the group fields for a document to the
+// group's accumulators.
+func (g *group) accumulate(vars *expr.Vars, fields []groupField, mem *memoryTracker) error {
+	for i, f := range fields {
+		v, err := f.arg.Eval(vars)
+		if err != nil {
+			return err
+		}
+		if err := g.accs[i].Add(v); err != nil {
+			return err
+		}
+		if retainsValues(f.op) {
+			if err := mem.add(v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// retainsValues returns true if an accumulator keeps a copy of the values fed
+// to it so their memory usage needs to be tracked.
+func retainsValues(op string) bool {
+	switch op {
+	case "$push", "$addToSet", "$mergeObjects":
+		return true
+	}
+	return false
+}
+
+// groupOutput returns the output documents for a list of groups.
+func groupOutput(groups []*group, fields []groupField) []bson.D {
+	out := make([]bson.D, len(groups))
+	for i, g := range groups {
+		doc := make(bson.D, 0, len(fields)+1)
+		doc = append(doc, bson.DocElem{Name: "_id", Value: g.id})
+		for j, f := range fields {
+			doc = append(doc, bson.DocElem{Name: f.name, Value: g.accs[j].Result()})
+		}
+		out[i] = doc
+	}
+	return out
+}
+
+// groupKey returns a string that uniquely identifies a value for grouping
+// purposes. Values that compare as equal (e.g. numbers of different types)
+// map to the same key.
+func groupKey(v interface{}) string {
+	var sb strings.Builder
+	writeGroupKey(&sb, v)
+	return sb.String()
+}
+
+func writeGroupKey(sb *strings.Builder, v interface{}) {
+	switch {
+	case bsonutil.IsNull(v):
+		sb.WriteString("null")
+		return
+	case bsonutil.IsNumber(v):
+		if i, ok := bsonutil.ToInt64(v); ok {
+			sb.WriteString("n" + strconv.FormatInt(i, 10))
+			return
+		}
+		f, _ := bsonutil.ToFloat64(v)
+		if math.IsNaN(f) {
+			sb.WriteString("nNaN")
+			return
+		}
+		sb.WriteString("n" + strconv.FormatFloat(f, 'g', -1, 64))
+		return
+	case bsonutil.IsDocument(v):
+		sb.WriteString("{")
+		for _, elem := range bsonutil.Elements(v) {
+			sb.WriteString(strconv.Quote(elem.Name) + ":")
+			writeGroupKey(sb, elem.Value)
+			sb.WriteString(",")
+		}
+		sb.WriteString("}")
+		return
+	case bsonutil.IsArray(v):
+		sb.WriteString("[")
+		for _, elem := range bsonutil.ToArray(v) {
+			writeGroupKey(sb, elem)
+			sb.WriteString(",")
+		}
+		sb.WriteString("]")
+		return
+	}
+
+	switch val := v.(type) {
+	case string:
+		sb.WriteString("s" + strconv.Quote(val))
+	case bson.Symbol:
+		sb.WriteString("s" + strconv.Quote(string(val)))
+	case time.Time:
+		sb.WriteString("d" + strconv.FormatInt(val.UnixNano()/int64(time.Millisecond), 10))
+	case bson.ObjectId:
+		sb.WriteString("o" + val.Hex())
+	default:
+		sb.WriteString(fmt.Sprintf("%s:%v", bsonutil.TypeName(v), v))
+	}
+}
@@ -0,0 +1,375 @@
+package aggregate
+
+import (
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/emulator/expr"
+	"github.com/achilleasa/mongolite/emulator/filter"
+	"github.com/achilleasa/mongolite/protocol"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// lookupStage implements $lookup which joins each input document with the
+// documents of another collection in the same database.
+//
+// Equality joins (localField/foreignField) are pushed down to the source as a
+// single $in query for the entire batch of input documents which allows
+// sources to answer them using their indexes. The fetched documents are then
+// assigned to the input documents that they match. Lookups with a pipeline
+// are evaluated separately for each input document.
+type lookupStage struct {
+	from         string
+	as           []string
+	localField   string
+	foreignField string
+
+	letNames []string
+	letExprs []expr.Expr
+	pipeline *Pipeline
+}
+
+func parseLookupStage(spec interface{}) (stage, error) {
+	if !bsonutil.IsDocument(spec) {
+		return nil, protocol.ServerErrorf(40319, "the $lookup specification must be an Object")
+	}
+
+	var (
+		s            = new(lookupStage)
+		as           string
+		pipelineSpec interface{}
+	)
+	for _, elem := range bsonutil.Elements(spec) {
+		switch elem.Name {
+		case "from", "as", "localField", "foreignField":
+			str, isString := elem.Value.(string)
+			if !isString {
+				return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "$lookup argument '%s: %v' must be a string, is type %s", elem.Name, elem.Value, bsonutil.TypeName(elem.Value))
+			}
+			switch elem.Name {
+			case "from":
+				s.from = str
+			case "as":
+				as = str
+			case "localField":
+				s.localField = str
+			case "foreignField":
+				s.foreignField = str
+			}
+		case "let":
+			if !bsonutil.IsDocument(elem.Value) {
+				return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "$lookup argument 'let' must be an object, is type %s", bsonutil.TypeName(elem.Value))
+			}
+			for _, v := range bsonutil.Elements(elem.Value) {
+				if err := expr.ValidateUserVariableName(v.Name); err != nil {
+					return nil, err
+				}
+				e, err := expr.Compile(v.Value)
+				if err != nil {
+					return nil, err
+				}
+				s.letNames = append(s.letNames, v.Name)
+				s.letExprs = append(s.letExprs, e)
+			}
+		case "pipeline":
+			pipelineSpec = elem.Value
+		default:
+			return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "unknown argument to $lookup: %s", elem.Name)
+		}
+	}
+
+	switch {
+	case s.from == "":
+		return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "must specify 'from' field for a $lookup")
+	case as == "":
+		return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "must specify 'as' field for a $lookup")
+	case (s.localField == "") != (s.foreignField == ""):
+		return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "$lookup requires both or neither of 'localField' and 'foreignField' to be specified")
+	case s.localField == "" && pipelineSpec == nil:
+		return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "$lookup requires either 'pipeline' or both 'localField' and 'foreignField' to be specified")
+	case pipelineSpec == nil && len(s.letNames) != 0:
+		return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "$lookup with a 'let' argument must also specify 'pipeline'")
+	}
+	s.as = splitPath(as)
+
+	if pipelineSpec != nil {
+		var err error
+		if s.pipeline, err = parseNestedPipeline(pipelineSpec); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *lookupStage) process(env *Env, docs []bson.D) ([]bson.D, error) {
+	if len(docs) == 0 {
+		return nil, nil
+	}
+
+	from := protocol.NamespacedCollection{Database: env.Namespace.Database, Collection: s.from}
+	query := bson.M{}
+	if s.localField != "" {
+		var values []interface{}
+		for _, doc := range docs {
+			values = append(values, s.localValues(doc)...)
+		}
+		query = bson.M{s.foreignField: bson.M{"$in": values}}
+	}
+
+	foreign, err := env.Source.Find(from, query)
+	if err != nil {
+		return nil, err
+	}
+
+	// Uncorrelated pipelines produce the same output for every input
+	// document so they only need to be evaluated once.
+	var uncorrelated []interface{}
+	if s.localField == "" && len(s.letNames) == 0 {
+		res, err := s.pipeline.Process(env.withScope(from, env.Vars), copyDocs(foreign))
+		if err != nil {
+			return nil, err
+		}
+		uncorrelated = toInterfaceList(res)
+	}
+
+	out := make([]bson.D, len(docs))
+	for i, doc := range docs {
+		joined := uncorrelated
+		if joined == nil {
+			if joined, err = s.join(env, from, doc, foreign); err != nil {
+				return nil, err
+			}
+		}
+		out[i] = setPath(doc, s.as, joined)
+	}
+	return out, nil
+}
+
+// join returns the foreign documents that should be joined with doc.
+func (s *lookupStage) join(env *Env, from protocol.NamespacedCollection, doc bson.D, foreign []bson.D) ([]interface{}, error) {
+	matched := foreign
+	if s.localField != "" {
+		matcher, err := filter.Compile(bson.M{s.foreignField: bson.M{"$in": s.localValues(doc)}})
+		if err != nil {
+			return nil, err
+		}
+
+		matched = nil
+		for _, candidate := range foreign {
+			if matcher.Match(candidate) {
+				matched = append(matched, candidate)
+			}
+		}
+	}
+
+	if s.pipeline == nil {
+		return toInterfaceList(matched), nil
+	}
+
+	scope := env.Vars
+	docVars := env.varsFor(doc)
+	for i, name := range s.letNames {
+		v, err := s.letExprs[i].Eval(docVars)
+		if err != nil {
+			return nil, err
+		}
+		scope = scope.With(name, expr.Value(v))
+	}
+
+	res, err := s.pipeline.Process(env.withScope(from, scope), copyDocs(matched))
+	if err != nil {
+		return nil, err
+	}
+	return toInterfaceList(res), nil
+}
+
+// localValues returns the values of the local field of doc that are matched
+// against the foreign field. Arrays are matched by their elements while
+// missing values match foreign documents where the foreign field is null or
+// missing.
+func (s *lookupStage) localValues(doc bson.D) []interface{} {
+	var values []interface{}
+	for _, v := range bsonutil.LookupValues(doc, s.localField) {
+		if bsonutil.IsArray(v) {
+			values = append(values, bsonutil.ToArray(v)...)
+			continue
+		}
+		values = append(values, v)
+	}
+
+	if len(values) == 0 {
+		values = append(values, nil)
+	}
+	return values
+}
+
+// graphLookupStage implements $graphLookup which performs a recursive search
+// on a collection. Each level of the search is pushed down to the source as
+// a $in query for the values collected by the previous level.
+type graphLookupStage struct {
+	from             string
+	as               []string
+	startWith        expr.Expr
+	connectFromField string
+	connectToField   string
+	maxDepth         int64
+	depthField       []string
+	restrict         bson.M
+}
+
+func parseGraphLookupStage(spec interface{}) (stage, error) {
+	if !bsonutil.IsDocument(spec) {
+		return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "the $graphLookup specification must be an Object")
+	}
+
+	var (
+		s  = &graphLookupStage{maxDepth: -1}
+		as string
+	)
+	for _, elem := range bsonutil.Elements(spec) {
+		switch elem.Name {
+		case "from", "as", "connectFromField", "connectToField", "depthField":
+			str, isString := elem.Value.(string)
+			if !isString {
+				return nil, protocol.ServerErrorf(40103, "expected string as argument for %s, found: %s", elem.Name, bsonutil.TypeName(elem.Value))
+			}
+			switch elem.Name {
+			case "from":
+				s.from = str
+			case "as":
+				as = str
+			case "connectFromField":
+				s.connectFromField = str
+			case "connectToField":
+				s.connectToField = str
+			case "depthField":
+				s.depthField = splitPath(str)
+			}
+		case "startWith":
+			var err error
+			if s.startWith, err = expr.Compile(elem.Value); err != nil {
+				return nil, err
+			}
+		case "maxDepth":
+			depth, isNum := bsonutil.ToInt64(elem.Value)
+			if !isNum {
+				return nil, protocol.ServerErrorf(40100, "maxDepth must be numeric, found type: %s", bsonutil.TypeName(elem.Value))
+			} else if f, _ := bsonutil.ToFloat64(elem.Value); float64(depth) != f {
+				return nil, protocol.ServerErrorf(40102, "maxDepth requires an integer argument, found: %v", elem.Value)
+			} else if depth < 0 {
+				return nil, protocol.ServerErrorf(40101, "maxDepth requires a nonnegative argument, found: %d", depth)
+			}
+			s.maxDepth = depth
+		case "restrictSearchWithMatch":
+			if !bsonutil.IsDocument(elem.Value) {
+				return nil, protocol.ServerErrorf(40185, "restrictSearchWithMatch must be an object, found %s", bsonutil.TypeName(elem.Value))
+			}
+			s.restrict = bsonutil.ToMap(elem.Value)
+			if _, err := filter.Compile(s.restrict); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, protocol.ServerErrorf(40104, "Unknown argument to $graphLookup: %s", elem.Name)
+		}
+	}
+
+	if s.from == "" || as == "" || s.startWith == nil || s.connectFromField == "" || s.connectToField == "" {
+		return nil, protocol.ServerErrorf(40105, "from, as, startWith, connectFromField, and connectToField must all be specified")
+	}
+	s.as = splitPath(as)
+	return s, nil
+}
+
+func (s *graphLookupStage) process(env *Env, docs []bson.D) ([]bson.D, error) {
+	from := protocol.NamespacedCollection{Database: env.Namespace.Database, Collection: s.from}
+
+	out := make([]bson.D, len(docs))
+	for i, doc := range docs {
+		start, err := s.startWith.Eval(env.varsFor(doc))
+		if err != nil {
+			return nil, err
+		}
+
+		found, err := s.search(env, from, flattenValues([]interface{}{start}))
+		if err != nil {
+			return nil, err
+		}
+		out[i] = setPath(doc, s.as, found)
+	}
+	return out, nil
+}
+
+// search performs a breadth-first search starting from the provided values
+// and returns the list of visited documents.
+func (s *graphLookupStage) search(env *Env, from protocol.NamespacedCollection, frontier []interface{}) ([]interface{}, error) {
+	var (
+		found   = []interface{}{}
+		visited = make(map[string]bool)
+		queried = make(map[string]bool)
+	)
+	for depth := int64(0); len(frontier) != 0 && (s.maxDepth < 0 || depth <= s.maxDepth); depth++ {
+		var values []interface{}
+		for _, v := range frontier {
+			if key := groupKey(v); !queried[key] {
+				queried[key] = true
+				values = append(values, v)
+			}
+		}
+		if len(values) == 0 {
+			break
+		}
+
+		query := bson.M{s.connectToField: bson.M{"$in": values}}
+		if len(s.restrict) != 0 {
+			query = bson.M{"$and": []interface{}{query, s.restrict}}
+		}
+		matches, err := env.Source.Find(from, query)
+		if err != nil {
+			return nil, err
+		}
+
+		frontier = nil
+		for _, doc := range matches {
+			id, _ := getField(doc, "_id")
+			key := groupKey(id)
+			if visited[key] {
+				continue
+			}
+			visited[key] = true
+
+			frontier = append(frontier, flattenValues(bsonutil.LookupValues(doc, s.connectFromField))...)
+			if s.depthField != nil {
+				doc = setPath(doc, s.depthField, depth)
+			}
+			found = append(found, doc)
+		}
+	}
+	return found, nil
+}
+
+// flattenValues expands any arrays in values into their elements. Missing
+// values are skipped.
+func flattenValues(values []interface{}) []interface{} {
+	var out []interface{}
+	for _, v := range values {
+		if bsonutil.IsArray(v) {
+			out = append(out, bsonutil.ToArray(v)...)
+		} else if !expr.IsMissing(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// copyDocs returns a shallow copy of a list of documents so that it can be
+// processed by a pipeline without affecting the original list.
+func copyDocs(docs []bson.D) []bson.D {
+	return append([]bson.D(nil), docs...)
+}
+
+// toInterfaceList converts a list of documents into an array value.
+func toInterfaceList(docs []bson.D) []interface{} {
+	out := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		out[i] = doc
+	}
+	return out
+}
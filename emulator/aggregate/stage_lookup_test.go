@@ -0,0 +1,130 @@
+package aggregate
+
+import (
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestLookup(t *testing.T) {
+	src := memSource{
+		testCol.String(): {
+			{"_id": 1, "item": "a", "qty": 2},
+			{"_id": 2, "item": []interface{}{"b", "c"}, "qty": 5},
+			{"_id": 3, "qty": 1},
+		},
+		"test.inventory": {
+			{"_id": 10, "sku": "a", "stock": 1},
+			{"_id": 11, "sku": "b", "stock": 6},
+			{"_id": 12, "sku": "c", "stock": 0},
+			{"_id": 13, "stock": 3},
+		},
+	}
+
+	runPipelineSpecs(t, src, []pipelineSpec{
+		{
+			descr: "equality match",
+			pipeline: []bson.D{
+				{{Name: "$lookup", Value: bson.M{"from": "inventory", "localField": "item", "foreignField": "sku", "as": "stock"}}},
+				{{Name: "$project", Value: bson.M{"stock._id": 1}}},
+			},
+			// Arrays match by their elements and missing local
+			// fields match foreign documents without the field.
+			exp: "[[{_id 1} {stock [[{_id 10}]]}] [{_id 2} {stock [[{_id 11}] [{_id 12}]]}] [{_id 3} {stock [[{_id 13}]]}]]",
+		},
+		{
+			descr: "correlated pipeline",
+			pipeline: []bson.D{
+				{{Name: "$lookup", Value: bson.M{
+					"from": "inventory",
+					"let":  bson.M{"needed": "$qty"},
+					"pipeline": []interface{}{
+						bson.M{"$match": bson.M{"$expr": bson.M{"$gte": []interface{}{"$stock", "$$needed"}}}},
+						bson.M{"$project": bson.M{"_id": 1}},
+					},
+					"as": "suppliers",
+				}}},
+				{{Name: "$project", Value: bson.M{"suppliers": 1}}},
+			},
+			exp: "[[{_id 1} {suppliers [[{_id 11}] [{_id 13}]]}] [{_id 2} {suppliers [[{_id 11}]]}] [{_id 3} {suppliers [[{_id 10}] [{_id 11}] [{_id 13}]]}]]",
+		},
+		{
+			descr: "uncorrelated pipeline",
+			pipeline: []bson.D{
+				{{Name: "$match", Value: bson.M{"_id": 1}}},
+				{{Name: "$lookup", Value: bson.M{
+					"from":     "inventory",
+					"pipeline": []interface{}{bson.M{"$count": "n"}},
+					"as":       "total",
+				}}},
+			},
+			exp: "[[{_id 1} {item a} {qty 2} {total [[{n 4}]]}]]",
+		},
+		{
+			descr:    "missing from",
+			pipeline: []bson.D{{{Name: "$lookup", Value: bson.M{"localField": "item", "foreignField": "sku", "as": "stock"}}}},
+			expErr:   9,
+		},
+		{
+			descr:    "let without pipeline",
+			pipeline: []bson.D{{{Name: "$lookup", Value: bson.M{"from": "inventory", "localField": "item", "foreignField": "sku", "let": bson.M{"x": 1}, "as": "stock"}}}},
+			expErr:   9,
+		},
+	})
+}
+
+func TestGraphLookup(t *testing.T) {
+	src := memSource{
+		testCol.String(): {
+			{"_id": 1, "name": "dev", "reportsTo": "lead"},
+		},
+		"test.employees": {
+			{"_id": "lead", "reportsTo": "manager", "active": true},
+			{"_id": "manager", "reportsTo": []interface{}{"cto", "cfo"}, "active": true},
+			{"_id": "cto", "reportsTo": "ceo", "active": false},
+			{"_id": "cfo", "reportsTo": "ceo", "active": true},
+			{"_id": "ceo", "reportsTo": "lead", "active": true},
+		},
+	}
+	graphLookup := func(opts bson.M) []bson.D {
+		spec := bson.M{
+			"from":             "employees",
+			"startWith":        "$reportsTo",
+			"connectFromField": "reportsTo",
+			"connectToField":   "_id",
+			"as":               "chain",
+		}
+		for k, v := range opts {
+			spec[k] = v
+		}
+		return []bson.D{
+			{{Name: "$graphLookup", Value: spec}},
+			{{Name: "$project", Value: bson.M{"chain._id": 1, "chain.depth": 1}}},
+		}
+	}
+
+	runPipelineSpecs(t, src, []pipelineSpec{
+		{
+			// The search stops at documents that it has already
+			// visited.
+			descr:    "full search with cycle",
+			pipeline: graphLookup(bson.M{"depthField": "depth"}),
+			exp:      "[[{_id 1} {chain [[{_id lead} {depth 0}] [{_id manager} {depth 1}] [{_id cto} {depth 2}] [{_id cfo} {depth 2}] [{_id ceo} {depth 3}]]}]]",
+		},
+		{
+			descr:    "max depth",
+			pipeline: graphLookup(bson.M{"maxDepth": 1}),
+			exp:      "[[{_id 1} {chain [[{_id lead}] [{_id manager}]]}]]",
+		},
+		{
+			descr:    "restrict search",
+			pipeline: graphLookup(bson.M{"restrictSearchWithMatch": bson.M{"active": true}}),
+			exp:      "[[{_id 1} {chain [[{_id lead}] [{_id manager}] [{_id cfo}] [{_id ceo}]]}]]",
+		},
+		{
+			descr:    "negative max depth",
+			pipeline: graphLookup(bson.M{"maxDepth": -1}),
+			expErr:   40101,
+		},
+	})
+}
@@ -0,0 +1,66 @@
+package aggregate
+
+import (
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/emulator/filter"
+	"github.com/achilleasa/mongolite/protocol"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// matchStage implements $match which filters documents using a query.
+type matchStage struct {
+	matcher *filter.Matcher
+
+	// True if the query contains $expr clauses that may reference
+	// pipeline variables.
+	hasExpr bool
+}
+
+func parseMatchStage(spec interface{}) (stage, error) {
+	if !bsonutil.IsDocument(spec) {
+		return nil, protocol.ServerErrorf(15959, "the match filter must be an expression in an object")
+	}
+
+	query := bsonutil.ToMap(spec)
+	matcher, err := filter.Compile(query)
+	if err != nil {
+		return nil, err
+	}
+	return &matchStage{matcher: matcher, hasExpr: containsExpr(query)}, nil
+}
+
+func (s *matchStage) process(env *Env, docs []bson.D) ([]bson.D, error) {
+	matcher := s.matcher
+	if s.hasExpr {
+		var err error
+		if matcher, err = filter.CompileWithVars(matcher.Query(), env.Vars); err != nil {
+			return nil, err
+		}
+	}
+
+	out := docs[:0:0]
+	for _, doc := range docs {
+		if matcher.Match(doc) {
+			out = append(out, doc)
+		}
+	}
+	return out, nil
+}
+
+// containsExpr returns true if a query contains an $expr clause either at the
+// top level or nested in a logical operator.
+func containsExpr(query interface{}) bool {
+	for _, elem := range bsonutil.Elements(query) {
+		switch elem.Name {
+		case "$expr":
+			return true
+		case "$and", "$or", "$nor":
+			for _, clause := range bsonutil.ToArray(elem.Value) {
+				if containsExpr(clause) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
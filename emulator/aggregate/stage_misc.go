@@ -0,0 +1,228 @@
+package aggregate
+
+import (
+	"math/rand"
+	"strings"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/protocol"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// limitStage implements $limit.
+type limitStage struct {
+	limit int64
+}
+
+func parseLimitStage(spec interface{}) (stage, error) {
+	limit, isNum := bsonutil.ToInt64(spec)
+	if !isNum {
+		return nil, protocol.ServerErrorf(15957, "the limit must be specified as a number")
+	} else if limit <= 0 {
+		return nil, protocol.ServerErrorf(15958, "the limit must be positive")
+	}
+	return &limitStage{limit: limit}, nil
+}
+
+func (s *limitStage) process(_ *Env, docs []bson.D) ([]bson.D, error) {
+	if int64(len(docs)) > s.limit {
+		return docs[:s.limit], nil
+	}
+	return docs, nil
+}
+
+// skipStage implements $skip.
+type skipStage struct {
+	skip int64
+}
+
+func parseSkipStage(spec interface{}) (stage, error) {
+	skip, isNum := bsonutil.ToInt64(spec)
+	if !isNum {
+		return nil, protocol.ServerErrorf(15972, "Argument to $skip must be a number")
+	} else if skip < 0 {
+		return nil, protocol.ServerErrorf(15956, "Argument to $skip cannot be negative")
+	}
+	return &skipStage{skip: skip}, nil
+}
+
+func (s *skipStage) process(_ *Env, docs []bson.D) ([]bson.D, error) {
+	if int64(len(docs)) <= s.skip {
+		return nil, nil
+	}
+	return docs[s.skip:], nil
+}
+
+// countStage implements $count which outputs a single document with the
+// number of input documents.
+type countStage struct {
+	field string
+}
+
+func parseCountStage(spec interface{}) (stage, error) {
+	field, isString := spec.(string)
+	switch {
+	case !isString || field == "":
+		return nil, protocol.ServerErrorf(40156, "the count field must be a non-empty string")
+	case strings.HasPrefix(field, "$"):
+		return nil, protocol.ServerErrorf(40158, "the count field cannot be a $-prefixed path")
+	case strings.Contains(field, "."):
+		return nil, protocol.ServerErrorf(40160, "the count field cannot contain '.'")
+	case field == "_id":
+		return nil, protocol.ServerErrorf(9039800, "the count field cannot be '_id'")
+	}
+	return &countStage{field: field}, nil
+}
+
+func (s *countStage) process(_ *Env, docs []bson.D) ([]bson.D, error) {
+	if len(docs) == 0 {
+		return nil, nil
+	}
+	return []bson.D{{{Name: s.field, Value: len(docs)}}}, nil
+}
+
+// unwindStage implements $unwind which outputs a document for each element of
+// an array field.
+type unwindStage struct {
+	path                       []string
+	includeArrayIndex          string
+	preserveNullAndEmptyArrays bool
+}
+
+func parseUnwindStage(spec interface{}) (stage, error) {
+	var (
+		s    = new(unwindStage)
+		path string
+	)
+
+	switch {
+	case bsonutil.IsDocument(spec):
+		for _, elem := range bsonutil.Elements(spec) {
+			switch elem.Name {
+			case "path":
+				var isString bool
+				if path, isString = elem.Value.(string); !isString {
+					return nil, protocol.ServerErrorf(28808, "expected a string as the path for $unwind stage, got %s", bsonutil.TypeName(elem.Value))
+				}
+			case "includeArrayIndex":
+				index, isString := elem.Value.(string)
+				if !isString {
+					return nil, protocol.ServerErrorf(28810, "expected a non-empty string for the includeArrayIndex option to $unwind stage, got %s", bsonutil.TypeName(elem.Value))
+				} else if index == "" {
+					return nil, protocol.ServerErrorf(28810, "expected a non-empty string for the includeArrayIndex option to $unwind stage, got string")
+				} else if strings.HasPrefix(index, "$") {
+					return nil, protocol.ServerErrorf(28822, "includeArrayIndex option to $unwind stage should not be prefixed with a '$': %s", index)
+				}
+				s.includeArrayIndex = index
+			case "preserveNullAndEmptyArrays":
+				preserve, isBool := elem.Value.(bool)
+				if !isBool {
+					return nil, protocol.ServerErrorf(28809, "expected a boolean for the preserveNullAndEmptyArrays option to $unwind stage, got %s", bsonutil.TypeName(elem.Value))
+				}
+				s.preserveNullAndEmptyArrays = preserve
+			default:
+				return nil, protocol.ServerErrorf(28811, "unrecognized option to $unwind stage: %s", elem.Name)
+			}
+		}
+		if path == "" {
+			return nil, protocol.ServerErrorf(28812, "no path specified to $unwind stage")
+		}
+	default:
+		var isString bool
+		if path, isString = spec.(string); !isString {
+			return nil, protocol.ServerErrorf(15981, "expected either a string or an object as specification for $unwind stage, got %s", bsonutil.TypeName(spec))
+		}
+	}
+
+	if !strings.HasPrefix(path, "$") {
+		return nil, protocol.ServerErrorf(28818, "path option to $unwind stage should be prefixed with a '$': %s", path)
+	}
+	s.path = splitPath(path[1:])
+	return s, nil
+}
+
+func (s *unwindStage) process(_ *Env, docs []bson.D) ([]bson.D, error) {
+	var out []bson.D
+	for _, doc := range docs {
+		v, found := bsonutil.LookupPath(doc, strings.Join(s.path, "."))
+
+		if !bsonutil.IsArray(v) {
+			if found && !bsonutil.IsNull(v) {
+				// Non-array values are treated as single-element
+				// arrays.
+				out = append(out, s.withIndex(doc, nil))
+			} else if s.preserveNullAndEmptyArrays {
+				out = append(out, s.withIndex(doc, nil))
+			}
+			continue
+		}
+
+		arr := bsonutil.ToArray(v)
+		if len(arr) == 0 {
+			if s.preserveNullAndEmptyArrays {
+				out = append(out, s.withIndex(removePath(doc, s.path), nil))
+			}
+			continue
+		}
+
+		for i, elem := range arr {
+			out = append(out, s.withIndex(setPath(doc, s.path, elem), int64(i)))
+		}
+	}
+	return out, nil
+}
+
+func (s *unwindStage) withIndex(doc bson.D, index interface{}) bson.D {
+	if s.includeArrayIndex == "" {
+		return doc
+	}
+	return setPath(doc, splitPath(s.includeArrayIndex), index)
+}
+
+// sampleStage implements $sample which randomly selects the specified number
+// of documents.
+type sampleStage struct {
+	size int64
+}
+
+func parseSampleStage(spec interface{}) (stage, error) {
+	if !bsonutil.IsDocument(spec) {
+		return nil, protocol.ServerErrorf(28745, "the $sample stage specification must be an object")
+	}
+
+	s := &sampleStage{size: -1}
+	for _, elem := range bsonutil.Elements(spec) {
+		if elem.Name != "size" {
+			return nil, protocol.ServerErrorf(28748, "unrecognized option to $sample: %s", elem.Name)
+		}
+
+		size, isNum := bsonutil.ToInt64(elem.Value)
+		if !isNum {
+			return nil, protocol.ServerErrorf(28746, "size argument to $sample must be a number")
+		} else if size < 0 {
+			return nil, protocol.ServerErrorf(28747, "size argument to $sample must not be negative")
+		}
+		s.size = size
+	}
+
+	if s.size < 0 {
+		return nil, protocol.ServerErrorf(28749, "$sample stage must specify a size")
+	}
+	return s, nil
+}
+
+func (s *sampleStage) process(env *Env, docs []bson.D) ([]bson.D, error) {
+	mem := env.newMemoryTracker(sortMemoryLimitError)
+	for _, doc := range docs {
+		if err := mem.add(doc); err != nil {
+			return nil, err
+		}
+	}
+
+	out := append([]bson.D(nil), docs...)
+	rand.Shuffle(len(out), func(i, j int) { out[i], out[j] = out[j], out[i] })
+	if int64(len(out)) > s.size {
+		out = out[:s.size]
+	}
+	return out, nil
+}
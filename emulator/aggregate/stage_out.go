@@ -0,0 +1,422 @@
+package aggregate
+
+import (
+	"strings"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/emulator/expr"
+	"github.com/achilleasa/mongolite/protocol"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// parseOutputTarget parses the target collection of $out and $merge which can
+// either be a collection name or a {db, coll} document. An empty database
+// name indicates the database of the aggregated collection.
+func parseOutputTarget(stageName string, spec interface{}) (protocol.NamespacedCollection, error) {
+	var target protocol.NamespacedCollection
+	switch val := spec.(type) {
+	case string:
+		target.Collection = val
+	default:
+		if !bsonutil.IsDocument(spec) {
+			return target, protocol.ServerErrorf(protocol.CodeTypeMismatch, "%s only supports a string or object argument, but found %s", stageName, bsonutil.TypeName(spec))
+		}
+		for _, elem := range bsonutil.Elements(spec) {
+			str, isString := elem.Value.(string)
+			switch {
+			case elem.Name != "db" && elem.Name != "coll":
+				return target, protocol.ServerErrorf(40415, "BSON field '%s.%s' is an unknown field.", stageName, elem.Name)
+			case !isString:
+				return target, protocol.ServerErrorf(protocol.CodeTypeMismatch, "BSON field '%s.%s' is the wrong type '%s', expected type 'string'", stageName, elem.Name, bsonutil.TypeName(elem.Value))
+			case elem.Name == "db":
+				target.Database = str
+			default:
+				target.Collection = str
+			}
+		}
+	}
+
+	switch {
+	case target.Collection == "":
+		return target, protocol.ServerErrorf(protocol.CodeInvalidNamespace, "Invalid %s target namespace: '%s'", stageName, target.String())
+	case strings.HasPrefix(target.Collection, "system."):
+		return target, protocol.ServerErrorf(17385, "Can't %s to special collection: %s", stageName, target.Collection)
+	case target.Database == "admin" || target.Database == "local" || target.Database == "config":
+		return target, protocol.ServerErrorf(31321, "Can't %s to internal database: %s", stageName, target.Database)
+	}
+	return target, nil
+}
+
+// resolveTarget fills in the database of an output target.
+func resolveTarget(env *Env, target protocol.NamespacedCollection) protocol.NamespacedCollection {
+	if target.Database == "" {
+		target.Database = env.Namespace.Database
+	}
+	return target
+}
+
+// outStage implements $out which replaces the contents of a collection with
+// the output of the pipeline.
+type outStage struct {
+	target protocol.NamespacedCollection
+}
+
+func parseOutStage(spec interface{}) (stage, error) {
+	target, err := parseOutputTarget("$out", spec)
+	if err != nil {
+		return nil, err
+	}
+	return &outStage{target: target}, nil
+}
+
+func (s *outStage) process(env *Env, docs []bson.D) ([]bson.D, error) {
+	if env.Writer == nil {
+		return nil, protocol.ServerErrorf(protocol.CodeIllegalOperation, "$out is not supported by this server")
+	}
+	target := resolveTarget(env, s.target)
+
+	var (
+		out = make([]bson.D, len(docs))
+		ids = make(map[string]bool, len(docs))
+	)
+	for i, doc := range docs {
+		doc = withID(doc)
+		id, _ := getField(doc, "_id")
+		key := groupKey(id)
+		if ids[key] {
+			return nil, protocol.ServerErrorf(protocol.CodeDuplicateKey, "E11000 duplicate key error collection: %s index: _id_ dup key: { _id: %v }", target.String(), id)
+		}
+		ids[key] = true
+		out[i] = doc
+	}
+
+	if err := env.Writer.ReplaceCollection(target, out); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// The supported values for the whenMatched option of $merge.
+const (
+	mergeReplace      = "replace"
+	mergeKeepExisting = "keepExisting"
+	mergeMerge        = "merge"
+	mergeFail         = "fail"
+	mergePipeline     = "pipeline"
+)
+
+// The supported values for the whenNotMatched option of $merge.
+const (
+	mergeInsert  = "insert"
+	mergeDiscard = "discard"
+)
+
+// mergeUpdateStages lists the stages that may be used by a whenMatched
+// pipeline.
+var mergeUpdateStages = map[string]bool{
+	"$addFields":   true,
+	"$set":         true,
+	"$project":     true,
+	"$unset":       true,
+	"$replaceRoot": true,
+	"$replaceWith": true,
+}
+
+// mergeStage implements $merge which merges the output of the pipeline into
+// a collection.
+//
+// The stage computes the complete set of writes before handing them over to
+// the Writer so that a failure (e.g. due to whenMatched: "fail") leaves the
+// target collection untouched.
+type mergeStage struct {
+	into           protocol.NamespacedCollection
+	on             []string
+	whenMatched    string
+	whenNotMatched string
+
+	pipeline *Pipeline
+	letNames []string
+	letExprs []expr.Expr
+}
+
+func parseMergeStage(spec interface{}) (stage, error) {
+	s := &mergeStage{
+		on:             []string{"_id"},
+		whenMatched:    mergeMerge,
+		whenNotMatched: mergeInsert,
+	}
+
+	if into, isString := spec.(string); isString {
+		target, err := parseOutputTarget("$merge", into)
+		if err != nil {
+			return nil, err
+		}
+		s.into = target
+		return s, nil
+	} else if !bsonutil.IsDocument(spec) {
+		return nil, protocol.ServerErrorf(51182, "$merge only supports a string or object argument, but found %s", bsonutil.TypeName(spec))
+	}
+
+	var (
+		hasInto bool
+		letSpec interface{}
+	)
+	for _, elem := range bsonutil.Elements(spec) {
+		var err error
+		switch elem.Name {
+		case "into":
+			s.into, err = parseOutputTarget("$merge", elem.Value)
+			hasInto = true
+		case "on":
+			s.on, err = parseMergeOn(elem.Value)
+		case "let":
+			if !bsonutil.IsDocument(elem.Value) {
+				return nil, protocol.ServerErrorf(protocol.CodeTypeMismatch, "BSON field '$merge.let' is the wrong type '%s', expected type 'object'", bsonutil.TypeName(elem.Value))
+			}
+			letSpec = elem.Value
+		case "whenMatched":
+			err = s.parseWhenMatched(elem.Value)
+		case "whenNotMatched":
+			mode, _ := elem.Value.(string)
+			switch mode {
+			case mergeInsert, mergeDiscard, mergeFail:
+				s.whenNotMatched = mode
+			default:
+				return nil, protocol.ServerErrorf(protocol.CodeBadValue, "Enumeration value '%v' for field '$merge.whenNotMatched' is not a valid value.", elem.Value)
+			}
+		default:
+			return nil, protocol.ServerErrorf(40415, "BSON field '$merge.%s' is an unknown field.", elem.Name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !hasInto {
+		return nil, protocol.ServerErrorf(40414, "BSON field '$merge.into' is missing but a required field")
+	}
+
+	if letSpec != nil {
+		if s.whenMatched != mergePipeline {
+			return nil, protocol.ServerErrorf(51199, "Cannot use 'let' variables with 'whenMatched: %s' mode", s.whenMatched)
+		}
+		for _, elem := range bsonutil.Elements(letSpec) {
+			if err := expr.ValidateUserVariableName(elem.Name); err != nil {
+				return nil, err
+			}
+			e, err := expr.Compile(elem.Value)
+			if err != nil {
+				return nil, err
+			}
+			s.letNames = append(s.letNames, elem.Name)
+			s.letExprs = append(s.letExprs, e)
+		}
+	} else if s.whenMatched == mergePipeline {
+		// By default, the pipeline can refer to the document being
+		// merged via $$new.
+		s.letNames = []string{"new"}
+		s.letExprs = []expr.Expr{expr.MustCompile("$$ROOT")}
+	}
+	return s, nil
+}
+
+func parseMergeOn(spec interface{}) ([]string, error) {
+	if field, isString := spec.(string); isString {
+		return []string{field}, nil
+	} else if !bsonutil.IsArray(spec) {
+		return nil, protocol.ServerErrorf(51186, "$merge 'on' field must be either a string or an array of strings, but found %s", bsonutil.TypeName(spec))
+	}
+
+	var fields []string
+	for _, v := range bsonutil.ToArray(spec) {
+		field, isString := v.(string)
+		if !isString {
+			return nil, protocol.ServerErrorf(51134, "$merge 'on' array elements must be strings, but found %s", bsonutil.TypeName(v))
+		}
+		fields = append(fields, field)
+	}
+	if len(fields) == 0 {
+		return nil, protocol.ServerErrorf(51187, "If explicitly specifying $merge 'on', must include at least one field")
+	}
+	return fields, nil
+}
+
+func (s *mergeStage) parseWhenMatched(spec interface{}) error {
+	if mode, isString := spec.(string); isString {
+		switch mode {
+		case mergeReplace, mergeKeepExisting, mergeMerge, mergeFail:
+			s.whenMatched = mode
+			return nil
+		}
+		return protocol.ServerErrorf(protocol.CodeBadValue, "Enumeration value '%s' for field '$merge.whenMatched' is not a valid value.", mode)
+	} else if !bsonutil.IsArray(spec) {
+		return protocol.ServerErrorf(51191, "$merge 'whenMatched' field must be either a string or an array, but found %s", bsonutil.TypeName(spec))
+	}
+
+	for _, item := range bsonutil.ToArray(spec) {
+		if elems := bsonutil.Elements(item); len(elems) == 1 && !mergeUpdateStages[elems[0].Name] {
+			return protocol.ServerErrorf(protocol.CodeInvalidOptions, "'whenMatched' pipeline may not contain the %s stage", elems[0].Name)
+		}
+	}
+
+	var err error
+	if s.pipeline, err = parseNestedPipeline(spec); err != nil {
+		return err
+	}
+	s.whenMatched = mergePipeline
+	return nil
+}
+
+func (s *mergeStage) process(env *Env, docs []bson.D) ([]bson.D, error) {
+	if env.Writer == nil {
+		return nil, protocol.ServerErrorf(protocol.CodeIllegalOperation, "$merge is not supported by this server")
+	}
+	into := resolveTarget(env, s.into)
+
+	// Collect the values of the on fields for each output document and
+	// fetch the documents that they match in a single query.
+	var (
+		out     = make([]bson.D, len(docs))
+		onVals  = make([][]interface{}, len(docs))
+		clauses = make([]interface{}, len(docs))
+	)
+	for i, doc := range docs {
+		if s.isOnID() {
+			doc = withID(doc)
+		}
+
+		clause := bson.M{}
+		for _, field := range s.on {
+			v, found := bsonutil.LookupPath(doc, field)
+			if !found || bsonutil.IsNull(v) || v == bson.Undefined || bsonutil.IsArray(v) {
+				return nil, protocol.ServerErrorf(51132, "$merge write error: 'on' field '%s' cannot be missing, null, undefined or an array", field)
+			}
+			onVals[i] = append(onVals[i], v)
+			clause[field] = bson.M{"$eq": v}
+		}
+		out[i], clauses[i] = doc, clause
+	}
+	if len(docs) == 0 {
+		return nil, nil
+	}
+
+	existing, err := env.Source.Find(into, bson.M{"$or": clauses})
+	if err != nil {
+		return nil, err
+	}
+	state := make(map[string]bson.D, len(existing))
+	for _, doc := range existing {
+		var vals []interface{}
+		for _, field := range s.on {
+			v, _ := bsonutil.LookupPath(doc, field)
+			vals = append(vals, v)
+		}
+		state[groupKey(vals)] = doc
+	}
+
+	// Apply the output documents in order. Writes to the same target
+	// document are coalesced so that only the final version is stored.
+	var (
+		writes   []bson.D
+		writeIdx = make(map[string]int)
+	)
+	for i, doc := range out {
+		key := groupKey(onVals[i])
+		target, matched := state[key]
+
+		var result bson.D
+		if matched {
+			if result, err = s.applyMatched(env, into, target, doc); err != nil {
+				return nil, err
+			} else if result == nil {
+				continue
+			}
+		} else {
+			switch s.whenNotMatched {
+			case mergeDiscard:
+				continue
+			case mergeFail:
+				return nil, protocol.ServerErrorf(13113, "$merge could not find a matching document in the target collection for at least one document in the source collection")
+			}
+			result = withID(doc)
+		}
+		state[key] = result
+
+		id, _ := getField(result, "_id")
+		idKey := groupKey(id)
+		if idx, found := writeIdx[idKey]; found {
+			writes[idx] = result
+			continue
+		}
+		writeIdx[idKey] = len(writes)
+		writes = append(writes, result)
+	}
+
+	if len(writes) == 0 {
+		return nil, nil
+	}
+	if err := env.Writer.WriteDocuments(into, writes); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// applyMatched returns the document that should replace target when it is
+// matched by doc. It returns a nil document if target should be left as-is.
+func (s *mergeStage) applyMatched(env *Env, into protocol.NamespacedCollection, target, doc bson.D) (bson.D, error) {
+	var result bson.D
+	switch s.whenMatched {
+	case mergeKeepExisting:
+		return nil, nil
+	case mergeFail:
+		id, _ := getField(target, "_id")
+		return nil, protocol.ServerErrorf(protocol.CodeDuplicateKey, "E11000 duplicate key error collection: %s index: _id_ dup key: { _id: %v }", into.String(), id)
+	case mergeReplace:
+		result = doc
+	case mergeMerge:
+		result = target
+		for _, elem := range doc {
+			result = setField(result, elem.Name, elem.Value)
+		}
+	case mergePipeline:
+		scope := env.Vars
+		docVars := env.varsFor(doc)
+		for i, name := range s.letNames {
+			v, err := s.letExprs[i].Eval(docVars)
+			if err != nil {
+				return nil, err
+			}
+			scope = scope.With(name, expr.Value(v))
+		}
+
+		res, err := s.pipeline.Process(env.withScope(into, scope), []bson.D{target})
+		if err != nil {
+			return nil, err
+		} else if len(res) != 1 {
+			return nil, protocol.ServerErrorf(protocol.CodeInternalError, "$merge 'whenMatched' pipeline must produce exactly one document, got %d", len(res))
+		}
+		result = res[0]
+	}
+
+	// The _id of matched documents cannot be modified.
+	targetID, _ := getField(target, "_id")
+	if id, found := getField(result, "_id"); !found {
+		result = append(bson.D{{Name: "_id", Value: targetID}}, result...)
+	} else if !bsonutil.Equal(id, targetID) {
+		return nil, protocol.ServerErrorf(protocol.CodeImmutableField, "$merge failed to update the matching document, did you attempt to modify the _id or the shard key?")
+	}
+	return result, nil
+}
+
+func (s *mergeStage) isOnID() bool {
+	return len(s.on) == 1 && s.on[0] == "_id"
+}
+
+// withID returns doc with a generated ObjectId as its _id if it does not
+// already have one.
+func withID(doc bson.D) bson.D {
+	if _, found := getField(doc, "_id"); found {
+		return doc
+	}
+	return append(bson.D{{Name: "_id", Value: bson.NewObjectId()}}, doc...)
+}
@@ -0,0 +1,515 @@
+package aggregate
+
+import (
+	"strings"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/emulator/expr"
+	"github.com/achilleasa/mongolite/protocol"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// projection is a tree describing the fields affected by a $project stage.
+type projection struct {
+	fields []*projField
+	byName map[string]*projField
+}
+
+type projField struct {
+	name string
+
+	// Set for fields that are included (e.g. {a: 1}) or excluded (e.g.
+	// {a: 0}) by the projection.
+	include, exclude bool
+
+	// Set for computed fields (e.g. {a: {$add: ["$b", 1]}}).
+	expr expr.Expr
+
+	// Set for fields with a nested projection (e.g. {a: {b: 1}}).
+	children *projection
+}
+
+func newProjection() *projection {
+	return &projection{byName: make(map[string]*projField)}
+}
+
+// field returns the field with the specified name, creating it if missing.
+func (p *projection) field(name string) *projField {
+	if f := p.byName[name]; f != nil {
+		return f
+	}
+	f := &projField{name: name}
+	p.fields = append(p.fields, f)
+	p.byName[name] = f
+	return f
+}
+
+func (p *projection) hasComputed() bool {
+	for _, f := range p.fields {
+		if f.expr != nil || (f.children != nil && f.children.hasComputed()) {
+			return true
+		}
+	}
+	return false
+}
+
+// projectStage implements $project (and $unset, which is an alias for an
+// exclusion projection).
+type projectStage struct {
+	proj      *projection
+	exclusion bool
+}
+
+func parseProjectStage(spec interface{}) (stage, error) {
+	if !bsonutil.IsDocument(spec) {
+		return nil, protocol.ServerErrorf(15969, "$project specification must be an object")
+	}
+
+	elems := bsonutil.Elements(spec)
+	if len(elems) == 0 {
+		return nil, protocol.ServerErrorf(51272, "Invalid $project :: caused by :: projection specification must have at least one field")
+	}
+
+	s := &projectStage{proj: newProjection()}
+	var inclusion, hasExclusion bool
+	if err := parseProjection(s.proj, "", elems, &inclusion, &hasExclusion); err != nil {
+		return nil, err
+	}
+
+	// Excluding _id is allowed in both inclusion and exclusion mode so a
+	// projection is in exclusion mode unless it includes any fields.
+	s.exclusion = !inclusion
+	if idField := s.proj.byName["_id"]; inclusion && idField == nil {
+		s.proj.field("_id").include = true
+	}
+	return s, nil
+}
+
+// parseProjection populates a projection tree from a list of specification
+// fields and keeps track of whether the specification uses inclusion or
+// exclusion mode.
+func parseProjection(proj *projection, prefix string, elems []bson.DocElem, inclusion, hasExclusion *bool) error {
+	for _, elem := range elems {
+		fullPath := prefix + elem.Name
+		if strings.HasPrefix(elem.Name, "$") {
+			return protocol.ServerErrorf(16410, "Invalid $project :: caused by :: FieldPath field names may not start with '$'.")
+		}
+
+		// Resolve dotted paths to nested projections.
+		target := proj
+		segs := splitPath(elem.Name)
+		for _, seg := range segs[:len(segs)-1] {
+			f := target.field(seg)
+			if f.children == nil {
+				if f.include || f.exclude || f.expr != nil {
+					return protocol.ServerErrorf(31250, "Invalid $project :: caused by :: Path collision at %s", fullPath)
+				}
+				f.children = newProjection()
+			}
+			target = f.children
+		}
+		f := target.field(segs[len(segs)-1])
+		if f.include || f.exclude || f.expr != nil || f.children != nil {
+			return protocol.ServerErrorf(31250, "Invalid $project :: caused by :: Path collision at %s", fullPath)
+		}
+
+		switch {
+		case isBoolOrNumber(elem.Value):
+			if expr.Truthy(elem.Value) {
+				if *hasExclusion && fullPath != "_id" {
+					return protocol.ServerErrorf(31253, "Invalid $project :: caused by :: Cannot do inclusion on field %s in exclusion projection", fullPath)
+				}
+				f.include = true
+				*inclusion = true
+			} else {
+				if *inclusion && fullPath != "_id" {
+					return protocol.ServerErrorf(31254, "Invalid $project :: caused by :: Cannot do exclusion on field %s in inclusion projection", fullPath)
+				}
+				f.exclude = true
+				if fullPath != "_id" {
+					*hasExclusion = true
+				}
+			}
+		case bsonutil.IsDocument(elem.Value) && !isOperatorDoc(elem.Value):
+			sub := bsonutil.Elements(elem.Value)
+			if len(sub) == 0 {
+				return protocol.ServerErrorf(51270, "Invalid $project :: caused by :: An empty sub-projection is not a valid value. Found empty object at path")
+			}
+			f.children = newProjection()
+			if err := parseProjection(f.children, fullPath+".", sub, inclusion, hasExclusion); err != nil {
+				return err
+			}
+		default:
+			if *hasExclusion {
+				return protocol.ServerErrorf(31252, "Invalid $project :: caused by :: Cannot use expression other than $meta in exclusion projection")
+			}
+			e, err := expr.Compile(elem.Value)
+			if err != nil {
+				return err
+			}
+			f.expr = e
+			*inclusion = true
+		}
+	}
+	return nil
+}
+
+func isBoolOrNumber(v interface{}) bool {
+	if _, isBool := v.(bool); isBool {
+		return true
+	}
+	return bsonutil.IsNumber(v)
+}
+
+func isOperatorDoc(v interface{}) bool {
+	elems := bsonutil.Elements(v)
+	return len(elems) != 0 && strings.HasPrefix(elems[0].Name, "$")
+}
+
+func (s *projectStage) process(env *Env, docs []bson.D) ([]bson.D, error) {
+	out := make([]bson.D, 0, len(docs))
+	for _, doc := range docs {
+		if s.exclusion {
+			out = append(out, applyExclusion(doc, s.proj))
+			continue
+		}
+
+		projected, err := applyInclusion(doc, s.proj, env.varsFor(doc))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, projected)
+	}
+	return out, nil
+}
+
+// applyInclusion builds a document with the included fields of doc (in
+// document order) followed by the computed fields (in specification order).
+func applyInclusion(doc bson.D, proj *projection, vars *expr.Vars) (bson.D, error) {
+	out := make(bson.D, 0, len(proj.fields))
+	for _, elem := range doc {
+		f := proj.byName[elem.Name]
+		if f == nil || f.expr != nil {
+			continue
+		}
+
+		switch {
+		case f.include:
+			out = append(out, elem)
+		case f.children != nil:
+			v, err := applyNestedInclusion(elem.Value, f.children, vars)
+			if err != nil {
+				return nil, err
+			} else if !expr.IsMissing(v) {
+				out = append(out, bson.DocElem{Name: elem.Name, Value: v})
+			}
+		}
+	}
+
+	for _, f := range proj.fields {
+		switch {
+		case f.expr != nil:
+			v, err := f.expr.Eval(vars)
+			if err != nil {
+				return nil, err
+			} else if !expr.IsMissing(v) {
+				out = setField(out, f.name, v)
+			}
+		case f.children != nil && f.children.hasComputed():
+			if _, found := getField(out, f.name); found {
+				continue // already handled above
+			}
+			// Computed fields are added even if the parent field
+			// is missing.
+			v, err := applyInclusion(bson.D{}, f.children, vars)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, bson.DocElem{Name: f.name, Value: v})
+		}
+	}
+	return out, nil
+}
+
+// applyNestedInclusion applies a nested inclusion projection to a field value.
+// Arrays are projected element-wise.
+func applyNestedInclusion(v interface{}, proj *projection, vars *expr.Vars) (interface{}, error) {
+	switch {
+	case bsonutil.IsDocument(v):
+		return applyInclusion(ToDocument(v), proj, vars)
+	case bsonutil.IsArray(v):
+		out := []interface{}{}
+		for _, elem := range bsonutil.ToArray(v) {
+			if !bsonutil.IsDocument(elem) && !bsonutil.IsArray(elem) && !proj.hasComputed() {
+				continue
+			}
+			res, err := applyNestedInclusion(elem, proj, vars)
+			if err != nil {
+				return nil, err
+			} else if !expr.IsMissing(res) {
+				out = append(out, res)
+			}
+		}
+		return out, nil
+	case proj.hasComputed():
+		return applyInclusion(bson.D{}, proj, vars)
+	}
+	return expr.Missing, nil
+}
+
+// applyExclusion returns a copy of doc without the excluded fields.
+func applyExclusion(doc bson.D, proj *projection) bson.D {
+	out := make(bson.D, 0, len(doc))
+	for _, elem := range doc {
+		f := proj.byName[elem.Name]
+		switch {
+		case f == nil:
+			out = append(out, elem)
+		case f.exclude:
+		case f.children != nil:
+			out = append(out, bson.DocElem{Name: elem.Name, Value: applyNestedExclusion(elem.Value, f.children)})
+		default:
+			out = append(out, elem)
+		}
+	}
+	return out
+}
+
+func applyNestedExclusion(v interface{}, proj *projection) interface{} {
+	switch {
+	case bsonutil.IsDocument(v):
+		return applyExclusion(ToDocument(v), proj)
+	case bsonutil.IsArray(v):
+		arr := bsonutil.ToArray(v)
+		out := make([]interface{}, len(arr))
+		for i, elem := range arr {
+			out[i] = applyNestedExclusion(elem, proj)
+		}
+		return out
+	}
+	return v
+}
+
+func parseUnsetStage(spec interface{}) (stage, error) {
+	var paths []interface{}
+	if s, isString := spec.(string); isString {
+		paths = []interface{}{s}
+	} else if bsonutil.IsArray(spec) {
+		paths = bsonutil.ToArray(spec)
+	} else {
+		return nil, protocol.ServerErrorf(31002, "$unset specification must be a string or an array")
+	}
+
+	if len(paths) == 0 {
+		return nil, protocol.ServerErrorf(31119, "$unset specification must be a string or an array with at least one field")
+	}
+
+	exclusion := make(bson.D, len(paths))
+	for i, path := range paths {
+		name, isString := path.(string)
+		if !isString {
+			return nil, protocol.ServerErrorf(31120, "$unset specification must be a string or an array containing only string values")
+		}
+		exclusion[i] = bson.DocElem{Name: name, Value: 0}
+	}
+	return parseProjectStage(exclusion)
+}
+
+// addFieldsStage implements $addFields (and its $set alias).
+type addFieldsStage struct {
+	fields []*addField
+}
+
+type addField struct {
+	name string
+
+	// Set if the field value is computed by an expression.
+	expr expr.Expr
+
+	// Set for nested specifications (e.g. {a: {b: 1}} or {"a.b": 1})
+	// which are merged into existing embedded documents.
+	children []*addField
+}
+
+func parseAddFieldsStage(spec interface{}) (stage, error) {
+	if !bsonutil.IsDocument(spec) {
+		return nil, protocol.ServerErrorf(40272, "$addFields specification stage must be an object")
+	}
+
+	fields, err := parseAddFields(bsonutil.Elements(spec))
+	if err != nil {
+		return nil, err
+	}
+	return &addFieldsStage{fields: fields}, nil
+}
+
+func parseAddFields(elems []bson.DocElem) ([]*addField, error) {
+	var (
+		fields []*addField
+		byName = make(map[string]*addField)
+	)
+
+	lookup := func(list *[]*addField, names map[string]*addField, name string) *addField {
+		if f := names[name]; f != nil {
+			return f
+		}
+		f := &addField{name: name}
+		*list = append(*list, f)
+		names[name] = f
+		return f
+	}
+
+	for _, elem := range elems {
+		if strings.HasPrefix(elem.Name, "$") {
+			return nil, protocol.ServerErrorf(16410, "Invalid $addFields :: caused by :: FieldPath field names may not start with '$'.")
+		}
+
+		segs := splitPath(elem.Name)
+		list, names := &fields, byName
+		var f *addField
+		for i, seg := range segs {
+			f = lookup(list, names, seg)
+			if i == len(segs)-1 {
+				break
+			}
+			if f.expr != nil {
+				return nil, protocol.ServerErrorf(31250, "Invalid $addFields :: caused by :: Path collision at %s", elem.Name)
+			}
+			list, names = &f.children, make(map[string]*addField)
+			for _, child := range f.children {
+				names[child.name] = child
+			}
+		}
+
+		if f.expr != nil || f.children != nil {
+			return nil, protocol.ServerErrorf(31250, "Invalid $addFields :: caused by :: Path collision at %s", elem.Name)
+		}
+
+		if bsonutil.IsDocument(elem.Value) && !isOperatorDoc(elem.Value) && len(bsonutil.Elements(elem.Value)) != 0 {
+			children, err := parseAddFields(bsonutil.Elements(elem.Value))
+			if err != nil {
+				return nil, err
+			}
+			f.children = children
+			continue
+		}
+
+		e, err := expr.Compile(elem.Value)
+		if err != nil {
+			return nil, err
+		}
+		f.expr = e
+	}
+	return fields, nil
+}
+
+func (s *addFieldsStage) process(env *Env, docs []bson.D) ([]bson.D, error) {
+	out := make([]bson.D, 0, len(docs))
+	for _, doc := range docs {
+		res, err := applyAddFields(doc, s.fields, env.varsFor(doc))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, res)
+	}
+	return out, nil
+}
+
+// applyAddFields returns a copy of doc with the specified fields added or
+// replaced. Fields whose expressions evaluate to a missing value (e.g.
+// $$REMOVE) are removed from the document.
+func applyAddFields(doc bson.D, fields []*addField, vars *expr.Vars) (bson.D, error) {
+	for _, f := range fields {
+		if f.expr != nil {
+			v, err := f.expr.Eval(vars)
+			if err != nil {
+				return nil, err
+			}
+			if expr.IsMissing(v) {
+				doc = removeField(doc, f.name)
+			} else {
+				doc = setField(doc, f.name, v)
+			}
+			continue
+		}
+
+		cur, _ := getField(doc, f.name)
+		v, err := applyNestedAddFields(cur, f.children, vars)
+		if err != nil {
+			return nil, err
+		}
+		doc = setField(doc, f.name, v)
+	}
+	return doc, nil
+}
+
+func applyNestedAddFields(v interface{}, fields []*addField, vars *expr.Vars) (interface{}, error) {
+	switch {
+	case bsonutil.IsDocument(v):
+		return applyAddFields(ToDocument(v), fields, vars)
+	case bsonutil.IsArray(v):
+		arr := bsonutil.ToArray(v)
+		out := make([]interface{}, len(arr))
+		for i, elem := range arr {
+			res, err := applyNestedAddFields(elem, fields, vars)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = res
+		}
+		return out, nil
+	}
+	return applyAddFields(bson.D{}, fields, vars)
+}
+
+// replaceRootStage implements $replaceRoot (and its $replaceWith alias) which
+// replaces each document with the result of an expression.
+type replaceRootStage struct {
+	newRoot expr.Expr
+}
+
+func parseReplaceRootStage(spec interface{}) (stage, error) {
+	if !bsonutil.IsDocument(spec) {
+		return nil, protocol.ServerErrorf(40229, "expected an object as specification for $replaceRoot stage, got %s", bsonutil.TypeName(spec))
+	}
+
+	var newRoot interface{}
+	for _, elem := range bsonutil.Elements(spec) {
+		if elem.Name != "newRoot" {
+			return nil, protocol.ServerErrorf(40415, "BSON field '$replaceRoot.%s' is an unknown field.", elem.Name)
+		}
+		newRoot = elem.Value
+	}
+	if newRoot == nil {
+		return nil, protocol.ServerErrorf(40414, "BSON field '$replaceRoot.newRoot' is missing but a required field")
+	}
+	return parseReplaceWithStage(newRoot)
+}
+
+func parseReplaceWithStage(spec interface{}) (stage, error) {
+	newRoot, err := expr.Compile(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &replaceRootStage{newRoot: newRoot}, nil
+}
+
+func (s *replaceRootStage) process(env *Env, docs []bson.D) ([]bson.D, error) {
+	out := make([]bson.D, len(docs))
+	for i, doc := range docs {
+		v, err := s.newRoot.Eval(env.varsFor(doc))
+		if err != nil {
+			return nil, err
+		}
+
+		if !bsonutil.IsDocument(v) {
+			typ := bsonutil.TypeName(v)
+			if expr.IsMissing(v) {
+				typ = "missing"
+			}
+			return nil, protocol.ServerErrorf(40228, "'newRoot' expression must evaluate to an object, but resulting value was: %v. Type of resulting value: '%s'. Input document: %v", expr.Value(v), typ, doc)
+		}
+		out[i] = ToDocument(v)
+	}
+	return out, nil
+}
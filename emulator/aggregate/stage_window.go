@@ -0,0 +1,932 @@
+package aggregate
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/emulator/expr"
+	"github.com/achilleasa/mongolite/protocol"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func windowMemoryLimitError(limit int64) error {
+	return protocol.ServerErrorf(5414201, "Exceeded memory limit in DocumentSourceSetWindowFields, max allowed is %d bytes. Pass allowDiskUse:true to opt in.", limit)
+}
+
+// windowPartition holds the documents of a $setWindowFields partition in sort
+// order.
+type windowPartition struct {
+	docs   []bson.D
+	vars   []*expr.Vars
+	sortBy SortSpec
+
+	// The value of the first sortBy field for each document. Range-based
+	// windows and the functions that operate on the sort order (e.g.
+	// $derivative) use it as the position of each document.
+	sortValues []interface{}
+}
+
+// windowFunc is implemented by the functions that can be used in the output
+// of $setWindowFields.
+type windowFunc interface {
+	// compute returns the output value for each document in a partition.
+	compute(p *windowPartition) ([]interface{}, error)
+}
+
+// setWindowFieldsStage implements $setWindowFields which adds fields computed
+// over a window of documents in the same partition.
+type setWindowFieldsStage struct {
+	partitionBy expr.Expr
+	sortBy      SortSpec
+	paths       [][]string
+	funcs       []windowFunc
+}
+
+func parseSetWindowFieldsStage(spec interface{}) (stage, error) {
+	if !bsonutil.IsDocument(spec) {
+		return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "the $setWindowFields stage specification must be an object, found %s", bsonutil.TypeName(spec))
+	}
+
+	var (
+		s      = new(setWindowFieldsStage)
+		output interface{}
+		err    error
+	)
+	for _, elem := range bsonutil.Elements(spec) {
+		switch elem.Name {
+		case "partitionBy":
+			if s.partitionBy, err = expr.Compile(elem.Value); err != nil {
+				return nil, err
+			}
+		case "sortBy":
+			if s.sortBy, err = ParseSort(elem.Value); err != nil {
+				return nil, err
+			}
+		case "output":
+			if !bsonutil.IsDocument(elem.Value) {
+				return nil, protocol.ServerErrorf(protocol.CodeTypeMismatch, "BSON field '$setWindowFields.output' is the wrong type '%s', expected type 'object'", bsonutil.TypeName(elem.Value))
+			}
+			output = elem.Value
+		default:
+			return nil, protocol.ServerErrorf(40415, "BSON field '$setWindowFields.%s' is an unknown field.", elem.Name)
+		}
+	}
+
+	if output == nil {
+		return nil, protocol.ServerErrorf(40414, "BSON field '$setWindowFields.output' is missing but a required field")
+	}
+	for _, elem := range bsonutil.Elements(output) {
+		if elem.Name == "" || strings.HasPrefix(elem.Name, "$") {
+			return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "FieldPath field names may not start with '$': %s", elem.Name)
+		}
+
+		fn, err := parseWindowFunc(elem.Value, s.sortBy)
+		if err != nil {
+			return nil, err
+		}
+		s.paths = append(s.paths, splitPath(elem.Name))
+		s.funcs = append(s.funcs, fn)
+	}
+	return s, nil
+}
+
+func (s *setWindowFieldsStage) process(env *Env, docs []bson.D) ([]bson.D, error) {
+	partitions, err := s.partition(env, docs)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]bson.D, 0, len(docs))
+	for _, p := range partitions {
+		results := make([][]interface{}, len(s.funcs))
+		for i, fn := range s.funcs {
+			if results[i], err = fn.compute(p); err != nil {
+				return nil, err
+			}
+		}
+
+		for i, doc := range p.docs {
+			for j, path := range s.paths {
+				doc = setPath(doc, path, expr.Value(results[j][i]))
+			}
+			out = append(out, doc)
+		}
+	}
+	return out, nil
+}
+
+// partition splits docs into partitions which are ordered by their partition
+// key. The documents of each partition are sorted using the sortBy spec.
+func (s *setWindowFieldsStage) partition(env *Env, docs []bson.D) ([]*windowPartition, error) {
+	var (
+		partitions []*windowPartition
+		keys       []interface{}
+		byKey      = make(map[string]*windowPartition)
+		mem        = env.newMemoryTracker(windowMemoryLimitError)
+	)
+	for _, doc := range docs {
+		if err := mem.add(doc); err != nil {
+			return nil, err
+		}
+
+		var key interface{}
+		if s.partitionBy != nil {
+			v, err := s.partitionBy.Eval(env.varsFor(doc))
+			if err != nil {
+				return nil, err
+			}
+			key = expr.Value(v)
+		}
+
+		p := byKey[groupKey(key)]
+		if p == nil {
+			p = &windowPartition{sortBy: s.sortBy}
+			byKey[groupKey(key)] = p
+			partitions = append(partitions, p)
+			keys = append(keys, key)
+		}
+		p.docs = append(p.docs, doc)
+	}
+
+	sort.Stable(partitionsByKey{partitions: partitions, keys: keys})
+	for _, p := range partitions {
+		s.sortBy.Sort(p.docs)
+		p.vars = make([]*expr.Vars, len(p.docs))
+		p.sortValues = make([]interface{}, len(p.docs))
+		for i, doc := range p.docs {
+			p.vars[i] = env.varsFor(doc)
+			if len(s.sortBy) != 0 {
+				p.sortValues[i], _ = bsonutil.LookupPath(doc, s.sortBy[0].Path)
+			}
+		}
+	}
+	return partitions, nil
+}
+
+// partitionsByKey sorts a list of partitions by their partition key.
+type partitionsByKey struct {
+	partitions []*windowPartition
+	keys       []interface{}
+}
+
+func (p partitionsByKey) Len() int { return len(p.partitions) }
+func (p partitionsByKey) Less(i, j int) bool {
+	return bsonutil.Compare(p.keys[i], p.keys[j]) < 0
+}
+func (p partitionsByKey) Swap(i, j int) {
+	p.partitions[i], p.partitions[j] = p.partitions[j], p.partitions[i]
+	p.keys[i], p.keys[j] = p.keys[j], p.keys[i]
+}
+
+// windowBound describes the lower or upper bound of a window.
+type windowBound struct {
+	unbounded bool
+	offset    float64
+}
+
+// windowBounds describes the documents that a window function operates on.
+// Document-based windows are defined by offsets relative to the position of
+// the current document while range-based windows are defined by offsets
+// relative to the value of its sortBy field.
+type windowBounds struct {
+	isRange      bool
+	lower, upper windowBound
+	unit         string
+}
+
+func parseWindowBounds(spec interface{}, sortBy SortSpec) (*windowBounds, error) {
+	if !bsonutil.IsDocument(spec) {
+		return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "'window' field must be an object")
+	}
+
+	var (
+		w         = new(windowBounds)
+		boundSpec interface{}
+		numBounds int
+	)
+	for _, elem := range bsonutil.Elements(spec) {
+		switch elem.Name {
+		case "documents", "range":
+			w.isRange = elem.Name == "range"
+			boundSpec = elem.Value
+			numBounds++
+		case "unit":
+			unit, isString := elem.Value.(string)
+			if !isString || !expr.IsDateUnit(unit) {
+				return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "'window.unit' must be one of: year, quarter, month, week, day, hour, minute, second, millisecond")
+			}
+			w.unit = unit
+		default:
+			return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "'window' field that is not 'documents', 'range' or 'unit': %s", elem.Name)
+		}
+	}
+
+	switch {
+	case numBounds != 1:
+		return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "'window' field must specify exactly one of 'documents' or 'range'")
+	case w.unit != "" && !w.isRange:
+		return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "Window bounds can only specify 'unit' with range-based bounds")
+	case !bsonutil.IsArray(boundSpec) || len(bsonutil.ToArray(boundSpec)) != 2:
+		return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "Window bounds must be a 2-element array: %v", boundSpec)
+	case w.isRange && len(sortBy) != 1:
+		return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "Range-based bounds require sortBy a single field")
+	case !w.isRange && len(sortBy) == 0 && !isUnboundedSpec(boundSpec):
+		return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "Document-based bounds require a sortBy")
+	}
+
+	bounds := bsonutil.ToArray(boundSpec)
+	var err error
+	if w.lower, err = parseWindowBound(bounds[0], w.isRange); err != nil {
+		return nil, err
+	}
+	if w.upper, err = parseWindowBound(bounds[1], w.isRange); err != nil {
+		return nil, err
+	}
+	if !w.lower.unbounded && !w.upper.unbounded && w.lower.offset > w.upper.offset {
+		return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "Lower bound must not exceed upper bound: %v", boundSpec)
+	}
+	return w, nil
+}
+
+func isUnboundedSpec(spec interface{}) bool {
+	for _, v := range bsonutil.ToArray(spec) {
+		if v != "unbounded" {
+			return false
+		}
+	}
+	return true
+}
+
+func parseWindowBound(spec interface{}, isRange bool) (windowBound, error) {
+	switch spec {
+	case "unbounded":
+		return windowBound{unbounded: true}, nil
+	case "current":
+		return windowBound{}, nil
+	}
+
+	f, isNum := bsonutil.ToFloat64(spec)
+	if !isNum {
+		return windowBound{}, protocol.ServerErrorf(protocol.CodeFailedToParse, "Window bounds must be 'unbounded', 'current', or a number: %v", spec)
+	} else if _, isInt := bsonutil.ToInt64(spec); !isRange && !isInt {
+		return windowBound{}, protocol.ServerErrorf(protocol.CodeFailedToParse, "Numeric document-based bounds must be an integer: %v", spec)
+	}
+	return windowBound{offset: f}, nil
+}
+
+// indices returns the indices of the documents in the window for the
+// document at position i. A nil window spans the entire partition.
+func (w *windowBounds) indices(p *windowPartition, i int) ([]int, error) {
+	lo, hi := 0, len(p.docs)-1
+	if w != nil && !w.isRange {
+		if !w.lower.unbounded {
+			lo = i + int(w.lower.offset)
+		}
+		if !w.upper.unbounded {
+			hi = i + int(w.upper.offset)
+		}
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > len(p.docs)-1 {
+			hi = len(p.docs) - 1
+		}
+	}
+
+	var out []int
+	for j := lo; j <= hi; j++ {
+		if w != nil && w.isRange {
+			in, err := w.inRange(p.sortValues[i], p.sortValues[j])
+			if err != nil {
+				return nil, err
+			} else if !in {
+				continue
+			}
+		}
+		out = append(out, j)
+	}
+	return out, nil
+}
+
+// inRange returns true if v falls within the range window of a document
+// whose sortBy value is cur.
+func (w *windowBounds) inRange(cur, v interface{}) (bool, error) {
+	if err := w.checkRangeValue(cur); err != nil {
+		return false, err
+	} else if err := w.checkRangeValue(v); err != nil {
+		return false, err
+	}
+
+	bound := func(b windowBound) interface{} {
+		if t, isTime := cur.(time.Time); isTime {
+			return expr.AddDate(t, w.unit, int64(b.offset))
+		}
+		f, _ := bsonutil.ToFloat64(cur)
+		return f + b.offset
+	}
+	if !w.lower.unbounded && bsonutil.Compare(v, bound(w.lower)) < 0 {
+		return false, nil
+	}
+	if !w.upper.unbounded && bsonutil.Compare(v, bound(w.upper)) > 0 {
+		return false, nil
+	}
+	return true, nil
+}
+
+func (w *windowBounds) checkRangeValue(v interface{}) error {
+	if _, isTime := v.(time.Time); isTime {
+		if w.unit == "" {
+			return protocol.ServerErrorf(5429513, "Invalid range: Expected the sortBy field to be a number, but it was Date")
+		}
+		return nil
+	} else if !bsonutil.IsNumber(v) {
+		return protocol.ServerErrorf(5429513, "Invalid range: Expected the sortBy field to be a number or a date, but it was %s", bsonutil.TypeName(v))
+	} else if w.unit != "" {
+		return protocol.ServerErrorf(5429513, "Invalid range: Expected the sortBy field to be a date, but it was %s", bsonutil.TypeName(v))
+	}
+	return nil
+}
+
+// parseWindowFunc parses the specification of a $setWindowFields output field
+// (e.g. {$sum: "$qty", window: {documents: [-1, 0]}}).
+func parseWindowFunc(spec interface{}, sortBy SortSpec) (windowFunc, error) {
+	if !bsonutil.IsDocument(spec) {
+		return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "The field must be an object: %v", spec)
+	}
+
+	var (
+		op, windowSpec, args interface{}
+		bounds               *windowBounds
+	)
+	for _, elem := range bsonutil.Elements(spec) {
+		switch {
+		case elem.Name == "window":
+			windowSpec = elem.Value
+		case strings.HasPrefix(elem.Name, "$") && op == nil:
+			op, args = elem.Name, elem.Value
+		default:
+			return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "Window function found an unknown argument: %s", elem.Name)
+		}
+	}
+	if op == nil {
+		return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "Expected a $-prefixed window function, got %v", spec)
+	}
+	name := op.(string)
+
+	if windowSpec != nil {
+		if noWindowFuncs[name] {
+			return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "'window' field is not allowed in %s", name)
+		}
+		var err error
+		if bounds, err = parseWindowBounds(windowSpec, sortBy); err != nil {
+			return nil, err
+		}
+	}
+
+	if sortedWindowFuncs[name] && len(sortBy) == 0 {
+		return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "%s requires a sortBy", name)
+	} else if singleSortWindowFuncs[name] && len(sortBy) != 1 {
+		return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "%s must be specified with a top level sortBy expression with exactly one element", name)
+	}
+
+	switch name {
+	case "$count":
+		if !bsonutil.IsDocument(args) || len(bsonutil.Elements(args)) != 0 {
+			return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "$count only accepts an empty object as input")
+		}
+		return &accumulatorWindowFunc{op: "$sum", arg: expr.MustCompile(1), bounds: bounds}, nil
+	case "$rank", "$denseRank", "$documentNumber":
+		if !bsonutil.IsDocument(args) || len(bsonutil.Elements(args)) != 0 {
+			return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "%s must be specified with '{}' as the value", name)
+		}
+		return rankWindowFunc(name), nil
+	case "$covariancePop", "$covarianceSamp":
+		return parseCovarianceWindowFunc(name, args, bounds)
+	case "$derivative", "$integral":
+		return parseCalculusWindowFunc(name, args, bounds)
+	case "$expMovingAvg":
+		return parseExpMovingAvgWindowFunc(args)
+	case "$shift":
+		return parseShiftWindowFunc(args)
+	case "$locf", "$linearFill":
+		input, err := expr.Compile(args)
+		if err != nil {
+			return nil, err
+		}
+		if name == "$locf" {
+			return locfWindowFunc{input: input}, nil
+		}
+		return linearFillWindowFunc{input: input}, nil
+	}
+
+	if !expr.IsAccumulator(name) {
+		return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "Unrecognized window function, %s", name)
+	}
+	arg, err := expr.Compile(args)
+	if err != nil {
+		return nil, err
+	}
+	return &accumulatorWindowFunc{op: name, arg: arg, bounds: bounds}, nil
+}
+
+// noWindowFuncs lists the window functions that do not accept a window.
+var noWindowFuncs = map[string]bool{
+	"$rank":           true,
+	"$denseRank":      true,
+	"$documentNumber": true,
+	"$shift":          true,
+	"$expMovingAvg":   true,
+	"$locf":           true,
+	"$linearFill":     true,
+}
+
+// sortedWindowFuncs lists the window functions that require a sortBy.
+var sortedWindowFuncs = map[string]bool{
+	"$rank":           true,
+	"$denseRank":      true,
+	"$documentNumber": true,
+	"$shift":          true,
+	"$expMovingAvg":   true,
+	"$derivative":     true,
+	"$integral":       true,
+}
+
+// singleSortWindowFuncs lists the window functions that require a sortBy with
+// a single field.
+var singleSortWindowFuncs = map[string]bool{
+	"$rank":       true,
+	"$denseRank":  true,
+	"$derivative": true,
+	"$integral":   true,
+	"$linearFill": true,
+}
+
+// accumulatorWindowFunc applies a group accumulator (e.g. $sum) to the
+// documents in a window.
+type accumulatorWindowFunc struct {
+	op     string
+	arg    expr.Expr
+	bounds *windowBounds
+}
+
+func (f *accumulatorWindowFunc) compute(p *windowPartition) ([]interface{}, error) {
+	out := make([]interface{}, len(p.docs))
+	for i := range p.docs {
+		// Windows spanning the entire partition produce the same value
+		// for every document.
+		if f.bounds == nil && i > 0 {
+			out[i] = out[0]
+			continue
+		}
+
+		idxs, err := f.bounds.indices(p, i)
+		if err != nil {
+			return nil, err
+		}
+
+		acc, _ := expr.NewAccumulator(f.op)
+		for _, idx := range idxs {
+			v, err := f.arg.Eval(p.vars[idx])
+			if err != nil {
+				return nil, err
+			}
+			if err := acc.Add(v); err != nil {
+				return nil, err
+			}
+		}
+		out[i] = acc.Result()
+	}
+	return out, nil
+}
+
+// rankWindowFunc implements $rank, $denseRank and $documentNumber.
+type rankWindowFunc string
+
+func (f rankWindowFunc) compute(p *windowPartition) ([]interface{}, error) {
+	out := make([]interface{}, len(p.docs))
+	rank, dense := 0, 0
+	for i, doc := range p.docs {
+		if i == 0 || p.sortBy.Compare(doc, p.docs[i-1]) != 0 {
+			rank, dense = i+1, dense+1
+		}
+
+		switch f {
+		case "$rank":
+			out[i] = rank
+		case "$denseRank":
+			out[i] = dense
+		default:
+			out[i] = i + 1
+		}
+	}
+	return out, nil
+}
+
+// shiftWindowFunc implements $shift which returns the value of an expression
+// for the document at a fixed offset from the current document.
+type shiftWindowFunc struct {
+	output       expr.Expr
+	by           int
+	defaultValue interface{}
+}
+
+func parseShiftWindowFunc(spec interface{}) (windowFunc, error) {
+	if !bsonutil.IsDocument(spec) {
+		return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "Argument to $shift must be an object")
+	}
+
+	var (
+		f           = new(shiftWindowFunc)
+		hasOutput   bool
+		hasBy       bool
+		defaultSpec interface{}
+	)
+	for _, elem := range bsonutil.Elements(spec) {
+		var err error
+		switch elem.Name {
+		case "output":
+			f.output, err = expr.Compile(elem.Value)
+			hasOutput = true
+		case "by":
+			by, isInt := bsonutil.ToInt64(elem.Value)
+			if !isInt || by > math.MaxInt32 || by < math.MinInt32 {
+				return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "$shift's 'by' field must be an integer, but found %v", elem.Value)
+			}
+			f.by, hasBy = int(by), true
+		case "default":
+			defaultSpec = elem.Value
+		default:
+			return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "Unknown argument in $shift: %s", elem.Name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !hasOutput || !hasBy {
+		return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "$shift requires an 'output' and a 'by' field")
+	}
+	if defaultSpec != nil {
+		e, err := expr.Compile(defaultSpec)
+		if err != nil {
+			return nil, err
+		} else if !expr.IsConstant(e) {
+			return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "$shift's default expression must be a constant")
+		}
+		if f.defaultValue, err = e.Eval(expr.NewVars(nil)); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (f *shiftWindowFunc) compute(p *windowPartition) ([]interface{}, error) {
+	out := make([]interface{}, len(p.docs))
+	for i := range p.docs {
+		j := i + f.by
+		if j < 0 || j >= len(p.docs) {
+			out[i] = f.defaultValue
+			continue
+		}
+
+		v, err := f.output.Eval(p.vars[j])
+		if err != nil {
+			return nil, err
+		} else if expr.IsMissing(v) {
+			v = nil
+		}
+		out[i] = v
+	}
+	return out, nil
+}
+
+// expMovingAvgWindowFunc implements $expMovingAvg.
+type expMovingAvgWindowFunc struct {
+	input expr.Expr
+	alpha float64
+}
+
+func parseExpMovingAvgWindowFunc(spec interface{}) (windowFunc, error) {
+	if !bsonutil.IsDocument(spec) {
+		return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "$expMovingAvg must have exactly one argument that is an object")
+	}
+
+	var (
+		f                = new(expMovingAvgWindowFunc)
+		hasN, hasAlpha   bool
+		inputSpec        interface{}
+		hasInput         bool
+		nValue, alphaVal interface{}
+	)
+	for _, elem := range bsonutil.Elements(spec) {
+		switch elem.Name {
+		case "input":
+			inputSpec, hasInput = elem.Value, true
+		case "N":
+			nValue, hasN = elem.Value, true
+		case "alpha":
+			alphaVal, hasAlpha = elem.Value, true
+		default:
+			return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "Got unrecognized field in $expMovingAvg, $expMovingAvg sub object must have exactly two fields: An 'input' field, and either an 'N' field or an 'alpha' field")
+		}
+	}
+
+	if !hasInput || hasN == hasAlpha {
+		return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "$expMovingAvg sub object must have exactly two fields: An 'input' field, and either an 'N' field or an 'alpha' field")
+	}
+
+	if hasN {
+		n, isInt := bsonutil.ToInt64(nValue)
+		if !isInt || n <= 0 {
+			return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "'N' field must be an integer greater than zero, but found: %v", nValue)
+		}
+		f.alpha = 2 / (float64(n) + 1)
+	} else {
+		alpha, isNum := bsonutil.ToFloat64(alphaVal)
+		if !isNum || alpha <= 0 || alpha >= 1 {
+			return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "'alpha' must be between 0 and 1 (exclusive), found %v", alphaVal)
+		}
+		f.alpha = alpha
+	}
+
+	var err error
+	if f.input, err = expr.Compile(inputSpec); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *expMovingAvgWindowFunc) compute(p *windowPartition) ([]interface{}, error) {
+	var (
+		out = make([]interface{}, len(p.docs))
+		avg interface{}
+	)
+	for i := range p.docs {
+		v, err := f.input.Eval(p.vars[i])
+		if err != nil {
+			return nil, err
+		}
+
+		x, isNum := bsonutil.ToFloat64(v)
+		if !isNum {
+			continue
+		}
+		if avg == nil {
+			avg = x
+		} else {
+			avg = f.alpha*x + (1-f.alpha)*avg.(float64)
+		}
+		out[i] = avg
+	}
+	return out, nil
+}
+
+// covarianceWindowFunc implements $covariancePop and $covarianceSamp.
+type covarianceWindowFunc struct {
+	x, y   expr.Expr
+	sample bool
+	bounds *windowBounds
+}
+
+func parseCovarianceWindowFunc(name string, spec interface{}, bounds *windowBounds) (windowFunc, error) {
+	args := bsonutil.ToArray(spec)
+	if !bsonutil.IsArray(spec) || len(args) != 2 {
+		return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "%s requires an array of exactly two expressions", name)
+	}
+
+	f := &covarianceWindowFunc{sample: name == "$covarianceSamp", bounds: bounds}
+	var err error
+	if f.x, err = expr.Compile(args[0]); err != nil {
+		return nil, err
+	}
+	if f.y, err = expr.Compile(args[1]); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *covarianceWindowFunc) compute(p *windowPartition) ([]interface{}, error) {
+	out := make([]interface{}, len(p.docs))
+	for i := range p.docs {
+		idxs, err := f.bounds.indices(p, i)
+		if err != nil {
+			return nil, err
+		}
+
+		var xs, ys []float64
+		for _, idx := range idxs {
+			xv, err := f.x.Eval(p.vars[idx])
+			if err != nil {
+				return nil, err
+			}
+			yv, err := f.y.Eval(p.vars[idx])
+			if err != nil {
+				return nil, err
+			}
+
+			x, xNum := bsonutil.ToFloat64(xv)
+			y, yNum := bsonutil.ToFloat64(yv)
+			if xNum && yNum {
+				xs, ys = append(xs, x), append(ys, y)
+			}
+		}
+
+		n := float64(len(xs))
+		if n == 0 || (f.sample && n == 1) {
+			continue
+		}
+
+		var meanX, meanY, sum float64
+		for j := range xs {
+			meanX += xs[j] / n
+			meanY += ys[j] / n
+		}
+		for j := range xs {
+			sum += (xs[j] - meanX) * (ys[j] - meanY)
+		}
+		if f.sample {
+			n--
+		}
+		out[i] = sum / n
+	}
+	return out, nil
+}
+
+// calculusUnits maps the units accepted by $derivative and $integral to their
+// duration.
+var calculusUnits = map[string]time.Duration{
+	"week":        7 * 24 * time.Hour,
+	"day":         24 * time.Hour,
+	"hour":        time.Hour,
+	"minute":      time.Minute,
+	"second":      time.Second,
+	"millisecond": time.Millisecond,
+}
+
+// calculusWindowFunc implements $derivative and $integral. The sortBy value
+// of each document is used as its position on the x axis.
+type calculusWindowFunc struct {
+	name   string
+	input  expr.Expr
+	unit   time.Duration
+	bounds *windowBounds
+}
+
+func parseCalculusWindowFunc(name string, spec interface{}, bounds *windowBounds) (windowFunc, error) {
+	if !bsonutil.IsDocument(spec) {
+		return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "%s expects an object, but got a %s", name, bsonutil.TypeName(spec))
+	} else if name == "$derivative" && bounds == nil {
+		return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "$derivative requires explicit window bounds")
+	}
+
+	f := &calculusWindowFunc{name: name, bounds: bounds}
+	for _, elem := range bsonutil.Elements(spec) {
+		switch elem.Name {
+		case "input":
+			var err error
+			if f.input, err = expr.Compile(elem.Value); err != nil {
+				return nil, err
+			}
+		case "unit":
+			unit, isString := elem.Value.(string)
+			if f.unit = calculusUnits[unit]; !isString || f.unit == 0 {
+				return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "%s 'unit' must be one of: week, day, hour, minute, second, millisecond", name)
+			}
+		default:
+			return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "%s got unexpected argument: %s", name, elem.Name)
+		}
+	}
+	if f.input == nil {
+		return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "%s requires an 'input' expression", name)
+	}
+	return f, nil
+}
+
+// position returns the x axis position for a sortBy value.
+func (f *calculusWindowFunc) position(v interface{}) (float64, error) {
+	if t, isTime := v.(time.Time); isTime {
+		if f.unit == 0 {
+			return 0, protocol.ServerErrorf(5624901, "%s where the sortBy is a Date requires an 'unit'", f.name)
+		}
+		return float64(t.UnixNano()/int64(time.Millisecond)) / float64(f.unit/time.Millisecond), nil
+	}
+
+	x, isNum := bsonutil.ToFloat64(v)
+	if !isNum {
+		return 0, protocol.ServerErrorf(5624900, "%s requires the sortBy to be a number or a date, but found %s", f.name, bsonutil.TypeName(v))
+	} else if f.unit != 0 {
+		return 0, protocol.ServerErrorf(5624902, "%s with 'unit' expects the sortBy field to be a Date", f.name)
+	}
+	return x, nil
+}
+
+func (f *calculusWindowFunc) compute(p *windowPartition) ([]interface{}, error) {
+	out := make([]interface{}, len(p.docs))
+	for i := range p.docs {
+		idxs, err := f.bounds.indices(p, i)
+		if err != nil {
+			return nil, err
+		}
+
+		var xs, ys []float64
+		for _, idx := range idxs {
+			x, err := f.position(p.sortValues[idx])
+			if err != nil {
+				return nil, err
+			}
+			v, err := f.input.Eval(p.vars[idx])
+			if err != nil {
+				return nil, err
+			}
+			if y, isNum := bsonutil.ToFloat64(v); isNum {
+				xs, ys = append(xs, x), append(ys, y)
+			}
+		}
+
+		if f.name == "$derivative" {
+			if n := len(xs); n >= 2 && xs[n-1] != xs[0] {
+				out[i] = (ys[n-1] - ys[0]) / (xs[n-1] - xs[0])
+			}
+			continue
+		}
+
+		// Compute the integral using the trapezoidal rule.
+		var area float64
+		for j := 1; j < len(xs); j++ {
+			area += (xs[j] - xs[j-1]) * (ys[j] + ys[j-1]) / 2
+		}
+		out[i] = area
+	}
+	return out, nil
+}
+
+// locfWindowFunc implements $locf which replaces null and missing values with
+// the last non-null value in the partition.
+type locfWindowFunc struct {
+	input expr.Expr
+}
+
+func (f locfWindowFunc) compute(p *windowPartition) ([]interface{}, error) {
+	var (
+		out  = make([]interface{}, len(p.docs))
+		last interface{}
+	)
+	for i := range p.docs {
+		v, err := f.input.Eval(p.vars[i])
+		if err != nil {
+			return nil, err
+		} else if !expr.IsNullish(v) {
+			last = v
+		}
+		out[i] = last
+	}
+	return out, nil
+}
+
+// linearFillWindowFunc implements $linearFill which fills null and missing
+// values by linear interpolation between the surrounding non-null values.
+type linearFillWindowFunc struct {
+	input expr.Expr
+}
+
+func (f linearFillWindowFunc) compute(p *windowPartition) ([]interface{}, error) {
+	var (
+		out   = make([]interface{}, len(p.docs))
+		known []int
+	)
+	for i := range p.docs {
+		v, err := f.input.Eval(p.vars[i])
+		if err != nil {
+			return nil, err
+		} else if expr.IsNullish(v) {
+			continue
+		} else if !bsonutil.IsNumber(v) {
+			return nil, protocol.ServerErrorf(protocol.CodeTypeMismatch, "$linearFill only supports numeric types, found %s", bsonutil.TypeName(v))
+		}
+		out[i] = v
+		known = append(known, i)
+	}
+
+	position := func(v interface{}) float64 {
+		if t, isTime := v.(time.Time); isTime {
+			return float64(t.UnixNano() / int64(time.Millisecond))
+		}
+		f, _ := bsonutil.ToFloat64(v)
+		return f
+	}
+
+	for k := 1; k < len(known); k++ {
+		lo, hi := known[k-1], known[k]
+		x0, x1 := position(p.sortValues[lo]), position(p.sortValues[hi])
+		y0, _ := bsonutil.ToFloat64(out[lo])
+		y1, _ := bsonutil.ToFloat64(out[hi])
+		for i := lo + 1; i < hi; i++ {
+			x := position(p.sortValues[i])
+			out[i] = y0 + (x-x0)*(y1-y0)/(x1-x0)
+		}
+	}
+	return out, nil
+}
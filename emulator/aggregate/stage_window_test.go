@@ -0,0 +1,99 @@
+package aggregate
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestSetWindowFields(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2021, 1, d, 0, 0, 0, 0, time.UTC) }
+	src := memSource{testCol.String(): {
+		{"_id": 1, "store": "a", "t": 1, "day": day(1), "qty": 1},
+		{"_id": 2, "store": "a", "t": 2, "day": day(2), "qty": 2},
+		{"_id": 3, "store": "a", "t": 4, "day": day(4), "qty": 4},
+		{"_id": 4, "store": "a", "t": 5, "day": day(5), "qty": 8},
+		{"_id": 5, "store": "b", "t": 1, "day": day(1), "qty": 16},
+	}}
+
+	// windowOutput returns a pipeline that computes the running total of
+	// qty per store over the provided window and projects it.
+	windowOutput := func(sortBy string, window bson.M) []bson.D {
+		sum := bson.M{"$sum": "$qty"}
+		if window != nil {
+			sum["window"] = window
+		}
+		return []bson.D{
+			{{Name: "$setWindowFields", Value: bson.M{
+				"partitionBy": "$store",
+				"sortBy":      bson.M{sortBy: 1},
+				"output":      bson.M{"total": sum},
+			}}},
+			{{Name: "$project", Value: bson.M{"total": 1}}},
+		}
+	}
+
+	runPipelineSpecs(t, src, []pipelineSpec{
+		{
+			descr:    "unbounded to current document",
+			pipeline: windowOutput("t", bson.M{"documents": []interface{}{"unbounded", "current"}}),
+			exp:      "[[{_id 1} {total 1}] [{_id 2} {total 3}] [{_id 3} {total 7}] [{_id 4} {total 15}] [{_id 5} {total 16}]]",
+		},
+		{
+			descr:    "sliding document window",
+			pipeline: windowOutput("t", bson.M{"documents": []interface{}{-1, 1}}),
+			exp:      "[[{_id 1} {total 3}] [{_id 2} {total 7}] [{_id 3} {total 14}] [{_id 4} {total 12}] [{_id 5} {total 16}]]",
+		},
+		{
+			descr:    "document window past the partition end",
+			pipeline: windowOutput("t", bson.M{"documents": []interface{}{1, 2}}),
+			exp:      "[[{_id 1} {total 6}] [{_id 2} {total 12}] [{_id 3} {total 8}] [{_id 4} {total 0}] [{_id 5} {total 0}]]",
+		},
+		{
+			descr:    "numeric range window",
+			pipeline: windowOutput("t", bson.M{"range": []interface{}{-1, 0}}),
+			exp:      "[[{_id 1} {total 1}] [{_id 2} {total 3}] [{_id 3} {total 4}] [{_id 4} {total 12}] [{_id 5} {total 16}]]",
+		},
+		{
+			descr:    "date range window",
+			pipeline: windowOutput("day", bson.M{"range": []interface{}{-2, "current"}, "unit": "day"}),
+			exp:      "[[{_id 1} {total 1}] [{_id 2} {total 3}] [{_id 3} {total 6}] [{_id 4} {total 12}] [{_id 5} {total 16}]]",
+		},
+		{
+			descr:    "whole partition",
+			pipeline: windowOutput("t", nil),
+			exp:      "[[{_id 1} {total 15}] [{_id 2} {total 15}] [{_id 3} {total 15}] [{_id 4} {total 15}] [{_id 5} {total 16}]]",
+		},
+		{
+			descr:    "lower bound exceeds upper bound",
+			pipeline: windowOutput("t", bson.M{"documents": []interface{}{1, -1}}),
+			expErr:   9,
+		},
+		{
+			descr:    "range window without unit over dates",
+			pipeline: windowOutput("day", bson.M{"range": []interface{}{-1, 0}}),
+			expErr:   5429513,
+		},
+		{
+			descr: "rank requires sortBy",
+			pipeline: []bson.D{{{Name: "$setWindowFields", Value: bson.M{
+				"output": bson.M{"r": bson.M{"$rank": bson.M{}}},
+			}}}},
+			expErr: 9,
+		},
+	})
+}
+
+func TestSetWindowFieldsMemoryLimit(t *testing.T) {
+	src := memSource{testCol.String(): {{"_id": 1, "qty": 1}, {"_id": 2, "qty": 2}}}
+	env := newTestEnv(t, src)
+	env.MemoryLimit = 1
+
+	_, err := runPipeline(env, []bson.D{{{Name: "$setWindowFields", Value: bson.M{
+		"output": bson.M{"total": bson.M{"$sum": "$qty"}},
+	}}}})
+	if errorCode(err) != 5414201 {
+		t.Fatalf("expected the memory limit to be exceeded; got %v", err)
+	}
+}
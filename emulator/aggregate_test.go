@@ -0,0 +1,290 @@
+package emulator
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/achilleasa/mongolite/emulator/aggregate"
+	"github.com/achilleasa/mongolite/protocol"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// writeErrBackend extends memBackend by reporting a write error for the
+// update operations whose selector matches failID.
+type writeErrBackend struct {
+	*memBackend
+	failID interface{}
+}
+
+func (b *writeErrBackend) HandleRequest(clientID string, req protocol.Request) (protocol.Response, error) {
+	r, ok := req.(*protocol.UpdateRequest)
+	if !ok {
+		return b.memBackend.HandleRequest(clientID, req)
+	}
+
+	for i, target := range r.Updates {
+		if target.Selector["_id"] != b.failID {
+			continue
+		}
+
+		applied := *r
+		applied.Updates = r.Updates[:i]
+		res, err := b.memBackend.HandleRequest(clientID, &applied)
+		if err != nil {
+			return res, err
+		}
+		res.Documents[0]["writeErrors"] = []interface{}{bson.M{
+			"index":  i,
+			"code":   protocol.CodeDuplicateKey,
+			"errmsg": "E11000 duplicate key error",
+		}}
+		return res, nil
+	}
+	return b.memBackend.HandleRequest(clientID, req)
+}
+
+func TestMergeReportsWriteErrors(t *testing.T) {
+	b := &writeErrBackend{memBackend: newMemBackend(), failID: 2}
+	emu := newTestEmulator(t, b)
+	insertDocs(t, emu, testCol, bson.M{"_id": 1}, bson.M{"_id": 2}, bson.M{"_id": 3})
+
+	out := protocol.NamespacedCollection{Database: "test", Collection: "out"}
+	_, err := emu.process("client", &protocol.AggregateRequest{
+		RequestInfo: cmdInfo(protocol.RequestTypeAggregate),
+		Collection:  testCol,
+		Pipeline: []bson.D{
+			{{Name: "$sort", Value: bson.M{"_id": 1}}},
+			{{Name: "$merge", Value: bson.M{"into": "out"}}},
+		},
+	})
+	if !hasErrorCode(err, protocol.CodeDuplicateKey) {
+		t.Fatalf("expected a DuplicateKey error; got %v", err)
+	}
+
+	// Without transactions, the fallback is not atomic; the upserts
+	// preceding the failed one remain written.
+	if got := ids(b.docs(out)); len(got) != 1 || got[0] != 1 {
+		t.Fatalf("expected _id [1] in the output collection; got %v", got)
+	}
+}
+
+func TestMergeInternalTransaction(t *testing.T) {
+	b := newTxnBackend()
+	emu := newTestEmulator(t, b)
+	insertDocs(t, emu, testCol, bson.M{"_id": 1, "a": 1}, bson.M{"_id": 2, "a": 2})
+
+	specs := []struct {
+		descr      string
+		into       string
+		outDocs    []bson.M
+		expErrCode protocol.ErrorCode
+		expEvents  []string
+	}{
+		{
+			descr:     "all upserts succeed",
+			into:      "out1",
+			expEvents: []string{"start", "query", "query", "update", "query", "query", "update", "commit"},
+		},
+		{
+			descr:      "an upsert violates a unique index",
+			into:       "out2",
+			outDocs:    []bson.M{{"_id": 10, "a": 2}},
+			expErrCode: protocol.CodeDuplicateKey,
+			expEvents:  []string{"start", "query", "query", "update", "query", "query", "abort"},
+		},
+	}
+
+	for _, spec := range specs {
+		t.Run(spec.descr, func(t *testing.T) {
+			out := protocol.NamespacedCollection{Database: testCol.Database, Collection: spec.into}
+			mustProcess(t, emu, &protocol.CreateIndexesRequest{
+				RequestInfo: cmdInfo(protocol.RequestTypeCreateIndexes),
+				Collection:  out,
+				Indexes:     []protocol.IndexSpec{{Name: "a_1", Key: bson.D{{Name: "a", Value: 1}}, Unique: true}},
+			})
+			if len(spec.outDocs) != 0 {
+				insertDocs(t, emu, out, spec.outDocs...)
+			}
+			b.recorded()
+
+			_, err := emu.process("client", &protocol.AggregateRequest{
+				RequestInfo: cmdInfo(protocol.RequestTypeAggregate),
+				Collection:  testCol,
+				Pipeline: []bson.D{
+					{{Name: "$sort", Value: bson.M{"_id": 1}}},
+					{{Name: "$merge", Value: bson.M{"into": spec.into}}},
+				},
+			})
+			if spec.expErrCode != 0 && !hasErrorCode(err, spec.expErrCode) {
+				t.Fatalf("expected error code %d; got %v", spec.expErrCode, err)
+			} else if spec.expErrCode == 0 && err != nil {
+				t.Fatal(err)
+			}
+
+			// Each upsert is preceded by the queries that check the
+			// unique index.
+			events, ok := b.recorded()
+			if !ok || fmt.Sprint(events) != fmt.Sprint(spec.expEvents) {
+				t.Fatalf("expected internal transaction events %v; got %v", spec.expEvents, events)
+			}
+		})
+	}
+}
+
+// queryRecorder extends memBackend by recording the query requests that it
+// receives.
+type queryRecorder struct {
+	*memBackend
+	queries []*protocol.QueryRequest
+}
+
+func (b *queryRecorder) HandleRequest(clientID string, req protocol.Request) (protocol.Response, error) {
+	if r, ok := req.(*protocol.QueryRequest); ok {
+		recorded := *r
+		b.queries = append(b.queries, &recorded)
+	}
+	return b.memBackend.HandleRequest(clientID, req)
+}
+
+func TestAggregatePushDown(t *testing.T) {
+	b := &queryRecorder{memBackend: newMemBackend()}
+	emu := newTestEmulator(t, b)
+	insertDocs(t, emu, testCol,
+		bson.M{"_id": 1, "a": 1, "b": 1},
+		bson.M{"_id": 2, "a": 1, "b": 2},
+		bson.M{"_id": 3, "a": 2, "b": 1},
+		bson.M{"_id": 4, "a": 2, "b": 2},
+	)
+
+	specs := []struct {
+		descr    string
+		pipeline []bson.D
+		expQuery protocol.QueryRequest
+		expIDs   []interface{}
+	}{
+		{
+			descr: "match, compound sort, skip, limit and project",
+			pipeline: []bson.D{
+				{{Name: "$match", Value: bson.M{"b": bson.M{"$gte": 1}}}},
+				{{Name: "$sort", Value: bson.D{{Name: "a", Value: -1}, {Name: "b", Value: 1}}}},
+				{{Name: "$skip", Value: 1}},
+				{{Name: "$limit", Value: 2}},
+				{{Name: "$project", Value: bson.M{"a": 1}}},
+			},
+			expQuery: protocol.QueryRequest{
+				Query:         bson.M{"b": bson.M{"$gte": 1}},
+				Sort:          bson.D{{Name: "a", Value: -1}, {Name: "b", Value: 1}},
+				NumToSkip:     1,
+				NumToReturn:   2,
+				FieldSelector: bson.M{"a": 1},
+			},
+			expIDs: []interface{}{4, 1},
+		},
+		{
+			descr: "stages after a limit are evaluated by the emulator",
+			pipeline: []bson.D{
+				{{Name: "$limit", Value: 3}},
+				{{Name: "$skip", Value: 1}},
+				{{Name: "$sort", Value: bson.M{"_id": -1}}},
+			},
+			expQuery: protocol.QueryRequest{
+				Query:       bson.M{},
+				NumToReturn: 3,
+			},
+			expIDs: []interface{}{3, 2},
+		},
+		{
+			descr: "group is evaluated by the emulator",
+			pipeline: []bson.D{
+				{{Name: "$sort", Value: bson.M{"b": -1}}},
+				{{Name: "$group", Value: bson.M{"_id": "$b"}}},
+				{{Name: "$sort", Value: bson.M{"_id": 1}}},
+			},
+			expQuery: protocol.QueryRequest{
+				Query: bson.M{},
+				Sort:  bson.D{{Name: "b", Value: -1}},
+			},
+			expIDs: []interface{}{1, 2},
+		},
+	}
+
+	for _, spec := range specs {
+		t.Run(spec.descr, func(t *testing.T) {
+			b.queries = nil
+			reply := mustProcess(t, emu, &protocol.AggregateRequest{
+				RequestInfo: cmdInfo(protocol.RequestTypeAggregate),
+				Collection:  testCol,
+				Pipeline:    spec.pipeline,
+			})
+			if got := ids(firstBatch(t, reply)); !reflect.DeepEqual(got, spec.expIDs) {
+				t.Fatalf("expected _id %v; got %v", spec.expIDs, got)
+			}
+
+			if len(b.queries) != 1 {
+				t.Fatalf("expected a single query request; got %d", len(b.queries))
+			}
+			got, exp := b.queries[0], spec.expQuery
+			if !reflect.DeepEqual(got.Query, exp.Query) || !reflect.DeepEqual(got.Sort, exp.Sort) ||
+				got.NumToSkip != exp.NumToSkip || got.NumToReturn != exp.NumToReturn ||
+				!reflect.DeepEqual(got.FieldSelector, exp.FieldSelector) {
+				t.Fatalf("expected pushed down query {query: %v, sort: %v, skip: %d, limit: %d, projection: %v}; got {query: %v, sort: %v, skip: %d, limit: %d, projection: %v}",
+					exp.Query, exp.Sort, exp.NumToSkip, exp.NumToReturn, exp.FieldSelector,
+					got.Query, got.Sort, got.NumToSkip, got.NumToReturn, got.FieldSelector)
+			}
+		})
+	}
+}
+
+// aggQueryBackend extends queryRecorder with an AggregateQueryBackend
+// implementation that accepts every query and returns fixed results.
+type aggQueryBackend struct {
+	*queryRecorder
+	pushed []aggregate.Query
+}
+
+func (b *aggQueryBackend) CanPushDownQuery(col protocol.NamespacedCollection, q aggregate.Query) bool {
+	return true
+}
+
+func (b *aggQueryBackend) QueryAggregate(clientID string, col protocol.NamespacedCollection, q aggregate.Query) ([]bson.D, error) {
+	b.pushed = append(b.pushed, q)
+	return []bson.D{
+		{{Name: "_id", Value: 1}, {Name: "n", Value: 2}},
+		{{Name: "_id", Value: 2}, {Name: "n", Value: 3}},
+	}, nil
+}
+
+func TestAggregateQueryBackend(t *testing.T) {
+	b := &aggQueryBackend{queryRecorder: &queryRecorder{memBackend: newMemBackend()}}
+	emu := newTestEmulator(t, b)
+
+	// The stages up to and including the group are evaluated by the
+	// backend and the final sort by the emulator.
+	reply := mustProcess(t, emu, &protocol.AggregateRequest{
+		RequestInfo: cmdInfo(protocol.RequestTypeAggregate),
+		Collection:  testCol,
+		Pipeline: []bson.D{
+			{{Name: "$match", Value: bson.M{"a": bson.M{"$gt": 0}}}},
+			{{Name: "$group", Value: bson.D{{Name: "_id", Value: "$b"}, {Name: "n", Value: bson.M{"$sum": 1}}}}},
+			{{Name: "$sort", Value: bson.M{"n": -1}}},
+		},
+	})
+	if got, exp := ids(firstBatch(t, reply)), []interface{}{2, 1}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected _id %v; got %v", exp, got)
+	}
+
+	expQuery := aggregate.Query{
+		Filter: bson.M{"a": bson.M{"$gt": 0}},
+		Group: &aggregate.GroupQuery{
+			ID:     "$b",
+			Fields: []aggregate.GroupQueryField{{Name: "n", Op: "$sum", Arg: 1}},
+		},
+	}
+	if len(b.pushed) != 1 || !reflect.DeepEqual(b.pushed[0], expQuery) {
+		t.Fatalf("expected pushed down query %+v; got %+v", expQuery, b.pushed)
+	}
+	if len(b.queries) != 0 {
+		t.Fatalf("expected no query requests; got %d", len(b.queries))
+	}
+}
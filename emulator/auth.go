@@ -0,0 +1,427 @@
+package emulator
+
+import (
+	"encoding/base64"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/emulator/scram"
+	"github.com/achilleasa/mongolite/protocol"
+	"golang.org/x/xerrors"
+	"gopkg.in/Sirupsen/logrus.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	// The collection where user credentials are stored.
+	usersCollection = protocol.NamespacedCollection{Database: "admin", Collection: "system.users"}
+
+	// The commands that clients may run before authenticating. All
+	// other requests are rejected when authentication is enabled.
+	unauthenticatedCommands = map[string]bool{
+		"ISMASTER":   true,
+		"HELLO":      true,
+		"BUILDINFO":  true,
+		"PING":       true,
+		"WHATSMYURI": true,
+	}
+)
+
+// The ID reported for SASL conversations. Each connection can only have a
+// single conversation in progress.
+const saslConversationID = 1
+
+// principal identifies an authenticated user.
+type principal struct {
+	user string
+	db   string
+}
+
+// saslConversation tracks a SASL conversation that is in progress.
+type saslConversation struct {
+	*scram.ServerConversation
+
+	db                string
+	skipEmptyExchange bool
+}
+
+// authRegistry tracks the authentication state of each connection. Users
+// authenticate via the SCRAM-SHA-1 or SCRAM-SHA-256 SASL mechanisms using
+// the credentials stored in the admin.system.users collection. Roles are
+// stored but not enforced; authenticated users may run any command.
+//
+// See https://github.com/mongodb/specifications/blob/master/source/auth/auth.rst
+type authRegistry struct {
+	// If true, requests from unauthenticated connections are rejected.
+	enabled bool
+
+	mu            sync.Mutex
+	conversations map[string]*saslConversation
+	principals    map[string]principal
+
+	// Serializes user management commands.
+	usersMu sync.Mutex
+}
+
+func newAuthRegistry() *authRegistry {
+	return &authRegistry{
+		conversations: make(map[string]*saslConversation),
+		principals:    make(map[string]principal),
+	}
+}
+
+// remove discards the authentication state of a connection.
+func (a *authRegistry) remove(clientID string) {
+	a.mu.Lock()
+	delete(a.conversations, clientID)
+	delete(a.principals, clientID)
+	a.mu.Unlock()
+}
+
+// authenticated returns true if a user has authenticated on the connection.
+func (a *authRegistry) authenticated(clientID string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, found := a.principals[clientID]
+	return found
+}
+
+// EnableAuth configures the emulator to reject requests from connections that
+// have not authenticated. Like mongod, clients connecting from localhost may
+// create the first user without authenticating.
+func (emu *MongoEmulator) EnableAuth() {
+	emu.auth.enabled = true
+}
+
+// checkAuthenticated returns an Unauthorized error if authentication is
+// enabled and req requires an authenticated connection.
+func (emu *MongoEmulator) checkAuthenticated(clientID string, req protocol.Request) error {
+	if !emu.auth.enabled || emu.auth.authenticated(clientID) {
+		return nil
+	}
+
+	cmdName := string(req.GetType())
+	switch r := req.(type) {
+	case *protocol.SaslStartRequest, *protocol.SaslContinueRequest, *protocol.LogoutRequest:
+		return nil
+	case *protocol.CreateUserRequest:
+		if ok, err := emu.localhostException(clientID); err != nil || ok {
+			return err
+		}
+	case *protocol.CommandRequest:
+		if unauthenticatedCommands[strings.ToUpper(r.Command)] {
+			return nil
+		}
+		cmdName = r.Command
+	case *protocol.QueryRequest:
+		cmdName = "find"
+	}
+	return protocol.ServerErrorf(protocol.CodeUnauthorized, "command %s requires authentication", cmdName)
+}
+
+// localhostException returns true if the client connects from localhost and
+// no users have been created yet.
+func (emu *MongoEmulator) localhostException(clientID string) (bool, error) {
+	host, _, err := net.SplitHostPort(clientID)
+	if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+		return false, nil
+	}
+
+	src := &backendSource{b: emu.b, clientID: clientID}
+	users, err := src.Find(usersCollection, bson.M{})
+	if err != nil {
+		return false, err
+	}
+	return len(users) == 0, nil
+}
+
+// maybeProcessAuthRequest services authentication and user management
+// requests. The handled return value is false for all other requests.
+func (emu *MongoEmulator) maybeProcessAuthRequest(clientID string, req protocol.Request) (res protocol.Response, handled bool, err error) {
+	var resDoc bson.M
+	switch r := req.(type) {
+	case *protocol.SaslStartRequest:
+		resDoc, err = emu.saslStart(clientID, r.Database, r.Mechanism, r.Payload, r.SkipEmptyExchange)
+	case *protocol.SaslContinueRequest:
+		resDoc, err = emu.saslContinue(clientID, r.ConversationID, r.Payload)
+	case *protocol.LogoutRequest:
+		emu.auth.mu.Lock()
+		if p, found := emu.auth.principals[clientID]; found && p.db == r.Database {
+			delete(emu.auth.principals, clientID)
+		}
+		emu.auth.mu.Unlock()
+		resDoc = bson.M{}
+	case *protocol.CreateUserRequest:
+		resDoc, err = emu.createUser(clientID, r)
+	case *protocol.DropUserRequest:
+		resDoc, err = emu.dropUser(clientID, r)
+	default:
+		return protocol.Response{}, false, nil
+	}
+
+	if err != nil {
+		return protocol.Response{}, true, err
+	}
+	resDoc["ok"] = 1
+	return protocol.Response{Documents: []bson.M{resDoc}}, true, nil
+}
+
+// saslStart starts a new SASL conversation for the connection and processes
+// the first client message. It returns the saslStart reply without the ok
+// field so that it can also be embedded into the speculativeAuthenticate
+// field of an isMaster reply.
+func (emu *MongoEmulator) saslStart(clientID, db, mechName string, payload []byte, skipEmptyExchange bool) (bson.M, error) {
+	mech, found := scram.Lookup(mechName)
+	if !found {
+		return nil, protocol.ServerErrorf(protocol.CodeBadValue, "Received authentication for mechanism %s which is unknown or not enabled", mechName)
+	}
+
+	conv := &saslConversation{
+		ServerConversation: mech.NewServerConversation(emu.userCredentials(clientID, db, mech)),
+		db:                 db,
+		skipEmptyExchange:  skipEmptyExchange,
+	}
+	emu.auth.mu.Lock()
+	emu.auth.conversations[clientID] = conv
+	emu.auth.mu.Unlock()
+	return emu.saslStep(clientID, conv, payload)
+}
+
+// saslContinue processes the next client message of the SASL conversation
+// that is in progress on the connection.
+func (emu *MongoEmulator) saslContinue(clientID string, convID int, payload []byte) (bson.M, error) {
+	emu.auth.mu.Lock()
+	conv := emu.auth.conversations[clientID]
+	emu.auth.mu.Unlock()
+	if conv == nil || convID != saslConversationID {
+		return nil, protocol.ServerErrorf(protocol.CodeProtocolError, "No SASL session state found")
+	}
+	return emu.saslStep(clientID, conv, payload)
+}
+
+// saslStep feeds a client message to conv. When the conversation completes,
+// the user becomes the authenticated principal of the connection.
+func (emu *MongoEmulator) saslStep(clientID string, conv *saslConversation, payload []byte) (bson.M, error) {
+	res, done, err := conv.Step(payload)
+	if err == nil && conv.skipEmptyExchange && conv.Authenticated() {
+		done = true
+	}
+
+	emu.auth.mu.Lock()
+	defer emu.auth.mu.Unlock()
+	if err != nil || done {
+		delete(emu.auth.conversations, clientID)
+	}
+	if err != nil {
+		emu.logger.WithFields(logrus.Fields{
+			"client_id": clientID,
+			"user":      conv.User(),
+			"db":        conv.db,
+		}).WithError(err).Warn("authentication failed")
+		return nil, protocol.ServerErrorf(protocol.CodeAuthenticationFailed, "Authentication failed.")
+	}
+	if done {
+		emu.auth.principals[clientID] = principal{user: conv.User(), db: conv.db}
+	}
+
+	return bson.M{
+		"conversationId": saslConversationID,
+		"done":           done,
+		"payload":        bson.Binary{Kind: 0x00, Data: res},
+	}, nil
+}
+
+// findUser returns the document of a user or nil if the user does not exist.
+func (emu *MongoEmulator) findUser(clientID, db, user string) (bson.M, error) {
+	id := db + "." + user
+	src := &backendSource{b: emu.b, clientID: clientID}
+	users, err := src.Find(usersCollection, bson.M{"_id": id})
+	if err != nil {
+		return nil, err
+	}
+	for _, userDoc := range users {
+		if userMap := userDoc.Map(); userMap["_id"] == id {
+			return userMap, nil
+		}
+	}
+	return nil, nil
+}
+
+// userCredentials returns a lookup function for the stored credentials of the
+// users defined in db.
+func (emu *MongoEmulator) userCredentials(clientID, db string, mech *scram.Mechanism) scram.CredentialsLookup {
+	return func(user string) (scram.Credentials, bool, error) {
+		userDoc, err := emu.findUser(clientID, db, user)
+		if err != nil || userDoc == nil {
+			return scram.Credentials{}, false, err
+		}
+		credDoc, found := bsonutil.Get(userDoc["credentials"], mech.Name)
+		if !found {
+			return scram.Credentials{}, false, nil
+		}
+		return decodeCredentials(bsonutil.ToMap(credDoc))
+	}
+}
+
+// userMechanisms returns the SCRAM mechanisms for which a user has
+// credentials.
+func userMechanisms(userDoc bson.M) []string {
+	var mechs []string
+	for _, mech := range scram.Mechanisms {
+		if _, found := bsonutil.Get(userDoc["credentials"], mech.Name); found {
+			mechs = append(mechs, mech.Name)
+		}
+	}
+	return mechs
+}
+
+// encodeCredentials returns the document that stores creds in the
+// credentials field of a user document.
+func encodeCredentials(creds scram.Credentials) bson.D {
+	return bson.D{
+		{Name: "iterationCount", Value: creds.IterationCount},
+		{Name: "salt", Value: base64.StdEncoding.EncodeToString(creds.Salt)},
+		{Name: "storedKey", Value: base64.StdEncoding.EncodeToString(creds.StoredKey)},
+		{Name: "serverKey", Value: base64.StdEncoding.EncodeToString(creds.ServerKey)},
+	}
+}
+
+// decodeCredentials parses a document produced by encodeCredentials. The
+// found return value is false if the document is malformed.
+func decodeCredentials(credDoc bson.M) (scram.Credentials, bool, error) {
+	var (
+		creds scram.Credentials
+		err   error
+	)
+	iterationCount, _ := bsonutil.ToInt64(credDoc["iterationCount"])
+	creds.IterationCount = int(iterationCount)
+	for field, dst := range map[string]*[]byte{"salt": &creds.Salt, "storedKey": &creds.StoredKey, "serverKey": &creds.ServerKey} {
+		encoded, _ := credDoc[field].(string)
+		if *dst, err = base64.StdEncoding.DecodeString(encoded); err != nil || len(*dst) == 0 {
+			return scram.Credentials{}, false, nil
+		}
+	}
+	return creds, creds.IterationCount > 0, nil
+}
+
+// createUser implements the createUser command.
+func (emu *MongoEmulator) createUser(clientID string, req *protocol.CreateUserRequest) (bson.M, error) {
+	mechs := scram.Mechanisms
+	if len(req.Mechanisms) != 0 {
+		mechs = nil
+		for _, name := range req.Mechanisms {
+			mech, found := scram.Lookup(name)
+			if !found {
+				return nil, protocol.ServerErrorf(protocol.CodeBadValue, "Unknown auth mechanism '%s'", name)
+			}
+			mechs = append(mechs, mech)
+		}
+	}
+	if req.Password == "" {
+		return nil, protocol.ServerErrorf(protocol.CodeBadValue, "Password cannot be empty")
+	}
+
+	creds := bson.D{}
+	for _, mech := range mechs {
+		c, err := mech.NewCredentials(req.User, req.Password)
+		if xerrors.Is(err, scram.ErrUnsupportedPassword) {
+			return nil, protocol.ServerErrorf(protocol.CodeBadValue, "Unable to create %s credentials: %v", mech.Name, err)
+		} else if err != nil {
+			return nil, err
+		}
+		creds = append(creds, bson.DocElem{Name: mech.Name, Value: encodeCredentials(c)})
+	}
+	roles := req.Roles
+	if roles == nil {
+		roles = []interface{}{}
+	}
+
+	emu.auth.usersMu.Lock()
+	defer emu.auth.usersMu.Unlock()
+	if userDoc, err := emu.findUser(clientID, req.Database, req.User); err != nil {
+		return nil, err
+	} else if userDoc != nil {
+		return nil, protocol.ServerErrorf(51003, "User \"%s@%s\" already exists", req.User, req.Database)
+	}
+
+	insertReq := &protocol.InsertRequest{
+		RequestInfo: derivedRequestInfo(nil, protocol.RequestTypeInsert, protocol.ReplyTypeOpMsg),
+		Collection:  usersCollection,
+	}
+	err := emu.insertDocument(clientID, insertReq, bson.M{
+		"_id":         req.Database + "." + req.User,
+		"user":        req.User,
+		"db":          req.Database,
+		"credentials": creds,
+		"roles":       roles,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bson.M{}, nil
+}
+
+// dropUser implements the dropUser command.
+func (emu *MongoEmulator) dropUser(clientID string, req *protocol.DropUserRequest) (bson.M, error) {
+	emu.auth.usersMu.Lock()
+	defer emu.auth.usersMu.Unlock()
+
+	deleteReq := &protocol.DeleteRequest{
+		RequestInfo: derivedRequestInfo(nil, protocol.RequestTypeDelete, protocol.ReplyTypeOpMsg),
+		Collection:  usersCollection,
+	}
+	n, err := emu.deleteDocuments(clientID, deleteReq, protocol.DeleteTarget{
+		Selector: bson.M{"_id": req.Database + "." + req.User},
+		Limit:    1,
+	})
+	if err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, protocol.ServerErrorf(protocol.CodeUserNotFound, "User '%s@%s' not found", req.User, req.Database)
+	}
+	return bson.M{}, nil
+}
+
+// authIsMasterFields returns the authentication related fields of an isMaster
+// reply. If the request asks for the SASL mechanisms of a user
+// (saslSupportedMechs), the reply lists the mechanisms for which the user has
+// credentials; if the user cannot be looked up, the error is logged and the
+// field is omitted. If the request includes a saslStart command
+// (speculativeAuthenticate), the reply includes the saslStart reply; failed
+// speculative attempts are omitted so that clients fall back to a regular
+// saslStart.
+func (emu *MongoEmulator) authIsMasterFields(clientID string, req *protocol.CommandRequest) bson.M {
+	fields := bson.M{}
+	if userID, isString := req.Args["saslSupportedMechs"].(string); isString {
+		if sep := strings.IndexByte(userID, '.'); sep != -1 {
+			userDoc, err := emu.findUser(clientID, userID[:sep], userID[sep+1:])
+			if err != nil {
+				emu.logger.WithField("client_id", clientID).WithError(err).Warn("unable to look up user for saslSupportedMechs")
+			} else if userDoc != nil {
+				fields["saslSupportedMechs"] = userMechanisms(userDoc)
+			}
+		}
+	}
+
+	if spec := bsonutil.ToMap(req.Args["speculativeAuthenticate"]); spec != nil {
+		mechName, _ := spec["mechanism"].(string)
+		db, _ := spec["db"].(string)
+		var payload []byte
+		switch p := spec["payload"].(type) {
+		case bson.Binary:
+			payload = p.Data
+		case string:
+			payload = []byte(p)
+		}
+		skipEmptyExchange, _ := bsonutil.ToMap(spec["options"])["skipEmptyExchange"].(bool)
+
+		if _, isSaslStart := spec["saslStart"]; isSaslStart {
+			if resDoc, err := emu.saslStart(clientID, db, mechName, payload, skipEmptyExchange); err == nil {
+				fields["speculativeAuthenticate"] = resDoc
+			}
+		}
+	}
+	return fields
+}
@@ -0,0 +1,463 @@
+package emulator
+
+import (
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/achilleasa/mongolite/emulator/aggregate"
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/emulator/filter"
+	"github.com/achilleasa/mongolite/emulator/index"
+	"github.com/achilleasa/mongolite/emulator/update"
+	"github.com/achilleasa/mongolite/protocol"
+	"golang.org/x/xerrors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// memBackend is an in-memory backend for exercising the emulator in tests. It
+// serves queries and single-operation writes via HandleRequest and implements
+// CatalogBackend and IndexBackend. It deliberately does not enforce unique
+// indexes so that tests observe the checks performed by the emulator.
+type memBackend struct {
+	mu   sync.Mutex
+	cols map[string]*memCollection
+}
+
+type memCollection struct {
+	options bson.M
+	docs    []bson.D
+	indexes []protocol.IndexSpec
+}
+
+func newMemBackend() *memBackend {
+	return &memBackend{cols: make(map[string]*memCollection)}
+}
+
+// docs returns a copy of the documents stored in col.
+func (b *memBackend) docs(col protocol.NamespacedCollection) []bson.D {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c := b.cols[col.String()]; c != nil {
+		return append([]bson.D(nil), c.docs...)
+	}
+	return nil
+}
+
+func (b *memBackend) collection(col protocol.NamespacedCollection, create bool) *memCollection {
+	c := b.cols[col.String()]
+	if c == nil && create {
+		c = &memCollection{}
+		b.cols[col.String()] = c
+	}
+	return c
+}
+
+func (b *memBackend) Name() string                       { return "memory" }
+func (b *memBackend) RemoveClient(clientID string) error { return nil }
+
+func (b *memBackend) HandleRequest(clientID string, req protocol.Request) (protocol.Response, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch r := req.(type) {
+	case *protocol.QueryRequest:
+		return b.query(r)
+	case *protocol.InsertRequest:
+		c := b.collection(r.Collection, true)
+		for _, doc := range r.Inserts {
+			if _, hasID := doc["_id"]; !hasID {
+				doc["_id"] = bson.NewObjectId()
+			}
+			c.docs = append(c.docs, aggregate.ToDocument(doc))
+		}
+		return protocol.Response{Documents: []bson.M{{"ok": 1, "n": len(r.Inserts)}}}, nil
+	case *protocol.UpdateRequest:
+		return b.update(r)
+	case *protocol.DeleteRequest:
+		var n int
+		c := b.collection(r.Collection, false)
+		for _, target := range r.Deletes {
+			if c == nil {
+				break
+			}
+			m, err := filter.Compile(target.Selector)
+			if err != nil {
+				return protocol.Response{}, err
+			}
+			kept := c.docs[:0]
+			for _, doc := range c.docs {
+				if m.Match(doc) && (target.Limit == 0 || n < target.Limit) {
+					n++
+					continue
+				}
+				kept = append(kept, doc)
+			}
+			c.docs = kept
+		}
+		return protocol.Response{Documents: []bson.M{{"ok": 1, "n": n}}}, nil
+	}
+	return protocol.Response{}, xerrors.Errorf("request %q: %w", req.GetType(), ErrUnsupportedRequest)
+}
+
+func (b *memBackend) query(r *protocol.QueryRequest) (protocol.Response, error) {
+	m, err := filter.Compile(r.Query)
+	if err != nil {
+		return protocol.Response{}, err
+	}
+
+	var matched []bson.D
+	if c := b.collection(r.Collection, false); c != nil {
+		for _, doc := range c.docs {
+			if m.Match(doc) {
+				matched = append(matched, doc)
+			}
+		}
+	}
+	if len(r.Sort) != 0 {
+		spec, err := aggregate.ParseSort(r.Sort)
+		if err != nil {
+			return protocol.Response{}, err
+		}
+		spec.Sort(matched)
+	}
+	if skip := int(r.NumToSkip); skip > 0 {
+		if skip > len(matched) {
+			skip = len(matched)
+		}
+		matched = matched[skip:]
+	}
+	if limit := abs(int(r.NumToReturn)); limit != 0 && limit < len(matched) {
+		matched = matched[:limit]
+	}
+
+	docs := make([]bson.M, len(matched))
+	for i, doc := range matched {
+		docs[i] = bsonutil.ToMap(doc)
+	}
+	return protocol.Response{Documents: docs}, nil
+}
+
+func (b *memBackend) update(r *protocol.UpdateRequest) (protocol.Response, error) {
+	var (
+		n, nModified int
+		upserted     []interface{}
+	)
+	c := b.collection(r.Collection, true)
+	for i, target := range r.Updates {
+		m, err := filter.Compile(target.Selector)
+		if err != nil {
+			return protocol.Response{}, err
+		}
+		u, err := update.Parse(target.Update, target.ArrayFilters)
+		if err != nil {
+			return protocol.Response{}, err
+		}
+
+		var matched bool
+		for j, doc := range c.docs {
+			if !m.Match(doc) {
+				continue
+			}
+			updated, err := u.Apply(doc, false)
+			if err != nil {
+				return protocol.Response{}, err
+			}
+			matched = true
+			n++
+			if !bsonutil.Equal(doc, updated) {
+				c.docs[j] = updated
+				nModified++
+			}
+			if target.Flags&protocol.UpdateFlagMulti == 0 {
+				break
+			}
+		}
+
+		if !matched && target.Flags&protocol.UpdateFlagUpsert != 0 {
+			doc, err := u.UpsertDocument(target.Selector)
+			if err != nil {
+				return protocol.Response{}, err
+			}
+			id, _ := bsonutil.Get(doc, "_id")
+			c.docs = append(c.docs, doc)
+			n++
+			upserted = append(upserted, bson.M{"index": i, "_id": id})
+		}
+	}
+
+	resDoc := bson.M{"ok": 1, "n": n, "nModified": nModified}
+	if len(upserted) != 0 {
+		resDoc["upserted"] = upserted
+	}
+	return protocol.Response{Documents: []bson.M{resDoc}}, nil
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func (b *memBackend) ListDatabases(clientID string) ([]DatabaseInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	seen := make(map[string]bool)
+	var dbs []DatabaseInfo
+	for ns := range b.cols {
+		col, _ := protocol.ParseNamespacedCollection(ns)
+		if !seen[col.Database] {
+			seen[col.Database] = true
+			dbs = append(dbs, DatabaseInfo{Name: col.Database})
+		}
+	}
+	sort.Slice(dbs, func(i, j int) bool { return dbs[i].Name < dbs[j].Name })
+	return dbs, nil
+}
+
+func (b *memBackend) ListCollections(clientID, db string) ([]CollectionInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var cols []CollectionInfo
+	for ns, c := range b.cols {
+		if col, _ := protocol.ParseNamespacedCollection(ns); col.Database == db {
+			cols = append(cols, CollectionInfo{Name: col.Collection, Options: c.options})
+		}
+	}
+	sort.Slice(cols, func(i, j int) bool { return cols[i].Name < cols[j].Name })
+	return cols, nil
+}
+
+func (b *memBackend) CreateCollection(clientID string, req *protocol.CreateRequest) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.collection(req.Collection, false) != nil {
+		return protocol.ServerErrorf(protocol.CodeNamespaceExists, "Collection already exists. NS: %s", req.Collection.String())
+	}
+	b.collection(req.Collection, true).options = req.Options
+	return nil
+}
+
+func (b *memBackend) DropCollection(clientID string, col protocol.NamespacedCollection) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.collection(col, false) == nil {
+		return protocol.ServerErrorf(protocol.CodeNamespaceNotFound, "ns not found")
+	}
+	delete(b.cols, col.String())
+	return nil
+}
+
+func (b *memBackend) DropDatabase(clientID, db string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ns := range b.cols {
+		if col, _ := protocol.ParseNamespacedCollection(ns); col.Database == db {
+			delete(b.cols, ns)
+		}
+	}
+	return nil
+}
+
+func (b *memBackend) RenameCollection(clientID string, req *protocol.RenameCollectionRequest) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := b.collection(req.From, false)
+	if c == nil {
+		return protocol.ServerErrorf(protocol.CodeNamespaceNotFound, "source namespace does not exist")
+	} else if b.collection(req.To, false) != nil && !req.DropTarget {
+		return protocol.ServerErrorf(protocol.CodeNamespaceExists, "target namespace exists")
+	}
+	delete(b.cols, req.From.String())
+	b.cols[req.To.String()] = c
+	return nil
+}
+
+func (b *memBackend) ModifyCollection(clientID string, req *protocol.CollModRequest) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := b.collection(req.Collection, false)
+	if c == nil {
+		return protocol.ServerErrorf(protocol.CodeNamespaceNotFound, "ns does not exist")
+	}
+	if c.options == nil {
+		c.options = bson.M{}
+	}
+	for k, v := range req.Options {
+		c.options[k] = v
+	}
+	return nil
+}
+
+func (b *memBackend) CreateIndexes(clientID string, col protocol.NamespacedCollection, specs []protocol.IndexSpec) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	created := b.collection(col, false) == nil
+	c := b.collection(col, true)
+	c.indexes = append(c.indexes, specs...)
+	return created, nil
+}
+
+func (b *memBackend) ListIndexes(clientID string, col protocol.NamespacedCollection) ([]protocol.IndexSpec, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := b.collection(col, false)
+	if c == nil {
+		return nil, protocol.ServerErrorf(protocol.CodeNamespaceNotFound, "ns does not exist: %s", col.String())
+	}
+	return append([]protocol.IndexSpec{index.IDIndexSpec()}, c.indexes...), nil
+}
+
+func (b *memBackend) DropIndexes(clientID string, col protocol.NamespacedCollection, names []string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := b.collection(col, false)
+	if c == nil {
+		return protocol.ServerErrorf(protocol.CodeNamespaceNotFound, "ns not found")
+	}
+	kept := c.indexes[:0]
+	for _, spec := range c.indexes {
+		if !containsString(names, spec.Name) {
+			kept = append(kept, spec)
+		}
+	}
+	c.indexes = kept
+	return nil
+}
+
+// scanBackend extends memBackend with IndexScanBackend support and records
+// the indexes that the emulator scans.
+type scanBackend struct {
+	*memBackend
+
+	scanMu   sync.Mutex
+	scans    []string
+	multikey map[string]bool
+}
+
+func newScanBackend() *scanBackend {
+	return &scanBackend{memBackend: newMemBackend(), multikey: make(map[string]bool)}
+}
+
+func (b *scanBackend) IndexInfo(clientID string, col protocol.NamespacedCollection) ([]index.Info, error) {
+	specs, err := b.ListIndexes(clientID, col)
+	if err != nil {
+		return nil, err
+	}
+
+	b.scanMu.Lock()
+	defer b.scanMu.Unlock()
+	infos := make([]index.Info, len(specs))
+	for i, spec := range specs {
+		infos[i] = index.Info{Spec: spec, Multikey: b.multikey[col.String()+"."+spec.Name]}
+	}
+	return infos, nil
+}
+
+func (b *scanBackend) SetMultikey(clientID string, col protocol.NamespacedCollection, name string) error {
+	b.scanMu.Lock()
+	defer b.scanMu.Unlock()
+	b.multikey[col.String()+"."+name] = true
+	return nil
+}
+
+func (b *scanBackend) ScanIndex(clientID string, col protocol.NamespacedCollection, plan *index.Plan) ([]bson.D, error) {
+	b.scanMu.Lock()
+	b.scans = append(b.scans, plan.Index.Name)
+	b.scanMu.Unlock()
+
+	// Return every document referenced by the index; the emulator
+	// filters the candidates.
+	var docs []bson.D
+	for _, doc := range b.docs(col) {
+		if keys, indexed, err := index.ExtractKeys(plan.Index, doc.Map()); err == nil && indexed && len(keys) != 0 {
+			docs = append(docs, doc)
+		}
+	}
+	return docs, nil
+}
+
+func (b *scanBackend) scanned() []string {
+	b.scanMu.Lock()
+	defer b.scanMu.Unlock()
+	return append([]string(nil), b.scans...)
+}
+
+// newTestEmulator returns an emulator backed by b.
+func newTestEmulator(t *testing.T, b Backend) *MongoEmulator {
+	t.Helper()
+	emu, err := NewMongoEmulator(b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return emu
+}
+
+// testCol is the collection used by tests.
+var testCol = protocol.NamespacedCollection{Database: "test", Collection: "col"}
+
+// cmdInfo returns the RequestInfo for a command of the specified type.
+func cmdInfo(reqType protocol.RequestType) protocol.RequestInfo {
+	return protocol.RequestInfo{RequestType: reqType, ReplyType: protocol.ReplyTypeOpMsg}
+}
+
+// mustProcess processes req and returns the first reply document.
+func mustProcess(t *testing.T, emu *MongoEmulator, req protocol.Request) bson.M {
+	t.Helper()
+	res, err := emu.process("client", req)
+	if err != nil {
+		t.Fatalf("%s: %v", req.GetType(), err)
+	}
+	if len(res.Documents) == 0 {
+		return nil
+	}
+	return res.Documents[0]
+}
+
+// insertDocs inserts docs into col via an insert command and fails the test
+// if any of the inserts reports an error.
+func insertDocs(t *testing.T, emu *MongoEmulator, col protocol.NamespacedCollection, docs ...bson.M) {
+	t.Helper()
+	reply := mustProcess(t, emu, &protocol.InsertRequest{
+		RequestInfo: cmdInfo(protocol.RequestTypeInsert),
+		Collection:  col,
+		Inserts:     docs,
+	})
+	if writeErrors := reply["writeErrors"]; writeErrors != nil {
+		t.Fatalf("insert: unexpected write errors: %v", writeErrors)
+	}
+}
+
+// firstBatch returns the documents in the first batch of a cursor reply.
+func firstBatch(t *testing.T, reply bson.M) []bson.D {
+	t.Helper()
+	cursor, ok := reply["cursor"].(bson.M)
+	if !ok {
+		t.Fatalf("expected a cursor reply; got %v", reply)
+	}
+	var docs []bson.D
+	for _, doc := range bsonutil.ToArray(cursor["firstBatch"]) {
+		docs = append(docs, aggregate.ToDocument(doc))
+	}
+	return docs
+}
+
+// ids returns the _id values of docs.
+func ids(docs []bson.D) []interface{} {
+	out := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		out[i], _ = bsonutil.Get(doc, "_id")
+	}
+	return out
+}
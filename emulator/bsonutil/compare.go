@@ -0,0 +1,270 @@
+package bsonutil
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The canonical sort order for BSON types as defined by mongo. Values with a
+// lower order are always considered to be less than values with a higher
+// order regardless of their contents.
+//
+// See https://docs.mongodb.com/manual/reference/bson-type-comparison-order
+const (
+	orderMinKey = iota
+	orderNull
+	orderNumber
+	orderString
+	orderObject
+	orderArray
+	orderBinary
+	orderObjectID
+	orderBool
+	orderDate
+	orderTimestamp
+	orderRegex
+	orderMaxKey
+	orderUnknown
+)
+
+func canonicalOrder(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return orderNull
+	case int, int32, int64, float64, float32, bson.Decimal128:
+		return orderNumber
+	case string, bson.Symbol:
+		return orderString
+	case bson.M, bson.D, map[string]interface{}, bson.RawD:
+		return orderObject
+	case []interface{}, []bson.M, []bson.D, []string:
+		return orderArray
+	case bson.Binary, []byte:
+		return orderBinary
+	case bson.ObjectId:
+		return orderObjectID
+	case bool:
+		return orderBool
+	case time.Time:
+		return orderDate
+	case bson.MongoTimestamp:
+		return orderTimestamp
+	case bson.RegEx:
+		return orderRegex
+	}
+
+	switch v {
+	case bson.Undefined:
+		return orderNull
+	case bson.MinKey:
+		return orderMinKey
+	case bson.MaxKey:
+		return orderMaxKey
+	}
+
+	return orderUnknown
+}
+
+// Compare returns an integer comparing two BSON values using the canonical
+// mongo comparison order. The result will be 0 if a == b, a negative value if
+// a < b and a positive value if a > b.
+func Compare(a, b interface{}) int {
+	oa, ob := canonicalOrder(a), canonicalOrder(b)
+	if oa != ob {
+		return oa - ob
+	}
+
+	switch oa {
+	case orderNull, orderMinKey, orderMaxKey:
+		return 0
+	case orderNumber:
+		return compareNumbers(a, b)
+	case orderString:
+		return strings.Compare(toString(a), toString(b))
+	case orderObject:
+		return compareDocs(a, b)
+	case orderArray:
+		return compareArrays(ToArray(a), ToArray(b))
+	case orderBinary:
+		ba, bb := toBinary(a), toBinary(b)
+		if len(ba.Data) != len(bb.Data) {
+			return len(ba.Data) - len(bb.Data)
+		}
+		if ba.Kind != bb.Kind {
+			return int(ba.Kind) - int(bb.Kind)
+		}
+		return bytes.Compare(ba.Data, bb.Data)
+	case orderObjectID:
+		return strings.Compare(string(a.(bson.ObjectId)), string(b.(bson.ObjectId)))
+	case orderBool:
+		ba, bb := a.(bool), b.(bool)
+		switch {
+		case ba == bb:
+			return 0
+		case !ba:
+			return -1
+		default:
+			return 1
+		}
+	case orderDate:
+		ta, tb := a.(time.Time), b.(time.Time)
+		switch {
+		case ta.Before(tb):
+			return -1
+		case ta.After(tb):
+			return 1
+		default:
+			return 0
+		}
+	case orderTimestamp:
+		ta, tb := a.(bson.MongoTimestamp), b.(bson.MongoTimestamp)
+		switch {
+		case ta < tb:
+			return -1
+		case ta > tb:
+			return 1
+		default:
+			return 0
+		}
+	case orderRegex:
+		ra, rb := a.(bson.RegEx), b.(bson.RegEx)
+		if c := strings.Compare(ra.Pattern, rb.Pattern); c != 0 {
+			return c
+		}
+		return strings.Compare(ra.Options, rb.Options)
+	}
+
+	return 0
+}
+
+// Equal returns true if a and b are equal according to the mongo comparison
+// rules. Numeric values of different types are considered equal if they
+// represent the same value.
+func Equal(a, b interface{}) bool {
+	return Compare(a, b) == 0
+}
+
+func compareNumbers(a, b interface{}) int {
+	// Use integer comparisons when possible to avoid losing precision
+	// for large int64 values.
+	ia, aIsInt := toInt64(a)
+	ib, bIsInt := toInt64(b)
+	if aIsInt && bIsInt {
+		switch {
+		case ia < ib:
+			return -1
+		case ia > ib:
+			return 1
+		default:
+			return 0
+		}
+	}
+
+	fa, _ := ToFloat64(a)
+	fb, _ := ToFloat64(b)
+	switch {
+	case math.IsNaN(fa) && math.IsNaN(fb):
+		return 0
+	case math.IsNaN(fa): // NaN sorts before all other numbers
+		return -1
+	case math.IsNaN(fb):
+		return 1
+	case fa < fb:
+		return -1
+	case fa > fb:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func compareDocs(a, b interface{}) int {
+	ea, eb := Elements(a), Elements(b)
+	for i := 0; i < len(ea) && i < len(eb); i++ {
+		// Compare the type of each field value first, then the field
+		// name and finally the value itself.
+		if c := canonicalOrder(ea[i].Value) - canonicalOrder(eb[i].Value); c != 0 {
+			return c
+		}
+		if c := strings.Compare(ea[i].Name, eb[i].Name); c != 0 {
+			return c
+		}
+		if c := Compare(ea[i].Value, eb[i].Value); c != 0 {
+			return c
+		}
+	}
+	return len(ea) - len(eb)
+}
+
+func compareArrays(a, b []interface{}) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := Compare(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return len(a) - len(b)
+}
+
+// Elements returns the list of fields for a document value. Ordered documents
+// (bson.D) retain their field order while the fields of unordered documents
+// (bson.M) are returned sorted by name so that the output is deterministic.
+// If v is not a document, Elements returns nil.
+func Elements(v interface{}) []bson.DocElem {
+	switch doc := v.(type) {
+	case bson.D:
+		return doc
+	case bson.RawD:
+		elems := make([]bson.DocElem, 0, len(doc))
+		for _, raw := range doc {
+			var val interface{}
+			if err := raw.Value.Unmarshal(&val); err == nil {
+				elems = append(elems, bson.DocElem{Name: raw.Name, Value: val})
+			}
+		}
+		return elems
+	case bson.M:
+		return sortedElements(doc)
+	case map[string]interface{}:
+		return sortedElements(doc)
+	}
+	return nil
+}
+
+func sortedElements(m map[string]interface{}) []bson.DocElem {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	elems := make([]bson.DocElem, len(keys))
+	for i, k := range keys {
+		elems[i] = bson.DocElem{Name: k, Value: m[k]}
+	}
+	return elems
+}
+
+func toString(v interface{}) string {
+	switch s := v.(type) {
+	case string:
+		return s
+	case bson.Symbol:
+		return string(s)
+	}
+	return ""
+}
+
+func toBinary(v interface{}) bson.Binary {
+	switch b := v.(type) {
+	case bson.Binary:
+		return b
+	case []byte:
+		return bson.Binary{Data: b}
+	}
+	return bson.Binary{}
+}
@@ -0,0 +1,205 @@
+package bsonutil
+
+import (
+	"strconv"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// LookupPath resolves a dotted field path against a document without
+// traversing into arrays (numeric path components can still be used to index
+// into array values). It returns false if any path segment is missing.
+func LookupPath(doc interface{}, path string) (interface{}, bool) {
+	cur := doc
+	for _, seg := range strings.Split(path, ".") {
+		if IsArray(cur) {
+			idx, err := strconv.Atoi(seg)
+			arr := ToArray(cur)
+			if err != nil || idx < 0 || idx >= len(arr) {
+				return nil, false
+			}
+			cur = arr[idx]
+			continue
+		}
+
+		next, found := Get(cur, seg)
+		if !found {
+			return nil, false
+		}
+		cur = next
+	}
+	return cur, true
+}
+
+// LookupValues resolves a dotted field path against a document using the
+// mongo query semantics for implicitly traversing arrays. When a path segment
+// refers to an array, the lookup fans out to each one of its elements. The
+// method returns all values that the path resolves to; arrays reached at the
+// end of the path are returned as-is so that callers can match against both
+// the array itself and its elements.
+func LookupValues(doc interface{}, path string) []interface{} {
+	return lookupValues(doc, strings.Split(path, "."))
+}
+
+func lookupValues(cur interface{}, segs []string) []interface{} {
+	if len(segs) == 0 {
+		return []interface{}{cur}
+	}
+
+	if IsArray(cur) {
+		var out []interface{}
+		arr := ToArray(cur)
+
+		// Numeric segments can be used to index directly into an array.
+		if idx, err := strconv.Atoi(segs[0]); err == nil && idx >= 0 && idx < len(arr) {
+			out = append(out, lookupValues(arr[idx], segs[1:])...)
+		}
+
+		// Fan out to embedded documents in the array.
+		for _, elem := range arr {
+			if IsDocument(elem) {
+				out = append(out, lookupValues(elem, segs)...)
+			}
+		}
+		return out
+	}
+
+	next, found := Get(cur, segs[0])
+	if !found {
+		return nil
+	}
+	return lookupValues(next, segs[1:])
+}
+
+// SetPath sets the value of a dotted field path in doc, creating any missing
+// intermediate documents. Numeric path segments can be used to set elements
+// of existing arrays. It returns false if the path traverses a non-document
+// value.
+func SetPath(doc bson.M, path string, value interface{}) bool {
+	segs := strings.Split(path, ".")
+	var cur interface{} = doc
+	for i, seg := range segs {
+		last := i == len(segs)-1
+		switch c := cur.(type) {
+		case bson.M:
+			if last {
+				c[seg] = value
+				return true
+			}
+			next, found := c[seg]
+			if !found || next == nil {
+				next = bson.M{}
+				c[seg] = next
+			} else if d, isD := next.(bson.D); isD {
+				// Convert ordered docs so they can be modified in place.
+				next = d.Map()
+				c[seg] = next
+			}
+			cur = next
+		case map[string]interface{}:
+			return SetPath(bson.M(c), strings.Join(segs[i:], "."), value)
+		case []interface{}:
+			idx, err := strconv.Atoi(seg)
+			if err != nil || idx < 0 {
+				return false
+			}
+			if idx >= len(c) {
+				// Growing arrays requires replacing the slice in
+				// the parent which we don't track here.
+				return false
+			}
+			if last {
+				c[idx] = value
+				return true
+			}
+			if d, isD := c[idx].(bson.D); isD {
+				c[idx] = d.Map()
+			} else if c[idx] == nil {
+				c[idx] = bson.M{}
+			}
+			cur = c[idx]
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// UnsetPath removes a dotted field path from doc. It returns true if the field
+// was found and removed.
+func UnsetPath(doc bson.M, path string) bool {
+	segs := strings.Split(path, ".")
+	var cur interface{} = doc
+	for i, seg := range segs {
+		last := i == len(segs)-1
+		switch c := cur.(type) {
+		case bson.M:
+			next, found := c[seg]
+			if !found {
+				return false
+			}
+			if last {
+				delete(c, seg)
+				return true
+			}
+			if d, isD := next.(bson.D); isD {
+				next = d.Map()
+				c[seg] = next
+			}
+			cur = next
+		case []interface{}:
+			idx, err := strconv.Atoi(seg)
+			if err != nil || idx < 0 || idx >= len(c) {
+				return false
+			}
+			if last {
+				// Mongo sets unset array elements to null.
+				c[idx] = nil
+				return true
+			}
+			if d, isD := c[idx].(bson.D); isD {
+				c[idx] = d.Map()
+			}
+			cur = c[idx]
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// DeepCopy returns a deep copy of a BSON value. Embedded documents are
+// converted to bson.M instances.
+func DeepCopy(v interface{}) interface{} {
+	switch val := v.(type) {
+	case bson.M:
+		return CopyDoc(val)
+	case map[string]interface{}:
+		return CopyDoc(bson.M(val))
+	case bson.D, bson.RawD:
+		return CopyDoc(ToMap(val))
+	}
+
+	if IsArray(v) {
+		arr := ToArray(v)
+		out := make([]interface{}, len(arr))
+		for i, elem := range arr {
+			out[i] = DeepCopy(elem)
+		}
+		return out
+	}
+	return v
+}
+
+// CopyDoc returns a deep copy of doc.
+func CopyDoc(doc bson.M) bson.M {
+	if doc == nil {
+		return nil
+	}
+	out := make(bson.M, len(doc))
+	for k, v := range doc {
+		out[k] = DeepCopy(v)
+	}
+	return out
+}
@@ -0,0 +1,45 @@
+package bsonutil
+
+import (
+	"regexp"
+	"strings"
+)
+
+// CompileRegex compiles a regular expression using the mongo (PCRE) option
+// flags. Only the i, m, s and x flags are supported.
+func CompileRegex(pattern, options string) (*regexp.Regexp, error) {
+	var flags string
+	for _, opt := range options {
+		switch opt {
+		case 'i', 'm', 's':
+			flags += string(opt)
+		case 'x':
+			// Strip unescaped whitespace to emulate extended mode.
+			pattern = stripRegexWhitespace(pattern)
+		}
+	}
+
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	return regexp.Compile(pattern)
+}
+
+func stripRegexWhitespace(pattern string) string {
+	var (
+		sb      strings.Builder
+		escaped bool
+	)
+	for _, r := range pattern {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
@@ -0,0 +1,245 @@
+// Package bsonutil provides helpers for inspecting, comparing and manipulating
+// the BSON values produced by the mgo bson decoder.
+package bsonutil
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// IsDocument returns true if v is an embedded document.
+func IsDocument(v interface{}) bool {
+	return canonicalOrder(v) == orderObject
+}
+
+// IsArray returns true if v is an array value.
+func IsArray(v interface{}) bool {
+	return canonicalOrder(v) == orderArray
+}
+
+// IsNumber returns true if v is a numeric value.
+func IsNumber(v interface{}) bool {
+	return canonicalOrder(v) == orderNumber
+}
+
+// IsNull returns true if v is a null or undefined value.
+func IsNull(v interface{}) bool {
+	return canonicalOrder(v) == orderNull
+}
+
+// SameTypeBracket returns true if a and b belong to the same type bracket
+// in the canonical mongo comparison order (e.g. both are numbers). Query
+// comparison operators only match values within the same bracket.
+func SameTypeBracket(a, b interface{}) bool {
+	return canonicalOrder(a) == canonicalOrder(b)
+}
+
+// ToArray converts any of the array types that can be emitted by the bson
+// decoder into a []interface{}. It returns nil if v is not an array.
+func ToArray(v interface{}) []interface{} {
+	switch arr := v.(type) {
+	case []interface{}:
+		return arr
+	case []bson.M:
+		out := make([]interface{}, len(arr))
+		for i, doc := range arr {
+			out[i] = doc
+		}
+		return out
+	case []bson.D:
+		out := make([]interface{}, len(arr))
+		for i, doc := range arr {
+			out[i] = doc
+		}
+		return out
+	case []string:
+		out := make([]interface{}, len(arr))
+		for i, s := range arr {
+			out[i] = s
+		}
+		return out
+	}
+	return nil
+}
+
+// ToMap converts an embedded document into a bson.M. Nested documents are not
+// converted. It returns nil if v is not a document.
+func ToMap(v interface{}) bson.M {
+	switch doc := v.(type) {
+	case bson.M:
+		return doc
+	case map[string]interface{}:
+		return bson.M(doc)
+	case bson.D:
+		return doc.Map()
+	case bson.RawD:
+		out := make(bson.M, len(doc))
+		for _, elem := range Elements(doc) {
+			out[elem.Name] = elem.Value
+		}
+		return out
+	}
+	return nil
+}
+
+// Get returns the value of a top-level field in an embedded document.
+func Get(doc interface{}, field string) (interface{}, bool) {
+	switch d := doc.(type) {
+	case bson.M:
+		v, found := d[field]
+		return v, found
+	case map[string]interface{}:
+		v, found := d[field]
+		return v, found
+	case bson.D:
+		for _, elem := range d {
+			if elem.Name == field {
+				return elem.Value, true
+			}
+		}
+	case bson.RawD:
+		for _, elem := range Elements(d) {
+			if elem.Name == field {
+				return elem.Value, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// ToFloat64 converts a numeric value into a float64.
+func ToFloat64(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	case bson.Decimal128:
+		f, err := strconv.ParseFloat(n.String(), 64)
+		if err != nil {
+			return math.NaN(), true
+		}
+		return f, true
+	}
+	return 0, false
+}
+
+// ToInt64 converts a numeric value into an int64. Floating point values are
+// only converted if they do not have a fractional part.
+func ToInt64(v interface{}) (int64, bool) {
+	if i, ok := toInt64(v); ok {
+		return i, true
+	}
+
+	if f, ok := ToFloat64(v); ok && f == math.Trunc(f) && !math.IsInf(f, 0) {
+		return int64(f), true
+	}
+	return 0, false
+}
+
+func toInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	}
+	return 0, false
+}
+
+// TypeName returns the mongo alias for the type of v as reported by the $type
+// aggregation operator.
+func TypeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case float64, float32:
+		return "double"
+	case string:
+		return "string"
+	case bson.Symbol:
+		return "symbol"
+	case bson.M, bson.D, map[string]interface{}, bson.RawD:
+		return "object"
+	case []interface{}, []bson.M, []bson.D, []string:
+		return "array"
+	case bson.Binary, []byte:
+		return "binData"
+	case bson.ObjectId:
+		return "objectId"
+	case bool:
+		return "bool"
+	case time.Time:
+		return "date"
+	case bson.RegEx:
+		return "regex"
+	case bson.DBPointer:
+		return "dbPointer"
+	case bson.JavaScript:
+		return "javascript"
+	case int, int32:
+		return "int"
+	case int64:
+		return "long"
+	case bson.MongoTimestamp:
+		return "timestamp"
+	case bson.Decimal128:
+		return "decimal"
+	}
+
+	switch v {
+	case bson.Undefined:
+		return "undefined"
+	case bson.MinKey:
+		return "minKey"
+	case bson.MaxKey:
+		return "maxKey"
+	}
+	return "unknown"
+}
+
+// TypeNumber returns the numeric BSON type identifier for the type of v.
+func TypeNumber(v interface{}) int {
+	return typeNumbers[TypeName(v)]
+}
+
+// TypeNumberForAlias returns the numeric BSON type identifier for a type alias
+// such as "string" or "objectId".
+func TypeNumberForAlias(alias string) (int, bool) {
+	n, found := typeNumbers[alias]
+	return n, found
+}
+
+var typeNumbers = map[string]int{
+	"double":     1,
+	"string":     2,
+	"object":     3,
+	"array":      4,
+	"binData":    5,
+	"undefined":  6,
+	"objectId":   7,
+	"bool":       8,
+	"date":       9,
+	"null":       10,
+	"regex":      11,
+	"dbPointer":  12,
+	"javascript": 13,
+	"symbol":     14,
+	"int":        16,
+	"timestamp":  17,
+	"long":       18,
+	"decimal":    19,
+	"minKey":     -1,
+	"maxKey":     127,
+}
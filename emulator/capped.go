@@ -0,0 +1,412 @@
+package emulator
+
+import (
+	"sync"
+
+	"github.com/achilleasa/mongolite/emulator/aggregate"
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/emulator/filter"
+	"github.com/achilleasa/mongolite/protocol"
+	"golang.org/x/xerrors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The minimum size of a capped collection. Like mongod, the emulator rounds
+// the size of capped collections up to a multiple of 256 bytes.
+const minCappedSize = 4096
+
+// cappedSpec describes the bounds of a capped collection.
+type cappedSpec struct {
+	// The maximum total size of the documents in bytes.
+	size int64
+
+	// The maximum number of documents or 0 if only the size is bounded.
+	max int64
+}
+
+// cappedCollections caches the bounds of capped collections. The bounds are
+// stored by the backend as collection options (capped, size and max) and
+// loaded via CatalogBackend the first time a collection is written to or
+// tailed.
+//
+// Capped collections are emulated on top of regular backend collections:
+// after each insert, the emulator evicts the oldest documents until the
+// collection is back within its bounds. Backends must therefore return the
+// documents of capped collections in insertion order when a query does not
+// specify a sort order.
+type cappedCollections struct {
+	mu sync.Mutex
+
+	// The bounds for each known collection keyed by namespace. A nil
+	// value indicates that the collection is not capped.
+	specs map[string]*cappedSpec
+
+	// The running totals of the documents in each capped collection keyed
+	// by namespace. The totals are computed by scanning the collection the
+	// first time that a document is inserted into it and are then updated
+	// as documents are inserted and evicted. Writes that may change the
+	// totals in other ways discard them so that they are recomputed.
+	usage map[string]*cappedUsage
+}
+
+// cappedUsage tracks the total size and number of the documents in a capped
+// collection.
+type cappedUsage struct {
+	size  int64
+	count int64
+}
+
+// exceeds returns true if the documents tracked by u do not fit within the
+// bounds described by spec.
+func (u *cappedUsage) exceeds(spec *cappedSpec) bool {
+	return u.size > spec.size || (spec.max > 0 && u.count > spec.max)
+}
+
+func newCappedCollections() *cappedCollections {
+	return &cappedCollections{
+		specs: make(map[string]*cappedSpec),
+		usage: make(map[string]*cappedUsage),
+	}
+}
+
+// invalidate discards the cached bounds and totals if req modifies the
+// catalog.
+func (c *cappedCollections) invalidate(req protocol.Request) {
+	switch req.(type) {
+	case *protocol.CreateRequest, *protocol.DropRequest, *protocol.DropDatabaseRequest,
+		*protocol.RenameCollectionRequest, *protocol.CollModRequest:
+		c.mu.Lock()
+		c.specs = make(map[string]*cappedSpec)
+		c.usage = make(map[string]*cappedUsage)
+		c.mu.Unlock()
+	}
+}
+
+// discardUsage discards the totals of col after a write that may have
+// updated or deleted some of its documents.
+func (c *cappedCollections) discardUsage(col protocol.NamespacedCollection) {
+	c.mu.Lock()
+	delete(c.usage, col.String())
+	c.mu.Unlock()
+}
+
+// discardAllUsage discards the totals of all capped collections. The totals
+// account for the documents inserted by transactions before they commit so
+// they must be discarded when a transaction aborts.
+func (c *cappedCollections) discardAllUsage() {
+	c.mu.Lock()
+	c.usage = make(map[string]*cappedUsage)
+	c.mu.Unlock()
+}
+
+// cappedSpec returns the bounds of col or nil if col is not a capped
+// collection.
+func (emu *MongoEmulator) cappedSpec(clientID string, col protocol.NamespacedCollection) (*cappedSpec, error) {
+	c := emu.capped
+	c.mu.Lock()
+	spec, found := c.specs[col.String()]
+	c.mu.Unlock()
+	if found {
+		return spec, nil
+	}
+
+	cb, ok := emu.b.(CatalogBackend)
+	if !ok {
+		return nil, nil
+	}
+	colList, err := cb.ListCollections(clientID, col.Database)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range colList {
+		if info.Name != col.Collection || info.Options["capped"] != true {
+			continue
+		}
+		size, _ := bsonutil.ToInt64(info.Options["size"])
+		max, _ := bsonutil.ToInt64(info.Options["max"])
+		spec = &cappedSpec{size: cappedSize(size), max: max}
+	}
+
+	c.mu.Lock()
+	c.specs[col.String()] = spec
+	c.mu.Unlock()
+	return spec, nil
+}
+
+// cappedSize returns the actual size of a capped collection for which the
+// client requested the provided size.
+func cappedSize(size int64) int64 {
+	if size < minCappedSize {
+		return minCappedSize
+	}
+	return (size + 255) / 256 * 256
+}
+
+// setCappedOptions records the bounds of a capped collection that req creates
+// as collection options.
+func setCappedOptions(req *protocol.CreateRequest) {
+	if !req.Capped {
+		return
+	}
+	if req.Options == nil {
+		req.Options = bson.M{}
+	}
+	req.Options["capped"] = true
+	req.Options["size"] = req.Size
+	if req.Max > 0 {
+		req.Options["max"] = req.Max
+	}
+}
+
+// enforceCappedBounds evicts the oldest documents of col if it is a capped
+// collection that exceeds its bounds after the provided documents were
+// inserted into it and wakes up any tailable cursors that await new
+// documents. A nil inserted slice indicates that the inserted documents are
+// not known (e.g. for upserts) and the totals of col must be recomputed.
+// Callers must hold writeMu (or the replica set mutex for the oplog) so that
+// the totals of col are updated by a single writer at a time.
+func (emu *MongoEmulator) enforceCappedBounds(clientID string, origin protocol.Request, col protocol.NamespacedCollection, inserted []bson.M) error {
+	spec, err := emu.cappedSpec(clientID, col)
+	if err != nil || spec == nil {
+		return err
+	}
+
+	c := emu.capped
+	c.mu.Lock()
+	usage := c.usage[col.String()]
+	c.mu.Unlock()
+	if usage != nil && inserted != nil {
+		for _, doc := range inserted {
+			data, err := bson.Marshal(doc)
+			if err != nil {
+				return err
+			}
+			usage.size += int64(len(data))
+			usage.count++
+		}
+	} else if usage, err = emu.scanCappedUsage(clientID, origin, col); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.usage[col.String()] = usage
+	c.mu.Unlock()
+	if usage.exceeds(spec) {
+		if err = emu.trimCappedCollection(clientID, origin, col, spec, usage); err != nil {
+			// The totals no longer reflect the documents that
+			// have been evicted so far.
+			c.discardUsage(col)
+			return err
+		}
+	}
+	emu.writes.notify()
+	return nil
+}
+
+// scanCappedUsage computes the totals of a capped collection by reading all
+// of its documents.
+func (emu *MongoEmulator) scanCappedUsage(clientID string, origin protocol.Request, col protocol.NamespacedCollection) (*cappedUsage, error) {
+	src := &backendSource{b: emu.b, clientID: clientID, origin: origin}
+	docs, err := src.Find(col, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	usage := new(cappedUsage)
+	for _, doc := range docs {
+		data, err := bson.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		usage.size += int64(len(data))
+		usage.count++
+	}
+	return usage, nil
+}
+
+// cappedEvictBatchSize is the minimum number of documents that
+// trimCappedCollection fetches at a time when looking for documents to evict.
+const cappedEvictBatchSize = 16
+
+// trimCappedCollection evicts the oldest documents of a capped collection
+// until the totals tracked by usage are within the bounds described by spec.
+// Only the documents that are about to be evicted are read from the backend.
+func (emu *MongoEmulator) trimCappedCollection(clientID string, origin protocol.Request, col protocol.NamespacedCollection, spec *cappedSpec, usage *cappedUsage) error {
+	src := &backendSource{b: emu.b, clientID: clientID, origin: origin}
+	req := &protocol.DeleteRequest{
+		RequestInfo: derivedRequestInfo(origin, protocol.RequestTypeDelete, protocol.ReplyTypeOpMsg),
+		Collection:  col,
+	}
+
+	for usage.exceeds(spec) {
+		batchSize := int64(cappedEvictBatchSize)
+		if spec.max > 0 && usage.count-spec.max > batchSize {
+			batchSize = usage.count - spec.max
+		}
+		docs, err := src.Query(col, aggregate.Query{Limit: batchSize})
+		if err != nil {
+			return err
+		} else if len(docs) == 0 {
+			return xerrors.Errorf("capped collection %q is empty but its documents exceed its bounds", col.String())
+		}
+
+		for _, doc := range docs {
+			if !usage.exceeds(spec) {
+				break
+			}
+			data, err := bson.Marshal(doc)
+			if err != nil {
+				return err
+			}
+			id, _ := bsonutil.Get(doc, "_id")
+			if _, err := emu.deleteDocuments(clientID, req, protocol.DeleteTarget{Selector: bson.M{"_id": id}, Limit: 1}); err != nil {
+				return err
+			}
+			usage.size -= int64(len(data))
+			usage.count--
+		}
+	}
+	return nil
+}
+
+// maybeProcessTailableQuery services queries that request a tailable cursor.
+// The handled return value is false for all other requests.
+func (emu *MongoEmulator) maybeProcessTailableQuery(clientID string, req protocol.Request) (res protocol.Response, handled bool, err error) {
+	r, isQuery := req.(*protocol.QueryRequest)
+	if !isQuery || r.Flags&protocol.QueryFlagTailableCursor == 0 {
+		return protocol.Response{}, false, nil
+	}
+
+	spec, err := emu.cappedSpec(clientID, r.Collection)
+	if err != nil {
+		return protocol.Response{}, true, err
+	} else if spec == nil {
+		return protocol.Response{}, true, protocol.ServerErrorf(protocol.CodeBadValue, "error processing query: ns=%s tailable cursor requested on non capped collection", r.Collection.String())
+	}
+	for _, elem := range r.Sort {
+		if elem.Name != "$natural" || asInt(elem.Value) != 1 {
+			return protocol.Response{}, true, protocol.ServerErrorf(protocol.CodeBadValue, "cannot use tailable option with a sort other than {$natural: 1}")
+		}
+	}
+
+	matcher, err := filter.Compile(r.Query)
+	if err != nil {
+		return protocol.Response{}, true, err
+	}
+	t := &cappedTailer{
+		emu:           emu,
+		col:           r.Collection,
+		matcher:       matcher,
+		fieldSelector: r.FieldSelector,
+		skip:          int(r.NumToSkip),
+	}
+
+	batchSize := int(r.NumToReturn)
+	if batchSize < 0 {
+		batchSize = -batchSize
+	} else if batchSize == 0 {
+		batchSize = defaultBatchSize
+	}
+	batch, _, err := t.poll(clientID, batchSize)
+	if err != nil {
+		return protocol.Response{}, true, err
+	}
+	cursorID := emu.cursors.registerTailable(r.Collection, t, r.Flags&protocol.QueryFlagAwaitData != 0)
+
+	// Find commands receive a cursor document whereas legacy queries
+	// receive the documents in the reply itself.
+	if r.GetReplyType() == protocol.ReplyTypeOpMsg {
+		return cursorResponse(r.Collection.String(), cursorID, toBatch(batch)), true, nil
+	}
+	docs := make([]bson.M, len(batch))
+	for i, doc := range batch {
+		docs[i] = bsonutil.ToMap(doc)
+	}
+	return protocol.Response{CursorID: cursorID, Documents: docs}, true, nil
+}
+
+// cappedTailer implements tailer for tailable cursors over capped
+// collections. It tracks the _id of the most recent document that it has
+// examined and returns the matching documents that were inserted after it.
+// Like the oplog, the tailer relies on the _id of the documents of the
+// collection increasing in insertion order, which is the case for the
+// ObjectIds generated by drivers and the emulator.
+type cappedTailer struct {
+	emu           *MongoEmulator
+	col           protocol.NamespacedCollection
+	matcher       *filter.Matcher
+	fieldSelector bson.M
+
+	mu sync.Mutex
+
+	// The number of matching documents to skip before returning any
+	// documents.
+	skip int
+
+	// The _id of the most recently examined document. The position is
+	// unset until the tailer has examined at least one document.
+	lastID      interface{}
+	hasPosition bool
+}
+
+// poll implements tailer.
+func (t *cappedTailer) poll(clientID string, batchSize int) ([]bson.D, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Only the documents following the last examined one are read. The
+	// last examined document is read as well to detect whether it has
+	// been evicted in the meantime.
+	query := bson.M{}
+	if t.hasPosition {
+		query = bson.M{"_id": bson.M{"$gte": t.lastID}}
+	}
+	src := &backendSource{b: t.emu.b, clientID: clientID}
+	docs, err := src.Find(t.col, query)
+	if err != nil {
+		return nil, false, err
+	}
+	if t.hasPosition {
+		if len(docs) == 0 {
+			return nil, false, t.positionLost()
+		} else if id, _ := bsonutil.Get(docs[0], "_id"); !bsonutil.Equal(id, t.lastID) {
+			return nil, false, t.positionLost()
+		}
+		docs = docs[1:]
+	}
+
+	var batch []bson.D
+	for _, doc := range docs {
+		if batchSize > 0 && len(batch) == batchSize {
+			break
+		}
+		t.lastID, _ = bsonutil.Get(doc, "_id")
+		t.hasPosition = true
+
+		if !t.matcher.Match(doc) {
+			continue
+		} else if t.skip > 0 {
+			t.skip--
+			continue
+		}
+
+		if len(t.fieldSelector) != 0 {
+			if doc, err = t.emu.project(clientID, nil, t.col, t.fieldSelector, doc); err != nil {
+				return nil, false, err
+			}
+		}
+		batch = append(batch, doc)
+	}
+	return batch, false, nil
+}
+
+// positionLost returns the error reported when the most recently examined
+// document has been evicted from the collection.
+func (t *cappedTailer) positionLost() error {
+	return protocol.ServerErrorf(protocol.CodeCappedPositionLost, "CollectionScan died due to position in capped collection being deleted. Last seen record id: %v", t.lastID)
+}
+
+// cursorFields implements tailer.
+func (t *cappedTailer) cursorFields() bson.M {
+	return nil
+}
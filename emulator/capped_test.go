@@ -0,0 +1,163 @@
+package emulator
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/protocol"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// createCapped creates the test collection as a capped collection that holds
+// up to max documents.
+func createCapped(t *testing.T, emu *MongoEmulator, max int64) {
+	t.Helper()
+	mustProcess(t, emu, &protocol.CreateRequest{
+		RequestInfo: cmdInfo(protocol.RequestTypeCreate),
+		Collection:  testCol,
+		Capped:      true,
+		Size:        minCappedSize,
+		Max:         max,
+	})
+}
+
+// fullScans returns the number of queries recorded by b that read all
+// documents of col.
+func fullScans(b *queryRecorder, col protocol.NamespacedCollection) int {
+	var n int
+	for _, q := range b.queries {
+		if q.Collection == col && len(q.Query) == 0 && q.NumToReturn == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func TestCappedCollectionBounds(t *testing.T) {
+	b := &queryRecorder{memBackend: newMemBackend()}
+	emu := newTestEmulator(t, b)
+	createCapped(t, emu, 3)
+	for id := 1; id <= 5; id++ {
+		insertDocs(t, emu, testCol, bson.M{"_id": id})
+	}
+	if got, exp := ids(b.docs(testCol)), []interface{}{3, 4, 5}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected _id %v after the oldest documents were evicted; got %v", exp, got)
+	}
+	if n := fullScans(b, testCol); n != 1 {
+		t.Fatalf("expected the collection to be scanned once; got %d scans", n)
+	}
+
+	// Deletes discard the running totals so the next insert scans the
+	// collection again.
+	mustProcess(t, emu, &protocol.DeleteRequest{
+		RequestInfo: cmdInfo(protocol.RequestTypeDelete),
+		Collection:  testCol,
+		Deletes:     []protocol.DeleteTarget{{Selector: bson.M{"_id": 3}, Limit: 1}},
+	})
+	insertDocs(t, emu, testCol, bson.M{"_id": 6})
+	insertDocs(t, emu, testCol, bson.M{"_id": 7})
+	if got, exp := ids(b.docs(testCol)), []interface{}{5, 6, 7}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected _id %v after the oldest documents were evicted; got %v", exp, got)
+	}
+	if n := fullScans(b, testCol); n != 2 {
+		t.Fatalf("expected the collection to be scanned twice; got %d scans", n)
+	}
+}
+
+func TestCappedTailer(t *testing.T) {
+	b := &queryRecorder{memBackend: newMemBackend()}
+	emu := newTestEmulator(t, b)
+	createCapped(t, emu, 3)
+	insertDocs(t, emu, testCol, bson.M{"_id": 1}, bson.M{"_id": 2})
+
+	reply := mustProcess(t, emu, &protocol.QueryRequest{
+		RequestInfo: cmdInfo(protocol.RequestTypeQuery),
+		Collection:  testCol,
+		Flags:       protocol.QueryFlagTailableCursor | protocol.QueryFlagAwaitData,
+	})
+	if got, exp := ids(firstBatch(t, reply)), []interface{}{1, 2}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected first batch %v; got %v", exp, got)
+	}
+	cursorID, _ := bsonutil.ToMap(reply["cursor"])["id"].(int64)
+
+	getMore := func() ([]interface{}, error) {
+		res, err := emu.process("client", &protocol.GetMoreRequest{
+			RequestInfo: cmdInfo(protocol.RequestTypeGetMore),
+			Collection:  testCol,
+			CursorID:    cursorID,
+			MaxTimeMS:   1,
+		})
+		if err != nil {
+			return nil, err
+		}
+		var got []interface{}
+		for _, doc := range bsonutil.ToArray(bsonutil.ToMap(res.Documents[0]["cursor"])["nextBatch"]) {
+			got = append(got, bsonutil.ToMap(doc)["_id"])
+		}
+		return got, nil
+	}
+
+	b.queries = nil
+	insertDocs(t, emu, testCol, bson.M{"_id": 3})
+	got, err := getMore()
+	if err != nil {
+		t.Fatal(err)
+	} else if exp := []interface{}{3}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected next batch %v; got %v", exp, got)
+	}
+	expQuery := bson.M{"_id": bson.M{"$gte": 2}}
+	if last := b.queries[len(b.queries)-1]; !reflect.DeepEqual(last.Query, expQuery) {
+		t.Fatalf("expected the tailer to query %v; got %v", expQuery, last.Query)
+	}
+
+	// The last document returned to the cursor is evicted.
+	insertDocs(t, emu, testCol, bson.M{"_id": 4})
+	insertDocs(t, emu, testCol, bson.M{"_id": 5})
+	insertDocs(t, emu, testCol, bson.M{"_id": 6})
+	if _, err := getMore(); !hasErrorCode(err, protocol.CodeCappedPositionLost) {
+		t.Fatalf("expected CappedPositionLost; got %v", err)
+	}
+}
+
+func TestOplogIsCapped(t *testing.T) {
+	b := newMemBackend()
+	emu := newTestEmulator(t, b)
+	if err := emu.EnableReplicaSet("rs0", "localhost:27017"); err != nil {
+		t.Fatal(err)
+	}
+	emu.oplogSize = minCappedSize
+	mustProcess(t, emu, &protocol.ReplSetInitiateRequest{
+		RequestInfo: cmdInfo(protocol.RequestTypeReplSetInitiate),
+	})
+	cursorID := watch(t, emu)
+
+	const numDocs = 100
+	for id := 1; id <= numDocs; id++ {
+		insertDocs(t, emu, testCol, bson.M{"_id": id})
+	}
+
+	entries := b.docs(oplogCollection)
+	var size int
+	for _, entry := range entries {
+		data, err := bson.Marshal(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size += len(data)
+	}
+	if size > minCappedSize || len(entries) >= numDocs {
+		t.Fatalf("expected the oplog to be bounded to %d bytes; got %d entries with %d bytes", minCappedSize, len(entries), size)
+	}
+
+	// The change stream has not read the evicted entries.
+	_, err := emu.process("client", &protocol.GetMoreRequest{
+		RequestInfo: cmdInfo(protocol.RequestTypeGetMore),
+		Collection:  testCol,
+		CursorID:    cursorID,
+		MaxTimeMS:   1,
+	})
+	if !hasErrorCode(err, protocol.CodeChangeStreamHistoryLost) {
+		t.Fatalf("expected ChangeStreamHistoryLost; got %v", err)
+	}
+}
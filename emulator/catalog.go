@@ -0,0 +1,317 @@
+package emulator
+
+import (
+	"fmt"
+
+	"github.com/achilleasa/mongolite/emulator/filter"
+	"github.com/achilleasa/mongolite/protocol"
+	"golang.org/x/xerrors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// DatabaseInfo describes a database managed by a backend.
+type DatabaseInfo struct {
+	Name       string
+	SizeOnDisk int64
+	Empty      bool
+}
+
+// CollectionInfo describes a collection managed by a backend.
+type CollectionInfo struct {
+	Name string
+
+	// The options that were specified when the collection was created
+	// or modified via collMod.
+	Options bson.M
+
+	// True if this is a read-only collection (e.g. a view).
+	ReadOnly bool
+}
+
+// CatalogBackend is implemented by backends that can list, create and drop
+// databases and collections. Requests for catalog operations against backends
+// that do not implement this interface fail with ErrUnsupportedRequest.
+type CatalogBackend interface {
+	Backend
+
+	// ListDatabases returns information about the known databases.
+	ListDatabases(clientID string) ([]DatabaseInfo, error)
+
+	// ListCollections returns information about the collections in db.
+	ListCollections(clientID, db string) ([]CollectionInfo, error)
+
+	// CreateCollection creates a new collection. It returns a NamespaceExists
+	// server error if the collection already exists.
+	CreateCollection(clientID string, req *protocol.CreateRequest) error
+
+	// DropCollection drops a collection and its indexes. It returns a
+	// NamespaceNotFound server error if the collection does not exist.
+	DropCollection(clientID string, col protocol.NamespacedCollection) error
+
+	// DropDatabase drops a database and all its collections.
+	DropDatabase(clientID, db string) error
+
+	// RenameCollection renames a collection, optionally moving it to a
+	// different database.
+	RenameCollection(clientID string, req *protocol.RenameCollectionRequest) error
+
+	// ModifyCollection updates the options of an existing collection.
+	ModifyCollection(clientID string, req *protocol.CollModRequest) error
+}
+
+func (emu *MongoEmulator) catalogBackend(req protocol.Request) (CatalogBackend, error) {
+	if cb, ok := emu.b.(CatalogBackend); ok {
+		return cb, nil
+	}
+	return nil, xerrors.Errorf("request %q: %w", req.GetType(), ErrUnsupportedRequest)
+}
+
+func (emu *MongoEmulator) handleListDatabases(clientID string, r protocol.Request) (protocol.Response, error) {
+	req := r.(*protocol.ListDatabasesRequest)
+	cb, err := emu.catalogBackend(req)
+	if err != nil {
+		return protocol.Response{}, err
+	}
+
+	matcher, err := filter.Compile(req.Filter)
+	if err != nil {
+		return protocol.Response{}, err
+	}
+
+	dbList, err := cb.ListDatabases(clientID)
+	if err != nil {
+		return protocol.Response{}, err
+	}
+
+	var (
+		dbDocs    = make([]interface{}, 0, len(dbList))
+		totalSize int64
+	)
+	for _, db := range dbList {
+		dbDoc := bson.M{
+			"name":       db.Name,
+			"sizeOnDisk": db.SizeOnDisk,
+			"empty":      db.Empty,
+		}
+		if !matcher.Match(dbDoc) {
+			continue
+		}
+
+		if req.NameOnly {
+			dbDoc = bson.M{"name": db.Name}
+		}
+		dbDocs = append(dbDocs, dbDoc)
+		totalSize += db.SizeOnDisk
+	}
+
+	resDoc := bson.M{
+		"ok":        1,
+		"databases": dbDocs,
+	}
+	if !req.NameOnly {
+		resDoc["totalSize"] = totalSize
+	}
+
+	return protocol.Response{Documents: []bson.M{resDoc}}, nil
+}
+
+func (emu *MongoEmulator) handleListCollections(clientID string, r protocol.Request) (protocol.Response, error) {
+	req := r.(*protocol.ListCollectionsRequest)
+	cb, err := emu.catalogBackend(req)
+	if err != nil {
+		return protocol.Response{}, err
+	}
+
+	matcher, err := filter.Compile(req.Filter)
+	if err != nil {
+		return protocol.Response{}, err
+	}
+
+	colList, err := cb.ListCollections(clientID, req.Database)
+	if err != nil {
+		return protocol.Response{}, err
+	}
+
+	colDocs := make([]interface{}, 0, len(colList))
+	for _, col := range colList {
+		colDoc := collectionInfoDoc(req.Database, col)
+		if !matcher.Match(colDoc) {
+			continue
+		}
+
+		if req.NameOnly {
+			colDoc = bson.M{"name": colDoc["name"], "type": colDoc["type"]}
+		}
+		colDocs = append(colDocs, colDoc)
+	}
+
+	// The full collection list is always returned in the first batch so
+	// we don't need to keep track of an open cursor.
+	return cursorResponse(fmt.Sprintf("%s.$cmd.listCollections", req.Database), 0, colDocs), nil
+}
+
+// collectionInfoDoc formats a CollectionInfo entry using the schema returned
+// by mongod for listCollections requests.
+func collectionInfoDoc(db string, col CollectionInfo) bson.M {
+	options := col.Options
+	if options == nil {
+		options = bson.M{}
+	}
+
+	colType := "collection"
+	if _, isView := options["viewOn"]; isView {
+		colType = "view"
+	}
+
+	colDoc := bson.M{
+		"name":    col.Name,
+		"type":    colType,
+		"options": options,
+		"info": bson.M{
+			"readOnly": col.ReadOnly || colType == "view",
+		},
+	}
+
+	if colType == "collection" {
+		colDoc["idIndex"] = bson.M{
+			"v":    2,
+			"key":  bson.M{"_id": 1},
+			"name": "_id_",
+			"ns":   fmt.Sprintf("%s.%s", db, col.Name),
+		}
+	}
+
+	return colDoc
+}
+
+func (emu *MongoEmulator) handleCreate(clientID string, r protocol.Request) (protocol.Response, error) {
+	req := r.(*protocol.CreateRequest)
+	cb, err := emu.catalogBackend(req)
+	if err != nil {
+		return protocol.Response{}, err
+	}
+
+	if err := validateCollectionName(req.Collection.Collection); err != nil {
+		return protocol.Response{}, err
+	}
+
+	// Capped collections are emulated so their bounds are persisted as
+	// collection options.
+	setCappedOptions(req)
+
+	if err := cb.CreateCollection(clientID, req); err != nil {
+		return protocol.Response{}, err
+	}
+	return okResponse(), nil
+}
+
+func (emu *MongoEmulator) handleDrop(clientID string, r protocol.Request) (protocol.Response, error) {
+	req := r.(*protocol.DropRequest)
+	cb, err := emu.catalogBackend(req)
+	if err != nil {
+		return protocol.Response{}, err
+	}
+
+	if err := cb.DropCollection(clientID, req.Collection); err != nil {
+		return protocol.Response{}, err
+	}
+
+	return protocol.Response{
+		Documents: []bson.M{{
+			"ok": 1,
+			"ns": req.Collection.String(),
+		}},
+	}, nil
+}
+
+func (emu *MongoEmulator) handleDropDatabase(clientID string, r protocol.Request) (protocol.Response, error) {
+	req := r.(*protocol.DropDatabaseRequest)
+	cb, err := emu.catalogBackend(req)
+	if err != nil {
+		return protocol.Response{}, err
+	}
+
+	if err := cb.DropDatabase(clientID, req.Database); err != nil {
+		return protocol.Response{}, err
+	}
+
+	return protocol.Response{
+		Documents: []bson.M{{
+			"ok":      1,
+			"dropped": req.Database,
+		}},
+	}, nil
+}
+
+func (emu *MongoEmulator) handleRenameCollection(clientID string, r protocol.Request) (protocol.Response, error) {
+	req := r.(*protocol.RenameCollectionRequest)
+	cb, err := emu.catalogBackend(req)
+	if err != nil {
+		return protocol.Response{}, err
+	}
+
+	if req.From == req.To {
+		return protocol.Response{}, protocol.ServerErrorf(protocol.CodeIllegalOperation, "Can't rename a collection to itself")
+	}
+	if err := validateCollectionName(req.To.Collection); err != nil {
+		return protocol.Response{}, err
+	}
+
+	if err := cb.RenameCollection(clientID, req); err != nil {
+		return protocol.Response{}, err
+	}
+	return okResponse(), nil
+}
+
+func (emu *MongoEmulator) handleCollMod(clientID string, r protocol.Request) (protocol.Response, error) {
+	req := r.(*protocol.CollModRequest)
+	cb, err := emu.catalogBackend(req)
+	if err != nil {
+		return protocol.Response{}, err
+	}
+
+	if err := cb.ModifyCollection(clientID, req); err != nil {
+		return protocol.Response{}, err
+	}
+	return okResponse(), nil
+}
+
+// validateCollectionName ensures that name is a valid mongo collection name.
+func validateCollectionName(name string) error {
+	switch {
+	case name == "":
+		return protocol.ServerErrorf(protocol.CodeInvalidNamespace, "Invalid collection name: collection names cannot be empty")
+	case name[0] == '.' || name[len(name)-1] == '.':
+		return protocol.ServerErrorf(protocol.CodeInvalidNamespace, "Invalid collection name: %s", name)
+	}
+
+	for _, r := range name {
+		if r == '$' || r == 0 {
+			return protocol.ServerErrorf(protocol.CodeInvalidNamespace, "Invalid collection name: %s", name)
+		}
+	}
+	return nil
+}
+
+// okResponse returns a response with a single {ok: 1} document.
+func okResponse() protocol.Response {
+	return protocol.Response{
+		Documents: []bson.M{{"ok": 1}},
+	}
+}
+
+// cursorResponse formats a batch of documents using the cursor reply schema
+// expected by clients for commands such as find, aggregate and
+// listCollections.
+func cursorResponse(ns string, cursorID int64, firstBatch []interface{}) protocol.Response {
+	return protocol.Response{
+		Documents: []bson.M{{
+			"ok": 1,
+			"cursor": bson.M{
+				"id":         cursorID,
+				"ns":         ns,
+				"firstBatch": firstBatch,
+			},
+		}},
+	}
+}
@@ -0,0 +1,529 @@
+package emulator
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/achilleasa/mongolite/emulator/aggregate"
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/emulator/filter"
+	"github.com/achilleasa/mongolite/protocol"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// changeStreamStages lists the stages that may follow the $changeStream stage
+// of a pipeline.
+var changeStreamStages = map[string]bool{
+	"$match":       true,
+	"$project":     true,
+	"$addFields":   true,
+	"$set":         true,
+	"$unset":       true,
+	"$replaceRoot": true,
+	"$replaceWith": true,
+}
+
+// changeStream generates change events from the entries of the oplog. Each
+// change stream watches either a single collection, all the collections of a
+// database or all the collections of the deployment.
+//
+// See https://docs.mongodb.com/manual/changeStreams
+type changeStream struct {
+	emu *MongoEmulator
+
+	// The watched namespace. The collection name is empty for database
+	// and deployment-wide change streams.
+	ns      protocol.NamespacedCollection
+	cluster bool
+
+	// If true, update events include the current contents of the updated
+	// document.
+	updateLookup bool
+
+	// The stages that follow $changeStream and the variables they can
+	// access.
+	pipeline *aggregate.Pipeline
+	let      bson.M
+
+	mu sync.Mutex
+
+	// The timestamp of the most recent oplog entry that has been
+	// processed.
+	lastTS bson.MongoTimestamp
+
+	// The events that have not been returned to the client yet.
+	pending []bson.D
+
+	// The token of the most recent event returned to the client or, if
+	// no events are pending, the token for lastTS.
+	resumeToken bson.D
+
+	// Set once the stream has emitted an invalidate event.
+	invalidated bool
+}
+
+// maybeProcessChangeStream services aggregations whose first stage is
+// $changeStream. The handled return value is false for all other requests.
+func (emu *MongoEmulator) maybeProcessChangeStream(clientID string, req protocol.Request) (res protocol.Response, handled bool, err error) {
+	r, isAggregate := req.(*protocol.AggregateRequest)
+	if !isAggregate || len(r.Pipeline) == 0 || len(r.Pipeline[0]) == 0 || r.Pipeline[0][0].Name != "$changeStream" {
+		return protocol.Response{}, false, nil
+	}
+
+	cs, err := emu.openChangeStream(clientID, r)
+	if err != nil {
+		return protocol.Response{}, true, err
+	}
+
+	batchSize := int(r.BatchSize)
+	if batchSize == 0 {
+		batchSize = defaultBatchSize
+	}
+	batch, done, err := cs.poll(clientID, batchSize)
+	if err != nil {
+		return protocol.Response{}, true, err
+	}
+
+	ns := cs.ns
+	if ns.Collection == "" {
+		ns.Collection = "$cmd.aggregate"
+	}
+	var cursorID int64
+	if !done {
+		cursorID = emu.cursors.registerTailable(ns, cs, true)
+	}
+
+	res = cursorResponse(ns.String(), cursorID, toBatch(batch))
+	cursorDoc := res.Documents[0]["cursor"].(bson.M)
+	for k, v := range cs.cursorFields() {
+		cursorDoc[k] = v
+	}
+	return res, true, nil
+}
+
+// openChangeStream validates the $changeStream stage of req and returns a
+// change stream positioned at the requested starting point.
+func (emu *MongoEmulator) openChangeStream(clientID string, req *protocol.AggregateRequest) (*changeStream, error) {
+	if emu.replSet == nil {
+		return nil, protocol.ServerErrorf(40573, "The $changeStream stage is only supported on replica sets")
+	} else if cfg, err := emu.replSetConfig(clientID); err != nil {
+		return nil, err
+	} else if cfg == nil {
+		return nil, protocol.ServerErrorf(40573, "The $changeStream stage is only supported on replica sets")
+	} else if inTransaction(req) {
+		return nil, protocol.ServerErrorf(protocol.CodeOperationNotSupportedInTransaction, "Operation not permitted in transaction :: caused by :: $changeStream cannot run within a multi-document transaction")
+	}
+
+	spec := req.Pipeline[0][0].Value
+	if !bsonutil.IsDocument(spec) {
+		return nil, protocol.ServerErrorf(50808, "$changeStream stage expects a document as argument.")
+	}
+
+	cs := &changeStream{emu: emu, ns: req.Collection, let: req.Let}
+	var (
+		startTS     *bson.MongoTimestamp
+		resumeOpts  int
+		resumeAfter bool
+	)
+	for _, opt := range bsonutil.Elements(spec) {
+		switch opt.Name {
+		case "fullDocument":
+			switch opt.Value {
+			case "default":
+			case "updateLookup":
+				cs.updateLookup = true
+			default:
+				return nil, protocol.ServerErrorf(protocol.CodeBadValue, "unrecognized value for fullDocument: %v", opt.Value)
+			}
+		case "resumeAfter", "startAfter":
+			ts, invalidate, err := parseResumeToken(opt.Value)
+			if err != nil {
+				return nil, err
+			} else if invalidate && opt.Name == "resumeAfter" {
+				return nil, protocol.ServerErrorf(protocol.CodeInvalidResumeToken, "Attempting to resume a change stream using 'resumeAfter' is not allowed from an invalidate notification.")
+			}
+			startTS, resumeAfter = &ts, true
+			resumeOpts++
+		case "startAtOperationTime":
+			ts, ok := opt.Value.(bson.MongoTimestamp)
+			if !ok {
+				return nil, protocol.ServerErrorf(protocol.CodeTypeMismatch, "BSON field '$changeStream.startAtOperationTime' is the wrong type '%s', expected type 'timestamp'", bsonutil.TypeName(opt.Value))
+			}
+			startTS = &ts
+			resumeOpts++
+		case "allChangesForCluster":
+			allChanges, ok := opt.Value.(bool)
+			if !ok {
+				return nil, protocol.ServerErrorf(protocol.CodeTypeMismatch, "BSON field '$changeStream.allChangesForCluster' is the wrong type '%s', expected type 'bool'", bsonutil.TypeName(opt.Value))
+			}
+			cs.cluster = allChanges
+		default:
+			return nil, protocol.ServerErrorf(40415, "BSON field '$changeStream.%s' is an unknown field.", opt.Name)
+		}
+	}
+	if resumeOpts > 1 {
+		return nil, protocol.ServerErrorf(40674, "Only one type of resume option is allowed, but multiple were found.")
+	}
+
+	if err := cs.validateNamespace(); err != nil {
+		return nil, err
+	}
+
+	for _, stage := range req.Pipeline[1:] {
+		if len(stage) != 0 && !changeStreamStages[stage[0].Name] {
+			return nil, protocol.ServerErrorf(protocol.CodeIllegalOperation, "%s is not permitted in a $changeStream pipeline", stage[0].Name)
+		}
+	}
+	pipeline, err := aggregate.Parse(req.Pipeline[1:])
+	if err != nil {
+		return nil, err
+	}
+	cs.pipeline = pipeline
+
+	// Streams report the events that occur after their starting point.
+	// The events at the starting point are only included when it is
+	// specified via startAtOperationTime.
+	switch {
+	case startTS == nil:
+		emu.replSet.mu.Lock()
+		cs.lastTS = emu.replSet.lastTS
+		emu.replSet.mu.Unlock()
+	case resumeAfter:
+		cs.lastTS = *startTS
+	default:
+		cs.lastTS = *startTS - 1
+	}
+	cs.resumeToken = resumeToken(cs.lastTS, false)
+	return cs, nil
+}
+
+// validateNamespace ensures that the watched namespace can be watched.
+func (cs *changeStream) validateNamespace() error {
+	switch {
+	case cs.cluster:
+		if cs.ns.Database != "admin" || cs.ns.Collection != "" {
+			return protocol.ServerErrorf(protocol.CodeInvalidOptions, "A $changeStream with 'allChangesForCluster:true' may only be opened on the 'admin' database, and with no collection name")
+		}
+	case cs.ns.Database == "admin" || cs.ns.Database == "config" || cs.ns.Database == "local":
+		return protocol.ServerErrorf(protocol.CodeInvalidNamespace, "$changeStream may not be opened on the internal %s database", cs.ns.Database)
+	case strings.HasPrefix(cs.ns.Collection, "system."):
+		return protocol.ServerErrorf(protocol.CodeInvalidNamespace, "$changeStream may not be opened on the internal %s collection", cs.ns.String())
+	}
+	return nil
+}
+
+// poll implements tailer.
+func (cs *changeStream) poll(clientID string, batchSize int) ([]bson.D, bool, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if len(cs.pending) == 0 && !cs.invalidated {
+		if err := cs.fetchLocked(clientID); err != nil {
+			return nil, false, err
+		}
+	}
+
+	n := len(cs.pending)
+	if batchSize > 0 && batchSize < n {
+		n = batchSize
+	}
+	batch := cs.pending[:n]
+	cs.pending = cs.pending[n:]
+
+	if n != 0 {
+		cs.resumeToken = bson.D(bsonutil.Elements(batch[n-1].Map()["_id"]))
+	} else if !cs.invalidated {
+		cs.resumeToken = resumeToken(cs.lastTS, false)
+	}
+	return batch, cs.invalidated && len(cs.pending) == 0, nil
+}
+
+// cursorFields implements tailer.
+func (cs *changeStream) cursorFields() bson.M {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return bson.M{"postBatchResumeToken": cs.resumeToken}
+}
+
+// fetchLocked converts the oplog entries that were appended since the
+// previous call into change events and queues the events that pass through
+// the stream's pipeline. Callers must hold the stream mutex.
+func (cs *changeStream) fetchLocked(clientID string) error {
+	// Entries are inserted while holding the replica set mutex so they
+	// become visible in timestamp order. The exception are the entries of
+	// transactions which only become visible when the transaction
+	// commits; the stream must not move past them until then.
+	rs := cs.emu.replSet
+	rs.mu.Lock()
+	visibleTS := rs.visibleTSLocked()
+	rs.mu.Unlock()
+	if visibleTS <= cs.lastTS {
+		return nil
+	}
+
+	// The oldest entries of the oplog are evicted once it exceeds its
+	// size; the stream cannot continue if it has not read them yet.
+	if cs.lastTS != 0 {
+		oldest, err := cs.emu.oplogEdge(clientID, false)
+		if err != nil {
+			return err
+		}
+		if ts, _ := oldest["ts"].(bson.MongoTimestamp); ts > cs.lastTS+1 {
+			return protocol.ServerErrorf(protocol.CodeChangeStreamHistoryLost, "Resume of change stream was not possible, as the resume point may no longer be in the oplog.")
+		}
+	}
+
+	matcher, err := filter.Compile(bson.M{"ts": bson.M{"$gt": cs.lastTS, "$lte": visibleTS}})
+	if err != nil {
+		return err
+	}
+	src := &backendSource{b: cs.emu.b, clientID: clientID}
+	docs, err := src.Find(oplogCollection, matcher.Query())
+	if err != nil {
+		return err
+	}
+
+	var entries []bson.M
+	for _, doc := range docs {
+		if matcher.Match(doc) {
+			entries = append(entries, doc.Map())
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bsonutil.Compare(entries[i]["ts"], entries[j]["ts"]) < 0
+	})
+
+	// The stream only advances past the entries it has read; entries of
+	// aborted transactions are never read.
+	var events []bson.D
+	for _, entry := range entries {
+		ts, _ := entry["ts"].(bson.MongoTimestamp)
+		cs.lastTS = ts
+		event, invalidate := cs.changeEvent(clientID, entry)
+		if event != nil {
+			events = append(events, event)
+		}
+		if invalidate {
+			events = append(events, bson.D{
+				{Name: "_id", Value: resumeToken(ts, true)},
+				{Name: "operationType", Value: "invalidate"},
+				{Name: "clusterTime", Value: ts},
+			})
+			cs.invalidated = true
+			break
+		}
+	}
+
+	env, err := aggregate.NewEnv(cs.ns, src, cs.let)
+	if err != nil {
+		return err
+	}
+	if events, err = cs.pipeline.Process(env, events); err != nil {
+		return err
+	}
+	for _, event := range events {
+		if _, _, err := parseResumeToken(event.Map()["_id"]); err != nil {
+			return protocol.ServerErrorf(protocol.CodeChangeStreamFatalError, "Encountered an event whose _id field, which contains the resume token, was modified by the pipeline. Modifying the _id field of an event makes it impossible to resume the stream from that point. Only transformations that retain the unmodified _id field are allowed.")
+		}
+	}
+	cs.pending = events
+	return nil
+}
+
+// changeEvent returns the change event for an oplog entry or nil if the entry
+// does not affect the watched namespace. The invalidate return value is true
+// if the entry invalidates the stream (e.g. the watched collection has been
+// dropped).
+func (cs *changeStream) changeEvent(clientID string, entry bson.M) (event bson.D, invalidate bool) {
+	var (
+		ts, _  = entry["ts"].(bson.MongoTimestamp)
+		ns, _  = entry["ns"].(string)
+		o      = entry["o"]
+		col, _ = protocol.ParseNamespacedCollection(ns)
+	)
+
+	var (
+		opType string
+		fields bson.D
+	)
+	switch entry["op"] {
+	case "i":
+		if !cs.watches(col) {
+			return nil, false
+		}
+		id, _ := bsonutil.Get(o, "_id")
+		opType, fields = "insert", bson.D{
+			{Name: "fullDocument", Value: bson.D(bsonutil.Elements(o))},
+			{Name: "ns", Value: namespaceDoc(col)},
+			{Name: "documentKey", Value: bson.D{{Name: "_id", Value: id}}},
+		}
+	case "u":
+		if !cs.watches(col) {
+			return nil, false
+		}
+		documentKey := bson.D(bsonutil.Elements(entry["o2"]))
+		if elems := bsonutil.Elements(o); len(elems) != 0 && strings.HasPrefix(elems[0].Name, "$") {
+			opType = "update"
+			if cs.updateLookup {
+				id, _ := bsonutil.Get(documentKey, "_id")
+				var fullDocument interface{}
+				if doc := cs.emu.findByID(clientID, nil, col, id); doc != nil {
+					fullDocument = doc
+				}
+				fields = append(fields, bson.DocElem{Name: "fullDocument", Value: fullDocument})
+			}
+			fields = append(fields,
+				bson.DocElem{Name: "ns", Value: namespaceDoc(col)},
+				bson.DocElem{Name: "documentKey", Value: documentKey},
+				bson.DocElem{Name: "updateDescription", Value: updateDescription(o)},
+			)
+		} else {
+			opType, fields = "replace", bson.D{
+				{Name: "fullDocument", Value: bson.D(elems)},
+				{Name: "ns", Value: namespaceDoc(col)},
+				{Name: "documentKey", Value: documentKey},
+			}
+		}
+	case "d":
+		if !cs.watches(col) {
+			return nil, false
+		}
+		opType, fields = "delete", bson.D{
+			{Name: "ns", Value: namespaceDoc(col)},
+			{Name: "documentKey", Value: bson.D(bsonutil.Elements(o))},
+		}
+	case "c":
+		return cs.commandEvent(col.Database, entry, ts)
+	default:
+		return nil, false
+	}
+
+	return cs.newEvent(entry, ts, opType, fields), false
+}
+
+// commandEvent returns the change event for an oplog entry that describes a
+// catalog change in db.
+func (cs *changeStream) commandEvent(db string, entry bson.M, ts bson.MongoTimestamp) (event bson.D, invalidate bool) {
+	o := entry["o"]
+	if coll, ok := bsonutil.Get(o, "drop"); ok {
+		col := protocol.NamespacedCollection{Database: db, Collection: fmt.Sprint(coll)}
+		if !cs.watches(col) {
+			return nil, false
+		}
+		return cs.newEvent(entry, ts, "drop", bson.D{{Name: "ns", Value: namespaceDoc(col)}}), cs.ns.Collection != ""
+	}
+
+	if from, ok := bsonutil.Get(o, "renameCollection"); ok {
+		to, _ := bsonutil.Get(o, "to")
+		fromCol, _ := protocol.ParseNamespacedCollection(fmt.Sprint(from))
+		toCol, _ := protocol.ParseNamespacedCollection(fmt.Sprint(to))
+		if !cs.watches(fromCol) && (cs.ns.Collection == "" || toCol != cs.ns) {
+			return nil, false
+		}
+		return cs.newEvent(entry, ts, "rename", bson.D{
+			{Name: "ns", Value: namespaceDoc(fromCol)},
+			{Name: "to", Value: namespaceDoc(toCol)},
+		}), cs.ns.Collection != ""
+	}
+
+	if _, ok := bsonutil.Get(o, "dropDatabase"); ok {
+		switch {
+		case cs.cluster:
+			return cs.newEvent(entry, ts, "dropDatabase", bson.D{{Name: "ns", Value: bson.D{{Name: "db", Value: db}}}}), false
+		case cs.ns.Database != db:
+			return nil, false
+		case cs.ns.Collection != "":
+			return cs.newEvent(entry, ts, "drop", bson.D{{Name: "ns", Value: namespaceDoc(cs.ns)}}), true
+		default:
+			return cs.newEvent(entry, ts, "dropDatabase", bson.D{{Name: "ns", Value: bson.D{{Name: "db", Value: db}}}}), true
+		}
+	}
+	return nil, false
+}
+
+// newEvent returns a change event with the provided operation type and
+// type-specific fields for an oplog entry.
+func (cs *changeStream) newEvent(entry bson.M, ts bson.MongoTimestamp, opType string, fields bson.D) bson.D {
+	event := bson.D{
+		{Name: "_id", Value: resumeToken(ts, false)},
+		{Name: "operationType", Value: opType},
+		{Name: "clusterTime", Value: ts},
+	}
+	if txnNumber, ok := entry["txnNumber"]; ok {
+		event = append(event,
+			bson.DocElem{Name: "txnNumber", Value: txnNumber},
+			bson.DocElem{Name: "lsid", Value: entry["lsid"]},
+		)
+	}
+	return append(event, fields...)
+}
+
+// watches returns true if changes to col are reported by the stream. Changes
+// to the internal databases and system collections are never reported.
+func (cs *changeStream) watches(col protocol.NamespacedCollection) bool {
+	switch {
+	case col.Database == "admin" || col.Database == "config" || col.Database == "local":
+		return false
+	case strings.HasPrefix(col.Collection, "system."):
+		return false
+	case cs.cluster:
+		return true
+	case cs.ns.Collection == "":
+		return col.Database == cs.ns.Database
+	}
+	return col == cs.ns
+}
+
+// updateDescription returns the updateDescription field of an update event
+// from the $set and $unset operators of an update oplog entry.
+func updateDescription(o interface{}) bson.D {
+	set, _ := bsonutil.Get(o, "$set")
+	unset, _ := bsonutil.Get(o, "$unset")
+
+	updatedFields := bson.D(bsonutil.Elements(set))
+	if updatedFields == nil {
+		updatedFields = bson.D{}
+	}
+	removedFields := []interface{}{}
+	for _, field := range bsonutil.Elements(unset) {
+		removedFields = append(removedFields, field.Name)
+	}
+	return bson.D{
+		{Name: "updatedFields", Value: updatedFields},
+		{Name: "removedFields", Value: removedFields},
+	}
+}
+
+func namespaceDoc(col protocol.NamespacedCollection) bson.D {
+	return bson.D{{Name: "db", Value: col.Database}, {Name: "coll", Value: col.Collection}}
+}
+
+// resumeToken returns the resume token for the change event that was
+// generated by the oplog entry with the provided timestamp. The invalidate
+// events that follow such events have a distinct token.
+func resumeToken(ts bson.MongoTimestamp, invalidate bool) bson.D {
+	var kind int
+	if invalidate {
+		kind = 1
+	}
+	return bson.D{{Name: "_data", Value: fmt.Sprintf("%016X%02X", uint64(ts), kind)}}
+}
+
+// parseResumeToken parses a resume token generated by resumeToken.
+func parseResumeToken(token interface{}) (ts bson.MongoTimestamp, invalidate bool, err error) {
+	data, _ := bsonutil.Get(token, "_data")
+	hex, ok := data.(string)
+	if !ok || len(hex) != 18 {
+		return 0, false, protocol.ServerErrorf(protocol.CodeFailedToParse, "invalid resume token: %v", token)
+	}
+
+	tsVal, tsErr := strconv.ParseUint(hex[:16], 16, 64)
+	kind, kindErr := strconv.ParseUint(hex[16:], 16, 8)
+	if tsErr != nil || kindErr != nil || kind > 1 {
+		return 0, false, protocol.ServerErrorf(protocol.CodeFailedToParse, "invalid resume token: %v", token)
+	}
+	return bson.MongoTimestamp(tsVal), kind == 1, nil
+}
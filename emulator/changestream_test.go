@@ -0,0 +1,165 @@
+package emulator
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/protocol"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// isolatingBackend extends memBackend with a TransactionBackend
+// implementation that buffers the inserts of transactions and applies them
+// when the transaction commits.
+type isolatingBackend struct {
+	*memBackend
+
+	txnMu   sync.Mutex
+	pending map[string][]protocol.Request
+}
+
+func newIsolatingBackend() *isolatingBackend {
+	return &isolatingBackend{memBackend: newMemBackend(), pending: make(map[string][]protocol.Request)}
+}
+
+func (b *isolatingBackend) HandleRequest(clientID string, req protocol.Request) (protocol.Response, error) {
+	r, isInsert := req.(*protocol.InsertRequest)
+	if txnID, ok := NewTxnID(req); ok && isInsert {
+		b.txnMu.Lock()
+		b.pending[txnID.String()] = append(b.pending[txnID.String()], r)
+		b.txnMu.Unlock()
+		return protocol.Response{Documents: []bson.M{{"ok": 1, "n": len(r.Inserts)}}}, nil
+	}
+	return b.memBackend.HandleRequest(clientID, req)
+}
+
+func (b *isolatingBackend) StartTransaction(clientID string, txn TxnID) error { return nil }
+
+func (b *isolatingBackend) CommitTransaction(clientID string, txn TxnID) error {
+	b.txnMu.Lock()
+	pending := b.pending[txn.String()]
+	delete(b.pending, txn.String())
+	b.txnMu.Unlock()
+
+	for _, req := range pending {
+		if _, err := b.memBackend.HandleRequest(clientID, req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *isolatingBackend) AbortTransaction(clientID string, txn TxnID) error {
+	b.txnMu.Lock()
+	delete(b.pending, txn.String())
+	b.txnMu.Unlock()
+	return nil
+}
+
+// newReplSetEmulator returns an emulator backed by b that emulates an
+// initiated replica set.
+func newReplSetEmulator(t *testing.T, b Backend) *MongoEmulator {
+	emu := newTestEmulator(t, b)
+	if err := emu.EnableReplicaSet("rs0", "localhost:27017"); err != nil {
+		t.Fatal(err)
+	}
+	mustProcess(t, emu, &protocol.ReplSetInitiateRequest{
+		RequestInfo: cmdInfo(protocol.RequestTypeReplSetInitiate),
+	})
+	return emu
+}
+
+// watch opens a change stream on the test collection and returns its cursor
+// ID.
+func watch(t *testing.T, emu *MongoEmulator) int64 {
+	t.Helper()
+	reply := mustProcess(t, emu, &protocol.AggregateRequest{
+		RequestInfo: cmdInfo(protocol.RequestTypeAggregate),
+		Collection:  testCol,
+		Pipeline:    []bson.D{{{Name: "$changeStream", Value: bson.M{}}}},
+	})
+	cursorID, _ := bsonutil.ToMap(reply["cursor"])["id"].(int64)
+	if cursorID == 0 {
+		t.Fatalf("expected an open change stream cursor; got %v", reply)
+	}
+	return cursorID
+}
+
+// nextEvents returns the next batch of change events of a change stream.
+func nextEvents(t *testing.T, emu *MongoEmulator, cursorID int64) []bson.M {
+	t.Helper()
+	reply := mustProcess(t, emu, &protocol.GetMoreRequest{
+		RequestInfo: cmdInfo(protocol.RequestTypeGetMore),
+		Collection:  testCol,
+		CursorID:    cursorID,
+		MaxTimeMS:   1,
+	})
+	var events []bson.M
+	for _, event := range bsonutil.ToArray(bsonutil.ToMap(reply["cursor"])["nextBatch"]) {
+		events = append(events, bsonutil.ToMap(event))
+	}
+	return events
+}
+
+// eventKeys returns the operation type and document _id of events.
+func eventKeys(events []bson.M) []interface{} {
+	var keys []interface{}
+	for _, event := range events {
+		keys = append(keys, event["operationType"], bsonutil.ToMap(event["documentKey"])["_id"])
+	}
+	return keys
+}
+
+func TestChangeStreamObservesTTLDelete(t *testing.T) {
+	emu := newReplSetEmulator(t, newMemBackend())
+	expireAfter := int64(60)
+	mustProcess(t, emu, &protocol.CreateIndexesRequest{
+		RequestInfo: cmdInfo(protocol.RequestTypeCreateIndexes),
+		Collection:  testCol,
+		Indexes: []protocol.IndexSpec{{
+			Name:               "expireAt_1",
+			Key:                bson.D{{Name: "expireAt", Value: 1}},
+			ExpireAfterSeconds: &expireAfter,
+		}},
+	})
+	insertDocs(t, emu, testCol,
+		bson.M{"_id": 1, "expireAt": time.Now().Add(-time.Hour)},
+		bson.M{"_id": 2, "expireAt": time.Now()},
+	)
+
+	cursorID := watch(t, emu)
+	if _, err := emu.runTTLPass(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, exp := eventKeys(nextEvents(t, emu, cursorID)), []interface{}{"delete", 1}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected events %v; got %v", exp, got)
+	}
+}
+
+func TestChangeStreamWaitsForOpenTransactions(t *testing.T) {
+	emu := newReplSetEmulator(t, newIsolatingBackend())
+	cursorID := watch(t, emu)
+
+	// The insert of the transaction precedes the insert outside of the
+	// transaction in the oplog but only becomes visible when the
+	// transaction commits.
+	c := newTxnClient(t, emu)
+	if err := c.insert(1, true, bson.M{"_id": 1}); err != nil {
+		t.Fatal(err)
+	}
+	insertDocs(t, emu, testCol, bson.M{"_id": 2})
+	if events := nextEvents(t, emu, cursorID); len(events) != 0 {
+		t.Fatalf("expected no events while the transaction is open; got %v", events)
+	}
+
+	if err := c.run(protocol.RequestTypeCommitTransaction, 1); err != nil {
+		t.Fatal(err)
+	}
+	if got, exp := eventKeys(nextEvents(t, emu, cursorID)), []interface{}{"insert", 1, "insert", 2}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected events %v; got %v", exp, got)
+	}
+}
@@ -0,0 +1,123 @@
+package emulator
+
+import (
+	"sync"
+	"time"
+
+	"github.com/achilleasa/mongolite/protocol"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// logicalClock tracks the cluster time of the emulated deployment. The clock
+// advances on every write and when clients gossip a greater cluster time.
+// Replies report the current cluster time via $clusterTime and the time of
+// the operation via operationTime so that causally consistent sessions can
+// order their operations.
+//
+// See https://github.com/mongodb/specifications/blob/master/source/causal-consistency/causal-consistency.rst
+type logicalClock struct {
+	mu   sync.Mutex
+	time bson.MongoTimestamp
+}
+
+// now returns the current cluster time.
+func (c *logicalClock) now() bson.MongoTimestamp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.time
+}
+
+// advance moves the clock forward to ts if ts is greater than the current
+// cluster time.
+func (c *logicalClock) advance(ts bson.MongoTimestamp) {
+	c.mu.Lock()
+	if ts > c.time {
+		c.time = ts
+	}
+	c.mu.Unlock()
+}
+
+// tick advances the clock for a new write and returns the cluster time
+// assigned to it. Cluster times combine the provided wall clock time (in
+// seconds) with an increment so that they are strictly increasing.
+func (c *logicalClock) tick(now time.Time) bson.MongoTimestamp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ts := bson.MongoTimestamp(now.Unix() << 32)
+	if ts <= c.time {
+		ts = c.time
+	}
+	ts++
+	c.time = ts
+	return ts
+}
+
+// checkClusterTime gossips the cluster time attached to req and ensures that
+// the clock has reached the cluster time specified via the afterClusterTime
+// read concern. As writes are applied synchronously, all writes up to the
+// current cluster time are visible to reads. A later afterClusterTime is
+// satisfied by advancing the clock, which is what a primary does by writing
+// a no-op oplog entry.
+func (emu *MongoEmulator) checkClusterTime(req protocol.Request) {
+	causal := req.CausalConsistency()
+	if causal.ClusterTime != nil {
+		emu.clock.advance(*causal.ClusterTime)
+	}
+	if causal.AfterClusterTime != nil {
+		emu.clock.advance(*causal.AfterClusterTime)
+	}
+}
+
+// advancesClusterTime returns true if req is a request whose successful
+// execution must advance the cluster time.
+func advancesClusterTime(req protocol.Request) bool {
+	switch req.GetType() {
+	case protocol.RequestTypeInsert, protocol.RequestTypeUpdate, protocol.RequestTypeDelete,
+		protocol.RequestTypeFindAndUpdate, protocol.RequestTypeFindAndDelete,
+		protocol.RequestTypeCreate, protocol.RequestTypeDrop, protocol.RequestTypeDropDatabase,
+		protocol.RequestTypeRenameCollection, protocol.RequestTypeCollMod,
+		protocol.RequestTypeCreateIndexes, protocol.RequestTypeDropIndexes,
+		protocol.RequestTypeCommitTransaction, protocol.RequestTypeReplSetInitiate:
+		return true
+	}
+	return false
+}
+
+// attachClusterTime adds the operationTime and $clusterTime fields to the
+// reply of a command. The reply document is copied as it may be shared (e.g.
+// the recorded reply of a retryable write). The signature of the cluster time
+// is a stub as the emulator does not validate the cluster times gossiped by
+// clients.
+func (emu *MongoEmulator) attachClusterTime(req protocol.Request, res protocol.Response, opTime bson.MongoTimestamp) protocol.Response {
+	switch r := req.(type) {
+	case protocol.GetMoreRequest:
+		// Legacy OP_GETMORE replies only contain documents.
+		return res
+	case *protocol.QueryRequest:
+		// Legacy OP_QUERY replies only contain documents.
+		if r.GetReplyType() != protocol.ReplyTypeOpMsg {
+			return res
+		}
+	}
+	if len(res.Documents) != 1 {
+		return res
+	} else if _, isCmdReply := res.Documents[0]["ok"]; !isCmdReply {
+		return res
+	}
+
+	resDoc := make(bson.M, len(res.Documents[0])+2)
+	for k, v := range res.Documents[0] {
+		resDoc[k] = v
+	}
+	resDoc["operationTime"] = opTime
+	resDoc["$clusterTime"] = bson.M{
+		"clusterTime": emu.clock.now(),
+		"signature": bson.M{
+			"hash":  bson.Binary{Kind: 0x00, Data: make([]byte, 20)},
+			"keyId": int64(0),
+		},
+	}
+	res.Documents = []bson.M{resDoc}
+	return res
+}
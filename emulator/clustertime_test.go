@@ -0,0 +1,112 @@
+package emulator
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// runCommand sends cmd to the emulator as an OP_MSG request and returns the
+// decoded reply.
+func runCommand(t *testing.T, emu *MongoEmulator, cmd bson.D) bson.M {
+	t.Helper()
+	body, err := bson.Marshal(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var req bytes.Buffer
+	for _, v := range []int32{int32(16 + 4 + 1 + len(body)), 1, 0, 2013} {
+		_ = binary.Write(&req, binary.LittleEndian, v)
+	}
+	_ = binary.Write(&req, binary.LittleEndian, uint32(0))
+	req.WriteByte(0)
+	req.Write(body)
+
+	var res bytes.Buffer
+	if err := emu.HandleRequest("client", &res, req.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Skip the header, flags and section kind of the reply.
+	var reply bson.M
+	if err := bson.Unmarshal(res.Bytes()[16+4+1:], &reply); err != nil {
+		t.Fatal(err)
+	}
+	if asInt(reply["ok"]) != 1 {
+		t.Fatalf("command %v failed: %v", cmd, reply)
+	}
+	return reply
+}
+
+// replyTimes returns the operationTime and $clusterTime of a command reply.
+func replyTimes(t *testing.T, reply bson.M) (opTime, clusterTime bson.MongoTimestamp) {
+	t.Helper()
+	opTime, _ = reply["operationTime"].(bson.MongoTimestamp)
+	clusterTime, _ = bsonutil.ToMap(reply["$clusterTime"])["clusterTime"].(bson.MongoTimestamp)
+	if opTime == 0 || clusterTime == 0 {
+		t.Fatalf("expected the reply to include the operation and cluster time; got %v", reply)
+	}
+	return opTime, clusterTime
+}
+
+func TestClusterTime(t *testing.T) {
+	emu := newTestEmulator(t, newMemBackend())
+
+	insert := func(id int) bson.M {
+		return runCommand(t, emu, bson.D{
+			{Name: "insert", Value: testCol.Collection},
+			{Name: "documents", Value: []interface{}{bson.M{"_id": id}}},
+			{Name: "$db", Value: testCol.Database},
+		})
+	}
+	count := func(extra ...bson.DocElem) bson.M {
+		return runCommand(t, emu, append(bson.D{
+			{Name: "count", Value: testCol.Collection},
+			{Name: "$db", Value: testCol.Database},
+		}, extra...))
+	}
+
+	// Writes advance the cluster time.
+	firstOp, firstCluster := replyTimes(t, insert(1))
+	if firstOp != firstCluster {
+		t.Fatalf("expected the write to be assigned the cluster time %v; got %v", firstCluster, firstOp)
+	}
+	secondOp, _ := replyTimes(t, insert(2))
+	if secondOp <= firstOp {
+		t.Fatalf("expected the operation time of the second write to exceed %v; got %v", firstOp, secondOp)
+	}
+
+	// Reads observe the current cluster time without advancing it.
+	if readOp, readCluster := replyTimes(t, count()); readOp != secondOp || readCluster != secondOp {
+		t.Fatalf("expected the read to report operation and cluster time %v; got %v and %v", secondOp, readOp, readCluster)
+	}
+
+	// Cluster times gossiped by clients advance the clock.
+	gossiped := bson.MongoTimestamp(time.Now().Add(time.Hour).Unix()<<32 | 1)
+	_, clusterTime := replyTimes(t, count(bson.DocElem{Name: "$clusterTime", Value: bson.D{
+		{Name: "clusterTime", Value: gossiped},
+		{Name: "signature", Value: bson.M{"hash": bson.Binary{Data: make([]byte, 20)}, "keyId": int64(0)}},
+	}}))
+	if clusterTime != gossiped {
+		t.Fatalf("expected the gossiped cluster time %v to be reported; got %v", gossiped, clusterTime)
+	}
+
+	// Reads wait for (and therefore advance the clock to) afterClusterTime.
+	after := gossiped + 10
+	readOp, _ := replyTimes(t, count(bson.DocElem{Name: "readConcern", Value: bson.D{
+		{Name: "afterClusterTime", Value: after},
+	}}))
+	if readOp < after {
+		t.Fatalf("expected the read to observe afterClusterTime %v; got operation time %v", after, readOp)
+	}
+
+	// Writes are ordered after the gossiped cluster times.
+	if writeOp, _ := replyTimes(t, insert(3)); writeOp <= after {
+		t.Fatalf("expected the write to be ordered after %v; got %v", after, writeOp)
+	}
+}
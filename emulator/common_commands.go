@@ -3,6 +3,7 @@ package emulator
 import (
 	"fmt"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/achilleasa/mongolite/protocol"
@@ -12,11 +13,14 @@ import (
 
 func (emu *MongoEmulator) registerCommandHandlers() {
 	allCmds := map[string]cmdHandlerFn{
-		"isMaster":         handleIsMaster,
+		"isMaster":         emu.handleIsMaster,
 		"whatsMyUri":       handleWhatsMyURI,
 		"buildInfo":        handleBuildInfo,
-		"replSetGetStatus": handleReplSetGetStatus,
+		"replSetGetStatus": emu.handleReplSetGetStatus,
 		"getLog":           handleGetLog,
+		"getLastError":     emu.handleGetLastError,
+		"setParameter":     emu.handleSetParameter,
+		"getParameter":     emu.handleGetParameter,
 	}
 
 	// Store command keys uppercased so we can perform case-insensitive lookups.
@@ -26,22 +30,35 @@ func (emu *MongoEmulator) registerCommandHandlers() {
 	}
 }
 
-func handleIsMaster(_ Backend, clientID string, _ *protocol.CommandRequest) (protocol.Response, error) {
-	return protocol.Response{
+func (emu *MongoEmulator) handleIsMaster(_ Backend, clientID string, req *protocol.CommandRequest) (protocol.Response, error) {
+	res := protocol.Response{
 		Documents: []bson.M{{
-			"ok":                  1,
-			"ismaster":            true,
-			"secondary":           false,
-			"readOnly":            false,
-			"maxBsonObjectSize":   16 * 1024 * 1024,
-			"maxMessageSizeBytes": 48 * 1000 * 1000,
-			"maxWriteBatchSize":   10000,
-			"localTime":           time.Now().UTC(),
-			"connectionId":        clientID,
-			"minWireVersion":      1,
-			"maxWireVersion":      6,
+			"ok":                           1,
+			"ismaster":                     true,
+			"secondary":                    false,
+			"readOnly":                     false,
+			"maxBsonObjectSize":            16 * 1024 * 1024,
+			"maxMessageSizeBytes":          48 * 1000 * 1000,
+			"maxWriteBatchSize":            10000,
+			"localTime":                    time.Now().UTC(),
+			"logicalSessionTimeoutMinutes": atomic.LoadInt64(&emu.sessions.timeoutMinutes),
+			"connectionId":                 clientID,
+			"minWireVersion":               1,
+			"maxWireVersion":               6,
 		}},
-	}, nil
+	}
+
+	// Failures to populate the optional fields are logged instead of
+	// failing the handshake.
+	if emu.replSet != nil {
+		for k, v := range emu.replSetIsMasterFields(clientID) {
+			res.Documents[0][k] = v
+		}
+	}
+	for k, v := range emu.authIsMasterFields(clientID, req) {
+		res.Documents[0][k] = v
+	}
+	return res, nil
 }
 
 func handleWhatsMyURI(_ Backend, clientID string, _ *protocol.CommandRequest) (protocol.Response, error) {
@@ -65,13 +82,29 @@ func handleBuildInfo(Backend, string, *protocol.CommandRequest) (protocol.Respon
 	}, nil
 }
 
-func handleReplSetGetStatus(_ Backend, _ string, req *protocol.CommandRequest) (protocol.Response, error) {
-	if req.Collection.Database != "admin" {
-		return protocol.Response{}, protocol.ServerErrorf(protocol.CodeUnauthorized, "replSetGetStatus may only be run against the admin database.")
+// handleGetLastError reports the error (if any) that occurred while processing
+// the last request sent by a client. Clients use this command to check the
+// outcome of legacy write operations which do not receive a reply.
+func (emu *MongoEmulator) handleGetLastError(_ Backend, clientID string, _ *protocol.CommandRequest) (protocol.Response, error) {
+	lastOp := emu.getLastOp(clientID)
+	resDoc := bson.M{
+		"ok":           1,
+		"n":            lastOp.n,
+		"connectionId": clientID,
+		"err":          nil,
 	}
 
-	// Emulate server with no replicas.
-	return protocol.Response{}, protocol.ServerErrorf(protocol.CodeNoReplicationEnabled, "not running with --replSet")
+	if lastErr := lastOp.err; lastErr != nil {
+		resDoc["err"] = lastErr.Error()
+		if srvErr, ok := asServerError(lastErr); ok {
+			resDoc["err"] = srvErr.Msg
+			resDoc["code"] = srvErr.Code
+			resDoc["codeName"] = srvErr.Code.String()
+		}
+		addDuplicateKeyInfo(resDoc, lastErr)
+	}
+
+	return protocol.Response{Documents: []bson.M{resDoc}}, nil
 }
 
 func handleGetLog(b Backend, _ string, _ *protocol.CommandRequest) (protocol.Response, error) {
@@ -92,7 +125,15 @@ Serving incoming client request using the %q backend.
 }
 
 // toErrorResponse converts a standard error into a mongo response payload.
-func toErrorResponse(err error, replyType protocol.ReplyType) protocol.Response {
+func toErrorResponse(err error, req protocol.Request) protocol.Response {
+	// Write commands report server-side failures via the writeErrors
+	// field of an otherwise successful reply.
+	if isWriteCommand(req) {
+		if res, ok := toWriteErrorResponse(err, req); ok {
+			return res
+		}
+	}
+
 	var flags protocol.ResponseFlag
 	if xerrors.Is(err, ErrInvalidCursor) {
 		flags |= protocol.ResponseFlagCursorNotFound
@@ -101,19 +142,29 @@ func toErrorResponse(err error, replyType protocol.ReplyType) protocol.Response
 	}
 
 	var errDoc bson.M
-	if replyType == protocol.ReplyTypeOpReply {
+	if req.GetReplyType() == protocol.ReplyTypeOpReply {
 		errDoc = bson.M{"$err": err.Error()}
+
+		// Server errors contain additional information.
+		if srvErr, ok := asServerError(err); ok {
+			errDoc["$err"] = srvErr.Msg
+			errDoc["code"] = srvErr.Code
+		}
 	} else {
 		errDoc = bson.M{"errmsg": err.Error()}
 
 		// Server errors contain additional information.
-		if srvErr, ok := err.(protocol.ServerError); ok {
+		if srvErr, ok := asServerError(err); ok {
 			errDoc["errmsg"] = srvErr.Msg
 			errDoc["code"] = srvErr.Code
 			errDoc["codeName"] = srvErr.Code.String()
+			if len(srvErr.Labels) != 0 {
+				errDoc["errorLabels"] = srvErr.Labels
+			}
 		}
 	}
 
+	addDuplicateKeyInfo(errDoc, err)
 	errDoc["ok"] = 0
 
 	return protocol.Response{
@@ -121,3 +172,64 @@ func toErrorResponse(err error, replyType protocol.ReplyType) protocol.Response
 		Documents: []bson.M{errDoc},
 	}
 }
+
+// isWriteCommand returns true if req is an insert, update or delete request
+// that was sent as a command (i.e. expects a reply).
+func isWriteCommand(req protocol.Request) bool {
+	return isWriteRequest(req) && req.GetReplyType() != protocol.ReplyTypeNone
+}
+
+// isWriteRequest returns true if req is an insert, update or delete request,
+// including legacy write operations that do not expect a reply.
+func isWriteRequest(req protocol.Request) bool {
+	switch req.GetType() {
+	case protocol.RequestTypeInsert, protocol.RequestTypeUpdate, protocol.RequestTypeDelete:
+		return true
+	}
+	return false
+}
+
+// toWriteErrorResponse formats a failed write operation using the reply
+// schema for write commands. It returns false if err does not describe a
+// failed write operation; other errors (e.g. authorization or session
+// failures) fail the whole command.
+func toWriteErrorResponse(err error, req protocol.Request) (protocol.Response, bool) {
+	var (
+		writeErr  *WriteError
+		dupKeyErr protocol.DuplicateKeyError
+		res       writeResult
+	)
+	switch {
+	case xerrors.As(err, &writeErr):
+		res.n, res.nModified = writeErr.N, writeErr.NModified
+		res.addError(writeErr.Index, writeErr.Err)
+	case xerrors.As(err, &dupKeyErr):
+		res.addError(0, err)
+	default:
+		return protocol.Response{}, false
+	}
+
+	resDoc := bson.M{
+		"ok":          1,
+		"n":           res.n,
+		"writeErrors": res.writeErrors,
+	}
+	if req.GetType() == protocol.RequestTypeUpdate {
+		resDoc["nModified"] = res.nModified
+	}
+	if len(res.errorLabels) != 0 {
+		resDoc["errorLabels"] = res.errorLabels
+	}
+
+	return protocol.Response{Documents: []bson.M{resDoc}}, true
+}
+
+// addDuplicateKeyInfo populates the keyPattern and keyValue fields of an error
+// document if err is a duplicate key error.
+func addDuplicateKeyInfo(errDoc bson.M, err error) {
+	var dupKeyErr protocol.DuplicateKeyError
+	if xerrors.As(err, &dupKeyErr) {
+		errDoc["keyPattern"] = dupKeyErr.KeyPattern
+		errDoc["keyValue"] = dupKeyErr.KeyValue
+	}
+}
@@ -0,0 +1,197 @@
+package emulator
+
+import (
+	"sort"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/emulator/filter"
+	"github.com/achilleasa/mongolite/emulator/index"
+	"github.com/achilleasa/mongolite/protocol"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// CountBackend is implemented by backends that can count documents and list
+// distinct field values without returning the matching documents to the
+// emulator (e.g. by running SQL aggregate queries).
+//
+// When a backend does not implement this interface, the emulator fetches the
+// matching documents via a query request and evaluates count and distinct
+// requests itself.
+type CountBackend interface {
+	Backend
+
+	// CountDocuments returns the number of documents that match the
+	// request query after applying the request skip and limit values.
+	// Backends may use the request hint to select an index. If the
+	// collection does not exist, CountDocuments returns 0.
+	CountDocuments(clientID string, req *protocol.CountRequest) (int64, error)
+
+	// EstimatedDocumentCount returns the number of documents in a
+	// collection using the collection metadata. If the collection does
+	// not exist, EstimatedDocumentCount returns 0.
+	EstimatedDocumentCount(clientID string, col protocol.NamespacedCollection) (int64, error)
+
+	// Distinct returns the distinct values of the request key across the
+	// documents that match the request query. Array values contribute
+	// each of their elements. If the collection does not exist, Distinct
+	// returns an empty list.
+	Distinct(clientID string, req *protocol.DistinctRequest) ([]interface{}, error)
+}
+
+func (emu *MongoEmulator) handleCount(clientID string, r protocol.Request) (protocol.Response, error) {
+	req := r.(*protocol.CountRequest)
+
+	// Compile the query even when the backend evaluates it so that clients
+	// receive the same errors for malformed queries in all cases.
+	matcher, err := filter.Compile(req.Query)
+	if err != nil {
+		return protocol.Response{}, err
+	}
+	if err := emu.validateHint(clientID, req.Collection, req.Hint); err != nil {
+		return protocol.Response{}, err
+	}
+
+	var n int64
+	if cb, ok := emu.b.(CountBackend); ok {
+		if req.IsEstimate() {
+			n, err = cb.EstimatedDocumentCount(clientID, req.Collection)
+		} else {
+			n, err = cb.CountDocuments(clientID, req)
+		}
+	} else {
+		n, err = emu.countMatching(clientID, req, matcher)
+	}
+	if err != nil {
+		return protocol.Response{}, err
+	}
+
+	return protocol.Response{
+		Documents: []bson.M{{"ok": 1, "n": n}},
+	}, nil
+}
+
+// countMatching implements the count command for backends that do not
+// implement CountBackend.
+func (emu *MongoEmulator) countMatching(clientID string, req *protocol.CountRequest, matcher *filter.Matcher) (int64, error) {
+	src := &backendSource{b: emu.b, clientID: clientID, origin: req}
+	docs, err := src.Find(req.Collection, matcher.Query())
+	if err != nil {
+		return 0, err
+	}
+
+	var n int64
+	for _, doc := range docs {
+		// Backends are free to return a superset of the matching
+		// documents so the query is also evaluated by the emulator.
+		if !matcher.Match(doc) {
+			continue
+		}
+		n++
+	}
+
+	if n -= req.Skip; n < 0 {
+		n = 0
+	}
+	if req.Limit != 0 && n > req.Limit {
+		n = req.Limit
+	}
+	return n, nil
+}
+
+// validateHint ensures that hint refers to an existing index. Hints are only
+// validated for backends that implement IndexBackend and collections that
+// exist.
+func (emu *MongoEmulator) validateHint(clientID string, col protocol.NamespacedCollection, hint interface{}) error {
+	ib, ok := emu.b.(IndexBackend)
+	if hint == nil || !ok {
+		return nil
+	}
+
+	existing, err := ib.ListIndexes(clientID, col)
+	if err != nil {
+		if hasErrorCode(err, protocol.CodeNamespaceNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	switch hint := hint.(type) {
+	case string:
+		for _, spec := range existing {
+			if spec.Name == hint {
+				return nil
+			}
+		}
+	case bson.D:
+		if _, found := index.FindByKey(existing, hint); found {
+			return nil
+		}
+	}
+	return protocol.ServerErrorf(protocol.CodeBadValue, "hint provided does not correspond to an existing index")
+}
+
+func (emu *MongoEmulator) handleDistinct(clientID string, r protocol.Request) (protocol.Response, error) {
+	req := r.(*protocol.DistinctRequest)
+	if req.Key == "" {
+		return protocol.Response{}, protocol.ServerErrorf(protocol.CodeFailedToParse, "FieldPath cannot be constructed with empty string")
+	}
+
+	matcher, err := filter.Compile(req.Query)
+	if err != nil {
+		return protocol.Response{}, err
+	}
+
+	var values []interface{}
+	if cb, ok := emu.b.(CountBackend); ok {
+		values, err = cb.Distinct(clientID, req)
+	} else {
+		values, err = emu.distinctValues(clientID, req, matcher)
+	}
+	if err != nil {
+		return protocol.Response{}, err
+	}
+
+	if values == nil {
+		values = []interface{}{}
+	}
+	return protocol.Response{
+		Documents: []bson.M{{"ok": 1, "values": values}},
+	}, nil
+}
+
+// distinctValues implements the distinct command for backends that do not
+// implement CountBackend. The values are returned in ascending order.
+func (emu *MongoEmulator) distinctValues(clientID string, req *protocol.DistinctRequest, matcher *filter.Matcher) ([]interface{}, error) {
+	src := &backendSource{b: emu.b, clientID: clientID, origin: req}
+	docs, err := src.Find(req.Collection, matcher.Query())
+	if err != nil {
+		return nil, err
+	}
+
+	var values []interface{}
+	for _, doc := range docs {
+		if !matcher.Match(doc) {
+			continue
+		}
+
+		for _, v := range bsonutil.LookupValues(doc, req.Key) {
+			if bsonutil.IsArray(v) {
+				values = append(values, bsonutil.ToArray(v)...)
+				continue
+			}
+			values = append(values, v)
+		}
+	}
+
+	sort.SliceStable(values, func(i, j int) bool {
+		return bsonutil.Compare(values[i], values[j]) < 0
+	})
+
+	var out []interface{}
+	for i, v := range values {
+		if i == 0 || bsonutil.Compare(v, values[i-1]) != 0 {
+			out = append(out, v)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,150 @@
+package emulator
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/achilleasa/mongolite/protocol"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// countBackend extends queryRecorder with a CountBackend implementation that
+// returns fixed results and records the requests that it receives.
+type countBackend struct {
+	*queryRecorder
+	calls []string
+}
+
+func (b *countBackend) CountDocuments(clientID string, req *protocol.CountRequest) (int64, error) {
+	b.calls = append(b.calls, "count")
+	return 42, nil
+}
+
+func (b *countBackend) EstimatedDocumentCount(clientID string, col protocol.NamespacedCollection) (int64, error) {
+	b.calls = append(b.calls, "estimate")
+	return 7, nil
+}
+
+func (b *countBackend) Distinct(clientID string, req *protocol.DistinctRequest) ([]interface{}, error) {
+	b.calls = append(b.calls, "distinct")
+	return nil, nil
+}
+
+func TestCount(t *testing.T) {
+	emu := newTestEmulator(t, newMemBackend())
+	insertDocs(t, emu, testCol,
+		bson.M{"_id": 1, "a": 1},
+		bson.M{"_id": 2, "a": 2},
+		bson.M{"_id": 3, "a": 2},
+		bson.M{"_id": 4, "a": 3},
+	)
+	missing := protocol.NamespacedCollection{Database: "test", Collection: "missing"}
+
+	specs := []struct {
+		descr  string
+		req    protocol.CountRequest
+		exp    int64
+		expErr protocol.ErrorCode
+	}{
+		{descr: "all documents", req: protocol.CountRequest{Collection: testCol}, exp: 4},
+		{descr: "query", req: protocol.CountRequest{Collection: testCol, Query: bson.M{"a": 2}}, exp: 2},
+		{descr: "skip and limit", req: protocol.CountRequest{Collection: testCol, Skip: 1, Limit: 2}, exp: 2},
+		{descr: "skip past the matching documents", req: protocol.CountRequest{Collection: testCol, Skip: 10}, exp: 0},
+		{descr: "missing collection", req: protocol.CountRequest{Collection: missing}, exp: 0},
+		{descr: "malformed query", req: protocol.CountRequest{Collection: testCol, Query: bson.M{"a": bson.M{"$bogus": 1}}}, expErr: protocol.CodeBadValue},
+		{descr: "unknown hint", req: protocol.CountRequest{Collection: testCol, Hint: "a_1"}, expErr: protocol.CodeBadValue},
+	}
+
+	for _, spec := range specs {
+		t.Run(spec.descr, func(t *testing.T) {
+			req := spec.req
+			req.RequestInfo = cmdInfo(protocol.RequestTypeCount)
+			res, err := emu.process("client", &req)
+			if spec.expErr != 0 {
+				if !hasErrorCode(err, spec.expErr) {
+					t.Fatalf("expected error with code %d; got %v", spec.expErr, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if got := res.Documents[0]["n"]; got != spec.exp {
+				t.Fatalf("expected count %d; got %v", spec.exp, got)
+			}
+		})
+	}
+}
+
+func TestDistinct(t *testing.T) {
+	emu := newTestEmulator(t, newMemBackend())
+	insertDocs(t, emu, testCol,
+		bson.M{"_id": 1, "a": bson.M{"b": 3}},
+		bson.M{"_id": 2, "a": bson.M{"b": []interface{}{1, 2}}},
+		bson.M{"_id": 3, "a": []interface{}{bson.M{"b": 2}, bson.M{"b": "x"}}},
+		bson.M{"_id": 4},
+	)
+
+	specs := []struct {
+		descr  string
+		key    string
+		query  bson.M
+		exp    []interface{}
+		expErr protocol.ErrorCode
+	}{
+		{descr: "arrays contribute their elements", key: "a.b", exp: []interface{}{1, 2, 3, "x"}},
+		{descr: "query", key: "a.b", query: bson.M{"_id": bson.M{"$lt": 3}}, exp: []interface{}{1, 2, 3}},
+		{descr: "no values", key: "c", exp: []interface{}{}},
+		{descr: "empty key", key: "", expErr: protocol.CodeFailedToParse},
+	}
+
+	for _, spec := range specs {
+		t.Run(spec.descr, func(t *testing.T) {
+			res, err := emu.process("client", &protocol.DistinctRequest{
+				RequestInfo: cmdInfo(protocol.RequestTypeDistinct),
+				Collection:  testCol,
+				Key:         spec.key,
+				Query:       spec.query,
+			})
+			if spec.expErr != 0 {
+				if !hasErrorCode(err, spec.expErr) {
+					t.Fatalf("expected error with code %d; got %v", spec.expErr, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if got := res.Documents[0]["values"]; !reflect.DeepEqual(got, spec.exp) {
+				t.Fatalf("expected values %v; got %v", spec.exp, got)
+			}
+		})
+	}
+}
+
+func TestCountBackend(t *testing.T) {
+	b := &countBackend{queryRecorder: &queryRecorder{memBackend: newMemBackend()}}
+	emu := newTestEmulator(t, b)
+
+	for _, req := range []protocol.Request{
+		&protocol.CountRequest{RequestInfo: cmdInfo(protocol.RequestTypeCount), Collection: testCol},
+		&protocol.CountRequest{RequestInfo: cmdInfo(protocol.RequestTypeCount), Collection: testCol, Query: bson.M{"a": 1}},
+		&protocol.DistinctRequest{RequestInfo: cmdInfo(protocol.RequestTypeDistinct), Collection: testCol, Key: "a"},
+	} {
+		mustProcess(t, emu, req)
+	}
+	if exp := []string{"estimate", "count", "distinct"}; !reflect.DeepEqual(b.calls, exp) {
+		t.Fatalf("expected backend calls %v; got %v", exp, b.calls)
+	}
+	if len(b.queries) != 0 {
+		t.Fatalf("expected no queries to be issued; got %d", len(b.queries))
+	}
+
+	// Malformed queries are rejected before reaching the backend.
+	_, err := emu.process("client", &protocol.CountRequest{
+		RequestInfo: cmdInfo(protocol.RequestTypeCount),
+		Collection:  testCol,
+		Query:       bson.M{"a": bson.M{"$bogus": 1}},
+	})
+	if err == nil || len(b.calls) != 3 {
+		t.Fatalf("expected the malformed query to be rejected by the emulator; got %v with backend calls %v", err, b.calls)
+	}
+}
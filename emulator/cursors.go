@@ -0,0 +1,280 @@
+package emulator
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/protocol"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// cursorIdleTimeout specifies how long an emulator-owned cursor can remain
+// unused before it is discarded. It matches the default idle cursor timeout
+// used by mongod.
+const cursorIdleTimeout = 10 * time.Minute
+
+// cursor holds the documents that have not yet been returned to the client
+// for a result set produced by the emulator (e.g. an aggregation).
+type cursor struct {
+	ns       protocol.NamespacedCollection
+	docs     []bson.D
+	lastUsed time.Time
+
+	// The source of new documents for tailable cursors or nil if the
+	// cursor is not tailable.
+	tail tailer
+
+	// If true, getMore requests for a tailable cursor wait for new
+	// documents to become available.
+	awaitData bool
+}
+
+// cursorRegistry tracks the cursors owned by the emulator. Requests that
+// reference cursors not tracked by the registry are forwarded to the backend.
+type cursorRegistry struct {
+	mu      sync.Mutex
+	cursors map[int64]*cursor
+	rng     *rand.Rand
+}
+
+func newCursorRegistry() *cursorRegistry {
+	return &cursorRegistry{
+		cursors: make(map[int64]*cursor),
+		rng:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// register tracks a new cursor for the provided documents and returns its ID.
+func (r *cursorRegistry) register(ns protocol.NamespacedCollection, docs []bson.D) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sweepLocked()
+
+	id := r.newIDLocked()
+	r.cursors[id] = &cursor{ns: ns, docs: docs, lastUsed: time.Now()}
+	return id
+}
+
+// registerTailable tracks a new tailable cursor that serves the documents
+// produced by t and returns its ID.
+func (r *cursorRegistry) registerTailable(ns protocol.NamespacedCollection, t tailer, awaitData bool) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sweepLocked()
+
+	id := r.newIDLocked()
+	r.cursors[id] = &cursor{ns: ns, lastUsed: time.Now(), tail: t, awaitData: awaitData}
+	return id
+}
+
+// newIDLocked returns a random non-zero ID that is not used by any tracked
+// cursor. Callers must hold the registry mutex.
+func (r *cursorRegistry) newIDLocked() int64 {
+	var id int64
+	for id == 0 || r.cursors[id] != nil {
+		id = r.rng.Int63()
+	}
+	return id
+}
+
+// tailable returns the tailer of the cursor with the provided ID or nil if
+// the cursor is not tailable. Looking up a tailable cursor marks it as used.
+func (r *cursorRegistry) tailable(id int64) (ns protocol.NamespacedCollection, t tailer, awaitData bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c := r.cursors[id]
+	if c == nil || c.tail == nil {
+		return protocol.NamespacedCollection{}, nil, false
+	}
+	c.lastUsed = time.Now()
+	return c.ns, c.tail, c.awaitData
+}
+
+// owns returns true if the cursor with the provided ID is tracked by the
+// registry.
+func (r *cursorRegistry) owns(id int64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sweepLocked()
+	return r.cursors[id] != nil
+}
+
+// next returns up to batchSize documents from a cursor and the ID that
+// the client should use for fetching the following batch. Once a cursor is
+// exhausted it is removed from the registry and the returned ID is 0. A
+// batchSize <= 0 returns all remaining documents.
+func (r *cursorRegistry) next(id int64, batchSize int) (protocol.NamespacedCollection, []bson.D, int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c := r.cursors[id]
+	if c == nil {
+		return protocol.NamespacedCollection{}, nil, 0, protocol.ServerErrorf(protocol.CodeCursorNotFound, "cursor id %d not found", id)
+	}
+
+	if batchSize <= 0 || batchSize > len(c.docs) {
+		batchSize = len(c.docs)
+	}
+	batch := c.docs[:batchSize]
+	c.docs = c.docs[batchSize:]
+	c.lastUsed = time.Now()
+
+	if len(c.docs) == 0 {
+		delete(r.cursors, id)
+		id = 0
+	}
+	return c.ns, batch, id, nil
+}
+
+// kill removes the cursors with the provided IDs from the registry and
+// returns the IDs of the killed cursors as well as the IDs that are not
+// tracked by the registry.
+func (r *cursorRegistry) kill(ids []int64) (killed, unknown []int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, id := range ids {
+		if r.cursors[id] == nil {
+			unknown = append(unknown, id)
+			continue
+		}
+		delete(r.cursors, id)
+		killed = append(killed, id)
+	}
+	return killed, unknown
+}
+
+// sweepLocked removes cursors that have been idle for longer than
+// cursorIdleTimeout. Callers must hold the registry mutex.
+func (r *cursorRegistry) sweepLocked() {
+	now := time.Now()
+	for id, c := range r.cursors {
+		if now.Sub(c.lastUsed) > cursorIdleTimeout {
+			delete(r.cursors, id)
+		}
+	}
+}
+
+// newCursor returns a cursor reply with the first batchSize documents from
+// docs. Any remaining documents are tracked by an emulator-owned cursor that
+// clients can iterate via getMore requests.
+func (emu *MongoEmulator) newCursor(ns protocol.NamespacedCollection, docs []bson.D, batchSize int) protocol.Response {
+	var cursorID int64
+	if batchSize > 0 && len(docs) > batchSize {
+		cursorID = emu.cursors.register(ns, docs[batchSize:])
+		docs = docs[:batchSize]
+	}
+	return cursorResponse(ns.String(), cursorID, toBatch(docs))
+}
+
+// maybeProcessCursorRequest services getMore and killCursors requests that
+// reference emulator-owned cursors. The handled return value is false if the
+// request should be forwarded to the backend instead.
+func (emu *MongoEmulator) maybeProcessCursorRequest(clientID string, req protocol.Request) (res protocol.Response, handled bool, err error) {
+	switch r := req.(type) {
+	case protocol.GetMoreRequest:
+		// Legacy OP_GETMORE request
+		if !emu.cursors.owns(r.CursorID) {
+			return protocol.Response{}, false, nil
+		}
+		var (
+			batch  []bson.D
+			nextID int64
+			err    error
+		)
+		if _, t, awaitData := emu.cursors.tailable(r.CursorID); t != nil {
+			batch, nextID, _, err = emu.tailCursor(clientID, r.CursorID, t, awaitData, int(r.NumToReturn), 0)
+		} else {
+			_, batch, nextID, err = emu.cursors.next(r.CursorID, int(r.NumToReturn))
+		}
+		if err != nil {
+			return protocol.Response{}, true, err
+		}
+		docs := make([]bson.M, len(batch))
+		for i, doc := range batch {
+			docs[i] = bsonutil.ToMap(doc)
+		}
+		return protocol.Response{CursorID: nextID, Documents: docs}, true, nil
+	case *protocol.GetMoreRequest:
+		if !emu.cursors.owns(r.CursorID) {
+			return protocol.Response{}, false, nil
+		}
+		if ns, t, awaitData := emu.cursors.tailable(r.CursorID); t != nil {
+			batch, nextID, cursorFields, err := emu.tailCursor(clientID, r.CursorID, t, awaitData, int(r.NumToReturn), r.MaxTimeMS)
+			if err != nil {
+				return protocol.Response{}, true, err
+			}
+			cursorDoc := bson.M{"id": nextID, "ns": ns.String(), "nextBatch": toBatch(batch)}
+			for k, v := range cursorFields {
+				cursorDoc[k] = v
+			}
+			return protocol.Response{Documents: []bson.M{{"ok": 1, "cursor": cursorDoc}}}, true, nil
+		}
+		ns, batch, nextID, err := emu.cursors.next(r.CursorID, int(r.NumToReturn))
+		if err != nil {
+			return protocol.Response{}, true, err
+		}
+		return protocol.Response{
+			Documents: []bson.M{{
+				"ok": 1,
+				"cursor": bson.M{
+					"id":        nextID,
+					"ns":        ns.String(),
+					"nextBatch": toBatch(batch),
+				},
+			}},
+		}, true, nil
+	case protocol.KillCursorsRequest:
+		// Legacy OP_KILL_CURSORS request; forward any cursors not
+		// owned by the emulator to the backend.
+		_, unknown := emu.cursors.kill(r.CursorIDs)
+		if len(unknown) == 0 {
+			return protocol.Response{}, true, nil
+		}
+		r.CursorIDs = unknown
+		res, err := emu.b.HandleRequest(clientID, r)
+		return res, true, err
+	case *protocol.KillCursorsRequest:
+		killed, unknown := emu.cursors.kill(r.CursorIDs)
+		if len(unknown) != 0 {
+			if len(killed) == 0 {
+				return protocol.Response{}, false, nil
+			}
+			fwdReq := *r
+			fwdReq.CursorIDs = unknown
+			res, err := emu.b.HandleRequest(clientID, &fwdReq)
+			return res, true, err
+		}
+		return protocol.Response{
+			Documents: []bson.M{{
+				"ok":              1,
+				"cursorsKilled":   toInterfaceList(killed),
+				"cursorsNotFound": []interface{}{},
+				"cursorsAlive":    []interface{}{},
+				"cursorsUnknown":  []interface{}{},
+			}},
+		}, true, nil
+	}
+	return protocol.Response{}, false, nil
+}
+
+// toBatch converts a list of documents into a batch for a cursor reply. The
+// documents are embedded as bson.D values to preserve their field order.
+func toBatch(docs []bson.D) []interface{} {
+	batch := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		batch[i] = doc
+	}
+	return batch
+}
+
+func toInterfaceList(ids []int64) []interface{} {
+	list := make([]interface{}, len(ids))
+	for i, id := range ids {
+		list[i] = id
+	}
+	return list
+}
@@ -3,8 +3,13 @@ package emulator
 import (
 	"io"
 	"io/ioutil"
+	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/achilleasa/mongolite/emulator/aggregate"
 	"github.com/achilleasa/mongolite/protocol"
 	"golang.org/x/xerrors"
 	"gopkg.in/Sirupsen/logrus.v1"
@@ -27,20 +32,78 @@ type Backend interface {
 
 type cmdHandlerFn func(Backend, string, *protocol.CommandRequest) (protocol.Response, error)
 
+type reqHandlerFn func(string, protocol.Request) (protocol.Response, error)
+
 // MongoEmulator emulates a mongo server by delegating CRUD requests to a
 // pluggable backend and handling a subset of common mongo commands.
 type MongoEmulator struct {
 	b      Backend
 	logger *logrus.Entry
 
-	// A map which stores the last seen error for each clientID
-	lastError map[string]error
+	// A map which stores the outcome of the last request for each
+	// clientID. Access to the map is guarded by a mutex as requests from
+	// different clients are processed concurrently.
+	lastErrMu sync.Mutex
+	lastOps   map[string]lastOp
 
 	// A list of handlers for common mongo commands. The emulator will
 	// try to use them when a request specifies a command that the backend
 	// does not know how to handle. The map keys are stored uppercased so
 	// we can handle commands in a case-insensitive manner.
 	cmdHandlers map[string]cmdHandlerFn
+
+	// A list of handlers for typed requests (e.g. catalog operations)
+	// that the emulator can service by delegating to one of the optional
+	// backend interfaces. Like command handlers, they are only used when
+	// the backend does not know how to handle a request.
+	reqHandlers map[protocol.RequestType]reqHandlerFn
+
+	// The state of the background task that deletes expired documents.
+	ttl *ttlMonitor
+
+	// The cursors for result sets generated by the emulator itself
+	// (e.g. aggregations).
+	cursors *cursorRegistry
+
+	// Wakes up getMore requests for tailable cursors that wait for new
+	// writes.
+	writes *writeNotifier
+
+	// The bounds of the capped collections.
+	capped *cappedCollections
+
+	// The cluster time of the emulated deployment.
+	clock *logicalClock
+
+	// The logical sessions started by clients.
+	sessions *sessionRegistry
+
+	// The authentication state of each connection.
+	auth *authRegistry
+
+	// The state of the emulated replica set or nil if the emulator runs
+	// as a standalone server.
+	replSet *replicaSet
+
+	// The maximum size of the oplog in bytes.
+	oplogSize int64
+
+	// The maximum number of bytes that each blocking aggregation stage
+	// may keep in memory. Accessed atomically as it can be modified via
+	// the setParameter command.
+	blockingMemoryLimit int64
+
+	// The directory for temporary files created by aggregation stages
+	// that spill to disk.
+	tempDir string
+
+	// Serializes the write operations that the emulator executes so that
+	// the unique index checks preceding each write observe the outcome
+	// of concurrent writes. It also serializes the findAndModify requests
+	// that the emulator executes on behalf of backends that do not
+	// implement FindAndModifyBackend. Writes issued by other processes
+	// sharing the same backend storage are not serialized.
+	writeMu sync.Mutex
 }
 
 // NewMongoEmulator returns a MongoEmulator instance that delegates CRUD
@@ -54,14 +117,64 @@ func NewMongoEmulator(b Backend, logger *logrus.Entry) (*MongoEmulator, error) {
 	}
 
 	emu := &MongoEmulator{
-		b:         b,
-		logger:    logger,
-		lastError: make(map[string]error),
+		b:        b,
+		logger:   logger,
+		lastOps:  make(map[string]lastOp),
+		ttl:      newTTLMonitor(),
+		cursors:  newCursorRegistry(),
+		writes:   newWriteNotifier(),
+		capped:   newCappedCollections(),
+		clock:    new(logicalClock),
+		sessions: newSessionRegistry(),
+		auth:     newAuthRegistry(),
+
+		blockingMemoryLimit: aggregate.DefaultMemoryLimit,
+		oplogSize:           DefaultOplogSizeMB << 20,
 	}
 	emu.registerCommandHandlers()
+	emu.registerRequestHandlers()
 	return emu, nil
 }
 
+// SetBlockingMemoryLimit sets the maximum number of bytes that each blocking
+// aggregation stage (e.g. $sort or $group) may keep in memory. Stages that
+// exceed the limit fail unless the aggregation allows disk use. The limit also
+// applies to sorts of find commands that are evaluated by the emulator.
+func (emu *MongoEmulator) SetBlockingMemoryLimit(limit int64) error {
+	if limit <= 0 {
+		return xerrors.Errorf("invalid blocking stage memory limit %d: value must be positive", limit)
+	}
+	atomic.StoreInt64(&emu.blockingMemoryLimit, limit)
+	return nil
+}
+
+// SetTempDir sets the directory for the temporary files that are created by
+// aggregations that spill to disk. If dir is empty, the default directory
+// for temporary files is used.
+func (emu *MongoEmulator) SetTempDir(dir string) error {
+	if dir != "" {
+		if fi, err := os.Stat(dir); err != nil {
+			return xerrors.Errorf("invalid temp dir %q: %w", dir, err)
+		} else if !fi.IsDir() {
+			return xerrors.Errorf("invalid temp dir %q: not a directory", dir)
+		}
+	}
+	emu.tempDir = dir
+	return nil
+}
+
+// EnableTestCommands registers additional commands that allow test suites to
+// control the emulator's internal state (e.g. trigger a TTL monitor pass on
+// demand). These commands should never be enabled in production.
+func (emu *MongoEmulator) EnableTestCommands() {
+	testCmds := map[string]cmdHandlerFn{
+		"triggerTTLMonitorPass": emu.handleTriggerTTLMonitorPass,
+	}
+	for cmdName, cmdFn := range testCmds {
+		emu.cmdHandlers[strings.ToUpper(cmdName)] = cmdFn
+	}
+}
+
 // HandleRequest implements the RequestHandler interface. This method processes
 // an incoming mongo request by first dispatching it to the configured backend.
 // If the backend is unable to handle the request, the method checks whether
@@ -78,18 +191,31 @@ func (emu *MongoEmulator) HandleRequest(clientID string, w io.Writer, reqData []
 		return xerrors.Errorf("unable to decode incoming request: %w", err)
 	}
 
+	emu.checkClusterTime(req)
+	clusterTime := emu.clock.now()
+
 	res, err := emu.process(clientID, req)
+
+	// Writes that have not advanced the clock themselves (e.g. via the
+	// oplog) are assigned a new cluster time.
+	opTime := emu.clock.now()
+	if err == nil && opTime == clusterTime && advancesClusterTime(req) {
+		opTime = emu.clock.tick(time.Now())
+	}
+
 	if err != nil {
-		emu.lastError[clientID] = err
+		emu.setLastOp(clientID, failedOp(err))
 		if req.GetReplyType() == protocol.ReplyTypeNone {
 			return nil
 		}
 
-		res = toErrorResponse(err, req.GetReplyType())
+		res = toErrorResponse(err, req)
 	}
+	res = emu.attachClusterTime(req, res, opTime)
 
-	// Reset last error
-	emu.lastError[clientID] = nil
+	// Reset last error and record the number of documents affected by
+	// legacy write operations.
+	emu.setLastOp(clientID, completedOp(req, res))
 
 	// Serialize response if this request expects one.
 	if req.GetReplyType() != protocol.ReplyTypeNone {
@@ -102,14 +228,131 @@ func (emu *MongoEmulator) HandleRequest(clientID string, w io.Writer, reqData []
 // client-specific state tracked by the emulator or its backend is properly
 // cleaned up when the remote client disconnects.
 func (emu *MongoEmulator) RemoveClient(clientID string) error {
-	delete(emu.lastError, clientID)
+	emu.lastErrMu.Lock()
+	delete(emu.lastOps, clientID)
+	emu.lastErrMu.Unlock()
+	emu.auth.remove(clientID)
 	if emu.b == nil {
 		return nil
 	}
 	return emu.b.RemoveClient(clientID)
 }
 
+// lastOp describes the outcome of the last request processed for a client as
+// reported by the getLastError command.
+type lastOp struct {
+	// The error that caused the request to fail or nil.
+	err error
+
+	// The number of documents written by a legacy write operation.
+	n int
+}
+
+// failedOp returns the lastOp for a request that failed with err.
+func failedOp(err error) lastOp {
+	op := lastOp{err: err}
+	var writeErr *WriteError
+	if xerrors.As(err, &writeErr) {
+		op.n = writeErr.N
+	}
+	return op
+}
+
+// completedOp returns the lastOp for a request that completed successfully
+// with res.
+func completedOp(req protocol.Request, res protocol.Response) lastOp {
+	var op lastOp
+	if isWriteRequest(req) && req.GetReplyType() == protocol.ReplyTypeNone && len(res.Documents) != 0 {
+		op.n = asInt(res.Documents[0]["n"])
+	}
+	return op
+}
+
+func (emu *MongoEmulator) setLastOp(clientID string, op lastOp) {
+	emu.lastErrMu.Lock()
+	emu.lastOps[clientID] = op
+	emu.lastErrMu.Unlock()
+}
+
+func (emu *MongoEmulator) getLastOp(clientID string) lastOp {
+	emu.lastErrMu.Lock()
+	defer emu.lastErrMu.Unlock()
+	return emu.lastOps[clientID]
+}
+
 func (emu *MongoEmulator) process(clientID string, req protocol.Request) (protocol.Response, error) {
+	// Users and their credentials are managed by the emulator.
+	if err := emu.checkAuthenticated(clientID, req); err != nil {
+		return protocol.Response{}, err
+	}
+	if res, handled, err := emu.maybeProcessAuthRequest(clientID, req); handled {
+		return res, err
+	}
+
+	// Sessions are managed by the emulator.
+	if res, handled, err := emu.maybeProcessSessionRequest(clientID, req); handled {
+		return res, err
+	}
+
+	// Transactions are tracked by the emulator and executed by the
+	// backend.
+	if err := emu.checkTransaction(clientID, req); err != nil {
+		return protocol.Response{}, err
+	}
+	if txnReq, isTxnReq := req.(*protocol.TransactionRequest); isTxnReq {
+		return emu.handleTransactionRequest(clientID, txnReq)
+	}
+
+	var (
+		res protocol.Response
+		err error
+	)
+	if writeID, isRetryable := retryableWriteID(req); isRetryable {
+		res, err = emu.processRetryableWrite(clientID, req, writeID)
+	} else {
+		res, err = emu.processRequest(clientID, req)
+	}
+	if res, err = emu.checkTransactionResult(clientID, req, res, err); err == nil {
+		emu.trackSessionCursors(req, res)
+		emu.logCatalogChange(clientID, req)
+		emu.capped.invalidate(req)
+	}
+	return res, err
+}
+
+// processRequest processes a request that is not a session or transaction
+// command.
+func (emu *MongoEmulator) processRequest(clientID string, req protocol.Request) (protocol.Response, error) {
+	// Cursors generated by the emulator are not known to the backend.
+	if res, handled, err := emu.maybeProcessCursorRequest(clientID, req); handled {
+		return res, err
+	}
+
+	// Change streams are served from the oplog maintained by the
+	// emulator.
+	if res, handled, err := emu.maybeProcessChangeStream(clientID, req); handled {
+		return res, err
+	}
+
+	// Tailable cursors are only supported for capped collections which are
+	// emulated on top of regular backend collections.
+	if res, handled, err := emu.maybeProcessTailableQuery(clientID, req); handled {
+		return res, err
+	}
+
+	// Queries that can be answered via an index scan are evaluated by
+	// the emulator.
+	if res, handled, err := emu.maybeProcessFind(clientID, req); handled {
+		return res, err
+	}
+
+	// Writes are executed one operation at a time so that the emulator
+	// can enforce unique indexes and report the outcome of each
+	// operation.
+	if isWriteRequest(req) {
+		return emu.handleWrite(clientID, req)
+	}
+
 	// Ask backend to process request.
 	res, err := emu.b.HandleRequest(clientID, req)
 
@@ -119,11 +362,36 @@ func (emu *MongoEmulator) process(clientID string, req protocol.Request) (protoc
 		if req.GetType() == protocol.RequestTypeCommand {
 			return emu.maybeProcessClientCommand(clientID, req.(*protocol.CommandRequest))
 		}
+
+		if h, found := emu.reqHandlers[req.GetType()]; found {
+			return h(clientID, req)
+		}
 	}
 
 	return res, err
 }
 
+func (emu *MongoEmulator) registerRequestHandlers() {
+	emu.reqHandlers = map[protocol.RequestType]reqHandlerFn{
+		protocol.RequestTypeListDatabases:    emu.handleListDatabases,
+		protocol.RequestTypeListCollections:  emu.handleListCollections,
+		protocol.RequestTypeCreate:           emu.handleCreate,
+		protocol.RequestTypeDrop:             emu.handleDrop,
+		protocol.RequestTypeDropDatabase:     emu.handleDropDatabase,
+		protocol.RequestTypeRenameCollection: emu.handleRenameCollection,
+		protocol.RequestTypeCollMod:          emu.handleCollMod,
+		protocol.RequestTypeCreateIndexes:    emu.handleCreateIndexes,
+		protocol.RequestTypeListIndexes:      emu.handleListIndexes,
+		protocol.RequestTypeDropIndexes:      emu.handleDropIndexes,
+		protocol.RequestTypeAggregate:        emu.handleAggregate,
+		protocol.RequestTypeCount:            emu.handleCount,
+		protocol.RequestTypeDistinct:         emu.handleDistinct,
+		protocol.RequestTypeFindAndUpdate:    emu.handleFindAndUpdate,
+		protocol.RequestTypeFindAndDelete:    emu.handleFindAndDelete,
+		protocol.RequestTypeReplSetInitiate:  emu.handleReplSetInitiate,
+	}
+}
+
 // maybeProcessClientCommand attempts to handle a mongo client command using one
 // of the registered command handlers and returns ErrUnsupportedRequest if the
 // command cannot be handled.
@@ -1,6 +1,11 @@
 package emulator
 
-import "golang.org/x/xerrors"
+import (
+	"fmt"
+
+	"github.com/achilleasa/mongolite/protocol"
+	"golang.org/x/xerrors"
+)
 
 var (
 	// ErrUnsupportedRequest is returned by backends when they cannot
@@ -11,3 +16,63 @@ var (
 	// unknown/invalid cursor ID.
 	ErrInvalidCursor = xerrors.New("invalid cursor")
 )
+
+// WriteError is returned by backends when an operation in a batch of write
+// operations (e.g. a bulk insert) fails. It allows the emulator to report the
+// failure using the writeErrors field expected by clients.
+type WriteError struct {
+	// The index of the failed operation in the batch.
+	Index int
+
+	// The number of documents that were successfully written before the
+	// failure occurred.
+	N int
+
+	// For update operations, the number of documents that were modified
+	// before the failure occurred.
+	NModified int
+
+	// The error that caused the operation to fail.
+	Err error
+}
+
+// Error returns a string representation for this error.
+func (e *WriteError) Error() string {
+	return fmt.Sprintf("write operation at index %d failed: %v", e.Index, e.Err)
+}
+
+// Unwrap returns the error that caused the write operation to fail.
+func (e *WriteError) Unwrap() error { return e.Err }
+
+// hasErrorCode returns true if err is a protocol.ServerError with the
+// specified error code.
+func hasErrorCode(err error, code protocol.ErrorCode) bool {
+	srvErr, ok := asServerError(err)
+	return ok && srvErr.Code == code
+}
+
+// asServerError extracts a protocol.ServerError from err. Duplicate key errors
+// are converted into their ServerError representation.
+func asServerError(err error) (protocol.ServerError, bool) {
+	var dupKeyErr protocol.DuplicateKeyError
+	if xerrors.As(err, &dupKeyErr) {
+		return dupKeyErr.ServerError(), true
+	}
+
+	var srvErr protocol.ServerError
+	if xerrors.As(err, &srvErr) {
+		return srvErr, true
+	}
+	return protocol.ServerError{}, false
+}
+
+// withErrorLabels returns err as a protocol.ServerError with the provided
+// labels attached. Errors that do not wrap a protocol.ServerError are reported
+// as internal errors.
+func withErrorLabels(err error, labels ...string) error {
+	srvErr, ok := asServerError(err)
+	if !ok {
+		srvErr = protocol.ServerErrorf(protocol.CodeInternalError, "%v", err)
+	}
+	return srvErr.WithLabels(labels...)
+}
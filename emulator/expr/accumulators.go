@@ -0,0 +1,263 @@
+package expr
+
+import (
+	"math"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/protocol"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Accumulator computes an aggregate value (e.g. a sum) over a sequence of
+// values. Accumulators are used by the $group stage.
+type Accumulator interface {
+	// Add feeds the next value to the accumulator.
+	Add(v interface{}) error
+
+	// Result returns the aggregated value.
+	Result() interface{}
+}
+
+// accumulatorFactories maps accumulator operator names to constructors.
+var accumulatorFactories = map[string]func() Accumulator{
+	"$sum":          func() Accumulator { return &sumAcc{sum: 0} },
+	"$avg":          func() Accumulator { return new(avgAcc) },
+	"$min":          func() Accumulator { return &minMaxAcc{sign: -1} },
+	"$max":          func() Accumulator { return &minMaxAcc{sign: 1} },
+	"$first":        func() Accumulator { return new(firstAcc) },
+	"$last":         func() Accumulator { return new(lastAcc) },
+	"$push":         func() Accumulator { return &pushAcc{values: []interface{}{}} },
+	"$addToSet":     func() Accumulator { return &addToSetAcc{values: []interface{}{}} },
+	"$stdDevPop":    func() Accumulator { return &stdDevAcc{} },
+	"$stdDevSamp":   func() Accumulator { return &stdDevAcc{sample: true} },
+	"$mergeObjects": func() Accumulator { return &mergeObjectsAcc{doc: bson.D{}} },
+}
+
+func init() {
+	// Some accumulators can also be used as expressions. They either
+	// accept a single array argument whose elements are accumulated or a
+	// list of arguments.
+	for _, op := range []string{"$sum", "$avg", "$min", "$max", "$stdDevPop", "$stdDevSamp"} {
+		operators[op] = compileAccumulatorExpr
+	}
+}
+
+// NewAccumulator returns a new accumulator for the specified operator (e.g.
+// "$sum"). It returns false if the operator is not supported.
+func NewAccumulator(op string) (Accumulator, bool) {
+	factory, found := accumulatorFactories[op]
+	if !found {
+		return nil, false
+	}
+	return factory(), true
+}
+
+// IsAccumulator returns true if op is a supported accumulator operator.
+func IsAccumulator(op string) bool {
+	_, found := accumulatorFactories[op]
+	return found
+}
+
+// sumAcc implements $sum. Non-numeric values are ignored.
+type sumAcc struct {
+	sum interface{}
+}
+
+func (a *sumAcc) Add(v interface{}) error {
+	if isNumber(v) {
+		a.sum = addNumbers(a.sum, v)
+	}
+	return nil
+}
+
+func (a *sumAcc) Result() interface{} { return a.sum }
+
+// avgAcc implements $avg. Non-numeric values are ignored; if no numeric
+// values are encountered, the result is null.
+type avgAcc struct {
+	sum   float64
+	count int
+	kind  numKind
+}
+
+func (a *avgAcc) Add(v interface{}) error {
+	if kind, isNum := numberKind(v); isNum {
+		a.sum += asFloat64(v)
+		a.count++
+		a.kind = maxKind(a.kind, kind)
+	}
+	return nil
+}
+
+func (a *avgAcc) Result() interface{} {
+	if a.count == 0 {
+		return nil
+	}
+	return makeFloat(a.kind, a.sum/float64(a.count))
+}
+
+// minMaxAcc implements $min and $max. Null and missing values are ignored.
+type minMaxAcc struct {
+	sign  int
+	value interface{}
+	set   bool
+}
+
+func (a *minMaxAcc) Add(v interface{}) error {
+	if IsNullish(v) {
+		return nil
+	}
+	if !a.set || bsonutil.Compare(v, a.value)*a.sign > 0 {
+		a.value, a.set = v, true
+	}
+	return nil
+}
+
+func (a *minMaxAcc) Result() interface{} { return a.value }
+
+// firstAcc implements $first.
+type firstAcc struct {
+	value interface{}
+	set   bool
+}
+
+func (a *firstAcc) Add(v interface{}) error {
+	if !a.set {
+		a.value, a.set = Value(v), true
+	}
+	return nil
+}
+
+func (a *firstAcc) Result() interface{} { return a.value }
+
+// lastAcc implements $last.
+type lastAcc struct {
+	value interface{}
+}
+
+func (a *lastAcc) Add(v interface{}) error {
+	a.value = Value(v)
+	return nil
+}
+
+func (a *lastAcc) Result() interface{} { return a.value }
+
+// pushAcc implements $push. Missing values are skipped.
+type pushAcc struct {
+	values []interface{}
+}
+
+func (a *pushAcc) Add(v interface{}) error {
+	if !IsMissing(v) {
+		a.values = append(a.values, v)
+	}
+	return nil
+}
+
+func (a *pushAcc) Result() interface{} { return a.values }
+
+// addToSetAcc implements $addToSet. Missing values are skipped.
+type addToSetAcc struct {
+	values []interface{}
+}
+
+func (a *addToSetAcc) Add(v interface{}) error {
+	if IsMissing(v) {
+		return nil
+	}
+	for _, existing := range a.values {
+		if bsonutil.SameTypeBracket(existing, v) && bsonutil.Equal(existing, v) {
+			return nil
+		}
+	}
+	a.values = append(a.values, v)
+	return nil
+}
+
+func (a *addToSetAcc) Result() interface{} { return a.values }
+
+// stdDevAcc implements $stdDevPop and $stdDevSamp using Welford's online
+// algorithm. Non-numeric values are ignored.
+type stdDevAcc struct {
+	sample bool
+	count  int
+	mean   float64
+	m2     float64
+}
+
+func (a *stdDevAcc) Add(v interface{}) error {
+	if !isNumber(v) {
+		return nil
+	}
+
+	f := asFloat64(v)
+	a.count++
+	delta := f - a.mean
+	a.mean += delta / float64(a.count)
+	a.m2 += delta * (f - a.mean)
+	return nil
+}
+
+func (a *stdDevAcc) Result() interface{} {
+	n := a.count
+	if a.sample {
+		n--
+	}
+	if n <= 0 {
+		return nil
+	}
+	return math.Sqrt(a.m2 / float64(n))
+}
+
+// mergeObjectsAcc implements $mergeObjects. Null and missing values are
+// ignored.
+type mergeObjectsAcc struct {
+	doc bson.D
+}
+
+func (a *mergeObjectsAcc) Add(v interface{}) error {
+	if IsNullish(v) {
+		return nil
+	} else if !bsonutil.IsDocument(v) {
+		return protocol.ServerErrorf(40400, "$mergeObjects requires object inputs, but input %s is of type %s", formatValue(v), typeName(v))
+	}
+	a.doc = mergeDocuments(a.doc, v)
+	return nil
+}
+
+func (a *mergeObjectsAcc) Result() interface{} { return a.doc }
+
+// accumulatorExpr evaluates an accumulator operator used as an expression.
+type accumulatorExpr struct {
+	op   string
+	args []Expr
+}
+
+func compileAccumulatorExpr(name string, args interface{}) (Expr, error) {
+	exprs, err := compileArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	return accumulatorExpr{op: name, args: exprs}, nil
+}
+
+func (e accumulatorExpr) Eval(vars *Vars) (interface{}, error) {
+	vals, err := evalArgs(e.args, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	// A single array argument is treated as the list of values to
+	// accumulate.
+	if len(vals) == 1 && bsonutil.IsArray(vals[0]) {
+		vals = bsonutil.ToArray(vals[0])
+	}
+
+	acc, _ := NewAccumulator(e.op)
+	for _, v := range vals {
+		if err := acc.Add(v); err != nil {
+			return nil, err
+		}
+	}
+	return acc.Result(), nil
+}
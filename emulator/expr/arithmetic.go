@@ -0,0 +1,282 @@
+package expr
+
+import (
+	"math"
+
+	"github.com/achilleasa/mongolite/protocol"
+)
+
+func init() {
+	registerOperators(map[string]compileFn{
+		"$abs":   fixedArity(1, evalAbs),
+		"$ceil":  fixedArity(1, roundingOp(math.Ceil)),
+		"$floor": fixedArity(1, roundingOp(math.Floor)),
+		"$exp":   fixedArity(1, floatOp(math.Exp, nil)),
+		"$sqrt":  fixedArity(1, floatOp(math.Sqrt, domainCheck(28714, "%s's argument must be greater than or equal to 0", func(f float64) bool { return f >= 0 }))),
+		"$ln":    fixedArity(1, floatOp(math.Log, domainCheck(28766, "%s's argument must be a positive number", func(f float64) bool { return f > 0 }))),
+		"$log10": fixedArity(1, floatOp(math.Log10, domainCheck(28761, "%s's argument must be a positive number", func(f float64) bool { return f > 0 }))),
+		"$log":   fixedArity(2, evalLog),
+		"$mod":   fixedArity(2, evalMod),
+		"$pow":   fixedArity(2, evalPow),
+		"$round": arityRange(1, 2, placeOp(roundHalfEvenPlace)),
+		"$trunc": arityRange(1, 2, placeOp(truncPlace)),
+	})
+}
+
+// checkNumeric returns an error if v is not a number.
+func checkNumeric(name string, v interface{}) error {
+	if !isNumber(v) {
+		return protocol.ServerErrorf(28765, "%s only supports numeric types, not %s", name, typeName(v))
+	}
+	return nil
+}
+
+func evalAbs(name string, vals []interface{}) (interface{}, error) {
+	v := vals[0]
+	if IsNullish(v) {
+		return nil, nil
+	} else if err := checkNumeric(name, v); err != nil {
+		return nil, err
+	}
+
+	kind, _ := numberKind(v)
+	switch kind {
+	case kindInt, kindLong:
+		n := asInt64(v)
+		if n == math.MinInt64 {
+			return nil, protocol.ServerErrorf(28680, "can't take %s of long long min", name)
+		} else if n < 0 {
+			n = -n
+		}
+		// The absolute value of the smallest int32 does not fit in
+		// an int32 so we need to promote it to a long.
+		if kind == kindInt && n > math.MaxInt32 {
+			return n, nil
+		}
+		return makeInt(kind, n), nil
+	}
+	return makeFloat(kind, math.Abs(asFloat64(v))), nil
+}
+
+// roundingOp returns an evaluator for operators that round a number to an
+// integral value ($ceil, $floor). Integer values are returned unchanged.
+func roundingOp(fn func(float64) float64) evalFn {
+	return func(name string, vals []interface{}) (interface{}, error) {
+		v := vals[0]
+		if IsNullish(v) {
+			return nil, nil
+		} else if err := checkNumeric(name, v); err != nil {
+			return nil, err
+		}
+
+		kind, _ := numberKind(v)
+		if kind <= kindLong {
+			return v, nil
+		}
+		return makeFloat(kind, fn(asFloat64(v))), nil
+	}
+}
+
+// domainCheck returns a function that validates the argument of a floating
+// point operator.
+func domainCheck(code protocol.ErrorCode, msg string, valid func(float64) bool) func(string, float64) error {
+	return func(name string, f float64) error {
+		if !valid(f) && !math.IsNaN(f) {
+			return protocol.ServerErrorf(code, msg, name)
+		}
+		return nil
+	}
+}
+
+// floatOp returns an evaluator for operators that apply a floating point
+// function to their argument. The result is a double unless the argument is a
+// decimal.
+func floatOp(fn func(float64) float64, check func(string, float64) error) evalFn {
+	return func(name string, vals []interface{}) (interface{}, error) {
+		v := vals[0]
+		if IsNullish(v) {
+			return nil, nil
+		} else if err := checkNumeric(name, v); err != nil {
+			return nil, err
+		}
+
+		f := asFloat64(v)
+		if check != nil {
+			if err := check(name, f); err != nil {
+				return nil, err
+			}
+		}
+
+		kind, _ := numberKind(v)
+		if kind != kindDecimal {
+			kind = kindDouble
+		}
+		return makeFloat(kind, fn(f)), nil
+	}
+}
+
+func evalLog(name string, vals []interface{}) (interface{}, error) {
+	v, base := vals[0], vals[1]
+	if anyNullish(vals) {
+		return nil, nil
+	} else if !isNumber(v) {
+		return nil, protocol.ServerErrorf(28756, "%s's argument must be numeric, not %s", name, typeName(v))
+	} else if !isNumber(base) {
+		return nil, protocol.ServerErrorf(28757, "%s's base must be numeric, not %s", name, typeName(base))
+	}
+
+	f, b := asFloat64(v), asFloat64(base)
+	if f <= 0 {
+		return nil, protocol.ServerErrorf(28758, "%s's argument must be a positive number, but is %v", name, f)
+	} else if b <= 0 || b == 1 {
+		return nil, protocol.ServerErrorf(28759, "%s's base must be a positive number not equal to 1, but is %v", name, b)
+	}
+
+	kv, _ := numberKind(v)
+	kb, _ := numberKind(base)
+	return makeFloat(maxKind(maxKind(kv, kb), kindDouble), math.Log(f)/math.Log(b)), nil
+}
+
+func evalMod(name string, vals []interface{}) (interface{}, error) {
+	a, b := vals[0], vals[1]
+	if anyNullish(vals) {
+		return nil, nil
+	} else if !isNumber(a) || !isNumber(b) {
+		return nil, protocol.ServerErrorf(16611, "%s only supports numeric types, not %s and %s", name, typeName(a), typeName(b))
+	}
+
+	ka, _ := numberKind(a)
+	kb, _ := numberKind(b)
+	kind := maxKind(ka, kb)
+	if kind <= kindLong {
+		divisor := asInt64(b)
+		if divisor == 0 {
+			return nil, protocol.ServerErrorf(16610, "can't %s by zero", name)
+		} else if divisor == -1 {
+			// Avoid overflowing when dividing the smallest
+			// integer by -1.
+			return makeInt(kind, 0), nil
+		}
+		return makeInt(kind, asInt64(a)%divisor), nil
+	}
+
+	divisor := asFloat64(b)
+	if divisor == 0 {
+		return nil, protocol.ServerErrorf(16610, "can't %s by zero", name)
+	}
+	return makeFloat(kind, math.Mod(asFloat64(a), divisor)), nil
+}
+
+func evalPow(name string, vals []interface{}) (interface{}, error) {
+	base, exp := vals[0], vals[1]
+	if anyNullish(vals) {
+		return nil, nil
+	} else if !isNumber(base) {
+		return nil, protocol.ServerErrorf(28762, "%s's base must be numeric, not %s", name, typeName(base))
+	} else if !isNumber(exp) {
+		return nil, protocol.ServerErrorf(28763, "%s's exponent must be numeric, not %s", name, typeName(exp))
+	}
+
+	b, e := asFloat64(base), asFloat64(exp)
+	if b == 0 && e < 0 {
+		return nil, protocol.ServerErrorf(28764, "%s cannot take a base of 0 and a negative exponent", name)
+	}
+
+	kb, _ := numberKind(base)
+	ke, _ := numberKind(exp)
+	kind := maxKind(kb, ke)
+	if kind <= kindLong && e >= 0 {
+		// Use integer exponentiation and fall back to a double if
+		// the result overflows.
+		if res, ok := intPow(asInt64(base), asInt64(exp)); ok {
+			if kind == kindInt && (res < math.MinInt32 || res > math.MaxInt32) {
+				return res, nil
+			}
+			return makeInt(kind, res), nil
+		}
+		return math.Pow(b, e), nil
+	} else if kind <= kindLong {
+		kind = kindDouble
+	}
+	return makeFloat(kind, math.Pow(b, e)), nil
+}
+
+// intPow computes base^exp using integer arithmetic. It returns false if the
+// result overflows an int64.
+func intPow(base, exp int64) (int64, bool) {
+	switch {
+	case exp == 0 || base == 1:
+		return 1, true
+	case base == 0:
+		return 0, true
+	case base == -1:
+		if exp%2 == 0 {
+			return 1, true
+		}
+		return -1, true
+	case exp >= 64:
+		return 0, false
+	}
+
+	res := int64(1)
+	for ; exp > 0; exp-- {
+		next := res * base
+		if next/base != res {
+			return 0, false
+		}
+		res = next
+	}
+	return res, true
+}
+
+// placeOp returns an evaluator for $round and $trunc which accept an
+// optional argument specifying the number of decimal places to keep.
+func placeOp(fn func(f float64, place int64) float64) evalFn {
+	return func(name string, vals []interface{}) (interface{}, error) {
+		v := vals[0]
+		var place int64
+		if len(vals) == 2 {
+			if IsNullish(vals[1]) {
+				return nil, nil
+			}
+			if !isNumber(vals[1]) || asFloat64(vals[1]) != math.Trunc(asFloat64(vals[1])) {
+				return nil, protocol.ServerErrorf(51081, "%s requires \"place\" argument to be an integral value", name)
+			}
+			if place = asInt64(vals[1]); place < -20 || place > 100 {
+				return nil, protocol.ServerErrorf(51083, "cannot apply %s with precision value %d value must be in [-20, 100]", name, place)
+			}
+		}
+
+		if IsNullish(v) {
+			return nil, nil
+		} else if !isNumber(v) {
+			return nil, protocol.ServerErrorf(51080, "%s only supports numeric types, not %s", name, typeName(v))
+		}
+
+		kind, _ := numberKind(v)
+		f := asFloat64(v)
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return v, nil
+		}
+		if kind <= kindLong {
+			if place >= 0 {
+				return v, nil
+			}
+			return makeInt(kind, int64(fn(f, place))), nil
+		}
+		return makeFloat(kind, fn(f, place)), nil
+	}
+}
+
+// roundHalfEvenPlace rounds f to the specified number of decimal places using
+// the round-half-to-even rule.
+func roundHalfEvenPlace(f float64, place int64) float64 {
+	scale := math.Pow(10, float64(place))
+	return math.RoundToEven(f*scale) / scale
+}
+
+// truncPlace truncates f to the specified number of decimal places.
+func truncPlace(f float64, place int64) float64 {
+	scale := math.Pow(10, float64(place))
+	return math.Trunc(f*scale) / scale
+}
@@ -0,0 +1,588 @@
+package expr
+
+import (
+	"math"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/protocol"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func init() {
+	registerOperators(map[string]compileFn{
+		"$arrayElemAt":   fixedArity(2, evalArrayElemAt),
+		"$first":         fixedArity(1, arrayEndOp(true)),
+		"$last":          fixedArity(1, arrayEndOp(false)),
+		"$concatArrays":  variadic(evalConcatArrays),
+		"$in":            fixedArity(2, evalIn),
+		"$indexOfArray":  arityRange(2, 4, evalIndexOfArray),
+		"$isArray":       fixedArity(1, evalIsArray),
+		"$range":         arityRange(2, 3, evalRange),
+		"$reverseArray":  fixedArity(1, evalReverseArray),
+		"$slice":         arityRange(2, 3, evalSlice),
+		"$arrayToObject": fixedArity(1, evalArrayToObject),
+		"$objectToArray": fixedArity(1, evalObjectToArray),
+		"$mergeObjects":  variadic(evalMergeObjects),
+		"$zip":           compileZip,
+		"$map":           compileMap,
+		"$filter":        compileFilter,
+		"$reduce":        compileReduce,
+	})
+}
+
+// isIntegral returns true if v is a number without a fractional part.
+func isIntegral(v interface{}) bool {
+	if !isNumber(v) {
+		return false
+	}
+	f := asFloat64(v)
+	return f == math.Trunc(f) && !math.IsInf(f, 0)
+}
+
+func evalArrayElemAt(name string, vals []interface{}) (interface{}, error) {
+	if anyNullish(vals) {
+		return nil, nil
+	} else if !bsonutil.IsArray(vals[0]) {
+		return nil, protocol.ServerErrorf(28689, "%s's first argument must be an array, but is %s", name, typeName(vals[0]))
+	} else if !isNumber(vals[1]) {
+		return nil, protocol.ServerErrorf(28690, "%s's second argument must be a numeric value, but is %s", name, typeName(vals[1]))
+	} else if !isIntegral(vals[1]) {
+		return nil, protocol.ServerErrorf(28691, "%s's second argument must be representable as a 32-bit integer: %s", name, formatValue(vals[1]))
+	}
+
+	arr := bsonutil.ToArray(vals[0])
+	idx := asInt64(vals[1])
+	if idx < 0 {
+		idx += int64(len(arr))
+	}
+	if idx < 0 || idx >= int64(len(arr)) {
+		return Missing, nil
+	}
+	return arr[idx], nil
+}
+
+// arrayEndOp returns an evaluator for the expression forms of $first and
+// $last which return the first or last element of an array.
+func arrayEndOp(first bool) evalFn {
+	return func(name string, vals []interface{}) (interface{}, error) {
+		if IsNullish(vals[0]) {
+			return nil, nil
+		} else if !bsonutil.IsArray(vals[0]) {
+			return nil, protocol.ServerErrorf(28689, "%s's argument must be an array, but is %s", name, typeName(vals[0]))
+		}
+
+		arr := bsonutil.ToArray(vals[0])
+		switch {
+		case len(arr) == 0:
+			return Missing, nil
+		case first:
+			return arr[0], nil
+		}
+		return arr[len(arr)-1], nil
+	}
+}
+
+func evalConcatArrays(name string, vals []interface{}) (interface{}, error) {
+	out := []interface{}{}
+	for _, v := range vals {
+		if IsNullish(v) {
+			return nil, nil
+		} else if !bsonutil.IsArray(v) {
+			return nil, protocol.ServerErrorf(28664, "%s only supports arrays, not %s", name, typeName(v))
+		}
+		out = append(out, bsonutil.ToArray(v)...)
+	}
+	return out, nil
+}
+
+func evalIn(name string, vals []interface{}) (interface{}, error) {
+	if !bsonutil.IsArray(vals[1]) {
+		return nil, protocol.ServerErrorf(40081, "%s requires an array as a second argument, found: %s", name, typeName(vals[1]))
+	}
+
+	for _, elem := range bsonutil.ToArray(vals[1]) {
+		if Compare(vals[0], elem) == 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func evalIndexOfArray(name string, vals []interface{}) (interface{}, error) {
+	if IsNullish(vals[0]) {
+		return nil, nil
+	} else if !bsonutil.IsArray(vals[0]) {
+		return nil, protocol.ServerErrorf(40090, "%s requires an array as a first argument, found: %s", name, typeName(vals[0]))
+	}
+
+	arr := bsonutil.ToArray(vals[0])
+	start, end := int64(0), int64(len(arr))
+	codes := [][2]protocol.ErrorCode{{40096, 40097}, {40098, 40099}}
+	for i, code := range codes {
+		if len(vals) <= i+2 {
+			break
+		}
+		v := vals[i+2]
+		if !isIntegral(v) {
+			return nil, protocol.ServerErrorf(code[0], "%s requires an integral %s index, found a value of type: %s", name, []string{"starting", "ending"}[i], typeName(v))
+		} else if asInt64(v) < 0 {
+			return nil, protocol.ServerErrorf(code[1], "%s requires a nonnegative %s index, found: %d", name, []string{"starting", "ending"}[i], asInt64(v))
+		}
+		if i == 0 {
+			start = asInt64(v)
+		} else if asInt64(v) < end {
+			end = asInt64(v)
+		}
+	}
+
+	for i := start; i < end; i++ {
+		if Compare(arr[i], vals[1]) == 0 {
+			return int(i), nil
+		}
+	}
+	return -1, nil
+}
+
+func evalIsArray(_ string, vals []interface{}) (interface{}, error) {
+	return bsonutil.IsArray(vals[0]), nil
+}
+
+func evalRange(name string, vals []interface{}) (interface{}, error) {
+	params := []struct {
+		desc                    string
+		notNumeric, notIntegral protocol.ErrorCode
+	}{
+		{"starting value", 34443, 34444},
+		{"ending value", 34445, 34446},
+		{"step value", 34447, 34448},
+	}
+
+	args := []int64{0, 0, 1}
+	for i, v := range vals {
+		if !isNumber(v) {
+			return nil, protocol.ServerErrorf(params[i].notNumeric, "%s requires a numeric %s, found value of type: %s", name, params[i].desc, typeName(v))
+		} else if !isIntegral(v) {
+			return nil, protocol.ServerErrorf(params[i].notIntegral, "%s requires a %s that can be represented as a 32-bit integer, found value: %s", name, params[i].desc, formatValue(v))
+		}
+		args[i] = asInt64(v)
+	}
+
+	start, end, step := args[0], args[1], args[2]
+	if step == 0 {
+		return nil, protocol.ServerErrorf(34449, "%s requires a non-zero step value", name)
+	}
+
+	out := []interface{}{}
+	for i := start; (step > 0 && i < end) || (step < 0 && i > end); i += step {
+		out = append(out, int(i))
+	}
+	return out, nil
+}
+
+func evalReverseArray(name string, vals []interface{}) (interface{}, error) {
+	if IsNullish(vals[0]) {
+		return nil, nil
+	} else if !bsonutil.IsArray(vals[0]) {
+		return nil, protocol.ServerErrorf(34435, "The argument to %s must be an array, but was of type: %s", name, typeName(vals[0]))
+	}
+
+	arr := bsonutil.ToArray(vals[0])
+	out := make([]interface{}, len(arr))
+	for i, elem := range arr {
+		out[len(arr)-1-i] = elem
+	}
+	return out, nil
+}
+
+func evalSlice(name string, vals []interface{}) (interface{}, error) {
+	if anyNullish(vals) {
+		return nil, nil
+	} else if !bsonutil.IsArray(vals[0]) {
+		return nil, protocol.ServerErrorf(28724, "First argument to %s must be an array, but is of type: %s", name, typeName(vals[0]))
+	} else if !isIntegral(vals[1]) {
+		return nil, protocol.ServerErrorf(28725, "Second argument to %s must be a numeric value, but is of type: %s", name, typeName(vals[1]))
+	}
+
+	arr := bsonutil.ToArray(vals[0])
+	size := int64(len(arr))
+
+	var start, end int64
+	if len(vals) == 2 {
+		// {$slice: [arr, n]} returns the first n elements if n is
+		// positive and the last n elements if it is negative.
+		n := asInt64(vals[1])
+		if n >= 0 {
+			start, end = 0, n
+		} else {
+			start, end = size+n, size
+		}
+	} else {
+		if !isIntegral(vals[2]) {
+			return nil, protocol.ServerErrorf(28727, "Third argument to %s must be numeric, but is of type: %s", name, typeName(vals[2]))
+		} else if asInt64(vals[2]) <= 0 {
+			return nil, protocol.ServerErrorf(28729, "Third argument to %s must be positive: %s", name, formatValue(vals[2]))
+		}
+
+		start = asInt64(vals[1])
+		if start < 0 {
+			start += size
+		}
+		end = start + asInt64(vals[2])
+	}
+
+	if start < 0 {
+		start = 0
+	}
+	if end > size {
+		end = size
+	}
+	if start >= end {
+		return []interface{}{}, nil
+	}
+	return append([]interface{}{}, arr[start:end]...), nil
+}
+
+func evalArrayToObject(name string, vals []interface{}) (interface{}, error) {
+	if IsNullish(vals[0]) {
+		return nil, nil
+	} else if !bsonutil.IsArray(vals[0]) {
+		return nil, protocol.ServerErrorf(40386, "%s requires an array input, found: %s", name, typeName(vals[0]))
+	}
+
+	var out bson.D
+	set := func(k string, v interface{}) {
+		for i := range out {
+			if out[i].Name == k {
+				out[i].Value = v
+				return
+			}
+		}
+		out = append(out, bson.DocElem{Name: k, Value: v})
+	}
+
+	for _, elem := range bsonutil.ToArray(vals[0]) {
+		var key, value interface{}
+		switch {
+		case bsonutil.IsArray(elem):
+			pair := bsonutil.ToArray(elem)
+			if len(pair) != 2 {
+				return nil, protocol.ServerErrorf(40397, "%s requires an array of size 2 arrays,found array of size: %d", name, len(pair))
+			}
+			key, value = pair[0], pair[1]
+		case bsonutil.IsDocument(elem):
+			elems := bsonutil.Elements(elem)
+			k, hasK := bsonutil.Get(elem, "k")
+			v, hasV := bsonutil.Get(elem, "v")
+			if len(elems) != 2 || !hasK || !hasV {
+				return nil, protocol.ServerErrorf(40392, "%s requires an object keys of 'k' and 'v'. Found incorrect number of keys:%d", name, len(elems))
+			}
+			key, value = k, v
+		default:
+			return nil, protocol.ServerErrorf(40398, "Unrecognised input type format for %s: %s", name, typeName(elem))
+		}
+
+		k, isString := key.(string)
+		if !isString {
+			return nil, protocol.ServerErrorf(40395, "%s requires an array of key-value pairs, where the key must be of type string. Found key type: %s", name, typeName(key))
+		}
+		set(k, value)
+	}
+
+	if out == nil {
+		out = bson.D{}
+	}
+	return out, nil
+}
+
+func evalObjectToArray(name string, vals []interface{}) (interface{}, error) {
+	if IsNullish(vals[0]) {
+		return nil, nil
+	} else if !bsonutil.IsDocument(vals[0]) {
+		return nil, protocol.ServerErrorf(40390, "%s requires a document input, found: %s", name, typeName(vals[0]))
+	}
+
+	out := []interface{}{}
+	for _, elem := range bsonutil.Elements(vals[0]) {
+		out = append(out, bson.D{{Name: "k", Value: elem.Name}, {Name: "v", Value: elem.Value}})
+	}
+	return out, nil
+}
+
+func evalMergeObjects(name string, vals []interface{}) (interface{}, error) {
+	out := bson.D{}
+	for _, v := range vals {
+		if IsNullish(v) {
+			continue
+		} else if !bsonutil.IsDocument(v) {
+			return nil, protocol.ServerErrorf(40400, "%s requires object inputs, but input %s is of type %s", name, formatValue(v), typeName(v))
+		}
+		out = mergeDocuments(out, v)
+	}
+	return out, nil
+}
+
+// mergeDocuments returns a copy of dst with the fields of src added to it.
+// Fields that exist in both documents are overwritten.
+func mergeDocuments(dst bson.D, src interface{}) bson.D {
+	out := append(bson.D{}, dst...)
+outer:
+	for _, elem := range bsonutil.Elements(src) {
+		for i := range out {
+			if out[i].Name == elem.Name {
+				out[i].Value = elem.Value
+				continue outer
+			}
+		}
+		out = append(out, elem)
+	}
+	return out
+}
+
+// zipExpr implements the $zip operator.
+type zipExpr struct {
+	name string
+	args namedArgs
+}
+
+func compileZip(name string, args interface{}) (Expr, error) {
+	compiled, err := compileNamedArgs(name, args, []string{"inputs", "useLongestLength", "defaults"}, "inputs")
+	if err != nil {
+		return nil, err
+	}
+	return zipExpr{name: name, args: compiled}, nil
+}
+
+func (e zipExpr) Eval(vars *Vars) (interface{}, error) {
+	inputsVal, err := e.args.eval("inputs", vars)
+	if err != nil {
+		return nil, err
+	}
+	longestVal, err := e.args.eval("useLongestLength", vars)
+	if err != nil {
+		return nil, err
+	}
+	defaultsVal, err := e.args.eval("defaults", vars)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bsonutil.IsArray(inputsVal) {
+		return nil, protocol.ServerErrorf(34461, "inputs must be an array of expressions, found %s", typeName(inputsVal))
+	}
+	useLongest := false
+	if !IsMissing(longestVal) {
+		b, isBool := longestVal.(bool)
+		if !isBool {
+			return nil, protocol.ServerErrorf(34463, "useLongestLength must be a bool, found %s", typeName(longestVal))
+		}
+		useLongest = b
+	}
+
+	var inputs [][]interface{}
+	for _, input := range bsonutil.ToArray(inputsVal) {
+		if IsNullish(input) {
+			return nil, nil
+		} else if !bsonutil.IsArray(input) {
+			return nil, protocol.ServerErrorf(34468, "%s found a non-array expression in input: %s", e.name, formatValue(input))
+		}
+		inputs = append(inputs, bsonutil.ToArray(input))
+	}
+
+	defaults := make([]interface{}, len(inputs))
+	if !IsMissing(defaultsVal) {
+		if !useLongest {
+			return nil, protocol.ServerErrorf(34466, "cannot specify defaults unless useLongestLength is true")
+		} else if !bsonutil.IsArray(defaultsVal) {
+			return nil, protocol.ServerErrorf(34462, "defaults must be an array of expressions, found %s", typeName(defaultsVal))
+		} else if len(bsonutil.ToArray(defaultsVal)) != len(inputs) {
+			return nil, protocol.ServerErrorf(34467, "defaults and inputs must have the same length")
+		}
+		copy(defaults, bsonutil.ToArray(defaultsVal))
+	}
+
+	var size int
+	for i, input := range inputs {
+		if i == 0 || (useLongest && len(input) > size) || (!useLongest && len(input) < size) {
+			size = len(input)
+		}
+	}
+
+	out := make([]interface{}, size)
+	for i := range out {
+		tuple := make([]interface{}, len(inputs))
+		for j, input := range inputs {
+			if i < len(input) {
+				tuple[j] = input[i]
+			} else {
+				tuple[j] = defaults[j]
+			}
+		}
+		out[i] = tuple
+	}
+	return out, nil
+}
+
+// compileAsVariable validates the name of the variable introduced by $map and
+// $filter for referencing the current array element.
+func compileAsVariable(args namedArgs, spec interface{}) (string, error) {
+	if _, found := args["as"]; !found {
+		return "this", nil
+	}
+
+	name, _ := bsonutil.Get(spec, "as")
+	varName, isString := name.(string)
+	if !isString {
+		return "", protocol.ServerErrorf(protocol.CodeFailedToParse, "'as' must be a string, found %s", typeName(name))
+	}
+	if err := validateVariableName(varName, false); err != nil {
+		return "", err
+	}
+	return varName, nil
+}
+
+// mapExpr implements $map which applies an expression to each element of an
+// array.
+type mapExpr struct {
+	name  string
+	input Expr
+	as    string
+	in    Expr
+}
+
+func compileMap(name string, args interface{}) (Expr, error) {
+	compiled, err := compileNamedArgs(name, args, []string{"input", "as", "in"}, "input", "in")
+	if err != nil {
+		return nil, err
+	}
+	as, err := compileAsVariable(compiled, args)
+	if err != nil {
+		return nil, err
+	}
+	return mapExpr{name: name, input: compiled["input"], as: as, in: compiled["in"]}, nil
+}
+
+func (e mapExpr) Eval(vars *Vars) (interface{}, error) {
+	input, err := e.input.Eval(vars)
+	if err != nil {
+		return nil, err
+	} else if IsNullish(input) {
+		return nil, nil
+	} else if !bsonutil.IsArray(input) {
+		return nil, protocol.ServerErrorf(16883, "input to %s must be an array not %s", e.name, typeName(input))
+	}
+
+	arr := bsonutil.ToArray(input)
+	out := make([]interface{}, len(arr))
+	for i, elem := range arr {
+		v, err := e.in.Eval(vars.With(e.as, elem))
+		if err != nil {
+			return nil, err
+		}
+		out[i] = Value(v)
+	}
+	return out, nil
+}
+
+// filterExpr implements $filter which selects the array elements that
+// satisfy a condition.
+type filterExpr struct {
+	name  string
+	input Expr
+	as    string
+	cond  Expr
+	limit Expr
+}
+
+func compileFilter(name string, args interface{}) (Expr, error) {
+	compiled, err := compileNamedArgs(name, args, []string{"input", "as", "cond", "limit"}, "input", "cond")
+	if err != nil {
+		return nil, err
+	}
+	as, err := compileAsVariable(compiled, args)
+	if err != nil {
+		return nil, err
+	}
+	return filterExpr{name: name, input: compiled["input"], as: as, cond: compiled["cond"], limit: compiled["limit"]}, nil
+}
+
+func (e filterExpr) Eval(vars *Vars) (interface{}, error) {
+	input, err := e.input.Eval(vars)
+	if err != nil {
+		return nil, err
+	} else if IsNullish(input) {
+		return nil, nil
+	} else if !bsonutil.IsArray(input) {
+		return nil, protocol.ServerErrorf(28651, "input to %s must be an array not %s", e.name, typeName(input))
+	}
+
+	limit := int64(-1)
+	if e.limit != nil {
+		v, err := e.limit.Eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		if !IsNullish(v) {
+			if !isIntegral(v) {
+				return nil, protocol.ServerErrorf(327391, "%s: limit must be represented as a 32-bit integral value: %s", e.name, formatValue(v))
+			} else if limit = asInt64(v); limit < 1 {
+				return nil, protocol.ServerErrorf(327392, "%s: limit must be greater than 0: %d", e.name, limit)
+			}
+		}
+	}
+
+	out := []interface{}{}
+	for _, elem := range bsonutil.ToArray(input) {
+		if limit >= 0 && int64(len(out)) == limit {
+			break
+		}
+
+		v, err := e.cond.Eval(vars.With(e.as, elem))
+		if err != nil {
+			return nil, err
+		}
+		if Truthy(v) {
+			out = append(out, elem)
+		}
+	}
+	return out, nil
+}
+
+// reduceExpr implements $reduce which combines the elements of an array into
+// a single value. The accumulated value and the current element are exposed
+// to the in expression as $$value and $$this.
+type reduceExpr struct {
+	name         string
+	input        Expr
+	initialValue Expr
+	in           Expr
+}
+
+func compileReduce(name string, args interface{}) (Expr, error) {
+	compiled, err := compileNamedArgs(name, args, []string{"input", "initialValue", "in"}, "input", "initialValue", "in")
+	if err != nil {
+		return nil, err
+	}
+	return reduceExpr{name: name, input: compiled["input"], initialValue: compiled["initialValue"], in: compiled["in"]}, nil
+}
+
+func (e reduceExpr) Eval(vars *Vars) (interface{}, error) {
+	input, err := e.input.Eval(vars)
+	if err != nil {
+		return nil, err
+	} else if IsNullish(input) {
+		return nil, nil
+	} else if !bsonutil.IsArray(input) {
+		return nil, protocol.ServerErrorf(40080, "%s requires that 'input' be an array, found: %s", e.name, formatValue(input))
+	}
+
+	acc, err := e.initialValue.Eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	for _, elem := range bsonutil.ToArray(input) {
+		if acc, err = e.in.Eval(vars.With("value", acc).With("this", elem)); err != nil {
+			return nil, err
+		}
+	}
+	return acc, nil
+}
@@ -0,0 +1,388 @@
+package expr
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/protocol"
+	"golang.org/x/xerrors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func init() {
+	registerOperators(map[string]compileFn{
+		"$convert":    compileConvert,
+		"$toBool":     fixedArity(1, convertOp("bool")),
+		"$toInt":      fixedArity(1, convertOp("int")),
+		"$toLong":     fixedArity(1, convertOp("long")),
+		"$toDouble":   fixedArity(1, convertOp("double")),
+		"$toDecimal":  fixedArity(1, convertOp("decimal")),
+		"$toString":   fixedArity(1, convertOp("string")),
+		"$toDate":     fixedArity(1, convertOp("date")),
+		"$toObjectId": fixedArity(1, convertOp("objectId")),
+		"$type":       fixedArity(1, evalType),
+		"$isNumber":   fixedArity(1, evalIsNumber),
+	})
+}
+
+// convertTargets lists the types supported by $convert.
+var convertTargets = map[string]bool{
+	"double":   true,
+	"string":   true,
+	"objectId": true,
+	"bool":     true,
+	"date":     true,
+	"int":      true,
+	"long":     true,
+	"decimal":  true,
+}
+
+// convertOp returns an evaluator for the $toX shorthands of $convert.
+func convertOp(to string) evalFn {
+	return func(_ string, vals []interface{}) (interface{}, error) {
+		if IsNullish(vals[0]) {
+			return nil, nil
+		}
+		return Convert(vals[0], to)
+	}
+}
+
+// Convert converts a value to the type with the specified alias (e.g. "int")
+// using the rules of the $convert operator.
+func Convert(v interface{}, to string) (interface{}, error) {
+	var (
+		res interface{}
+		err error
+	)
+	switch to {
+	case "bool":
+		res, err = toBool(v)
+	case "int":
+		res, err = toInteger(v, kindInt)
+	case "long":
+		res, err = toInteger(v, kindLong)
+	case "double":
+		res, err = toDouble(v)
+	case "decimal":
+		res, err = toDouble(v)
+		if err == nil {
+			res = toDecimal(v, res.(float64))
+		}
+	case "string":
+		res, err = toString(v)
+	case "date":
+		res, err = toDate(v)
+	case "objectId":
+		res, err = toObjectID(v)
+	default:
+		return nil, protocol.ServerErrorf(protocol.CodeBadValue, "Unknown type name: %s", to)
+	}
+
+	if xerrors.Is(err, errUnsupportedConversion) {
+		return nil, protocol.ServerErrorf(protocol.CodeConversionFailure, "Unsupported conversion from %s to %s in $convert with no onError value", typeName(v), to)
+	}
+	return res, err
+}
+
+// errUnsupportedConversion is returned by the conversion helpers when there
+// is no conversion rule between two types.
+var errUnsupportedConversion = xerrors.New("unsupported conversion")
+
+func conversionFailure(format string, args ...interface{}) error {
+	return protocol.ServerErrorf(protocol.CodeConversionFailure, format, args...)
+}
+
+func toBool(v interface{}) (interface{}, error) {
+	switch val := v.(type) {
+	case bool:
+		return val, nil
+	case string, bson.ObjectId, time.Time, bson.MongoTimestamp:
+		return true, nil
+	}
+	if isNumber(v) {
+		return asFloat64(v) != 0, nil
+	}
+	return nil, errUnsupportedConversion
+}
+
+func toInteger(v interface{}, kind numKind) (interface{}, error) {
+	target := map[numKind]string{kindInt: "int", kindLong: "long"}[kind]
+	min, max := float64(math.MinInt32), float64(math.MaxInt32)
+	if kind == kindLong {
+		min, max = math.MinInt64, math.MaxInt64
+	}
+
+	switch val := v.(type) {
+	case bool:
+		if val {
+			return makeInt(kind, 1), nil
+		}
+		return makeInt(kind, 0), nil
+	case string:
+		bits := 32
+		if kind == kindLong {
+			bits = 64
+		}
+		n, err := strconv.ParseInt(val, 10, bits)
+		if err != nil {
+			return nil, conversionFailure("Failed to parse number '%s' in $convert with no onError value: Did not consume whole string.", val)
+		}
+		return makeInt(kind, n), nil
+	case time.Time:
+		if kind == kindLong {
+			return val.UnixNano() / int64(time.Millisecond), nil
+		}
+		return nil, errUnsupportedConversion
+	}
+
+	numKind, isNum := numberKind(v)
+	if !isNum {
+		return nil, errUnsupportedConversion
+	}
+	if numKind <= kindLong {
+		n := asInt64(v)
+		if float64(n) < min || float64(n) > max {
+			return nil, conversionFailure("Conversion would overflow target type in $convert with no onError value: %d", n)
+		}
+		return makeInt(kind, n), nil
+	}
+
+	f := asFloat64(v)
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, conversionFailure("Attempt to convert %s value to %s in $convert with no onError value", formatValue(v), target)
+	} else if f = math.Trunc(f); f < min || f >= max+1 {
+		return nil, conversionFailure("Conversion would overflow target type in $convert with no onError value: %s", formatValue(v))
+	}
+	return makeInt(kind, int64(f)), nil
+}
+
+func toDouble(v interface{}) (interface{}, error) {
+	switch val := v.(type) {
+	case bool:
+		if val {
+			return 1.0, nil
+		}
+		return 0.0, nil
+	case string:
+		f, err := parseFloat(val)
+		if err != nil {
+			return nil, conversionFailure("Failed to parse number '%s' in $convert with no onError value: Did not consume whole string.", val)
+		}
+		return f, nil
+	case time.Time:
+		return float64(val.UnixNano() / int64(time.Millisecond)), nil
+	}
+
+	if isNumber(v) {
+		return asFloat64(v), nil
+	}
+	return nil, errUnsupportedConversion
+}
+
+// parseFloat parses a floating point number, accepting the special values
+// supported by mongo.
+func parseFloat(s string) (float64, error) {
+	switch strings.ToLower(s) {
+	case "infinity", "inf":
+		return math.Inf(1), nil
+	case "-infinity", "-inf":
+		return math.Inf(-1), nil
+	case "nan":
+		return math.NaN(), nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// toDecimal converts v to a decimal. Integers and decimal strings are
+// converted exactly while other values are converted via their double value.
+func toDecimal(v interface{}, f float64) interface{} {
+	var repr string
+	switch val := v.(type) {
+	case bson.Decimal128:
+		return val
+	case string:
+		repr = val
+	default:
+		if k, _ := numberKind(v); isNumber(v) && k <= kindLong {
+			repr = strconv.FormatInt(asInt64(v), 10)
+		}
+	}
+
+	if repr != "" {
+		if d, err := bson.ParseDecimal128(repr); err == nil {
+			return d
+		}
+	}
+	return makeFloat(kindDecimal, f)
+}
+
+func toString(v interface{}) (interface{}, error) {
+	switch val := v.(type) {
+	case bool:
+		return strconv.FormatBool(val), nil
+	case bson.ObjectId:
+		return val.Hex(), nil
+	case string:
+		return val, nil
+	case time.Time:
+		return formatValue(val), nil
+	}
+
+	if isNumber(v) {
+		return formatNumber(v), nil
+	}
+	return nil, errUnsupportedConversion
+}
+
+// formatNumber formats a number using the mongo shell conventions.
+func formatNumber(v interface{}) string {
+	switch n := v.(type) {
+	case float64:
+		return formatDouble(n)
+	case float32:
+		return formatDouble(float64(n))
+	case bson.Decimal128:
+		return n.String()
+	}
+	return strconv.FormatInt(asInt64(v), 10)
+}
+
+func formatDouble(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func toDate(v interface{}) (interface{}, error) {
+	switch val := v.(type) {
+	case time.Time:
+		return val, nil
+	case bson.ObjectId:
+		return val.Time().UTC(), nil
+	case bson.MongoTimestamp:
+		return time.Unix(int64(val>>32), 0).UTC(), nil
+	case string:
+		t, err := parseDate(val, time.UTC, "")
+		if err != nil {
+			return nil, conversionFailure("Error parsing date string '%s'", val)
+		}
+		return t, nil
+	case int, int32:
+		return nil, errUnsupportedConversion
+	}
+
+	if isNumber(v) {
+		f := asFloat64(v)
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, conversionFailure("Conversion would overflow target type in $convert with no onError value: %s", formatValue(v))
+		}
+		return millisToTime(int64(f)), nil
+	}
+	return nil, errUnsupportedConversion
+}
+
+func toObjectID(v interface{}) (interface{}, error) {
+	switch val := v.(type) {
+	case bson.ObjectId:
+		return val, nil
+	case string:
+		if !bson.IsObjectIdHex(val) {
+			return nil, conversionFailure("Failed to parse objectId '%s' in $convert with no onError value: Invalid string length for parsing to OID, expected 24 but found %d", val, len(val))
+		}
+		return bson.ObjectIdHex(val), nil
+	}
+	return nil, errUnsupportedConversion
+}
+
+// convertExpr implements the $convert operator.
+type convertExpr struct {
+	name string
+	args namedArgs
+}
+
+func compileConvert(name string, args interface{}) (Expr, error) {
+	compiled, err := compileNamedArgs(name, args, []string{"input", "to", "onError", "onNull"}, "input", "to")
+	if err != nil {
+		return nil, err
+	}
+	return convertExpr{name: name, args: compiled}, nil
+}
+
+func (e convertExpr) Eval(vars *Vars) (interface{}, error) {
+	input, err := e.args.eval("input", vars)
+	if err != nil {
+		return nil, err
+	}
+	toVal, err := e.args.eval("to", vars)
+	if err != nil {
+		return nil, err
+	}
+
+	if IsNullish(input) {
+		if e.args["onNull"] != nil {
+			return e.args.eval("onNull", vars)
+		}
+		return nil, nil
+	}
+	if IsNullish(toVal) {
+		return nil, nil
+	}
+
+	to, err := convertTargetName(toVal)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := Convert(input, to)
+	if err != nil && e.args["onError"] != nil && hasConversionFailure(err) {
+		return e.args.eval("onError", vars)
+	}
+	return res, err
+}
+
+// convertTargetName resolves the 'to' argument of $convert which can either
+// be a type alias or a numeric BSON type identifier.
+func convertTargetName(to interface{}) (string, error) {
+	if s, isString := to.(string); isString {
+		if !convertTargets[s] {
+			if _, known := bsonutil.TypeNumberForAlias(s); !known {
+				return "", protocol.ServerErrorf(protocol.CodeBadValue, "Unknown type name: %s", s)
+			}
+			return "", protocol.ServerErrorf(protocol.CodeConversionFailure, "Unsupported conversion to %s in $convert with no onError value", s)
+		}
+		return s, nil
+	}
+
+	if !isIntegral(to) {
+		return "", protocol.ServerErrorf(protocol.CodeFailedToParse, "$convert's 'to' argument must be a string or number, but is %s", typeName(to))
+	}
+	num := int(asInt64(to))
+	for alias := range convertTargets {
+		if n, _ := bsonutil.TypeNumberForAlias(alias); n == num {
+			return alias, nil
+		}
+	}
+	return "", protocol.ServerErrorf(protocol.CodeFailedToParse, "In $convert, numeric value for 'to' does not correspond to a BSON type: %d", num)
+}
+
+func hasConversionFailure(err error) bool {
+	var serverErr protocol.ServerError
+	return xerrors.As(err, &serverErr) && serverErr.Code == protocol.CodeConversionFailure
+}
+
+func evalType(_ string, vals []interface{}) (interface{}, error) {
+	return typeName(vals[0]), nil
+}
+
+func evalIsNumber(_ string, vals []interface{}) (interface{}, error) {
+	return isNumber(vals[0]), nil
+}
@@ -0,0 +1,1059 @@
+package expr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/protocol"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func init() {
+	registerOperators(map[string]compileFn{
+		"$year":           datePartOp(func(t time.Time) int { return t.Year() }),
+		"$month":          datePartOp(func(t time.Time) int { return int(t.Month()) }),
+		"$dayOfMonth":     datePartOp(func(t time.Time) int { return t.Day() }),
+		"$hour":           datePartOp(func(t time.Time) int { return t.Hour() }),
+		"$minute":         datePartOp(func(t time.Time) int { return t.Minute() }),
+		"$second":         datePartOp(func(t time.Time) int { return t.Second() }),
+		"$millisecond":    datePartOp(func(t time.Time) int { return t.Nanosecond() / int(time.Millisecond) }),
+		"$dayOfWeek":      datePartOp(func(t time.Time) int { return int(t.Weekday()) + 1 }),
+		"$dayOfYear":      datePartOp(func(t time.Time) int { return t.YearDay() }),
+		"$week":           datePartOp(weekOfYear),
+		"$isoWeek":        datePartOp(func(t time.Time) int { _, w := t.ISOWeek(); return w }),
+		"$isoWeekYear":    datePartOp(func(t time.Time) int { y, _ := t.ISOWeek(); return y }),
+		"$isoDayOfWeek":   datePartOp(isoDayOfWeek),
+		"$dateToString":   compileDateToString,
+		"$dateFromString": compileDateFromString,
+		"$dateToParts":    compileDateToParts,
+		"$dateFromParts":  compileDateFromParts,
+		"$dateAdd":        compileDateAdd,
+		"$dateSubtract":   compileDateAdd,
+		"$dateDiff":       compileDateDiff,
+		"$dateTrunc":      compileDateTrunc,
+	})
+}
+
+// defaultDateFormat is the format used by $dateToString when no format is
+// specified.
+const defaultDateFormat = "%Y-%m-%dT%H:%M:%S.%LZ"
+
+// millisToTime converts a number of milliseconds since the Unix epoch into a
+// UTC time value.
+func millisToTime(ms int64) time.Time {
+	secs, rem := ms/1000, ms%1000
+	if rem < 0 {
+		secs, rem = secs-1, rem+1000
+	}
+	return time.Unix(secs, rem*int64(time.Millisecond)).UTC()
+}
+
+// timeToMillis returns the number of milliseconds since the Unix epoch.
+func timeToMillis(t time.Time) int64 {
+	return t.Unix()*1000 + int64(t.Nanosecond())/int64(time.Millisecond)
+}
+
+// toTime converts a date-like value (date, timestamp or ObjectId) into a
+// time value.
+func toTime(name string, v interface{}) (time.Time, error) {
+	switch val := v.(type) {
+	case time.Time:
+		return val.UTC(), nil
+	case bson.MongoTimestamp:
+		return time.Unix(int64(val>>32), 0).UTC(), nil
+	case bson.ObjectId:
+		return val.Time().UTC(), nil
+	}
+	return time.Time{}, protocol.ServerErrorf(16006, "can't convert from BSON type %s to Date", typeName(v))
+}
+
+// ParseTimezone parses a timezone specification which can either be an Olson
+// timezone identifier (e.g. "Europe/London") or a UTC offset (e.g. "+03",
+// "-0530" or "+05:30").
+func ParseTimezone(tz string) (*time.Location, error) {
+	switch tz {
+	case "", "UTC", "GMT", "Z":
+		return time.UTC, nil
+	}
+
+	if tz[0] == '+' || tz[0] == '-' {
+		digits := strings.Replace(tz[1:], ":", "", 1)
+		if (len(digits) == 2 || len(digits) == 4) && isDigits(digits) {
+			hours, _ := strconv.Atoi(digits[:2])
+			var mins int
+			if len(digits) == 4 {
+				mins, _ = strconv.Atoi(digits[2:])
+			}
+			offset := hours*3600 + mins*60
+			if tz[0] == '-' {
+				offset = -offset
+			}
+			return time.FixedZone(tz, offset), nil
+		}
+	} else if loc, err := time.LoadLocation(tz); err == nil {
+		return loc, nil
+	}
+	return nil, protocol.ServerErrorf(40485, "unrecognized time zone identifier: \"%s\"", tz)
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// evalTimezone evaluates the optional timezone argument of a date operator.
+// It returns a nil location if the timezone evaluates to null.
+func evalTimezone(name string, args namedArgs, vars *Vars) (*time.Location, error) {
+	v, err := args.eval("timezone", vars)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case IsMissing(v):
+		return time.UTC, nil
+	case IsNullish(v):
+		return nil, nil
+	}
+
+	tz, isString := v.(string)
+	if !isString {
+		return nil, protocol.ServerErrorf(40517, "timezone must evaluate to a string, found %s", typeName(v))
+	}
+	return ParseTimezone(tz)
+}
+
+func weekOfYear(t time.Time) int {
+	// Weeks start on Sunday; days before the first Sunday of the year
+	// belong to week 0.
+	return (t.YearDay() + 6 - int(t.Weekday())) / 7
+}
+
+func isoDayOfWeek(t time.Time) int {
+	if t.Weekday() == time.Sunday {
+		return 7
+	}
+	return int(t.Weekday())
+}
+
+// datePartExpr implements the operators that extract a component from a date
+// (e.g. $year).
+type datePartExpr struct {
+	name string
+	args namedArgs
+	fn   func(time.Time) int
+}
+
+// datePartOp returns a compiler for an operator that extracts a component of
+// a date. The operators accept either a date expression or a document with a
+// date expression and an optional timezone.
+func datePartOp(fn func(time.Time) int) compileFn {
+	return func(name string, args interface{}) (Expr, error) {
+		if bsonutil.IsArray(args) {
+			arr := bsonutil.ToArray(args)
+			if len(arr) != 1 {
+				return nil, protocol.ServerErrorf(40536, "%s accepts exactly one argument if given an array, but was given %d", name, len(arr))
+			}
+			args = arr[0]
+		}
+
+		if _, hasDate := bsonutil.Get(args, "date"); hasDate && bsonutil.IsDocument(args) {
+			compiled, err := compileNamedArgs(name, args, []string{"date", "timezone"}, "date")
+			if err != nil {
+				return nil, err
+			}
+			return datePartExpr{name: name, args: compiled, fn: fn}, nil
+		}
+
+		e, err := Compile(args)
+		if err != nil {
+			return nil, err
+		}
+		return datePartExpr{name: name, args: namedArgs{"date": e}, fn: fn}, nil
+	}
+}
+
+func (e datePartExpr) Eval(vars *Vars) (interface{}, error) {
+	v, err := e.args.eval("date", vars)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := evalTimezone(e.name, e.args, vars)
+	if err != nil {
+		return nil, err
+	} else if IsNullish(v) || loc == nil {
+		return nil, nil
+	}
+
+	t, err := toTime(e.name, v)
+	if err != nil {
+		return nil, err
+	}
+	return e.fn(t.In(loc)), nil
+}
+
+// dateToStringExpr implements the $dateToString operator.
+type dateToStringExpr struct {
+	name string
+	args namedArgs
+}
+
+func compileDateToString(name string, args interface{}) (Expr, error) {
+	compiled, err := compileNamedArgs(name, args, []string{"date", "format", "timezone", "onNull"}, "date")
+	if err != nil {
+		return nil, err
+	}
+	return dateToStringExpr{name: name, args: compiled}, nil
+}
+
+func (e dateToStringExpr) Eval(vars *Vars) (interface{}, error) {
+	format := defaultDateFormat
+	if e.args["format"] != nil {
+		v, err := e.args.eval("format", vars)
+		if err != nil {
+			return nil, err
+		} else if IsNullish(v) {
+			return nil, nil
+		}
+
+		var isString bool
+		if format, isString = v.(string); !isString {
+			return nil, protocol.ServerErrorf(18533, "%s requires that 'format' be a string, found: %s with value %s", e.name, typeName(v), formatValue(v))
+		}
+	}
+
+	loc, err := evalTimezone(e.name, e.args, vars)
+	if err != nil {
+		return nil, err
+	} else if loc == nil {
+		return nil, nil
+	}
+
+	v, err := e.args.eval("date", vars)
+	if err != nil {
+		return nil, err
+	} else if IsNullish(v) {
+		if e.args["onNull"] != nil {
+			return e.args.eval("onNull", vars)
+		}
+		return nil, nil
+	}
+
+	t, err := toTime(e.name, v)
+	if err != nil {
+		return nil, err
+	}
+	return FormatDate(t.In(loc), format)
+}
+
+// FormatDate formats a date using the format specifiers supported by the
+// $dateToString operator.
+func FormatDate(t time.Time, format string) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			sb.WriteByte(format[i])
+			continue
+		}
+
+		if i == len(format)-1 {
+			return "", protocol.ServerErrorf(18535, "Unmatched '%%' at end of format string")
+		}
+		i++
+
+		_, offset := t.Zone()
+		switch format[i] {
+		case 'd':
+			fmt.Fprintf(&sb, "%02d", t.Day())
+		case 'G':
+			y, _ := t.ISOWeek()
+			fmt.Fprintf(&sb, "%04d", y)
+		case 'H':
+			fmt.Fprintf(&sb, "%02d", t.Hour())
+		case 'j':
+			fmt.Fprintf(&sb, "%03d", t.YearDay())
+		case 'L':
+			fmt.Fprintf(&sb, "%03d", t.Nanosecond()/int(time.Millisecond))
+		case 'm':
+			fmt.Fprintf(&sb, "%02d", int(t.Month()))
+		case 'M':
+			fmt.Fprintf(&sb, "%02d", t.Minute())
+		case 'S':
+			fmt.Fprintf(&sb, "%02d", t.Second())
+		case 'w':
+			fmt.Fprintf(&sb, "%d", int(t.Weekday())+1)
+		case 'u':
+			fmt.Fprintf(&sb, "%d", isoDayOfWeek(t))
+		case 'U':
+			fmt.Fprintf(&sb, "%02d", weekOfYear(t))
+		case 'V':
+			_, w := t.ISOWeek()
+			fmt.Fprintf(&sb, "%02d", w)
+		case 'Y':
+			fmt.Fprintf(&sb, "%04d", t.Year())
+		case 'z':
+			sign := '+'
+			if offset < 0 {
+				sign, offset = '-', -offset
+			}
+			fmt.Fprintf(&sb, "%c%02d%02d", sign, offset/3600, (offset%3600)/60)
+		case 'Z':
+			fmt.Fprintf(&sb, "%+d", offset/60)
+		case 'b':
+			sb.WriteString(t.Month().String()[:3])
+		case 'B':
+			sb.WriteString(t.Month().String())
+		case '%':
+			sb.WriteByte('%')
+		default:
+			return "", protocol.ServerErrorf(18536, "Invalid format character '%%%c' in format string", format[i])
+		}
+	}
+	return sb.String(), nil
+}
+
+// dateFromStringExpr implements the $dateFromString operator.
+type dateFromStringExpr struct {
+	name string
+	args namedArgs
+}
+
+func compileDateFromString(name string, args interface{}) (Expr, error) {
+	compiled, err := compileNamedArgs(name, args, []string{"dateString", "format", "timezone", "onError", "onNull"}, "dateString")
+	if err != nil {
+		return nil, err
+	}
+	return dateFromStringExpr{name: name, args: compiled}, nil
+}
+
+func (e dateFromStringExpr) Eval(vars *Vars) (interface{}, error) {
+	var format string
+	if e.args["format"] != nil {
+		v, err := e.args.eval("format", vars)
+		if err != nil {
+			return nil, err
+		} else if IsNullish(v) {
+			return nil, nil
+		}
+
+		var isString bool
+		if format, isString = v.(string); !isString {
+			return nil, protocol.ServerErrorf(40684, "%s requires that 'format' be a string, found: %s with value %s", e.name, typeName(v), formatValue(v))
+		}
+	}
+
+	loc, err := evalTimezone(e.name, e.args, vars)
+	if err != nil {
+		return nil, err
+	} else if loc == nil {
+		return nil, nil
+	}
+
+	v, err := e.args.eval("dateString", vars)
+	if err != nil {
+		return nil, err
+	} else if IsNullish(v) {
+		if e.args["onNull"] != nil {
+			return e.args.eval("onNull", vars)
+		}
+		return nil, nil
+	}
+
+	s, isString := v.(string)
+	if !isString {
+		err = protocol.ServerErrorf(protocol.CodeConversionFailure, "%s requires that 'dateString' be a string, found: %s with value %s", e.name, typeName(v), formatValue(v))
+	} else {
+		var t time.Time
+		if t, err = parseDate(s, loc, format); err == nil {
+			return t, nil
+		}
+		err = protocol.ServerErrorf(protocol.CodeConversionFailure, "Error parsing date string '%s'; %v", s, err)
+	}
+
+	if e.args["onError"] != nil {
+		return e.args.eval("onError", vars)
+	}
+	return nil, err
+}
+
+// isoDateLayouts lists the layouts accepted when parsing date strings without
+// an explicit format.
+var isoDateLayouts = []string{
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05.999999999Z0700",
+	"2006-01-02T15:04:05.999999999Z07",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999Z0700",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04",
+	"2006-01-02",
+	"2006/01/02 15:04:05",
+	"2006/01/02",
+	"January 2, 2006",
+	"Jan 2, 2006",
+	"Jan 2 2006",
+}
+
+// parseDate parses a date string. If format is empty, the string is parsed
+// using a set of common ISO-8601 layouts. Dates without an explicit UTC offset
+// are interpreted in the provided location.
+func parseDate(s string, loc *time.Location, format string) (time.Time, error) {
+	if format != "" {
+		return parseDateWithFormat(s, loc, format)
+	}
+
+	for _, layout := range isoDateLayouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unable to parse date")
+}
+
+// parseDateWithFormat parses a date string using the format specifiers
+// supported by $dateFromString.
+func parseDateWithFormat(s string, loc *time.Location, format string) (time.Time, error) {
+	var (
+		year, month, day     = 1970, 1, 1
+		hour, minute, second int
+		millis               int
+		isoYear, isoWeek     int
+		isoDay               = -1
+		offset               *int
+		pos                  int
+	)
+
+	readNum := func(maxDigits int) (int, error) {
+		start := pos
+		if pos < len(s) && (s[pos] == '-' || s[pos] == '+') && maxDigits == 4 {
+			pos++
+		}
+		for pos < len(s) && pos-start < maxDigits && s[pos] >= '0' && s[pos] <= '9' {
+			pos++
+		}
+		if start == pos {
+			return 0, fmt.Errorf("expected a number at position %d", start)
+		}
+		return strconv.Atoi(s[start:pos])
+	}
+
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			if pos >= len(s) || s[pos] != format[i] {
+				return time.Time{}, fmt.Errorf("format literal not found")
+			}
+			pos++
+			continue
+		}
+
+		if i == len(format)-1 {
+			return time.Time{}, protocol.ServerErrorf(18535, "Unmatched '%%' at end of format string")
+		}
+		i++
+
+		var err error
+		switch format[i] {
+		case 'Y':
+			year, err = readNum(4)
+		case 'G':
+			isoYear, err = readNum(4)
+		case 'm':
+			month, err = readNum(2)
+		case 'd':
+			day, err = readNum(2)
+		case 'j':
+			var yday int
+			if yday, err = readNum(3); err == nil {
+				month, day = 1, yday
+			}
+		case 'H':
+			hour, err = readNum(2)
+		case 'M':
+			minute, err = readNum(2)
+		case 'S':
+			second, err = readNum(2)
+		case 'L':
+			millis, err = readNum(3)
+		case 'V':
+			isoWeek, err = readNum(2)
+		case 'u':
+			isoDay, err = readNum(1)
+		case 'z', 'Z':
+			rest := s[pos:]
+			end := 0
+			for end < len(rest) && (rest[end] == '+' || rest[end] == '-' || rest[end] == ':' || rest[end] >= '0' && rest[end] <= '9') {
+				end++
+			}
+			tz := rest[:end]
+			pos += end
+			if format[i] == 'Z' {
+				var mins int
+				if mins, err = strconv.Atoi(tz); err == nil {
+					off := mins * 60
+					offset = &off
+				}
+				break
+			}
+			var tzLoc *time.Location
+			if tzLoc, err = ParseTimezone(tz); err == nil {
+				_, off := time.Date(2000, 1, 1, 0, 0, 0, 0, tzLoc).Zone()
+				offset = &off
+			}
+		case '%':
+			if pos >= len(s) || s[pos] != '%' {
+				return time.Time{}, fmt.Errorf("format literal not found")
+			}
+			pos++
+		default:
+			return time.Time{}, protocol.ServerErrorf(18536, "Invalid format character '%%%c' in format string", format[i])
+		}
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	if pos != len(s) {
+		return time.Time{}, fmt.Errorf("trailing data")
+	}
+
+	if offset != nil {
+		loc = time.FixedZone("", *offset)
+	}
+	if isoYear != 0 {
+		if isoDay < 0 {
+			isoDay = 1
+		}
+		t := isoWeekDate(isoYear, isoWeek, isoDay, loc)
+		return t.Add(time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute + time.Duration(second)*time.Second + time.Duration(millis)*time.Millisecond).UTC(), nil
+	}
+	return time.Date(year, time.Month(month), day, hour, minute, second, millis*int(time.Millisecond), loc).UTC(), nil
+}
+
+// isoWeekDate returns the start of the day specified using the ISO-8601 week
+// date notation.
+func isoWeekDate(isoYear, isoWeek, isoDay int, loc *time.Location) time.Time {
+	// January 4th is always in the first ISO week of the year.
+	jan4 := time.Date(isoYear, time.January, 4, 0, 0, 0, 0, loc)
+	week1Monday := jan4.AddDate(0, 0, 1-isoDayOfWeek(jan4))
+	return week1Monday.AddDate(0, 0, (isoWeek-1)*7+isoDay-1)
+}
+
+// dateToPartsExpr implements the $dateToParts operator.
+type dateToPartsExpr struct {
+	name string
+	args namedArgs
+}
+
+func compileDateToParts(name string, args interface{}) (Expr, error) {
+	compiled, err := compileNamedArgs(name, args, []string{"date", "timezone", "iso8601"}, "date")
+	if err != nil {
+		return nil, err
+	}
+	return dateToPartsExpr{name: name, args: compiled}, nil
+}
+
+func (e dateToPartsExpr) Eval(vars *Vars) (interface{}, error) {
+	v, err := e.args.eval("date", vars)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := evalTimezone(e.name, e.args, vars)
+	if err != nil {
+		return nil, err
+	}
+	isoVal, err := e.args.eval("iso8601", vars)
+	if err != nil {
+		return nil, err
+	}
+
+	if IsNullish(v) || loc == nil {
+		return nil, nil
+	}
+
+	var iso bool
+	if !IsMissing(isoVal) {
+		b, isBool := isoVal.(bool)
+		if !isBool {
+			return nil, protocol.ServerErrorf(40521, "iso8601 must evaluate to a bool, found %s", typeName(isoVal))
+		}
+		iso = b
+	}
+
+	t, err := toTime(e.name, v)
+	if err != nil {
+		return nil, err
+	}
+	t = t.In(loc)
+
+	var parts bson.D
+	if iso {
+		y, w := t.ISOWeek()
+		parts = bson.D{
+			{Name: "isoWeekYear", Value: y},
+			{Name: "isoWeek", Value: w},
+			{Name: "isoDayOfWeek", Value: isoDayOfWeek(t)},
+		}
+	} else {
+		parts = bson.D{
+			{Name: "year", Value: t.Year()},
+			{Name: "month", Value: int(t.Month())},
+			{Name: "day", Value: t.Day()},
+		}
+	}
+	return append(parts,
+		bson.DocElem{Name: "hour", Value: t.Hour()},
+		bson.DocElem{Name: "minute", Value: t.Minute()},
+		bson.DocElem{Name: "second", Value: t.Second()},
+		bson.DocElem{Name: "millisecond", Value: t.Nanosecond() / int(time.Millisecond)},
+	), nil
+}
+
+// dateFromPartsExpr implements the $dateFromParts operator.
+type dateFromPartsExpr struct {
+	name string
+	args namedArgs
+	iso  bool
+}
+
+func compileDateFromParts(name string, args interface{}) (Expr, error) {
+	compiled, err := compileNamedArgs(name, args, []string{
+		"year", "month", "day", "isoWeekYear", "isoWeek", "isoDayOfWeek",
+		"hour", "minute", "second", "millisecond", "timezone",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	hasNatural := compiled["year"] != nil || compiled["month"] != nil || compiled["day"] != nil
+	hasISO := compiled["isoWeekYear"] != nil || compiled["isoWeek"] != nil || compiled["isoDayOfWeek"] != nil
+	switch {
+	case hasNatural && hasISO:
+		return nil, protocol.ServerErrorf(40489, "%s does not allow mixing natural dates with ISO dates", name)
+	case compiled["year"] == nil && compiled["isoWeekYear"] == nil:
+		return nil, protocol.ServerErrorf(40516, "%s requires either 'year' or 'isoWeekYear' to be present", name)
+	}
+	return dateFromPartsExpr{name: name, args: compiled, iso: hasISO}, nil
+}
+
+func (e dateFromPartsExpr) Eval(vars *Vars) (interface{}, error) {
+	type part struct {
+		name     string
+		def      int64
+		min, max int64
+	}
+	parts := []part{
+		{"year", 1970, 1, 9999},
+		{"month", 1, -32768, 32767},
+		{"day", 1, -32768, 32767},
+		{"hour", 0, -32768, 32767},
+		{"minute", 0, -32768, 32767},
+		{"second", 0, -32768, 32767},
+		{"millisecond", 0, -32768, 32767},
+	}
+	if e.iso {
+		parts[0] = part{"isoWeekYear", 1970, 1, 9999}
+		parts[1] = part{"isoWeek", 1, -32768, 32767}
+		parts[2] = part{"isoDayOfWeek", 1, -32768, 32767}
+	}
+
+	vals := make([]int64, len(parts))
+	isNull := false
+	for i, p := range parts {
+		v, err := e.args.eval(p.name, vars)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case IsMissing(v):
+			vals[i] = p.def
+			continue
+		case IsNullish(v):
+			isNull = true
+			continue
+		case !isIntegral(v):
+			return nil, protocol.ServerErrorf(40515, "'%s' must evaluate to an integer, found %s with value %s", p.name, typeName(v), formatValue(v))
+		}
+
+		vals[i] = asInt64(v)
+		if vals[i] < p.min || vals[i] > p.max {
+			if i == 0 {
+				return nil, protocol.ServerErrorf(40523, "'%s' must evaluate to an integer in the range %d to %d, found %d", p.name, p.min, p.max, vals[i])
+			}
+			return nil, protocol.ServerErrorf(31034, "'%s' must evaluate to a value in the range [%d, %d]; value %d is not in range", p.name, p.min, p.max, vals[i])
+		}
+	}
+
+	loc, err := evalTimezone(e.name, e.args, vars)
+	if err != nil {
+		return nil, err
+	} else if isNull || loc == nil {
+		return nil, nil
+	}
+
+	timeOfDay := time.Duration(vals[3])*time.Hour +
+		time.Duration(vals[4])*time.Minute +
+		time.Duration(vals[5])*time.Second +
+		time.Duration(vals[6])*time.Millisecond
+
+	if e.iso {
+		return isoWeekDate(int(vals[0]), int(vals[1]), int(vals[2]), loc).Add(timeOfDay).UTC(), nil
+	}
+	return time.Date(int(vals[0]), time.Month(vals[1]), int(vals[2]), 0, 0, 0, 0, loc).Add(timeOfDay).UTC(), nil
+}
+
+// dateUnits lists the time units supported by the date arithmetic
+// operators.
+var dateUnits = map[string]bool{
+	"year":        true,
+	"quarter":     true,
+	"month":       true,
+	"week":        true,
+	"day":         true,
+	"hour":        true,
+	"minute":      true,
+	"second":      true,
+	"millisecond": true,
+}
+
+// fixedUnitDurations maps the time units with a fixed duration to their
+// length.
+var fixedUnitDurations = map[string]time.Duration{
+	"hour":        time.Hour,
+	"minute":      time.Minute,
+	"second":      time.Second,
+	"millisecond": time.Millisecond,
+}
+
+func evalUnit(name, param string, args namedArgs, vars *Vars) (string, bool, error) {
+	v, err := args.eval(param, vars)
+	if err != nil {
+		return "", false, err
+	} else if IsNullish(v) {
+		return "", false, nil
+	}
+
+	unit, isString := v.(string)
+	if !isString {
+		return "", false, protocol.ServerErrorf(5439013, "%s requires '%s' to be a string, but got %s", name, param, typeName(v))
+	} else if !dateUnits[unit] {
+		return "", false, protocol.ServerErrorf(protocol.CodeFailedToParse, "%s parameter '%s' value parsing failed :: caused by :: unknown time unit value: %s", name, param, unit)
+	}
+	return unit, true, nil
+}
+
+// IsDateUnit returns true if unit is one of the time units (e.g. "day")
+// accepted by the date expressions.
+func IsDateUnit(unit string) bool {
+	return dateUnits[unit]
+}
+
+// AddDate adds amount units to t using UTC for calendar arithmetic.
+func AddDate(t time.Time, unit string, amount int64) time.Time {
+	return addDateUnits(t, unit, amount, time.UTC)
+}
+
+// addDateUnits adds amount units to t in the specified location. When adding
+// months, quarters or years, the day of month is clamped to the last day of
+// the resulting month.
+func addDateUnits(t time.Time, unit string, amount int64, loc *time.Location) time.Time {
+	if d, fixed := fixedUnitDurations[unit]; fixed {
+		return t.Add(time.Duration(amount) * d)
+	}
+
+	local := t.In(loc)
+	switch unit {
+	case "day":
+		return local.AddDate(0, 0, int(amount)).UTC()
+	case "week":
+		return local.AddDate(0, 0, 7*int(amount)).UTC()
+	case "quarter":
+		amount *= 3
+	case "year":
+		amount *= 12
+	}
+
+	months := int64(local.Month()-1) + amount
+	year := int64(local.Year()) + floorDiv(months, 12)
+	month := time.Month(months-floorDiv(months, 12)*12) + 1
+
+	day := local.Day()
+	if last := daysIn(int(year), month, loc); day > last {
+		day = last
+	}
+	return time.Date(int(year), month, day, local.Hour(), local.Minute(), local.Second(), local.Nanosecond(), loc).UTC()
+}
+
+func daysIn(year int, month time.Month, loc *time.Location) int {
+	return time.Date(year, month+1, 0, 0, 0, 0, 0, loc).Day()
+}
+
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if (a%b != 0) && ((a < 0) != (b < 0)) {
+		q--
+	}
+	return q
+}
+
+// dateAddExpr implements the $dateAdd and $dateSubtract operators.
+type dateAddExpr struct {
+	name     string
+	args     namedArgs
+	subtract bool
+}
+
+func compileDateAdd(name string, args interface{}) (Expr, error) {
+	compiled, err := compileNamedArgs(name, args, []string{"startDate", "unit", "amount", "timezone"}, "startDate", "unit", "amount")
+	if err != nil {
+		return nil, err
+	}
+	return dateAddExpr{name: name, args: compiled, subtract: name == "$dateSubtract"}, nil
+}
+
+func (e dateAddExpr) Eval(vars *Vars) (interface{}, error) {
+	start, err := e.args.eval("startDate", vars)
+	if err != nil {
+		return nil, err
+	}
+	unit, hasUnit, err := evalUnit(e.name, "unit", e.args, vars)
+	if err != nil {
+		return nil, err
+	}
+	amount, err := e.args.eval("amount", vars)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := evalTimezone(e.name, e.args, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	if IsNullish(start) || !hasUnit || IsNullish(amount) || loc == nil {
+		return nil, nil
+	}
+
+	t, err := toTime(e.name, start)
+	if err != nil {
+		return nil, protocol.ServerErrorf(5166403, "%s requires startDate to be convertible to a date", e.name)
+	} else if !isIntegral(amount) {
+		return nil, protocol.ServerErrorf(5166405, "%s expects integer amount of time units", e.name)
+	}
+
+	n := asInt64(amount)
+	if e.subtract {
+		n = -n
+	}
+	return addDateUnits(t, unit, n, loc), nil
+}
+
+// dateDiffExpr implements the $dateDiff operator.
+type dateDiffExpr struct {
+	name string
+	args namedArgs
+}
+
+func compileDateDiff(name string, args interface{}) (Expr, error) {
+	compiled, err := compileNamedArgs(name, args, []string{"startDate", "endDate", "unit", "timezone", "startOfWeek"}, "startDate", "endDate", "unit")
+	if err != nil {
+		return nil, err
+	}
+	return dateDiffExpr{name: name, args: compiled}, nil
+}
+
+func (e dateDiffExpr) Eval(vars *Vars) (interface{}, error) {
+	var dates [2]time.Time
+	isNull := false
+	for i, param := range []string{"startDate", "endDate"} {
+		v, err := e.args.eval(param, vars)
+		if err != nil {
+			return nil, err
+		} else if IsNullish(v) {
+			isNull = true
+			continue
+		}
+
+		if dates[i], err = toTime(e.name, v); err != nil {
+			return nil, protocol.ServerErrorf(5166307, "%s requires '%s' to be a date, but got %s", e.name, param, typeName(v))
+		}
+	}
+
+	unit, hasUnit, err := evalUnit(e.name, "unit", e.args, vars)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := evalTimezone(e.name, e.args, vars)
+	if err != nil {
+		return nil, err
+	}
+	startOfWeek, err := evalStartOfWeek(e.name, e.args, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	if isNull || !hasUnit || loc == nil {
+		return nil, nil
+	}
+	return dateDiff(dates[0], dates[1], unit, loc, startOfWeek), nil
+}
+
+// evalStartOfWeek evaluates the optional startOfWeek argument of $dateDiff and
+// $dateTrunc. The default is Sunday.
+func evalStartOfWeek(name string, args namedArgs, vars *Vars) (time.Weekday, error) {
+	v, err := args.eval("startOfWeek", vars)
+	if err != nil {
+		return 0, err
+	} else if IsNullish(v) {
+		return time.Sunday, nil
+	}
+
+	s, isString := v.(string)
+	if isString {
+		for day := time.Sunday; day <= time.Saturday; day++ {
+			if full := strings.ToLower(day.String()); strings.ToLower(s) == full || strings.ToLower(s) == full[:3] {
+				return day, nil
+			}
+		}
+	}
+	return 0, protocol.ServerErrorf(5439015, "%s parameter 'startOfWeek' value cannot be recognized as a day of a week: %s", name, formatValue(v))
+}
+
+// dateDiff returns the number of unit boundaries crossed between start and
+// end in the specified location.
+func dateDiff(start, end time.Time, unit string, loc *time.Location, startOfWeek time.Weekday) int64 {
+	if d, fixed := fixedUnitDurations[unit]; fixed {
+		_, startOff := start.In(loc).Zone()
+		_, endOff := end.In(loc).Zone()
+		s := timeToMillis(start) + int64(startOff)*1000
+		e := timeToMillis(end) + int64(endOff)*1000
+		unitMillis := int64(d / time.Millisecond)
+		return floorDiv(e, unitMillis) - floorDiv(s, unitMillis)
+	}
+
+	s, e := start.In(loc), end.In(loc)
+	switch unit {
+	case "year":
+		return int64(e.Year() - s.Year())
+	case "quarter":
+		return int64(e.Year()*4+(int(e.Month())-1)/3) - int64(s.Year()*4+(int(s.Month())-1)/3)
+	case "month":
+		return int64(e.Year()*12+int(e.Month())) - int64(s.Year()*12+int(s.Month()))
+	case "week":
+		return floorDiv(localDays(e)-weekdayOffset(e, startOfWeek), 7) - floorDiv(localDays(s)-weekdayOffset(s, startOfWeek), 7)
+	}
+	return localDays(e) - localDays(s)
+}
+
+// localDays returns the number of days between the Unix epoch and the local
+// date of t.
+func localDays(t time.Time) int64 {
+	return floorDiv(time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).Unix(), 86400)
+}
+
+// weekdayOffset returns the number of days between t and the most recent
+// startOfWeek day (inclusive).
+func weekdayOffset(t time.Time, startOfWeek time.Weekday) int64 {
+	return int64((int(t.Weekday()) - int(startOfWeek) + 7) % 7)
+}
+
+// dateTruncExpr implements the $dateTrunc operator.
+type dateTruncExpr struct {
+	name string
+	args namedArgs
+}
+
+func compileDateTrunc(name string, args interface{}) (Expr, error) {
+	compiled, err := compileNamedArgs(name, args, []string{"date", "unit", "binSize", "timezone", "startOfWeek"}, "date", "unit")
+	if err != nil {
+		return nil, err
+	}
+	return dateTruncExpr{name: name, args: compiled}, nil
+}
+
+func (e dateTruncExpr) Eval(vars *Vars) (interface{}, error) {
+	v, err := e.args.eval("date", vars)
+	if err != nil {
+		return nil, err
+	}
+	unit, hasUnit, err := evalUnit(e.name, "unit", e.args, vars)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := evalTimezone(e.name, e.args, vars)
+	if err != nil {
+		return nil, err
+	}
+	startOfWeek, err := evalStartOfWeek(e.name, e.args, vars)
+	if err != nil {
+		return nil, err
+	}
+	binSizeVal, err := e.args.eval("binSize", vars)
+	if err != nil {
+		return nil, err
+	}
+
+	binSize := int64(1)
+	if !IsMissing(binSizeVal) {
+		if IsNullish(binSizeVal) {
+			return nil, nil
+		} else if !isIntegral(binSizeVal) || asInt64(binSizeVal) <= 0 {
+			return nil, protocol.ServerErrorf(5439017, "%s requires 'binSize' to be a 64-bit integer greater than 0, but got value '%s' of type %s", e.name, formatValue(binSizeVal), typeName(binSizeVal))
+		}
+		binSize = asInt64(binSizeVal)
+	}
+
+	if IsNullish(v) || !hasUnit || loc == nil {
+		return nil, nil
+	}
+
+	t, err := toTime(e.name, v)
+	if err != nil {
+		return nil, protocol.ServerErrorf(5439012, "%s requires 'date' to be a date, but got %s", e.name, typeName(v))
+	}
+	return truncateDate(t, unit, binSize, loc, startOfWeek), nil
+}
+
+// truncateDate truncates t to the start of the binSize-unit bin it belongs
+// to. Bins are aligned to the reference date 2000-01-01T00:00:00 in the
+// specified location (or the first startOfWeek day following it for weeks).
+func truncateDate(t time.Time, unit string, binSize int64, loc *time.Location, startOfWeek time.Weekday) time.Time {
+	ref := time.Date(2000, time.January, 1, 0, 0, 0, 0, loc)
+	if unit == "week" {
+		ref = ref.AddDate(0, 0, (int(startOfWeek)-int(ref.Weekday())+7)%7)
+	}
+
+	switch unit {
+	case "year", "quarter", "month":
+		months := map[string]int64{"year": 12, "quarter": 3, "month": 1}[unit] * binSize
+		local := t.In(loc)
+		elapsed := int64(local.Year()-2000)*12 + int64(local.Month()-1)
+		bin := floorDiv(elapsed, months) * months
+		return time.Date(2000+int(floorDiv(bin, 12)), time.Month(bin-floorDiv(bin, 12)*12)+1, 1, 0, 0, 0, 0, loc).UTC()
+	case "week", "day":
+		days := binSize
+		if unit == "week" {
+			days *= 7
+		}
+		local := t.In(loc)
+		elapsed := localDays(local) - localDays(ref)
+		return ref.AddDate(0, 0, int(floorDiv(elapsed, days)*days)).UTC()
+	}
+
+	// For fixed length units, bins are computed using the local time so
+	// that the bin boundaries respect the timezone offset.
+	_, offset := t.In(loc).Zone()
+	_, refOffset := ref.Zone()
+	binMillis := int64(fixedUnitDurations[unit]/time.Millisecond) * binSize
+	elapsed := timeToMillis(t) + int64(offset)*1000 - (timeToMillis(ref) + int64(refOffset)*1000)
+	truncated := floorDiv(elapsed, binMillis) * binMillis
+	return millisToTime(timeToMillis(ref) + int64(refOffset)*1000 + truncated - int64(offset)*1000)
+}
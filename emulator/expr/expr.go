@@ -0,0 +1,324 @@
+// Package expr implements a compiler and evaluator for the mongo aggregation
+// expression language. Expressions are used by aggregation pipeline stages,
+// $expr query predicates and pipeline-style updates.
+//
+// See https://docs.mongodb.com/manual/meta/aggregation-quick-reference/#expressions
+package expr
+
+import (
+	"strings"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/protocol"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type missingValue struct{}
+
+// Missing is returned by expressions that evaluate to a non-existent value
+// (e.g. a field path that refers to a missing field or the $$REMOVE
+// variable). Unlike null, missing values are omitted from documents built by
+// object expressions.
+var Missing interface{} = missingValue{}
+
+// IsMissing returns true if v is the Missing value.
+func IsMissing(v interface{}) bool {
+	_, isMissing := v.(missingValue)
+	return isMissing
+}
+
+// IsNullish returns true if v is null, undefined or missing.
+func IsNullish(v interface{}) bool {
+	return IsMissing(v) || bsonutil.IsNull(v)
+}
+
+// Expr is a compiled aggregation expression.
+type Expr interface {
+	// Eval evaluates the expression using the provided variables.
+	Eval(vars *Vars) (interface{}, error)
+}
+
+// Compile parses an aggregation expression specification.
+func Compile(spec interface{}) (Expr, error) {
+	switch v := spec.(type) {
+	case string:
+		if strings.HasPrefix(v, "$$") {
+			return compileVariable(v[2:])
+		} else if strings.HasPrefix(v, "$") {
+			return compileFieldPath(v[1:])
+		}
+		return literal{v}, nil
+	case bson.D, bson.M, map[string]interface{}, bson.RawD:
+		return compileDocument(bsonutil.Elements(v))
+	}
+
+	if bsonutil.IsArray(spec) {
+		return compileArray(bsonutil.ToArray(spec))
+	}
+	return literal{spec}, nil
+}
+
+// MustCompile is like Compile but panics if the expression cannot be
+// compiled. It is intended for expressions that are known to be valid.
+func MustCompile(spec interface{}) Expr {
+	e, err := Compile(spec)
+	if err != nil {
+		panic(err)
+	}
+	return e
+}
+
+// Eval compiles and evaluates an expression against a document.
+func Eval(spec interface{}, doc interface{}) (interface{}, error) {
+	e, err := Compile(spec)
+	if err != nil {
+		return nil, err
+	}
+	return e.Eval(NewVars(doc))
+}
+
+// Value converts the result of an expression into a value that can be stored
+// in a document. Missing values are converted to null.
+func Value(v interface{}) interface{} {
+	if IsMissing(v) {
+		return nil
+	}
+	return v
+}
+
+// literal is an expression that evaluates to a constant value.
+type literal struct {
+	value interface{}
+}
+
+func (e literal) Eval(*Vars) (interface{}, error) { return e.value, nil }
+
+// IsConstant returns true if e always evaluates to the same value regardless
+// of the input document.
+func IsConstant(e Expr) bool {
+	_, isLiteral := e.(literal)
+	return isLiteral
+}
+
+// fieldPath is an expression that resolves a dotted path against the value of
+// a variable (by default $$CURRENT).
+type fieldPath struct {
+	variable string
+	path     []string
+}
+
+func compileFieldPath(path string) (Expr, error) {
+	if path == "" {
+		return nil, protocol.ServerErrorf(16872, "'$' by itself is not a valid FieldPath")
+	}
+
+	segs := strings.Split(path, ".")
+	for _, seg := range segs {
+		if seg == "" {
+			return nil, protocol.ServerErrorf(15998, "FieldPath field names may not be empty strings.")
+		} else if strings.HasPrefix(seg, "$") {
+			return nil, protocol.ServerErrorf(16410, "FieldPath field names may not start with '$'.")
+		}
+	}
+	return fieldPath{variable: "CURRENT", path: segs}, nil
+}
+
+func compileVariable(spec string) (Expr, error) {
+	segs := strings.Split(spec, ".")
+	if err := validateVariableName(segs[0], true); err != nil {
+		return nil, err
+	}
+
+	for _, seg := range segs[1:] {
+		if seg == "" {
+			return nil, protocol.ServerErrorf(15998, "FieldPath field names may not be empty strings.")
+		}
+	}
+	return fieldPath{variable: segs[0], path: segs[1:]}, nil
+}
+
+// ValidateUserVariableName checks that name can be used as the name of a
+// user-defined variable (e.g. in the let option of a command).
+func ValidateUserVariableName(name string) error {
+	return validateVariableName(name, false)
+}
+
+// validateVariableName checks that name is a valid variable name. User-defined
+// variables must start with a lowercase letter or a non-ascii character while
+// system variables (e.g. ROOT) are uppercase and can only be referenced.
+func validateVariableName(name string, allowSystem bool) error {
+	if name == "" {
+		return protocol.ServerErrorf(16869, "empty variable names are not allowed")
+	}
+
+	if first := name[0]; first >= 'A' && first <= 'Z' {
+		if allowSystem && isSystemVariable(name) {
+			return nil
+		}
+		return protocol.ServerErrorf(16870, "'%s' starts with an invalid character for a user variable name", name)
+	} else if !(first >= 'a' && first <= 'z') && first < 0x80 {
+		return protocol.ServerErrorf(16870, "'%s' starts with an invalid character for a user variable name", name)
+	}
+
+	for _, r := range name[1:] {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r >= 0x80) {
+			return protocol.ServerErrorf(16871, "'%s' contains an invalid character for a variable name: '%c'", name, r)
+		}
+	}
+	return nil
+}
+
+func (e fieldPath) Eval(vars *Vars) (interface{}, error) {
+	v, err := vars.Get(e.variable)
+	if err != nil {
+		return nil, err
+	}
+	return traversePath(v, e.path), nil
+}
+
+// traversePath resolves a field path against a value. Arrays in the path
+// yield an array with the result of applying the remaining path to each one
+// of their embedded documents.
+func traversePath(v interface{}, path []string) interface{} {
+	if len(path) == 0 {
+		return v
+	}
+
+	if bsonutil.IsArray(v) {
+		var out = []interface{}{}
+		for _, elem := range bsonutil.ToArray(v) {
+			if !bsonutil.IsDocument(elem) && !bsonutil.IsArray(elem) {
+				continue
+			}
+			if res := traversePath(elem, path); !IsMissing(res) {
+				out = append(out, res)
+			}
+		}
+		return out
+	}
+
+	if !bsonutil.IsDocument(v) {
+		return Missing
+	}
+
+	next, found := bsonutil.Get(v, path[0])
+	if !found {
+		return Missing
+	}
+	return traversePath(next, path[1:])
+}
+
+// objectExpr is an expression that builds an embedded document.
+type objectExpr struct {
+	names []string
+	exprs []Expr
+}
+
+func compileDocument(elems []bson.DocElem) (Expr, error) {
+	if len(elems) != 0 && strings.HasPrefix(elems[0].Name, "$") {
+		if len(elems) != 1 {
+			return nil, protocol.ServerErrorf(15983, "an expression specification must contain exactly one field, the name of the expression. Found %d fields in %s", len(elems), formatSpec(bson.D(elems)))
+		}
+		return compileOperator(elems[0].Name, elems[0].Value)
+	}
+
+	obj := objectExpr{
+		names: make([]string, len(elems)),
+		exprs: make([]Expr, len(elems)),
+	}
+	for i, elem := range elems {
+		if strings.HasPrefix(elem.Name, "$") {
+			return nil, protocol.ServerErrorf(16404, "a nested object cannot have fields that start with '$': %s", elem.Name)
+		} else if strings.Contains(elem.Name, ".") {
+			return nil, protocol.ServerErrorf(16412, "FieldPath field names may not contain '.'.")
+		}
+
+		e, err := Compile(elem.Value)
+		if err != nil {
+			return nil, err
+		}
+		obj.names[i], obj.exprs[i] = elem.Name, e
+	}
+	return obj, nil
+}
+
+func (e objectExpr) Eval(vars *Vars) (interface{}, error) {
+	out := make(bson.D, 0, len(e.names))
+	for i, name := range e.names {
+		v, err := e.exprs[i].Eval(vars)
+		if err != nil {
+			return nil, err
+		} else if IsMissing(v) {
+			continue
+		}
+		out = append(out, bson.DocElem{Name: name, Value: v})
+	}
+	return out, nil
+}
+
+// arrayExpr is an expression that builds an array.
+type arrayExpr struct {
+	elems []Expr
+}
+
+func compileArray(specs []interface{}) (Expr, error) {
+	arr := arrayExpr{elems: make([]Expr, len(specs))}
+	for i, spec := range specs {
+		e, err := Compile(spec)
+		if err != nil {
+			return nil, err
+		}
+		arr.elems[i] = e
+	}
+	return arr, nil
+}
+
+func (e arrayExpr) Eval(vars *Vars) (interface{}, error) {
+	out := make([]interface{}, len(e.elems))
+	for i, elemExpr := range e.elems {
+		v, err := elemExpr.Eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = Value(v)
+	}
+	return out, nil
+}
+
+// formatSpec returns a JSON-like representation of an expression
+// specification for inclusion in error messages.
+func formatSpec(spec interface{}) string {
+	var sb strings.Builder
+	writeSpec(&sb, spec)
+	return sb.String()
+}
+
+func writeSpec(sb *strings.Builder, spec interface{}) {
+	switch {
+	case bsonutil.IsDocument(spec):
+		sb.WriteString("{")
+		for i, elem := range bsonutil.Elements(spec) {
+			if i != 0 {
+				sb.WriteString(",")
+			}
+			sb.WriteString(" " + elem.Name + ": ")
+			writeSpec(sb, elem.Value)
+		}
+		sb.WriteString(" }")
+	case bsonutil.IsArray(spec):
+		sb.WriteString("[ ")
+		for i, elem := range bsonutil.ToArray(spec) {
+			if i != 0 {
+				sb.WriteString(", ")
+			}
+			writeSpec(sb, elem)
+		}
+		sb.WriteString(" ]")
+	default:
+		if s, isString := spec.(string); isString {
+			sb.WriteString("\"" + s + "\"")
+			return
+		}
+		sb.WriteString(formatValue(spec))
+	}
+}
@@ -0,0 +1,155 @@
+package expr
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/achilleasa/mongolite/protocol"
+	"golang.org/x/xerrors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// evalSpec describes an expression together with its expected result. If
+// expErr is non-zero, the evaluation must fail with that error code.
+type evalSpec struct {
+	descr  string
+	expr   interface{}
+	exp    interface{}
+	expErr protocol.ErrorCode
+}
+
+// testDoc is the document that expressions are evaluated against.
+var testDoc = bson.D{
+	{Name: "int", Value: 7},
+	{Name: "long", Value: int64(7)},
+	{Name: "double", Value: 2.5},
+	{Name: "null", Value: nil},
+	{Name: "date", Value: time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)},
+}
+
+func runEvalSpecs(t *testing.T, specs []evalSpec) {
+	t.Helper()
+	for _, spec := range specs {
+		t.Run(spec.descr, func(t *testing.T) {
+			got, err := Eval(spec.expr, testDoc)
+			if spec.expErr != 0 {
+				var srvErr protocol.ServerError
+				if !xerrors.As(err, &srvErr) || srvErr.Code != spec.expErr {
+					t.Fatalf("expected error with code %d; got %v (result %v)", spec.expErr, err, got)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			// Decimals are compared via their string representation.
+			if d, isDecimal := got.(bson.Decimal128); isDecimal {
+				got = "decimal:" + d.String()
+			}
+			if !reflect.DeepEqual(got, spec.exp) {
+				t.Fatalf("expected %#v (%T); got %#v (%T)", spec.exp, spec.exp, got, got)
+			}
+		})
+	}
+}
+
+func TestNumericPromotion(t *testing.T) {
+	runEvalSpecs(t, []evalSpec{
+		{descr: "int + int", expr: bson.M{"$add": []interface{}{"$int", 1}}, exp: 8},
+		{descr: "int + long", expr: bson.M{"$add": []interface{}{"$int", "$long"}}, exp: int64(14)},
+		{descr: "int + double", expr: bson.M{"$add": []interface{}{"$int", "$double"}}, exp: 9.5},
+		{descr: "int overflow promotes to long", expr: bson.M{"$add": []interface{}{math.MaxInt32, 1}}, exp: int64(math.MaxInt32 + 1)},
+		{descr: "long overflow promotes to double", expr: bson.M{"$add": []interface{}{int64(math.MaxInt64), int64(1)}}, exp: float64(math.MaxInt64) + 1},
+		{descr: "int * long", expr: bson.M{"$multiply": []interface{}{"$int", "$long"}}, exp: int64(49)},
+		{descr: "long - int", expr: bson.M{"$subtract": []interface{}{"$long", 10}}, exp: int64(-3)},
+		{descr: "multiply by decimal", expr: bson.M{"$multiply": []interface{}{2, mustDecimal("1.5")}}, exp: "decimal:3"},
+		{descr: "integer division yields double", expr: bson.M{"$divide": []interface{}{"$int", 2}}, exp: 3.5},
+		{descr: "division by zero", expr: bson.M{"$divide": []interface{}{"$int", 0}}, expErr: 16608},
+		{descr: "mod keeps int", expr: bson.M{"$mod": []interface{}{"$int", 4}}, exp: 3},
+		{descr: "add non-numeric", expr: bson.M{"$add": []interface{}{"$int", "a"}}, expErr: 16554},
+	})
+}
+
+func TestRounding(t *testing.T) {
+	runEvalSpecs(t, []evalSpec{
+		{descr: "half to even (down)", expr: bson.M{"$round": []interface{}{2.5, 0}}, exp: 2.0},
+		{descr: "half to even (up)", expr: bson.M{"$round": []interface{}{3.5}}, exp: 4.0},
+		{descr: "negative half to even", expr: bson.M{"$round": []interface{}{-2.5}}, exp: -2.0},
+		{descr: "half to even at decimal place", expr: bson.M{"$round": []interface{}{1.25, 1}}, exp: 1.2},
+		{descr: "integer with positive place", expr: bson.M{"$round": []interface{}{"$int", 2}}, exp: 7},
+		{descr: "integer with negative place", expr: bson.M{"$round": []interface{}{25, -1}}, exp: 20},
+		{descr: "long with negative place", expr: bson.M{"$round": []interface{}{int64(12351), -2}}, exp: int64(12400)},
+		{descr: "trunc", expr: bson.M{"$trunc": []interface{}{1.99, 1}}, exp: 1.9},
+		{descr: "null input", expr: bson.M{"$round": []interface{}{"$null", 1}}, exp: nil},
+		{descr: "non-integral place", expr: bson.M{"$round": []interface{}{1.5, 0.5}}, expErr: 51081},
+		{descr: "place out of range", expr: bson.M{"$round": []interface{}{1.5, 101}}, expErr: 51083},
+		{descr: "non-numeric input", expr: bson.M{"$round": []interface{}{"a"}}, expErr: 51080},
+	})
+}
+
+func TestDateArithmetic(t *testing.T) {
+	jan31 := time.Date(2021, 1, 31, 10, 0, 0, 0, time.UTC)
+	runEvalSpecs(t, []evalSpec{
+		{descr: "add milliseconds to date", expr: bson.M{"$add": []interface{}{"$date", 1500}}, exp: time.Date(2021, 6, 1, 12, 0, 1, 500e6, time.UTC)},
+		{descr: "subtract dates", expr: bson.M{"$subtract": []interface{}{"$date", jan31}}, exp: int64(121*24*time.Hour/time.Millisecond + 2*time.Hour/time.Millisecond)},
+		{descr: "subtract milliseconds from date", expr: bson.M{"$subtract": []interface{}{"$date", int64(60000)}}, exp: time.Date(2021, 6, 1, 11, 59, 0, 0, time.UTC)},
+		{descr: "add month clamps day", expr: bson.M{"$dateAdd": bson.M{"startDate": jan31, "unit": "month", "amount": 1}}, exp: time.Date(2021, 2, 28, 10, 0, 0, 0, time.UTC)},
+		{descr: "subtract year", expr: bson.M{"$dateSubtract": bson.M{"startDate": "$date", "unit": "year", "amount": 1}}, exp: time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)},
+		{descr: "diff counts boundaries", expr: bson.M{"$dateDiff": bson.M{"startDate": time.Date(2021, 12, 31, 23, 0, 0, 0, time.UTC), "endDate": time.Date(2022, 1, 1, 1, 0, 0, 0, time.UTC), "unit": "year"}}, exp: int64(1)},
+		{descr: "diff in days honors timezone", expr: bson.M{"$dateDiff": bson.M{"startDate": time.Date(2021, 6, 1, 3, 0, 0, 0, time.UTC), "endDate": time.Date(2021, 6, 1, 5, 0, 0, 0, time.UTC), "unit": "day", "timezone": "America/New_York"}}, exp: int64(1)},
+		{descr: "hour in Olson timezone", expr: bson.M{"$hour": bson.M{"date": "$date", "timezone": "America/New_York"}}, exp: 8},
+		{descr: "minute in UTC offset", expr: bson.M{"$minute": bson.M{"date": "$date", "timezone": "+0530"}}, exp: 30},
+		{descr: "format in timezone", expr: bson.M{"$dateToString": bson.M{"date": "$date", "format": "%Y-%m-%d %H:%M", "timezone": "Asia/Tokyo"}}, exp: "2021-06-01 21:00"},
+		{descr: "parse with timezone", expr: bson.M{"$dateFromString": bson.M{"dateString": "2021-06-01T12:00:00", "timezone": "+02:00"}}, exp: time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)},
+		{descr: "unknown timezone", expr: bson.M{"$hour": bson.M{"date": "$date", "timezone": "Mars/Olympus"}}, expErr: 40485},
+		{descr: "date part of null", expr: bson.M{"$year": "$null"}, exp: nil},
+	})
+}
+
+func TestConvert(t *testing.T) {
+	runEvalSpecs(t, []evalSpec{
+		{descr: "string to double", expr: bson.M{"$convert": bson.M{"input": "1.5", "to": "double"}}, exp: 1.5},
+		{descr: "double to int truncates", expr: bson.M{"$toInt": 2.9}, exp: 2},
+		{descr: "bool to long", expr: bson.M{"$toLong": true}, exp: int64(1)},
+		{descr: "non-empty string to bool", expr: bson.M{"$toBool": "false"}, exp: true},
+		{descr: "numeric target type", expr: bson.M{"$convert": bson.M{"input": 1, "to": 2}}, exp: "1"},
+		{descr: "unparsable string", expr: bson.M{"$convert": bson.M{"input": "abc", "to": "int"}}, expErr: protocol.CodeConversionFailure},
+		{descr: "int overflow", expr: bson.M{"$toInt": 1e10}, expErr: protocol.CodeConversionFailure},
+		{descr: "invalid object id", expr: bson.M{"$toObjectId": "xyz"}, expErr: protocol.CodeConversionFailure},
+		{descr: "unsupported conversion", expr: bson.M{"$convert": bson.M{"input": "$date", "to": "int"}}, expErr: protocol.CodeConversionFailure},
+		{descr: "onError", expr: bson.M{"$convert": bson.M{"input": "abc", "to": "int", "onError": "bad"}}, exp: "bad"},
+		{descr: "onNull", expr: bson.M{"$convert": bson.M{"input": "$missing", "to": "int", "onNull": 0}}, exp: 0},
+		{descr: "null without onNull", expr: bson.M{"$convert": bson.M{"input": "$null", "to": "int"}}, exp: nil},
+		{descr: "unknown type name", expr: bson.M{"$convert": bson.M{"input": 1, "to": "foo"}}, expErr: protocol.CodeBadValue},
+		{descr: "unsupported target", expr: bson.M{"$convert": bson.M{"input": 1, "to": "array", "onError": 0}}, expErr: protocol.CodeConversionFailure},
+		{descr: "missing required argument", expr: bson.M{"$convert": bson.M{"input": 1}}, expErr: protocol.CodeFailedToParse},
+	})
+}
+
+func TestNullAndMissing(t *testing.T) {
+	runEvalSpecs(t, []evalSpec{
+		{descr: "add null", expr: bson.M{"$add": []interface{}{1, "$null"}}, exp: nil},
+		{descr: "add missing", expr: bson.M{"$add": []interface{}{1, "$missing"}}, exp: nil},
+		{descr: "concat missing", expr: bson.M{"$concat": []interface{}{"a", "$missing"}}, exp: nil},
+		{descr: "toUpper null", expr: bson.M{"$toUpper": "$null"}, exp: ""},
+		{descr: "ifNull missing", expr: bson.M{"$ifNull": []interface{}{"$missing", "default"}}, exp: "default"},
+		{descr: "ifNull null", expr: bson.M{"$ifNull": []interface{}{"$null", "default"}}, exp: "default"},
+		{descr: "missing equals null", expr: bson.M{"$eq": []interface{}{"$missing", nil}}, exp: false},
+		{descr: "missing sorts before null", expr: bson.M{"$lt": []interface{}{"$missing", nil}}, exp: true},
+		{descr: "type of missing", expr: bson.M{"$type": "$missing"}, exp: "missing"},
+		{descr: "type of null", expr: bson.M{"$type": "$null"}, exp: "null"},
+		{descr: "object omits missing fields", expr: bson.M{"a": "$missing", "b": "$null"}, exp: bson.D{{Name: "b", Value: nil}}},
+		{descr: "array keeps missing as null", expr: []interface{}{"$missing"}, exp: []interface{}{nil}},
+		{descr: "cond on null", expr: bson.M{"$cond": []interface{}{"$null", "yes", "no"}}, exp: "no"},
+	})
+}
+
+func mustDecimal(s string) bson.Decimal128 {
+	d, err := bson.ParseDecimal128(s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
@@ -0,0 +1,165 @@
+package expr
+
+import (
+	"math"
+	"strconv"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// numKind describes the BSON numeric types in order of increasing precedence.
+// Arithmetic operators return a value using the highest precedence type of
+// their operands.
+type numKind int
+
+const (
+	kindInt numKind = iota
+	kindLong
+	kindDouble
+	kindDecimal
+)
+
+// numberKind returns the numeric kind of v. Note that the bson decoder emits
+// 32-bit integers as int values.
+func numberKind(v interface{}) (numKind, bool) {
+	switch v.(type) {
+	case int, int32:
+		return kindInt, true
+	case int64:
+		return kindLong, true
+	case float64, float32:
+		return kindDouble, true
+	case bson.Decimal128:
+		return kindDecimal, true
+	}
+	return 0, false
+}
+
+func isNumber(v interface{}) bool {
+	_, isNum := numberKind(v)
+	return isNum
+}
+
+func asInt64(v interface{}) int64 {
+	switch n := v.(type) {
+	case int:
+		return int64(n)
+	case int32:
+		return int64(n)
+	case int64:
+		return n
+	}
+	return int64(asFloat64(v))
+}
+
+func asFloat64(v interface{}) float64 {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case int32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case float32:
+		return float64(n)
+	case float64:
+		return n
+	case bson.Decimal128:
+		f, err := strconv.ParseFloat(n.String(), 64)
+		if err != nil {
+			return math.NaN()
+		}
+		return f
+	}
+	return math.NaN()
+}
+
+// makeInt returns an integer value using the narrowest type that can hold it
+// while respecting the minimum kind requested by the caller.
+func makeInt(kind numKind, n int64) interface{} {
+	if kind == kindInt && n >= math.MinInt32 && n <= math.MaxInt32 {
+		return int(n)
+	}
+	return n
+}
+
+// makeFloat returns a floating point value of the requested kind.
+func makeFloat(kind numKind, f float64) interface{} {
+	if kind == kindDecimal {
+		d, err := bson.ParseDecimal128(strconv.FormatFloat(f, 'g', -1, 64))
+		if err == nil {
+			return d
+		}
+	}
+	return f
+}
+
+// AddNumbers adds two numeric values using the same type promotion rules as
+// the $add operator.
+func AddNumbers(a, b interface{}) interface{} { return addNumbers(a, b) }
+
+// MultiplyNumbers multiplies two numeric values using the same type promotion
+// rules as the $multiply operator.
+func MultiplyNumbers(a, b interface{}) interface{} { return multiplyNumbers(a, b) }
+
+// addNumbers adds two numbers. Integer additions that overflow are converted
+// to doubles.
+func addNumbers(a, b interface{}) interface{} {
+	ka, _ := numberKind(a)
+	kb, _ := numberKind(b)
+	kind := maxKind(ka, kb)
+
+	if kind <= kindLong {
+		x, y := asInt64(a), asInt64(b)
+		sum := x + y
+		if (sum > x) == (y > 0) {
+			return makeInt(kind, sum)
+		}
+		return float64(x) + float64(y)
+	}
+	return makeFloat(kind, asFloat64(a)+asFloat64(b))
+}
+
+// subtractNumbers subtracts b from a.
+func subtractNumbers(a, b interface{}) interface{} {
+	ka, _ := numberKind(a)
+	kb, _ := numberKind(b)
+	kind := maxKind(ka, kb)
+
+	if kind <= kindLong {
+		x, y := asInt64(a), asInt64(b)
+		diff := x - y
+		if (diff < x) == (y > 0) {
+			return makeInt(kind, diff)
+		}
+		return float64(x) - float64(y)
+	}
+	return makeFloat(kind, asFloat64(a)-asFloat64(b))
+}
+
+// multiplyNumbers multiplies two numbers.
+func multiplyNumbers(a, b interface{}) interface{} {
+	ka, _ := numberKind(a)
+	kb, _ := numberKind(b)
+	kind := maxKind(ka, kb)
+
+	if kind <= kindLong {
+		x, y := asInt64(a), asInt64(b)
+		if x == 0 || y == 0 {
+			return makeInt(kind, 0)
+		}
+		prod := x * y
+		if prod/y == x && !(x == -1 && y == math.MinInt64) && !(y == -1 && x == math.MinInt64) {
+			return makeInt(kind, prod)
+		}
+		return float64(x) * float64(y)
+	}
+	return makeFloat(kind, asFloat64(a)*asFloat64(b))
+}
+
+func maxKind(a, b numKind) numKind {
+	if a > b {
+		return a
+	}
+	return b
+}
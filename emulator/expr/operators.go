@@ -0,0 +1,590 @@
+package expr
+
+import (
+	"strings"
+	"time"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/protocol"
+)
+
+// compileFn compiles the arguments of an expression operator.
+type compileFn func(name string, args interface{}) (Expr, error)
+
+// operators maps expression operator names to their compilers. The map is
+// populated by init functions as some operators need to compile nested
+// expressions.
+var operators = map[string]compileFn{}
+
+func init() {
+	registerOperators(map[string]compileFn{
+		"$literal": compileLiteral,
+
+		// Arithmetic operators
+		"$add":      variadic(evalAdd),
+		"$subtract": fixedArity(2, evalSubtract),
+		"$multiply": variadic(evalMultiply),
+		"$divide":   fixedArity(2, evalDivide),
+
+		// Comparison operators
+		"$cmp": fixedArity(2, evalCmp),
+		"$eq":  fixedArity(2, cmpOp(func(c int) bool { return c == 0 })),
+		"$ne":  fixedArity(2, cmpOp(func(c int) bool { return c != 0 })),
+		"$gt":  fixedArity(2, cmpOp(func(c int) bool { return c > 0 })),
+		"$gte": fixedArity(2, cmpOp(func(c int) bool { return c >= 0 })),
+		"$lt":  fixedArity(2, cmpOp(func(c int) bool { return c < 0 })),
+		"$lte": fixedArity(2, cmpOp(func(c int) bool { return c <= 0 })),
+
+		// Boolean operators
+		"$and": compileAnd,
+		"$or":  compileOr,
+		"$not": fixedArity(1, evalNot),
+
+		// Conditional operators
+		"$cond":   compileCond,
+		"$ifNull": compileIfNull,
+		"$switch": compileSwitch,
+
+		// String operators
+		"$concat":  variadic(evalConcat),
+		"$toLower": fixedArity(1, stringCase(strings.ToLower)),
+		"$toUpper": fixedArity(1, stringCase(strings.ToUpper)),
+
+		// Array operators
+		"$size": fixedArity(1, evalSize),
+	})
+}
+
+func registerOperators(ops map[string]compileFn) {
+	for name, fn := range ops {
+		operators[name] = fn
+	}
+}
+
+func compileOperator(name string, args interface{}) (Expr, error) {
+	fn, found := operators[name]
+	if !found {
+		return nil, protocol.ServerErrorf(protocol.CodeInvalidPipelineOperator, "Unrecognized expression '%s'", name)
+	}
+	return fn(name, args)
+}
+
+// compileArgs compiles the arguments of an operator. Operators accept either
+// an array of arguments or a single (non-array) argument.
+func compileArgs(args interface{}) ([]Expr, error) {
+	specs := []interface{}{args}
+	if bsonutil.IsArray(args) {
+		specs = bsonutil.ToArray(args)
+	}
+
+	exprs := make([]Expr, len(specs))
+	for i, spec := range specs {
+		e, err := Compile(spec)
+		if err != nil {
+			return nil, err
+		}
+		exprs[i] = e
+	}
+	return exprs, nil
+}
+
+// evalArgs evaluates a list of argument expressions.
+func evalArgs(args []Expr, vars *Vars) ([]interface{}, error) {
+	vals := make([]interface{}, len(args))
+	for i, arg := range args {
+		v, err := arg.Eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		vals[i] = v
+	}
+	return vals, nil
+}
+
+// funcExpr is an operator expression that evaluates all its arguments before
+// applying a function to their values.
+type funcExpr struct {
+	name string
+	args []Expr
+	fn   func(name string, vals []interface{}) (interface{}, error)
+}
+
+func (e funcExpr) Eval(vars *Vars) (interface{}, error) {
+	vals, err := evalArgs(e.args, vars)
+	if err != nil {
+		return nil, err
+	}
+	return e.fn(e.name, vals)
+}
+
+type evalFn func(name string, vals []interface{}) (interface{}, error)
+
+// variadic returns a compiler for operators that accept any number of
+// arguments.
+func variadic(fn evalFn) compileFn {
+	return func(name string, args interface{}) (Expr, error) {
+		exprs, err := compileArgs(args)
+		if err != nil {
+			return nil, err
+		}
+		return funcExpr{name: name, args: exprs, fn: fn}, nil
+	}
+}
+
+// fixedArity returns a compiler for operators that accept an exact number of
+// arguments.
+func fixedArity(n int, fn evalFn) compileFn {
+	return arityRange(n, n, fn)
+}
+
+// arityRange returns a compiler for operators that accept between min and
+// max arguments.
+func arityRange(min, max int, fn evalFn) compileFn {
+	return func(name string, args interface{}) (Expr, error) {
+		exprs, err := compileArgs(args)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(exprs) < min || len(exprs) > max {
+			if min == max {
+				return nil, protocol.ServerErrorf(16020, "Expression %s takes exactly %d arguments. %d were passed in.", name, min, len(exprs))
+			} else if len(exprs) < min {
+				return nil, protocol.ServerErrorf(16020, "Expression %s takes at least %d arguments, and at most %d. %d were passed in.", name, min, max, len(exprs))
+			}
+			return nil, protocol.ServerErrorf(16020, "Expression %s takes at most %d arguments, and at least %d. %d were passed in.", name, max, min, len(exprs))
+		}
+		return funcExpr{name: name, args: exprs, fn: fn}, nil
+	}
+}
+
+// anyNullish returns true if any of the values is null, undefined or missing.
+func anyNullish(vals []interface{}) bool {
+	for _, v := range vals {
+		if IsNullish(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func compileLiteral(_ string, args interface{}) (Expr, error) {
+	return literal{args}, nil
+}
+
+func evalAdd(name string, vals []interface{}) (interface{}, error) {
+	var (
+		sum     interface{} = 0
+		date    time.Time
+		hasDate bool
+		isNull  bool
+	)
+	for _, v := range vals {
+		switch {
+		case IsNullish(v):
+			isNull = true
+		case isNumber(v):
+			sum = addNumbers(sum, v)
+		default:
+			t, isDate := v.(time.Time)
+			if !isDate {
+				return nil, protocol.ServerErrorf(16554, "%s only supports numeric or date types, not %s", name, typeName(v))
+			} else if hasDate {
+				return nil, protocol.ServerErrorf(16612, "only one date allowed in an %s expression", name)
+			}
+			date, hasDate = t, true
+		}
+	}
+
+	switch {
+	case isNull:
+		return nil, nil
+	case hasDate:
+		return date.Add(time.Duration(roundHalfEven(asFloat64(sum))) * time.Millisecond), nil
+	}
+	return sum, nil
+}
+
+func evalSubtract(name string, vals []interface{}) (interface{}, error) {
+	a, b := vals[0], vals[1]
+	if anyNullish(vals) {
+		return nil, nil
+	}
+
+	aDate, aIsDate := a.(time.Time)
+	bDate, bIsDate := b.(time.Time)
+	switch {
+	case isNumber(a) && isNumber(b):
+		return subtractNumbers(a, b), nil
+	case aIsDate && bIsDate:
+		return int64(aDate.Sub(bDate) / time.Millisecond), nil
+	case aIsDate && isNumber(b):
+		return aDate.Add(-time.Duration(roundHalfEven(asFloat64(b))) * time.Millisecond), nil
+	}
+	return nil, protocol.ServerErrorf(16556, "can't %s %s from %s", name, typeName(b), typeName(a))
+}
+
+func evalMultiply(name string, vals []interface{}) (interface{}, error) {
+	var prod interface{} = 1
+	for _, v := range vals {
+		if IsNullish(v) {
+			return nil, nil
+		} else if !isNumber(v) {
+			return nil, protocol.ServerErrorf(16555, "%s only supports numeric types, not %s", name, typeName(v))
+		}
+		prod = multiplyNumbers(prod, v)
+	}
+	return prod, nil
+}
+
+func evalDivide(name string, vals []interface{}) (interface{}, error) {
+	a, b := vals[0], vals[1]
+	if anyNullish(vals) {
+		return nil, nil
+	} else if !isNumber(a) || !isNumber(b) {
+		return nil, protocol.ServerErrorf(16609, "%s only supports numeric types, not %s and %s", name, typeName(a), typeName(b))
+	}
+
+	divisor := asFloat64(b)
+	if divisor == 0 {
+		return nil, protocol.ServerErrorf(16608, "can't %s by zero", name)
+	}
+
+	ka, _ := numberKind(a)
+	kb, _ := numberKind(b)
+	if maxKind(ka, kb) == kindDecimal {
+		return makeFloat(kindDecimal, asFloat64(a)/divisor), nil
+	}
+	return asFloat64(a) / divisor, nil
+}
+
+func evalCmp(_ string, vals []interface{}) (interface{}, error) {
+	switch c := Compare(vals[0], vals[1]); {
+	case c < 0:
+		return -1, nil
+	case c > 0:
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func cmpOp(pred func(int) bool) evalFn {
+	return func(_ string, vals []interface{}) (interface{}, error) {
+		return pred(Compare(vals[0], vals[1])), nil
+	}
+}
+
+// logicalExpr implements the short-circuiting $and and $or operators.
+type logicalExpr struct {
+	args []Expr
+
+	// The truth value that causes evaluation to stop early: false for $and
+	// and true for $or.
+	shortCircuit bool
+}
+
+func compileAnd(_ string, args interface{}) (Expr, error) {
+	exprs, err := compileArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	return logicalExpr{args: exprs, shortCircuit: false}, nil
+}
+
+func compileOr(_ string, args interface{}) (Expr, error) {
+	exprs, err := compileArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	return logicalExpr{args: exprs, shortCircuit: true}, nil
+}
+
+func (e logicalExpr) Eval(vars *Vars) (interface{}, error) {
+	for _, arg := range e.args {
+		v, err := arg.Eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		if Truthy(v) == e.shortCircuit {
+			return e.shortCircuit, nil
+		}
+	}
+	return !e.shortCircuit, nil
+}
+
+func evalNot(_ string, vals []interface{}) (interface{}, error) {
+	return !Truthy(vals[0]), nil
+}
+
+// condExpr implements the $cond operator.
+type condExpr struct {
+	ifExpr, thenExpr, elseExpr Expr
+}
+
+func compileCond(name string, args interface{}) (Expr, error) {
+	var specs [3]interface{}
+	if bsonutil.IsArray(args) {
+		arr := bsonutil.ToArray(args)
+		if len(arr) != 3 {
+			return nil, protocol.ServerErrorf(16020, "Expression %s takes exactly 3 arguments. %d were passed in.", name, len(arr))
+		}
+		copy(specs[:], arr)
+	} else if bsonutil.IsDocument(args) {
+		var found [3]bool
+		for _, elem := range bsonutil.Elements(args) {
+			switch elem.Name {
+			case "if":
+				specs[0], found[0] = elem.Value, true
+			case "then":
+				specs[1], found[1] = elem.Value, true
+			case "else":
+				specs[2], found[2] = elem.Value, true
+			default:
+				return nil, protocol.ServerErrorf(17083, "Unrecognized parameter to %s: %s", name, elem.Name)
+			}
+		}
+		for i, param := range []string{"if", "then", "else"} {
+			if !found[i] {
+				return nil, protocol.ServerErrorf(protocol.ErrorCode(17080+i), "Missing '%s' parameter to %s", param, name)
+			}
+		}
+	} else {
+		return nil, protocol.ServerErrorf(16020, "Expression %s takes exactly 3 arguments. 1 were passed in.", name)
+	}
+
+	var (
+		cond condExpr
+		err  error
+	)
+	if cond.ifExpr, err = Compile(specs[0]); err != nil {
+		return nil, err
+	}
+	if cond.thenExpr, err = Compile(specs[1]); err != nil {
+		return nil, err
+	}
+	if cond.elseExpr, err = Compile(specs[2]); err != nil {
+		return nil, err
+	}
+	return cond, nil
+}
+
+func (e condExpr) Eval(vars *Vars) (interface{}, error) {
+	v, err := e.ifExpr.Eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	if Truthy(v) {
+		return e.thenExpr.Eval(vars)
+	}
+	return e.elseExpr.Eval(vars)
+}
+
+// ifNullExpr implements the $ifNull operator which returns the first argument
+// that does not evaluate to a null or missing value.
+type ifNullExpr struct {
+	args []Expr
+}
+
+func compileIfNull(name string, args interface{}) (Expr, error) {
+	exprs, err := compileArgs(args)
+	if err != nil {
+		return nil, err
+	} else if len(exprs) < 2 {
+		return nil, protocol.ServerErrorf(1257300, "%s needs at least two arguments, had: %d", name, len(exprs))
+	}
+	return ifNullExpr{args: exprs}, nil
+}
+
+func (e ifNullExpr) Eval(vars *Vars) (interface{}, error) {
+	for i, arg := range e.args {
+		v, err := arg.Eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		if !IsNullish(v) || i == len(e.args)-1 {
+			return v, nil
+		}
+	}
+	return nil, nil
+}
+
+// switchExpr implements the $switch operator which evaluates the expression
+// of the first branch whose case expression is true.
+type switchExpr struct {
+	name     string
+	cases    []Expr
+	thens    []Expr
+	defaultE Expr
+}
+
+func compileSwitch(name string, args interface{}) (Expr, error) {
+	if !bsonutil.IsDocument(args) {
+		return nil, protocol.ServerErrorf(40060, "%s requires an object as an argument, found: %s", name, typeName(args))
+	}
+
+	sw := switchExpr{name: name}
+	for _, elem := range bsonutil.Elements(args) {
+		switch elem.Name {
+		case "branches":
+			if !bsonutil.IsArray(elem.Value) {
+				return nil, protocol.ServerErrorf(40061, "%s expected an array for 'branches', found: %s", name, typeName(elem.Value))
+			}
+			for _, branch := range bsonutil.ToArray(elem.Value) {
+				if !bsonutil.IsDocument(branch) {
+					return nil, protocol.ServerErrorf(40062, "%s expected each branch to be an object, found: %s", name, typeName(branch))
+				}
+
+				var caseExpr, thenExpr Expr
+				for _, branchElem := range bsonutil.Elements(branch) {
+					e, err := Compile(branchElem.Value)
+					if err != nil {
+						return nil, err
+					}
+					switch branchElem.Name {
+					case "case":
+						caseExpr = e
+					case "then":
+						thenExpr = e
+					default:
+						return nil, protocol.ServerErrorf(40063, "%s found an unknown argument to a branch: %s", name, branchElem.Name)
+					}
+				}
+
+				if caseExpr == nil {
+					return nil, protocol.ServerErrorf(40064, "%s requires each branch have a 'case' expression", name)
+				} else if thenExpr == nil {
+					return nil, protocol.ServerErrorf(40065, "%s requires each branch have a 'then' expression.", name)
+				}
+				sw.cases = append(sw.cases, caseExpr)
+				sw.thens = append(sw.thens, thenExpr)
+			}
+		case "default":
+			e, err := Compile(elem.Value)
+			if err != nil {
+				return nil, err
+			}
+			sw.defaultE = e
+		default:
+			return nil, protocol.ServerErrorf(40067, "%s found an unknown argument: %s", name, elem.Name)
+		}
+	}
+
+	if len(sw.cases) == 0 {
+		return nil, protocol.ServerErrorf(40068, "%s requires at least one branch.", name)
+	}
+	return sw, nil
+}
+
+func (e switchExpr) Eval(vars *Vars) (interface{}, error) {
+	for i, caseExpr := range e.cases {
+		v, err := caseExpr.Eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		if Truthy(v) {
+			return e.thens[i].Eval(vars)
+		}
+	}
+
+	if e.defaultE == nil {
+		return nil, protocol.ServerErrorf(40066, "%s could not find a matching branch for an input, and no default was specified.", e.name)
+	}
+	return e.defaultE.Eval(vars)
+}
+
+func evalConcat(name string, vals []interface{}) (interface{}, error) {
+	var sb strings.Builder
+	for _, v := range vals {
+		if IsNullish(v) {
+			return nil, nil
+		}
+		s, isString := v.(string)
+		if !isString {
+			return nil, protocol.ServerErrorf(16702, "%s only supports strings, not %s", name, typeName(v))
+		}
+		sb.WriteString(s)
+	}
+	return sb.String(), nil
+}
+
+func stringCase(fn func(string) string) evalFn {
+	return func(name string, vals []interface{}) (interface{}, error) {
+		s, err := coerceToString(vals[0])
+		if err != nil {
+			return nil, err
+		}
+		return fn(s), nil
+	}
+}
+
+func evalSize(name string, vals []interface{}) (interface{}, error) {
+	if !bsonutil.IsArray(vals[0]) {
+		return nil, protocol.ServerErrorf(17124, "The argument to %s must be an array. Type of argument is %s", name, typeName(vals[0]))
+	}
+	return len(bsonutil.ToArray(vals[0])), nil
+}
+
+// roundHalfEven rounds f to the nearest integer, rounding ties to even.
+func roundHalfEven(f float64) int64 {
+	t := int64(f)
+	diff := f - float64(t)
+	switch {
+	case diff > 0.5 || (diff == 0.5 && t%2 != 0):
+		t++
+	case diff < -0.5 || (diff == -0.5 && t%2 != 0):
+		t--
+	}
+	return t
+}
+
+// namedArgs holds the compiled arguments of an operator that accepts a
+// document with named parameters (e.g. {$trim: {input: ..., chars: ...}}).
+type namedArgs map[string]Expr
+
+// compileNamedArgs compiles the named arguments of an operator. It returns an
+// error if the arguments are not specified as a document, if an unknown
+// parameter is specified or if any of the required parameters is missing.
+func compileNamedArgs(name string, args interface{}, params []string, required ...string) (namedArgs, error) {
+	if !bsonutil.IsDocument(args) {
+		return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "%s requires an object as an argument, found: %s", name, typeName(args))
+	}
+
+	compiled := make(namedArgs)
+	for _, elem := range bsonutil.Elements(args) {
+		if !containsString(params, elem.Name) {
+			return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "%s found an unknown argument: %s", name, elem.Name)
+		}
+
+		e, err := Compile(elem.Value)
+		if err != nil {
+			return nil, err
+		}
+		compiled[elem.Name] = e
+	}
+
+	for _, param := range required {
+		if compiled[param] == nil {
+			return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "%s requires '%s' to be specified", name, param)
+		}
+	}
+	return compiled, nil
+}
+
+// eval evaluates a named argument. Arguments that were not specified evaluate
+// to Missing.
+func (a namedArgs) eval(param string, vars *Vars) (interface{}, error) {
+	e := a[param]
+	if e == nil {
+		return Missing, nil
+	}
+	return e.Eval(vars)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
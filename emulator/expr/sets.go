@@ -0,0 +1,160 @@
+package expr
+
+import (
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/protocol"
+)
+
+func init() {
+	registerOperators(map[string]compileFn{
+		"$setUnion":        variadic(evalSetUnion),
+		"$setIntersection": variadic(evalSetIntersection),
+		"$setDifference":   fixedArity(2, evalSetDifference),
+		"$setEquals":       variadic(evalSetEquals),
+		"$setIsSubset":     fixedArity(2, evalSetIsSubset),
+		"$anyElementTrue":  fixedArity(1, elementTruthOp(true)),
+		"$allElementTrue":  fixedArity(1, elementTruthOp(false)),
+	})
+}
+
+// valueSet is a list of distinct values that preserves insertion order.
+type valueSet []interface{}
+
+func (s valueSet) contains(v interface{}) bool {
+	for _, item := range s {
+		if bsonutil.SameTypeBracket(item, v) && bsonutil.Equal(item, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s valueSet) add(vals ...interface{}) valueSet {
+	for _, v := range vals {
+		if !s.contains(v) {
+			s = append(s, v)
+		}
+	}
+	return s
+}
+
+func (s valueSet) toArray() []interface{} {
+	return append([]interface{}{}, s...)
+}
+
+func evalSetUnion(name string, vals []interface{}) (interface{}, error) {
+	set := valueSet{}
+	for _, v := range vals {
+		if IsNullish(v) {
+			return nil, nil
+		} else if !bsonutil.IsArray(v) {
+			return nil, protocol.ServerErrorf(17043, "All operands of %s must be arrays. One argument is of type: %s", name, typeName(v))
+		}
+		set = set.add(bsonutil.ToArray(v)...)
+	}
+	return set.toArray(), nil
+}
+
+func evalSetIntersection(name string, vals []interface{}) (interface{}, error) {
+	var set valueSet
+	for i, v := range vals {
+		if IsNullish(v) {
+			return nil, nil
+		} else if !bsonutil.IsArray(v) {
+			return nil, protocol.ServerErrorf(17047, "All operands of %s must be arrays. One argument is of type: %s", name, typeName(v))
+		}
+
+		operand := valueSet{}.add(bsonutil.ToArray(v)...)
+		if i == 0 {
+			set = operand
+			continue
+		}
+
+		var next valueSet
+		for _, item := range set {
+			if operand.contains(item) {
+				next = append(next, item)
+			}
+		}
+		set = next
+	}
+	return set.toArray(), nil
+}
+
+func evalSetDifference(name string, vals []interface{}) (interface{}, error) {
+	if anyNullish(vals) {
+		return nil, nil
+	} else if !bsonutil.IsArray(vals[0]) {
+		return nil, protocol.ServerErrorf(17048, "both operands of %s must be arrays. First argument is of type: %s", name, typeName(vals[0]))
+	} else if !bsonutil.IsArray(vals[1]) {
+		return nil, protocol.ServerErrorf(17049, "both operands of %s must be arrays. Second argument is of type: %s", name, typeName(vals[1]))
+	}
+
+	exclude := valueSet{}.add(bsonutil.ToArray(vals[1])...)
+	set := valueSet{}
+	for _, v := range bsonutil.ToArray(vals[0]) {
+		if !exclude.contains(v) {
+			set = set.add(v)
+		}
+	}
+	return set.toArray(), nil
+}
+
+func evalSetEquals(name string, vals []interface{}) (interface{}, error) {
+	if len(vals) < 2 {
+		return nil, protocol.ServerErrorf(17045, "%s needs at least two arguments had: %d", name, len(vals))
+	}
+
+	var first valueSet
+	for i, v := range vals {
+		if !bsonutil.IsArray(v) {
+			return nil, protocol.ServerErrorf(17044, "All operands of %s must be arrays. One argument is of type: %s", name, typeName(v))
+		}
+
+		set := valueSet{}.add(bsonutil.ToArray(v)...)
+		if i == 0 {
+			first = set
+			continue
+		}
+		if !isSubset(set, first) || !isSubset(first, set) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func evalSetIsSubset(name string, vals []interface{}) (interface{}, error) {
+	if !bsonutil.IsArray(vals[0]) {
+		return nil, protocol.ServerErrorf(17310, "both operands of %s must be arrays. First argument is of type: %s", name, typeName(vals[0]))
+	} else if !bsonutil.IsArray(vals[1]) {
+		return nil, protocol.ServerErrorf(17042, "both operands of %s must be arrays. Second argument is of type: %s", name, typeName(vals[1]))
+	}
+	return isSubset(bsonutil.ToArray(vals[0]), valueSet{}.add(bsonutil.ToArray(vals[1])...)), nil
+}
+
+// isSubset returns true if all values in sub are members of set.
+func isSubset(sub []interface{}, set valueSet) bool {
+	for _, v := range sub {
+		if !set.contains(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// elementTruthOp returns an evaluator for $anyElementTrue (any is true) and
+// $allElementTrue (any is false).
+func elementTruthOp(any bool) evalFn {
+	return func(name string, vals []interface{}) (interface{}, error) {
+		if !bsonutil.IsArray(vals[0]) {
+			return nil, protocol.ServerErrorf(17041, "%s's argument must be an array, but is %s", name, typeName(vals[0]))
+		}
+
+		for _, v := range bsonutil.ToArray(vals[0]) {
+			if Truthy(v) == any {
+				return any, nil
+			}
+		}
+		return !any, nil
+	}
+}
@@ -0,0 +1,462 @@
+package expr
+
+import (
+	"math"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/protocol"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func init() {
+	registerOperators(map[string]compileFn{
+		"$strLenBytes":  fixedArity(1, evalStrLenBytes),
+		"$strLenCP":     fixedArity(1, evalStrLenCP),
+		"$substr":       fixedArity(3, evalSubstrBytes),
+		"$substrBytes":  fixedArity(3, evalSubstrBytes),
+		"$substrCP":     fixedArity(3, evalSubstrCP),
+		"$indexOfBytes": arityRange(2, 4, indexOfOp(false)),
+		"$indexOfCP":    arityRange(2, 4, indexOfOp(true)),
+		"$split":        fixedArity(2, evalSplit),
+		"$strcasecmp":   fixedArity(2, evalStrcasecmp),
+		"$trim":         compileTrim,
+		"$ltrim":        compileTrim,
+		"$rtrim":        compileTrim,
+		"$replaceOne":   compileReplace,
+		"$replaceAll":   compileReplace,
+		"$regexMatch":   compileRegexOp,
+		"$regexFind":    compileRegexOp,
+		"$regexFindAll": compileRegexOp,
+	})
+}
+
+// coerceToString converts a value to a string using the rules of the string
+// operators that accept non-string arguments (e.g. $toLower and $substr).
+// Null and missing values are converted to the empty string.
+func coerceToString(v interface{}) (string, error) {
+	switch val := v.(type) {
+	case string:
+		return val, nil
+	case bson.Symbol:
+		return string(val), nil
+	}
+
+	if IsNullish(v) {
+		return "", nil
+	}
+	if isNumber(v) || bsonutil.TypeName(v) == "date" || bsonutil.TypeName(v) == "timestamp" {
+		return formatValue(v), nil
+	}
+	return "", protocol.ServerErrorf(16007, "can't convert from BSON type %s to String", typeName(v))
+}
+
+func evalStrLenBytes(name string, vals []interface{}) (interface{}, error) {
+	s, isString := vals[0].(string)
+	if !isString {
+		return nil, protocol.ServerErrorf(34473, "%s requires a string argument, found: %s", name, typeName(vals[0]))
+	}
+	return len(s), nil
+}
+
+func evalStrLenCP(name string, vals []interface{}) (interface{}, error) {
+	s, isString := vals[0].(string)
+	if !isString {
+		return nil, protocol.ServerErrorf(34471, "%s requires a string argument, found: %s", name, typeName(vals[0]))
+	}
+	return utf8.RuneCountInString(s), nil
+}
+
+func evalSubstrBytes(name string, vals []interface{}) (interface{}, error) {
+	s, err := coerceToString(vals[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if !isNumber(vals[1]) {
+		return nil, protocol.ServerErrorf(16034, "%s: starting index must be a numeric type (is BSON type %s)", name, typeName(vals[1]))
+	} else if !isNumber(vals[2]) {
+		return nil, protocol.ServerErrorf(16035, "%s: length must be a numeric type (is BSON type %s)", name, typeName(vals[2]))
+	}
+
+	start, length := asInt64(vals[1]), asInt64(vals[2])
+	if start < 0 {
+		return nil, protocol.ServerErrorf(50752, "%s: starting index must be non-negative (got: %d)", name, start)
+	} else if start >= int64(len(s)) {
+		return "", nil
+	}
+
+	end := int64(len(s))
+	if length >= 0 && start+length < end {
+		end = start + length
+	}
+
+	if !isCharBoundary(s, start) {
+		return nil, protocol.ServerErrorf(28656, "%s: Invalid range, starting index is a UTF-8 continuation byte.", name)
+	} else if !isCharBoundary(s, end) {
+		return nil, protocol.ServerErrorf(28657, "%s: Invalid range, ending index is in the middle of a UTF-8 character.", name)
+	}
+	return s[start:end], nil
+}
+
+// isCharBoundary returns true if the byte at offset i starts a new UTF-8
+// character or i is the end of the string.
+func isCharBoundary(s string, i int64) bool {
+	return i >= int64(len(s)) || utf8.RuneStart(s[i])
+}
+
+func evalSubstrCP(name string, vals []interface{}) (interface{}, error) {
+	s, err := coerceToString(vals[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if !isNumber(vals[1]) {
+		return nil, protocol.ServerErrorf(34450, "%s: starting index must be a numeric type (is BSON type %s)", name, typeName(vals[1]))
+	} else if f := asFloat64(vals[1]); f != math.Trunc(f) {
+		return nil, protocol.ServerErrorf(34451, "%s: starting index cannot be represented as a 32-bit integral value", name)
+	} else if !isNumber(vals[2]) {
+		return nil, protocol.ServerErrorf(34452, "%s: length must be a numeric type (is BSON type %s)", name, typeName(vals[2]))
+	} else if f := asFloat64(vals[2]); f != math.Trunc(f) {
+		return nil, protocol.ServerErrorf(34453, "%s: length cannot be represented as a 32-bit integral value", name)
+	}
+
+	start, length := asInt64(vals[1]), asInt64(vals[2])
+	if start < 0 {
+		return nil, protocol.ServerErrorf(34455, "%s: the starting index must be nonnegative integer.", name)
+	} else if length < 0 {
+		return nil, protocol.ServerErrorf(34454, "%s: length must be a nonnegative integer.", name)
+	}
+
+	runes := []rune(s)
+	if start >= int64(len(runes)) {
+		return "", nil
+	}
+	end := start + length
+	if end > int64(len(runes)) {
+		end = int64(len(runes))
+	}
+	return string(runes[start:end]), nil
+}
+
+// indexOfOp returns an evaluator for $indexOfBytes and $indexOfCP. The
+// returned index and the optional start and end arguments are expressed in
+// code points if useCodePoints is true; otherwise they are byte offsets.
+func indexOfOp(useCodePoints bool) evalFn {
+	return func(name string, vals []interface{}) (interface{}, error) {
+		if IsNullish(vals[0]) {
+			return nil, nil
+		}
+
+		s, isString := vals[0].(string)
+		if !isString {
+			return nil, protocol.ServerErrorf(40091, "%s requires a string as the first argument, found: %s", name, typeName(vals[0]))
+		}
+		substr, isString := vals[1].(string)
+		if !isString {
+			return nil, protocol.ServerErrorf(40092, "%s requires a string as the second argument, found: %s", name, typeName(vals[1]))
+		}
+
+		var units []string
+		if useCodePoints {
+			for _, r := range s {
+				units = append(units, string(r))
+			}
+		} else {
+			for i := 0; i < len(s); i++ {
+				units = append(units, s[i:i+1])
+			}
+		}
+
+		start, end := int64(0), int64(len(units))
+		// The error codes for non-integral and negative start and end
+		// indexes.
+		codes := [][2]protocol.ErrorCode{{40096, 40097}, {40098, 40099}}
+		for i, code := range codes {
+			if len(vals) <= i+2 {
+				break
+			}
+			v := vals[i+2]
+			if !isNumber(v) || asFloat64(v) != math.Trunc(asFloat64(v)) {
+				return nil, protocol.ServerErrorf(code[0], "%s requires an integral %s index, found a value of type: %s", name, []string{"starting", "ending"}[i], typeName(v))
+			} else if asInt64(v) < 0 {
+				return nil, protocol.ServerErrorf(code[1], "%s requires a nonnegative %s index, found: %d", name, []string{"start", "ending"}[i], asInt64(v))
+			}
+			if i == 0 {
+				start = asInt64(v)
+			} else if asInt64(v) < end {
+				end = asInt64(v)
+			}
+		}
+
+		if start > end || start > int64(len(units)) {
+			return -1, nil
+		}
+
+		haystack := strings.Join(units[start:end], "")
+		idx := strings.Index(haystack, substr)
+		if idx < 0 {
+			return -1, nil
+		}
+		if useCodePoints {
+			idx = utf8.RuneCountInString(haystack[:idx])
+		}
+		return int(start) + idx, nil
+	}
+}
+
+func evalSplit(name string, vals []interface{}) (interface{}, error) {
+	if anyNullish(vals) {
+		return nil, nil
+	}
+
+	s, isString := vals[0].(string)
+	if !isString {
+		return nil, protocol.ServerErrorf(40085, "%s requires an expression that evaluates to a string as a first argument, found: %s", name, typeName(vals[0]))
+	}
+	sep, isString := vals[1].(string)
+	if !isString {
+		return nil, protocol.ServerErrorf(40086, "%s requires an expression that evaluates to a string as a second argument, found: %s", name, typeName(vals[1]))
+	} else if sep == "" {
+		return nil, protocol.ServerErrorf(40087, "%s requires a non-empty separator", name)
+	}
+
+	parts := strings.Split(s, sep)
+	out := make([]interface{}, len(parts))
+	for i, part := range parts {
+		out[i] = part
+	}
+	return out, nil
+}
+
+func evalStrcasecmp(_ string, vals []interface{}) (interface{}, error) {
+	a, err := coerceToString(vals[0])
+	if err != nil {
+		return nil, err
+	}
+	b, err := coerceToString(vals[1])
+	if err != nil {
+		return nil, err
+	}
+	return strings.Compare(strings.ToUpper(a), strings.ToUpper(b)), nil
+}
+
+// defaultTrimChars are the characters removed by the trim operators when the
+// chars argument is not specified.
+const defaultTrimChars = "\x00 \t\n\v\f\r\u00a0\u1680\u2000\u2001\u2002\u2003\u2004\u2005\u2006\u2007\u2008\u2009\u200a\u2028\u2029\u202f\u205f\u3000"
+
+// trimExpr implements the $trim, $ltrim and $rtrim operators.
+type trimExpr struct {
+	name        string
+	args        namedArgs
+	left, right bool
+}
+
+func compileTrim(name string, args interface{}) (Expr, error) {
+	compiled, err := compileNamedArgs(name, args, []string{"input", "chars"}, "input")
+	if err != nil {
+		return nil, err
+	}
+	return trimExpr{
+		name:  name,
+		args:  compiled,
+		left:  name != "$rtrim",
+		right: name != "$ltrim",
+	}, nil
+}
+
+func (e trimExpr) Eval(vars *Vars) (interface{}, error) {
+	input, err := e.args.eval("input", vars)
+	if err != nil {
+		return nil, err
+	} else if IsNullish(input) {
+		return nil, nil
+	}
+
+	s, isString := input.(string)
+	if !isString {
+		return nil, protocol.ServerErrorf(50699, "%s requires its input to be a string, got %s (of type %s) instead.", e.name, formatValue(input), typeName(input))
+	}
+
+	chars := defaultTrimChars
+	if e.args["chars"] != nil {
+		v, err := e.args.eval("chars", vars)
+		if err != nil {
+			return nil, err
+		} else if IsNullish(v) {
+			return nil, nil
+		}
+		if chars, isString = v.(string); !isString {
+			return nil, protocol.ServerErrorf(50700, "%s requires 'chars' to be a string, got %s (of type %s) instead.", e.name, formatValue(v), typeName(v))
+		}
+	}
+
+	if e.left {
+		s = strings.TrimLeft(s, chars)
+	}
+	if e.right {
+		s = strings.TrimRight(s, chars)
+	}
+	return s, nil
+}
+
+// replaceExpr implements the $replaceOne and $replaceAll operators.
+type replaceExpr struct {
+	name string
+	args namedArgs
+	all  bool
+}
+
+func compileReplace(name string, args interface{}) (Expr, error) {
+	compiled, err := compileNamedArgs(name, args, []string{"input", "find", "replacement"}, "input", "find", "replacement")
+	if err != nil {
+		return nil, err
+	}
+	return replaceExpr{name: name, args: compiled, all: name == "$replaceAll"}, nil
+}
+
+func (e replaceExpr) Eval(vars *Vars) (interface{}, error) {
+	var (
+		params = []string{"input", "find", "replacement"}
+		vals   = make([]string, len(params))
+		isNull bool
+	)
+	for i, param := range params {
+		v, err := e.args.eval(param, vars)
+		if err != nil {
+			return nil, err
+		} else if IsNullish(v) {
+			isNull = true
+			continue
+		}
+
+		s, isString := v.(string)
+		if !isString {
+			return nil, protocol.ServerErrorf(51746, "%s requires that '%s' be a string, found: %s", e.name, param, formatValue(v))
+		}
+		vals[i] = s
+	}
+
+	if isNull {
+		return nil, nil
+	}
+
+	n := 1
+	if e.all {
+		n = -1
+	}
+	return strings.Replace(vals[0], vals[1], vals[2], n), nil
+}
+
+// regexExpr implements the $regexMatch, $regexFind and $regexFindAll
+// operators.
+type regexExpr struct {
+	name string
+	args namedArgs
+}
+
+func compileRegexOp(name string, args interface{}) (Expr, error) {
+	compiled, err := compileNamedArgs(name, args, []string{"input", "regex", "options"}, "input", "regex")
+	if err != nil {
+		return nil, err
+	}
+	return regexExpr{name: name, args: compiled}, nil
+}
+
+func (e regexExpr) Eval(vars *Vars) (interface{}, error) {
+	input, err := e.args.eval("input", vars)
+	if err != nil {
+		return nil, err
+	}
+	regexArg, err := e.args.eval("regex", vars)
+	if err != nil {
+		return nil, err
+	}
+	optionsArg, err := e.args.eval("options", vars)
+	if err != nil {
+		return nil, err
+	}
+
+	var pattern, options string
+	switch re := regexArg.(type) {
+	case string:
+		pattern = re
+	case bson.RegEx:
+		pattern, options = re.Pattern, re.Options
+	default:
+		if !IsNullish(regexArg) {
+			return nil, protocol.ServerErrorf(51105, "%s needs 'regex' to be of type string or regex", e.name)
+		}
+	}
+
+	if !IsNullish(optionsArg) {
+		opts, isString := optionsArg.(string)
+		if !isString {
+			return nil, protocol.ServerErrorf(51106, "%s needs 'options' to be of type string", e.name)
+		} else if options != "" && opts != "" {
+			return nil, protocol.ServerErrorf(51107, "%s found regex option(s) specified in both 'regex' and 'option' fields", e.name)
+		}
+		options += opts
+	}
+
+	if !IsNullish(input) {
+		if _, isString := input.(string); !isString {
+			return nil, protocol.ServerErrorf(51104, "%s needs 'input' to be of type string", e.name)
+		}
+	}
+
+	// Null inputs or patterns never match.
+	if IsNullish(input) || IsNullish(regexArg) {
+		switch e.name {
+		case "$regexMatch":
+			return false, nil
+		case "$regexFind":
+			return nil, nil
+		}
+		return []interface{}{}, nil
+	}
+
+	re, err := bsonutil.CompileRegex(pattern, options)
+	if err != nil {
+		return nil, protocol.ServerErrorf(51111, "Invalid Regex in %s: %v", e.name, err)
+	}
+
+	s := input.(string)
+	switch e.name {
+	case "$regexMatch":
+		return re.MatchString(s), nil
+	case "$regexFind":
+		loc := re.FindStringSubmatchIndex(s)
+		if loc == nil {
+			return nil, nil
+		}
+		return regexMatchDoc(s, loc), nil
+	}
+
+	matches := []interface{}{}
+	for _, loc := range re.FindAllStringSubmatchIndex(s, -1) {
+		matches = append(matches, regexMatchDoc(s, loc))
+	}
+	return matches, nil
+}
+
+// regexMatchDoc builds the document describing a regex match as returned by
+// $regexFind and $regexFindAll. The index of the match is expressed in code
+// points.
+func regexMatchDoc(s string, loc []int) bson.D {
+	captures := []interface{}{}
+	for i := 2; i < len(loc); i += 2 {
+		if loc[i] < 0 {
+			captures = append(captures, nil)
+			continue
+		}
+		captures = append(captures, s[loc[i]:loc[i+1]])
+	}
+
+	return bson.D{
+		{Name: "match", Value: s[loc[0]:loc[1]]},
+		{Name: "idx", Value: utf8.RuneCountInString(s[:loc[0]])},
+		{Name: "captures", Value: captures},
+	}
+}
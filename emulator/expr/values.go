@@ -0,0 +1,85 @@
+package expr
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Truthy returns the boolean interpretation of a value using the aggregation
+// rules: null, undefined, missing, false and numeric zero values are false;
+// everything else (including empty arrays and strings) is true.
+func Truthy(v interface{}) bool {
+	if IsNullish(v) {
+		return false
+	}
+
+	switch val := v.(type) {
+	case bool:
+		return val
+	}
+
+	if f, isNum := bsonutil.ToFloat64(v); isNum {
+		return f != 0
+	}
+	return true
+}
+
+// Compare returns an integer comparing two values using the canonical mongo
+// comparison order. Missing values are considered to be less than any other
+// value, including null.
+func Compare(a, b interface{}) int {
+	aMissing, bMissing := IsMissing(a), IsMissing(b)
+	switch {
+	case aMissing && bMissing:
+		return 0
+	case aMissing:
+		return -1
+	case bMissing:
+		return 1
+	}
+	return bsonutil.Compare(a, b)
+}
+
+// typeName returns the type alias of v for inclusion in error messages.
+func typeName(v interface{}) string {
+	if IsMissing(v) {
+		return "missing"
+	}
+	return bsonutil.TypeName(v)
+}
+
+// formatValue returns a string representation of v for inclusion in error
+// messages.
+func formatValue(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return val
+	case time.Time:
+		return val.UTC().Format("2006-01-02T15:04:05.000Z")
+	case bson.ObjectId:
+		return "ObjectId('" + val.Hex() + "')"
+	case missingValue:
+		return "missing"
+	}
+
+	if bsonutil.IsDocument(v) {
+		parts := make([]string, 0)
+		for _, elem := range bsonutil.Elements(v) {
+			parts = append(parts, elem.Name+": "+formatValue(elem.Value))
+		}
+		return "{ " + strings.Join(parts, ", ") + " }"
+	} else if bsonutil.IsArray(v) {
+		parts := make([]string, 0)
+		for _, elem := range bsonutil.ToArray(v) {
+			parts = append(parts, formatValue(elem))
+		}
+		return "[ " + strings.Join(parts, ", ") + " ]"
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,139 @@
+package expr
+
+import (
+	"time"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/protocol"
+)
+
+// Vars is an immutable scope of variables that can be referenced by
+// expressions via the $$name syntax. Nested scopes (e.g. the ones introduced
+// by $let or $map) are created via the With method and shadow the variables
+// of their parent scope.
+type Vars struct {
+	parent *Vars
+	name   string
+	value  interface{}
+}
+
+// NewVars returns a variable scope where the ROOT and CURRENT system
+// variables refer to doc.
+func NewVars(doc interface{}) *Vars {
+	return new(Vars).WithDocument(doc)
+}
+
+// With returns a child scope that defines a variable with the specified name.
+func (v *Vars) With(name string, value interface{}) *Vars {
+	return &Vars{parent: v, name: name, value: value}
+}
+
+// WithDocument returns a child scope where the ROOT and CURRENT system
+// variables refer to doc.
+func (v *Vars) WithDocument(doc interface{}) *Vars {
+	return v.With("ROOT", doc).With("CURRENT", doc)
+}
+
+// Get returns the value of a variable. It returns an error if the variable is
+// not defined.
+func (v *Vars) Get(name string) (interface{}, error) {
+	for scope := v; scope != nil; scope = scope.parent {
+		if scope.name == name && scope.parent != nil {
+			return scope.value, nil
+		}
+	}
+
+	switch name {
+	case "REMOVE":
+		return Missing, nil
+	case "NOW":
+		// Callers should define NOW so that it remains constant
+		// for the duration of a pipeline.
+		return time.Now().UTC().Truncate(time.Millisecond), nil
+	}
+	return nil, protocol.ServerErrorf(17276, "Use of undefined variable: %s", name)
+}
+
+// isSystemVariable returns true if name is one of the system variables that
+// can be referenced by expressions.
+func isSystemVariable(name string) bool {
+	switch name {
+	case "ROOT", "CURRENT", "REMOVE", "NOW", "CLUSTER_TIME", "DESCEND", "PRUNE", "KEEP", "SEARCH_META":
+		return true
+	}
+	return false
+}
+
+func init() {
+	registerOperators(map[string]compileFn{
+		"$let": compileLet,
+	})
+}
+
+// letExpr implements $let which binds variables for use by a nested
+// expression. Variable values are evaluated in the enclosing scope.
+type letExpr struct {
+	names []string
+	exprs []Expr
+	in    Expr
+}
+
+func compileLet(name string, args interface{}) (Expr, error) {
+	if !bsonutil.IsDocument(args) {
+		return nil, protocol.ServerErrorf(16874, "%s only supports an object as its argument", name)
+	}
+
+	var (
+		let                letExpr
+		varsSpec, inSpec   interface{}
+		hasVars, hasInSpec bool
+	)
+	for _, elem := range bsonutil.Elements(args) {
+		switch elem.Name {
+		case "vars":
+			varsSpec, hasVars = elem.Value, true
+		case "in":
+			inSpec, hasInSpec = elem.Value, true
+		default:
+			return nil, protocol.ServerErrorf(16875, "Unrecognized parameter to %s: %s", name, elem.Name)
+		}
+	}
+
+	if !hasVars {
+		return nil, protocol.ServerErrorf(16876, "Missing 'vars' parameter to %s", name)
+	} else if !hasInSpec {
+		return nil, protocol.ServerErrorf(16877, "Missing 'in' parameter to %s", name)
+	} else if !bsonutil.IsDocument(varsSpec) {
+		return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "invalid parameter: expected an object (vars)")
+	}
+
+	for _, elem := range bsonutil.Elements(varsSpec) {
+		if err := validateVariableName(elem.Name, false); err != nil {
+			return nil, err
+		}
+		e, err := Compile(elem.Value)
+		if err != nil {
+			return nil, err
+		}
+		let.names = append(let.names, elem.Name)
+		let.exprs = append(let.exprs, e)
+	}
+
+	var err error
+	if let.in, err = Compile(inSpec); err != nil {
+		return nil, err
+	}
+	return let, nil
+}
+
+func (e letExpr) Eval(vars *Vars) (interface{}, error) {
+	scope := vars
+	for i, name := range e.names {
+		v, err := e.exprs[i].Eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		scope = scope.With(name, v)
+	}
+	return e.in.Eval(scope)
+}
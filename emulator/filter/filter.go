@@ -0,0 +1,636 @@
+// Package filter implements an evaluator for the mongo query language that
+// can be used to match documents against a query filter.
+package filter
+
+import (
+	"math"
+	"strings"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/emulator/expr"
+	"github.com/achilleasa/mongolite/protocol"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// predicate is implemented by compiled filter expressions.
+type predicate func(doc interface{}) bool
+
+// Matcher evaluates documents against a compiled query filter.
+type Matcher struct {
+	query bson.M
+	pred  predicate
+}
+
+// Compile parses a mongo query filter and returns a Matcher for it. An empty
+// or nil query yields a Matcher that matches all documents.
+func Compile(query bson.M) (*Matcher, error) {
+	return CompileWithVars(query, nil)
+}
+
+// CompileWithVars is like Compile but allows $expr clauses in the query to
+// reference the variables defined in vars.
+func CompileWithVars(query bson.M, vars *expr.Vars) (*Matcher, error) {
+	pred, err := compileQuery(query, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Matcher{query: query, pred: pred}, nil
+}
+
+// MustCompile is like Compile but panics if the query cannot be compiled.
+func MustCompile(query bson.M) *Matcher {
+	m, err := Compile(query)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// Query returns the query filter that was used to compile this Matcher.
+func (m *Matcher) Query() bson.M { return m.query }
+
+// Match returns true if doc satisfies the query filter.
+func (m *Matcher) Match(doc interface{}) bool {
+	return m.pred(doc)
+}
+
+// compileQuery compiles a query document into a predicate that returns true
+// if all its clauses match. The vars argument specifies the variables that
+// are visible to $expr clauses and may be nil.
+func compileQuery(query interface{}, vars *expr.Vars) (predicate, error) {
+	var preds []predicate
+	for _, elem := range bsonutil.Elements(query) {
+		var (
+			pred predicate
+			err  error
+		)
+
+		switch elem.Name {
+		case "$and", "$or", "$nor":
+			pred, err = compileLogicalOp(elem.Name, elem.Value, vars)
+		case "$comment":
+			continue
+		case "$expr":
+			pred, err = compileExpr(elem.Value, vars)
+		case "$where", "$text", "$jsonSchema":
+			return nil, protocol.ServerErrorf(protocol.CodeBadValue, "%s is not supported", elem.Name)
+		default:
+			if strings.HasPrefix(elem.Name, "$") {
+				return nil, protocol.ServerErrorf(protocol.CodeBadValue, "unknown top level operator: %s", elem.Name)
+			}
+			pred, err = compileFieldClause(elem.Name, elem.Value)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+		preds = append(preds, pred)
+	}
+
+	return allOf(preds), nil
+}
+
+// compileExpr compiles an $expr clause which matches documents for which an
+// aggregation expression evaluates to a truthy value. Documents for which the
+// expression fails to evaluate are not matched.
+func compileExpr(arg interface{}, vars *expr.Vars) (predicate, error) {
+	e, err := expr.Compile(arg)
+	if err != nil {
+		return nil, err
+	}
+
+	if vars == nil {
+		vars = new(expr.Vars)
+	}
+	return func(doc interface{}) bool {
+		v, err := e.Eval(vars.WithDocument(doc))
+		return err == nil && expr.Truthy(v)
+	}, nil
+}
+
+func compileLogicalOp(op string, arg interface{}, vars *expr.Vars) (predicate, error) {
+	if !bsonutil.IsArray(arg) {
+		return nil, protocol.ServerErrorf(protocol.CodeBadValue, "%s must be an array", op)
+	}
+
+	clauses := bsonutil.ToArray(arg)
+	if len(clauses) == 0 {
+		return nil, protocol.ServerErrorf(protocol.CodeBadValue, "%s/$or/$nor entries need to be full objects", op)
+	}
+
+	preds := make([]predicate, len(clauses))
+	for i, clause := range clauses {
+		if !bsonutil.IsDocument(clause) {
+			return nil, protocol.ServerErrorf(protocol.CodeBadValue, "%s/$or/$nor entries need to be full objects", op)
+		}
+
+		pred, err := compileQuery(clause, vars)
+		if err != nil {
+			return nil, err
+		}
+		preds[i] = pred
+	}
+
+	switch op {
+	case "$and":
+		return allOf(preds), nil
+	case "$or":
+		return anyOf(preds), nil
+	default: // $nor
+		matchAny := anyOf(preds)
+		return func(doc interface{}) bool { return !matchAny(doc) }, nil
+	}
+}
+
+// compileFieldClause compiles the query clause for a particular field path. The
+// clause can either be a document with query operators or a value which is
+// matched for equality.
+func compileFieldClause(path string, clause interface{}) (predicate, error) {
+	if !isOperatorDoc(clause) {
+		return valuePredicate(path, compileEq(clause)), nil
+	}
+
+	var (
+		preds   []predicate
+		elems   = bsonutil.Elements(clause)
+		options string
+	)
+
+	// The $options operator modifies the $regex operator
+	if opts, found := bsonutil.Get(clause, "$options"); found {
+		var isStr bool
+		if options, isStr = opts.(string); !isStr {
+			return nil, protocol.ServerErrorf(protocol.CodeBadValue, "$options has to be a string")
+		}
+	}
+
+	for _, elem := range elems {
+		op, arg := elem.Name, elem.Value
+
+		var (
+			pred predicate
+			err  error
+		)
+		switch op {
+		case "$options":
+			if _, hasRegex := bsonutil.Get(clause, "$regex"); !hasRegex {
+				return nil, protocol.ServerErrorf(protocol.CodeBadValue, "$options needs a $regex")
+			}
+			continue
+		case "$regex":
+			var match valueMatcher
+			if match, err = compileRegex(arg, options); err == nil {
+				pred = valuePredicate(path, match)
+			}
+		case "$not":
+			pred, err = compileNot(path, arg)
+		case "$elemMatch":
+			pred, err = compileElemMatch(path, arg)
+		case "$size":
+			pred, err = compileSize(path, arg)
+		case "$all":
+			pred, err = compileAll(path, arg)
+		case "$exists":
+			pred = compileExists(path, arg)
+		case "$ne", "$nin":
+			// These operators are the negation of $eq and $in.
+			positiveOp := "$eq"
+			if op == "$nin" {
+				positiveOp = "$in"
+			}
+
+			var match valueMatcher
+			if match, err = compileValueOp(positiveOp, arg); err == nil {
+				inner := valuePredicate(path, match)
+				pred = func(doc interface{}) bool { return !inner(doc) }
+			}
+		default:
+			var match valueMatcher
+			if match, err = compileValueOp(op, arg); err == nil {
+				pred = valuePredicate(path, match)
+			}
+		}
+
+		if err != nil {
+			return nil, err
+		}
+		preds = append(preds, pred)
+	}
+
+	return allOf(preds), nil
+}
+
+// compileNot compiles the $not operator which accepts either an operator
+// document or a regular expression.
+func compileNot(path string, arg interface{}) (predicate, error) {
+	var inner predicate
+	switch {
+	case isRegex(arg):
+		match, err := compileRegex(arg, "")
+		if err != nil {
+			return nil, err
+		}
+		inner = valuePredicate(path, match)
+	case isOperatorDoc(arg):
+		var err error
+		if inner, err = compileFieldClause(path, arg); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, protocol.ServerErrorf(protocol.CodeBadValue, "$not needs a regex or a document")
+	}
+
+	return func(doc interface{}) bool { return !inner(doc) }, nil
+}
+
+// compileElemMatch compiles an $elemMatch operator. The operator argument can
+// either be a set of query operators that are applied to each array element
+// or a full query that is applied to each array element that is a document.
+func compileElemMatch(path string, arg interface{}) (predicate, error) {
+	if !bsonutil.IsDocument(arg) {
+		return nil, protocol.ServerErrorf(protocol.CodeBadValue, "$elemMatch needs an Object")
+	}
+
+	var elemPred predicate
+	if isOperatorDoc(arg) && !isLogicalOpDoc(arg) {
+		// Apply operators to the elements themselves. We achieve this by
+		// wrapping each element in a document with a synthetic field.
+		fieldPred, err := compileFieldClause("elem", arg)
+		if err != nil {
+			return nil, err
+		}
+		elemPred = func(elem interface{}) bool {
+			return fieldPred(bson.M{"elem": elem})
+		}
+	} else {
+		queryPred, err := compileQuery(arg, nil)
+		if err != nil {
+			return nil, err
+		}
+		elemPred = func(elem interface{}) bool {
+			return bsonutil.IsDocument(elem) && queryPred(elem)
+		}
+	}
+
+	return func(doc interface{}) bool {
+		for _, v := range bsonutil.LookupValues(doc, path) {
+			if !bsonutil.IsArray(v) {
+				continue
+			}
+			for _, elem := range bsonutil.ToArray(v) {
+				if elemPred(elem) {
+					return true
+				}
+			}
+		}
+		return false
+	}, nil
+}
+
+func compileSize(path string, arg interface{}) (predicate, error) {
+	size, ok := bsonutil.ToInt64(arg)
+	if !ok {
+		return nil, protocol.ServerErrorf(protocol.CodeBadValue, "$size needs a number")
+	} else if size < 0 {
+		return nil, protocol.ServerErrorf(protocol.CodeBadValue, "$size may not be negative")
+	}
+
+	return func(doc interface{}) bool {
+		for _, v := range bsonutil.LookupValues(doc, path) {
+			if bsonutil.IsArray(v) && int64(len(bsonutil.ToArray(v))) == size {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func compileAll(path string, arg interface{}) (predicate, error) {
+	if !bsonutil.IsArray(arg) {
+		return nil, protocol.ServerErrorf(protocol.CodeBadValue, "$all needs an array")
+	}
+
+	var preds []predicate
+	for _, v := range bsonutil.ToArray(arg) {
+		// Each entry may either be a value or an $elemMatch expression.
+		if elemMatch, found := bsonutil.Get(v, "$elemMatch"); found && bsonutil.IsDocument(v) {
+			pred, err := compileElemMatch(path, elemMatch)
+			if err != nil {
+				return nil, err
+			}
+			preds = append(preds, pred)
+			continue
+		}
+
+		var match valueMatcher
+		if isRegex(v) {
+			var err error
+			if match, err = compileRegex(v, ""); err != nil {
+				return nil, err
+			}
+		} else {
+			match = compileEq(v)
+		}
+		preds = append(preds, valuePredicate(path, match))
+	}
+
+	// An empty $all list never matches.
+	if len(preds) == 0 {
+		return func(interface{}) bool { return false }, nil
+	}
+	return allOf(preds), nil
+}
+
+func compileExists(path string, arg interface{}) predicate {
+	want := truthy(arg)
+	return func(doc interface{}) bool {
+		return (len(bsonutil.LookupValues(doc, path)) != 0) == want
+	}
+}
+
+// valueMatcher returns true if a single value satisfies a query operator.
+type valueMatcher func(v interface{}) bool
+
+// valuePredicate returns a predicate that applies a valueMatcher to all
+// values that a path resolves to. If any of the values is an array, the
+// matcher is applied both to the array itself and its elements.
+func valuePredicate(path string, match valueMatcher) predicate {
+	return func(doc interface{}) bool {
+		vals := bsonutil.LookupValues(doc, path)
+		if len(vals) == 0 {
+			// Missing fields are treated as null values.
+			return match(nil)
+		}
+
+		for _, v := range vals {
+			if match(v) {
+				return true
+			}
+			if bsonutil.IsArray(v) {
+				for _, elem := range bsonutil.ToArray(v) {
+					if match(elem) {
+						return true
+					}
+				}
+			}
+		}
+		return false
+	}
+}
+
+func compileValueOp(op string, arg interface{}) (valueMatcher, error) {
+	switch op {
+	case "$eq":
+		return compileEq(arg), nil
+	case "$gt", "$gte", "$lt", "$lte":
+		return compileCmp(op, arg), nil
+	case "$in":
+		return compileIn(arg)
+	case "$type":
+		return compileType(arg)
+	case "$mod":
+		return compileMod(arg)
+	}
+
+	return nil, protocol.ServerErrorf(protocol.CodeBadValue, "unknown operator: %s", op)
+}
+
+func compileEq(arg interface{}) valueMatcher {
+	if isRegex(arg) {
+		// Regex values match both regex fields and strings.
+		re := arg.(bson.RegEx)
+		if match, err := compileRegex(arg, ""); err == nil {
+			return func(v interface{}) bool {
+				if other, isRe := v.(bson.RegEx); isRe {
+					return other == re
+				}
+				return match(v)
+			}
+		}
+	}
+
+	if bsonutil.IsNull(arg) {
+		return func(v interface{}) bool { return bsonutil.IsNull(v) }
+	}
+
+	return func(v interface{}) bool {
+		return bsonutil.SameTypeBracket(v, arg) && bsonutil.Equal(v, arg)
+	}
+}
+
+func compileCmp(op string, arg interface{}) valueMatcher {
+	var accept func(int) bool
+	switch op {
+	case "$gt":
+		accept = func(c int) bool { return c > 0 }
+	case "$gte":
+		accept = func(c int) bool { return c >= 0 }
+	case "$lt":
+		accept = func(c int) bool { return c < 0 }
+	default: // $lte
+		accept = func(c int) bool { return c <= 0 }
+	}
+
+	return func(v interface{}) bool {
+		// MinKey and MaxKey compare against all types.
+		if arg == bson.MinKey || arg == bson.MaxKey {
+			return accept(bsonutil.Compare(v, arg))
+		}
+
+		// Missing values only match $gte/$lte null queries.
+		if !bsonutil.SameTypeBracket(v, arg) {
+			return false
+		}
+		return accept(bsonutil.Compare(v, arg))
+	}
+}
+
+func compileIn(arg interface{}) (valueMatcher, error) {
+	if !bsonutil.IsArray(arg) {
+		return nil, protocol.ServerErrorf(protocol.CodeBadValue, "$in needs an array")
+	}
+
+	var matchers []valueMatcher
+	for _, v := range bsonutil.ToArray(arg) {
+		if bsonutil.IsDocument(v) && isOperatorDoc(v) {
+			return nil, protocol.ServerErrorf(protocol.CodeBadValue, "cannot nest $ under $in")
+		}
+		matchers = append(matchers, compileEq(v))
+	}
+
+	return func(v interface{}) bool {
+		for _, match := range matchers {
+			if match(v) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func compileType(arg interface{}) (valueMatcher, error) {
+	var types []interface{}
+	if bsonutil.IsArray(arg) {
+		types = bsonutil.ToArray(arg)
+	} else {
+		types = []interface{}{arg}
+	}
+
+	var (
+		wantNumbers bool
+		wantTypes   = make(map[int]bool)
+	)
+	for _, t := range types {
+		switch tv := t.(type) {
+		case string:
+			if tv == "number" {
+				wantNumbers = true
+				continue
+			}
+			typeNum, known := bsonutil.TypeNumberForAlias(tv)
+			if !known {
+				return nil, protocol.ServerErrorf(protocol.CodeBadValue, "unknown type name alias: %s", tv)
+			}
+			wantTypes[typeNum] = true
+		default:
+			typeNum, isNum := bsonutil.ToInt64(t)
+			if !isNum {
+				return nil, protocol.ServerErrorf(protocol.CodeBadValue, "type must be represented as a number or a string")
+			}
+			wantTypes[int(typeNum)] = true
+		}
+	}
+
+	return func(v interface{}) bool {
+		if wantNumbers && bsonutil.IsNumber(v) {
+			return true
+		}
+		return wantTypes[bsonutil.TypeNumber(v)]
+	}, nil
+}
+
+func compileMod(arg interface{}) (valueMatcher, error) {
+	args := bsonutil.ToArray(arg)
+	if len(args) != 2 {
+		return nil, protocol.ServerErrorf(protocol.CodeBadValue, "malformed mod, needs to be an array of 2 elements")
+	}
+
+	divisor, okDiv := bsonutil.ToFloat64(args[0])
+	remainder, okRem := bsonutil.ToFloat64(args[1])
+	if !okDiv || !okRem {
+		return nil, protocol.ServerErrorf(protocol.CodeBadValue, "malformed mod, divisor and remainder must be numbers")
+	} else if int64(divisor) == 0 {
+		return nil, protocol.ServerErrorf(protocol.CodeBadValue, "divisor cannot be 0")
+	}
+
+	d, r := int64(divisor), int64(remainder)
+	return func(v interface{}) bool {
+		f, isNum := bsonutil.ToFloat64(v)
+		if !isNum || math.IsNaN(f) || math.IsInf(f, 0) {
+			return false
+		}
+		return int64(f)%d == r
+	}, nil
+}
+
+func compileRegex(arg interface{}, options string) (valueMatcher, error) {
+	var pattern string
+	switch re := arg.(type) {
+	case string:
+		pattern = re
+	case bson.RegEx:
+		pattern = re.Pattern
+		if options == "" {
+			options = re.Options
+		}
+	default:
+		return nil, protocol.ServerErrorf(protocol.CodeBadValue, "$regex has to be a string")
+	}
+
+	re, err := bsonutil.CompileRegex(pattern, options)
+	if err != nil {
+		return nil, protocol.ServerErrorf(protocol.CodeBadValue, "invalid regular expression %q: %v", pattern, err)
+	}
+
+	return func(v interface{}) bool {
+		switch s := v.(type) {
+		case string:
+			return re.MatchString(s)
+		case bson.Symbol:
+			return re.MatchString(string(s))
+		}
+		return false
+	}, nil
+}
+
+// isOperatorDoc returns true if v is a document whose first field is a query
+// operator.
+func isOperatorDoc(v interface{}) bool {
+	elems := bsonutil.Elements(v)
+	return len(elems) != 0 && strings.HasPrefix(elems[0].Name, "$")
+}
+
+// isLogicalOpDoc returns true if v is a document which contains a top-level
+// logical operator.
+func isLogicalOpDoc(v interface{}) bool {
+	for _, elem := range bsonutil.Elements(v) {
+		switch elem.Name {
+		case "$and", "$or", "$nor":
+			return true
+		}
+	}
+	return false
+}
+
+func isRegex(v interface{}) bool {
+	_, isRe := v.(bson.RegEx)
+	return isRe
+}
+
+// truthy returns true if v evaluates to true using the mongo rules for
+// boolean coercion.
+func truthy(v interface{}) bool {
+	switch val := v.(type) {
+	case bool:
+		return val
+	case nil:
+		return false
+	}
+	if v == bson.Undefined {
+		return false
+	}
+	if f, isNum := bsonutil.ToFloat64(v); isNum {
+		return f != 0
+	}
+	return true
+}
+
+func allOf(preds []predicate) predicate {
+	switch len(preds) {
+	case 0:
+		return func(interface{}) bool { return true }
+	case 1:
+		return preds[0]
+	}
+
+	return func(doc interface{}) bool {
+		for _, pred := range preds {
+			if !pred(doc) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func anyOf(preds []predicate) predicate {
+	return func(doc interface{}) bool {
+		for _, pred := range preds {
+			if pred(doc) {
+				return true
+			}
+		}
+		return false
+	}
+}
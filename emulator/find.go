@@ -0,0 +1,118 @@
+package emulator
+
+import (
+	"sync/atomic"
+
+	"github.com/achilleasa/mongolite/emulator/aggregate"
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/protocol"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// maybeProcessFind services query requests that the emulator evaluates itself
+// instead of forwarding them to the backend. This is the case for queries
+// that can be answered by scanning one of the indexes of an IndexScanBackend.
+// Such queries are sorted by the emulator and, like aggregations, fail if the
+// sort exceeds the blocking memory limit unless the query allows disk use.
+// The handled return value is false if the request should be forwarded to the
+// backend instead.
+func (emu *MongoEmulator) maybeProcessFind(clientID string, req protocol.Request) (res protocol.Response, handled bool, err error) {
+	r, isQuery := req.(*protocol.QueryRequest)
+	if !isQuery || hasNaturalSort(r.Sort) {
+		return protocol.Response{}, false, nil
+	}
+
+	src := &backendSource{b: emu.b, clientID: clientID, origin: r}
+	if _, plan, err := src.planQuery(r.Collection, r.Query); err != nil {
+		return protocol.Response{}, true, err
+	} else if plan == nil {
+		return protocol.Response{}, false, nil
+	}
+
+	// Find commands interpret numToReturn as a limit whereas legacy
+	// queries interpret it as the size of the first batch. In both cases
+	// a negative value requests a single batch with up to that many
+	// documents.
+	var (
+		limit       = int64(r.NumToReturn)
+		batchSize   = defaultBatchSize
+		singleBatch = limit < 0
+	)
+	if singleBatch {
+		limit = -limit
+	} else if r.GetReplyType() != protocol.ReplyTypeOpMsg {
+		if limit != 0 {
+			batchSize = int(limit)
+		}
+		limit = 0
+	}
+
+	pipeline, err := aggregate.Parse(findPipeline(r, limit))
+	if err != nil {
+		return protocol.Response{}, true, err
+	}
+	env, err := aggregate.NewEnv(r.Collection, src, nil)
+	if err != nil {
+		return protocol.Response{}, true, err
+	}
+	env.AllowDiskUse = r.AllowDiskUse
+	env.MemoryLimit = atomic.LoadInt64(&emu.blockingMemoryLimit)
+	env.TempDir = emu.tempDir
+
+	docs, err := pipeline.Run(env)
+	if err != nil {
+		return protocol.Response{}, true, err
+	}
+	if singleBatch {
+		batchSize = len(docs)
+	}
+
+	// Find commands receive a cursor document whereas legacy queries
+	// receive the documents in the reply itself.
+	if r.GetReplyType() == protocol.ReplyTypeOpMsg {
+		return emu.newCursor(r.Collection, docs, batchSize), true, nil
+	}
+	var cursorID int64
+	if len(docs) > batchSize {
+		cursorID = emu.cursors.register(r.Collection, docs[batchSize:])
+		docs = docs[:batchSize]
+	}
+	batch := make([]bson.M, len(docs))
+	for i, doc := range docs {
+		batch[i] = bsonutil.ToMap(doc)
+	}
+	return protocol.Response{CursorID: cursorID, Documents: batch}, true, nil
+}
+
+// findPipeline returns the aggregation pipeline that evaluates a query
+// request, returning at most limit documents if limit is non-zero.
+func findPipeline(r *protocol.QueryRequest, limit int64) []bson.D {
+	var stages []bson.D
+	if len(r.Query) != 0 {
+		stages = append(stages, bson.D{{Name: "$match", Value: r.Query}})
+	}
+	if len(r.Sort) != 0 {
+		stages = append(stages, bson.D{{Name: "$sort", Value: r.Sort}})
+	}
+	if r.NumToSkip > 0 {
+		stages = append(stages, bson.D{{Name: "$skip", Value: int64(r.NumToSkip)}})
+	}
+	if limit > 0 {
+		stages = append(stages, bson.D{{Name: "$limit", Value: limit}})
+	}
+	if len(r.FieldSelector) != 0 {
+		stages = append(stages, bson.D{{Name: "$project", Value: r.FieldSelector}})
+	}
+	return stages
+}
+
+// hasNaturalSort returns true if a sort specification requests the natural
+// order of the collection which is only known to the backend.
+func hasNaturalSort(spec bson.D) bool {
+	for _, elem := range spec {
+		if elem.Name == "$natural" {
+			return true
+		}
+	}
+	return false
+}
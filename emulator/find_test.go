@@ -0,0 +1,155 @@
+package emulator
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/achilleasa/mongolite/protocol"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestIndexSelection(t *testing.T) {
+	b := newScanBackend()
+	emu := newTestEmulator(t, b)
+	mustProcess(t, emu, &protocol.CreateIndexesRequest{
+		RequestInfo: cmdInfo(protocol.RequestTypeCreateIndexes),
+		Collection:  testCol,
+		Indexes:     []protocol.IndexSpec{{Name: "a_1", Key: bson.D{{Name: "a", Value: 1}}}},
+	})
+	insertDocs(t, emu, testCol,
+		bson.M{"_id": 1, "a": 1, "b": "x"},
+		bson.M{"_id": 2, "a": 2, "b": "y"},
+		bson.M{"_id": 3, "a": 2, "b": "z"},
+	)
+
+	specs := []struct {
+		descr    string
+		req      protocol.Request
+		expScans []string
+		check    func(t *testing.T, reply bson.M)
+	}{
+		{
+			descr: "find on indexed field",
+			req: &protocol.QueryRequest{
+				RequestInfo: cmdInfo(protocol.RequestTypeQuery),
+				Collection:  testCol,
+				Query:       bson.M{"a": 2, "b": "z"},
+			},
+			expScans: []string{"a_1"},
+			check: func(t *testing.T, reply bson.M) {
+				if got := ids(firstBatch(t, reply)); !reflect.DeepEqual(got, []interface{}{3}) {
+					t.Fatalf("expected _id [3]; got %v", got)
+				}
+			},
+		},
+		{
+			descr: "find on _id",
+			req: &protocol.QueryRequest{
+				RequestInfo: cmdInfo(protocol.RequestTypeQuery),
+				Collection:  testCol,
+				Query:       bson.M{"_id": bson.M{"$in": []interface{}{1, 3}}},
+				Sort:        bson.D{{Name: "_id", Value: -1}},
+			},
+			expScans: []string{"_id_"},
+			check: func(t *testing.T, reply bson.M) {
+				if got := ids(firstBatch(t, reply)); !reflect.DeepEqual(got, []interface{}{3, 1}) {
+					t.Fatalf("expected _id [3 1]; got %v", got)
+				}
+			},
+		},
+		{
+			descr: "find on unindexed field",
+			req: &protocol.QueryRequest{
+				RequestInfo: cmdInfo(protocol.RequestTypeQuery),
+				Collection:  testCol,
+				Query:       bson.M{"b": "y"},
+			},
+			check: func(t *testing.T, reply bson.M) {
+				if got := reply["_id"]; got != 2 {
+					t.Fatalf("expected backend reply with _id 2; got %v", reply)
+				}
+			},
+		},
+		{
+			descr: "count on indexed field",
+			req: &protocol.CountRequest{
+				RequestInfo: cmdInfo(protocol.RequestTypeCount),
+				Collection:  testCol,
+				Query:       bson.M{"a": bson.M{"$gte": 2}},
+			},
+			expScans: []string{"a_1"},
+			check: func(t *testing.T, reply bson.M) {
+				if got := asInt(reply["n"]); got != 2 {
+					t.Fatalf("expected count 2; got %d", got)
+				}
+			},
+		},
+		{
+			descr: "aggregate with leading $match on indexed field",
+			req: &protocol.AggregateRequest{
+				RequestInfo: cmdInfo(protocol.RequestTypeAggregate),
+				Collection:  testCol,
+				Pipeline: []bson.D{
+					{{Name: "$match", Value: bson.M{"a": 1}}},
+					{{Name: "$project", Value: bson.M{"b": 1}}},
+				},
+			},
+			expScans: []string{"a_1"},
+			check: func(t *testing.T, reply bson.M) {
+				exp := []bson.D{{{Name: "_id", Value: 1}, {Name: "b", Value: "x"}}}
+				if got := firstBatch(t, reply); !reflect.DeepEqual(got, exp) {
+					t.Fatalf("expected %v; got %v", exp, got)
+				}
+			},
+		},
+	}
+
+	for _, spec := range specs {
+		t.Run(spec.descr, func(t *testing.T) {
+			before := len(b.scanned())
+			spec.check(t, mustProcess(t, emu, spec.req))
+			if got := b.scanned()[before:]; fmt.Sprint(got) != fmt.Sprint(spec.expScans) {
+				t.Fatalf("expected index scans %v; got %v", spec.expScans, got)
+			}
+		})
+	}
+}
+
+func TestFindSortMemoryLimit(t *testing.T) {
+	b := newScanBackend()
+	emu := newTestEmulator(t, b)
+	if err := emu.SetBlockingMemoryLimit(64); err != nil {
+		t.Fatal(err)
+	}
+	if err := emu.SetTempDir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	insertDocs(t, emu, testCol,
+		bson.M{"_id": 1, "b": "z"},
+		bson.M{"_id": 2, "b": "x"},
+		bson.M{"_id": 3, "b": "y"},
+	)
+
+	find := func(allowDiskUse bool) (protocol.Response, error) {
+		return emu.process("client", &protocol.QueryRequest{
+			RequestInfo:  cmdInfo(protocol.RequestTypeQuery),
+			Collection:   testCol,
+			Query:        bson.M{"_id": bson.M{"$gte": 1}},
+			Sort:         bson.D{{Name: "b", Value: 1}},
+			AllowDiskUse: allowDiskUse,
+		})
+	}
+
+	if _, err := find(false); !hasErrorCode(err, protocol.CodeQueryExceededMemoryLimitNoDiskUseAllowed) {
+		t.Fatalf("expected a QueryExceededMemoryLimitNoDiskUseAllowed error; got %v", err)
+	}
+
+	res, err := find(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(firstBatch(t, res.Documents[0])); !reflect.DeepEqual(got, []interface{}{2, 3, 1}) {
+		t.Fatalf("expected _id [2 3 1]; got %v", got)
+	}
+}
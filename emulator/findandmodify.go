@@ -0,0 +1,315 @@
+package emulator
+
+import (
+	"github.com/achilleasa/mongolite/emulator/aggregate"
+	"github.com/achilleasa/mongolite/emulator/filter"
+	"github.com/achilleasa/mongolite/emulator/update"
+	"github.com/achilleasa/mongolite/protocol"
+	"golang.org/x/xerrors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// FindAndModifyBackend is implemented by backends that can atomically select
+// and modify a single document (e.g. by running both steps within a single
+// SQL transaction).
+//
+// When a backend does not implement this interface, the emulator finds the
+// document via a query request and modifies it via a separate write request.
+// If the backend implements TransactionBackend, both requests are executed
+// within an internal transaction. Otherwise, the emulator only serializes
+// these steps with the other writes that it executes itself; writes that are
+// applied to the backend by other processes (e.g. a second emulator sharing
+// the same database) may interleave with them. In both cases the emulator
+// enforces the constraints of the collection indexes. Backends implementing
+// this interface are responsible for enforcing them.
+type FindAndModifyBackend interface {
+	Backend
+
+	// FindAndUpdate applies the request update to the first document that
+	// matches the request query in the request sort order, or inserts a
+	// new document if no document matches and the request specifies an
+	// upsert. The returned value is the document before the update unless
+	// the request asks for the updated document. The value must not be
+	// projected by the backend.
+	FindAndUpdate(clientID string, req *protocol.FindAndUpdateRequest) (FindAndModifyResult, error)
+
+	// FindAndDelete deletes the first document that matches the request
+	// query in the request sort order and returns it back as the result
+	// value. The value must not be projected by the backend.
+	FindAndDelete(clientID string, req *protocol.FindAndDeleteRequest) (FindAndModifyResult, error)
+}
+
+// FindAndModifyResult describes the outcome of a findAndModify request.
+type FindAndModifyResult struct {
+	// The returned document or nil if no document was modified.
+	Value bson.D
+
+	// The number of documents that were modified (0 or 1).
+	N int
+
+	// True if the update modified an existing document.
+	UpdatedExisting bool
+
+	// The _id of the document inserted by an upsert or nil.
+	Upserted interface{}
+}
+
+func (emu *MongoEmulator) handleFindAndUpdate(clientID string, r protocol.Request) (protocol.Response, error) {
+	req := r.(*protocol.FindAndUpdateRequest)
+
+	// Validate the request even when the backend executes it so that
+	// clients receive the same errors in all cases.
+	matcher, sortSpec, err := compileFindAndModifyQuery(req.Query, req.Sort)
+	if err != nil {
+		return protocol.Response{}, err
+	}
+	u, err := update.Parse(req.Update, req.ArrayFilters)
+	if err != nil {
+		return protocol.Response{}, err
+	}
+
+	var res FindAndModifyResult
+	if fb, ok := emu.b.(FindAndModifyBackend); ok {
+		res, err = fb.FindAndUpdate(clientID, req)
+	} else {
+		txnReq := *req
+		emu.writeMu.Lock()
+		err = emu.runInternalTxn(clientID, &txnReq.RequestInfo, func() (err error) {
+			res, err = emu.findAndUpdate(clientID, &txnReq, matcher, sortSpec, u)
+			return err
+		})
+		emu.writeMu.Unlock()
+	}
+	emu.capped.discardUsage(req.Collection)
+	if err != nil {
+		return protocol.Response{}, err
+	}
+
+	if res.N != 0 && emu.oplogEnabled(clientID, req.Collection) {
+		var entries []bson.D
+		if res.Upserted == nil {
+			id, updated := res.Value.Map()["_id"], res.Value
+			if !req.ReturnUpdatedDoc {
+				updated = emu.findByID(clientID, req, req.Collection, id)
+			}
+			if updated != nil {
+				entries = append(entries, updateOplogEntry(req.Collection, id, u, updated))
+			}
+		} else if doc := emu.findByID(clientID, req, req.Collection, res.Upserted); doc != nil {
+			entries = append(entries, insertOplogEntry(req.Collection, doc))
+		}
+		emu.appendOplog(clientID, req, entries)
+	}
+
+	lastErrorObject := bson.M{"n": res.N, "updatedExisting": res.UpdatedExisting}
+	if res.Upserted != nil {
+		lastErrorObject["upserted"] = res.Upserted
+	}
+	return emu.findAndModifyResponse(clientID, req, req.Collection, req.FieldSelector, lastErrorObject, res.Value)
+}
+
+// findAndUpdate implements the update variant of findAndModify for backends
+// that do not implement FindAndModifyBackend.
+func (emu *MongoEmulator) findAndUpdate(clientID string, req *protocol.FindAndUpdateRequest, matcher *filter.Matcher, sortSpec aggregate.SortSpec, u *update.Update) (FindAndModifyResult, error) {
+	doc, err := emu.findFirst(clientID, req, req.Collection, matcher, sortSpec)
+	if err != nil {
+		return FindAndModifyResult{}, err
+	}
+	specs, err := emu.collectionIndexes(clientID, req.Collection)
+	if err != nil {
+		return FindAndModifyResult{}, err
+	}
+
+	if doc == nil {
+		if !req.Upsert {
+			return FindAndModifyResult{}, nil
+		}
+
+		inserted, err := u.UpsertDocument(req.Query)
+		if err != nil {
+			return FindAndModifyResult{}, err
+		}
+		if err := emu.checkIndexKeys(clientID, req, req.Collection, specs, []bson.M{inserted.Map()}, nil); err != nil {
+			return FindAndModifyResult{}, err
+		}
+		_, err = emu.execSingleWrite(clientID, &protocol.InsertRequest{
+			RequestInfo: derivedRequestInfo(req, protocol.RequestTypeInsert, protocol.ReplyTypeOpMsg),
+			Collection:  req.Collection,
+			Inserts:     []bson.M{inserted.Map()},
+		})
+		if err != nil {
+			return FindAndModifyResult{}, xerrors.Errorf("unable to upsert document into %q: %w", req.Collection.String(), err)
+		}
+
+		res := FindAndModifyResult{N: 1, Upserted: inserted.Map()["_id"]}
+		if req.ReturnUpdatedDoc {
+			res.Value = inserted
+		}
+		return res, nil
+	}
+
+	updated, err := u.Apply(doc, false)
+	if err != nil {
+		return FindAndModifyResult{}, err
+	}
+	id := doc.Map()["_id"]
+	if err := emu.checkIndexKeys(clientID, req, req.Collection, specs, []bson.M{updated.Map()}, []interface{}{id}); err != nil {
+		return FindAndModifyResult{}, err
+	}
+	_, err = emu.execSingleWrite(clientID, &protocol.UpdateRequest{
+		RequestInfo: derivedRequestInfo(req, protocol.RequestTypeUpdate, protocol.ReplyTypeOpMsg),
+		Collection:  req.Collection,
+		Updates: []protocol.UpdateTarget{{
+			Selector: bson.M{"_id": id},
+			Update:   updated.Map(),
+		}},
+	})
+	if err != nil {
+		return FindAndModifyResult{}, xerrors.Errorf("unable to update document in %q: %w", req.Collection.String(), err)
+	}
+
+	res := FindAndModifyResult{Value: doc, N: 1, UpdatedExisting: true}
+	if req.ReturnUpdatedDoc {
+		res.Value = updated
+	}
+	return res, nil
+}
+
+func (emu *MongoEmulator) handleFindAndDelete(clientID string, r protocol.Request) (protocol.Response, error) {
+	req := r.(*protocol.FindAndDeleteRequest)
+
+	matcher, sortSpec, err := compileFindAndModifyQuery(req.Query, req.Sort)
+	if err != nil {
+		return protocol.Response{}, err
+	}
+
+	var res FindAndModifyResult
+	if fb, ok := emu.b.(FindAndModifyBackend); ok {
+		res, err = fb.FindAndDelete(clientID, req)
+	} else {
+		txnReq := *req
+		emu.writeMu.Lock()
+		err = emu.runInternalTxn(clientID, &txnReq.RequestInfo, func() (err error) {
+			res, err = emu.findAndDelete(clientID, &txnReq, matcher, sortSpec)
+			return err
+		})
+		emu.writeMu.Unlock()
+	}
+	emu.capped.discardUsage(req.Collection)
+	if err != nil {
+		return protocol.Response{}, err
+	}
+
+	if res.N != 0 && emu.oplogEnabled(clientID, req.Collection) {
+		emu.appendOplog(clientID, req, []bson.D{deleteOplogEntry(req.Collection, res.Value.Map()["_id"])})
+	}
+
+	return emu.findAndModifyResponse(clientID, req, req.Collection, req.FieldSelector, bson.M{"n": res.N}, res.Value)
+}
+
+// findAndDelete implements the remove variant of findAndModify for backends
+// that do not implement FindAndModifyBackend.
+func (emu *MongoEmulator) findAndDelete(clientID string, req *protocol.FindAndDeleteRequest, matcher *filter.Matcher, sortSpec aggregate.SortSpec) (FindAndModifyResult, error) {
+	doc, err := emu.findFirst(clientID, req, req.Collection, matcher, sortSpec)
+	if err != nil || doc == nil {
+		return FindAndModifyResult{}, err
+	}
+
+	_, err = emu.execSingleWrite(clientID, &protocol.DeleteRequest{
+		RequestInfo: derivedRequestInfo(req, protocol.RequestTypeDelete, protocol.ReplyTypeOpMsg),
+		Collection:  req.Collection,
+		Deletes: []protocol.DeleteTarget{{
+			Selector: bson.M{"_id": doc.Map()["_id"]},
+			Limit:    1,
+		}},
+	})
+	if err != nil {
+		return FindAndModifyResult{}, xerrors.Errorf("unable to delete document from %q: %w", req.Collection.String(), err)
+	}
+	return FindAndModifyResult{Value: doc, N: 1}, nil
+}
+
+// compileFindAndModifyQuery compiles the query and the (optional) sort order
+// of a findAndModify request.
+func compileFindAndModifyQuery(query bson.M, sort bson.D) (*filter.Matcher, aggregate.SortSpec, error) {
+	matcher, err := filter.Compile(query)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(sort) == 0 {
+		return matcher, nil, nil
+	}
+
+	sortSpec, err := aggregate.ParseSort(sort)
+	if err != nil {
+		return nil, nil, err
+	}
+	return matcher, sortSpec, nil
+}
+
+// findFirst returns the first document in col that is matched by matcher in
+// the order specified by sortSpec. It returns nil if no document matches.
+func (emu *MongoEmulator) findFirst(clientID string, origin protocol.Request, col protocol.NamespacedCollection, matcher *filter.Matcher, sortSpec aggregate.SortSpec) (bson.D, error) {
+	src := &backendSource{b: emu.b, clientID: clientID, origin: origin}
+	docs, err := src.Find(col, matcher.Query())
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []bson.D
+	for _, doc := range docs {
+		if matcher.Match(doc) {
+			matched = append(matched, doc)
+		}
+	}
+	if len(matched) == 0 {
+		return nil, nil
+	}
+
+	if sortSpec != nil {
+		sortSpec.Sort(matched)
+	}
+	return matched[0], nil
+}
+
+// findAndModifyResponse projects the value of a findAndModify request using
+// fieldSelector and returns the command reply.
+func (emu *MongoEmulator) findAndModifyResponse(clientID string, origin protocol.Request, col protocol.NamespacedCollection, fieldSelector bson.M, lastErrorObject bson.M, value bson.D) (protocol.Response, error) {
+	var out interface{}
+	if value != nil {
+		out = value
+		if len(fieldSelector) != 0 {
+			projected, err := emu.project(clientID, origin, col, fieldSelector, value)
+			if err != nil {
+				return protocol.Response{}, err
+			}
+			out = projected
+		}
+	}
+
+	return protocol.Response{
+		Documents: []bson.M{{
+			"lastErrorObject": lastErrorObject,
+			"value":           out,
+			"ok":              1,
+		}},
+	}, nil
+}
+
+// project applies a find projection to doc.
+func (emu *MongoEmulator) project(clientID string, origin protocol.Request, col protocol.NamespacedCollection, fieldSelector bson.M, doc bson.D) (bson.D, error) {
+	pipeline, err := aggregate.Parse([]bson.D{{{Name: "$project", Value: fieldSelector}}})
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := aggregate.NewEnv(col, &backendSource{b: emu.b, clientID: clientID, origin: origin}, nil)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := pipeline.Process(env, []bson.D{doc})
+	if err != nil {
+		return nil, err
+	}
+	return docs[0], nil
+}
@@ -0,0 +1,164 @@
+package emulator
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/achilleasa/mongolite/protocol"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// txnBackend extends memBackend with a TransactionBackend implementation that
+// records the transaction lifecycle and the transactions of the requests it
+// receives. It does not isolate the writes of transactions.
+type txnBackend struct {
+	*memBackend
+
+	txnMu  sync.Mutex
+	events []string
+}
+
+func newTxnBackend() *txnBackend {
+	return &txnBackend{memBackend: newMemBackend()}
+}
+
+func (b *txnBackend) record(event string) {
+	b.txnMu.Lock()
+	b.events = append(b.events, event)
+	b.txnMu.Unlock()
+}
+
+func (b *txnBackend) HandleRequest(clientID string, req protocol.Request) (protocol.Response, error) {
+	event := string(req.GetType())
+	if txnID, ok := NewTxnID(req); ok {
+		event += fmt.Sprintf("@%s/%d", txnID.Session.String(), txnID.Number)
+	}
+	b.record(event)
+	return b.memBackend.HandleRequest(clientID, req)
+}
+
+func (b *txnBackend) StartTransaction(clientID string, txn TxnID) error {
+	b.record(fmt.Sprintf("start@%s/%d", txn.Session.String(), txn.Number))
+	return nil
+}
+
+func (b *txnBackend) CommitTransaction(clientID string, txn TxnID) error {
+	b.record(fmt.Sprintf("commit@%s/%d", txn.Session.String(), txn.Number))
+	return nil
+}
+
+func (b *txnBackend) AbortTransaction(clientID string, txn TxnID) error {
+	b.record(fmt.Sprintf("abort@%s/%d", txn.Session.String(), txn.Number))
+	return nil
+}
+
+// recorded returns the events recorded since the most recent transaction was
+// started with the transaction suffix stripped. It returns false if any of
+// these events does not belong to that transaction. The recording is reset.
+func (b *txnBackend) recorded() ([]string, bool) {
+	b.txnMu.Lock()
+	defer b.txnMu.Unlock()
+	events := b.events
+	b.events = nil
+
+	start := -1
+	for i, event := range events {
+		if strings.HasPrefix(event, "start@") {
+			start = i
+		}
+	}
+	if start == -1 {
+		return nil, false
+	}
+
+	txn := strings.TrimPrefix(events[start], "start")
+	var stripped []string
+	for _, event := range events[start:] {
+		if !strings.HasSuffix(event, txn) {
+			return events, false
+		}
+		stripped = append(stripped, strings.TrimSuffix(event, txn))
+	}
+	return stripped, true
+}
+
+func TestFindAndModifyInternalTransaction(t *testing.T) {
+	b := newTxnBackend()
+	emu := newTestEmulator(t, b)
+	mustProcess(t, emu, &protocol.CreateIndexesRequest{
+		RequestInfo: cmdInfo(protocol.RequestTypeCreateIndexes),
+		Collection:  testCol,
+		Indexes:     []protocol.IndexSpec{{Name: "a_1", Key: bson.D{{Name: "a", Value: 1}}, Unique: true}},
+	})
+	insertDocs(t, emu, testCol, bson.M{"_id": 1, "a": 1}, bson.M{"_id": 2, "a": 2})
+
+	specs := []struct {
+		descr     string
+		req       protocol.Request
+		expEvents []string
+	}{
+		{
+			descr: "update",
+			req: &protocol.FindAndUpdateRequest{
+				RequestInfo: cmdInfo(protocol.RequestTypeFindAndUpdate),
+				Collection:  testCol,
+				Query:       bson.M{"_id": 1},
+				Update:      bson.M{"$set": bson.M{"b": 1}},
+			},
+			// The second query checks the unique index.
+			expEvents: []string{"start", "query", "query", "update", "commit"},
+		},
+		{
+			descr: "delete",
+			req: &protocol.FindAndDeleteRequest{
+				RequestInfo: cmdInfo(protocol.RequestTypeFindAndDelete),
+				Collection:  testCol,
+				Query:       bson.M{"_id": 1},
+			},
+			expEvents: []string{"start", "query", "delete", "commit"},
+		},
+	}
+
+	for _, spec := range specs {
+		t.Run(spec.descr, func(t *testing.T) {
+			b.recorded()
+			if _, err := emu.process("client", spec.req); err != nil {
+				t.Fatal(err)
+			}
+
+			events, ok := b.recorded()
+			if !ok || fmt.Sprint(events) != fmt.Sprint(spec.expEvents) {
+				t.Fatalf("expected internal transaction events %v; got %v", spec.expEvents, events)
+			}
+		})
+	}
+}
+
+func TestFindAndModifyInternalTransactionAbort(t *testing.T) {
+	b := newTxnBackend()
+	emu := newTestEmulator(t, b)
+	mustProcess(t, emu, &protocol.CreateIndexesRequest{
+		RequestInfo: cmdInfo(protocol.RequestTypeCreateIndexes),
+		Collection:  testCol,
+		Indexes:     []protocol.IndexSpec{{Name: "a_1", Key: bson.D{{Name: "a", Value: 1}}, Unique: true}},
+	})
+	insertDocs(t, emu, testCol, bson.M{"_id": 1, "a": 1}, bson.M{"_id": 2, "a": 2})
+	b.recorded()
+
+	_, err := emu.process("client", &protocol.FindAndUpdateRequest{
+		RequestInfo: cmdInfo(protocol.RequestTypeFindAndUpdate),
+		Collection:  testCol,
+		Query:       bson.M{"_id": 2},
+		Update:      bson.M{"$set": bson.M{"a": 1}},
+	})
+	if !hasErrorCode(err, protocol.CodeDuplicateKey) {
+		t.Fatalf("expected a duplicate key error; got %v", err)
+	}
+
+	events, ok := b.recorded()
+	if exp := []string{"start", "query", "query", "abort"}; !ok || fmt.Sprint(events) != fmt.Sprint(exp) {
+		t.Fatalf("expected internal transaction events %v; got %v", exp, events)
+	}
+}
@@ -0,0 +1,224 @@
+package index
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/emulator/filter"
+	"github.com/achilleasa/mongolite/protocol"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ExtractKeys returns the keys that an index stores for doc. Missing fields
+// are indexed as null values.
+//
+// If one of the indexed fields resolves to an array, the index is multikey
+// and a separate key is returned for each array element. Mongo only allows a
+// single array-valued field per compound index; if more than one of the
+// indexed fields resolves to an array, ExtractKeys returns a
+// CannotIndexParallelArrays server error.
+//
+// The second result is false if the document is not referenced by the index,
+// i.e. it lacks all the indexed fields and the index is sparse or it does not
+// match the index's partial filter expression.
+func ExtractKeys(spec protocol.IndexSpec, doc bson.M) ([]bson.D, bool, error) {
+	var (
+		fieldValues = make([][]interface{}, len(spec.Key))
+		arrayField  = -1
+		foundField  bool
+	)
+	for i, elem := range spec.Key {
+		values, isArray := keyValues(doc, elem.Name)
+		if isArray {
+			if arrayField != -1 {
+				return nil, false, protocol.ServerErrorf(
+					protocol.CodeCannotIndexParallelArrays,
+					"cannot index parallel arrays [%s] [%s]",
+					spec.Key[arrayField].Name, elem.Name,
+				)
+			}
+			arrayField = i
+		}
+
+		if len(values) == 0 {
+			values = []interface{}{nil}
+		} else {
+			foundField = true
+		}
+		fieldValues[i] = values
+	}
+
+	if spec.Sparse && !foundField {
+		return nil, false, nil
+	}
+
+	if spec.PartialFilterExpression != nil {
+		// Partial filters are validated when the index is created.
+		m, err := filter.Compile(spec.PartialFilterExpression)
+		if err != nil || !m.Match(doc) {
+			return nil, false, nil
+		}
+	}
+
+	// At most one field can yield multiple values so the number of keys
+	// is equal to the number of values for that field.
+	numKeys := 1
+	if arrayField != -1 {
+		numKeys = len(fieldValues[arrayField])
+	}
+
+	keys := make([]bson.D, 0, numKeys)
+nextKey:
+	for k := 0; k < numKeys; k++ {
+		key := make(bson.D, len(spec.Key))
+		for i, elem := range spec.Key {
+			v := fieldValues[i][0]
+			if i == arrayField {
+				v = fieldValues[i][k]
+			}
+			key[i] = bson.DocElem{Name: elem.Name, Value: v}
+		}
+
+		// Skip duplicate keys produced by repeated array elements.
+		for _, other := range keys {
+			if keyValuesEqual(key, other) {
+				continue nextKey
+			}
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, true, nil
+}
+
+// IsMultikeyDoc returns true if any of the fields indexed by spec resolves to
+// an array value in doc.
+func IsMultikeyDoc(spec protocol.IndexSpec, doc bson.M) bool {
+	for _, elem := range spec.Key {
+		if _, isArray := keyValues(doc, elem.Name); isArray {
+			return true
+		}
+	}
+	return false
+}
+
+// keyValues resolves a dotted field path against a document and returns the
+// list of values that should be indexed for it. Arrays encountered while
+// traversing the path fan out to their elements. The second result is true
+// if an array was encountered.
+func keyValues(doc interface{}, path string) ([]interface{}, bool) {
+	var (
+		out     []interface{}
+		isArray bool
+	)
+
+	var walk func(cur interface{}, segs []string)
+	walk = func(cur interface{}, segs []string) {
+		if len(segs) == 0 {
+			if bsonutil.IsArray(cur) {
+				isArray = true
+				arr := bsonutil.ToArray(cur)
+				if len(arr) == 0 {
+					// Empty arrays are indexed as undefined.
+					out = append(out, bson.Undefined)
+				}
+				out = append(out, arr...)
+				return
+			}
+			out = append(out, cur)
+			return
+		}
+
+		if bsonutil.IsArray(cur) {
+			isArray = true
+			arr := bsonutil.ToArray(cur)
+			if idx, err := strconv.Atoi(segs[0]); err == nil && idx >= 0 && idx < len(arr) {
+				walk(arr[idx], segs[1:])
+				return
+			}
+			for _, elem := range arr {
+				if bsonutil.IsDocument(elem) {
+					walk(elem, segs)
+				}
+			}
+			return
+		}
+
+		next, found := bsonutil.Get(cur, segs[0])
+		if !found {
+			return
+		}
+		walk(next, segs[1:])
+	}
+	walk(doc, strings.Split(path, "."))
+
+	return out, isArray
+}
+
+// NewDuplicateKeyError returns the error reported when doc violates the unique
+// constraint of an index.
+func NewDuplicateKeyError(col protocol.NamespacedCollection, spec protocol.IndexSpec, key bson.D) protocol.DuplicateKeyError {
+	keyPattern := make(bson.D, len(spec.Key))
+	for i, elem := range spec.Key {
+		keyPattern[i] = bson.DocElem{Name: elem.Name, Value: elem.Value}
+	}
+
+	return protocol.DuplicateKeyError{
+		Collection: col,
+		IndexName:  spec.Name,
+		KeyPattern: keyPattern,
+		KeyValue:   key,
+	}
+}
+
+// CheckUnique verifies that doc does not violate the unique constraints of
+// any of the provided indexes when it is stored alongside the existing
+// documents. When checking an updated document, callers must exclude its
+// original version from the existing document list.
+//
+// For multikey indexes, the constraint applies across documents: two
+// documents conflict if any of their index keys are equal.
+func CheckUnique(col protocol.NamespacedCollection, indexes []protocol.IndexSpec, doc bson.M, existing []bson.M) error {
+	for _, spec := range indexes {
+		if !spec.Unique && !IsIDIndex(spec) {
+			continue
+		}
+
+		keys, indexed, err := ExtractKeys(spec, doc)
+		if err != nil {
+			return err
+		} else if !indexed {
+			continue
+		}
+
+		for _, other := range existing {
+			otherKeys, indexed, err := ExtractKeys(spec, other)
+			if err != nil || !indexed {
+				continue
+			}
+
+			for _, key := range keys {
+				for _, otherKey := range otherKeys {
+					if keyValuesEqual(key, otherKey) {
+						return NewDuplicateKeyError(col, spec, key)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// keyValuesEqual compares the values of two index keys, ignoring field names.
+func keyValuesEqual(a, b bson.D) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bsonutil.SameTypeBracket(a[i].Value, b[i].Value) || !bsonutil.Equal(a[i].Value, b[i].Value) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,457 @@
+package index
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/protocol"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Bounds describes the range of values that an index key field must fall in
+// for a document to be a candidate match for a query.
+type Bounds struct {
+	// The indexed field path.
+	Field string
+
+	// The key type of the indexed field ("1", "-1" or a special type).
+	KeyType string
+
+	// A list of discrete values that the field must match. If empty, the
+	// range defined by the Min/Max fields applies instead.
+	Points []interface{}
+
+	// The (optional) lower and upper range bounds for the field.
+	Min, Max                   interface{}
+	HasMin, HasMax             bool
+	MinInclusive, MaxInclusive bool
+}
+
+// IsPoint returns true if the bounds describe a set of discrete values.
+func (b Bounds) IsPoint() bool {
+	return len(b.Points) != 0
+}
+
+// Info describes an index together with the runtime state that determines
+// how the planner can use it.
+type Info struct {
+	Spec protocol.IndexSpec
+
+	// Multikey is set if at least one indexed document stores an array
+	// value in one of the key fields. Backends must track this flag as
+	// documents are written since it restricts how bounds can be combined.
+	Multikey bool
+}
+
+// Plan describes how an index can be used to narrow down the documents that
+// need to be examined by a query. Index bounds are a necessary but not a
+// sufficient condition for a match: callers must still evaluate the full
+// query filter against the documents selected via the index.
+type Plan struct {
+	Index  protocol.IndexSpec
+	Bounds []Bounds
+
+	// Multikey is set if the index contains one key per array element.
+	// As a document may then be referenced by multiple index entries,
+	// backends must de-duplicate the documents selected via the index.
+	Multikey bool
+}
+
+// String returns a textual description of the plan suitable for including in
+// explain output.
+func (p *Plan) String() string {
+	if p == nil {
+		return "COLLSCAN"
+	}
+	return "IXSCAN { " + p.Index.Name + " }"
+}
+
+// rangePredicate is a single range operator specified by a query.
+type rangePredicate struct {
+	op    string
+	value interface{}
+
+	// Predicates that belong to the same group must be satisfied by the
+	// same value (e.g. when specified within an $elemMatch). For multikey
+	// indexes, only predicates of the same group can be intersected.
+	group int
+}
+
+// constraint collects the index-friendly predicates that a query specifies
+// for a particular field.
+type constraint struct {
+	// The sets of discrete values specified by equality and $in
+	// predicates.
+	pointSets [][]interface{}
+
+	ranges []rangePredicate
+
+	// Set if the query may match documents where the field is null or
+	// missing.
+	matchesNull bool
+}
+
+// SelectIndex examines a query and returns a Plan for the index that is
+// expected to yield the smallest number of candidate documents. It returns
+// nil if none of the provided indexes can be used to answer the query.
+func SelectIndex(query bson.M, indexes []Info) *Plan {
+	constraints := make(map[string]*constraint)
+	new(constraintCollector).collect(query, "", constraints)
+	if len(constraints) == 0 {
+		return nil
+	}
+
+	var (
+		best      *Plan
+		bestScore int
+	)
+	for _, info := range indexes {
+		if !usableForQuery(info.Spec, query, constraints) {
+			continue
+		}
+
+		plan, score := planForIndex(info, constraints)
+		if plan == nil {
+			continue
+		}
+
+		if best == nil || score > bestScore || (score == bestScore && betterTieBreak(info.Spec, best.Index)) {
+			best, bestScore = plan, score
+		}
+	}
+
+	return best
+}
+
+// planForIndex calculates the bounds for each leading index key field that is
+// constrained by the query. It returns a nil plan if the first key field is
+// not constrained.
+func planForIndex(info Info, constraints map[string]*constraint) (*Plan, int) {
+	var (
+		spec  = info.Spec
+		plan  = &Plan{Index: spec, Multikey: info.Multikey}
+		score int
+	)
+
+	for _, elem := range spec.Key {
+		c := constraints[elem.Name]
+		if c == nil {
+			break
+		}
+
+		keyType := KeyType(elem.Value)
+		switch keyType {
+		case "1", "-1", "hashed":
+		default:
+			// Other special indexes require dedicated query
+			// operators which are not supported by the planner.
+			return nil, 0
+		}
+
+		b := Bounds{Field: elem.Name, KeyType: keyType}
+		if points, ok := c.points(info.Multikey); ok {
+			b.Points = points
+			score += 2
+		} else if keyType != "hashed" && c.setRange(&b, info.Multikey) {
+			score++
+		} else {
+			break
+		}
+		plan.Bounds = append(plan.Bounds, b)
+
+		// Index bounds for subsequent fields can only be used if this
+		// field is constrained to a set of discrete values.
+		if !b.IsPoint() {
+			break
+		}
+	}
+
+	if len(plan.Bounds) == 0 {
+		return nil, 0
+	}
+
+	// Unique indexes with all fields pinned yield at most one document per
+	// point so they are always preferred.
+	if spec.Unique && len(plan.Bounds) == len(spec.Key) && plan.Bounds[len(plan.Bounds)-1].IsPoint() {
+		score += 100
+	}
+	return plan, score
+}
+
+// points returns the discrete values that the field must match. For regular
+// indexes, the intersection of all point sets is returned. Multikey indexes
+// store each array element separately; as different elements may satisfy
+// each one of the predicates, only the first point set can be used.
+func (c *constraint) points(multikey bool) ([]interface{}, bool) {
+	if len(c.pointSets) == 0 {
+		return nil, false
+	}
+
+	points := c.pointSets[0]
+	if !multikey {
+		for _, other := range c.pointSets[1:] {
+			points = intersectPoints(points, other)
+		}
+	}
+
+	// Keep points sorted so backends can scan the index in order.
+	sorted := append([]interface{}(nil), points...)
+	sort.SliceStable(sorted, func(i, j int) bool { return bsonutil.Compare(sorted[i], sorted[j]) < 0 })
+	return sorted, true
+}
+
+// setRange populates the min/max fields of b with the range predicates
+// collected for the field. For multikey indexes, only the predicates that must
+// be satisfied by the same array element are combined. It returns false if
+// the constraint does not include any range predicates.
+func (c *constraint) setRange(b *Bounds, multikey bool) bool {
+	if len(c.ranges) == 0 {
+		return false
+	}
+
+	group := c.ranges[0].group
+	for _, pred := range c.ranges {
+		if multikey && pred.group != group {
+			continue
+		}
+
+		switch pred.op {
+		case "$gt", "$gte":
+			if !b.HasMin || bsonutil.Compare(pred.value, b.Min) > 0 || (bsonutil.Equal(pred.value, b.Min) && pred.op == "$gt") {
+				b.Min, b.HasMin, b.MinInclusive = pred.value, true, pred.op == "$gte"
+			}
+		case "$lt", "$lte":
+			if !b.HasMax || bsonutil.Compare(pred.value, b.Max) < 0 || (bsonutil.Equal(pred.value, b.Max) && pred.op == "$lt") {
+				b.Max, b.HasMax, b.MaxInclusive = pred.value, true, pred.op == "$lte"
+			}
+		}
+	}
+	return true
+}
+
+// usableForQuery checks whether the sparse and partial index restrictions
+// allow an index to be used for answering a query.
+func usableForQuery(spec protocol.IndexSpec, query bson.M, constraints map[string]*constraint) bool {
+	if spec.Sparse {
+		// Sparse indexes omit documents that do not contain the indexed
+		// fields so they can only be used when the query rules out
+		// null/missing values for at least one of the key fields.
+		var excludesNull bool
+		for _, elem := range spec.Key {
+			if c := constraints[elem.Name]; c != nil && !c.matchesNull {
+				excludesNull = true
+				break
+			}
+		}
+		if !excludesNull {
+			return false
+		}
+	}
+
+	if spec.PartialFilterExpression != nil {
+		// Conservatively require that the query includes each one of the
+		// partial filter clauses verbatim.
+		clauses := topLevelClauses(query)
+		for _, elem := range bsonutil.Elements(spec.PartialFilterExpression) {
+			var found bool
+			for _, clause := range clauses {
+				if clause.Name == elem.Name && bsonutil.Equal(clause.Value, elem.Value) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// betterTieBreak returns true if index a should be preferred over index b when
+// both have the same score. Indexes with fewer fields are preferred as they
+// are cheaper to scan; ties are resolved by name so the choice is stable.
+func betterTieBreak(a, b protocol.IndexSpec) bool {
+	if len(a.Key) != len(b.Key) {
+		return len(a.Key) < len(b.Key)
+	}
+	return strings.Compare(a.Name, b.Name) < 0
+}
+
+// topLevelClauses returns the list of top-level clauses in a query, expanding
+// any $and operators.
+func topLevelClauses(query interface{}) []bson.DocElem {
+	var clauses []bson.DocElem
+	for _, elem := range bsonutil.Elements(query) {
+		if elem.Name == "$and" {
+			for _, sub := range bsonutil.ToArray(elem.Value) {
+				clauses = append(clauses, topLevelClauses(sub)...)
+			}
+			continue
+		}
+		clauses = append(clauses, elem)
+	}
+	return clauses
+}
+
+// constraintCollector extracts the index-friendly predicates from a query.
+type constraintCollector struct {
+	// A counter for assigning groups to range predicates.
+	nextGroup int
+}
+
+// collect populates the constraint map with the equality and range predicates
+// specified by the top-level clauses of a query. Field names are prefixed
+// with pathPrefix which allows the collector to process the clauses of an
+// $elemMatch expression.
+func (cc *constraintCollector) collect(query interface{}, pathPrefix string, constraints map[string]*constraint) {
+	// All predicates within an $elemMatch must be satisfied by the same
+	// array element and therefore share the same group. Top-level
+	// predicates are not grouped.
+	var group int
+	if pathPrefix != "" {
+		cc.nextGroup++
+		group = cc.nextGroup
+	}
+
+	for _, clause := range topLevelClauses(query) {
+		if strings.HasPrefix(clause.Name, "$") {
+			// Other logical operators ($or, $nor) cannot be used
+			// to narrow down the scan.
+			continue
+		}
+		cc.applyClause(pathPrefix+clause.Name, clause.Value, group, constraints)
+	}
+}
+
+// applyClause narrows down the constraint for field using the predicates in a
+// field clause.
+func (cc *constraintCollector) applyClause(field string, clause interface{}, group int, constraints map[string]*constraint) {
+	c := constraints[field]
+	if c == nil {
+		c = &constraint{matchesNull: true}
+	}
+	if cc.applyPredicates(c, field, clause, group, constraints) {
+		constraints[field] = c
+	}
+}
+
+// applyPredicates updates constraint c with the predicates in a field clause.
+// It returns true if the clause contained any usable predicates.
+func (cc *constraintCollector) applyPredicates(c *constraint, field string, clause interface{}, group int, constraints map[string]*constraint) bool {
+	elems := bsonutil.Elements(clause)
+	if len(elems) == 0 || !strings.HasPrefix(elems[0].Name, "$") {
+		// Plain value equality. Regular expressions cannot be used as
+		// index points.
+		if _, isRegex := clause.(bson.RegEx); isRegex {
+			return false
+		}
+		c.addPoints([]interface{}{clause})
+		return true
+	}
+
+	var usable bool
+	for _, elem := range elems {
+		switch elem.Name {
+		case "$eq":
+			if _, isRegex := elem.Value.(bson.RegEx); isRegex {
+				continue
+			}
+			c.addPoints([]interface{}{elem.Value})
+			usable = true
+		case "$in":
+			values := bsonutil.ToArray(elem.Value)
+			if values == nil || containsRegex(values) {
+				continue
+			}
+			c.addPoints(values)
+			usable = true
+		case "$gt", "$gte", "$lt", "$lte":
+			// Ungrouped predicates may each be satisfied by a
+			// different array element.
+			predGroup := group
+			if predGroup == 0 {
+				cc.nextGroup++
+				predGroup = cc.nextGroup
+			}
+			c.ranges = append(c.ranges, rangePredicate{op: elem.Name, value: elem.Value, group: predGroup})
+			c.matchesNull = c.matchesNull && bsonutil.IsNull(elem.Value) && (elem.Name == "$gte" || elem.Name == "$lte")
+			usable = true
+		case "$exists":
+			if b, isBool := elem.Value.(bool); isBool && b {
+				c.matchesNull = false
+			}
+		case "$elemMatch":
+			sub := bsonutil.Elements(elem.Value)
+			if len(sub) == 0 || !strings.HasPrefix(sub[0].Name, "$") {
+				// Predicates on embedded document fields.
+				cc.collect(elem.Value, field+".", constraints)
+				continue
+			}
+
+			// Operators applied to the array elements themselves
+			// (e.g. {$elemMatch: {$gt: 1, $lt: 5}}). They must all
+			// be satisfied by the same element.
+			cc.nextGroup++
+			if cc.applyPredicates(c, field, elem.Value, cc.nextGroup, constraints) {
+				// $elemMatch never matches null or missing fields.
+				c.matchesNull = false
+				usable = true
+			}
+		}
+	}
+	return usable
+}
+
+// addPoints restricts the constraint to a set of discrete values. Arrays
+// match both documents storing an identical array and documents storing an
+// array that contains them. As multikey indexes store a key per array
+// element, the first element of each array (or undefined for empty arrays)
+// is included as an additional point.
+func (c *constraint) addPoints(values []interface{}) {
+	var points []interface{}
+	for _, v := range values {
+		if bsonutil.IsArray(v) {
+			if arr := bsonutil.ToArray(v); len(arr) != 0 {
+				points = append(points, arr[0])
+			} else {
+				points = append(points, bson.Undefined)
+			}
+		}
+		points = append(points, v)
+	}
+	c.pointSets = append(c.pointSets, points)
+
+	c.matchesNull = false
+	for _, p := range points {
+		if bsonutil.IsNull(p) {
+			c.matchesNull = true
+			break
+		}
+	}
+}
+
+// intersectPoints returns the values that are present in both point lists.
+func intersectPoints(a, b []interface{}) []interface{} {
+	var merged []interface{}
+	for _, p := range a {
+		for _, other := range b {
+			if bsonutil.Equal(p, other) {
+				merged = append(merged, p)
+				break
+			}
+		}
+	}
+	return merged
+}
+
+func containsRegex(values []interface{}) bool {
+	for _, v := range values {
+		if _, isRegex := v.(bson.RegEx); isRegex {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,204 @@
+// Package index provides backend-agnostic helpers for working with mongo
+// indexes: validating index specifications and selecting the index that
+// can be used to narrow down the set of documents scanned by a query.
+package index
+
+import (
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/emulator/filter"
+	"github.com/achilleasa/mongolite/protocol"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// IDIndexName is the name of the index that mongod implicitly creates on the
+// _id field of each collection.
+const IDIndexName = "_id_"
+
+// The special (non-ascending/descending) index types that are recognized
+// by the validator.
+var specialIndexTypes = map[string]bool{
+	"hashed":      true,
+	"text":        true,
+	"2d":          true,
+	"2dsphere":    true,
+	"geoHaystack": true,
+}
+
+// IDIndexSpec returns the spec for the implicit index on the _id field.
+func IDIndexSpec() protocol.IndexSpec {
+	return protocol.IndexSpec{
+		Name:   IDIndexName,
+		Key:    bson.D{{Name: "_id", Value: 1}},
+		Unique: true,
+	}
+}
+
+// IsIDIndex returns true if spec describes the implicit _id index.
+func IsIDIndex(spec protocol.IndexSpec) bool {
+	return spec.Name == IDIndexName || (len(spec.Key) == 1 && spec.Key[0].Name == "_id" && KeyType(spec.Key[0].Value) == "1")
+}
+
+// KeyType returns the type of an index key component: "1" for ascending, "-1"
+// for descending or the name of a special index type (e.g. "hashed"). It
+// returns an empty string for invalid key values.
+func KeyType(v interface{}) string {
+	if s, isStr := v.(string); isStr {
+		if specialIndexTypes[s] {
+			return s
+		}
+		return ""
+	}
+
+	if f, isNum := bsonutil.ToFloat64(v); isNum {
+		switch {
+		case f > 0:
+			return "1"
+		case f < 0:
+			return "-1"
+		}
+	}
+	return ""
+}
+
+// Validate checks an index specification for errors.
+func Validate(spec protocol.IndexSpec) error {
+	if spec.Name == "" || spec.Name == "*" {
+		return protocol.ServerErrorf(protocol.CodeCannotCreateIndex, "index name %q is not valid", spec.Name)
+	}
+	if len(spec.Key) == 0 {
+		return protocol.ServerErrorf(protocol.CodeCannotCreateIndex, "index key pattern for %q cannot be empty", spec.Name)
+	}
+
+	var (
+		seen        = make(map[string]bool, len(spec.Key))
+		specialType string
+	)
+	for _, elem := range spec.Key {
+		if elem.Name == "" {
+			return protocol.ServerErrorf(protocol.CodeCannotCreateIndex, "index key pattern for %q contains an empty field name", spec.Name)
+		} else if seen[elem.Name] {
+			return protocol.ServerErrorf(protocol.CodeCannotCreateIndex, "index key pattern for %q contains duplicate field %q", spec.Name, elem.Name)
+		}
+		seen[elem.Name] = true
+
+		keyType := KeyType(elem.Value)
+		switch keyType {
+		case "":
+			return protocol.ServerErrorf(protocol.CodeCannotCreateIndex, "bad index key pattern %v: unknown index plugin %v", spec.Key, elem.Value)
+		case "1", "-1":
+		default:
+			if specialType != "" && specialType != keyType {
+				return protocol.ServerErrorf(protocol.CodeCannotCreateIndex, "can't use more than one index plugin for a single index")
+			}
+			specialType = keyType
+		}
+	}
+
+	if spec.Unique && specialType == "hashed" {
+		return protocol.ServerErrorf(protocol.CodeCannotCreateIndex, "currently hashed indexes cannot guarantee uniqueness")
+	}
+
+	if spec.PartialFilterExpression != nil {
+		if spec.Sparse {
+			return protocol.ServerErrorf(protocol.CodeCannotCreateIndex, "cannot mix \"partialFilterExpression\" and \"sparse\" options")
+		}
+		if _, err := filter.Compile(spec.PartialFilterExpression); err != nil {
+			return protocol.ServerErrorf(protocol.CodeCannotCreateIndex, "invalid partialFilterExpression for %q: %v", spec.Name, err)
+		}
+	}
+
+	if IsIDIndex(spec) && spec.Name == IDIndexName {
+		if spec.Sparse {
+			return protocol.ServerErrorf(protocol.CodeCannotCreateIndex, "the field 'sparse' is not valid for an _id index specification")
+		} else if spec.PartialFilterExpression != nil {
+			return protocol.ServerErrorf(protocol.CodeCannotCreateIndex, "the field 'partialFilterExpression' is not valid for an _id index specification")
+		} else if spec.ExpireAfterSeconds != nil {
+			return protocol.ServerErrorf(protocol.CodeCannotCreateIndex, "the field 'expireAfterSeconds' is not valid for an _id index specification")
+		}
+	}
+
+	return nil
+}
+
+// CheckConflict returns an error if a new index specification conflicts with
+// an existing index. It returns (true, nil) if the specs describe the same
+// index, in which case the new index does not need to be created.
+func CheckConflict(existing, spec protocol.IndexSpec) (bool, error) {
+	sameKey := keysEqual(existing.Key, spec.Key)
+	sameOptions := existing.Unique == spec.Unique &&
+		existing.Sparse == spec.Sparse &&
+		bsonutil.Equal(existing.PartialFilterExpression, spec.PartialFilterExpression) &&
+		ttlEqual(existing.ExpireAfterSeconds, spec.ExpireAfterSeconds)
+
+	switch {
+	case existing.Name == spec.Name && sameKey && sameOptions:
+		return true, nil
+	case existing.Name == spec.Name && IsIDIndex(existing) && sameKey:
+		// The unique flag is implied for the _id index.
+		return true, nil
+	case existing.Name == spec.Name:
+		return false, protocol.ServerErrorf(protocol.CodeIndexKeySpecsConflict, "index with name: %s already exists with a different key or options", spec.Name)
+	case sameKey && bsonutil.Equal(existing.PartialFilterExpression, spec.PartialFilterExpression):
+		return false, protocol.ServerErrorf(protocol.CodeIndexOptionsConflict, "index with key %v already exists with a different name: %s", spec.Key, existing.Name)
+	}
+	return false, nil
+}
+
+func keysEqual(a, b bson.D) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || KeyType(a[i].Value) != KeyType(b[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+func ttlEqual(a, b *int64) bool {
+	switch {
+	case a == nil && b == nil:
+		return true
+	case a == nil || b == nil:
+		return false
+	}
+	return *a == *b
+}
+
+// FindByKey returns the index whose key pattern matches key.
+func FindByKey(indexes []protocol.IndexSpec, key bson.D) (protocol.IndexSpec, bool) {
+	for _, spec := range indexes {
+		if keysEqual(spec.Key, key) {
+			return spec, true
+		}
+	}
+	return protocol.IndexSpec{}, false
+}
+
+// ToDoc formats an index specification using the schema returned by mongod
+// for listIndexes requests.
+func ToDoc(ns string, spec protocol.IndexSpec) bson.D {
+	doc := bson.D{
+		{Name: "v", Value: 2},
+		{Name: "key", Value: spec.Key},
+		{Name: "name", Value: spec.Name},
+		{Name: "ns", Value: ns},
+	}
+	if spec.Unique && !IsIDIndex(spec) {
+		doc = append(doc, bson.DocElem{Name: "unique", Value: true})
+	}
+	if spec.Sparse {
+		doc = append(doc, bson.DocElem{Name: "sparse", Value: true})
+	}
+	if spec.PartialFilterExpression != nil {
+		doc = append(doc, bson.DocElem{Name: "partialFilterExpression", Value: spec.PartialFilterExpression})
+	}
+	if spec.ExpireAfterSeconds != nil {
+		doc = append(doc, bson.DocElem{Name: "expireAfterSeconds", Value: *spec.ExpireAfterSeconds})
+	}
+	for _, elem := range bsonutil.Elements(spec.Options) {
+		doc = append(doc, elem)
+	}
+	return doc
+}
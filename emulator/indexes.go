@@ -0,0 +1,215 @@
+package emulator
+
+import (
+	"github.com/achilleasa/mongolite/emulator/index"
+	"github.com/achilleasa/mongolite/protocol"
+	"golang.org/x/xerrors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// IndexBackend is implemented by backends that support secondary indexes.
+// Index management requests against backends that do not implement this
+// interface fail with ErrUnsupportedRequest.
+//
+// The emulator validates index specifications and resolves conflicts with
+// existing indexes before invoking the backend.
+//
+// Backends are responsible for maintaining index entries on every write. The
+// index.ExtractKeys helper returns the entries that must be stored for a
+// document, fanning out array values into one entry per element (multikey
+// indexes). Before executing a write, the emulator rejects documents with
+// parallel arrays and documents that violate unique indexes.
+type IndexBackend interface {
+	Backend
+
+	// CreateIndexes builds the specified indexes on a collection. If the
+	// collection does not exist, it must be created and the method should
+	// return true as its first result.
+	CreateIndexes(clientID string, col protocol.NamespacedCollection, specs []protocol.IndexSpec) (bool, error)
+
+	// ListIndexes returns the indexes for a collection, including the
+	// implicit index on _id. It returns a NamespaceNotFound server error
+	// if the collection does not exist.
+	ListIndexes(clientID string, col protocol.NamespacedCollection) ([]protocol.IndexSpec, error)
+
+	// DropIndexes drops the indexes with the specified names.
+	DropIndexes(clientID string, col protocol.NamespacedCollection, names []string) error
+}
+
+// IndexScanBackend is implemented by index backends that can look up
+// documents via the entries of their indexes.
+//
+// The emulator plans the queries that it evaluates on behalf of find, count,
+// distinct, aggregate and findAndModify requests with index.SelectIndex and
+// asks the backend to scan the bounds of the selected index instead of
+// querying the whole collection. Queries that cannot use any index are
+// issued as regular query requests.
+type IndexScanBackend interface {
+	IndexBackend
+
+	// IndexInfo returns the indexes for a collection together with their
+	// multikey state. It returns a NamespaceNotFound server error if the
+	// collection does not exist.
+	IndexInfo(clientID string, col protocol.NamespacedCollection) ([]index.Info, error)
+
+	// ScanIndex returns the documents referenced by the index entries
+	// that fall within the plan bounds. Each document must be returned
+	// once even if it is referenced by multiple entries of a multikey
+	// index. The emulator evaluates the full query against the returned
+	// documents.
+	ScanIndex(clientID string, col protocol.NamespacedCollection, plan *index.Plan) ([]bson.D, error)
+
+	// SetMultikey records that the index with the specified name stores
+	// at least one array value. The emulator calls it before writing the
+	// first such document; the flag is reported by IndexInfo and must
+	// persist until the index is dropped.
+	SetMultikey(clientID string, col protocol.NamespacedCollection, name string) error
+}
+
+func (emu *MongoEmulator) indexBackend(req protocol.Request) (IndexBackend, error) {
+	if ib, ok := emu.b.(IndexBackend); ok {
+		return ib, nil
+	}
+	return nil, xerrors.Errorf("request %q: %w", req.GetType(), ErrUnsupportedRequest)
+}
+
+func (emu *MongoEmulator) handleCreateIndexes(clientID string, r protocol.Request) (protocol.Response, error) {
+	req := r.(*protocol.CreateIndexesRequest)
+	ib, err := emu.indexBackend(req)
+	if err != nil {
+		return protocol.Response{}, err
+	}
+
+	existing, err := ib.ListIndexes(clientID, req.Collection)
+	if err != nil && !hasErrorCode(err, protocol.CodeNamespaceNotFound) {
+		return protocol.Response{}, err
+	}
+
+	var toCreate []protocol.IndexSpec
+nextSpec:
+	for _, spec := range req.Indexes {
+		if err := index.Validate(spec); err != nil {
+			return protocol.Response{}, err
+		}
+
+		for _, other := range append(existing, toCreate...) {
+			exists, err := index.CheckConflict(other, spec)
+			if err != nil {
+				return protocol.Response{}, err
+			} else if exists {
+				continue nextSpec
+			}
+		}
+		toCreate = append(toCreate, spec)
+	}
+
+	// The _id index is implicitly created together with the collection.
+	numIndexesBefore := len(existing)
+	if numIndexesBefore == 0 {
+		numIndexesBefore = 1
+	}
+
+	resDoc := bson.M{
+		"ok":                             1,
+		"createdCollectionAutomatically": false,
+		"numIndexesBefore":               numIndexesBefore,
+		"numIndexesAfter":                numIndexesBefore,
+	}
+
+	if len(toCreate) == 0 {
+		resDoc["note"] = "all indexes already exist"
+		return protocol.Response{Documents: []bson.M{resDoc}}, nil
+	}
+
+	createdCol, err := ib.CreateIndexes(clientID, req.Collection, toCreate)
+	if err != nil {
+		return protocol.Response{}, err
+	}
+
+	resDoc["createdCollectionAutomatically"] = createdCol
+	resDoc["numIndexesAfter"] = numIndexesBefore + len(toCreate)
+	return protocol.Response{Documents: []bson.M{resDoc}}, nil
+}
+
+func (emu *MongoEmulator) handleListIndexes(clientID string, r protocol.Request) (protocol.Response, error) {
+	req := r.(*protocol.ListIndexesRequest)
+	ib, err := emu.indexBackend(req)
+	if err != nil {
+		return protocol.Response{}, err
+	}
+
+	specs, err := ib.ListIndexes(clientID, req.Collection)
+	if err != nil {
+		return protocol.Response{}, err
+	}
+
+	ns := req.Collection.String()
+	indexDocs := make([]interface{}, len(specs))
+	for i, spec := range specs {
+		indexDocs[i] = index.ToDoc(ns, spec)
+	}
+
+	return cursorResponse(ns, 0, indexDocs), nil
+}
+
+func (emu *MongoEmulator) handleDropIndexes(clientID string, r protocol.Request) (protocol.Response, error) {
+	req := r.(*protocol.DropIndexesRequest)
+	ib, err := emu.indexBackend(req)
+	if err != nil {
+		return protocol.Response{}, err
+	}
+
+	existing, err := ib.ListIndexes(clientID, req.Collection)
+	if err != nil {
+		return protocol.Response{}, err
+	}
+
+	var toDrop []string
+	switch {
+	case req.DropAll:
+		for _, spec := range existing {
+			if !index.IsIDIndex(spec) {
+				toDrop = append(toDrop, spec.Name)
+			}
+		}
+	case req.KeyPattern != nil:
+		spec, found := index.FindByKey(existing, req.KeyPattern)
+		if !found {
+			return protocol.Response{}, protocol.ServerErrorf(protocol.CodeIndexNotFound, "can't find index with key: %v", req.KeyPattern)
+		} else if index.IsIDIndex(spec) {
+			return protocol.Response{}, protocol.ServerErrorf(protocol.CodeInvalidOptions, "cannot drop _id index")
+		}
+		toDrop = []string{spec.Name}
+	default:
+		for _, name := range req.Names {
+			if name == index.IDIndexName {
+				return protocol.Response{}, protocol.ServerErrorf(protocol.CodeInvalidOptions, "cannot drop _id index")
+			}
+
+			var found bool
+			for _, spec := range existing {
+				if spec.Name == name {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return protocol.Response{}, protocol.ServerErrorf(protocol.CodeIndexNotFound, "index not found with name [%s]", name)
+			}
+		}
+		toDrop = req.Names
+	}
+
+	if len(toDrop) != 0 {
+		if err := ib.DropIndexes(clientID, req.Collection, toDrop); err != nil {
+			return protocol.Response{}, err
+		}
+	}
+
+	return protocol.Response{
+		Documents: []bson.M{{
+			"ok":          1,
+			"nIndexesWas": len(existing),
+		}},
+	}, nil
+}
@@ -0,0 +1,309 @@
+package emulator
+
+import (
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/emulator/filter"
+	"github.com/achilleasa/mongolite/emulator/index"
+	"github.com/achilleasa/mongolite/emulator/update"
+	"github.com/achilleasa/mongolite/protocol"
+	"golang.org/x/xerrors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// collectionIndexes returns the indexes of col. The implicit _id index is
+// always included, even for backends that do not support secondary indexes
+// or collections that do not exist yet.
+func (emu *MongoEmulator) collectionIndexes(clientID string, col protocol.NamespacedCollection) ([]protocol.IndexSpec, error) {
+	var specs []protocol.IndexSpec
+	if ib, ok := emu.b.(IndexBackend); ok {
+		var err error
+		if specs, err = ib.ListIndexes(clientID, col); err != nil && !hasErrorCode(err, protocol.CodeNamespaceNotFound) {
+			return nil, xerrors.Errorf("unable to list indexes for %q: %w", col.String(), err)
+		}
+	}
+
+	for _, spec := range specs {
+		if index.IsIDIndex(spec) {
+			return specs, nil
+		}
+	}
+	return append([]protocol.IndexSpec{index.IDIndexSpec()}, specs...), nil
+}
+
+// checkInsert verifies that doc can be inserted into col without violating
+// the constraints of the collection indexes.
+func (emu *MongoEmulator) checkInsert(clientID string, origin protocol.Request, col protocol.NamespacedCollection, doc bson.M) error {
+	specs, err := emu.collectionIndexes(clientID, col)
+	if err != nil {
+		return err
+	}
+	return emu.checkIndexKeys(clientID, origin, col, specs, []bson.M{doc}, nil)
+}
+
+// updatePreview describes the outcome of an update operation that has been
+// evaluated by the emulator before it is sent to the backend.
+type updatePreview struct {
+	u *update.Update
+
+	// The documents that match the update selector and their contents
+	// after the update is applied.
+	matched []bson.D
+	updated []bson.D
+
+	// The document inserted by an upsert or nil if the operation matches
+	// existing documents or is not an upsert.
+	upserted bson.D
+}
+
+// modified returns the _id of the matched documents whose contents are
+// changed by the update.
+func (p *updatePreview) modified() []interface{} {
+	var ids []interface{}
+	for i, doc := range p.matched {
+		if !bsonutil.Equal(doc, p.updated[i]) {
+			ids = append(ids, doc.Map()["_id"])
+		}
+	}
+	return ids
+}
+
+// previewUpdate applies an update operation to the matching documents of col
+// without writing the results.
+func (emu *MongoEmulator) previewUpdate(clientID string, origin protocol.Request, col protocol.NamespacedCollection, target protocol.UpdateTarget) (*updatePreview, error) {
+	u, err := update.Parse(target.Update, target.ArrayFilters)
+	if err != nil {
+		return nil, err
+	}
+	matcher, err := filter.Compile(target.Selector)
+	if err != nil {
+		return nil, err
+	}
+
+	src := &backendSource{b: emu.b, clientID: clientID, origin: origin}
+	docs, err := src.Find(col, matcher.Query())
+	if err != nil {
+		return nil, err
+	}
+
+	preview := &updatePreview{u: u}
+	for _, doc := range docs {
+		if !matcher.Match(doc) {
+			continue
+		}
+
+		out, err := u.Apply(doc, false)
+		if err != nil {
+			return nil, err
+		}
+		preview.matched = append(preview.matched, doc)
+		preview.updated = append(preview.updated, out)
+		if target.Flags&protocol.UpdateFlagMulti == 0 {
+			break
+		}
+	}
+
+	if len(preview.matched) == 0 && target.Flags&protocol.UpdateFlagUpsert != 0 {
+		if preview.upserted, err = u.UpsertDocument(target.Selector); err != nil {
+			return nil, err
+		}
+	}
+	return preview, nil
+}
+
+// checkUpdate verifies that applying an update operation to col does not
+// violate the constraints of the collection indexes. The documents produced
+// by the update are checked against the documents that the update leaves
+// untouched. If preview is nil, the update is evaluated when the indexes of
+// col require it.
+func (emu *MongoEmulator) checkUpdate(clientID string, origin protocol.Request, col protocol.NamespacedCollection, target protocol.UpdateTarget, preview *updatePreview) error {
+	specs, err := emu.collectionIndexes(clientID, col)
+	if err != nil {
+		return err
+	}
+
+	// Updates cannot change the _id of existing documents so there is
+	// nothing to check if the _id index is the only index and no
+	// document can be upserted.
+	upsert := target.Flags&protocol.UpdateFlagUpsert != 0
+	if len(specs) == 1 && !upsert {
+		return nil
+	}
+
+	if preview == nil {
+		if preview, err = emu.previewUpdate(clientID, origin, col, target); err != nil {
+			return err
+		}
+	}
+
+	var (
+		updated  []bson.M
+		replaced []interface{}
+	)
+	for i, doc := range preview.matched {
+		updated = append(updated, preview.updated[i].Map())
+		replaced = append(replaced, doc.Map()["_id"])
+	}
+	if preview.upserted != nil {
+		updated = append(updated, preview.upserted.Map())
+	}
+	if len(updated) == 0 {
+		return nil
+	}
+	return emu.checkIndexKeys(clientID, origin, col, specs, updated, replaced)
+}
+
+// checkIndexKeys verifies that docs can be stored in col. It extracts the
+// keys of each document for each one of the provided indexes, rejecting
+// documents with parallel arrays in compound indexes, and flags the indexes
+// that become multikey via the backend. It then verifies that the documents
+// do not violate the unique indexes.
+//
+// Callers must hold writeMu until the checked documents have been written.
+func (emu *MongoEmulator) checkIndexKeys(clientID string, origin protocol.Request, col protocol.NamespacedCollection, specs []protocol.IndexSpec, docs []bson.M, replaced []interface{}) error {
+	var unique []protocol.IndexSpec
+	for _, spec := range specs {
+		if !hasPlainKeys(spec) {
+			// Special indexes (e.g. text or geo indexes) derive
+			// their keys differently.
+			continue
+		}
+
+		var multikey bool
+		for _, doc := range docs {
+			if _, _, err := index.ExtractKeys(spec, doc); err != nil {
+				return err
+			}
+			multikey = multikey || index.IsMultikeyDoc(spec, doc)
+		}
+		if multikey {
+			if err := emu.setMultikey(clientID, col, spec); err != nil {
+				return err
+			}
+		}
+
+		if spec.Unique || index.IsIDIndex(spec) {
+			unique = append(unique, spec)
+		}
+	}
+	return emu.checkUnique(clientID, origin, col, unique, docs, replaced)
+}
+
+// setMultikey flags an index as multikey if the backend supports index scans
+// and the index is not already flagged. As the IndexScanBackend methods do
+// not receive the transaction arguments, writes within a transaction flag the
+// index immediately; the flag remains set if the transaction aborts, which
+// only makes index scans more conservative. Indexes of collections that do
+// not exist outside of the transaction are left as-is.
+func (emu *MongoEmulator) setMultikey(clientID string, col protocol.NamespacedCollection, spec protocol.IndexSpec) error {
+	isb, ok := emu.b.(IndexScanBackend)
+	if !ok {
+		return nil
+	}
+
+	infos, err := isb.IndexInfo(clientID, col)
+	if hasErrorCode(err, protocol.CodeNamespaceNotFound) {
+		return nil
+	} else if err != nil {
+		return xerrors.Errorf("unable to list indexes for %q: %w", col.String(), err)
+	}
+	for _, info := range infos {
+		if info.Spec.Name == spec.Name && info.Multikey {
+			return nil
+		}
+	}
+
+	if err := isb.SetMultikey(clientID, col, spec.Name); err != nil {
+		return xerrors.Errorf("unable to flag index %q of %q as multikey: %w", spec.Name, col.String(), err)
+	}
+	return nil
+}
+
+// hasPlainKeys returns true if all key fields of spec are ascending,
+// descending or hashed.
+func hasPlainKeys(spec protocol.IndexSpec) bool {
+	for _, elem := range spec.Key {
+		switch index.KeyType(elem.Value) {
+		case "1", "-1", "hashed":
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// checkUnique verifies that storing docs in col does not violate the
+// constraints of the provided unique indexes. The documents whose _id is
+// included in replaced are about to be overwritten and are excluded from the
+// check. Each document is also checked against the documents preceding it.
+// Documents without an _id are assigned a new one when stored so the _id
+// index is not checked for them.
+func (emu *MongoEmulator) checkUnique(clientID string, origin protocol.Request, col protocol.NamespacedCollection, specs []protocol.IndexSpec, docs []bson.M, replaced []interface{}) error {
+	// Select the candidate documents that share at least one key with
+	// the checked documents.
+	var (
+		clauses []interface{}
+		scanAll bool
+	)
+	for _, doc := range docs {
+		_, hasID := doc["_id"]
+		for _, spec := range specs {
+			if index.IsIDIndex(spec) && !hasID {
+				continue
+			}
+
+			keys, indexed, err := index.ExtractKeys(spec, doc)
+			if err != nil {
+				return err
+			} else if !indexed {
+				continue
+			}
+
+			for _, key := range keys {
+				clause := bson.M{}
+				for _, elem := range key {
+					// Empty arrays are indexed as undefined
+					// which cannot be expressed as a query.
+					if elem.Value == bson.Undefined {
+						scanAll = true
+						break
+					}
+					clause[elem.Name] = bson.M{"$eq": elem.Value}
+				}
+				clauses = append(clauses, clause)
+			}
+		}
+	}
+	if len(clauses) == 0 {
+		return nil
+	}
+
+	query := bson.M{"$or": clauses}
+	if scanAll {
+		query = bson.M{}
+	}
+	src := &backendSource{b: emu.b, clientID: clientID, origin: origin}
+	candidates, err := src.Find(col, query)
+	if err != nil {
+		return err
+	}
+
+	var existing []bson.M
+nextCandidate:
+	for _, doc := range candidates {
+		m := doc.Map()
+		for _, id := range replaced {
+			if bsonutil.Equal(m["_id"], id) {
+				continue nextCandidate
+			}
+		}
+		existing = append(existing, m)
+	}
+
+	for _, doc := range docs {
+		if err := index.CheckUnique(col, specs, doc, existing); err != nil {
+			return err
+		}
+		existing = append(existing, doc)
+	}
+	return nil
+}
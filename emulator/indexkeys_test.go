@@ -0,0 +1,369 @@
+package emulator
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/protocol"
+	"golang.org/x/xerrors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestUniqueIndexEnforcement(t *testing.T) {
+	specs := []struct {
+		descr         string
+		req           protocol.Request
+		expN          int
+		expErrIndex   int
+		expKeyPattern bson.D
+		expKeyValue   bson.D
+	}{
+		{
+			descr: "insert with duplicate _id",
+			req: &protocol.InsertRequest{
+				RequestInfo: cmdInfo(protocol.RequestTypeInsert),
+				Collection:  testCol,
+				Inserts:     []bson.M{{"_id": 3, "a": 3}, {"_id": 1}, {"_id": 4, "a": 4}},
+			},
+			expN:          1,
+			expErrIndex:   1,
+			expKeyPattern: bson.D{{Name: "_id", Value: 1}},
+			expKeyValue:   bson.D{{Name: "_id", Value: 1}},
+		},
+		{
+			descr: "insert with duplicate unique key",
+			req: &protocol.InsertRequest{
+				RequestInfo: cmdInfo(protocol.RequestTypeInsert),
+				Collection:  testCol,
+				Inserts:     []bson.M{{"_id": 3, "a": 2}},
+			},
+			expKeyPattern: bson.D{{Name: "a", Value: 1}},
+			expKeyValue:   bson.D{{Name: "a", Value: 2}},
+		},
+		{
+			descr: "insert with array containing duplicate unique key",
+			req: &protocol.InsertRequest{
+				RequestInfo: cmdInfo(protocol.RequestTypeInsert),
+				Collection:  testCol,
+				Inserts:     []bson.M{{"_id": 3, "a": []interface{}{5, 1}}},
+			},
+			expKeyPattern: bson.D{{Name: "a", Value: 1}},
+			expKeyValue:   bson.D{{Name: "a", Value: 1}},
+		},
+		{
+			descr: "update to duplicate unique key",
+			req: &protocol.UpdateRequest{
+				RequestInfo: cmdInfo(protocol.RequestTypeUpdate),
+				Collection:  testCol,
+				Updates: []protocol.UpdateTarget{{
+					Selector: bson.M{"_id": 2},
+					Update:   bson.M{"$set": bson.M{"a": 1}},
+				}},
+			},
+			expKeyPattern: bson.D{{Name: "a", Value: 1}},
+			expKeyValue:   bson.D{{Name: "a", Value: 1}},
+		},
+		{
+			descr: "upsert with duplicate unique key",
+			req: &protocol.UpdateRequest{
+				RequestInfo: cmdInfo(protocol.RequestTypeUpdate),
+				Collection:  testCol,
+				Updates: []protocol.UpdateTarget{{
+					Selector: bson.M{"_id": 5},
+					Update:   bson.M{"$set": bson.M{"a": 2}},
+					Flags:    protocol.UpdateFlagUpsert,
+				}},
+			},
+			expKeyPattern: bson.D{{Name: "a", Value: 1}},
+			expKeyValue:   bson.D{{Name: "a", Value: 2}},
+		},
+		{
+			descr: "multi update producing duplicate keys",
+			req: &protocol.UpdateRequest{
+				RequestInfo: cmdInfo(protocol.RequestTypeUpdate),
+				Collection:  testCol,
+				Updates: []protocol.UpdateTarget{{
+					Selector: bson.M{},
+					Update:   bson.M{"$set": bson.M{"a": 7}},
+					Flags:    protocol.UpdateFlagMulti,
+				}},
+			},
+			expKeyPattern: bson.D{{Name: "a", Value: 1}},
+			expKeyValue:   bson.D{{Name: "a", Value: 7}},
+		},
+	}
+
+	for _, spec := range specs {
+		t.Run(spec.descr, func(t *testing.T) {
+			emu := newUniqueTestEmulator(t)
+			reply := mustProcess(t, emu, spec.req)
+			if got := asInt(reply["n"]); got != spec.expN {
+				t.Fatalf("expected n to be %d; got %d", spec.expN, got)
+			}
+
+			writeErrors := bsonutil.ToArray(reply["writeErrors"])
+			if len(writeErrors) != 1 {
+				t.Fatalf("expected 1 write error; got %v", reply)
+			}
+			writeErr := writeErrors[0].(bson.M)
+			if got := asInt(writeErr["index"]); got != spec.expErrIndex {
+				t.Fatalf("expected error for op %d; got %d", spec.expErrIndex, got)
+			}
+			if got := writeErr["code"]; got != protocol.CodeDuplicateKey {
+				t.Fatalf("expected code %d; got %d", protocol.CodeDuplicateKey, got)
+			}
+			if got := writeErr["keyPattern"]; !bsonutil.Equal(got, spec.expKeyPattern) {
+				t.Fatalf("expected keyPattern %v; got %v", spec.expKeyPattern, got)
+			}
+			if got := writeErr["keyValue"]; !bsonutil.Equal(got, spec.expKeyValue) {
+				t.Fatalf("expected keyValue %v; got %v", spec.expKeyValue, got)
+			}
+		})
+	}
+}
+
+func TestUniqueIndexAllowsNonConflictingWrites(t *testing.T) {
+	emu := newUniqueTestEmulator(t)
+
+	// Updating a document without changing its key must not conflict
+	// with its own index entry.
+	reply := mustProcess(t, emu, &protocol.UpdateRequest{
+		RequestInfo: cmdInfo(protocol.RequestTypeUpdate),
+		Collection:  testCol,
+		Updates: []protocol.UpdateTarget{{
+			Selector: bson.M{"_id": 1},
+			Update:   bson.M{"$set": bson.M{"a": 1, "b": true}},
+		}},
+	})
+	if reply["writeErrors"] != nil {
+		t.Fatalf("unexpected write errors: %v", reply)
+	}
+
+	insertDocs(t, emu, testCol, bson.M{"_id": 3, "a": 3}, bson.M{"_id": 4})
+	if got := len(emu.b.(*memBackend).docs(testCol)); got != 4 {
+		t.Fatalf("expected 4 documents; got %d", got)
+	}
+}
+
+func TestUniqueIndexFindAndModify(t *testing.T) {
+	emu := newUniqueTestEmulator(t)
+
+	_, err := emu.process("client", &protocol.FindAndUpdateRequest{
+		RequestInfo: cmdInfo(protocol.RequestTypeFindAndUpdate),
+		Collection:  testCol,
+		Query:       bson.M{"_id": 2},
+		Update:      bson.M{"$set": bson.M{"a": 1}},
+	})
+	var dupKeyErr protocol.DuplicateKeyError
+	if !xerrors.As(err, &dupKeyErr) {
+		t.Fatalf("expected a duplicate key error; got %v", err)
+	}
+
+	res := toErrorResponse(err, &protocol.FindAndUpdateRequest{RequestInfo: cmdInfo(protocol.RequestTypeFindAndUpdate)})
+	errDoc := res.Documents[0]
+	if errDoc["code"] != protocol.CodeDuplicateKey || errDoc["keyValue"] == nil {
+		t.Fatalf("expected E11000 reply with keyValue; got %v", errDoc)
+	}
+}
+
+func TestUniqueIndexLegacyInsert(t *testing.T) {
+	emu := newUniqueTestEmulator(t)
+
+	_, err := emu.process("client", &protocol.InsertRequest{
+		RequestInfo: protocol.RequestInfo{RequestType: protocol.RequestTypeInsert, ReplyType: protocol.ReplyTypeNone},
+		Collection:  testCol,
+		Inserts:     []bson.M{{"_id": 2}},
+	})
+	if !hasErrorCode(err, protocol.CodeDuplicateKey) {
+		t.Fatalf("expected a duplicate key error; got %v", err)
+	}
+}
+
+func TestWriteErrorResponse(t *testing.T) {
+	req := &protocol.InsertRequest{RequestInfo: cmdInfo(protocol.RequestTypeInsert)}
+
+	res := toErrorResponse(protocol.ServerErrorf(protocol.CodeUnauthorized, "not authorized"), req)
+	if doc := res.Documents[0]; doc["ok"] != 0 || doc["writeErrors"] != nil {
+		t.Fatalf("expected command failure for non-write errors; got %v", doc)
+	}
+
+	res = toErrorResponse(&WriteError{Index: 2, N: 2, Err: protocol.ServerErrorf(protocol.CodeBadValue, "bad value")}, req)
+	if doc := res.Documents[0]; doc["ok"] != 1 || len(bsonutil.ToArray(doc["writeErrors"])) != 1 {
+		t.Fatalf("expected writeErrors reply for write errors; got %v", doc)
+	}
+
+	updateReq := &protocol.UpdateRequest{RequestInfo: cmdInfo(protocol.RequestTypeUpdate)}
+	res = toErrorResponse(&WriteError{Index: 2, N: 2, NModified: 1, Err: protocol.ServerErrorf(protocol.CodeBadValue, "bad value")}, updateReq)
+	if doc := res.Documents[0]; doc["n"] != 2 || doc["nModified"] != 1 {
+		t.Fatalf("expected n: 2 and nModified: 1; got %v", doc)
+	}
+}
+
+func TestGetLastErrorReportsN(t *testing.T) {
+	emu := newUniqueTestEmulator(t)
+
+	legacyUpdate := func(selector, update bson.M) {
+		t.Helper()
+		selectorDoc, err := bson.Marshal(selector)
+		if err != nil {
+			t.Fatal(err)
+		}
+		updateDoc, err := bson.Marshal(update)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// OP_UPDATE with the multi flag set.
+		var payload bytes.Buffer
+		_ = binary.Write(&payload, binary.LittleEndian, int32(0))
+		payload.WriteString(testCol.String())
+		payload.WriteByte(0)
+		_ = binary.Write(&payload, binary.LittleEndian, int32(protocol.UpdateFlagMulti))
+		payload.Write(selectorDoc)
+		payload.Write(updateDoc)
+
+		var msg bytes.Buffer
+		hdr := []int32{int32(16 + payload.Len()), 1, 0, 2001}
+		_ = binary.Write(&msg, binary.LittleEndian, hdr)
+		msg.Write(payload.Bytes())
+
+		var out bytes.Buffer
+		if err := emu.HandleRequest("client", &out, msg.Bytes()); err != nil {
+			t.Fatal(err)
+		} else if out.Len() != 0 {
+			t.Fatalf("expected legacy update to receive no reply; got %d bytes", out.Len())
+		}
+	}
+	getLastError := func() bson.M {
+		t.Helper()
+		res, err := emu.handleGetLastError(nil, "client", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.Documents[0]
+	}
+
+	legacyUpdate(bson.M{"a": bson.M{"$gte": 1}}, bson.M{"$set": bson.M{"b": 1}})
+	if doc := getLastError(); doc["n"] != 2 || doc["err"] != nil {
+		t.Fatalf("expected n: 2 without error; got %v", doc)
+	}
+
+	legacyUpdate(bson.M{"_id": 2}, bson.M{"$set": bson.M{"a": 1}})
+	if doc := getLastError(); doc["n"] != 0 || doc["code"] != protocol.CodeDuplicateKey {
+		t.Fatalf("expected n: 0 with a duplicate key error; got %v", doc)
+	}
+}
+
+// newUniqueTestEmulator returns an emulator whose test collection has a
+// unique index on "a" and stores the documents {_id: 1, a: 1} and
+// {_id: 2, a: 2}.
+func newUniqueTestEmulator(t *testing.T) *MongoEmulator {
+	emu := newTestEmulator(t, newMemBackend())
+	mustProcess(t, emu, &protocol.CreateIndexesRequest{
+		RequestInfo: cmdInfo(protocol.RequestTypeCreateIndexes),
+		Collection:  testCol,
+		Indexes:     []protocol.IndexSpec{{Name: "a_1", Key: bson.D{{Name: "a", Value: 1}}, Unique: true}},
+	})
+	insertDocs(t, emu, testCol, bson.M{"_id": 1, "a": 1}, bson.M{"_id": 2, "a": 2})
+	return emu
+}
+
+func TestDuplicateKeyInsertOverWire(t *testing.T) {
+	emu := newUniqueTestEmulator(t)
+
+	body, err := bson.Marshal(bson.D{
+		{Name: "insert", Value: testCol.Collection},
+		{Name: "documents", Value: []interface{}{bson.D{{Name: "_id", Value: 3}, {Name: "a", Value: 1}}}},
+		{Name: "$db", Value: testCol.Database},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// OP_MSG with a single body section.
+	var msg bytes.Buffer
+	hdr := []int32{int32(16 + 4 + 1 + len(body)), 1, 0, 2013}
+	if err := binary.Write(&msg, binary.LittleEndian, hdr); err != nil {
+		t.Fatal(err)
+	}
+	_ = binary.Write(&msg, binary.LittleEndian, uint32(0))
+	msg.WriteByte(0)
+	msg.Write(body)
+
+	var out bytes.Buffer
+	if err := emu.HandleRequest("client", &out, msg.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Skip the reply header, flags and section kind.
+	var reply bson.M
+	if err := bson.Unmarshal(out.Bytes()[21:], &reply); err != nil {
+		t.Fatal(err)
+	}
+	writeErrors := bsonutil.ToArray(reply["writeErrors"])
+	if asInt(reply["ok"]) != 1 || len(writeErrors) != 1 {
+		t.Fatalf("expected a reply with a write error; got %v", reply)
+	}
+	writeErr := bsonutil.ToMap(writeErrors[0])
+	if asInt(writeErr["code"]) != int(protocol.CodeDuplicateKey) || writeErr["keyValue"] == nil || writeErr["keyPattern"] == nil {
+		t.Fatalf("expected E11000 write error with key info; got %v", writeErr)
+	}
+}
+
+func TestParallelArraysRejected(t *testing.T) {
+	emu := newTestEmulator(t, newMemBackend())
+	mustProcess(t, emu, &protocol.CreateIndexesRequest{
+		RequestInfo: cmdInfo(protocol.RequestTypeCreateIndexes),
+		Collection:  testCol,
+		Indexes:     []protocol.IndexSpec{{Name: "a_1_b_1", Key: bson.D{{Name: "a", Value: 1}, {Name: "b", Value: 1}}}},
+	})
+	insertDocs(t, emu, testCol, bson.M{"_id": 1, "a": []interface{}{1, 2}, "b": 1})
+
+	reply := mustProcess(t, emu, &protocol.UpdateRequest{
+		RequestInfo: cmdInfo(protocol.RequestTypeUpdate),
+		Collection:  testCol,
+		Updates: []protocol.UpdateTarget{{
+			Selector: bson.M{"_id": 1},
+			Update:   bson.M{"$set": bson.M{"b": []interface{}{3, 4}}},
+		}},
+	})
+	writeErrors := bsonutil.ToArray(reply["writeErrors"])
+	if len(writeErrors) != 1 || writeErrors[0].(bson.M)["code"] != protocol.CodeCannotIndexParallelArrays {
+		t.Fatalf("expected a CannotIndexParallelArrays write error; got %v", reply)
+	}
+}
+
+func TestMultikeyTracking(t *testing.T) {
+	b := newScanBackend()
+	emu := newTestEmulator(t, b)
+	mustProcess(t, emu, &protocol.CreateIndexesRequest{
+		RequestInfo: cmdInfo(protocol.RequestTypeCreateIndexes),
+		Collection:  testCol,
+		Indexes: []protocol.IndexSpec{
+			{Name: "a_1", Key: bson.D{{Name: "a", Value: 1}}},
+			{Name: "b_1", Key: bson.D{{Name: "b", Value: 1}}},
+		},
+	})
+	insertDocs(t, emu, testCol, bson.M{"_id": 1, "a": 1, "b": 1})
+	mustProcess(t, emu, &protocol.UpdateRequest{
+		RequestInfo: cmdInfo(protocol.RequestTypeUpdate),
+		Collection:  testCol,
+		Updates: []protocol.UpdateTarget{{
+			Selector: bson.M{"_id": 1},
+			Update:   bson.M{"$set": bson.M{"b": []interface{}{1, 2}}},
+		}},
+	})
+
+	infos, err := b.IndexInfo("client", testCol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := map[string]bool{"_id_": false, "a_1": false, "b_1": true}
+	for _, info := range infos {
+		if info.Multikey != exp[info.Spec.Name] {
+			t.Errorf("expected multikey flag for index %q to be %t", info.Spec.Name, exp[info.Spec.Name])
+		}
+	}
+}
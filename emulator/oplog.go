@@ -0,0 +1,292 @@
+package emulator
+
+import (
+	"time"
+
+	"github.com/achilleasa/mongolite/emulator/aggregate"
+	"github.com/achilleasa/mongolite/emulator/filter"
+	"github.com/achilleasa/mongolite/emulator/update"
+	"github.com/achilleasa/mongolite/protocol"
+	"golang.org/x/xerrors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	// The collection where the oplog entries are stored.
+	oplogCollection = protocol.NamespacedCollection{Database: "local", Collection: "oplog.rs"}
+)
+
+// oplogEnabled returns true if writes to col must be recorded in the oplog.
+// Writes are only recorded once the replica set has been initiated and
+// writes to the local database are never recorded.
+func (emu *MongoEmulator) oplogEnabled(clientID string, col protocol.NamespacedCollection) bool {
+	if emu.replSet == nil || col.Database == "local" {
+		return false
+	}
+	cfg, err := emu.replSetConfig(clientID)
+	return err == nil && cfg != nil
+}
+
+// appendOplog assigns a timestamp to each of the provided entries and appends
+// them to the oplog. The session and transaction arguments of origin (if any)
+// are recorded in the entries and the entries are written within the same
+// transaction as origin.
+func (emu *MongoEmulator) appendOplog(clientID string, origin protocol.Request, entries []bson.D) {
+	if len(entries) == 0 {
+		return
+	}
+
+	emu.replSet.mu.Lock()
+	emu.appendOplogLocked(clientID, origin, entries)
+	emu.replSet.mu.Unlock()
+}
+
+// appendOplogLocked implements appendOplog. Callers must hold the replica set
+// mutex. Entries are inserted while holding the mutex so that they become
+// visible in timestamp order.
+func (emu *MongoEmulator) appendOplogLocked(clientID string, origin protocol.Request, entries []bson.D) {
+	var (
+		now     = time.Now()
+		inserts = make([]bson.M, len(entries))
+	)
+	for i, entry := range entries {
+		doc := entry.Map()
+		doc["ts"] = emu.replSet.nextTimestampLocked(now)
+		doc["t"] = int64(1)
+		doc["h"] = int64(0)
+		doc["v"] = 2
+		doc["wall"] = now
+		if origin != nil && origin.SessionID() != nil {
+			doc["lsid"] = origin.SessionID().Document()
+			if txnNumber := origin.Transaction().Number; txnNumber != nil {
+				doc["txnNumber"] = *txnNumber
+			}
+		}
+		inserts[i] = doc
+	}
+	if origin != nil {
+		if txnID, ok := NewTxnID(origin); ok {
+			if _, found := emu.replSet.openTxns[txnID.String()]; !found {
+				emu.replSet.openTxns[txnID.String()] = inserts[0]["ts"].(bson.MongoTimestamp)
+			}
+		}
+	}
+
+	_, err := emu.b.HandleRequest(clientID, &protocol.InsertRequest{
+		RequestInfo: derivedRequestInfo(origin, protocol.RequestTypeInsert, protocol.ReplyTypeOpMsg),
+		Collection:  oplogCollection,
+		Inserts:     inserts,
+	})
+	if err == nil {
+		err = emu.enforceCappedBounds(clientID, origin, oplogCollection, inserts)
+	}
+	if err != nil {
+		emu.logger.WithField("client_id", clientID).WithError(err).Warn("unable to append oplog entries")
+		return
+	}
+	emu.writes.notify()
+}
+
+// createOplog creates the oplog as a capped collection whose size is bounded
+// by the configured oplog size. The oplog is not created if the backend does
+// not implement CatalogBackend or if it already exists.
+func (emu *MongoEmulator) createOplog(clientID string) error {
+	cb, ok := emu.b.(CatalogBackend)
+	if !ok {
+		return nil
+	}
+	colList, err := cb.ListCollections(clientID, oplogCollection.Database)
+	if err != nil {
+		return xerrors.Errorf("unable to create the oplog: %w", err)
+	}
+	for _, info := range colList {
+		if info.Name == oplogCollection.Collection {
+			return nil
+		}
+	}
+
+	req := &protocol.CreateRequest{
+		RequestInfo: protocol.RequestInfo{
+			RequestType: protocol.RequestTypeCreate,
+			ReplyType:   protocol.ReplyTypeOpMsg,
+		},
+		Collection: oplogCollection,
+		Capped:     true,
+		Size:       emu.oplogSize,
+	}
+	setCappedOptions(req)
+	if err := cb.CreateCollection(clientID, req); err != nil {
+		return xerrors.Errorf("unable to create the oplog: %w", err)
+	}
+	emu.capped.invalidate(req)
+	return nil
+}
+
+// oplogEdge returns the oldest or, if newest is set, the most recent entry of
+// the oplog. It returns nil if the oplog is empty.
+func (emu *MongoEmulator) oplogEdge(clientID string, newest bool) (bson.M, error) {
+	src := &backendSource{b: emu.b, clientID: clientID}
+	docs, err := src.Query(oplogCollection, aggregate.Query{
+		Sort:  aggregate.SortSpec{{Path: "ts", Descending: newest}},
+		Limit: 1,
+	})
+	if err != nil || len(docs) == 0 {
+		return nil, err
+	}
+	return docs[0].Map(), nil
+}
+
+// finishOplogTxn records that txn has been committed or aborted so that
+// readers of the oplog may move past the entries that it wrote.
+func (emu *MongoEmulator) finishOplogTxn(txn TxnID) {
+	if emu.replSet == nil {
+		return
+	}
+
+	emu.replSet.mu.Lock()
+	_, found := emu.replSet.openTxns[txn.String()]
+	delete(emu.replSet.openTxns, txn.String())
+	emu.replSet.mu.Unlock()
+	if found {
+		emu.writes.notify()
+	}
+}
+
+// matchingIDs returns the _id of the documents in col that match selector.
+// If single is set, only the first matching document is considered.
+func (emu *MongoEmulator) matchingIDs(clientID string, origin protocol.Request, col protocol.NamespacedCollection, selector bson.M, single bool) ([]interface{}, error) {
+	matcher, err := filter.Compile(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	src := &backendSource{b: emu.b, clientID: clientID, origin: origin}
+	docs, err := src.Find(col, matcher.Query())
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []interface{}
+	for _, doc := range docs {
+		if !matcher.Match(doc) {
+			continue
+		}
+		ids = append(ids, doc.Map()["_id"])
+		if single {
+			break
+		}
+	}
+	return ids, nil
+}
+
+// findByID returns the document in col with the provided _id or nil if no such
+// document exists.
+func (emu *MongoEmulator) findByID(clientID string, origin protocol.Request, col protocol.NamespacedCollection, id interface{}) bson.D {
+	src := &backendSource{b: emu.b, clientID: clientID, origin: origin}
+	docs, err := src.Find(col, bson.M{"_id": id})
+	if err != nil || len(docs) == 0 {
+		return nil
+	}
+	return docs[0]
+}
+
+// updateOplogEntries returns the oplog entries for an update operation that
+// was evaluated by previewUpdate before it was applied. Entries are only
+// recorded for the documents whose contents were changed by the update.
+func (emu *MongoEmulator) updateOplogEntries(clientID string, req *protocol.UpdateRequest, preview *updatePreview, res UpdateResult) []bson.D {
+	var entries []bson.D
+	for _, id := range preview.modified() {
+		if updated := emu.findByID(clientID, req, req.Collection, id); updated != nil {
+			entries = append(entries, updateOplogEntry(req.Collection, id, preview.u, updated))
+		}
+	}
+
+	if res.UpsertedID != nil {
+		if doc := emu.findByID(clientID, req, req.Collection, res.UpsertedID); doc != nil {
+			entries = append(entries, insertOplogEntry(req.Collection, doc))
+		}
+	}
+	return entries
+}
+
+// insertOplogEntry returns the oplog entry for an inserted document.
+func insertOplogEntry(col protocol.NamespacedCollection, doc interface{}) bson.D {
+	return bson.D{
+		{Name: "op", Value: "i"},
+		{Name: "ns", Value: col.String()},
+		{Name: "o", Value: doc},
+	}
+}
+
+// updateOplogEntry returns the oplog entry for a document with the provided
+// _id that was modified by u. The updated argument is the contents of the
+// document after the update. Replacement-style updates record the new
+// contents of the document while updates that use update operators record
+// the modified fields and their new values via $set and $unset.
+func updateOplogEntry(col protocol.NamespacedCollection, id interface{}, u *update.Update, updated bson.D) bson.D {
+	var o interface{} = updated
+	if !u.IsReplacement() {
+		updatedFields, removedFields := u.Describe(updated)
+		ops := bson.D{{Name: "$v", Value: 1}}
+		if len(updatedFields) != 0 {
+			ops = append(ops, bson.DocElem{Name: "$set", Value: updatedFields})
+		}
+		if len(removedFields) != 0 {
+			unset := make(bson.D, len(removedFields))
+			for i, path := range removedFields {
+				unset[i] = bson.DocElem{Name: path, Value: true}
+			}
+			ops = append(ops, bson.DocElem{Name: "$unset", Value: unset})
+		}
+		o = ops
+	}
+
+	return bson.D{
+		{Name: "op", Value: "u"},
+		{Name: "ns", Value: col.String()},
+		{Name: "o2", Value: bson.M{"_id": id}},
+		{Name: "o", Value: o},
+	}
+}
+
+// deleteOplogEntry returns the oplog entry for a deleted document.
+func deleteOplogEntry(col protocol.NamespacedCollection, id interface{}) bson.D {
+	return bson.D{
+		{Name: "op", Value: "d"},
+		{Name: "ns", Value: col.String()},
+		{Name: "o", Value: bson.M{"_id": id}},
+	}
+}
+
+// logCatalogChange appends the oplog entry for a successfully executed
+// request that drops or renames a collection or drops a database.
+func (emu *MongoEmulator) logCatalogChange(clientID string, req protocol.Request) {
+	var (
+		db string
+		o  bson.D
+	)
+	switch r := req.(type) {
+	case *protocol.DropRequest:
+		db, o = r.Collection.Database, bson.D{{Name: "drop", Value: r.Collection.Collection}}
+	case *protocol.DropDatabaseRequest:
+		db, o = r.Database, bson.D{{Name: "dropDatabase", Value: 1}}
+	case *protocol.RenameCollectionRequest:
+		db, o = r.From.Database, bson.D{
+			{Name: "renameCollection", Value: r.From.String()},
+			{Name: "to", Value: r.To.String()},
+			{Name: "dropTarget", Value: r.DropTarget},
+		}
+	default:
+		return
+	}
+
+	col := protocol.NamespacedCollection{Database: db, Collection: "$cmd"}
+	if !emu.oplogEnabled(clientID, col) {
+		return
+	}
+	emu.appendOplog(clientID, req, []bson.D{{
+		{Name: "op", Value: "c"},
+		{Name: "ns", Value: col.String()},
+		{Name: "o", Value: o},
+	}})
+}
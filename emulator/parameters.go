@@ -0,0 +1,137 @@
+package emulator
+
+import (
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/protocol"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// serverParameter describes a runtime parameter that can be inspected and
+// modified via the getParameter and setParameter commands.
+type serverParameter struct {
+	get func() interface{}
+	set func(v interface{}) error
+}
+
+func (emu *MongoEmulator) serverParameters() map[string]serverParameter {
+	return map[string]serverParameter{
+		"ttlMonitorSleepSecs": {
+			get: func() interface{} { return int(atomic.LoadInt64(&emu.ttl.sleepSecs)) },
+			set: func(v interface{}) error {
+				secs, ok := bsonutil.ToInt64(v)
+				if !ok {
+					return protocol.ServerErrorf(protocol.CodeBadValue, "ttlMonitorSleepSecs must be a number")
+				} else if secs <= 0 {
+					return protocol.ServerErrorf(protocol.CodeBadValue, "ttlMonitorSleepSecs must be greater than 0")
+				}
+				emu.ttl.setSleepSecs(secs)
+				return nil
+			},
+		},
+		"internalQueryMaxBlockingSortMemoryUsageBytes": {
+			get: func() interface{} { return atomic.LoadInt64(&emu.blockingMemoryLimit) },
+			set: func(v interface{}) error {
+				limit, ok := bsonutil.ToInt64(v)
+				if !ok {
+					return protocol.ServerErrorf(protocol.CodeBadValue, "internalQueryMaxBlockingSortMemoryUsageBytes must be a number")
+				} else if limit <= 0 {
+					return protocol.ServerErrorf(protocol.CodeBadValue, "internalQueryMaxBlockingSortMemoryUsageBytes must be greater than 0")
+				}
+				atomic.StoreInt64(&emu.blockingMemoryLimit, limit)
+				return nil
+			},
+		},
+		"localLogicalSessionTimeoutMinutes": {
+			get: func() interface{} { return int(atomic.LoadInt64(&emu.sessions.timeoutMinutes)) },
+			set: func(v interface{}) error {
+				minutes, ok := bsonutil.ToInt64(v)
+				if !ok {
+					return protocol.ServerErrorf(protocol.CodeBadValue, "localLogicalSessionTimeoutMinutes must be a number")
+				} else if minutes <= 0 {
+					return protocol.ServerErrorf(protocol.CodeBadValue, "localLogicalSessionTimeoutMinutes must be greater than 0")
+				}
+				atomic.StoreInt64(&emu.sessions.timeoutMinutes, minutes)
+				return nil
+			},
+		},
+	}
+}
+
+// handleSetParameter implements the setParameter command. Only the parameters
+// that affect the emulator's behavior are supported.
+func (emu *MongoEmulator) handleSetParameter(_ Backend, _ string, req *protocol.CommandRequest) (protocol.Response, error) {
+	if req.Collection.Database != "admin" {
+		return protocol.Response{}, protocol.ServerErrorf(protocol.CodeUnauthorized, "setParameter may only be run against the admin database.")
+	}
+
+	var (
+		params = emu.serverParameters()
+		resDoc = bson.M{"ok": 1}
+		names  = paramNames(req.Args)
+	)
+	if len(names) == 0 {
+		return protocol.Response{}, protocol.ServerErrorf(protocol.CodeBadValue, "no option found to set, use help:true to see options ")
+	}
+
+	for _, name := range names {
+		param, found := params[name]
+		if !found {
+			return protocol.Response{}, protocol.ServerErrorf(protocol.CodeInvalidOptions, "attempted to set unrecognized parameter [%s], use help:true to see options ", name)
+		}
+
+		resDoc["was"] = param.get()
+		if err := param.set(req.Args[name]); err != nil {
+			return protocol.Response{}, err
+		}
+	}
+
+	return protocol.Response{Documents: []bson.M{resDoc}}, nil
+}
+
+// handleGetParameter implements the getParameter command. If no parameter
+// names are specified (e.g. {getParameter: "*"}), all supported parameters
+// are returned.
+func (emu *MongoEmulator) handleGetParameter(_ Backend, _ string, req *protocol.CommandRequest) (protocol.Response, error) {
+	if req.Collection.Database != "admin" {
+		return protocol.Response{}, protocol.ServerErrorf(protocol.CodeUnauthorized, "getParameter may only be run against the admin database.")
+	}
+
+	var (
+		params = emu.serverParameters()
+		resDoc = bson.M{"ok": 1}
+		names  = paramNames(req.Args)
+	)
+	if len(names) == 0 {
+		for name := range params {
+			names = append(names, name)
+		}
+	}
+
+	for _, name := range names {
+		param, found := params[name]
+		if !found {
+			return protocol.Response{}, protocol.ServerErrorf(protocol.CodeInvalidOptions, "no option found to get")
+		}
+		resDoc[name] = param.get()
+	}
+
+	return protocol.Response{Documents: []bson.M{resDoc}}, nil
+}
+
+// paramNames returns the sorted list of command arguments that refer to
+// server parameters.
+func paramNames(args bson.M) []string {
+	var names []string
+	for name := range args {
+		if strings.HasPrefix(name, "$") || protocol.IsGenericCommandArg(name) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,324 @@
+package emulator
+
+import (
+	"sync"
+	"time"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/protocol"
+	"golang.org/x/xerrors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	// The collection where the replica set configuration is stored.
+	replSetConfigCollection = protocol.NamespacedCollection{Database: "local", Collection: "system.replset"}
+)
+
+// DefaultOplogSizeMB is the default size of the oplog in megabytes. It
+// matches the smallest oplog that mongod creates by default.
+const DefaultOplogSizeMB = 990
+
+// replicaSet tracks the state of the single-node replica set that is emulated
+// when the emulator is started with a replica set name. The emulator is always
+// the primary member of the set.
+type replicaSet struct {
+	name       string
+	host       string
+	electionID bson.ObjectId
+	startTime  time.Time
+
+	mu sync.Mutex
+
+	// The replica set configuration or nil if the set has not been
+	// initiated yet. The configuration is persisted by the backend and
+	// loaded lazily the first time that it is needed.
+	config       bson.M
+	configLoaded bool
+
+	// The clock that assigns timestamps to oplog entries.
+	clock *logicalClock
+
+	// The optime of the most recent oplog entry.
+	lastTS        bson.MongoTimestamp
+	lastWriteDate time.Time
+
+	// The timestamp of the first oplog entry written by each transaction
+	// (keyed by TxnID) that has not finished yet. The entries of a transaction only become
+	// visible to other readers once the transaction commits.
+	openTxns map[string]bson.MongoTimestamp
+}
+
+// EnableReplicaSet configures the emulator to report itself as the primary
+// member of a single-node replica set with the provided name. The host is the
+// address that clients should use to connect to the set member. Like mongod,
+// the replica set must be initiated via the replSetInitiate command before
+// it can be used.
+func (emu *MongoEmulator) EnableReplicaSet(name, host string) error {
+	if name == "" {
+		return xerrors.Errorf("invalid replica set name: value must not be empty")
+	} else if host == "" {
+		return xerrors.Errorf("invalid replica set host: value must not be empty")
+	}
+
+	emu.replSet = &replicaSet{
+		name:       name,
+		host:       host,
+		electionID: bson.NewObjectId(),
+		startTime:  time.Now(),
+		clock:      emu.clock,
+		openTxns:   make(map[string]bson.MongoTimestamp),
+	}
+	return nil
+}
+
+// SetOplogSizeMB sets the size of the oplog in megabytes. Like mongod, the
+// size only applies to the oplog that is created when the replica set is
+// initiated.
+func (emu *MongoEmulator) SetOplogSizeMB(size int64) error {
+	if size <= 0 {
+		return xerrors.Errorf("invalid oplog size %d: value must be positive", size)
+	}
+	emu.oplogSize = size << 20
+	return nil
+}
+
+// replSetConfig returns the configuration of the replica set or nil if the
+// set has not been initiated.
+func (emu *MongoEmulator) replSetConfig(clientID string) (bson.M, error) {
+	rs := emu.replSet
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if err := emu.loadReplSetLocked(clientID); err != nil {
+		return nil, err
+	}
+	return rs.config, nil
+}
+
+// loadReplSetLocked loads the replica set configuration and the optime of the
+// most recent oplog entry from the backend. Callers must hold the replica set
+// mutex.
+func (emu *MongoEmulator) loadReplSetLocked(clientID string) error {
+	rs := emu.replSet
+	if rs.configLoaded {
+		return nil
+	}
+
+	src := &backendSource{b: emu.b, clientID: clientID}
+	configs, err := src.Find(replSetConfigCollection, bson.M{"_id": rs.name})
+	if err != nil {
+		return xerrors.Errorf("unable to load replica set configuration: %w", err)
+	}
+	lastEntry, err := emu.oplogEdge(clientID, true)
+	if err != nil {
+		return xerrors.Errorf("unable to load the most recent oplog entry: %w", err)
+	}
+
+	for _, cfg := range configs {
+		if cfgMap := cfg.Map(); cfgMap["_id"] == rs.name {
+			rs.config = cfgMap
+		}
+	}
+	if ts, _ := lastEntry["ts"].(bson.MongoTimestamp); ts > rs.lastTS {
+		rs.lastTS = ts
+		rs.lastWriteDate, _ = lastEntry["wall"].(time.Time)
+	}
+	rs.clock.advance(rs.lastTS)
+	rs.configLoaded = true
+	return nil
+}
+
+// replSetIsMasterFields returns the replica set related fields of an isMaster
+// reply. If the replica set configuration cannot be loaded, the error is
+// logged and the set is reported as not yet initiated.
+func (emu *MongoEmulator) replSetIsMasterFields(clientID string) bson.M {
+	cfg, err := emu.replSetConfig(clientID)
+	if err != nil {
+		emu.logger.WithField("client_id", clientID).WithError(err).Warn("unable to load replica set configuration")
+		cfg = nil
+	}
+
+	rs := emu.replSet
+	if cfg == nil {
+		return bson.M{
+			"ismaster":     false,
+			"secondary":    false,
+			"isreplicaset": true,
+			"info":         "Does not have a valid replica set config",
+		}
+	}
+
+	rs.mu.Lock()
+	opTime, lastWriteDate := rs.opTimeLocked(), rs.lastWriteDate
+	rs.mu.Unlock()
+
+	return bson.M{
+		"ismaster":   true,
+		"secondary":  false,
+		"setName":    rs.name,
+		"setVersion": cfg["version"],
+		"hosts":      []string{rs.host},
+		"primary":    rs.host,
+		"me":         rs.host,
+		"electionId": rs.electionID,
+		"lastWrite": bson.M{
+			"opTime":            opTime,
+			"lastWriteDate":     lastWriteDate,
+			"majorityOpTime":    opTime,
+			"majorityWriteDate": lastWriteDate,
+		},
+	}
+}
+
+// opTimeLocked returns the optime of the most recent oplog entry. Callers must
+// hold the replica set mutex.
+func (rs *replicaSet) opTimeLocked() bson.M {
+	return bson.M{"ts": rs.lastTS, "t": int64(1)}
+}
+
+// visibleTSLocked returns the timestamp up to which all oplog entries are
+// visible to readers outside of transactions. Entries written by
+// transactions that have not finished yet, and the entries that follow
+// them, are excluded. Callers must hold the replica set mutex.
+func (rs *replicaSet) visibleTSLocked() bson.MongoTimestamp {
+	visible := rs.lastTS
+	for _, ts := range rs.openTxns {
+		if ts <= visible {
+			visible = ts - 1
+		}
+	}
+	return visible
+}
+
+// nextTimestampLocked returns a timestamp that is greater than the timestamp
+// of all existing oplog entries. Oplog timestamps are assigned by the logical
+// clock so that they double as cluster times. Callers must hold the replica
+// set mutex.
+func (rs *replicaSet) nextTimestampLocked(now time.Time) bson.MongoTimestamp {
+	ts := rs.clock.tick(now)
+	rs.lastTS, rs.lastWriteDate = ts, now
+	return ts
+}
+
+// handleReplSetGetStatus implements the replSetGetStatus command.
+func (emu *MongoEmulator) handleReplSetGetStatus(_ Backend, clientID string, req *protocol.CommandRequest) (protocol.Response, error) {
+	if req.Collection.Database != "admin" {
+		return protocol.Response{}, protocol.ServerErrorf(protocol.CodeUnauthorized, "replSetGetStatus may only be run against the admin database.")
+	} else if emu.replSet == nil {
+		// Emulate server with no replicas.
+		return protocol.Response{}, protocol.ServerErrorf(protocol.CodeNoReplicationEnabled, "not running with --replSet")
+	}
+
+	cfg, err := emu.replSetConfig(clientID)
+	if err != nil {
+		return protocol.Response{}, err
+	} else if cfg == nil {
+		return protocol.Response{}, protocol.ServerErrorf(protocol.CodeNotYetInitialized, "no replset config has been received")
+	}
+
+	rs := emu.replSet
+	rs.mu.Lock()
+	opTime, lastWriteDate := rs.opTimeLocked(), rs.lastWriteDate
+	rs.mu.Unlock()
+
+	now := time.Now()
+	return protocol.Response{
+		Documents: []bson.M{{
+			"ok":                      1,
+			"set":                     rs.name,
+			"date":                    now.UTC(),
+			"myState":                 1,
+			"term":                    int64(1),
+			"heartbeatIntervalMillis": int64(2000),
+			"optimes": bson.M{
+				"lastCommittedOpTime":       opTime,
+				"readConcernMajorityOpTime": opTime,
+				"appliedOpTime":             opTime,
+				"durableOpTime":             opTime,
+			},
+			"members": []bson.M{{
+				"_id":           0,
+				"name":          rs.host,
+				"health":        1.0,
+				"state":         1,
+				"stateStr":      "PRIMARY",
+				"uptime":        int(now.Sub(rs.startTime).Seconds()),
+				"optime":        opTime,
+				"optimeDate":    lastWriteDate,
+				"electionTime":  bson.MongoTimestamp(rs.startTime.Unix() << 32),
+				"electionDate":  rs.startTime.UTC(),
+				"configVersion": cfg["version"],
+				"self":          true,
+			}},
+		}},
+	}, nil
+}
+
+// handleReplSetInitiate implements the replSetInitiate command. Only
+// configurations with a single member (the emulator itself) are accepted.
+func (emu *MongoEmulator) handleReplSetInitiate(clientID string, r protocol.Request) (protocol.Response, error) {
+	req := r.(*protocol.ReplSetInitiateRequest)
+	if emu.replSet == nil {
+		return protocol.Response{}, protocol.ServerErrorf(protocol.CodeNoReplicationEnabled, "This node was not started with the replSet option")
+	}
+
+	rs := emu.replSet
+	cfg, err := emu.validateReplSetConfig(req.Config)
+	if err != nil {
+		return protocol.Response{}, err
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if err := emu.loadReplSetLocked(clientID); err != nil {
+		return protocol.Response{}, err
+	} else if rs.config != nil {
+		return protocol.Response{}, protocol.ServerErrorf(protocol.CodeAlreadyInitialized, "already initialized")
+	}
+
+	_, err = emu.b.HandleRequest(clientID, &protocol.InsertRequest{
+		RequestInfo: protocol.RequestInfo{
+			RequestType: protocol.RequestTypeInsert,
+			ReplyType:   protocol.ReplyTypeOpMsg,
+		},
+		Collection: replSetConfigCollection,
+		Inserts:    []bson.M{cfg},
+	})
+	if err != nil {
+		return protocol.Response{}, xerrors.Errorf("unable to store replica set configuration: %w", err)
+	}
+	rs.config = cfg
+	if err := emu.createOplog(clientID); err != nil {
+		return protocol.Response{}, err
+	}
+
+	emu.appendOplogLocked(clientID, nil, []bson.D{{
+		{Name: "op", Value: "n"},
+		{Name: "ns", Value: ""},
+		{Name: "o", Value: bson.M{"msg": "initiating set"}},
+	}})
+	return protocol.Response{Documents: []bson.M{{"ok": 1}}}, nil
+}
+
+// validateReplSetConfig validates a replica set configuration supplied to
+// replSetInitiate. If cfg is nil, a default configuration is returned.
+func (emu *MongoEmulator) validateReplSetConfig(cfg bson.M) (bson.M, error) {
+	rs := emu.replSet
+	if cfg == nil {
+		return bson.M{
+			"_id":     rs.name,
+			"version": 1,
+			"members": []bson.M{{"_id": 0, "host": rs.host}},
+		}, nil
+	}
+
+	if name, _ := cfg["_id"].(string); name != rs.name {
+		return nil, protocol.ServerErrorf(protocol.CodeInvalidReplicaSetConfig, "Attempting to initiate a replica set with name %v, but command line reports %s; rejecting", cfg["_id"], rs.name)
+	} else if members := bsonutil.ToArray(cfg["members"]); len(members) != 1 {
+		return nil, protocol.ServerErrorf(protocol.CodeInvalidReplicaSetConfig, "replica set configuration must contain exactly one member; only single-node replica sets are supported")
+	}
+	if _, hasVersion := cfg["version"]; !hasVersion {
+		cfg["version"] = 1
+	}
+	return cfg, nil
+}
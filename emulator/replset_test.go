@@ -0,0 +1,126 @@
+package emulator
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/protocol"
+	"golang.org/x/xerrors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// failingQueryBackend extends memBackend by failing the queries against the
+// collections of the databases listed in failDBs.
+type failingQueryBackend struct {
+	*memBackend
+	failDBs map[string]bool
+}
+
+func (b *failingQueryBackend) HandleRequest(clientID string, req protocol.Request) (protocol.Response, error) {
+	if r, ok := req.(*protocol.QueryRequest); ok && b.failDBs[r.Collection.Database] {
+		return protocol.Response{}, xerrors.Errorf("backend unavailable")
+	}
+	return b.memBackend.HandleRequest(clientID, req)
+}
+
+func TestIsMasterToleratesBackendErrors(t *testing.T) {
+	b := &failingQueryBackend{
+		memBackend: newMemBackend(),
+		failDBs:    map[string]bool{"local": true, "admin": true},
+	}
+	emu := newTestEmulator(t, b)
+	if err := emu.EnableReplicaSet("rs0", "localhost:27017"); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := emu.handleIsMaster(nil, "client", &protocol.CommandRequest{
+		RequestInfo: cmdInfo(protocol.RequestTypeCommand),
+		Command:     "isMaster",
+		Args:        bson.M{"isMaster": 1, "saslSupportedMechs": "admin.alice"},
+	})
+	if err != nil {
+		t.Fatalf("expected the handshake to succeed; got %v", err)
+	}
+
+	resDoc := res.Documents[0]
+	if resDoc["isreplicaset"] != true || resDoc["setName"] != nil {
+		t.Fatalf("expected the replica set to be reported as uninitiated; got %v", resDoc)
+	}
+	if _, found := resDoc["saslSupportedMechs"]; found {
+		t.Fatalf("expected saslSupportedMechs to be omitted; got %v", resDoc)
+	}
+}
+
+func TestUpdateOplogEntries(t *testing.T) {
+	b := newMemBackend()
+	emu := newTestEmulator(t, b)
+	if err := emu.EnableReplicaSet("rs0", "localhost:27017"); err != nil {
+		t.Fatal(err)
+	}
+	mustProcess(t, emu, &protocol.ReplSetInitiateRequest{
+		RequestInfo: cmdInfo(protocol.RequestTypeReplSetInitiate),
+	})
+	insertDocs(t, emu, testCol, bson.M{"_id": 1, "a": 2}, bson.M{"_id": 2, "a": 1}, bson.M{"_id": 3, "a": 1})
+
+	// The update leaves the first matching document unchanged.
+	mustProcess(t, emu, &protocol.UpdateRequest{
+		RequestInfo: cmdInfo(protocol.RequestTypeUpdate),
+		Collection:  testCol,
+		Updates: []protocol.UpdateTarget{{
+			Selector: bson.M{},
+			Update:   bson.M{"$set": bson.M{"a": 2}},
+			Flags:    protocol.UpdateFlagMulti,
+		}},
+	})
+
+	var updatedIDs []interface{}
+	for _, entry := range b.docs(oplogCollection) {
+		if entryMap := entry.Map(); entryMap["op"] == "u" {
+			updatedIDs = append(updatedIDs, bsonutil.ToMap(entryMap["o2"])["_id"])
+		}
+	}
+	if exp := []interface{}{2, 3}; !reflect.DeepEqual(updatedIDs, exp) {
+		t.Fatalf("expected update oplog entries for _id %v; got %v", exp, updatedIDs)
+	}
+}
+
+func TestReplSetLoadsLastOpTime(t *testing.T) {
+	b := &queryRecorder{memBackend: newMemBackend()}
+	emu := newTestEmulator(t, b)
+	if err := emu.EnableReplicaSet("rs0", "localhost:27017"); err != nil {
+		t.Fatal(err)
+	}
+	mustProcess(t, emu, &protocol.ReplSetInitiateRequest{
+		RequestInfo: cmdInfo(protocol.RequestTypeReplSetInitiate),
+	})
+	insertDocs(t, emu, testCol, bson.M{"_id": 1}, bson.M{"_id": 2}, bson.M{"_id": 3})
+	expTS := emu.replSet.lastTS
+
+	// A new emulator instance resumes from the most recent oplog entry
+	// without reading the whole oplog.
+	emu = newTestEmulator(t, b)
+	if err := emu.EnableReplicaSet("rs0", "localhost:27017"); err != nil {
+		t.Fatal(err)
+	}
+	b.queries = nil
+	if _, err := emu.replSetConfig("client"); err != nil {
+		t.Fatal(err)
+	}
+	if emu.replSet.lastTS != expTS {
+		t.Fatalf("expected the last optime to be %v; got %v", expTS, emu.replSet.lastTS)
+	}
+	var oplogQueries int
+	for _, q := range b.queries {
+		if q.Collection != oplogCollection {
+			continue
+		}
+		oplogQueries++
+		if q.NumToReturn != 1 {
+			t.Fatalf("expected the oplog query to be limited to the most recent entry; got %+v", q)
+		}
+	}
+	if oplogQueries != 1 {
+		t.Fatalf("expected a single oplog query; got %d", oplogQueries)
+	}
+}
@@ -0,0 +1,197 @@
+package emulator
+
+import (
+	"time"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/protocol"
+	"golang.org/x/xerrors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	// The collection where the replies of retryable writes are recorded
+	// for backends that do not implement RetryableWriteBackend. Like
+	// mongod, the emulator keeps a single document per session.
+	retryableWritesCollection = protocol.NamespacedCollection{Database: "config", Collection: "transactions"}
+)
+
+// RetryableWriteBackend is implemented by backends that can durably record the
+// outcome of retryable writes (e.g. in a dedicated SQL table).
+//
+// Drivers retry a failed write once, using the same lsid and txnNumber, if the
+// original attempt failed due to a network error. The emulator records the
+// reply of each completed retryable write so that a retried write returns the
+// original reply instead of being applied twice. When a backend does not
+// implement this interface, the replies are stored in the config.transactions
+// collection via regular query and update requests. In both cases, the write
+// and the recording of its reply are not applied atomically.
+type RetryableWriteBackend interface {
+	Backend
+
+	// LoadWriteResult returns the recorded reply for the retryable write
+	// identified by id or nil if no such write has completed.
+	LoadWriteResult(clientID string, id TxnID) (bson.M, error)
+
+	// StoreWriteResult records the reply of the retryable write identified
+	// by id. Replies recorded for earlier transaction numbers of the same
+	// session may be discarded.
+	StoreWriteResult(clientID string, id TxnID, reply bson.M) error
+}
+
+// retryableWriteID returns the ID of the retryable write that req represents.
+// The ok return value is false if req is not a retryable write.
+func retryableWriteID(req protocol.Request) (id TxnID, ok bool) {
+	session, txn := req.SessionID(), req.Transaction()
+	if session == nil || txn.Number == nil || txn.Autocommit != nil || !isRetryableWriteCommand(req) {
+		return TxnID{}, false
+	}
+	return TxnID{Session: *session, Number: *txn.Number}, true
+}
+
+// isRetryableWriteCommand returns true if req is a write command that can be
+// retried by clients.
+func isRetryableWriteCommand(req protocol.Request) bool {
+	switch req.GetType() {
+	case protocol.RequestTypeInsert, protocol.RequestTypeUpdate, protocol.RequestTypeDelete,
+		protocol.RequestTypeFindAndUpdate, protocol.RequestTypeFindAndDelete:
+		return true
+	}
+	return false
+}
+
+// processRetryableWrite executes a retryable write unless it has already been
+// executed, in which case the reply of the original execution is returned.
+func (emu *MongoEmulator) processRetryableWrite(clientID string, req protocol.Request, id TxnID) (protocol.Response, error) {
+	s := emu.sessions.get(id.Session)
+	if s == nil {
+		return protocol.Response{}, protocol.ServerErrorf(protocol.CodeNoSuchSession, "session %s does not exist", id.Session.String())
+	}
+
+	// Holding the session lock while the write executes ensures that a
+	// retry which arrives while the original attempt is still running
+	// waits for it to complete and observes its reply.
+	s.txnMu.Lock()
+	defer s.txnMu.Unlock()
+
+	if id.Number < s.txnNumber {
+		return protocol.Response{}, protocol.ServerErrorf(protocol.CodeTransactionTooOld, "Retryable write with txnNumber %d is prohibited on session %s because a newer retryable write or transaction with txnNumber %d has already started on this session.", id.Number, id.Session.String(), s.txnNumber)
+	} else if id.Number == s.txnNumber && s.txnState != txnStateNone {
+		return protocol.Response{}, protocol.ServerErrorf(protocol.CodeIncompleteTransactionHistory, "Cannot retry a retryable write that has been converted into a transaction")
+	}
+
+	reply, err := emu.loadWriteResult(clientID, s, id)
+	if err != nil {
+		return protocol.Response{}, err
+	} else if reply != nil {
+		return protocol.Response{Documents: []bson.M{reply}}, nil
+	}
+
+	// A new transaction number discards the reply of the previous write.
+	s.txnNumber, s.txnState, s.writeResult = id.Number, txnStateNone, nil
+
+	res, err := emu.processRequest(clientID, req)
+	if err != nil {
+		if srvErr, ok := asServerError(err); ok && isRetryableError(srvErr.Code) {
+			return res, withErrorLabels(err, protocol.ErrorLabelRetryableWriteError)
+		}
+		return res, err
+	} else if len(res.Documents) == 0 {
+		return res, nil
+	}
+
+	if err = emu.storeWriteResult(clientID, s, id, res.Documents[0]); err != nil {
+		return protocol.Response{}, err
+	}
+	return res, nil
+}
+
+// loadWriteResult returns the recorded reply of the retryable write identified
+// by id or nil if the write has not been executed. Callers must hold the
+// transaction mutex of s.
+func (emu *MongoEmulator) loadWriteResult(clientID string, s *session, id TxnID) (bson.M, error) {
+	if id.Number == s.txnNumber && s.writeResult != nil {
+		return s.writeResult, nil
+	}
+
+	rb, ok := emu.b.(RetryableWriteBackend)
+	if !ok {
+		return emu.loadStoredWriteResult(clientID, id)
+	}
+	reply, err := rb.LoadWriteResult(clientID, id)
+	if err != nil {
+		return nil, xerrors.Errorf("unable to load result of retryable write %d: %w", id.Number, err)
+	}
+	return reply, nil
+}
+
+// storeWriteResult records the reply of the retryable write identified by id.
+// Callers must hold the transaction mutex of s.
+func (emu *MongoEmulator) storeWriteResult(clientID string, s *session, id TxnID, reply bson.M) error {
+	if rb, ok := emu.b.(RetryableWriteBackend); ok {
+		if err := rb.StoreWriteResult(clientID, id, reply); err != nil {
+			return xerrors.Errorf("unable to store result of retryable write %d: %w", id.Number, err)
+		}
+	} else {
+		emu.storeWriteResultDoc(clientID, id, reply)
+	}
+	s.writeResult = reply
+	return nil
+}
+
+// loadStoredWriteResult returns the reply of the retryable write identified by
+// id from the config.transactions collection or nil if no reply has been
+// recorded for it.
+func (emu *MongoEmulator) loadStoredWriteResult(clientID string, id TxnID) (bson.M, error) {
+	src := &backendSource{b: emu.b, clientID: clientID}
+	docs, err := src.Find(retryableWritesCollection, bson.M{"_id": id.Session.Document()})
+	if xerrors.Is(err, ErrUnsupportedRequest) {
+		return nil, nil
+	} else if err != nil {
+		return nil, xerrors.Errorf("unable to load result of retryable write %d: %w", id.Number, err)
+	}
+
+	for _, doc := range docs {
+		docMap := doc.Map()
+		if txnNum, _ := bsonutil.ToInt64(docMap["txnNum"]); txnNum == id.Number && docMap["reply"] != nil {
+			return bsonutil.ToMap(docMap["reply"]), nil
+		}
+	}
+	return nil, nil
+}
+
+// storeWriteResultDoc records the reply of the retryable write identified by
+// id in the config.transactions collection, replacing the reply recorded for
+// an earlier write of the same session. As the write has already been
+// applied, failures are logged instead of being reported to the client; the
+// reply is still kept in memory with the session state.
+func (emu *MongoEmulator) storeWriteResultDoc(clientID string, id TxnID, reply bson.M) {
+	req := &protocol.UpdateRequest{
+		RequestInfo: protocol.RequestInfo{RequestType: protocol.RequestTypeUpdate, ReplyType: protocol.ReplyTypeOpMsg},
+		Collection:  retryableWritesCollection,
+	}
+	target := protocol.UpdateTarget{
+		Selector: bson.M{"_id": id.Session.Document()},
+		Update: bson.M{
+			"_id":           id.Session.Document(),
+			"txnNum":        id.Number,
+			"lastWriteDate": time.Now().UTC(),
+			"reply":         reply,
+		},
+		Flags: protocol.UpdateFlagUpsert,
+	}
+
+	_, err := emu.updateDocuments(clientID, req, target)
+	if err != nil && !xerrors.Is(err, ErrUnsupportedRequest) {
+		emu.logger.WithField("session_id", id.Session.String()).WithError(err).Warn("unable to store result of retryable write")
+	}
+}
+
+// isRetryableError returns true if a write that failed with code can be safely
+// retried by clients.
+func isRetryableError(code protocol.ErrorCode) bool {
+	return code.IsA(protocol.ErrorCategoryRetriableError) ||
+		code.IsA(protocol.ErrorCategoryNetworkError) ||
+		code.IsA(protocol.ErrorCategoryNotPrimaryError) ||
+		code.IsA(protocol.ErrorCategoryShutdownError)
+}
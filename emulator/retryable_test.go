@@ -0,0 +1,56 @@
+package emulator
+
+import (
+	"testing"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/protocol"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestRetryableWriteSurvivesRestart(t *testing.T) {
+	b := newMemBackend()
+	sessionID, err := newLogicalSessionID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	insert := func(emu *MongoEmulator, txnNumber int64) bson.M {
+		t.Helper()
+		info := cmdInfo(protocol.RequestTypeInsert)
+		info.Session, info.Txn = &sessionID, protocol.TxnInfo{Number: &txnNumber}
+		return mustProcess(t, emu, &protocol.InsertRequest{
+			RequestInfo: info,
+			Collection:  testCol,
+			Inserts:     []bson.M{{"a": txnNumber}},
+		})
+	}
+
+	if reply := insert(newTestEmulator(t, b), 1); asInt(reply["n"]) != 1 {
+		t.Fatalf("expected n: 1; got %v", reply)
+	}
+
+	// A retry that reaches a new emulator instance must return the
+	// recorded reply instead of inserting the document again.
+	emu := newTestEmulator(t, b)
+	if reply := insert(emu, 1); asInt(reply["n"]) != 1 || reply["writeErrors"] != nil {
+		t.Fatalf("expected the original reply; got %v", reply)
+	}
+	if got := len(b.docs(testCol)); got != 1 {
+		t.Fatalf("expected the retried insert to be applied once; got %d documents", got)
+	}
+
+	// A new transaction number executes the write and replaces the
+	// recorded reply.
+	insert(emu, 2)
+	if got := len(b.docs(testCol)); got != 2 {
+		t.Fatalf("expected 2 documents; got %d", got)
+	}
+	recorded := b.docs(retryableWritesCollection)
+	if len(recorded) != 1 {
+		t.Fatalf("expected a single config.transactions document for the session; got %v", recorded)
+	}
+	if txnNum, _ := bsonutil.Get(recorded[0], "txnNum"); txnNum != int64(2) {
+		t.Fatalf("expected the recorded txnNum to be 2; got %v", txnNum)
+	}
+}
@@ -0,0 +1,201 @@
+package scram
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// ErrAuthenticationFailed is returned when a client fails to prove that it
+// knows the password of the user it authenticates as.
+var ErrAuthenticationFailed = xerrors.New("authentication failed")
+
+// CredentialsLookup returns the credentials of user for the mechanism of a
+// conversation. The found return value is false if the user does not exist or
+// has no credentials for the mechanism.
+type CredentialsLookup func(user string) (creds Credentials, found bool, err error)
+
+// ServerConversation tracks the server side of a SCRAM conversation. The
+// conversation consists of three steps:
+//
+//   - the client-first message is answered with the server-first message.
+//   - the client-final message is answered with the server-final message.
+//   - the empty client message that acknowledges the server-final message
+//     completes the conversation.
+type ServerConversation struct {
+	mech   *Mechanism
+	lookup CredentialsLookup
+	step   int
+
+	user            string
+	creds           Credentials
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+	authenticated   bool
+
+	// Set if the user does not exist. The conversation proceeds with
+	// fake credentials and fails when the client proof is verified so
+	// that clients cannot find out which users exist.
+	unknownUser bool
+}
+
+// NewServerConversation starts a conversation for authenticating a client
+// with the provided mechanism.
+func (m *Mechanism) NewServerConversation(lookup CredentialsLookup) *ServerConversation {
+	return &ServerConversation{mech: m, lookup: lookup}
+}
+
+// User returns the name of the user that the client authenticates as.
+func (c *ServerConversation) User() string { return c.user }
+
+// Authenticated returns true if the client has proven that it knows the
+// password of the user.
+func (c *ServerConversation) Authenticated() bool { return c.authenticated }
+
+// Step processes the next client message and returns the server response.
+// The done return value is true when the conversation has completed
+// successfully.
+func (c *ServerConversation) Step(msg []byte) (res []byte, done bool, err error) {
+	step := c.step
+	c.step++
+
+	switch step {
+	case 0:
+		res, err = c.processClientFirst(string(msg))
+		return res, false, err
+	case 1:
+		res, err = c.processClientFinal(string(msg))
+		return res, false, err
+	case 2:
+		if !c.authenticated || len(msg) != 0 {
+			return nil, false, xerrors.Errorf("unexpected client message after the server-final message")
+		}
+		return nil, true, nil
+	}
+	return nil, false, xerrors.Errorf("conversation has already completed")
+}
+
+// processClientFirst parses a client-first message with the format
+// "gs2-header client-first-bare" where the bare message contains the user
+// name (n) and client nonce (r) attributes.
+func (c *ServerConversation) processClientFirst(msg string) ([]byte, error) {
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 {
+		return nil, xerrors.Errorf("malformed client-first message")
+	}
+	switch {
+	case parts[0] == "n" || parts[0] == "y":
+	case strings.HasPrefix(parts[0], "p="):
+		return nil, xerrors.Errorf("channel binding is not supported")
+	default:
+		return nil, xerrors.Errorf("malformed client-first message: invalid gs2 header")
+	}
+	c.gs2Header = parts[0] + "," + parts[1] + ","
+	c.clientFirstBare = parts[2]
+
+	attrs, err := parseAttributes(c.clientFirstBare)
+	if err != nil {
+		return nil, err
+	} else if _, found := attrs["m"]; found {
+		return nil, xerrors.Errorf("mandatory extensions are not supported")
+	}
+
+	if c.user, err = decodeUserName(attrs["n"]); err != nil {
+		return nil, err
+	}
+	clientNonce := attrs["r"]
+	if clientNonce == "" {
+		return nil, xerrors.Errorf("malformed client-first message: missing client nonce")
+	}
+
+	creds, found, err := c.lookup(c.user)
+	if err != nil {
+		return nil, err
+	} else if !found {
+		creds, c.unknownUser = c.mech.fakeCredentials(c.user), true
+	}
+	c.creds = creds
+
+	serverNonce := make([]byte, 24)
+	if _, err = rand.Read(serverNonce); err != nil {
+		return nil, err
+	}
+	c.nonce = clientNonce + base64.StdEncoding.EncodeToString(serverNonce)
+	c.serverFirst = "r=" + c.nonce +
+		",s=" + base64.StdEncoding.EncodeToString(creds.Salt) +
+		",i=" + strconv.Itoa(creds.IterationCount)
+	return []byte(c.serverFirst), nil
+}
+
+// processClientFinal parses a client-final message with the format
+// "c=<gs2-header>,r=<nonce>,p=<proof>", verifies the client proof and
+// returns the server signature.
+func (c *ServerConversation) processClientFinal(msg string) ([]byte, error) {
+	proofIndex := strings.LastIndex(msg, ",p=")
+	if proofIndex == -1 {
+		return nil, xerrors.Errorf("malformed client-final message: missing proof")
+	}
+	withoutProof := msg[:proofIndex]
+
+	attrs, err := parseAttributes(msg)
+	if err != nil {
+		return nil, err
+	}
+	if attrs["c"] != base64.StdEncoding.EncodeToString([]byte(c.gs2Header)) {
+		return nil, xerrors.Errorf("channel binding data does not match the gs2 header")
+	} else if attrs["r"] != c.nonce {
+		return nil, xerrors.Errorf("nonce mismatch")
+	}
+	proof, err := base64.StdEncoding.DecodeString(attrs["p"])
+	if err != nil || len(proof) != len(c.creds.StoredKey) {
+		return nil, xerrors.Errorf("malformed client proof")
+	}
+
+	authMsg := []byte(c.clientFirstBare + "," + c.serverFirst + "," + withoutProof)
+	clientKey := c.mech.hmac(c.creds.StoredKey, authMsg)
+	for i := range clientKey {
+		clientKey[i] ^= proof[i]
+	}
+	if subtle.ConstantTimeCompare(c.mech.h(clientKey), c.creds.StoredKey) != 1 || c.unknownUser {
+		if c.unknownUser {
+			return nil, xerrors.Errorf("unknown user %q: %w", c.user, ErrAuthenticationFailed)
+		}
+		return nil, xerrors.Errorf("invalid proof for user %q: %w", c.user, ErrAuthenticationFailed)
+	}
+	c.authenticated = true
+
+	serverSignature := c.mech.hmac(c.creds.ServerKey, authMsg)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), nil
+}
+
+// parseAttributes parses a comma-separated list of "<name>=<value>" SCRAM
+// attributes.
+func parseAttributes(msg string) (map[string]string, error) {
+	attrs := make(map[string]string)
+	for _, attr := range strings.Split(msg, ",") {
+		if len(attr) < 2 || attr[1] != '=' {
+			return nil, xerrors.Errorf("malformed attribute %q", attr)
+		}
+		attrs[attr[:1]] = attr[2:]
+	}
+	return attrs, nil
+}
+
+// decodeUserName decodes a user name where the "," and "=" characters are
+// escaped as "=2C" and "=3D".
+func decodeUserName(name string) (string, error) {
+	if name == "" {
+		return "", xerrors.Errorf("malformed client-first message: missing user name")
+	}
+	decoded := strings.NewReplacer("=2C", ",", "=3D", "=").Replace(name)
+	if strings.Count(decoded, "=") != strings.Count(name, "=3D") {
+		return "", xerrors.Errorf("malformed user name %q", name)
+	}
+	return decoded, nil
+}
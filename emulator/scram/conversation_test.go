@@ -0,0 +1,110 @@
+package scram
+
+import (
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/xerrors"
+)
+
+// authenticate runs a conversation for user with the provided password
+// against lookup. It returns the server-first message and the error reported
+// by the server.
+func authenticate(t *testing.T, m *Mechanism, lookup CredentialsLookup, user, password string) (string, error) {
+	t.Helper()
+	conv := m.NewServerConversation(lookup)
+
+	clientFirstBare := "n=" + user + ",r=clientnonce"
+	res, _, err := conv.Step([]byte("n,," + clientFirstBare))
+	if err != nil {
+		return "", err
+	}
+	serverFirst := string(res)
+	attrs, err := parseAttributes(serverFirst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt, _ := base64.StdEncoding.DecodeString(attrs["s"])
+	iterations, _ := strconv.Atoi(attrs["i"])
+
+	prepared, err := m.prepare(user, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saltedPassword := pbkdf2(m.hash, []byte(prepared), salt, iterations)
+	clientKey := m.hmac(saltedPassword, []byte("Client Key"))
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte("n,,")) + ",r=" + attrs["r"]
+	signature := m.hmac(m.h(clientKey), []byte(clientFirstBare+","+serverFirst+","+withoutProof))
+	for i := range clientKey {
+		clientKey[i] ^= signature[i]
+	}
+
+	_, _, err = conv.Step([]byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(clientKey)))
+	return serverFirst, err
+}
+
+func TestServerConversation(t *testing.T) {
+	for _, m := range Mechanisms {
+		t.Run(m.Name, func(t *testing.T) {
+			creds, err := m.NewCredentials("alice", "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			lookup := func(user string) (Credentials, bool, error) {
+				return creds, user == "alice", nil
+			}
+
+			if _, err := authenticate(t, m, lookup, "alice", "secret"); err != nil {
+				t.Fatalf("expected authentication to succeed; got %v", err)
+			}
+			if _, err := authenticate(t, m, lookup, "alice", "wrong"); !xerrors.Is(err, ErrAuthenticationFailed) {
+				t.Fatalf("expected an authentication failure for a wrong password; got %v", err)
+			}
+
+			// Unknown users are answered with a server-first message
+			// and fail when the proof is verified.
+			first, err := authenticate(t, m, lookup, "bob", "secret")
+			if !xerrors.Is(err, ErrAuthenticationFailed) {
+				t.Fatalf("expected an authentication failure for an unknown user; got %v", err)
+			}
+			if !strings.Contains(first, ",i="+strconv.Itoa(m.iterations)) {
+				t.Fatalf("expected the default iteration count in %q", first)
+			}
+			again, _ := authenticate(t, m, lookup, "bob", "secret")
+			if salt := strings.Split(first, ",")[1]; !strings.Contains(again, ","+salt+",") {
+				t.Fatalf("expected repeated attempts to observe the same salt; got %q and %q", first, again)
+			}
+		})
+	}
+}
+
+func TestSASLPrep(t *testing.T) {
+	specs := []struct {
+		descr    string
+		password string
+		expErr   bool
+	}{
+		{descr: "printable ASCII", password: "p@ss w0rd~"},
+		{descr: "non-ASCII", password: "pässword", expErr: true},
+		{descr: "control character", password: "pass\tword", expErr: true},
+	}
+
+	for _, spec := range specs {
+		t.Run(spec.descr, func(t *testing.T) {
+			_, err := SHA256.NewCredentials("alice", spec.password)
+			if spec.expErr && !xerrors.Is(err, ErrUnsupportedPassword) {
+				t.Fatalf("expected ErrUnsupportedPassword; got %v", err)
+			} else if !spec.expErr && err != nil {
+				t.Fatal(err)
+			}
+
+			// SCRAM-SHA-1 hashes the password and accepts any
+			// characters.
+			if _, err := SHA1.NewCredentials("alice", spec.password); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+// Package scram implements the server side of the SCRAM-SHA-1 and
+// SCRAM-SHA-256 SASL authentication mechanisms as used by mongo.
+//
+// See https://tools.ietf.org/html/rfc5802 and
+// https://github.com/mongodb/specifications/blob/master/source/auth/auth.rst
+package scram
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+
+	"golang.org/x/xerrors"
+)
+
+// ErrUnsupportedPassword is returned when a password cannot be prepared for
+// SCRAM-SHA-256 as it contains characters outside of the printable ASCII
+// range.
+var ErrUnsupportedPassword = xerrors.New("SCRAM-SHA-256 passwords may only contain printable ASCII characters")
+
+// fakeSaltKey is the secret used for deriving the salts that are reported
+// for users that do not exist.
+var fakeSaltKey = randomBytes(32)
+
+// Mechanism describes a SCRAM mechanism.
+type Mechanism struct {
+	// The SASL name of the mechanism.
+	Name string
+
+	hash       func() hash.Hash
+	iterations int
+	saltLen    int
+
+	// prepare derives the password that is fed to the key derivation
+	// function from the user name and the cleartext password.
+	prepare func(user, password string) (string, error)
+}
+
+// The supported SCRAM mechanisms. The iteration counts and salt lengths match
+// the mongod defaults.
+var (
+	SHA1 = &Mechanism{
+		Name:       "SCRAM-SHA-1",
+		hash:       sha1.New,
+		iterations: 10000,
+		saltLen:    16,
+		prepare:    mongoPasswordDigest,
+	}
+	SHA256 = &Mechanism{
+		Name:       "SCRAM-SHA-256",
+		hash:       sha256.New,
+		iterations: 15000,
+		saltLen:    28,
+		prepare:    saslPrep,
+	}
+)
+
+// Mechanisms lists the supported mechanisms.
+var Mechanisms = []*Mechanism{SHA1, SHA256}
+
+// Lookup returns the mechanism with the provided SASL name.
+func Lookup(name string) (*Mechanism, bool) {
+	for _, m := range Mechanisms {
+		if m.Name == name {
+			return m, true
+		}
+	}
+	return nil, false
+}
+
+// Credentials contains the information that the server stores for verifying
+// the proofs of a user without knowing the user's password.
+type Credentials struct {
+	IterationCount int
+	Salt           []byte
+	StoredKey      []byte
+	ServerKey      []byte
+}
+
+// NewCredentials generates the credentials for authenticating user with the
+// provided password using a random salt.
+func (m *Mechanism) NewCredentials(user, password string) (Credentials, error) {
+	salt := make([]byte, m.saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return Credentials{}, err
+	}
+
+	prepared, err := m.prepare(user, password)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	saltedPassword := pbkdf2(m.hash, []byte(prepared), salt, m.iterations)
+	return Credentials{
+		IterationCount: m.iterations,
+		Salt:           salt,
+		StoredKey:      m.h(m.hmac(saltedPassword, []byte("Client Key"))),
+		ServerKey:      m.hmac(saltedPassword, []byte("Server Key")),
+	}, nil
+}
+
+// fakeCredentials returns the credentials that are used in place of the
+// credentials of a user that does not exist. The salt is derived from the
+// user name so that, like for existing users, repeated attempts observe the
+// same salt. No proof matches the stored key.
+func (m *Mechanism) fakeCredentials(user string) Credentials {
+	size := m.hash().Size()
+	return Credentials{
+		IterationCount: m.iterations,
+		Salt:           m.hmac(fakeSaltKey, []byte(user))[:m.saltLen],
+		StoredKey:      make([]byte, size),
+		ServerKey:      make([]byte, size),
+	}
+}
+
+func (m *Mechanism) h(data []byte) []byte {
+	h := m.hash()
+	_, _ = h.Write(data)
+	return h.Sum(nil)
+}
+
+func (m *Mechanism) hmac(key, data []byte) []byte {
+	mac := hmac.New(m.hash, key)
+	_, _ = mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// mongoPasswordDigest returns the password digest that SCRAM-SHA-1 uses
+// instead of the cleartext password.
+func mongoPasswordDigest(user, password string) (string, error) {
+	sum := md5.Sum([]byte(user + ":mongo:" + password))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// saslPrep prepares a SCRAM-SHA-256 password with the SASLprep profile (RFC
+// 4013). Only passwords that consist of printable ASCII characters, which
+// the profile leaves unchanged, are supported as the emulator does not
+// implement the Unicode normalization that the profile requires for other
+// passwords. Control characters are prohibited by the profile.
+func saslPrep(_, password string) (string, error) {
+	for i := 0; i < len(password); i++ {
+		if password[i] < 0x20 || password[i] > 0x7e {
+			return "", ErrUnsupportedPassword
+		}
+	}
+	return password, nil
+}
+
+// randomBytes returns n random bytes. It panics if the system's secure random
+// number generator fails.
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// pbkdf2 implements the Hi function from RFC 5802, i.e. PBKDF2 with an output
+// length equal to the size of the hash.
+func pbkdf2(h func() hash.Hash, password, salt []byte, iterations int) []byte {
+	mac := hmac.New(h, password)
+	_, _ = mac.Write(salt)
+	var block [4]byte
+	binary.BigEndian.PutUint32(block[:], 1)
+	_, _ = mac.Write(block[:])
+
+	u := mac.Sum(nil)
+	out := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		_, _ = mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range out {
+			out[j] ^= u[j]
+		}
+	}
+	return out
+}
@@ -0,0 +1,287 @@
+package emulator
+
+import (
+	"crypto/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/achilleasa/mongolite/protocol"
+	"golang.org/x/xerrors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// DefaultLogicalSessionTimeoutMinutes is the number of minutes that a logical
+// session can remain idle before it expires. It matches the default session
+// timeout used by mongod.
+const DefaultLogicalSessionTimeoutMinutes = 30
+
+// session tracks the server-side state of a logical session.
+type session struct {
+	id      protocol.LogicalSessionID
+	lastUse time.Time
+
+	// The cursors that were opened by commands within the session and
+	// the namespace they belong to.
+	cursors map[int64]protocol.NamespacedCollection
+
+	// The state of the most recent transaction or retryable write of the
+	// session. Guarded by txnMu so that the backend calls that change the
+	// state of the transaction do not block other sessions.
+	txnMu     sync.Mutex
+	txnNumber int64
+	txnState  txnState
+
+	// The reply of the retryable write with the current transaction
+	// number or nil if no such write has completed.
+	writeResult bson.M
+}
+
+// sessionRegistry tracks the logical sessions that clients have started either
+// explicitly (via startSession) or implicitly by attaching an lsid to a
+// command. Sessions that remain idle for longer than the session timeout
+// expire and are removed the next time the registry is accessed.
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+
+	// The session timeout in minutes. Accessed atomically as it can be
+	// modified via the setParameter command.
+	timeoutMinutes int64
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{
+		sessions:       make(map[string]*session),
+		timeoutMinutes: DefaultLogicalSessionTimeoutMinutes,
+	}
+}
+
+// timeout returns the duration after which idle sessions expire.
+func (r *sessionRegistry) timeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&r.timeoutMinutes)) * time.Minute
+}
+
+// touch marks the session with the provided ID as used, creating it if it
+// does not exist, and returns any sessions that have expired.
+func (r *sessionRegistry) touch(id protocol.LogicalSessionID) (expired []*session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	expired = r.sweepLocked()
+
+	s := r.sessions[id.String()]
+	if s == nil {
+		s = &session{id: id, cursors: make(map[int64]protocol.NamespacedCollection), txnNumber: -1}
+		r.sessions[id.String()] = s
+	}
+	s.lastUse = time.Now()
+	return expired
+}
+
+// remove removes the sessions with the provided IDs from the registry and
+// returns them together with any sessions that have expired. If all is set,
+// all sessions are removed.
+func (r *sessionRegistry) remove(ids []protocol.LogicalSessionID, all bool) []*session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	removed := r.sweepLocked()
+
+	if all {
+		for key, s := range r.sessions {
+			removed = append(removed, s)
+			delete(r.sessions, key)
+		}
+		return removed
+	}
+
+	for _, id := range ids {
+		if s := r.sessions[id.String()]; s != nil {
+			removed = append(removed, s)
+			delete(r.sessions, id.String())
+		}
+	}
+	return removed
+}
+
+// get returns the session with the provided ID or nil if it does not exist.
+func (r *sessionRegistry) get(id protocol.LogicalSessionID) *session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sessions[id.String()]
+}
+
+// trackCursor associates a cursor with a session so that it can be killed
+// when the session ends. A cursor ID of 0 is ignored.
+func (r *sessionRegistry) trackCursor(id protocol.LogicalSessionID, ns protocol.NamespacedCollection, cursorID int64) {
+	if cursorID == 0 {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s := r.sessions[id.String()]; s != nil {
+		s.cursors[cursorID] = ns
+	}
+}
+
+// untrackCursor removes an exhausted or killed cursor from a session.
+func (r *sessionRegistry) untrackCursor(id protocol.LogicalSessionID, cursorID int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s := r.sessions[id.String()]; s != nil {
+		delete(s.cursors, cursorID)
+	}
+}
+
+// sweepLocked removes the sessions that have been idle for longer than the
+// session timeout and returns them. Callers must hold the registry mutex.
+func (r *sessionRegistry) sweepLocked() []*session {
+	var (
+		expired []*session
+		timeout = r.timeout()
+		now     = time.Now()
+	)
+	for key, s := range r.sessions {
+		if now.Sub(s.lastUse) > timeout {
+			expired = append(expired, s)
+			delete(r.sessions, key)
+		}
+	}
+	return expired
+}
+
+// SetLogicalSessionTimeoutMinutes sets the number of minutes that a logical
+// session can remain idle before it expires. The timeout is advertised to
+// clients via the logicalSessionTimeoutMinutes field of isMaster replies.
+func (emu *MongoEmulator) SetLogicalSessionTimeoutMinutes(minutes int64) error {
+	if minutes <= 0 {
+		return xerrors.Errorf("invalid logical session timeout %d: value must be positive", minutes)
+	}
+	atomic.StoreInt64(&emu.sessions.timeoutMinutes, minutes)
+	return nil
+}
+
+// maybeProcessSessionRequest services the logical session commands and keeps
+// track of the session that req belongs to. The handled return value is false
+// if the request should be processed by the backend.
+func (emu *MongoEmulator) maybeProcessSessionRequest(clientID string, req protocol.Request) (res protocol.Response, handled bool, err error) {
+	if id := req.SessionID(); id != nil {
+		emu.endSessions(clientID, emu.sessions.touch(*id))
+	}
+
+	switch r := req.(type) {
+	case *protocol.StartSessionRequest:
+		id, err := newLogicalSessionID()
+		if err != nil {
+			return protocol.Response{}, true, err
+		}
+		emu.endSessions(clientID, emu.sessions.touch(id))
+
+		return protocol.Response{
+			Documents: []bson.M{{
+				"ok":             1,
+				"id":             id.Document(),
+				"timeoutMinutes": atomic.LoadInt64(&emu.sessions.timeoutMinutes),
+			}},
+		}, true, nil
+	case *protocol.SessionsRequest:
+		switch r.GetType() {
+		case protocol.RequestTypeRefreshSessions:
+			for _, id := range r.Sessions {
+				emu.endSessions(clientID, emu.sessions.touch(id))
+			}
+		case protocol.RequestTypeEndSessions:
+			emu.endSessions(clientID, emu.sessions.remove(r.Sessions, false))
+		case protocol.RequestTypeKillSessions:
+			emu.endSessions(clientID, emu.sessions.remove(r.Sessions, len(r.Sessions) == 0))
+		}
+		return protocol.Response{Documents: []bson.M{{"ok": 1}}}, true, nil
+	}
+	return protocol.Response{}, false, nil
+}
+
+// trackSessionCursors associates the cursor returned in res with the session
+// of req and stops tracking cursors that have been exhausted or killed.
+func (emu *MongoEmulator) trackSessionCursors(req protocol.Request, res protocol.Response) {
+	id := req.SessionID()
+	if id == nil || len(res.Documents) == 0 {
+		return
+	}
+
+	switch r := req.(type) {
+	case *protocol.GetMoreRequest:
+		if nextID, _ := replyCursorID(res.Documents[0]); nextID == 0 {
+			emu.sessions.untrackCursor(*id, r.CursorID)
+		}
+	case *protocol.KillCursorsRequest:
+		for _, cursorID := range r.CursorIDs {
+			emu.sessions.untrackCursor(*id, cursorID)
+		}
+	default:
+		if cursorID, ns := replyCursorID(res.Documents[0]); cursorID != 0 {
+			emu.sessions.trackCursor(*id, ns, cursorID)
+		}
+	}
+}
+
+// replyCursorID extracts the cursor ID and namespace from a command reply that
+// contains a cursor document.
+func replyCursorID(resDoc bson.M) (int64, protocol.NamespacedCollection) {
+	var cursorDoc bson.M
+	switch c := resDoc["cursor"].(type) {
+	case bson.M:
+		cursorDoc = c
+	case bson.D:
+		cursorDoc = c.Map()
+	default:
+		return 0, protocol.NamespacedCollection{}
+	}
+
+	cursorID, _ := cursorDoc["id"].(int64)
+	ns, _ := cursorDoc["ns"].(string)
+	col, _ := protocol.ParseNamespacedCollection(ns)
+	return cursorID, col
+}
+
+// endSessions releases the server-side resources held by the provided
+// sessions, aborting their in-progress transactions and killing their
+// cursors.
+func (emu *MongoEmulator) endSessions(clientID string, sessions []*session) {
+	for _, s := range sessions {
+		s.txnMu.Lock()
+		emu.abortTxnLocked(clientID, s)
+		s.txnMu.Unlock()
+
+		byNamespace := make(map[protocol.NamespacedCollection][]int64)
+		for cursorID, ns := range s.cursors {
+			byNamespace[ns] = append(byNamespace[ns], cursorID)
+		}
+
+		for ns, cursorIDs := range byNamespace {
+			if _, unknown := emu.cursors.kill(cursorIDs); len(unknown) != 0 {
+				_, err := emu.b.HandleRequest(clientID, &protocol.KillCursorsRequest{
+					RequestInfo: protocol.RequestInfo{
+						RequestType: protocol.RequestTypeKillCursors,
+						ReplyType:   protocol.ReplyTypeOpMsg,
+					},
+					Collection: ns,
+					CursorIDs:  unknown,
+				})
+				if err != nil && !xerrors.Is(err, ErrUnsupportedRequest) {
+					emu.logger.WithField("session_id", s.id.String()).WithError(err).Warn("unable to kill session cursors")
+				}
+			}
+		}
+	}
+}
+
+// newLogicalSessionID generates a random (version 4) UUID for a new session.
+func newLogicalSessionID() (protocol.LogicalSessionID, error) {
+	uuid := make([]byte, 16)
+	if _, err := rand.Read(uuid); err != nil {
+		return protocol.LogicalSessionID{}, xerrors.Errorf("unable to generate session ID: %w", err)
+	}
+	uuid[6] = (uuid[6] & 0x0f) | 0x40
+	uuid[8] = (uuid[8] & 0x3f) | 0x80
+	return protocol.LogicalSessionID{ID: bson.Binary{Kind: 0x04, Data: uuid}}, nil
+}
@@ -0,0 +1,116 @@
+package emulator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/protocol"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// openSessionCursor runs an aggregation within session id that leaves a
+// cursor open and returns the cursor ID.
+func openSessionCursor(t *testing.T, emu *MongoEmulator, id protocol.LogicalSessionID) int64 {
+	t.Helper()
+	info := cmdInfo(protocol.RequestTypeAggregate)
+	info.Session = &id
+	reply := mustProcess(t, emu, &protocol.AggregateRequest{
+		RequestInfo: info,
+		Collection:  testCol,
+		Pipeline:    []bson.D{{{Name: "$match", Value: bson.M{}}}},
+		BatchSize:   1,
+	})
+	cursorID, _ := bsonutil.ToMap(reply["cursor"])["id"].(int64)
+	if cursorID == 0 {
+		t.Fatalf("expected an open cursor; got %v", reply)
+	}
+	return cursorID
+}
+
+func TestSessionCommands(t *testing.T) {
+	emu := newTestEmulator(t, newMemBackend())
+	insertDocs(t, emu, testCol, bson.M{"_id": 1}, bson.M{"_id": 2}, bson.M{"_id": 3}, bson.M{"_id": 4})
+
+	reply := mustProcess(t, emu, &protocol.StartSessionRequest{RequestInfo: cmdInfo(protocol.RequestTypeStartSession)})
+	if reply["timeoutMinutes"] != int64(DefaultLogicalSessionTimeoutMinutes) {
+		t.Fatalf("expected the session timeout to be reported; got %v", reply)
+	}
+	first := protocol.LogicalSessionID{ID: bsonutil.ToMap(reply["id"])["id"].(bson.Binary)}
+	if emu.sessions.get(first) == nil {
+		t.Fatalf("expected session %s to be registered", first)
+	}
+	second, err := newLogicalSessionID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	firstCursor := openSessionCursor(t, emu, first)
+	secondCursor := openSessionCursor(t, emu, second)
+
+	// Ending a session kills its cursors but leaves other sessions alone.
+	mustProcess(t, emu, &protocol.SessionsRequest{
+		RequestInfo: cmdInfo(protocol.RequestTypeEndSessions),
+		Sessions:    []protocol.LogicalSessionID{first},
+	})
+	if emu.cursors.owns(firstCursor) {
+		t.Fatal("expected the cursor of the ended session to be killed")
+	}
+	if !emu.cursors.owns(secondCursor) {
+		t.Fatal("expected the cursor of the active session to remain open")
+	}
+
+	// killSessions without a session list kills all sessions.
+	mustProcess(t, emu, &protocol.SessionsRequest{RequestInfo: cmdInfo(protocol.RequestTypeKillSessions)})
+	if emu.cursors.owns(secondCursor) {
+		t.Fatal("expected killSessions to kill the cursors of all sessions")
+	}
+	if emu.sessions.get(second) != nil {
+		t.Fatalf("expected session %s to be removed", second)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	emu := newTestEmulator(t, newMemBackend())
+	insertDocs(t, emu, testCol, bson.M{"_id": 1}, bson.M{"_id": 2}, bson.M{"_id": 3})
+
+	var ids []protocol.LogicalSessionID
+	for i := 0; i < 3; i++ {
+		id, err := newLogicalSessionID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	expiring, refreshed, active := ids[0], ids[1], ids[2]
+	expiringCursor := openSessionCursor(t, emu, expiring)
+	refreshedCursor := openSessionCursor(t, emu, refreshed)
+
+	// The refreshed session is about to expire when it is refreshed while
+	// the other session has been idle for longer than the timeout.
+	timeout := emu.sessions.timeout()
+	emu.sessions.get(refreshed).lastUse = time.Now().Add(-timeout + time.Minute)
+	mustProcess(t, emu, &protocol.SessionsRequest{
+		RequestInfo: cmdInfo(protocol.RequestTypeRefreshSessions),
+		Sessions:    []protocol.LogicalSessionID{refreshed},
+	})
+	if idle := time.Since(emu.sessions.get(refreshed).lastUse); idle > time.Minute {
+		t.Fatalf("expected refreshSessions to reset the idle time; got %v", idle)
+	}
+	emu.sessions.get(expiring).lastUse = time.Now().Add(-2 * timeout)
+
+	// Any command that carries a session sweeps the expired sessions.
+	info := cmdInfo(protocol.RequestTypeInsert)
+	info.Session = &active
+	mustProcess(t, emu, &protocol.InsertRequest{RequestInfo: info, Collection: testCol, Inserts: []bson.M{{"_id": 4}}})
+
+	if emu.sessions.get(expiring) != nil {
+		t.Fatal("expected the idle session to expire")
+	}
+	if emu.cursors.owns(expiringCursor) {
+		t.Fatal("expected the cursor of the expired session to be killed")
+	}
+	if !emu.cursors.owns(refreshedCursor) {
+		t.Fatal("expected the cursor of the refreshed session to remain open")
+	}
+}
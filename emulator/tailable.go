@@ -0,0 +1,93 @@
+package emulator
+
+import (
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// defaultAwaitDataTimeout is the maximum amount of time that a getMore
+// request for a tailable cursor waits for new documents when the client does
+// not specify maxTimeMS. It matches the default used by mongod.
+const defaultAwaitDataTimeout = time.Second
+
+// tailer is implemented by the sources of tailable cursors (e.g. change
+// streams). Tailable cursors remain open after the client has retrieved all
+// available documents and return any documents that become available later
+// on in response to subsequent getMore requests.
+type tailer interface {
+	// poll returns up to batchSize of the documents that became available
+	// since the previous call. A batchSize <= 0 returns all of them. The
+	// done return value is true if no more documents will ever become
+	// available and the cursor must be closed.
+	poll(clientID string, batchSize int) (docs []bson.D, done bool, err error)
+
+	// cursorFields returns any additional fields to include in the cursor
+	// document of replies (e.g. the postBatchResumeToken of change
+	// streams).
+	cursorFields() bson.M
+}
+
+// writeNotifier allows tailable cursors to wait for new writes.
+type writeNotifier struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+func newWriteNotifier() *writeNotifier {
+	return &writeNotifier{ch: make(chan struct{})}
+}
+
+// wait returns a channel that is closed by the next call to notify.
+func (n *writeNotifier) wait() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.ch
+}
+
+// notify wakes up all goroutines waiting for a write.
+func (n *writeNotifier) notify() {
+	n.mu.Lock()
+	close(n.ch)
+	n.ch = make(chan struct{})
+	n.mu.Unlock()
+}
+
+// tailCursor returns the next batch for the tailable cursor with the provided
+// ID together with the ID that the client should use for fetching the
+// following batch and any additional cursor fields. If the cursor awaits data
+// and no documents are available, tailCursor blocks until a write produces
+// new documents or maxTimeMS elapses. Cursors that are done or fail are
+// removed from the registry and the returned cursor ID is 0.
+func (emu *MongoEmulator) tailCursor(clientID string, id int64, t tailer, awaitData bool, batchSize int, maxTimeMS int64) ([]bson.D, int64, bson.M, error) {
+	timeout := defaultAwaitDataTimeout
+	if maxTimeMS > 0 {
+		timeout = time.Duration(maxTimeMS) * time.Millisecond
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		// Obtain the channel before polling so that writes which
+		// complete while polling are not missed.
+		written := emu.writes.wait()
+
+		docs, done, err := t.poll(clientID, batchSize)
+		if err != nil || done {
+			emu.cursors.kill([]int64{id})
+			if err != nil {
+				return nil, 0, nil, err
+			}
+			return docs, 0, t.cursorFields(), nil
+		} else if len(docs) != 0 || !awaitData {
+			return docs, id, t.cursorFields(), nil
+		}
+
+		select {
+		case <-written:
+		case <-timer.C:
+			return nil, id, t.cursorFields(), nil
+		}
+	}
+}
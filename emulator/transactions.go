@@ -0,0 +1,338 @@
+package emulator
+
+import (
+	"fmt"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/protocol"
+	"golang.org/x/xerrors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// TransactionBackend is implemented by backends that can execute the commands
+// of multi-document transactions within a single backend transaction (e.g. a
+// SQL transaction).
+//
+// The emulator tracks the state of each transaction and validates the
+// transaction arguments (lsid, txnNumber, startTransaction and autocommit) of
+// incoming commands. Commands that belong to a transaction are sent to the
+// backend with their session and transaction arguments intact, and so are any
+// requests that the emulator issues to the backend while processing them. The
+// backend must execute such requests within the transaction identified by
+// their TxnID and serve their reads from a snapshot of the data taken when the
+// transaction started (plus the writes of the transaction itself).
+//
+// When a backend does not implement this interface, commands that specify
+// autocommit: false are rejected as is the case for standalone mongod servers.
+type TransactionBackend interface {
+	Backend
+
+	// StartTransaction begins a new backend transaction for txn.
+	StartTransaction(clientID string, txn TxnID) error
+
+	// CommitTransaction commits the backend transaction for txn. Writes
+	// that conflict with the writes of concurrent transactions must fail
+	// with a WriteConflict error and transactions that the backend does
+	// not know about with a NoSuchTransaction error; in both cases the
+	// backend transaction must have been rolled back. Any other error
+	// leaves the outcome of the commit unknown and clients may retry the
+	// commit. The method is then invoked again for the same transaction
+	// and must succeed if the transaction has been committed or fail with
+	// NoSuchTransaction if it has been rolled back.
+	CommitTransaction(clientID string, txn TxnID) error
+
+	// AbortTransaction discards the backend transaction for txn. It is
+	// also invoked for transactions whose commit outcome is unknown when
+	// their session moves on to a new transaction or ends, and must not
+	// fail if the transaction has already been committed or rolled back.
+	AbortTransaction(clientID string, txn TxnID) error
+}
+
+// TxnID identifies a multi-document transaction.
+type TxnID struct {
+	// The session that the transaction belongs to.
+	Session protocol.LogicalSessionID
+
+	// The transaction number (txnNumber) within the session.
+	Number int64
+}
+
+// String returns the session and transaction number of the transaction.
+func (id TxnID) String() string { return fmt.Sprintf("%s/%d", id.Session.String(), id.Number) }
+
+// NewTxnID returns the ID of the transaction that req belongs to. The ok
+// return value is false if req is not part of a multi-document transaction.
+func NewTxnID(req protocol.Request) (id TxnID, ok bool) {
+	session, txn := req.SessionID(), req.Transaction()
+	if session == nil || txn.Number == nil || !txn.InTransaction() {
+		return TxnID{}, false
+	}
+	return TxnID{Session: *session, Number: *txn.Number}, true
+}
+
+// txnState describes the state of the most recent transaction of a session.
+type txnState int
+
+const (
+	txnStateNone txnState = iota
+	txnStateInProgress
+	txnStateCommitted
+	txnStateAborted
+
+	// The backend failed to commit the transaction without reporting
+	// whether the transaction was rolled back. Retrying commitTransaction
+	// asks the backend to commit it again.
+	txnStateCommitUnknown
+)
+
+// checkTransaction validates the transaction arguments of req and starts a new
+// transaction if req specifies startTransaction.
+func (emu *MongoEmulator) checkTransaction(clientID string, req protocol.Request) error {
+	var (
+		id      = req.SessionID()
+		txn     = req.Transaction()
+		isTxnOp = req.GetType() == protocol.RequestTypeCommitTransaction || req.GetType() == protocol.RequestTypeAbortTransaction
+	)
+
+	if txn.Number == nil {
+		if isTxnOp {
+			return protocol.ServerErrorf(protocol.CodeInvalidOptions, "%s must be run within a transaction", req.GetType())
+		} else if txn.Autocommit != nil || txn.StartTransaction {
+			return protocol.ServerErrorf(protocol.CodeInvalidOptions, "'autocommit' field requires a transaction number to also be specified")
+		}
+		return nil
+	} else if id == nil {
+		return protocol.ServerErrorf(protocol.CodeInvalidOptions, "Transaction number requires a session ID to also be specified")
+	}
+
+	if !txn.InTransaction() {
+		if txn.Autocommit != nil {
+			return protocol.ServerErrorf(protocol.CodeInvalidOptions, "Specifying autocommit=true is not allowed.")
+		} else if txn.StartTransaction || !isRetryableWriteCommand(req) {
+			return protocol.ServerErrorf(protocol.CodeInvalidOptions, "txnNumber may only be provided for multi-document transactions and retryable write commands. autocommit:false was not provided, and %s is not a retryable write command.", req.GetType())
+		}
+		return nil
+	}
+
+	tb, ok := emu.b.(TransactionBackend)
+	if !ok {
+		return protocol.ServerErrorf(protocol.CodeIllegalOperation, "Transaction numbers are only allowed on a replica set member or mongos")
+	}
+
+	s := emu.sessions.get(*id)
+	if s == nil {
+		return noSuchTransaction(*txn.Number)
+	}
+	s.txnMu.Lock()
+	defer s.txnMu.Unlock()
+
+	if !txn.StartTransaction {
+		switch {
+		case *txn.Number != s.txnNumber:
+			return noSuchTransaction(*txn.Number)
+		case s.txnState == txnStateAborted:
+			return protocol.ServerErrorf(protocol.CodeNoSuchTransaction, "Transaction %d has been aborted.", *txn.Number).
+				WithLabels(protocol.ErrorLabelTransientTransactionError)
+		case s.txnState == txnStateCommitted && !isTxnOp:
+			return protocol.ServerErrorf(protocol.CodeTransactionCommitted, "Transaction %d has been committed.", *txn.Number)
+		case s.txnState == txnStateCommitUnknown && !isTxnOp:
+			return protocol.ServerErrorf(protocol.CodeIllegalOperation, "Transaction %d is being committed; retry commitTransaction to find out its outcome.", *txn.Number)
+		}
+		return nil
+	}
+
+	if isTxnOp {
+		return protocol.ServerErrorf(protocol.CodeInvalidOptions, "%s may not be the first command in a transaction", req.GetType())
+	} else if *txn.Number < s.txnNumber {
+		return protocol.ServerErrorf(protocol.CodeTransactionTooOld, "Cannot start transaction %d on session %s because a newer transaction %d has already started.", *txn.Number, id.String(), s.txnNumber)
+	} else if *txn.Number == s.txnNumber && (s.txnState != txnStateNone || s.writeResult != nil) {
+		return protocol.ServerErrorf(protocol.CodeConflictingOperationInProgress, "Transaction %d has already been started on session %s.", *txn.Number, id.String())
+	}
+
+	// Starting a new transaction implicitly aborts the previous one.
+	emu.abortTxnLocked(clientID, s)
+
+	if err := tb.StartTransaction(clientID, TxnID{Session: *id, Number: *txn.Number}); err != nil {
+		return xerrors.Errorf("unable to start transaction %d: %w", *txn.Number, err)
+	}
+	s.txnNumber, s.txnState, s.writeResult = *txn.Number, txnStateInProgress, nil
+	return nil
+}
+
+// handleTransactionRequest implements the commitTransaction and
+// abortTransaction commands. The transaction arguments of req have already
+// been validated by checkTransaction.
+func (emu *MongoEmulator) handleTransactionRequest(clientID string, req *protocol.TransactionRequest) (protocol.Response, error) {
+	txnID, _ := NewTxnID(req)
+	tb := emu.b.(TransactionBackend)
+	s := emu.sessions.get(txnID.Session)
+	if s == nil {
+		return protocol.Response{}, noSuchTransaction(txnID.Number)
+	}
+	s.txnMu.Lock()
+	defer s.txnMu.Unlock()
+
+	switch req.GetType() {
+	case protocol.RequestTypeCommitTransaction:
+		// Commits are idempotent so that clients can retry them.
+		if s.txnState == txnStateCommitted {
+			break
+		}
+
+		if err := tb.CommitTransaction(clientID, txnID); err != nil {
+			// The backend has rolled back the transaction only if it
+			// reports a transient error. Otherwise, the transaction
+			// may have been committed and retrying the commit must
+			// not cause clients to run the transaction again.
+			if hasErrorCode(err, protocol.CodeWriteConflict) || hasErrorCode(err, protocol.CodeNoSuchTransaction) {
+				s.txnState = txnStateAborted
+				emu.finishOplogTxn(txnID)
+				emu.capped.discardAllUsage()
+				return protocol.Response{}, withErrorLabels(err, protocol.ErrorLabelTransientTransactionError)
+			}
+			s.txnState = txnStateCommitUnknown
+			return protocol.Response{}, withErrorLabels(err, protocol.ErrorLabelUnknownTransactionCommitResult)
+		}
+		s.txnState = txnStateCommitted
+		emu.finishOplogTxn(txnID)
+	case protocol.RequestTypeAbortTransaction:
+		switch s.txnState {
+		case txnStateCommitted:
+			return protocol.Response{}, protocol.ServerErrorf(protocol.CodeTransactionCommitted, "Transaction %d has been committed.", txnID.Number)
+		case txnStateCommitUnknown:
+			return protocol.Response{}, protocol.ServerErrorf(protocol.CodeIllegalOperation, "Transaction %d is being committed; retry commitTransaction to find out its outcome.", txnID.Number)
+		}
+		emu.abortTxnLocked(clientID, s)
+	}
+
+	return protocol.Response{Documents: []bson.M{{"ok": 1}}}, nil
+}
+
+// checkTransactionResult inspects the outcome of a request that belongs to a
+// transaction. Write conflicts abort the transaction and are reported with the
+// TransientTransactionError label so that clients can retry the transaction.
+func (emu *MongoEmulator) checkTransactionResult(clientID string, req protocol.Request, res protocol.Response, err error) (protocol.Response, error) {
+	txnID, ok := NewTxnID(req)
+	if !ok || req.GetType() == protocol.RequestTypeCommitTransaction || req.GetType() == protocol.RequestTypeAbortTransaction {
+		return res, err
+	}
+
+	// Writes within a transaction report conflicts as command errors
+	// instead of write errors.
+	if err == nil && len(res.Documents) != 0 {
+		for _, writeErr := range bsonutil.ToArray(res.Documents[0]["writeErrors"]) {
+			if code, _ := bsonutil.Get(writeErr, "code"); asInt(code) == int(protocol.CodeWriteConflict) {
+				err = protocol.ServerErrorf(protocol.CodeWriteConflict, "WriteConflict error: this operation conflicted with another operation. Please retry your operation or multi-document transaction.")
+				break
+			}
+		}
+	}
+
+	if err == nil || !hasErrorCode(err, protocol.CodeWriteConflict) {
+		return res, err
+	}
+
+	if s := emu.sessions.get(txnID.Session); s != nil {
+		s.txnMu.Lock()
+		if s.txnNumber == txnID.Number && s.txnState == txnStateInProgress {
+			emu.abortTxnLocked(clientID, s)
+		}
+		s.txnMu.Unlock()
+	}
+	return protocol.Response{}, withErrorLabels(err, protocol.ErrorLabelTransientTransactionError)
+}
+
+// abortTxnLocked aborts the in-progress transaction (if any) of s. The
+// backend transaction of a transaction whose commit outcome is unknown is
+// aborted as well in case it is still pending. Callers must hold the
+// transaction mutex of s.
+func (emu *MongoEmulator) abortTxnLocked(clientID string, s *session) {
+	if s.txnState != txnStateInProgress && s.txnState != txnStateCommitUnknown {
+		return
+	}
+	s.txnState = txnStateAborted
+	emu.capped.discardAllUsage()
+
+	txnID := TxnID{Session: s.id, Number: s.txnNumber}
+	defer emu.finishOplogTxn(txnID)
+	tb, ok := emu.b.(TransactionBackend)
+	if !ok {
+		return
+	}
+	if err := tb.AbortTransaction(clientID, txnID); err != nil {
+		emu.logger.WithField("session_id", s.id.String()).WithError(err).Warn("unable to abort transaction")
+	}
+}
+
+// runInternalTxn runs fn within a transaction that the emulator starts on its
+// own behalf so that the requests issued by fn are applied atomically. The
+// session and transaction arguments of info are replaced by the ones of the
+// internal transaction so that the requests derived from it are executed
+// within that transaction. If the backend does not implement
+// TransactionBackend or info already belongs to a multi-document transaction,
+// fn is invoked as-is.
+func (emu *MongoEmulator) runInternalTxn(clientID string, info *protocol.RequestInfo, fn func() error) error {
+	tb, ok := emu.b.(TransactionBackend)
+	if !ok || info.Txn.InTransaction() {
+		return fn()
+	}
+
+	sessionID, err := newLogicalSessionID()
+	if err != nil {
+		return err
+	}
+	number, autocommit := int64(1), false
+	info.Session = &sessionID
+	info.Txn = protocol.TxnInfo{Number: &number, Autocommit: &autocommit}
+
+	txnID := TxnID{Session: sessionID, Number: number}
+	if err := tb.StartTransaction(clientID, txnID); err != nil {
+		return xerrors.Errorf("unable to start internal transaction: %w", err)
+	}
+	defer emu.finishOplogTxn(txnID)
+
+	abort := func() {
+		if abortErr := tb.AbortTransaction(clientID, txnID); abortErr != nil {
+			emu.logger.WithField("session_id", sessionID.String()).WithError(abortErr).Warn("unable to abort internal transaction")
+		}
+	}
+	if err := fn(); err != nil {
+		emu.capped.discardAllUsage()
+		abort()
+		return err
+	}
+	if err := tb.CommitTransaction(clientID, txnID); err != nil {
+		emu.capped.discardAllUsage()
+
+		// Internal transactions are not retried; make sure that a
+		// commit with an unknown outcome does not remain pending.
+		if !hasErrorCode(err, protocol.CodeWriteConflict) && !hasErrorCode(err, protocol.CodeNoSuchTransaction) {
+			abort()
+		}
+		return xerrors.Errorf("unable to commit internal transaction: %w", err)
+	}
+	return nil
+}
+
+// derivedRequestInfo returns the RequestInfo for a request that the emulator
+// issues to the backend while processing origin. The session and transaction
+// arguments of origin are propagated so that the request is executed within
+// the same transaction as origin.
+func derivedRequestInfo(origin protocol.Request, reqType protocol.RequestType, replyType protocol.ReplyType) protocol.RequestInfo {
+	info := protocol.RequestInfo{RequestType: reqType, ReplyType: replyType}
+	if origin != nil {
+		info.Session, info.Txn = origin.SessionID(), origin.Transaction()
+	}
+	return info
+}
+
+// inTransaction returns true if req belongs to a multi-document transaction.
+func inTransaction(req protocol.Request) bool {
+	_, ok := NewTxnID(req)
+	return ok
+}
+
+func noSuchTransaction(txnNumber int64) error {
+	return protocol.ServerErrorf(protocol.CodeNoSuchTransaction, "Given transaction number %d does not match any in-progress transactions.", txnNumber).
+		WithLabels(protocol.ErrorLabelTransientTransactionError)
+}
@@ -0,0 +1,214 @@
+package emulator
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/achilleasa/mongolite/protocol"
+	"golang.org/x/xerrors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// flakyCommitBackend extends txnBackend by failing the commits of
+// transactions with the queued errors.
+type flakyCommitBackend struct {
+	*txnBackend
+	commitErrs []error
+	commits    int
+}
+
+func (b *flakyCommitBackend) CommitTransaction(clientID string, txn TxnID) error {
+	b.commits++
+	if len(b.commitErrs) != 0 {
+		err := b.commitErrs[0]
+		b.commitErrs = b.commitErrs[1:]
+		if err != nil {
+			return err
+		}
+	}
+	return b.txnBackend.CommitTransaction(clientID, txn)
+}
+
+// takeEvents returns the events recorded by b and resets the recording.
+func takeEvents(b *txnBackend) []string {
+	b.txnMu.Lock()
+	defer b.txnMu.Unlock()
+	events := b.events
+	b.events = nil
+	return events
+}
+
+// txnClient issues the commands of the transactions of a single session.
+type txnClient struct {
+	emu       *MongoEmulator
+	sessionID protocol.LogicalSessionID
+}
+
+func newTxnClient(t *testing.T, emu *MongoEmulator) *txnClient {
+	sessionID, err := newLogicalSessionID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &txnClient{emu: emu, sessionID: sessionID}
+}
+
+func (c *txnClient) info(reqType protocol.RequestType, txnNumber int64, start bool) protocol.RequestInfo {
+	autocommit := false
+	info := cmdInfo(reqType)
+	info.Session = &c.sessionID
+	info.Txn = protocol.TxnInfo{Number: &txnNumber, StartTransaction: start, Autocommit: &autocommit}
+	return info
+}
+
+func (c *txnClient) insert(txnNumber int64, start bool, doc bson.M) error {
+	_, err := c.emu.process("client", &protocol.InsertRequest{
+		RequestInfo: c.info(protocol.RequestTypeInsert, txnNumber, start),
+		Collection:  testCol,
+		Inserts:     []bson.M{doc},
+	})
+	return err
+}
+
+func (c *txnClient) run(reqType protocol.RequestType, txnNumber int64) error {
+	_, err := c.emu.process("client", &protocol.TransactionRequest{RequestInfo: c.info(reqType, txnNumber, false)})
+	return err
+}
+
+// errorOutcome describes err as its error code and labels.
+func errorOutcome(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	var srvErr protocol.ServerError
+	if !xerrors.As(err, &srvErr) {
+		return err.Error()
+	}
+	return fmt.Sprintf("%d%v", srvErr.Code, srvErr.Labels)
+}
+
+func TestTransactionCommit(t *testing.T) {
+	unknownResult := xerrors.New("connection to the database lost")
+	writeConflict := protocol.ServerErrorf(protocol.CodeWriteConflict, "write conflict")
+
+	specs := []struct {
+		descr       string
+		commitErrs  []error
+		expOutcomes []string
+		expCommits  int
+		// True if the transaction ends up committed rather than
+		// aborted.
+		expCommitted bool
+	}{
+		{
+			descr:        "commit is idempotent",
+			expOutcomes:  []string{"ok", "ok"},
+			expCommits:   1,
+			expCommitted: true,
+		},
+		{
+			descr:      "unknown commit result is resolved by retrying the commit",
+			commitErrs: []error{unknownResult},
+			expOutcomes: []string{
+				fmt.Sprintf("%d[%s]", protocol.CodeInternalError, protocol.ErrorLabelUnknownTransactionCommitResult),
+				"ok",
+				"ok",
+			},
+			expCommits:   2,
+			expCommitted: true,
+		},
+		{
+			descr:      "write conflict aborts the transaction",
+			commitErrs: []error{writeConflict},
+			expOutcomes: []string{
+				fmt.Sprintf("%d[%s]", protocol.CodeWriteConflict, protocol.ErrorLabelTransientTransactionError),
+				fmt.Sprintf("%d[%s]", protocol.CodeNoSuchTransaction, protocol.ErrorLabelTransientTransactionError),
+			},
+			expCommits: 1,
+		},
+	}
+
+	for _, spec := range specs {
+		t.Run(spec.descr, func(t *testing.T) {
+			b := &flakyCommitBackend{txnBackend: newTxnBackend(), commitErrs: spec.commitErrs}
+			emu := newTestEmulator(t, b)
+			c := newTxnClient(t, emu)
+			if err := c.insert(1, true, bson.M{"_id": 1}); err != nil {
+				t.Fatal(err)
+			}
+
+			for i, exp := range spec.expOutcomes {
+				if got := errorOutcome(c.run(protocol.RequestTypeCommitTransaction, 1)); got != exp {
+					t.Fatalf("commit attempt %d: expected %s; got %s", i+1, exp, got)
+				}
+			}
+			if b.commits != spec.expCommits {
+				t.Fatalf("expected %d backend commits; got %d", spec.expCommits, b.commits)
+			}
+
+			expCode := protocol.CodeNoSuchTransaction
+			if spec.expCommitted {
+				expCode = protocol.CodeTransactionCommitted
+			}
+			if err := c.insert(1, false, bson.M{"_id": 2}); !hasErrorCode(err, expCode) {
+				t.Fatalf("expected writes to the finished transaction to fail with code %d; got %v", expCode, err)
+			}
+		})
+	}
+}
+
+func TestTransactionCommitUnknownAbortedByNextTransaction(t *testing.T) {
+	b := &flakyCommitBackend{txnBackend: newTxnBackend(), commitErrs: []error{xerrors.New("connection to the database lost")}}
+	emu := newTestEmulator(t, b)
+	c := newTxnClient(t, emu)
+	if err := c.insert(1, true, bson.M{"_id": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.run(protocol.RequestTypeCommitTransaction, 1); err == nil {
+		t.Fatal("expected the commit to fail")
+	}
+	if err := c.run(protocol.RequestTypeAbortTransaction, 1); !hasErrorCode(err, protocol.CodeIllegalOperation) {
+		t.Fatalf("expected abortTransaction to be rejected while the commit outcome is unknown; got %v", err)
+	}
+
+	takeEvents(b.txnBackend)
+	if err := c.insert(2, true, bson.M{"_id": 2}); err != nil {
+		t.Fatal(err)
+	}
+	events := takeEvents(b.txnBackend)
+	if len(events) < 2 || events[0] != "abort@"+c.sessionID.String()+"/1" || events[1] != "start@"+c.sessionID.String()+"/2" {
+		t.Fatalf("expected the pending transaction to be aborted before the next one starts; got %v", events)
+	}
+}
+
+func TestTransactionAbort(t *testing.T) {
+	b := newTxnBackend()
+	emu := newTestEmulator(t, b)
+	c := newTxnClient(t, emu)
+	if err := c.insert(1, true, bson.M{"_id": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	takeEvents(b)
+	if err := c.run(protocol.RequestTypeAbortTransaction, 1); err != nil {
+		t.Fatal(err)
+	}
+	if events := takeEvents(b); len(events) != 1 || events[0] != "abort@"+c.sessionID.String()+"/1" {
+		t.Fatalf("expected the backend transaction to be aborted; got %v", events)
+	}
+
+	transient := fmt.Sprintf("%d[%s]", protocol.CodeNoSuchTransaction, protocol.ErrorLabelTransientTransactionError)
+	if got := errorOutcome(c.insert(1, false, bson.M{"_id": 2})); got != transient {
+		t.Fatalf("expected writes to the aborted transaction to fail with %s; got %s", transient, got)
+	}
+	if got := errorOutcome(c.run(protocol.RequestTypeCommitTransaction, 1)); got != transient {
+		t.Fatalf("expected the commit of the aborted transaction to fail with %s; got %s", transient, got)
+	}
+
+	// The session may start a new transaction.
+	if err := c.insert(2, true, bson.M{"_id": 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.run(protocol.RequestTypeCommitTransaction, 2); err != nil {
+		t.Fatal(err)
+	}
+}
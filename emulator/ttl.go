@@ -0,0 +1,205 @@
+package emulator
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/achilleasa/mongolite/emulator/index"
+	"github.com/achilleasa/mongolite/protocol"
+	"golang.org/x/xerrors"
+	"gopkg.in/Sirupsen/logrus.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// DefaultTTLMonitorSleepSecs is the default interval between TTL monitor
+// passes. It matches the default value used by mongod.
+const DefaultTTLMonitorSleepSecs = 60
+
+// The client ID used when the TTL monitor issues requests to the backend.
+const ttlMonitorClientID = "ttl-monitor"
+
+// ttlMonitor tracks the state of the background task that deletes expired
+// documents from collections with TTL indexes.
+type ttlMonitor struct {
+	// The interval between passes. Accessed atomically as it can be
+	// modified via the setParameter command.
+	sleepSecs int64
+
+	// Notifies the monitor loop that the sleep interval has changed.
+	resetCh chan struct{}
+
+	// Serializes passes triggered by the monitor loop and by clients.
+	passMu sync.Mutex
+}
+
+func newTTLMonitor() *ttlMonitor {
+	return &ttlMonitor{
+		sleepSecs: DefaultTTLMonitorSleepSecs,
+		resetCh:   make(chan struct{}, 1),
+	}
+}
+
+func (m *ttlMonitor) sleepInterval() time.Duration {
+	return time.Duration(atomic.LoadInt64(&m.sleepSecs)) * time.Second
+}
+
+// setSleepSecs updates the interval between passes and wakes up the monitor
+// loop so the new interval takes effect immediately.
+func (m *ttlMonitor) setSleepSecs(secs int64) {
+	atomic.StoreInt64(&m.sleepSecs, secs)
+	select {
+	case m.resetCh <- struct{}{}:
+	default: // a reset is already pending
+	}
+}
+
+// SetTTLMonitorSleepSecs sets the interval between TTL monitor passes.
+func (emu *MongoEmulator) SetTTLMonitorSleepSecs(secs int64) error {
+	if secs <= 0 {
+		return xerrors.Errorf("invalid TTL monitor sleep interval %d: value must be positive", secs)
+	}
+	emu.ttl.setSleepSecs(secs)
+	return nil
+}
+
+// RunTTLMonitor periodically deletes expired documents from collections with
+// TTL indexes (i.e. indexes that specify expireAfterSeconds) until the
+// provided context is cancelled.
+//
+// The monitor requires a backend that implements both the CatalogBackend and
+// the IndexBackend interfaces; for other backends, passes are no-ops.
+func (emu *MongoEmulator) RunTTLMonitor(ctx context.Context) {
+	emu.logger.WithField("sleep_secs", atomic.LoadInt64(&emu.ttl.sleepSecs)).Info("starting TTL monitor")
+	for {
+		timer := time.NewTimer(emu.ttl.sleepInterval())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			emu.logger.Info("stopping TTL monitor")
+			return
+		case <-emu.ttl.resetCh:
+			timer.Stop()
+		case <-timer.C:
+			if _, err := emu.runTTLPass(); err != nil {
+				emu.logger.WithField("err", err).Warn("TTL monitor pass failed")
+			}
+		}
+	}
+}
+
+// runTTLPass deletes expired documents from all collections with TTL indexes
+// and returns the number of TTL indexes that were processed.
+func (emu *MongoEmulator) runTTLPass() (int, error) {
+	emu.ttl.passMu.Lock()
+	defer emu.ttl.passMu.Unlock()
+
+	cb, isCatalogBackend := emu.b.(CatalogBackend)
+	ib, isIndexBackend := emu.b.(IndexBackend)
+	if !isCatalogBackend || !isIndexBackend {
+		return 0, nil
+	}
+
+	dbs, err := cb.ListDatabases(ttlMonitorClientID)
+	if err != nil {
+		return 0, xerrors.Errorf("unable to list databases: %w", err)
+	}
+
+	var numIndexes int
+	for _, db := range dbs {
+		cols, err := cb.ListCollections(ttlMonitorClientID, db.Name)
+		if err != nil {
+			return numIndexes, xerrors.Errorf("unable to list collections for database %q: %w", db.Name, err)
+		}
+
+		for _, colInfo := range cols {
+			if colInfo.ReadOnly {
+				continue
+			}
+
+			col := protocol.NamespacedCollection{Database: db.Name, Collection: colInfo.Name}
+			specs, err := ib.ListIndexes(ttlMonitorClientID, col)
+			if err != nil {
+				if hasErrorCode(err, protocol.CodeNamespaceNotFound) {
+					continue // dropped while the pass was running
+				}
+				return numIndexes, xerrors.Errorf("unable to list indexes for %q: %w", col.String(), err)
+			}
+
+			for _, spec := range specs {
+				if !isTTLIndex(spec) {
+					continue
+				}
+
+				if err := emu.deleteExpired(col, spec); err != nil {
+					return numIndexes, err
+				}
+				numIndexes++
+			}
+		}
+	}
+
+	return numIndexes, nil
+}
+
+// isTTLIndex returns true if spec describes a single-field TTL index. Like
+// mongod, the emulator ignores expireAfterSeconds for the _id and compound
+// indexes.
+func isTTLIndex(spec protocol.IndexSpec) bool {
+	return spec.ExpireAfterSeconds != nil && len(spec.Key) == 1 && !index.IsIDIndex(spec)
+}
+
+// deleteExpired removes the documents whose indexed date field is older than
+// the TTL index expiry threshold. For arrays of dates, a document expires
+// when its earliest date expires.
+func (emu *MongoEmulator) deleteExpired(col protocol.NamespacedCollection, spec protocol.IndexSpec) error {
+	cutoff := time.Now().Add(-time.Duration(*spec.ExpireAfterSeconds) * time.Second)
+
+	selector := bson.M{spec.Key[0].Name: bson.M{"$lt": cutoff}}
+	if spec.PartialFilterExpression != nil {
+		selector = bson.M{"$and": []interface{}{selector, spec.PartialFilterExpression}}
+	}
+
+	req := &protocol.DeleteRequest{
+		RequestInfo: protocol.RequestInfo{
+			RequestType: protocol.RequestTypeDelete,
+			ReplyType:   protocol.ReplyTypeOpMsg,
+		},
+		Collection: col,
+		Deletes:    []protocol.DeleteTarget{{Selector: selector}},
+	}
+
+	// The delete is executed like a client write so that it is recorded
+	// in the oplog.
+	res, err := emu.handleWrite(ttlMonitorClientID, req)
+	if err == nil {
+		err = replyWriteError(res)
+	}
+	if err != nil {
+		return xerrors.Errorf("unable to delete expired documents from %q using index %q: %w", col.String(), spec.Name, err)
+	}
+
+	emu.logger.WithFields(logrus.Fields{
+		"ns":    col.String(),
+		"index": spec.Name,
+	}).Debug("deleted expired documents")
+	return nil
+}
+
+// handleTriggerTTLMonitorPass runs a TTL monitor pass synchronously so test
+// suites can verify document expiry without waiting for the next scheduled
+// pass. It is only available when test commands are enabled.
+func (emu *MongoEmulator) handleTriggerTTLMonitorPass(Backend, string, *protocol.CommandRequest) (protocol.Response, error) {
+	numIndexes, err := emu.runTTLPass()
+	if err != nil {
+		return protocol.Response{}, err
+	}
+
+	return protocol.Response{
+		Documents: []bson.M{{
+			"ok":         1,
+			"ttlIndexes": numIndexes,
+		}},
+	}, nil
+}
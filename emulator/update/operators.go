@@ -0,0 +1,536 @@
+package update
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/emulator/expr"
+	"github.com/achilleasa/mongolite/emulator/filter"
+	"github.com/achilleasa/mongolite/protocol"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// operation is a single update operator applied to a field path.
+type operation struct {
+	name  string
+	path  string
+	segs  []string
+	value interface{}
+
+	// The target path for $rename operations.
+	renameTo string
+
+	// The values and modifiers for $push and $addToSet operations.
+	each      []interface{}
+	position  *int64
+	slice     *int64
+	sortSpec  interface{}
+	hasSort   bool
+	pullMatch func(interface{}) bool
+}
+
+// opParser validates the argument of an update operator and populates op.
+type opParser func(op *operation, arg interface{}) error
+
+var opParsers map[string]opParser
+
+func init() {
+	opParsers = map[string]opParser{
+		"$set":         parseSet,
+		"$setOnInsert": parseSet,
+		"$unset":       parseSet,
+		"$inc":         parseArithmetic,
+		"$mul":         parseArithmetic,
+		"$min":         parseSet,
+		"$max":         parseSet,
+		"$currentDate": parseCurrentDate,
+		"$rename":      parseRename,
+		"$push":        parsePush,
+		"$addToSet":    parseAddToSet,
+		"$pop":         parsePop,
+		"$pull":        parsePull,
+		"$pullAll":     parsePullAll,
+		"$bit":         parseBit,
+	}
+}
+
+// newOperation validates the field path of an update operator.
+func (u *Update) newOperation(name, path string) (*operation, error) {
+	if path == "" {
+		return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "An empty update path is not valid.")
+	}
+
+	segs := strings.Split(path, ".")
+	for i, seg := range segs {
+		switch {
+		case seg == "":
+			return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "The update path '%s' contains an empty field name, which is not allowed.", path)
+		case i == 0 && strings.HasPrefix(seg, "$"):
+			return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "The update path '%s' contains an illegal field name '%s'", path, seg)
+		case isArrayFilterSegment(seg):
+			if _, found := u.arrayFilters[seg[2:len(seg)-1]]; !found {
+				return nil, protocol.ServerErrorf(protocol.CodeBadValue, "No array filter found for identifier '%s' in path '%s'", seg[2:len(seg)-1], path)
+			}
+		}
+	}
+	return &operation{name: name, path: path, segs: segs}, nil
+}
+
+// isArrayFilterSegment returns true if seg is a $[<identifier>] positional
+// operator.
+func isArrayFilterSegment(seg string) bool {
+	return len(seg) > 3 && strings.HasPrefix(seg, "$[") && strings.HasSuffix(seg, "]")
+}
+
+// isArrayUpdateSegment returns true if seg is one of the $[] or
+// $[<identifier>] positional operators.
+func isArrayUpdateSegment(seg string) bool {
+	return seg == "$[]" || isArrayFilterSegment(seg)
+}
+
+func parseSet(op *operation, arg interface{}) error {
+	op.value = arg
+	return nil
+}
+
+func parseArithmetic(op *operation, arg interface{}) error {
+	if !bsonutil.IsNumber(arg) {
+		verb := "increment"
+		if op.name == "$mul" {
+			verb = "multiply"
+		}
+		return protocol.ServerErrorf(protocol.CodeTypeMismatch, "Cannot %s with non-numeric argument: {%s: %v}", verb, op.path, arg)
+	}
+	op.value = arg
+	return nil
+}
+
+func parseCurrentDate(op *operation, arg interface{}) error {
+	if b, isBool := arg.(bool); isBool {
+		if b {
+			op.value = "date"
+		}
+		return nil
+	}
+
+	typ, _ := bsonutil.Get(arg, "$type")
+	if len(bsonutil.Elements(arg)) != 1 || (typ != "date" && typ != "timestamp") {
+		return protocol.ServerErrorf(protocol.CodeBadValue, "The '$type' string field is required to be 'date' or 'timestamp': {$currentDate: {field : {$type: 'date'}}}")
+	}
+	op.value = typ
+	return nil
+}
+
+func parseRename(op *operation, arg interface{}) error {
+	to, isString := arg.(string)
+	switch {
+	case !isString:
+		return protocol.ServerErrorf(protocol.CodeBadValue, "The 'to' field for $rename must be a string: %s: %v", op.path, arg)
+	case to == op.path:
+		return protocol.ServerErrorf(protocol.CodeBadValue, "The source and target field for $rename must differ: %s: %q", op.path, to)
+	case to == "" || strings.Contains("."+to+".", ".."):
+		return protocol.ServerErrorf(protocol.CodeBadValue, "The update path '%s' contains an empty field name, which is not allowed.", to)
+	case strings.Contains(op.path, "$") || strings.Contains(to, "$"):
+		return protocol.ServerErrorf(protocol.CodeBadValue, "The source and target field for $rename may not be dynamic: %s: %q", op.path, to)
+	}
+	op.renameTo = to
+	return nil
+}
+
+func parsePush(op *operation, arg interface{}) error {
+	if !bsonutil.IsDocument(arg) {
+		op.each = []interface{}{arg}
+		return nil
+	}
+	if _, hasEach := bsonutil.Get(arg, "$each"); !hasEach {
+		op.each = []interface{}{arg}
+		return nil
+	}
+
+	for _, elem := range bsonutil.Elements(arg) {
+		switch elem.Name {
+		case "$each":
+			if !bsonutil.IsArray(elem.Value) {
+				return protocol.ServerErrorf(protocol.CodeBadValue, "The argument to $each in $push must be an array but it was of type: %s", bsonutil.TypeName(elem.Value))
+			}
+			op.each = bsonutil.ToArray(elem.Value)
+		case "$position", "$slice":
+			n, isInt := bsonutil.ToInt64(elem.Value)
+			if !isInt {
+				return protocol.ServerErrorf(protocol.CodeBadValue, "The value for %s must be an integer value, not of type: %s", elem.Name, bsonutil.TypeName(elem.Value))
+			}
+			if elem.Name == "$position" {
+				op.position = &n
+			} else {
+				op.slice = &n
+			}
+		case "$sort":
+			if err := validatePushSort(elem.Value); err != nil {
+				return err
+			}
+			op.sortSpec, op.hasSort = elem.Value, true
+		default:
+			return protocol.ServerErrorf(protocol.CodeBadValue, "Unrecognized clause in $push: %s", elem.Name)
+		}
+	}
+	return nil
+}
+
+func validatePushSort(spec interface{}) error {
+	if bsonutil.IsNumber(spec) {
+		if dir, _ := bsonutil.ToFloat64(spec); dir == 1 || dir == -1 {
+			return nil
+		}
+		return protocol.ServerErrorf(protocol.CodeBadValue, "The $sort element value must be either 1 or -1")
+	}
+	if !bsonutil.IsDocument(spec) || len(bsonutil.Elements(spec)) == 0 {
+		return protocol.ServerErrorf(protocol.CodeBadValue, "The $sort is invalid: use 1/-1 to sort the whole element, or {field:1/-1} to sort embedded fields")
+	}
+	for _, elem := range bsonutil.Elements(spec) {
+		if dir, _ := bsonutil.ToFloat64(elem.Value); dir != 1 && dir != -1 {
+			return protocol.ServerErrorf(protocol.CodeBadValue, "The $sort element value must be either 1 or -1")
+		}
+	}
+	return nil
+}
+
+func parseAddToSet(op *operation, arg interface{}) error {
+	op.each = []interface{}{arg}
+	if !bsonutil.IsDocument(arg) {
+		return nil
+	}
+	each, hasEach := bsonutil.Get(arg, "$each")
+	if !hasEach {
+		return nil
+	}
+
+	if len(bsonutil.Elements(arg)) != 1 {
+		return protocol.ServerErrorf(protocol.CodeBadValue, "Found unexpected fields after $each in $addToSet: %v", arg)
+	} else if !bsonutil.IsArray(each) {
+		return protocol.ServerErrorf(protocol.CodeTypeMismatch, "The argument to $each in $addToSet must be an array but it was of type %s", bsonutil.TypeName(each))
+	}
+	op.each = bsonutil.ToArray(each)
+	return nil
+}
+
+func parsePop(op *operation, arg interface{}) error {
+	if n, _ := bsonutil.ToFloat64(arg); !bsonutil.IsNumber(arg) || (n != 1 && n != -1) {
+		return protocol.ServerErrorf(protocol.CodeFailedToParse, "$pop expects 1 or -1, found: %v", arg)
+	}
+	op.value = arg
+	return nil
+}
+
+func parsePull(op *operation, arg interface{}) error {
+	if !bsonutil.IsDocument(arg) {
+		op.pullMatch = func(v interface{}) bool { return bsonutil.Equal(v, arg) }
+		return nil
+	}
+
+	// Conditions whose fields are query operators are matched against the
+	// array elements themselves; other conditions are matched against the
+	// fields of embedded document elements.
+	if strings.HasPrefix(firstField(arg), "$") {
+		matcher, err := filter.Compile(bson.M{"v": arg})
+		if err != nil {
+			return err
+		}
+		op.pullMatch = func(v interface{}) bool { return matcher.Match(bson.D{{Name: "v", Value: v}}) }
+		return nil
+	}
+
+	matcher, err := filter.Compile(bsonutil.ToMap(arg))
+	if err != nil {
+		return err
+	}
+	op.pullMatch = func(v interface{}) bool { return bsonutil.IsDocument(v) && matcher.Match(v) }
+	return nil
+}
+
+func parsePullAll(op *operation, arg interface{}) error {
+	if !bsonutil.IsArray(arg) {
+		return protocol.ServerErrorf(protocol.CodeBadValue, "$pullAll requires an array argument but was given a %s", bsonutil.TypeName(arg))
+	}
+	values := bsonutil.ToArray(arg)
+	op.pullMatch = func(v interface{}) bool {
+		for _, other := range values {
+			if bsonutil.Equal(v, other) {
+				return true
+			}
+		}
+		return false
+	}
+	return nil
+}
+
+func parseBit(op *operation, arg interface{}) error {
+	if !bsonutil.IsDocument(arg) {
+		return protocol.ServerErrorf(protocol.CodeBadValue, "The $bit modifier is not compatible with a %s. You must pass in an embedded document: {$bit: {field: {and/or/xor: #}}", bsonutil.TypeName(arg))
+	}
+	for _, elem := range bsonutil.Elements(arg) {
+		switch elem.Name {
+		case "and", "or", "xor":
+		default:
+			return protocol.ServerErrorf(protocol.CodeBadValue, "The $bit modifier only supports 'and', 'or', and 'xor', not '%s' which is an unknown operator: {%s: %v}", elem.Name, elem.Name, elem.Value)
+		}
+		switch elem.Value.(type) {
+		case int, int64:
+		default:
+			return protocol.ServerErrorf(protocol.CodeBadValue, "The $bit modifier field must be an Integer(32/64 bit); a '%s' is not supported here: {%s: %v}", bsonutil.TypeName(elem.Value), elem.Name, elem.Value)
+		}
+	}
+	op.value = arg
+	return nil
+}
+
+// apply applies the operation to doc and returns the updated document.
+func (op *operation) apply(a *applier, doc bson.D) (bson.D, error) {
+	for _, seg := range op.segs {
+		if seg == "$" {
+			return nil, protocol.ServerErrorf(protocol.CodeBadValue, "The positional operator did not find the match needed from the query.")
+		}
+	}
+
+	if op.name == "$rename" {
+		return op.applyRename(a, doc)
+	}
+
+	var (
+		create = true
+		fn     modifier
+	)
+	switch op.name {
+	case "$set", "$setOnInsert":
+		fn = func(interface{}, bool) (interface{}, bool, error) {
+			return copyValue(op.value), true, nil
+		}
+	case "$unset":
+		create = false
+		fn = func(interface{}, bool) (interface{}, bool, error) {
+			return nil, false, nil
+		}
+	case "$inc", "$mul":
+		fn = func(v interface{}, exists bool) (interface{}, bool, error) {
+			switch {
+			case !exists && op.name == "$inc":
+				return op.value, true, nil
+			case !exists:
+				return expr.MultiplyNumbers(0, op.value), true, nil
+			case !bsonutil.IsNumber(v):
+				return nil, false, protocol.ServerErrorf(protocol.CodeTypeMismatch, "Cannot apply %s to a value of non-numeric type. %s has the field '%s' of non-numeric type %s", op.name, describeID(a.id), op.segs[len(op.segs)-1], bsonutil.TypeName(v))
+			case op.name == "$inc":
+				return expr.AddNumbers(v, op.value), true, nil
+			}
+			return expr.MultiplyNumbers(v, op.value), true, nil
+		}
+	case "$min", "$max":
+		fn = func(v interface{}, exists bool) (interface{}, bool, error) {
+			cmp := bsonutil.Compare(op.value, v)
+			if !exists || (op.name == "$min" && cmp < 0) || (op.name == "$max" && cmp > 0) {
+				return copyValue(op.value), true, nil
+			}
+			return v, true, nil
+		}
+	case "$currentDate":
+		fn = func(interface{}, bool) (interface{}, bool, error) {
+			now := time.Now()
+			if op.value == "timestamp" {
+				return bson.MongoTimestamp(now.Unix()<<32 | 1), true, nil
+			}
+			return now.Truncate(time.Millisecond), true, nil
+		}
+	case "$push", "$addToSet":
+		fn = func(v interface{}, exists bool) (interface{}, bool, error) {
+			if exists && !bsonutil.IsArray(v) {
+				return nil, false, protocol.ServerErrorf(protocol.CodeBadValue, "The field '%s' must be an array but is of type %s in document %s", op.segs[len(op.segs)-1], bsonutil.TypeName(v), describeID(a.id))
+			}
+			arr := bsonutil.ToArray(v)
+			if op.name == "$addToSet" {
+				return op.addToSet(arr), true, nil
+			}
+			return op.push(arr), true, nil
+		}
+	case "$pop", "$pull", "$pullAll":
+		create = false
+		fn = func(v interface{}, exists bool) (interface{}, bool, error) {
+			if !exists {
+				return nil, false, nil
+			} else if !bsonutil.IsArray(v) {
+				return nil, false, protocol.ServerErrorf(protocol.CodeBadValue, "Cannot apply %s to a non-array value", op.name)
+			}
+			arr := bsonutil.ToArray(v)
+			if op.name == "$pop" {
+				return op.pop(arr), true, nil
+			}
+			out := []interface{}{}
+			for _, elem := range arr {
+				if !op.pullMatch(elem) {
+					out = append(out, elem)
+				}
+			}
+			return out, true, nil
+		}
+	case "$bit":
+		fn = func(v interface{}, exists bool) (interface{}, bool, error) {
+			return op.bit(a, v, exists)
+		}
+	}
+
+	out, err := a.walk(doc, op, 0, create, fn)
+	if err != nil {
+		return nil, err
+	}
+	return out.(bson.D), nil
+}
+
+// applyRename moves the value of the source field of a $rename operation to
+// its target field.
+func (op *operation) applyRename(a *applier, doc bson.D) (bson.D, error) {
+	v, exists, err := lookup(doc, op.segs)
+	if err != nil || !exists {
+		return doc, err
+	}
+	toSegs := strings.Split(op.renameTo, ".")
+	if _, _, err = lookup(doc, toSegs); err != nil {
+		return nil, err
+	}
+
+	unset := &operation{name: "$unset", path: op.path, segs: op.segs}
+	if doc, err = unset.apply(a, doc); err != nil {
+		return nil, err
+	}
+	set := &operation{name: "$set", path: op.renameTo, segs: toSegs, value: v}
+	return set.apply(a, doc)
+}
+
+// push implements $push for the array arr.
+func (op *operation) push(arr []interface{}) []interface{} {
+	pos := int64(len(arr))
+	if op.position != nil {
+		pos = *op.position
+		if pos < 0 {
+			pos += int64(len(arr))
+		}
+		if pos < 0 {
+			pos = 0
+		} else if pos > int64(len(arr)) {
+			pos = int64(len(arr))
+		}
+	}
+
+	out := make([]interface{}, 0, len(arr)+len(op.each))
+	out = append(out, arr[:pos]...)
+	for _, v := range op.each {
+		out = append(out, copyValue(v))
+	}
+	out = append(out, arr[pos:]...)
+
+	if op.hasSort {
+		sort.SliceStable(out, func(i, j int) bool {
+			return comparePushElements(out[i], out[j], op.sortSpec) < 0
+		})
+	}
+
+	if op.slice != nil {
+		n := *op.slice
+		switch {
+		case n >= 0 && n < int64(len(out)):
+			out = out[:n]
+		case n < 0 && -n < int64(len(out)):
+			out = out[int64(len(out))+n:]
+		}
+	}
+	return out
+}
+
+// comparePushElements compares two array elements using the $sort modifier of
+// a $push operation.
+func comparePushElements(a, b, spec interface{}) int {
+	if bsonutil.IsNumber(spec) {
+		dir, _ := bsonutil.ToInt64(spec)
+		return int(dir) * bsonutil.Compare(a, b)
+	}
+
+	for _, elem := range bsonutil.Elements(spec) {
+		av, _ := bsonutil.LookupPath(a, elem.Name)
+		bv, _ := bsonutil.LookupPath(b, elem.Name)
+		if cmp := bsonutil.Compare(av, bv); cmp != 0 {
+			dir, _ := bsonutil.ToInt64(elem.Value)
+			return int(dir) * cmp
+		}
+	}
+	return 0
+}
+
+// addToSet implements $addToSet for the array arr.
+func (op *operation) addToSet(arr []interface{}) []interface{} {
+	out := append([]interface{}{}, arr...)
+	for _, v := range op.each {
+		found := false
+		for _, elem := range out {
+			if bsonutil.Equal(elem, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			out = append(out, copyValue(v))
+		}
+	}
+	return out
+}
+
+// pop implements $pop for the array arr.
+func (op *operation) pop(arr []interface{}) []interface{} {
+	if len(arr) == 0 {
+		return arr
+	}
+	if dir, _ := bsonutil.ToFloat64(op.value); dir < 0 {
+		return arr[1:]
+	}
+	return arr[:len(arr)-1]
+}
+
+// bit implements $bit for the value v.
+func (op *operation) bit(a *applier, v interface{}, exists bool) (interface{}, bool, error) {
+	var (
+		res    int64
+		is64   bool
+		isLong bool
+	)
+	switch val := v.(type) {
+	case int:
+		res = int64(val)
+	case int64:
+		res, is64 = val, true
+	default:
+		if exists {
+			return nil, false, protocol.ServerErrorf(protocol.CodeBadValue, "Cannot apply $bit to a value of non-integral type.%s has the field %s of non-integer type %s", describeID(a.id), op.segs[len(op.segs)-1], bsonutil.TypeName(v))
+		}
+	}
+
+	for _, elem := range bsonutil.Elements(op.value) {
+		var arg int64
+		switch n := elem.Value.(type) {
+		case int:
+			arg = int64(n)
+		case int64:
+			arg, isLong = n, true
+		}
+		switch elem.Name {
+		case "and":
+			res &= arg
+		case "or":
+			res |= arg
+		case "xor":
+			res ^= arg
+		}
+	}
+
+	if is64 || isLong {
+		return res, true, nil
+	}
+	return int(int32(res)), true, nil
+}
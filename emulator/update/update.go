@@ -0,0 +1,610 @@
+// Package update implements mongo update documents which either modify the
+// fields of a document via update operators (e.g. $set) or replace its
+// contents.
+//
+// See https://docs.mongodb.com/manual/reference/operator/update
+package update
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/emulator/filter"
+	"github.com/achilleasa/mongolite/protocol"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Update is a parsed update document.
+type Update struct {
+	// Set for replacement-style updates.
+	replacement bson.D
+	isReplace   bool
+
+	// The update operations sorted by field path.
+	ops []*operation
+
+	// The compiled array filters, keyed by their identifier.
+	arrayFilters map[string]*filter.Matcher
+}
+
+// Parse validates an update document together with the (optional) array
+// filters for the $[<identifier>] positional operator and returns an Update.
+func Parse(spec bson.M, arrayFilters []bson.M) (*Update, error) {
+	u := &Update{arrayFilters: make(map[string]*filter.Matcher)}
+
+	// Updates either consist of update operators or replacement fields.
+	var firstOp, firstPlain string
+	for _, name := range sortedKeys(spec) {
+		if !strings.HasPrefix(name, "$") {
+			if firstPlain == "" {
+				firstPlain = name
+			}
+		} else if firstOp == "" {
+			firstOp = name
+		}
+	}
+	if firstOp != "" && firstPlain != "" {
+		return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "Update document cannot mix update operators and replacement fields: found operator %s and field %s", firstOp, firstPlain)
+	}
+
+	if firstOp == "" {
+		if len(arrayFilters) != 0 {
+			return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "arrayFilters may not be specified for a replacement-style update")
+		}
+		u.isReplace = true
+		u.replacement = withIDFirst(toDocument(spec))
+		return u, nil
+	}
+
+	if err := u.parseArrayFilters(arrayFilters); err != nil {
+		return nil, err
+	}
+
+	for _, opName := range sortedKeys(spec) {
+		parser, found := opParsers[opName]
+		if !found {
+			return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "Unknown modifier: %s. Expected a valid update modifier or pipeline-style update specified as an array", opName)
+		}
+
+		args := spec[opName]
+		if !bsonutil.IsDocument(args) {
+			return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "Modifiers operate on fields but we found type %s instead. For example: {$mod: {<field>: ...}} not {%s: %v}", bsonutil.TypeName(args), opName, args)
+		}
+
+		for _, elem := range bsonutil.Elements(args) {
+			op, err := u.newOperation(opName, elem.Name)
+			if err != nil {
+				return nil, err
+			}
+			if err := parser(op, elem.Value); err != nil {
+				return nil, err
+			}
+			u.ops = append(u.ops, op)
+		}
+	}
+
+	if err := u.checkConflicts(); err != nil {
+		return nil, err
+	}
+	for id := range u.arrayFilters {
+		if !u.usesArrayFilter(id) {
+			return nil, protocol.ServerErrorf(protocol.CodeFailedToParse, "The array filter for identifier '%s' was not used in the update", id)
+		}
+	}
+
+	sort.SliceStable(u.ops, func(i, j int) bool { return u.ops[i].path < u.ops[j].path })
+	return u, nil
+}
+
+// IsReplacement returns true if the update replaces the contents of documents
+// instead of using update operators.
+func (u *Update) IsReplacement() bool {
+	return u.isReplace
+}
+
+func (u *Update) parseArrayFilters(arrayFilters []bson.M) error {
+	for _, af := range arrayFilters {
+		var id string
+		for _, name := range sortedKeys(af) {
+			fieldID := strings.SplitN(name, ".", 2)[0]
+			if id != "" && fieldID != id {
+				return protocol.ServerErrorf(protocol.CodeFailedToParse, "Error parsing array filter :: caused by :: Expected a single top-level field name, found '%s' and '%s'", id, fieldID)
+			}
+			id = fieldID
+		}
+		if id == "" {
+			return protocol.ServerErrorf(protocol.CodeFailedToParse, "Cannot use an expression without a top-level field name in arrayFilters")
+		} else if _, exists := u.arrayFilters[id]; exists {
+			return protocol.ServerErrorf(protocol.CodeFailedToParse, "Found multiple array filters with the same top-level field name %s", id)
+		}
+
+		matcher, err := filter.Compile(af)
+		if err != nil {
+			return err
+		}
+		u.arrayFilters[id] = matcher
+	}
+	return nil
+}
+
+func (u *Update) usesArrayFilter(id string) bool {
+	for _, op := range u.ops {
+		for _, seg := range op.segs {
+			if seg == "$["+id+"]" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkConflicts ensures that no two operations modify the same path or a
+// path and one of its prefixes.
+func (u *Update) checkConflicts() error {
+	var paths []string
+	for _, op := range u.ops {
+		paths = append(paths, op.path)
+		if op.renameTo != "" {
+			paths = append(paths, op.renameTo)
+		}
+	}
+	sort.Strings(paths)
+
+	for i := 1; i < len(paths); i++ {
+		for j := 0; j < i; j++ {
+			if paths[i] == paths[j] || strings.HasPrefix(paths[i], paths[j]+".") {
+				return protocol.ServerErrorf(protocol.CodeConflictingUpdateOperators, "Updating the path '%s' would create a conflict at '%s'", paths[i], paths[j])
+			}
+		}
+	}
+	return nil
+}
+
+// Apply returns a copy of doc with the update applied. The isInsert flag
+// indicates that doc is the seed for an upserted document which enables
+// $setOnInsert operations and allows the _id field to be set.
+func (u *Update) Apply(doc bson.D, isInsert bool) (bson.D, error) {
+	id, hasID := get(doc, "_id")
+
+	if u.isReplace {
+		out := copyValue(u.replacement).(bson.D)
+		newID, replaceHasID := get(out, "_id")
+		switch {
+		case !hasID:
+		case !replaceHasID:
+			out = withIDFirst(append(out, bson.DocElem{Name: "_id", Value: id}))
+		case !isInsert && !bsonutil.Equal(id, newID):
+			return nil, protocol.ServerErrorf(protocol.CodeImmutableField, "After applying the update, the (immutable) field '_id' was found to have been altered to _id: %v", newID)
+		}
+		return out, nil
+	}
+
+	out := copyValue(doc).(bson.D)
+	a := &applier{u: u, id: id}
+	for _, op := range u.ops {
+		if op.name == "$setOnInsert" && !isInsert {
+			continue
+		}
+
+		var err error
+		if out, err = op.apply(a, out); err != nil {
+			return nil, err
+		}
+	}
+
+	if newID, _ := get(out, "_id"); hasID && !isInsert && !bsonutil.Equal(id, newID) {
+		return nil, protocol.ServerErrorf(protocol.CodeImmutableField, "Performing an update on the path '_id' would modify the immutable field '_id'")
+	}
+	return out, nil
+}
+
+// UpsertDocument returns the document that is inserted when an upsert does
+// not match any existing document. The document is seeded with the equality
+// clauses of the query before the update is applied. If the resulting
+// document does not specify an _id, a new ObjectId is generated.
+func (u *Update) UpsertDocument(query bson.M) (bson.D, error) {
+	seed := bson.D{}
+	a := &applier{u: u}
+	if err := a.seedFromQuery(&seed, query); err != nil {
+		return nil, err
+	}
+
+	out, err := u.Apply(seed, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.isReplace {
+		// Replacement documents only inherit the _id from the query.
+		if id, hasID := get(seed, "_id"); hasID {
+			if _, replaceHasID := get(out, "_id"); !replaceHasID {
+				out = append(out, bson.DocElem{Name: "_id", Value: id})
+			}
+		}
+		out = filterFields(out, func(name string) bool {
+			_, inReplacement := get(u.replacement, name)
+			return inReplacement || name == "_id"
+		})
+	}
+
+	if _, hasID := get(out, "_id"); !hasID {
+		out = append(out, bson.DocElem{Name: "_id", Value: bson.NewObjectId()})
+	}
+	return withIDFirst(out), nil
+}
+
+// Describe returns the fields that were modified by applying the update to a
+// document in the format used by the updateDescription field of change
+// events. The updated fields are reported using their dotted paths and their
+// values in updated (the document after the update was applied). Paths that
+// refer to array elements are reported up to the enclosing array field.
+func (u *Update) Describe(updated bson.D) (updatedFields bson.D, removedFields []string) {
+	if u.isReplace {
+		return nil, nil
+	}
+
+	addUpdated := func(segs []string) {
+		if segs = arrayFieldPrefix(segs); len(segs) == 0 {
+			return
+		}
+		path := strings.Join(segs, ".")
+		for _, elem := range updatedFields {
+			if elem.Name == path {
+				return
+			}
+		}
+		if v, found, err := lookup(updated, segs); err == nil && found {
+			updatedFields = append(updatedFields, bson.DocElem{Name: path, Value: v})
+		}
+	}
+
+	for _, op := range u.ops {
+		switch op.name {
+		case "$setOnInsert":
+			// Only applies to inserted documents.
+		case "$unset":
+			removedFields = append(removedFields, op.path)
+		case "$rename":
+			removedFields = append(removedFields, op.path)
+			addUpdated(strings.Split(op.renameTo, "."))
+		default:
+			addUpdated(op.segs)
+		}
+	}
+	return updatedFields, removedFields
+}
+
+// arrayFieldPrefix returns the leading segments of a field path up to (but not
+// including) the first positional operator or array index.
+func arrayFieldPrefix(segs []string) []string {
+	for i, seg := range segs {
+		if _, isIndex := arrayIndex(seg); isIndex || strings.HasPrefix(seg, "$") {
+			return segs[:i]
+		}
+	}
+	return segs
+}
+
+// seedFromQuery copies the fields that the query matches by equality into doc.
+func (a *applier) seedFromQuery(doc *bson.D, query bson.M) error {
+	for _, name := range sortedKeys(query) {
+		value := query[name]
+		if name == "$and" {
+			for _, clause := range bsonutil.ToArray(value) {
+				if err := a.seedFromQuery(doc, bsonutil.ToMap(clause)); err != nil {
+					return err
+				}
+			}
+			continue
+		} else if strings.HasPrefix(name, "$") {
+			continue
+		}
+
+		if bsonutil.IsDocument(value) {
+			if first := firstField(value); strings.HasPrefix(first, "$") {
+				eq, hasEq := bsonutil.Get(value, "$eq")
+				if !hasEq {
+					continue
+				}
+				value = eq
+			}
+		}
+
+		op := &operation{name: "$set", path: name, segs: strings.Split(name, "."), value: value}
+		updated, err := op.apply(a, *doc)
+		if err != nil {
+			return err
+		}
+		*doc = updated
+	}
+	return nil
+}
+
+// applier holds the state for applying an update to a single document.
+type applier struct {
+	u *Update
+
+	// The _id of the updated document which is included in error messages.
+	id interface{}
+}
+
+// modifier computes the new value for a field given its current value. It
+// returns false if the field should be removed.
+type modifier func(v interface{}, exists bool) (interface{}, bool, error)
+
+// walk applies fn to the values that op.segs[depth:] resolves to within cur and
+// returns the updated value. If create is set, missing fields along the path
+// are created.
+func (a *applier) walk(cur interface{}, op *operation, depth int, create bool, fn modifier) (interface{}, error) {
+	seg := op.segs[depth]
+	last := depth == len(op.segs)-1
+	if isArrayUpdateSegment(seg) && !bsonutil.IsArray(cur) {
+		return nil, protocol.ServerErrorf(protocol.CodeBadValue, "Cannot apply array updates to non-array element %s: %v", op.segs[depth-1], cur)
+	}
+
+	switch c := cur.(type) {
+	case bson.D:
+		idx := -1
+		for i, elem := range c {
+			if elem.Name == seg {
+				idx = i
+				break
+			}
+		}
+
+		if !last {
+			if idx == -1 {
+				if !create {
+					return c, nil
+				} else if isArrayUpdateSegment(op.segs[depth+1]) {
+					return nil, protocol.ServerErrorf(protocol.CodeBadValue, "The path '%s' must exist in the document in order to apply array updates.", strings.Join(op.segs[:depth+1], "."))
+				}
+				child, err := a.walk(bson.D{}, op, depth+1, create, fn)
+				if err != nil {
+					return nil, err
+				}
+				return append(c, bson.DocElem{Name: seg, Value: child}), nil
+			}
+
+			child, err := a.walk(c[idx].Value, op, depth+1, create, fn)
+			if err != nil {
+				return nil, err
+			}
+			c[idx].Value = child
+			return c, nil
+		}
+
+		var old interface{}
+		if idx != -1 {
+			old = c[idx].Value
+		}
+		v, keep, err := fn(old, idx != -1)
+		switch {
+		case err != nil:
+			return nil, err
+		case !keep && idx != -1:
+			return append(c[:idx:idx], c[idx+1:]...), nil
+		case !keep:
+			return c, nil
+		case idx != -1:
+			c[idx].Value = v
+			return c, nil
+		}
+		return append(c, bson.DocElem{Name: seg, Value: v}), nil
+	case []interface{}:
+		indices, err := a.arrayIndices(c, op, depth, create)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range indices {
+			if i >= len(c) {
+				for len(c) <= i {
+					c = append(c, nil)
+				}
+				if last {
+					v, keep, err := fn(nil, false)
+					if err != nil {
+						return nil, err
+					} else if keep {
+						c[i] = v
+					}
+					continue
+				}
+			}
+
+			if !last {
+				if c[i], err = a.walk(c[i], op, depth+1, create, fn); err != nil {
+					return nil, err
+				}
+				continue
+			}
+
+			v, keep, err := fn(c[i], true)
+			if err != nil {
+				return nil, err
+			} else if !keep {
+				// Removing array elements via $unset sets them to null.
+				v = nil
+			}
+			c[i] = v
+		}
+		return c, nil
+	}
+
+	if !create {
+		return cur, nil
+	}
+	return nil, protocol.ServerErrorf(protocol.CodePathNotViable, "Cannot create field '%s' in element {%s: %v}", seg, op.segs[depth-1], cur)
+}
+
+// arrayIndices returns the indices of the elements of arr that are targeted by
+// op.segs[depth]. Indices past the end of the array are only returned if
+// create is set.
+func (a *applier) arrayIndices(arr []interface{}, op *operation, depth int, create bool) ([]int, error) {
+	seg := op.segs[depth]
+	switch {
+	case seg == "$[]":
+		indices := make([]int, len(arr))
+		for i := range arr {
+			indices[i] = i
+		}
+		return indices, nil
+	case strings.HasPrefix(seg, "$[") && strings.HasSuffix(seg, "]"):
+		id := seg[2 : len(seg)-1]
+		matcher := a.u.arrayFilters[id]
+		var indices []int
+		for i, elem := range arr {
+			if matcher.Match(bson.D{{Name: id, Value: elem}}) {
+				indices = append(indices, i)
+			}
+		}
+		return indices, nil
+	}
+
+	idx, isIndex := arrayIndex(seg)
+	switch {
+	case isIndex && (idx < len(arr) || create):
+		return []int{idx}, nil
+	case isIndex || !create:
+		return nil, nil
+	}
+	return nil, protocol.ServerErrorf(protocol.CodePathNotViable, "Cannot create field '%s' in element {%s: %v}", seg, op.segs[depth-1], arr)
+}
+
+// arrayIndex parses a path segment as an array index.
+func arrayIndex(seg string) (int, bool) {
+	if seg == "" || len(seg) > 9 {
+		return 0, false
+	}
+	idx := 0
+	for _, r := range seg {
+		if r < '0' || r > '9' {
+			return 0, false
+		}
+		idx = idx*10 + int(r-'0')
+	}
+	return idx, true
+}
+
+// lookup returns the value of a field path that does not traverse arrays.
+func lookup(doc bson.D, segs []string) (interface{}, bool, error) {
+	var cur interface{} = doc
+	for i, seg := range segs {
+		if bsonutil.IsArray(cur) {
+			return nil, false, protocol.ServerErrorf(protocol.CodeBadValue, "The source field cannot be an array element, '%s' in doc has an array field called '%s'", strings.Join(segs, "."), segs[i-1])
+		}
+		d, isDoc := cur.(bson.D)
+		if !isDoc {
+			return nil, false, nil
+		}
+		v, found := get(d, seg)
+		if !found {
+			return nil, false, nil
+		}
+		cur = v
+	}
+	return cur, true, nil
+}
+
+// get returns the value of a top-level field of doc.
+func get(doc bson.D, name string) (interface{}, bool) {
+	for _, elem := range doc {
+		if elem.Name == name {
+			return elem.Value, true
+		}
+	}
+	return nil, false
+}
+
+// withIDFirst moves the _id field of doc to the front.
+func withIDFirst(doc bson.D) bson.D {
+	for i, elem := range doc {
+		if elem.Name == "_id" {
+			if i == 0 {
+				return doc
+			}
+			out := make(bson.D, 0, len(doc))
+			out = append(out, elem)
+			out = append(out, doc[:i]...)
+			return append(out, doc[i+1:]...)
+		}
+	}
+	return doc
+}
+
+// filterFields returns the top-level fields of doc for which keep returns
+// true.
+func filterFields(doc bson.D, keep func(string) bool) bson.D {
+	out := doc[:0:0]
+	for _, elem := range doc {
+		if keep(elem.Name) {
+			out = append(out, elem)
+		}
+	}
+	return out
+}
+
+// toDocument converts a document into a bson.D, recursively converting any
+// nested documents. The fields of unordered documents are sorted by name.
+func toDocument(v interface{}) bson.D {
+	if d, isD := v.(bson.D); isD {
+		return copyValue(d).(bson.D)
+	}
+
+	m := bsonutil.ToMap(v)
+	out := make(bson.D, 0, len(m))
+	for _, name := range sortedKeys(m) {
+		out = append(out, bson.DocElem{Name: name, Value: copyValue(m[name])})
+	}
+	return out
+}
+
+// copyValue returns a deep copy of v. Documents are converted to bson.D
+// values and arrays to []interface{} values so that they can be modified.
+func copyValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case bson.D:
+		out := make(bson.D, len(val))
+		for i, elem := range val {
+			out[i] = bson.DocElem{Name: elem.Name, Value: copyValue(elem.Value)}
+		}
+		return out
+	case bson.M, map[string]interface{}, bson.RawD:
+		return toDocument(val)
+	}
+
+	if bsonutil.IsArray(v) {
+		arr := bsonutil.ToArray(v)
+		out := make([]interface{}, len(arr))
+		for i, elem := range arr {
+			out[i] = copyValue(elem)
+		}
+		return out
+	}
+	return v
+}
+
+func sortedKeys(v interface{}) []string {
+	var keys []string
+	for _, elem := range bsonutil.Elements(v) {
+		keys = append(keys, elem.Name)
+	}
+	if _, isD := v.(bson.D); !isD {
+		sort.Strings(keys)
+	}
+	return keys
+}
+
+func firstField(v interface{}) string {
+	if keys := sortedKeys(v); len(keys) != 0 {
+		return keys[0]
+	}
+	return ""
+}
+
+// describeID formats an _id value for inclusion in error messages.
+func describeID(id interface{}) string {
+	return fmt.Sprintf("{_id: %v}", id)
+}
@@ -0,0 +1,90 @@
+package update
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/protocol"
+	"golang.org/x/xerrors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestParseErrors(t *testing.T) {
+	specs := []struct {
+		descr  string
+		spec   bson.M
+		expErr string
+	}{
+		{
+			descr:  "operator followed by replacement field",
+			spec:   bson.M{"$set": bson.M{"a": 1}, "b": 2},
+			expErr: "Update document cannot mix update operators and replacement fields: found operator $set and field b",
+		},
+		{
+			descr:  "replacement field followed by operator",
+			spec:   bson.M{"a": 1, "$inc": bson.M{"b": 1}},
+			expErr: "Update document cannot mix update operators and replacement fields: found operator $inc and field a",
+		},
+		{
+			descr:  "unknown operator",
+			spec:   bson.M{"$foo": bson.M{"a": 1}},
+			expErr: "Unknown modifier: $foo",
+		},
+		{
+			descr:  "operator with non-document argument",
+			spec:   bson.M{"$set": 1},
+			expErr: "Modifiers operate on fields",
+		},
+	}
+
+	for _, spec := range specs {
+		t.Run(spec.descr, func(t *testing.T) {
+			_, err := Parse(spec.spec, nil)
+			var srvErr protocol.ServerError
+			if !xerrors.As(err, &srvErr) || srvErr.Code != protocol.CodeFailedToParse {
+				t.Fatalf("expected a FailedToParse error; got %v", err)
+			}
+			if !strings.Contains(srvErr.Msg, spec.expErr) {
+				t.Fatalf("expected error to contain %q; got %q", spec.expErr, srvErr.Msg)
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	doc := bson.D{{Name: "_id", Value: 1}, {Name: "a", Value: 1}, {Name: "b", Value: "x"}}
+
+	specs := []struct {
+		descr string
+		spec  bson.M
+		exp   bson.D
+	}{
+		{
+			descr: "replacement keeps _id",
+			spec:  bson.M{"c": true},
+			exp:   bson.D{{Name: "_id", Value: 1}, {Name: "c", Value: true}},
+		},
+		{
+			descr: "operators",
+			spec:  bson.M{"$inc": bson.M{"a": 2}, "$unset": bson.M{"b": ""}},
+			exp:   bson.D{{Name: "_id", Value: 1}, {Name: "a", Value: 3}},
+		},
+	}
+
+	for _, spec := range specs {
+		t.Run(spec.descr, func(t *testing.T) {
+			u, err := Parse(spec.spec, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := u.Apply(doc, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bsonutil.Equal(got, spec.exp) {
+				t.Fatalf("expected %v; got %v", spec.exp, got)
+			}
+		})
+	}
+}
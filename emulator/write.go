@@ -0,0 +1,380 @@
+package emulator
+
+import (
+	"github.com/achilleasa/mongolite/emulator/bsonutil"
+	"github.com/achilleasa/mongolite/emulator/update"
+	"github.com/achilleasa/mongolite/protocol"
+	"golang.org/x/xerrors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// WriteBackend is implemented by backends that can execute the individual
+// operations of a write command and report their outcome.
+//
+// The emulator executes the operations of insert, update and delete commands
+// one at a time and assembles the bulk write reply expected by clients
+// (n, nModified, upserted and writeErrors), stopping at the first failure
+// unless the command specifies ordered: false. When a backend does not
+// implement this interface, each operation is sent to the backend as a
+// separate single-operation request and its outcome is read from the reply.
+// The same applies to the operations of commands within a multi-document
+// transaction as the interface methods do not receive the transaction
+// arguments.
+type WriteBackend interface {
+	Backend
+
+	// InsertDocument inserts doc into col, creating the collection if
+	// it does not exist.
+	InsertDocument(clientID string, col protocol.NamespacedCollection, doc bson.M) error
+
+	// UpdateDocuments applies a single update operation to col.
+	UpdateDocuments(clientID string, col protocol.NamespacedCollection, target protocol.UpdateTarget) (UpdateResult, error)
+
+	// DeleteDocuments applies a single delete operation to col and
+	// returns the number of deleted documents.
+	DeleteDocuments(clientID string, col protocol.NamespacedCollection, target protocol.DeleteTarget) (int, error)
+}
+
+// UpdateResult describes the outcome of a single update operation.
+type UpdateResult struct {
+	// The number of documents that matched the update selector plus the
+	// number of upserted documents.
+	N int
+
+	// The number of documents whose contents were changed.
+	NModified int
+
+	// The _id of the document inserted by an upsert or nil.
+	UpsertedID interface{}
+}
+
+// writeResult accumulates the outcome of the operations in a write command.
+type writeResult struct {
+	n           int
+	nModified   int
+	upserted    []interface{}
+	writeErrors []interface{}
+
+	// The labels of the failed operations which are reported at the top
+	// level of the reply.
+	errorLabels []string
+
+	// The most recent failure.
+	lastErr *WriteError
+}
+
+// addError records the failure of the operation at index.
+func (r *writeResult) addError(index int, err error) {
+	srvErr, ok := asServerError(err)
+	if !ok {
+		srvErr = protocol.ServerErrorf(protocol.CodeInternalError, "%v", err)
+	}
+
+	writeErrDoc := bson.M{
+		"index":  index,
+		"code":   srvErr.Code,
+		"errmsg": srvErr.Msg,
+	}
+	addDuplicateKeyInfo(writeErrDoc, err)
+	r.writeErrors = append(r.writeErrors, writeErrDoc)
+	r.lastErr = &WriteError{Index: index, N: r.n, NModified: r.nModified, Err: err}
+
+	for _, label := range srvErr.Labels {
+		if !containsString(r.errorLabels, label) {
+			r.errorLabels = append(r.errorLabels, label)
+		}
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// handleWrite executes an insert, update or delete request and returns a bulk
+// write reply. Before each operation is executed, the emulator verifies that
+// it does not violate the constraints of the collection indexes.
+func (emu *MongoEmulator) handleWrite(clientID string, req protocol.Request) (protocol.Response, error) {
+	var (
+		res             writeResult
+		continueOnError bool
+		writeConcern    bson.M
+		numOps          int
+		execOp          func(int) error
+	)
+
+	switch req := req.(type) {
+	case *protocol.InsertRequest:
+		continueOnError = req.Flags&protocol.InsertFlagContinueOnError != 0
+		writeConcern, numOps = req.WriteConcern, len(req.Inserts)
+		logOplog := emu.oplogEnabled(clientID, req.Collection)
+		execOp = func(i int) error {
+			doc := req.Inserts[i]
+			if _, hasID := doc["_id"]; logOplog && !hasID {
+				// The _id must be known in order to record the
+				// insert in the oplog.
+				doc["_id"] = bson.NewObjectId()
+			}
+			if err := emu.checkInsert(clientID, req, req.Collection, doc); err != nil {
+				return err
+			}
+			if err := emu.insertDocument(clientID, req, doc); err != nil {
+				return err
+			}
+			res.n++
+			if err := emu.enforceCappedBounds(clientID, req, req.Collection, []bson.M{doc}); err != nil {
+				return err
+			}
+
+			if logOplog {
+				emu.appendOplog(clientID, req, []bson.D{insertOplogEntry(req.Collection, doc)})
+			}
+			return nil
+		}
+	case *protocol.UpdateRequest:
+		continueOnError = req.ContinueOnError
+		writeConcern, numOps = req.WriteConcern, len(req.Updates)
+		logOplog := emu.oplogEnabled(clientID, req.Collection)
+		execOp = func(i int) error {
+			var (
+				target  = req.Updates[i]
+				preview *updatePreview
+				err     error
+			)
+			if logOplog {
+				// The oplog records the documents whose
+				// contents are changed by the update.
+				if preview, err = emu.previewUpdate(clientID, req, req.Collection, target); err != nil {
+					return err
+				}
+			}
+			if err := emu.checkUpdate(clientID, req, req.Collection, target, preview); err != nil {
+				return err
+			}
+
+			opRes, err := emu.updateDocuments(clientID, req, target)
+			emu.capped.discardUsage(req.Collection)
+			if err != nil {
+				return err
+			}
+			res.n += opRes.N
+			res.nModified += opRes.NModified
+			if opRes.UpsertedID != nil {
+				res.upserted = append(res.upserted, bson.M{"index": i, "_id": opRes.UpsertedID})
+				if err := emu.enforceCappedBounds(clientID, req, req.Collection, nil); err != nil {
+					return err
+				}
+			}
+
+			if logOplog {
+				emu.appendOplog(clientID, req, emu.updateOplogEntries(clientID, req, preview, opRes))
+			}
+			return nil
+		}
+	case *protocol.DeleteRequest:
+		continueOnError = req.ContinueOnError
+		writeConcern, numOps = req.WriteConcern, len(req.Deletes)
+		logOplog := emu.oplogEnabled(clientID, req.Collection)
+		execOp = func(i int) error {
+			var (
+				target = req.Deletes[i]
+				ids    []interface{}
+				err    error
+			)
+			if logOplog {
+				if ids, err = emu.matchingIDs(clientID, req, req.Collection, target.Selector, target.Limit == 1); err != nil {
+					return err
+				}
+			}
+
+			n, err := emu.deleteDocuments(clientID, req, target)
+			emu.capped.discardUsage(req.Collection)
+			if err != nil {
+				return err
+			}
+			res.n += n
+
+			if logOplog {
+				var entries []bson.D
+				for j := 0; j < n && j < len(ids); j++ {
+					entries = append(entries, deleteOplogEntry(req.Collection, ids[j]))
+				}
+				emu.appendOplog(clientID, req, entries)
+			}
+			return nil
+		}
+	default:
+		return protocol.Response{}, xerrors.Errorf("request %q: %w", req.GetType(), ErrUnsupportedRequest)
+	}
+
+	for i := 0; i < numOps; i++ {
+		emu.writeMu.Lock()
+		err := execOp(i)
+		emu.writeMu.Unlock()
+		if err == nil {
+			continue
+		} else if xerrors.Is(err, ErrUnsupportedRequest) {
+			return protocol.Response{}, err
+		}
+
+		res.addError(i, err)
+		if !continueOnError {
+			break
+		}
+	}
+
+	// Legacy write operations do not receive a reply; their outcome is
+	// reported via getLastError using the error or the reply document
+	// returned here.
+	if req.GetReplyType() == protocol.ReplyTypeNone && res.lastErr != nil {
+		return protocol.Response{}, res.lastErr
+	}
+
+	resDoc := bson.M{"ok": 1, "n": res.n}
+	if req.GetType() == protocol.RequestTypeUpdate {
+		resDoc["nModified"] = res.nModified
+	}
+	if len(res.upserted) != 0 {
+		resDoc["upserted"] = res.upserted
+	}
+	if len(res.writeErrors) != 0 {
+		resDoc["writeErrors"] = res.writeErrors
+	}
+	if len(res.errorLabels) != 0 {
+		resDoc["errorLabels"] = res.errorLabels
+	}
+	if wcErr := emu.checkWriteConcern(writeConcern); wcErr != nil {
+		resDoc["writeConcernError"] = wcErr
+	}
+	return protocol.Response{Documents: []bson.M{resDoc}}, nil
+}
+
+// checkWriteConcern returns a writeConcernError document if writeConcern
+// cannot be satisfied by the emulated server or nil otherwise.
+func (emu *MongoEmulator) checkWriteConcern(writeConcern bson.M) bson.M {
+	w, hasW := writeConcern["w"]
+	if !hasW || !bsonutil.IsNumber(w) {
+		return nil
+	}
+
+	if n, _ := bsonutil.ToInt64(w); n > 1 && emu.replSet != nil {
+		// The emulated replica set only has a single member.
+		return bson.M{
+			"code":     protocol.CodeUnsatisfiableWriteConcern,
+			"codeName": protocol.CodeUnsatisfiableWriteConcern.String(),
+			"errmsg":   "Not enough data-bearing nodes",
+		}
+	} else if n > 1 {
+		return bson.M{
+			"code":     protocol.CodeBadValue,
+			"codeName": protocol.CodeBadValue.String(),
+			"errmsg":   "cannot use 'w' > 1 when a host is not replicated",
+		}
+	}
+	return nil
+}
+
+func (emu *MongoEmulator) insertDocument(clientID string, req *protocol.InsertRequest, doc bson.M) error {
+	if wb, ok := emu.b.(WriteBackend); ok && !inTransaction(req) {
+		return wb.InsertDocument(clientID, req.Collection, doc)
+	}
+
+	opReq := *req
+	opReq.Inserts = []bson.M{doc}
+	_, err := emu.execSingleWrite(clientID, &opReq)
+	return err
+}
+
+func (emu *MongoEmulator) updateDocuments(clientID string, req *protocol.UpdateRequest, target protocol.UpdateTarget) (UpdateResult, error) {
+	// Validate the update so that malformed updates are reported in the
+	// same way regardless of the backend.
+	if _, err := update.Parse(target.Update, target.ArrayFilters); err != nil {
+		return UpdateResult{}, err
+	}
+
+	if wb, ok := emu.b.(WriteBackend); ok && !inTransaction(req) {
+		return wb.UpdateDocuments(clientID, req.Collection, target)
+	}
+
+	opReq := *req
+	opReq.Updates = []protocol.UpdateTarget{target}
+	resDoc, err := emu.execSingleWrite(clientID, &opReq)
+	if err != nil {
+		return UpdateResult{}, err
+	}
+
+	var res UpdateResult
+	res.N = asInt(resDoc["n"])
+	res.NModified = asInt(resDoc["nModified"])
+	if upserted := bsonutil.ToArray(resDoc["upserted"]); len(upserted) != 0 {
+		res.UpsertedID, _ = bsonutil.Get(upserted[0], "_id")
+	}
+	return res, nil
+}
+
+func (emu *MongoEmulator) deleteDocuments(clientID string, req *protocol.DeleteRequest, target protocol.DeleteTarget) (int, error) {
+	if wb, ok := emu.b.(WriteBackend); ok && !inTransaction(req) {
+		return wb.DeleteDocuments(clientID, req.Collection, target)
+	}
+
+	opReq := *req
+	opReq.Deletes = []protocol.DeleteTarget{target}
+	resDoc, err := emu.execSingleWrite(clientID, &opReq)
+	if err != nil {
+		return 0, err
+	}
+	return asInt(resDoc["n"]), nil
+}
+
+// execSingleWrite sends a write request with a single operation to the
+// backend and returns the reply document. Failures that the backend reports
+// via the writeErrors field of its reply are returned as errors.
+func (emu *MongoEmulator) execSingleWrite(clientID string, req protocol.Request) (bson.M, error) {
+	res, err := emu.b.HandleRequest(clientID, req)
+	if err != nil {
+		var writeErr *WriteError
+		if xerrors.As(err, &writeErr) {
+			return nil, writeErr.Err
+		}
+		return nil, err
+	}
+
+	if len(res.Documents) == 0 {
+		return bson.M{}, nil
+	}
+	if err := replyWriteError(res); err != nil {
+		return nil, err
+	}
+	return res.Documents[0], nil
+}
+
+// replyWriteError returns the first failure reported via the writeErrors
+// field of a write command reply or nil if the reply does not report any
+// failures.
+func replyWriteError(res protocol.Response) error {
+	if len(res.Documents) == 0 {
+		return nil
+	}
+	writeErrors := bsonutil.ToArray(res.Documents[0]["writeErrors"])
+	if len(writeErrors) == 0 {
+		return nil
+	}
+	code, _ := bsonutil.Get(writeErrors[0], "code")
+	errmsg, _ := bsonutil.Get(writeErrors[0], "errmsg")
+	return protocol.ServerErrorf(protocol.ErrorCode(asInt(code)), "%v", errmsg)
+}
+
+// asInt converts a numeric reply field into an int. Error codes in replies
+// assembled by the emulator are stored as protocol.ErrorCode values. It
+// returns 0 if v is not a number.
+func asInt(v interface{}) int {
+	if code, ok := v.(protocol.ErrorCode); ok {
+		return int(code)
+	}
+	n, _ := bsonutil.ToInt64(v)
+	return int(n)
+}
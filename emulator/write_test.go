@@ -0,0 +1,57 @@
+package emulator
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestLegacyDelete(t *testing.T) {
+	b := newMemBackend()
+	emu := newTestEmulator(t, b)
+	insertDocs(t, emu, testCol, bson.M{"_id": 1, "a": 1}, bson.M{"_id": 2, "a": 2}, bson.M{"_id": 3, "a": 3})
+
+	legacyDelete := func(selector bson.M, singleRemove bool) {
+		t.Helper()
+		selectorDoc, err := bson.Marshal(selector)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var flags int32
+		if singleRemove {
+			flags = 1
+		}
+		var payload bytes.Buffer
+		_ = binary.Write(&payload, binary.LittleEndian, int32(0))
+		payload.WriteString(testCol.String())
+		payload.WriteByte(0)
+		_ = binary.Write(&payload, binary.LittleEndian, flags)
+		payload.Write(selectorDoc)
+
+		var msg bytes.Buffer
+		hdr := []int32{int32(16 + payload.Len()), 1, 0, 2006}
+		_ = binary.Write(&msg, binary.LittleEndian, hdr)
+		msg.Write(payload.Bytes())
+
+		var out bytes.Buffer
+		if err := emu.HandleRequest("client", &out, msg.Bytes()); err != nil {
+			t.Fatal(err)
+		} else if out.Len() != 0 {
+			t.Fatalf("expected legacy delete to receive no reply; got %d bytes", out.Len())
+		}
+	}
+
+	legacyDelete(bson.M{"a": bson.M{"$gte": 2}}, true)
+	if got, exp := ids(b.docs(testCol)), []interface{}{1, 3}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected _id %v after a single remove; got %v", exp, got)
+	}
+
+	legacyDelete(bson.M{}, false)
+	if got := b.docs(testCol); len(got) != 0 {
+		t.Fatalf("expected all documents to be deleted; got %v", got)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"strings"
 
 	"github.com/achilleasa/mongolite/cmd"
+	"github.com/achilleasa/mongolite/emulator"
+	"github.com/achilleasa/mongolite/emulator/aggregate"
 	"github.com/achilleasa/mongolite/protocol"
 	"gopkg.in/urfave/cli.v2"
 )
@@ -24,6 +26,14 @@ func main() {
 				Usage: "Emulate a mongo server using a configurable backend",
 				Flags: []cli.Flag{
 					&cli.StringFlag{Name: "backend", Value: "dummy", Usage: "the type of backend to use. Ssupported backends: dummy"},
+					&cli.Int64Flag{Name: "ttl-monitor-sleep-secs", Value: 60, Usage: "the interval between passes of the background task that deletes expired documents"},
+					&cli.BoolFlag{Name: "enable-test-commands", Usage: "enable commands that allow test suites to control the emulator's internal state"},
+					&cli.Int64Flag{Name: "blocking-memory-limit", Value: aggregate.DefaultMemoryLimit, Usage: "the maximum number of bytes that each blocking aggregation stage (e.g. $sort) may keep in memory"},
+					&cli.StringFlag{Name: "temp-dir", Value: "", Usage: "the directory for temporary files created by aggregations that spill to disk; defaults to the system temp dir"},
+					&cli.Int64Flag{Name: "logical-session-timeout-minutes", Value: emulator.DefaultLogicalSessionTimeoutMinutes, Usage: "the number of minutes that a logical session can remain idle before it expires"},
+					&cli.StringFlag{Name: "replSet", Value: "", Usage: "emulate the primary member of a single-node replica set with the specified name"},
+					&cli.Int64Flag{Name: "oplogSize", Value: emulator.DefaultOplogSizeMB, Usage: "the maximum size of the oplog in megabytes; only applies when the replica set is initiated"},
+					&cli.BoolFlag{Name: "auth", Usage: "reject commands from clients that have not authenticated via SCRAM-SHA-1 or SCRAM-SHA-256"},
 				},
 				Action:   cmd.EmulateServer,
 				Category: "tools",
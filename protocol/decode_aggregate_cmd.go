@@ -0,0 +1,222 @@
+package protocol
+
+import (
+	"golang.org/x/xerrors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// decodeAggregateCommand decodes an aggregate command using the schema
+// described in https://docs.mongodb.com/manual/reference/command/aggregate.
+func decodeAggregateCommand(hdr RPCHeader, nsCol NamespacedCollection, cmdArgs bson.M, replyType ReplyType) (Request, error) {
+	// Database-level aggregations specify a numeric command value and
+	// therefore the collection name is not overridden by the decoder.
+	if nsCol.Collection == "$cmd" {
+		nsCol.Collection = ""
+	}
+
+	req := &AggregateRequest{
+		RequestInfo:  RequestInfo{Header: hdr, RequestType: RequestTypeAggregate, ReplyType: replyType},
+		Collection:   nsCol,
+		AllowDiskUse: asBool(cmdArgs["allowDiskUse"]),
+		Explain:      asBool(cmdArgs["explain"]),
+		Options:      bson.M{},
+	}
+
+	stageList, valid := cmdArgs["pipeline"].([]interface{})
+	if !valid {
+		return nil, xerrors.Errorf("malformed aggregate command: pipeline must be an array")
+	}
+	for i, stage := range stageList {
+		stageDoc, valid := stage.(bson.D)
+		if !valid {
+			return nil, xerrors.Errorf("malformed aggregate command: invalid pipeline stage at index %d", i)
+		}
+		req.Pipeline = append(req.Pipeline, stageDoc)
+	}
+
+	if cursorDoc, valid := cmdArgs["cursor"].(bson.D); valid {
+		if batchSize, valid := asInt64(cursorDoc.Map()["batchSize"]); valid {
+			if batchSize < 0 {
+				return nil, xerrors.Errorf("malformed aggregate command: batchSize must be non-negative")
+			}
+			req.BatchSize = int32(batchSize)
+		}
+	}
+
+	if letDoc, valid := cmdArgs["let"].(bson.D); valid {
+		req.Let = letDoc.Map()
+	} else if cmdArgs["let"] != nil {
+		return nil, xerrors.Errorf("malformed aggregate command: let must be a document")
+	}
+
+	for k, v := range cmdArgs {
+		switch k {
+		case "pipeline", "cursor", "allowDiskUse", "explain", "let":
+		default:
+			if !genericCmdArgs[k] {
+				req.Options[k] = v
+			}
+		}
+	}
+
+	return req, nil
+}
+
+// decodeGetMoreCommand decodes a getMore command using the schema described in
+// https://docs.mongodb.com/manual/reference/command/getMore. The cursor ID is
+// specified as the command value.
+func decodeGetMoreCommand(hdr RPCHeader, nsCol NamespacedCollection, cmdValue interface{}, cmdArgs bson.M, replyType ReplyType) (Request, error) {
+	cursorID, valid := cmdValue.(int64)
+	if !valid {
+		return nil, xerrors.Errorf("malformed getMore command: cursor ID must be a 64-bit integer")
+	}
+
+	colName, valid := cmdArgs["collection"].(string)
+	if !valid || colName == "" {
+		return nil, xerrors.Errorf("malformed getMore command: collection must be a non-empty string")
+	}
+	nsCol.Collection = colName
+
+	req := &GetMoreRequest{
+		RequestInfo: RequestInfo{Header: hdr, RequestType: RequestTypeGetMore, ReplyType: replyType},
+		Collection:  nsCol,
+		CursorID:    cursorID,
+	}
+
+	if batchSize, valid := asInt64(cmdArgs["batchSize"]); valid {
+		if batchSize < 0 {
+			return nil, xerrors.Errorf("malformed getMore command: batchSize must be non-negative")
+		}
+		req.NumToReturn = int32(batchSize)
+	}
+
+	if maxTimeMS, valid := asInt64(cmdArgs["maxTimeMS"]); valid {
+		if maxTimeMS < 0 {
+			return nil, xerrors.Errorf("malformed getMore command: maxTimeMS must be non-negative")
+		}
+		req.MaxTimeMS = maxTimeMS
+	}
+
+	return req, nil
+}
+
+// decodeKillCursorsCommand decodes a killCursors command using the schema
+// described in https://docs.mongodb.com/manual/reference/command/killCursors.
+func decodeKillCursorsCommand(hdr RPCHeader, nsCol NamespacedCollection, cmdArgs bson.M, replyType ReplyType) (Request, error) {
+	if err := ensureCollectionName("killCursors", nsCol); err != nil {
+		return nil, err
+	}
+
+	cursorList, valid := cmdArgs["cursors"].([]interface{})
+	if !valid {
+		return nil, xerrors.Errorf("malformed killCursors command: cursors must be an array")
+	}
+
+	cursorIDs := make([]int64, len(cursorList))
+	for i, v := range cursorList {
+		if cursorIDs[i], valid = v.(int64); !valid {
+			return nil, xerrors.Errorf("malformed killCursors command: invalid cursor ID at index %d", i)
+		}
+	}
+
+	return &KillCursorsRequest{
+		RequestInfo: RequestInfo{Header: hdr, RequestType: RequestTypeKillCursors, ReplyType: replyType},
+		Collection:  nsCol,
+		CursorIDs:   cursorIDs,
+	}, nil
+}
+
+// decodeCountCommand decodes a count command using the schema described in
+// https://docs.mongodb.com/manual/reference/command/count.
+func decodeCountCommand(hdr RPCHeader, nsCol NamespacedCollection, cmdArgs bson.M, replyType ReplyType) (Request, error) {
+	if err := ensureCollectionName("count", nsCol); err != nil {
+		return nil, err
+	}
+
+	req := &CountRequest{
+		RequestInfo: RequestInfo{Header: hdr, RequestType: RequestTypeCount, ReplyType: replyType},
+		Collection:  nsCol,
+		Options:     bson.M{},
+	}
+
+	for k, v := range cmdArgs {
+		switch k {
+		case "query":
+			if v == nil {
+				continue
+			}
+			queryDoc, valid := v.(bson.D)
+			if !valid {
+				return nil, xerrors.Errorf("malformed count command: query must be a document")
+			}
+			req.Query = queryDoc.Map()
+		case "skip":
+			skip, valid := asInt64(v)
+			if !valid || skip < 0 {
+				return nil, xerrors.Errorf("malformed count command: skip must be a non-negative number")
+			}
+			req.Skip = skip
+		case "limit":
+			limit, valid := asInt64(v)
+			if !valid {
+				return nil, xerrors.Errorf("malformed count command: limit must be a number")
+			}
+			// Negative limits are treated like positive ones.
+			if limit < 0 {
+				limit = -limit
+			}
+			req.Limit = limit
+		case "hint":
+			switch hint := v.(type) {
+			case string, bson.D:
+				req.Hint = hint
+			default:
+				return nil, xerrors.Errorf("malformed count command: hint must be a string or a document")
+			}
+		default:
+			if !genericCmdArgs[k] {
+				req.Options[k] = v
+			}
+		}
+	}
+
+	return req, nil
+}
+
+// decodeDistinctCommand decodes a distinct command using the schema described
+// in https://docs.mongodb.com/manual/reference/command/distinct.
+func decodeDistinctCommand(hdr RPCHeader, nsCol NamespacedCollection, cmdArgs bson.M, replyType ReplyType) (Request, error) {
+	if err := ensureCollectionName("distinct", nsCol); err != nil {
+		return nil, err
+	}
+
+	key, valid := cmdArgs["key"].(string)
+	if !valid {
+		return nil, xerrors.Errorf("malformed distinct command: key must be a string")
+	}
+
+	req := &DistinctRequest{
+		RequestInfo: RequestInfo{Header: hdr, RequestType: RequestTypeDistinct, ReplyType: replyType},
+		Collection:  nsCol,
+		Key:         key,
+		Options:     bson.M{},
+	}
+
+	if queryDoc, valid := cmdArgs["query"].(bson.D); valid {
+		req.Query = queryDoc.Map()
+	} else if cmdArgs["query"] != nil {
+		return nil, xerrors.Errorf("malformed distinct command: query must be a document")
+	}
+
+	for k, v := range cmdArgs {
+		switch k {
+		case "key", "query":
+		default:
+			if !genericCmdArgs[k] {
+				req.Options[k] = v
+			}
+		}
+	}
+
+	return req, nil
+}
@@ -0,0 +1,128 @@
+package protocol
+
+import (
+	"golang.org/x/xerrors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// decodeSaslStartCommand decodes a saslStart command using the schema
+// described in https://github.com/mongodb/specifications/blob/master/source/auth/auth.rst.
+func decodeSaslStartCommand(hdr RPCHeader, nsCol NamespacedCollection, cmdArgs bson.M, replyType ReplyType) (Request, error) {
+	req := &SaslStartRequest{
+		RequestInfo: RequestInfo{Header: hdr, RequestType: RequestTypeSaslStart, ReplyType: replyType},
+		Database:    nsCol.Database,
+	}
+
+	var valid bool
+	if req.Mechanism, valid = cmdArgs["mechanism"].(string); !valid {
+		return nil, xerrors.Errorf("malformed saslStart command: expected a mechanism")
+	}
+	payload, err := decodeSaslPayload(cmdArgs["payload"])
+	if err != nil {
+		return nil, xerrors.Errorf("malformed saslStart command: %w", err)
+	}
+	req.Payload = payload
+
+	if opts, isDoc := cmdArgs["options"].(bson.D); isDoc {
+		req.SkipEmptyExchange, _ = opts.Map()["skipEmptyExchange"].(bool)
+	}
+	return req, nil
+}
+
+// decodeSaslContinueCommand decodes a saslContinue command using the schema
+// described in https://github.com/mongodb/specifications/blob/master/source/auth/auth.rst.
+func decodeSaslContinueCommand(hdr RPCHeader, nsCol NamespacedCollection, cmdArgs bson.M, replyType ReplyType) (Request, error) {
+	req := &SaslContinueRequest{
+		RequestInfo: RequestInfo{Header: hdr, RequestType: RequestTypeSaslContinue, ReplyType: replyType},
+		Database:    nsCol.Database,
+	}
+
+	convID, valid := asInt64(cmdArgs["conversationId"])
+	if !valid {
+		return nil, xerrors.Errorf("malformed saslContinue command: expected a conversationId")
+	}
+	req.ConversationID = int(convID)
+
+	payload, err := decodeSaslPayload(cmdArgs["payload"])
+	if err != nil {
+		return nil, xerrors.Errorf("malformed saslContinue command: %w", err)
+	}
+	req.Payload = payload
+	return req, nil
+}
+
+// decodeSaslPayload extracts the payload of a SASL command. Drivers send the
+// payload as binary data whereas legacy shells send it as a string.
+func decodeSaslPayload(v interface{}) ([]byte, error) {
+	switch payload := v.(type) {
+	case bson.Binary:
+		return payload.Data, nil
+	case []byte:
+		return payload, nil
+	case string:
+		return []byte(payload), nil
+	}
+	return nil, xerrors.Errorf("expected a binary payload")
+}
+
+// decodeLogoutCommand decodes a logout command using the schema described in
+// https://docs.mongodb.com/manual/reference/command/logout.
+func decodeLogoutCommand(hdr RPCHeader, nsCol NamespacedCollection, _ bson.M, replyType ReplyType) (Request, error) {
+	return &LogoutRequest{
+		RequestInfo: RequestInfo{Header: hdr, RequestType: RequestTypeLogout, ReplyType: replyType},
+		Database:    nsCol.Database,
+	}, nil
+}
+
+// decodeCreateUserCommand decodes a createUser command using the schema
+// described in https://docs.mongodb.com/manual/reference/command/createUser.
+func decodeCreateUserCommand(hdr RPCHeader, nsCol NamespacedCollection, cmdValue interface{}, cmdArgs bson.M, replyType ReplyType) (Request, error) {
+	req := &CreateUserRequest{
+		RequestInfo: RequestInfo{Header: hdr, RequestType: RequestTypeCreateUser, ReplyType: replyType},
+		Database:    nsCol.Database,
+	}
+
+	var valid bool
+	if req.User, valid = cmdValue.(string); !valid || req.User == "" {
+		return nil, xerrors.Errorf("malformed createUser command: expected a user name")
+	}
+	if req.Password, valid = cmdArgs["pwd"].(string); !valid {
+		return nil, xerrors.Errorf("malformed createUser command: expected a password")
+	}
+
+	if v, found := cmdArgs["roles"]; found {
+		if req.Roles, valid = v.([]interface{}); !valid {
+			return nil, xerrors.Errorf("malformed createUser command: expected an array of roles")
+		}
+	}
+
+	if v, found := cmdArgs["mechanisms"]; found {
+		mechList, valid := v.([]interface{})
+		if !valid {
+			return nil, xerrors.Errorf("malformed createUser command: expected an array of mechanisms")
+		}
+		for i, mech := range mechList {
+			name, valid := mech.(string)
+			if !valid {
+				return nil, xerrors.Errorf("malformed createUser command: invalid mechanism at index %d", i)
+			}
+			req.Mechanisms = append(req.Mechanisms, name)
+		}
+	}
+	return req, nil
+}
+
+// decodeDropUserCommand decodes a dropUser command using the schema described
+// in https://docs.mongodb.com/manual/reference/command/dropUser.
+func decodeDropUserCommand(hdr RPCHeader, nsCol NamespacedCollection, cmdValue interface{}, _ bson.M, replyType ReplyType) (Request, error) {
+	req := &DropUserRequest{
+		RequestInfo: RequestInfo{Header: hdr, RequestType: RequestTypeDropUser, ReplyType: replyType},
+		Database:    nsCol.Database,
+	}
+
+	var valid bool
+	if req.User, valid = cmdValue.(string); !valid || req.User == "" {
+		return nil, xerrors.Errorf("malformed dropUser command: expected a user name")
+	}
+	return req, nil
+}
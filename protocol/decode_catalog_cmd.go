@@ -0,0 +1,227 @@
+package protocol
+
+import (
+	"golang.org/x/xerrors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// genericCmdArgs contains the set of arguments that can be attached to any
+// command and which should not be treated as command-specific options.
+var genericCmdArgs = map[string]bool{
+	"$db":                  true,
+	"$clusterTime":         true,
+	"$readPreference":      true,
+	"lsid":                 true,
+	"txnNumber":            true,
+	"autocommit":           true,
+	"startTransaction":     true,
+	"readConcern":          true,
+	"writeConcern":         true,
+	"maxTimeMS":            true,
+	"comment":              true,
+	"apiVersion":           true,
+	"apiStrict":            true,
+	"apiDeprecationErrors": true,
+}
+
+// IsGenericCommandArg returns true if name is an argument that can be attached
+// to any command (e.g. lsid or $db) rather than a command-specific option.
+func IsGenericCommandArg(name string) bool {
+	return genericCmdArgs[name]
+}
+
+// decodeListDatabasesCommand decodes a listDatabases command using the schema
+// described in https://docs.mongodb.com/manual/reference/command/listDatabases.
+func decodeListDatabasesCommand(hdr RPCHeader, _ NamespacedCollection, cmdArgs bson.M, replyType ReplyType) (Request, error) {
+	req := &ListDatabasesRequest{
+		RequestInfo:         RequestInfo{Header: hdr, RequestType: RequestTypeListDatabases, ReplyType: replyType},
+		NameOnly:            asBool(cmdArgs["nameOnly"]),
+		AuthorizedDatabases: asBool(cmdArgs["authorizedDatabases"]),
+	}
+
+	if filter, valid := cmdArgs["filter"].(bson.D); valid {
+		req.Filter = filter.Map()
+	} else if cmdArgs["filter"] != nil {
+		return nil, xerrors.Errorf("malformed listDatabases command: filter must be a document")
+	}
+
+	return req, nil
+}
+
+// decodeListCollectionsCommand decodes a listCollections command using the
+// schema described in https://docs.mongodb.com/manual/reference/command/listCollections.
+func decodeListCollectionsCommand(hdr RPCHeader, nsCol NamespacedCollection, cmdArgs bson.M, replyType ReplyType) (Request, error) {
+	req := &ListCollectionsRequest{
+		RequestInfo:           RequestInfo{Header: hdr, RequestType: RequestTypeListCollections, ReplyType: replyType},
+		Database:              nsCol.Database,
+		NameOnly:              asBool(cmdArgs["nameOnly"]),
+		AuthorizedCollections: asBool(cmdArgs["authorizedCollections"]),
+	}
+
+	if filter, valid := cmdArgs["filter"].(bson.D); valid {
+		req.Filter = filter.Map()
+	} else if cmdArgs["filter"] != nil {
+		return nil, xerrors.Errorf("malformed listCollections command: filter must be a document")
+	}
+
+	if cursorDoc, valid := cmdArgs["cursor"].(bson.D); valid {
+		if batchSize, valid := asInt64(cursorDoc.Map()["batchSize"]); valid {
+			if batchSize < 0 {
+				return nil, xerrors.Errorf("malformed listCollections command: batchSize must be non-negative")
+			}
+			req.BatchSize = int32(batchSize)
+		}
+	}
+
+	return req, nil
+}
+
+// decodeCreateCommand decodes a create command using the schema described in
+// https://docs.mongodb.com/manual/reference/command/create.
+func decodeCreateCommand(hdr RPCHeader, nsCol NamespacedCollection, cmdArgs bson.M, replyType ReplyType) (Request, error) {
+	if err := ensureCollectionName("create", nsCol); err != nil {
+		return nil, err
+	}
+
+	req := &CreateRequest{
+		RequestInfo: RequestInfo{Header: hdr, RequestType: RequestTypeCreate, ReplyType: replyType},
+		Collection:  nsCol,
+		Capped:      asBool(cmdArgs["capped"]),
+		Options:     bson.M{},
+	}
+
+	for k, v := range cmdArgs {
+		switch {
+		case k == "capped":
+		case k == "size":
+			size, valid := asInt64(v)
+			if !valid || size < 0 {
+				return nil, xerrors.Errorf("malformed create command: size must be a non-negative number")
+			}
+			req.Size = size
+		case k == "max":
+			max, valid := asInt64(v)
+			if !valid {
+				return nil, xerrors.Errorf("malformed create command: max must be a number")
+			}
+			req.Max = max
+		case !genericCmdArgs[k]:
+			req.Options[k] = v
+		}
+	}
+
+	if req.Capped && req.Size == 0 {
+		return nil, xerrors.Errorf("malformed create command: the size field is required when creating a capped collection")
+	}
+
+	return req, nil
+}
+
+// decodeDropCommand decodes a drop command using the schema described in
+// https://docs.mongodb.com/manual/reference/command/drop.
+func decodeDropCommand(hdr RPCHeader, nsCol NamespacedCollection, _ bson.M, replyType ReplyType) (Request, error) {
+	if err := ensureCollectionName("drop", nsCol); err != nil {
+		return nil, err
+	}
+
+	return &DropRequest{
+		RequestInfo: RequestInfo{Header: hdr, RequestType: RequestTypeDrop, ReplyType: replyType},
+		Collection:  nsCol,
+	}, nil
+}
+
+// decodeDropDatabaseCommand decodes a dropDatabase command using the schema
+// described in https://docs.mongodb.com/manual/reference/command/dropDatabase.
+func decodeDropDatabaseCommand(hdr RPCHeader, nsCol NamespacedCollection, _ bson.M, replyType ReplyType) (Request, error) {
+	return &DropDatabaseRequest{
+		RequestInfo: RequestInfo{Header: hdr, RequestType: RequestTypeDropDatabase, ReplyType: replyType},
+		Database:    nsCol.Database,
+	}, nil
+}
+
+// decodeRenameCollectionCommand decodes a renameCollection command using the
+// schema described in https://docs.mongodb.com/manual/reference/command/renameCollection.
+// The command must be run against the admin database and specifies both the
+// source and target collections as fully qualified namespaces.
+func decodeRenameCollectionCommand(hdr RPCHeader, nsCol NamespacedCollection, cmdArgs bson.M, replyType ReplyType) (Request, error) {
+	// The command decoders will populate the collection name with the
+	// value of the renameCollection field which is the source namespace.
+	from, err := ParseNamespacedCollection(nsCol.Collection)
+	if err != nil {
+		return nil, xerrors.Errorf("malformed renameCollection command: invalid source namespace: %w", err)
+	}
+
+	toNS, valid := cmdArgs["to"].(string)
+	if !valid {
+		return nil, xerrors.Errorf("malformed renameCollection command: missing target namespace")
+	}
+	to, err := ParseNamespacedCollection(toNS)
+	if err != nil {
+		return nil, xerrors.Errorf("malformed renameCollection command: invalid target namespace: %w", err)
+	}
+
+	return &RenameCollectionRequest{
+		RequestInfo: RequestInfo{Header: hdr, RequestType: RequestTypeRenameCollection, ReplyType: replyType},
+		From:        from,
+		To:          to,
+		DropTarget:  asBool(cmdArgs["dropTarget"]),
+	}, nil
+}
+
+// decodeCollModCommand decodes a collMod command using the schema described in
+// https://docs.mongodb.com/manual/reference/command/collMod.
+func decodeCollModCommand(hdr RPCHeader, nsCol NamespacedCollection, cmdArgs bson.M, replyType ReplyType) (Request, error) {
+	if err := ensureCollectionName("collMod", nsCol); err != nil {
+		return nil, err
+	}
+
+	req := &CollModRequest{
+		RequestInfo: RequestInfo{Header: hdr, RequestType: RequestTypeCollMod, ReplyType: replyType},
+		Collection:  nsCol,
+		Options:     bson.M{},
+	}
+	for k, v := range cmdArgs {
+		if !genericCmdArgs[k] {
+			req.Options[k] = v
+		}
+	}
+
+	return req, nil
+}
+
+// ensureCollectionName returns an error if the collection name for a command
+// that targets a specific collection is missing.
+func ensureCollectionName(cmdName string, nsCol NamespacedCollection) error {
+	if nsCol.Collection == "" || nsCol.Collection == "$cmd" {
+		return xerrors.Errorf("malformed %s command: missing collection name", cmdName)
+	}
+	return nil
+}
+
+// asInt64 converts any of the numeric types that can be emitted by the bson
+// decoder into an int64 value.
+func asInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case float64:
+		return int64(n), true
+	}
+	return 0, false
+}
+
+// asBool interprets v as a boolean flag. Mongo clients (e.g. the mongo shell)
+// may encode flags as numbers instead of booleans.
+func asBool(v interface{}) bool {
+	if b, isBool := v.(bool); isBool {
+		return b
+	}
+	if n, isNum := asInt64(v); isNum {
+		return n != 0
+	}
+	return false
+}
@@ -31,6 +31,9 @@ func decodeInsertCommand(hdr RPCHeader, nsCol NamespacedCollection, cmdArgs bson
 	if ordered, valid := cmdArgs["ordered"].(bool); valid && !ordered {
 		req.Flags |= InsertFlagContinueOnError
 	}
+	if writeConcern, valid := cmdArgs["writeConcern"].(bson.D); valid {
+		req.WriteConcern = writeConcern.Map()
+	}
 
 	return req, nil
 }
@@ -63,7 +66,7 @@ func decodeUpdateCommand(hdr RPCHeader, nsCol NamespacedCollection, cmdArgs bson
 		if multi, valid := updateDocMap["multi"].(bool); valid && multi {
 			updateTargets[i].Flags |= UpdateFlagMulti
 		}
-		if arrayFilterList, valid := cmdArgs["arrayFilters"].([]interface{}); valid {
+		if arrayFilterList, valid := updateDocMap["arrayFilters"].([]interface{}); valid {
 			for j, fdoc := range arrayFilterList {
 				arrayFilter, valid := fdoc.(bson.D)
 				if !valid {
@@ -74,11 +77,20 @@ func decodeUpdateCommand(hdr RPCHeader, nsCol NamespacedCollection, cmdArgs bson
 		}
 	}
 
-	return &UpdateRequest{
+	req := &UpdateRequest{
 		RequestInfo: RequestInfo{Header: hdr, RequestType: RequestTypeUpdate, ReplyType: replyType},
 		Collection:  nsCol,
 		Updates:     updateTargets,
-	}, nil
+	}
+
+	if ordered, valid := cmdArgs["ordered"].(bool); valid && !ordered {
+		req.ContinueOnError = true
+	}
+	if writeConcern, valid := cmdArgs["writeConcern"].(bson.D); valid {
+		req.WriteConcern = writeConcern.Map()
+	}
+
+	return req, nil
 }
 
 // decodeDeleteCommand decodes a delete command packed within a query operation
@@ -111,6 +123,13 @@ func decodeDeleteCommand(hdr RPCHeader, nsCol NamespacedCollection, cmdArgs bson
 		Deletes:     deleteTargets,
 	}
 
+	if ordered, valid := cmdArgs["ordered"].(bool); valid && !ordered {
+		req.ContinueOnError = true
+	}
+	if writeConcern, valid := cmdArgs["writeConcern"].(bson.D); valid {
+		req.WriteConcern = writeConcern.Map()
+	}
+
 	return req, nil
 }
 
@@ -139,7 +158,18 @@ func decodeFindCommand(hdr RPCHeader, nsCol NamespacedCollection, cmdArgs bson.M
 		req.FieldSelector = projection.Map()
 	}
 	if sort, valid := cmdArgs["sort"].(bson.D); valid {
-		req.Sort = sort.Map()
+		req.Sort = sort
+	}
+	req.AllowDiskUse = asBool(cmdArgs["allowDiskUse"])
+
+	if asBool(cmdArgs["tailable"]) {
+		req.Flags |= QueryFlagTailableCursor
+	}
+	if asBool(cmdArgs["awaitData"]) {
+		if req.Flags&QueryFlagTailableCursor == 0 {
+			return nil, xerrors.Errorf("malformed find command: cannot set awaitData without tailable")
+		}
+		req.Flags |= QueryFlagAwaitData
 	}
 
 	return req, nil
@@ -155,10 +185,9 @@ func decodeFindAndModifyCommand(hdr RPCHeader, nsCol NamespacedCollection, cmdAr
 		query = bson.M{} // default to empty query
 	}
 
-	var sort bson.M
-	if sortDoc, valid := cmdArgs["sort"].(bson.D); valid {
-		sort = sortDoc.Map()
-	}
+	// Preserve the field order of the sort document as it determines
+	// the document that gets modified.
+	sort, _ := cmdArgs["sort"].(bson.D)
 
 	var fieldSelector bson.M
 	if fieldSelDoc, valid := cmdArgs["fields"].(bson.D); valid {
@@ -0,0 +1,149 @@
+package protocol
+
+import (
+	"golang.org/x/xerrors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// decodeCreateIndexesCommand decodes a createIndexes command using the schema
+// described in https://docs.mongodb.com/manual/reference/command/createIndexes.
+func decodeCreateIndexesCommand(hdr RPCHeader, nsCol NamespacedCollection, cmdArgs bson.M, replyType ReplyType) (Request, error) {
+	if err := ensureCollectionName("createIndexes", nsCol); err != nil {
+		return nil, err
+	}
+
+	indexList, valid := cmdArgs["indexes"].([]interface{})
+	if !valid || len(indexList) == 0 {
+		return nil, xerrors.Errorf("malformed createIndexes command: missing or empty index list")
+	}
+
+	specs := make([]IndexSpec, len(indexList))
+	for i, indexDoc := range indexList {
+		specDoc, valid := indexDoc.(bson.D)
+		if !valid {
+			return nil, xerrors.Errorf("malformed createIndexes command: invalid index spec at index %d", i)
+		}
+
+		spec, err := decodeIndexSpec(specDoc)
+		if err != nil {
+			return nil, xerrors.Errorf("malformed createIndexes command: invalid index spec at index %d: %w", i, err)
+		}
+		specs[i] = spec
+	}
+
+	return &CreateIndexesRequest{
+		RequestInfo: RequestInfo{Header: hdr, RequestType: RequestTypeCreateIndexes, ReplyType: replyType},
+		Collection:  nsCol,
+		Indexes:     specs,
+	}, nil
+}
+
+// decodeIndexSpec decodes an index specification document.
+func decodeIndexSpec(specDoc bson.D) (IndexSpec, error) {
+	spec := IndexSpec{Options: bson.M{}}
+	for _, elem := range specDoc {
+		switch elem.Name {
+		case "key":
+			key, valid := elem.Value.(bson.D)
+			if !valid || len(key) == 0 {
+				return IndexSpec{}, xerrors.Errorf("key must be a non-empty document")
+			}
+			spec.Key = key
+		case "name":
+			name, valid := elem.Value.(string)
+			if !valid {
+				return IndexSpec{}, xerrors.Errorf("name must be a string")
+			}
+			spec.Name = name
+		case "unique":
+			spec.Unique = asBool(elem.Value)
+		case "sparse":
+			spec.Sparse = asBool(elem.Value)
+		case "partialFilterExpression":
+			filter, valid := elem.Value.(bson.D)
+			if !valid {
+				return IndexSpec{}, xerrors.Errorf("partialFilterExpression must be a document")
+			}
+			spec.PartialFilterExpression = filter.Map()
+		case "expireAfterSeconds":
+			ttl, valid := asInt64(elem.Value)
+			if !valid || ttl < 0 {
+				return IndexSpec{}, xerrors.Errorf("expireAfterSeconds must be a non-negative number")
+			}
+			spec.ExpireAfterSeconds = &ttl
+		case "ns", "v", "background":
+			// Ignored legacy options
+		default:
+			spec.Options[elem.Name] = elem.Value
+		}
+	}
+
+	if len(spec.Key) == 0 {
+		return IndexSpec{}, xerrors.Errorf("missing key pattern")
+	}
+	if spec.Name == "" {
+		spec.Name = DefaultIndexName(spec.Key)
+	}
+
+	return spec, nil
+}
+
+// decodeListIndexesCommand decodes a listIndexes command using the schema
+// described in https://docs.mongodb.com/manual/reference/command/listIndexes.
+func decodeListIndexesCommand(hdr RPCHeader, nsCol NamespacedCollection, cmdArgs bson.M, replyType ReplyType) (Request, error) {
+	if err := ensureCollectionName("listIndexes", nsCol); err != nil {
+		return nil, err
+	}
+
+	req := &ListIndexesRequest{
+		RequestInfo: RequestInfo{Header: hdr, RequestType: RequestTypeListIndexes, ReplyType: replyType},
+		Collection:  nsCol,
+	}
+
+	if cursorDoc, valid := cmdArgs["cursor"].(bson.D); valid {
+		if batchSize, valid := asInt64(cursorDoc.Map()["batchSize"]); valid {
+			if batchSize < 0 {
+				return nil, xerrors.Errorf("malformed listIndexes command: batchSize must be non-negative")
+			}
+			req.BatchSize = int32(batchSize)
+		}
+	}
+
+	return req, nil
+}
+
+// decodeDropIndexesCommand decodes a dropIndexes command using the schema
+// described in https://docs.mongodb.com/manual/reference/command/dropIndexes.
+func decodeDropIndexesCommand(hdr RPCHeader, nsCol NamespacedCollection, cmdArgs bson.M, replyType ReplyType) (Request, error) {
+	if err := ensureCollectionName("dropIndexes", nsCol); err != nil {
+		return nil, err
+	}
+
+	req := &DropIndexesRequest{
+		RequestInfo: RequestInfo{Header: hdr, RequestType: RequestTypeDropIndexes, ReplyType: replyType},
+		Collection:  nsCol,
+	}
+
+	switch index := cmdArgs["index"].(type) {
+	case string:
+		if index == "*" {
+			req.DropAll = true
+		} else {
+			req.Names = []string{index}
+		}
+	case bson.D:
+		req.KeyPattern = index
+	case []interface{}:
+		for i, name := range index {
+			nameStr, valid := name.(string)
+			if !valid {
+				return nil, xerrors.Errorf("malformed dropIndexes command: invalid index name at index %d", i)
+			}
+			req.Names = append(req.Names, nameStr)
+		}
+	default:
+		return nil, xerrors.Errorf("malformed dropIndexes command: index must be a string, document or list of names")
+	}
+
+	return req, nil
+}
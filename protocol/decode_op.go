@@ -33,6 +33,59 @@ var (
 		"delete":        decodeDeleteCommand,
 		"find":          decodeFindCommand,
 		"findAndModify": decodeFindAndModifyCommand,
+
+		// Database and collection management commands
+		"listDatabases":    decodeListDatabasesCommand,
+		"listCollections":  decodeListCollectionsCommand,
+		"create":           decodeCreateCommand,
+		"drop":             decodeDropCommand,
+		"dropDatabase":     decodeDropDatabaseCommand,
+		"renameCollection": decodeRenameCollectionCommand,
+		"collMod":          decodeCollModCommand,
+
+		// Index management commands
+		"createIndexes": decodeCreateIndexesCommand,
+		"listIndexes":   decodeListIndexesCommand,
+		"dropIndexes":   decodeDropIndexesCommand,
+		"deleteIndexes": decodeDropIndexesCommand,
+
+		// Aggregation and cursor commands
+		"aggregate":   decodeAggregateCommand,
+		"count":       decodeCountCommand,
+		"distinct":    decodeDistinctCommand,
+		"killCursors": decodeKillCursorsCommand,
+
+		// Logical session commands
+		"startSession": decodeStartSessionCommand,
+
+		// Transaction commands
+		"commitTransaction": decodeTransactionCommand(RequestTypeCommitTransaction),
+		"abortTransaction":  decodeTransactionCommand(RequestTypeAbortTransaction),
+
+		// Authentication commands
+		"saslStart":    decodeSaslStartCommand,
+		"saslContinue": decodeSaslContinueCommand,
+		"logout":       decodeLogoutCommand,
+	}
+
+	// Register decoders for mongo commands that use the command value as
+	// an argument (e.g. {getMore: <cursorID>}) instead of specifying the
+	// target collection name. These decoders take precedence over the
+	// ones registered in cmdDecoder.
+	cmdValueDecoder = map[string]func(RPCHeader, NamespacedCollection, interface{}, bson.M, ReplyType) (Request, error){
+		"getMore": decodeGetMoreCommand,
+
+		// Logical session commands
+		"endSessions":     decodeSessionsCommand(RequestTypeEndSessions),
+		"refreshSessions": decodeSessionsCommand(RequestTypeRefreshSessions),
+		"killSessions":    decodeSessionsCommand(RequestTypeKillSessions),
+
+		// Replication commands
+		"replSetInitiate": decodeReplSetInitiateCommand,
+
+		// User management commands
+		"createUser": decodeCreateUserCommand,
+		"dropUser":   decodeDropUserCommand,
 	}
 )
 
@@ -267,7 +320,7 @@ func decodeDeleteOp(hdr RPCHeader, r io.Reader) (Request, error) {
 		return nil, xerrors.Errorf("unable to read selector doc for delete op: %w", err)
 	}
 
-	return DeleteRequest{
+	return &DeleteRequest{
 		RequestInfo: RequestInfo{Header: hdr, RequestType: RequestTypeDelete},
 
 		Collection: nsCol,
@@ -403,18 +456,29 @@ func decodeQueryOp(hdr RPCHeader, r io.Reader) (Request, error) {
 
 	// Locate a suitable decoder for the command and use OP_REPLY for
 	// responses since this is an OP_QUERY request.
-	if dec := cmdDecoder[cmdName]; dec != nil {
-		return dec(hdr, nsCol, cmdArgs, ReplyTypeOpReply)
+	var req Request
+	if dec := cmdValueDecoder[cmdName]; dec != nil {
+		req, err = dec(hdr, nsCol, queryDoc[0].Value, cmdArgs, ReplyTypeOpReply)
+	} else if dec := cmdDecoder[cmdName]; dec != nil {
+		req, err = dec(hdr, nsCol, cmdArgs, ReplyTypeOpReply)
+	} else {
+		// Fallback to wrapping this as a generic command
+		req = &CommandRequest{
+			// This request requires a reply to be sent back to the client
+			RequestInfo: RequestInfo{Header: hdr, RequestType: RequestTypeCommand, ReplyType: ReplyTypeOpReply},
+			Collection:  nsCol,
+			Command:     cmdName,
+			Args:        cmdArgs,
+		}
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	// Fallback to wrapping this as a generic command
-	return &CommandRequest{
-		// This request requires a reply to be sent back to the client
-		RequestInfo: RequestInfo{Header: hdr, RequestType: RequestTypeCommand, ReplyType: ReplyTypeOpReply},
-		Collection:  nsCol,
-		Command:     cmdName,
-		Args:        cmdArgs,
-	}, nil
+	if err = decodeSessionArgs(req, cmdArgs); err != nil {
+		return nil, xerrors.Errorf("unable to parse command %q in query op: %w", cmdName, err)
+	}
+	return req, nil
 }
 
 // decodeMsgOp unpacks a generic message operation request. According to the
@@ -558,27 +622,35 @@ func decodeMsgOp(hdr RPCHeader, r io.Reader) (Request, error) {
 		cmdArgs[sec.path] = sec.docList
 	}
 
-	// Locate a suitable decoder for the command
-	if dec := cmdDecoder[cmdName]; dec != nil {
-		// Since the incoming request uses OP_MSG as its envelope,
-		// make sure that decoded requests signal that an OP_MSG reply
-		// is required
-		req, err := dec(hdr, nsCol, cmdArgs, ReplyTypeOpMsg)
-		if err != nil {
-			return nil, xerrors.Errorf("unable to parse command %q in msg op: %w", cmdName, err)
+	// Locate a suitable decoder for the command. Since the incoming
+	// request uses OP_MSG as its envelope, make sure that decoded requests
+	// signal that an OP_MSG reply is required
+	var (
+		req Request
+		err error
+	)
+	if dec := cmdValueDecoder[cmdName]; dec != nil {
+		req, err = dec(hdr, nsCol, bodySection[0].Value, cmdArgs, ReplyTypeOpMsg)
+	} else if dec := cmdDecoder[cmdName]; dec != nil {
+		req, err = dec(hdr, nsCol, cmdArgs, ReplyTypeOpMsg)
+	} else {
+		// Fallback to wrapping this as a generic command which expects
+		// a reply using an OP_MSG response.
+		req = &CommandRequest{
+			// This request requires a reply to be sent back to the client
+			RequestInfo: RequestInfo{Header: hdr, RequestType: RequestTypeCommand, ReplyType: ReplyTypeOpMsg},
+			Collection:  nsCol,
+			Command:     cmdName,
+			Args:        cmdArgs,
 		}
-		return req, err
 	}
-
-	// Fallback to wrapping this as a generic command which expects a reply
-	// using an OP_MSG response.
-	return &CommandRequest{
-		// This request requires a reply to be sent back to the client
-		RequestInfo: RequestInfo{Header: hdr, RequestType: RequestTypeCommand, ReplyType: ReplyTypeOpMsg},
-		Collection:  nsCol,
-		Command:     cmdName,
-		Args:        cmdArgs,
-	}, nil
+	if err == nil {
+		err = decodeSessionArgs(req, cmdArgs)
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("unable to parse command %q in msg op: %w", cmdName, err)
+	}
+	return req, nil
 }
 
 // decodeUnknownOp is invoked when the reader encounters an unknown opcode.
@@ -602,13 +674,24 @@ func decodeNamespacedCollection(r io.Reader, maxLen int) (NamespacedCollection,
 		return NamespacedCollection{}, xerrors.Errorf("unable to decode namespaced collection: %w", err)
 	}
 
-	tokens := strings.SplitN(cstring, ".", 2)
+	nsCol, err := ParseNamespacedCollection(cstring)
+	if err != nil {
+		return NamespacedCollection{}, xerrors.Errorf("unable to decode namespaced collection: %w", err)
+	}
+	return nsCol, nil
+}
+
+// ParseNamespacedCollection splits a "dbname.collectionname" string into a
+// namespaced collection instance. It returns an error if either the database
+// or the collection name is empty.
+func ParseNamespacedCollection(ns string) (NamespacedCollection, error) {
+	tokens := strings.SplitN(ns, ".", 2)
 	if len(tokens) != 2 {
-		return NamespacedCollection{}, xerrors.Errorf("unable to decode namespaced collection: malformed namespace %q", cstring)
+		return NamespacedCollection{}, xerrors.Errorf("malformed namespace %q", ns)
 	} else if len(tokens[0]) == 0 {
-		return NamespacedCollection{}, xerrors.Errorf("unable to decode namespaced collection: malformed namespace %q; empty database name", cstring)
+		return NamespacedCollection{}, xerrors.Errorf("malformed namespace %q; empty database name", ns)
 	} else if len(tokens[1]) == 0 {
-		return NamespacedCollection{}, xerrors.Errorf("unable to decode namespaced collection: malformed namespace %q; empty collection name", cstring)
+		return NamespacedCollection{}, xerrors.Errorf("malformed namespace %q; empty collection name", ns)
 	}
 
 	return NamespacedCollection{
@@ -0,0 +1,28 @@
+package protocol
+
+import (
+	"golang.org/x/xerrors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// decodeReplSetInitiateCommand decodes a replSetInitiate command using the
+// schema described in https://docs.mongodb.com/manual/reference/command/replSetInitiate.
+func decodeReplSetInitiateCommand(hdr RPCHeader, _ NamespacedCollection, cmdValue interface{}, _ bson.M, replyType ReplyType) (Request, error) {
+	req := &ReplSetInitiateRequest{
+		RequestInfo: RequestInfo{Header: hdr, RequestType: RequestTypeReplSetInitiate, ReplyType: replyType},
+	}
+
+	switch cfg := cmdValue.(type) {
+	case bson.D:
+		req.Config = cfg.Map()
+	case bson.M:
+		req.Config = cfg
+	case nil:
+	default:
+		// Shells send {replSetInitiate: 1} when no config is provided.
+		if _, isNumber := asInt64(cmdValue); !isNumber {
+			return nil, xerrors.Errorf("malformed replSetInitiate command: expected a config document")
+		}
+	}
+	return req, nil
+}
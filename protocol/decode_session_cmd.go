@@ -0,0 +1,138 @@
+package protocol
+
+import (
+	"golang.org/x/xerrors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// decodeStartSessionCommand decodes a startSession command using the schema
+// described in https://docs.mongodb.com/manual/reference/command/startSession.
+func decodeStartSessionCommand(hdr RPCHeader, _ NamespacedCollection, _ bson.M, replyType ReplyType) (Request, error) {
+	return &StartSessionRequest{
+		RequestInfo: RequestInfo{Header: hdr, RequestType: RequestTypeStartSession, ReplyType: replyType},
+	}, nil
+}
+
+// decodeSessionsCommand returns a decoder for the commands that receive a
+// list of lsid documents as their command value (e.g. {endSessions: [...]}).
+func decodeSessionsCommand(reqType RequestType) func(RPCHeader, NamespacedCollection, interface{}, bson.M, ReplyType) (Request, error) {
+	return func(hdr RPCHeader, _ NamespacedCollection, cmdValue interface{}, _ bson.M, replyType ReplyType) (Request, error) {
+		sessionList, valid := cmdValue.([]interface{})
+		if !valid {
+			return nil, xerrors.Errorf("malformed %s command: expected an array of session IDs", reqType)
+		}
+
+		req := &SessionsRequest{
+			RequestInfo: RequestInfo{Header: hdr, RequestType: reqType, ReplyType: replyType},
+		}
+		for i, v := range sessionList {
+			id, err := decodeLogicalSessionID(v)
+			if err != nil {
+				return nil, xerrors.Errorf("malformed %s command: invalid session ID at index %d: %w", reqType, i, err)
+			}
+			req.Sessions = append(req.Sessions, id)
+		}
+		return req, nil
+	}
+}
+
+// decodeTransactionCommand returns a decoder for the commitTransaction and
+// abortTransaction commands.
+func decodeTransactionCommand(reqType RequestType) func(RPCHeader, NamespacedCollection, bson.M, ReplyType) (Request, error) {
+	return func(hdr RPCHeader, _ NamespacedCollection, _ bson.M, replyType ReplyType) (Request, error) {
+		return &TransactionRequest{
+			RequestInfo: RequestInfo{Header: hdr, RequestType: reqType, ReplyType: replyType},
+		}, nil
+	}
+}
+
+// decodeSessionArgs populates the session, transaction and causal consistency
+// arguments of a decoded command request from the generic lsid, txnNumber,
+// startTransaction, autocommit, $clusterTime and readConcern command
+// arguments.
+func decodeSessionArgs(req Request, cmdArgs bson.M) error {
+	var (
+		id     *LogicalSessionID
+		txn    TxnInfo
+		causal CausalInfo
+	)
+
+	if lsid, found := cmdArgs["lsid"]; found {
+		decoded, err := decodeLogicalSessionID(lsid)
+		if err != nil {
+			return xerrors.Errorf("malformed lsid: %w", err)
+		}
+		id = &decoded
+	}
+
+	if v, found := cmdArgs["txnNumber"]; found {
+		var txnNumber int64
+		switch n := v.(type) {
+		case int64:
+			txnNumber = n
+		case int:
+			txnNumber = int64(n)
+		default:
+			return xerrors.Errorf("malformed txnNumber: expected a long")
+		}
+		txn.Number = &txnNumber
+	}
+	if v, found := cmdArgs["autocommit"]; found {
+		autocommit, valid := v.(bool)
+		if !valid {
+			return xerrors.Errorf("malformed autocommit: expected a boolean")
+		}
+		txn.Autocommit = &autocommit
+	}
+	txn.StartTransaction = asBool(cmdArgs["startTransaction"])
+
+	if v, found := cmdArgs["$clusterTime"]; found {
+		clusterTime, valid := lookupTimestamp(v, "clusterTime")
+		if !valid {
+			return xerrors.Errorf("malformed $clusterTime: clusterTime must be a timestamp")
+		}
+		causal.ClusterTime = &clusterTime
+	}
+	if v, found := cmdArgs["readConcern"]; found {
+		if doc, valid := v.(bson.D); valid {
+			if _, found := doc.Map()["afterClusterTime"]; found {
+				afterClusterTime, valid := lookupTimestamp(doc, "afterClusterTime")
+				if !valid {
+					return xerrors.Errorf("malformed readConcern: afterClusterTime must be a timestamp")
+				}
+				causal.AfterClusterTime = &afterClusterTime
+			}
+		}
+	}
+
+	if setter, ok := req.(interface {
+		setSession(*LogicalSessionID, TxnInfo, CausalInfo)
+	}); ok {
+		setter.setSession(id, txn, causal)
+	}
+	return nil
+}
+
+// lookupTimestamp returns the timestamp stored in the specified field of doc.
+func lookupTimestamp(doc interface{}, field string) (bson.MongoTimestamp, bool) {
+	d, valid := doc.(bson.D)
+	if !valid {
+		return 0, false
+	}
+	ts, valid := d.Map()[field].(bson.MongoTimestamp)
+	return ts, valid
+}
+
+// decodeLogicalSessionID decodes an lsid document ({id: UUID}).
+func decodeLogicalSessionID(v interface{}) (LogicalSessionID, error) {
+	doc, valid := v.(bson.D)
+	if !valid {
+		return LogicalSessionID{}, xerrors.Errorf("expected a document")
+	}
+
+	uuid, valid := doc.Map()["id"].(bson.Binary)
+	if !valid || uuid.Kind != 0x04 || len(uuid.Data) != 16 {
+		return LogicalSessionID{}, xerrors.Errorf("id must be a UUID")
+	}
+	return LogicalSessionID{ID: uuid}, nil
+}
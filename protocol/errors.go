@@ -1,33 +1,55 @@
 package protocol
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
 
 // ErrorCode describes the type of error messages returned by a mongo server.
 type ErrorCode int
 
-// A common subset of the error codes returned by mongo servers. The full list
-// can be found here:
-// https://github.com/mongodb/mongo/blob/master/src/mongo/base/error_codes.yml.
-const (
-	CodeUnauthorized         ErrorCode = 13
-	CodeNoReplicationEnabled ErrorCode = 76
-)
+//go:generate go run gen_error_codes.go -in error_codes.yml -out error_codes.go
+
+// ErrorCategory groups related error codes (e.g. network errors). Clients
+// use categories to decide how to react to an error.
+type ErrorCategory string
 
-func (ec ErrorCode) String() string {
-	switch ec {
-	case CodeUnauthorized:
-		return "Unauthorized"
-	case CodeNoReplicationEnabled:
-		return "NoReplicationEnabled"
-	default:
-		return "Unknown"
+// Categories returns the categories that the error code belongs to.
+func (ec ErrorCode) Categories() []ErrorCategory {
+	return errorCodeCategories[ec]
+}
+
+// IsA returns true if the error code belongs to the specified category.
+func (ec ErrorCode) IsA(cat ErrorCategory) bool {
+	for _, c := range errorCodeCategories[ec] {
+		if c == cat {
+			return true
+		}
 	}
+	return false
 }
 
+// The labels that can be attached to server errors. Drivers inspect them to
+// decide whether an operation or a whole transaction can be retried.
+const (
+	ErrorLabelTransientTransactionError      = "TransientTransactionError"
+	ErrorLabelUnknownTransactionCommitResult = "UnknownTransactionCommitResult"
+	ErrorLabelRetryableWriteError            = "RetryableWriteError"
+	ErrorLabelNonResumableChangeStreamError  = "NonResumableChangeStreamError"
+	ErrorLabelResumableChangeStreamError     = "ResumableChangeStreamError"
+)
+
 // ServerError describes a server error with an associated status code.
 type ServerError struct {
 	Msg  string
 	Code ErrorCode
+
+	// An optional list of labels (e.g. TransientTransactionError) that
+	// are reported to clients via the errorLabels field of error replies.
+	Labels []string
 }
 
 // ServerErrorf creates a formatted ServerError.
@@ -42,3 +64,98 @@ func ServerErrorf(code ErrorCode, format string, args ...interface{}) ServerErro
 func (e ServerError) Error() string {
 	return fmt.Sprintf("%s (code %d): %s", e.Code.String(), e.Code, e.Msg)
 }
+
+// WithLabels returns a copy of the error with the specified labels added to
+// its existing labels.
+func (e ServerError) WithLabels(labels ...string) ServerError {
+	out := e
+	out.Labels = append([]string(nil), e.Labels...)
+	for _, label := range labels {
+		if !e.HasLabel(label) {
+			out.Labels = append(out.Labels, label)
+		}
+	}
+	return out
+}
+
+// HasLabel returns true if the error has been tagged with the specified label.
+func (e ServerError) HasLabel(label string) bool {
+	for _, l := range e.Labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+// DuplicateKeyError is returned when a write operation violates the
+// constraints of a unique index.
+type DuplicateKeyError struct {
+	Collection NamespacedCollection
+
+	// The name of the unique index whose constraint was violated.
+	IndexName string
+
+	// The key pattern of the index and the key value that caused the
+	// constraint violation. Clients use these fields to figure out the
+	// cause of the conflict.
+	KeyPattern bson.D
+	KeyValue   bson.D
+}
+
+// ServerError converts the duplicate key error into a ServerError using the
+// error message format of mongod.
+func (e DuplicateKeyError) ServerError() ServerError {
+	return ServerErrorf(
+		CodeDuplicateKey,
+		"E11000 duplicate key error collection: %s index: %s dup key: %s",
+		e.Collection, e.IndexName, formatKeyValue(e.KeyValue),
+	)
+}
+
+// Error returns a string representation for this error
+func (e DuplicateKeyError) Error() string {
+	return e.ServerError().Error()
+}
+
+// formatKeyValue formats a key value document using the shell-like notation
+// used by mongod in duplicate key error messages.
+func formatKeyValue(doc bson.D) string {
+	if len(doc) == 0 {
+		return "{}"
+	}
+
+	tokens := make([]string, len(doc))
+	for i, elem := range doc {
+		tokens[i] = fmt.Sprintf("%s: %s", elem.Name, formatValue(elem.Value))
+	}
+	return "{ " + strings.Join(tokens, ", ") + " }"
+}
+
+func formatValue(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return fmt.Sprintf("%q", val)
+	case bson.ObjectId:
+		return fmt.Sprintf("ObjectId('%s')", val.Hex())
+	case time.Time:
+		return fmt.Sprintf("new Date(%d)", val.UnixNano()/int64(time.Millisecond))
+	case bson.D:
+		return formatKeyValue(val)
+	case bson.M:
+		var doc bson.D
+		for k, v := range val {
+			doc = append(doc, bson.DocElem{Name: k, Value: v})
+		}
+		return formatKeyValue(doc)
+	case []interface{}:
+		tokens := make([]string, len(val))
+		for i, item := range val {
+			tokens[i] = formatValue(item)
+		}
+		return "[ " + strings.Join(tokens, ", ") + " ]"
+	}
+	return fmt.Sprint(v)
+}
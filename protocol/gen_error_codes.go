@@ -0,0 +1,150 @@
+//go:build ignore
+// +build ignore
+
+// gen_error_codes generates the ErrorCode constants, their names and their
+// categories from the error_codes.yml file. It is invoked via go generate.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	categoryRegex = regexp.MustCompile(`^\s*-\s*(\w+)\s*$`)
+	codeRegex     = regexp.MustCompile(`^\s*-\s*\{code:\s*(\d+),\s*name:\s*(\w+)(?:,\s*categories:\s*\[([\w,\s]*)\])?\s*\}\s*$`)
+)
+
+type errorCode struct {
+	code       int
+	name       string
+	categories []string
+}
+
+func main() {
+	in := flag.String("in", "error_codes.yml", "the error code definitions")
+	out := flag.String("out", "error_codes.go", "the generated file")
+	flag.Parse()
+
+	if err := generate(*in, *out); err != nil {
+		fmt.Fprintf(os.Stderr, "gen_error_codes: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func generate(in, out string) error {
+	categories, codes, err := parse(in)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by gen_error_codes.go from %s; DO NOT EDIT.\n\n", in)
+	fmt.Fprintf(&buf, "package protocol\n\nimport \"fmt\"\n\n")
+
+	fmt.Fprintf(&buf, "// The error codes returned by mongo servers.\nconst (\n")
+	for _, ec := range codes {
+		fmt.Fprintf(&buf, "\tCode%s ErrorCode = %d\n", ec.name, ec.code)
+	}
+	fmt.Fprintf(&buf, ")\n\n")
+
+	fmt.Fprintf(&buf, "// The categories that group related error codes.\nconst (\n")
+	for _, cat := range categories {
+		fmt.Fprintf(&buf, "\tErrorCategory%s ErrorCategory = %q\n", cat, cat)
+	}
+	fmt.Fprintf(&buf, ")\n\n")
+
+	fmt.Fprintf(&buf, "// String returns the name of the error code. Codes that are not part of the\n")
+	fmt.Fprintf(&buf, "// catalog are raised from a specific code location (e.g. while parsing\n")
+	fmt.Fprintf(&buf, "// aggregation stages) and use the location as their name.\n")
+	fmt.Fprintf(&buf, "func (ec ErrorCode) String() string {\n\tswitch ec {\n")
+	for _, ec := range codes {
+		fmt.Fprintf(&buf, "\tcase Code%s:\n\t\treturn %q\n", ec.name, ec.name)
+	}
+	fmt.Fprintf(&buf, "\tdefault:\n\t\treturn fmt.Sprintf(\"Location%%d\", int(ec))\n\t}\n}\n\n")
+
+	fmt.Fprintf(&buf, "// errorCodeCategories maps error codes to the categories they belong to.\n")
+	fmt.Fprintf(&buf, "var errorCodeCategories = map[ErrorCode][]ErrorCategory{\n")
+	for _, ec := range codes {
+		if len(ec.categories) == 0 {
+			continue
+		}
+		fmt.Fprintf(&buf, "\tCode%s: {", ec.name)
+		for i, cat := range ec.categories {
+			if i != 0 {
+				fmt.Fprintf(&buf, ", ")
+			}
+			fmt.Fprintf(&buf, "ErrorCategory%s", cat)
+		}
+		fmt.Fprintf(&buf, "},\n")
+	}
+	fmt.Fprintf(&buf, "}\n")
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("unable to format generated code: %v", err)
+	}
+	return ioutil.WriteFile(out, src, 0644)
+}
+
+func parse(in string) ([]string, []errorCode, error) {
+	f, err := os.Open(in)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	var (
+		section    string
+		categories []string
+		codes      []errorCode
+		known      = make(map[string]bool)
+	)
+	s := bufio.NewScanner(f)
+	for lineNum := 1; s.Scan(); lineNum++ {
+		line := s.Text()
+		if trimmed := strings.TrimSpace(line); trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		} else if strings.HasSuffix(trimmed, ":") && !strings.HasPrefix(line, " ") {
+			section = strings.TrimSuffix(trimmed, ":")
+			continue
+		}
+
+		switch section {
+		case "error_categories":
+			m := categoryRegex.FindStringSubmatch(line)
+			if m == nil {
+				return nil, nil, fmt.Errorf("%s:%d: malformed error category", in, lineNum)
+			}
+			categories = append(categories, m[1])
+			known[m[1]] = true
+		case "error_codes":
+			m := codeRegex.FindStringSubmatch(line)
+			if m == nil {
+				return nil, nil, fmt.Errorf("%s:%d: malformed error code", in, lineNum)
+			}
+			code, _ := strconv.Atoi(m[1])
+			ec := errorCode{code: code, name: m[2]}
+			for _, cat := range strings.Split(m[3], ",") {
+				if cat = strings.TrimSpace(cat); cat == "" {
+					continue
+				} else if !known[cat] {
+					return nil, nil, fmt.Errorf("%s:%d: unknown error category %q", in, lineNum, cat)
+				}
+				ec.categories = append(ec.categories, cat)
+			}
+			codes = append(codes, ec)
+		default:
+			return nil, nil, fmt.Errorf("%s:%d: unexpected section %q", in, lineNum, section)
+		}
+	}
+	return categories, codes, s.Err()
+}
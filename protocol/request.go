@@ -22,6 +22,43 @@ const (
 	RequestTypeFindAndUpdate RequestType = "findAndUpdate"
 	RequestTypeFindAndDelete RequestType = "findAndDelete"
 	RequestTypeUnknown       RequestType = "unknown"
+
+	// Database and collection management requests.
+	RequestTypeListDatabases    RequestType = "listDatabases"
+	RequestTypeListCollections  RequestType = "listCollections"
+	RequestTypeCreate           RequestType = "create"
+	RequestTypeDrop             RequestType = "drop"
+	RequestTypeDropDatabase     RequestType = "dropDatabase"
+	RequestTypeRenameCollection RequestType = "renameCollection"
+	RequestTypeCollMod          RequestType = "collMod"
+
+	// Index management requests.
+	RequestTypeCreateIndexes RequestType = "createIndexes"
+	RequestTypeListIndexes   RequestType = "listIndexes"
+	RequestTypeDropIndexes   RequestType = "dropIndexes"
+
+	// Aggregation requests.
+	RequestTypeAggregate RequestType = "aggregate"
+	RequestTypeCount     RequestType = "count"
+	RequestTypeDistinct  RequestType = "distinct"
+
+	// Logical session requests.
+	RequestTypeStartSession    RequestType = "startSession"
+	RequestTypeEndSessions     RequestType = "endSessions"
+	RequestTypeRefreshSessions RequestType = "refreshSessions"
+	RequestTypeKillSessions    RequestType = "killSessions"
+
+	RequestTypeCommitTransaction RequestType = "commitTransaction"
+	RequestTypeAbortTransaction  RequestType = "abortTransaction"
+
+	RequestTypeReplSetInitiate RequestType = "replSetInitiate"
+
+	// Authentication and user management requests.
+	RequestTypeSaslStart    RequestType = "saslStart"
+	RequestTypeSaslContinue RequestType = "saslContinue"
+	RequestTypeLogout       RequestType = "logout"
+	RequestTypeCreateUser   RequestType = "createUser"
+	RequestTypeDropUser     RequestType = "dropUser"
 )
 
 // AllRequestTypeNames returns a lexicographically sorted list with all
@@ -38,6 +75,31 @@ func AllRequestTypeNames() []string {
 		string(RequestTypeFindAndUpdate),
 		string(RequestTypeFindAndDelete),
 		string(RequestTypeUnknown),
+		string(RequestTypeListDatabases),
+		string(RequestTypeListCollections),
+		string(RequestTypeCreate),
+		string(RequestTypeDrop),
+		string(RequestTypeDropDatabase),
+		string(RequestTypeRenameCollection),
+		string(RequestTypeCollMod),
+		string(RequestTypeCreateIndexes),
+		string(RequestTypeListIndexes),
+		string(RequestTypeDropIndexes),
+		string(RequestTypeAggregate),
+		string(RequestTypeCount),
+		string(RequestTypeDistinct),
+		string(RequestTypeStartSession),
+		string(RequestTypeEndSessions),
+		string(RequestTypeRefreshSessions),
+		string(RequestTypeKillSessions),
+		string(RequestTypeCommitTransaction),
+		string(RequestTypeAbortTransaction),
+		string(RequestTypeReplSetInitiate),
+		string(RequestTypeSaslStart),
+		string(RequestTypeSaslContinue),
+		string(RequestTypeLogout),
+		string(RequestTypeCreateUser),
+		string(RequestTypeDropUser),
 	}
 	sort.Strings(list)
 	return list
@@ -71,6 +133,19 @@ type Request interface {
 
 	// RequestID returns the unique request ID for an incoming request.
 	RequestID() int32
+
+	// SessionID returns the logical session that the request belongs to
+	// or nil if the request was not sent within a session.
+	SessionID() *LogicalSessionID
+
+	// Transaction returns the transaction arguments (txnNumber,
+	// startTransaction and autocommit) attached to the request.
+	Transaction() TxnInfo
+
+	// CausalConsistency returns the causal consistency arguments
+	// ($clusterTime and readConcern.afterClusterTime) attached to the
+	// request.
+	CausalConsistency() CausalInfo
 }
 
 // RPCHeader provides information about a request or response payload.
@@ -105,6 +180,17 @@ type RequestInfo struct {
 	//   - uses the OP_REPLY format (OP_QUERY, OP_GETMORE)
 	//   - uses the new OP_MSG format (for requests using OP_MSG envelopes).
 	ReplyType ReplyType
+
+	// The logical session (lsid) that the request belongs to. Only
+	// populated for commands sent within a session.
+	Session *LogicalSessionID
+
+	// The transaction arguments that were attached to the request.
+	Txn TxnInfo
+
+	// The causal consistency arguments that were attached to the
+	// request.
+	Causal CausalInfo
 }
 
 // Opcode returns the opcode for this request.
@@ -119,6 +205,20 @@ func (r RequestInfo) GetType() RequestType { return r.RequestType }
 // GetReplyType returns the expected reply type for this request.
 func (r RequestInfo) GetReplyType() ReplyType { return r.ReplyType }
 
+// SessionID returns the logical session that the request belongs to.
+func (r RequestInfo) SessionID() *LogicalSessionID { return r.Session }
+
+// Transaction returns the transaction arguments attached to the request.
+func (r RequestInfo) Transaction() TxnInfo { return r.Txn }
+
+// CausalConsistency returns the causal consistency arguments attached to the
+// request.
+func (r RequestInfo) CausalConsistency() CausalInfo { return r.Causal }
+
+func (r *RequestInfo) setSession(id *LogicalSessionID, txn TxnInfo, causal CausalInfo) {
+	r.Session, r.Txn, r.Causal = id, txn, causal
+}
+
 // NamespacedCollection encodes a namespaced collection.
 type NamespacedCollection struct {
 	Database   string
@@ -148,6 +248,13 @@ type UpdateRequest struct {
 
 	Collection NamespacedCollection
 	Updates    []UpdateTarget
+
+	// If set, the database will continue processing the remaining updates
+	// even if an error occurs (i.e. the request specified ordered: false).
+	ContinueOnError bool
+
+	// The (optional) write concern for the request.
+	WriteConcern bson.M
 }
 
 // UpdateTarget represents a single update operation.
@@ -175,15 +282,28 @@ type InsertRequest struct {
 	Collection NamespacedCollection
 	Flags      InsertFlag
 	Inserts    []bson.M
+
+	// The (optional) write concern for the request.
+	WriteConcern bson.M
 }
 
 // GetMoreRequest represents a request to read additional documents off a cursor.
+//
+// Requests decoded from a legacy OP_GETMORE message expect an OP_REPLY with the
+// next batch of documents. Requests decoded from a getMore command expect a
+// command reply with the next batch nested in a cursor document:
+// {cursor: {id, ns, nextBatch}, ok: 1}.
 type GetMoreRequest struct {
 	RequestInfo
 
 	Collection  NamespacedCollection
 	NumToReturn int32
 	CursorID    int64
+
+	// The maximum number of milliseconds to wait for new documents when
+	// the cursor is tailable and awaits data. A zero value selects the
+	// server default.
+	MaxTimeMS int64
 }
 
 // ReplyExpected always returns true for GetMore requests.
@@ -195,6 +315,13 @@ type DeleteRequest struct {
 
 	Collection NamespacedCollection
 	Deletes    []DeleteTarget
+
+	// If set, the database will continue processing the remaining deletes
+	// even if an error occurs (i.e. the request specified ordered: false).
+	ContinueOnError bool
+
+	// The (optional) write concern for the request.
+	WriteConcern bson.M
 }
 
 // DeleteTarget represents a single delete operation.
@@ -207,6 +334,10 @@ type DeleteTarget struct {
 type KillCursorsRequest struct {
 	RequestInfo
 
+	// The collection that the cursors belong to. Only populated for
+	// requests decoded from a killCursors command.
+	Collection NamespacedCollection
+
 	CursorIDs []int64
 }
 
@@ -246,8 +377,12 @@ type QueryRequest struct {
 	NumToSkip     int32
 	NumToReturn   int32
 	Query         bson.M
-	Sort          bson.M
+	Sort          bson.D
 	FieldSelector bson.M
+
+	// Allows sorts that exceed the memory limit of the server to spill
+	// to disk.
+	AllowDiskUse bool
 }
 
 // FindAndUpdateRequest encapsulates the arguments for a find and replace
@@ -266,7 +401,7 @@ type FindAndUpdateRequest struct {
 
 	// Optional sort order in case multiple documents match the query. Only
 	// the first document will be affected by this operation.
-	Sort bson.M
+	Sort bson.D
 
 	Update       bson.M
 	ArrayFilters []bson.M
@@ -297,7 +432,7 @@ type FindAndDeleteRequest struct {
 
 	// Optional sort order in case multiple documents match the query. Only
 	// the first document will be affected by this operation.
-	Sort bson.M
+	Sort bson.D
 
 	// An optional selector for the fields in the returned document.
 	FieldSelector bson.M
@@ -0,0 +1,86 @@
+package protocol
+
+import "gopkg.in/mgo.v2/bson"
+
+// AggregateRequest represents a request to run an aggregation pipeline.
+//
+// See https://docs.mongodb.com/manual/reference/command/aggregate
+type AggregateRequest struct {
+	RequestInfo
+
+	// The collection to aggregate. For database-level aggregations (e.g.
+	// {aggregate: 1}), the collection name is empty.
+	Collection NamespacedCollection
+
+	// The pipeline stages. Each stage is a single-field document whose
+	// field name is the stage name.
+	Pipeline []bson.D
+
+	// The number of documents to include in the first batch. A zero value
+	// selects the server default.
+	BatchSize int32
+
+	// If true, blocking stages may write temporary data to disk.
+	AllowDiskUse bool
+
+	// If true, the server returns information about the pipeline
+	// execution plan instead of running it.
+	Explain bool
+
+	// Variables that can be accessed by pipeline expressions.
+	Let bson.M
+
+	// Any additional options (e.g. collation, hint or comment).
+	Options bson.M
+}
+
+// CountRequest represents a request to count the documents in a collection.
+//
+// See https://docs.mongodb.com/manual/reference/command/count
+type CountRequest struct {
+	RequestInfo
+
+	Collection NamespacedCollection
+
+	// The query for selecting the documents to count. A nil value
+	// matches all documents.
+	Query bson.M
+
+	// The number of matching documents to skip and the maximum number of
+	// documents to count. A zero Limit counts all matching documents.
+	Skip  int64
+	Limit int64
+
+	// An (optional) index hint; either an index name or a key pattern.
+	Hint interface{}
+
+	// Any additional options (e.g. collation or readConcern).
+	Options bson.M
+}
+
+// IsEstimate returns true if the request counts all documents in the
+// collection and can therefore be answered using the collection metadata
+// (e.g. estimatedDocumentCount).
+func (r *CountRequest) IsEstimate() bool {
+	return len(r.Query) == 0 && r.Skip == 0 && r.Limit == 0
+}
+
+// DistinctRequest represents a request to list the distinct values of a field
+// across the documents of a collection.
+//
+// See https://docs.mongodb.com/manual/reference/command/distinct
+type DistinctRequest struct {
+	RequestInfo
+
+	Collection NamespacedCollection
+
+	// The field path whose values are returned.
+	Key string
+
+	// The query for selecting documents. A nil value matches all
+	// documents.
+	Query bson.M
+
+	// Any additional options (e.g. collation or readConcern).
+	Options bson.M
+}
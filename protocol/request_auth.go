@@ -0,0 +1,81 @@
+package protocol
+
+// SaslStartRequest represents a request to start a SASL authentication
+// conversation.
+//
+// See https://github.com/mongodb/specifications/blob/master/source/auth/auth.rst
+type SaslStartRequest struct {
+	RequestInfo
+
+	// The database that holds the credentials of the user.
+	Database string
+
+	// The SASL mechanism (e.g. SCRAM-SHA-256).
+	Mechanism string
+
+	// The first message of the client.
+	Payload []byte
+
+	// If true, the server completes the conversation as soon as the client
+	// proof has been verified instead of waiting for an empty client
+	// message.
+	SkipEmptyExchange bool
+}
+
+// SaslContinueRequest represents a request to continue a SASL authentication
+// conversation.
+type SaslContinueRequest struct {
+	RequestInfo
+
+	// The database that holds the credentials of the user.
+	Database string
+
+	// The conversation ID returned by saslStart.
+	ConversationID int
+
+	// The next message of the client.
+	Payload []byte
+}
+
+// LogoutRequest represents a request to log out the user that is
+// authenticated on the connection.
+//
+// See https://docs.mongodb.com/manual/reference/command/logout
+type LogoutRequest struct {
+	RequestInfo
+
+	// The database that the user authenticated against.
+	Database string
+}
+
+// CreateUserRequest represents a request to create a user.
+//
+// See https://docs.mongodb.com/manual/reference/command/createUser
+type CreateUserRequest struct {
+	RequestInfo
+
+	// The database that holds the credentials of the user.
+	Database string
+
+	User     string
+	Password string
+
+	// The roles granted to the user.
+	Roles []interface{}
+
+	// The SCRAM mechanisms for which credentials should be generated. If
+	// empty, credentials are generated for all supported mechanisms.
+	Mechanisms []string
+}
+
+// DropUserRequest represents a request to remove a user.
+//
+// See https://docs.mongodb.com/manual/reference/command/dropUser
+type DropUserRequest struct {
+	RequestInfo
+
+	// The database that holds the credentials of the user.
+	Database string
+
+	User string
+}
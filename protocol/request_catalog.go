@@ -0,0 +1,109 @@
+package protocol
+
+import "gopkg.in/mgo.v2/bson"
+
+// ListDatabasesRequest represents a request to list the databases known to
+// the server.
+//
+// See https://docs.mongodb.com/manual/reference/command/listDatabases
+type ListDatabasesRequest struct {
+	RequestInfo
+
+	// An optional filter for the returned database list. The filter is
+	// applied to the name, sizeOnDisk and empty fields of each entry.
+	Filter bson.M
+
+	// If true, only the database names will be returned.
+	NameOnly bool
+
+	// If true, only list databases that the user is authorized to access.
+	AuthorizedDatabases bool
+}
+
+// ListCollectionsRequest represents a request to list the collections in a
+// database. The reply is always returned as a cursor.
+//
+// See https://docs.mongodb.com/manual/reference/command/listCollections
+type ListCollectionsRequest struct {
+	RequestInfo
+
+	Database string
+
+	// An optional filter for the returned collection list. The filter is
+	// applied to the full collection info documents.
+	Filter bson.M
+
+	// If true, only the collection names and types will be returned.
+	NameOnly bool
+
+	// If true, only list collections that the user is authorized to access.
+	AuthorizedCollections bool
+
+	// The batch size for the returned cursor (0 means no limit).
+	BatchSize int32
+}
+
+// CreateRequest represents a request to explicitly create a collection.
+//
+// See https://docs.mongodb.com/manual/reference/command/create
+type CreateRequest struct {
+	RequestInfo
+
+	Collection NamespacedCollection
+
+	// If true, create a capped collection whose size is bounded by the
+	// Size (in bytes) and (optionally) Max (number of documents) fields.
+	Capped bool
+	Size   int64
+	Max    int64
+
+	// Any other collection options (e.g. validator, collation) that were
+	// specified by the client.
+	Options bson.M
+}
+
+// DropRequest represents a request to drop a collection and its indexes.
+//
+// See https://docs.mongodb.com/manual/reference/command/drop
+type DropRequest struct {
+	RequestInfo
+
+	Collection NamespacedCollection
+}
+
+// DropDatabaseRequest represents a request to drop a database and all its
+// collections.
+//
+// See https://docs.mongodb.com/manual/reference/command/dropDatabase
+type DropDatabaseRequest struct {
+	RequestInfo
+
+	Database string
+}
+
+// RenameCollectionRequest represents a request to rename a collection. The
+// target collection may live in a different database.
+//
+// See https://docs.mongodb.com/manual/reference/command/renameCollection
+type RenameCollectionRequest struct {
+	RequestInfo
+
+	From NamespacedCollection
+	To   NamespacedCollection
+
+	// If true, the target collection will be dropped if it already exists.
+	DropTarget bool
+}
+
+// CollModRequest represents a request to modify the options of an existing
+// collection.
+//
+// See https://docs.mongodb.com/manual/reference/command/collMod
+type CollModRequest struct {
+	RequestInfo
+
+	Collection NamespacedCollection
+
+	// The collection options to modify (e.g. validator, index).
+	Options bson.M
+}
@@ -0,0 +1,100 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// IndexSpec describes an index on a collection.
+type IndexSpec struct {
+	// The index name. If not specified by the client, a name is generated
+	// from the key pattern (e.g. "a_1_b_-1").
+	Name string
+
+	// The ordered list of indexed fields. Values are either 1 or -1 for
+	// ascending and descending indexes or a string for special index types
+	// (e.g. "hashed", "text", "2dsphere").
+	Key bson.D
+
+	// If true, the index rejects documents with duplicate key values.
+	Unique bool
+
+	// If true, the index only references documents that contain the
+	// indexed fields.
+	Sparse bool
+
+	// If specified, the index only references documents that match this
+	// filter expression.
+	PartialFilterExpression bson.M
+
+	// If specified, documents are automatically removed once the value of
+	// the indexed date field is older than this number of seconds.
+	ExpireAfterSeconds *int64
+
+	// Any other index options (e.g. collation, hidden) specified by the client.
+	Options bson.M
+}
+
+// KeyFields returns the list of field paths referenced by the index key.
+func (s IndexSpec) KeyFields() []string {
+	fields := make([]string, len(s.Key))
+	for i, elem := range s.Key {
+		fields[i] = elem.Name
+	}
+	return fields
+}
+
+// DefaultIndexName generates the name that mongod assigns to an index when
+// the client does not explicitly provide one.
+func DefaultIndexName(key bson.D) string {
+	tokens := make([]string, 0, len(key)*2)
+	for _, elem := range key {
+		tokens = append(tokens, elem.Name, fmt.Sprint(elem.Value))
+	}
+	return strings.Join(tokens, "_")
+}
+
+// CreateIndexesRequest represents a request to build one or more indexes on
+// a collection. The collection is implicitly created if it does not exist.
+//
+// See https://docs.mongodb.com/manual/reference/command/createIndexes
+type CreateIndexesRequest struct {
+	RequestInfo
+
+	Collection NamespacedCollection
+	Indexes    []IndexSpec
+}
+
+// ListIndexesRequest represents a request to list the indexes of a
+// collection. The reply is always returned as a cursor.
+//
+// See https://docs.mongodb.com/manual/reference/command/listIndexes
+type ListIndexesRequest struct {
+	RequestInfo
+
+	Collection NamespacedCollection
+
+	// The batch size for the returned cursor (0 means no limit).
+	BatchSize int32
+}
+
+// DropIndexesRequest represents a request to drop one or more indexes from a
+// collection. Indexes can be specified either by name or by key pattern.
+//
+// See https://docs.mongodb.com/manual/reference/command/dropIndexes
+type DropIndexesRequest struct {
+	RequestInfo
+
+	Collection NamespacedCollection
+
+	// If true, drop all indexes except the one on _id.
+	DropAll bool
+
+	// The names of the indexes to drop.
+	Names []string
+
+	// The key pattern of the index to drop.
+	KeyPattern bson.D
+}
@@ -0,0 +1,14 @@
+package protocol
+
+import "gopkg.in/mgo.v2/bson"
+
+// ReplSetInitiateRequest represents a request to initiate a replica set.
+//
+// See https://docs.mongodb.com/manual/reference/command/replSetInitiate
+type ReplSetInitiateRequest struct {
+	RequestInfo
+
+	// The replica set configuration or nil if the server should generate
+	// a default configuration.
+	Config bson.M
+}
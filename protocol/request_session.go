@@ -0,0 +1,87 @@
+package protocol
+
+import (
+	"encoding/hex"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// LogicalSessionID identifies a logical session. Clients attach it to the
+// commands they run within a session via the lsid argument.
+//
+// See https://docs.mongodb.com/manual/reference/server-sessions
+type LogicalSessionID struct {
+	// A UUID (binary subtype 4) generated by the client or the server.
+	ID bson.Binary
+}
+
+// String returns the hex-encoded session UUID.
+func (id LogicalSessionID) String() string { return hex.EncodeToString(id.ID.Data) }
+
+// Document returns the lsid document for the session.
+func (id LogicalSessionID) Document() bson.D {
+	return bson.D{{Name: "id", Value: id.ID}}
+}
+
+// TxnInfo describes the transaction arguments that clients attach to the
+// commands they run within a session.
+//
+// See https://github.com/mongodb/specifications/blob/master/source/transactions/transactions.rst
+type TxnInfo struct {
+	// The transaction number (txnNumber) or nil if not specified. It is
+	// attached to the commands of multi-document transactions and to
+	// retryable writes.
+	Number *int64
+
+	// True if the command is the first command of a transaction.
+	StartTransaction bool
+
+	// The value of the autocommit argument or nil if not specified.
+	// Commands within a multi-document transaction set it to false.
+	Autocommit *bool
+}
+
+// InTransaction returns true if the arguments mark a command as part of a
+// multi-document transaction.
+func (t TxnInfo) InTransaction() bool { return t.Autocommit != nil && !*t.Autocommit }
+
+// CausalInfo describes the causal consistency arguments that clients attach to
+// the commands they run within a causally consistent session.
+//
+// See https://github.com/mongodb/specifications/blob/master/source/causal-consistency/causal-consistency.rst
+type CausalInfo struct {
+	// The most recent cluster time ($clusterTime) known to the client or
+	// nil if not specified.
+	ClusterTime *bson.MongoTimestamp
+
+	// The readConcern.afterClusterTime argument or nil if not specified.
+	// Reads must observe all writes up to this cluster time.
+	AfterClusterTime *bson.MongoTimestamp
+}
+
+// StartSessionRequest represents a request to start a new logical session.
+//
+// See https://docs.mongodb.com/manual/reference/command/startSession
+type StartSessionRequest struct {
+	RequestInfo
+}
+
+// SessionsRequest represents a request that operates on a list of logical
+// sessions (endSessions, refreshSessions or killSessions).
+//
+// See https://docs.mongodb.com/manual/reference/command/nav-sessions
+type SessionsRequest struct {
+	RequestInfo
+
+	// The list of sessions to operate on. An empty killSessions list
+	// targets all sessions.
+	Sessions []LogicalSessionID
+}
+
+// TransactionRequest represents a request to commit or abort the transaction
+// that is specified by the session and transaction arguments of the request.
+//
+// See https://docs.mongodb.com/manual/reference/command/commitTransaction
+type TransactionRequest struct {
+	RequestInfo
+}